@@ -0,0 +1,172 @@
+//  Access Control
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the RoleType role whose users see every ECAL row when AdminRoles isn't set
+const defaultAdminRole = "Admin"
+
+// how long whether a user is an admin is remembered.  Kept short so a role change in the app takes effect quickly.
+const accessCacheTTL = 5 * time.Minute
+
+// accessScope is the ECAL rows a request may see: all of them, or only those on the accounts assigned to userEmail
+// or to someone in userEmail's management hierarchy
+type accessScope struct {
+	all       bool
+	userEmail string
+}
+
+// allAccess is the scope of the service's own work (e.g. cache warming) and of UnrestrictedClients
+var allAccess = accessScope{all: true}
+
+// accessCacheEntry is whether a user was an admin of an instance-environment when last looked up
+type accessCacheEntry struct {
+	admin  bool
+	loaded time.Time
+}
+
+// accessCache is keyed by instanceEnv|userEmail and guarded by accessCacheLock
+var accessCache = make(map[string]accessCacheEntry)
+var accessCacheLock sync.RWMutex
+
+//
+// Returns the scope of a request to an ECAL query endpoint from its basic auth client and userEmail parameter, reading
+// the user's role from db.  The isAdmin parameter isn't trusted; see resolveAccess.
+//
+func requestAccess(r *http.Request, db QueryRunner, instanceEnv string) (accessScope, error) {
+	client, _, _ := r.BasicAuth()
+	return resolveAccess(r.Context(), db, client, instanceEnv, r.URL.Query().Get("userEmail"))
+}
+
+//
+// Decides what a caller may see.  A user whose role in the instance-environment's User1 table is one of AdminRoles
+// sees everything; anyone else sees their hierarchy.  userEmail is required unless the client is one of
+// UnrestrictedClients (integrations that need every row), in which case leaving it out gives unrestricted access.
+// The service can't check userEmail itself, so it is only taken from TrustedUserClients, the front ends that sign
+// their users in; any other client sending it is refused rather than trusted with whoever it names.
+//
+func resolveAccess(ctx context.Context, db QueryRunner, client string, instanceEnv string, userEmail string) (accessScope, error) {
+	userEmail = strings.ToLower(strings.TrimSpace(userEmail))
+	if len(userEmail) < 1 {
+		if unrestrictedClient(client) {
+			return allAccess, nil
+		}
+		return accessScope{}, inputError("userEmail query parameter is required")
+	}
+	if !trustedUserClient(client) {
+		return accessScope{}, inputError("userEmail is only accepted from the clients in TrustedUserClients")
+	}
+	admin, err := isAppAdmin(ctx, db, instanceEnv, userEmail)
+	if err != nil {
+		return accessScope{}, err
+	}
+	if admin {
+		return allAccess, nil
+	}
+	return accessScope{userEmail: userEmail}, nil
+}
+
+func unrestrictedClient(client string) bool {
+	return len(client) > 0 && configListContains(GlobalConfig.UnrestrictedClients, client)
+}
+
+//
+// True if the client may say which user it is acting for: one of TrustedUserClients or, when that isn't set,
+// ServiceUsername (the VB apps)
+//
+func trustedUserClient(client string) bool {
+	if len(client) < 1 {
+		return false
+	}
+	if len(GlobalConfig.TrustedUserClients) < 1 {
+		return client == GlobalConfig.ServiceUsername
+	}
+	return configListContains(GlobalConfig.TrustedUserClients, client)
+}
+
+//
+// True if the user's role in an ECAL instance-environment's User1 table in db is one of AdminRoles (default Admin).
+// Only ECAL instance-environments have admins; anything else returns false.
+//
+func isAppAdmin(ctx context.Context, db QueryRunner, instanceEnv string, userEmail string) (bool, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		return false, nil
+	}
+	key := instanceEnv + "|" + userEmail
+	accessCacheLock.RLock()
+	entry, ok := accessCache[key]
+	accessCacheLock.RUnlock()
+	if ok && time.Since(entry.loaded) < accessCacheTTL {
+		return entry.admin, nil
+	}
+
+	roles := GlobalConfig.AdminRoles
+	if len(roles) < 1 {
+		roles = []string{defaultAdminRole}
+	}
+	args := []interface{}{userEmail}
+	binds := []string{}
+	for _, role := range roles {
+		args = append(args, role)
+		binds = append(binds, fmt.Sprintf(":%d", len(args)))
+	}
+
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+schema+".User1 u INNER JOIN "+schema+".RoleType r ON r.id = u.rolename "+
+		"WHERE LOWER(u.useremail) = :1 AND r.rolename IN ("+strings.Join(binds, ", ")+")", args...).Scan(&count)
+	if err != nil {
+		thisError := fmt.Sprintf("Error reading the role of %s (%s): %s", userEmail, instanceEnv, err.Error())
+		return false, errors.New(thisError)
+	}
+
+	accessCacheLock.Lock()
+	accessCache[key] = accessCacheEntry{admin: count > 0, loaded: time.Now()}
+	accessCacheLock.Unlock()
+	return count > 0, nil
+}
+
+//
+// Returns a condition limiting accountColumn to the accounts the scope may see, with :bind standing for the user's
+// email (%SCHEMA% is left for the caller to replace), and the value to bind.  The email is matched ignoring case, as
+// resolveAccess lowercases it.  Both are empty for a scope that sees everything.
+//
+func (scope accessScope) accountCondition(accountColumn string, bind int) (string, []interface{}) {
+	if scope.all {
+		return "", nil
+	}
+	condition := fmt.Sprintf(`%s IN
+		(
+		SELECT ua.account
+		FROM %%SCHEMA%%.UserAccount ua
+		INNER JOIN %%SCHEMA%%.User1 u ON ua.user1 = u.id
+		WHERE LOWER(u.useremail) = :%d OR u.manager in
+			(
+			SELECT c.reportemail
+			FROM %%SCHEMA%%.ManagerClosure c
+			WHERE LOWER(c.manageremail) = :%d
+			)
+		)`, accountColumn, bind, bind)
+	return condition, []interface{}{scope.userEmail}
+}
+
+//
+// Describes the scope for error messages and logs
+//
+func (scope accessScope) String() string {
+	if scope.all {
+		return "all"
+	}
+	return scope.userEmail
+}
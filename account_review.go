@@ -0,0 +1,238 @@
+//  Account Review
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the review states of an ECAL account flagged by an account load
+const (
+	reviewOpen     = "OPEN"
+	reviewResolved = "RESOLVED"
+)
+
+// the reason recorded for an ECAL account whose CIM account moved to another parent
+const reviewCimParentChanged = "CIM_PARENT_CHANGED"
+
+// AccountReview is an ECAL account flagged for review because its CIM account changed upstream
+type AccountReview struct {
+	ID           int64  `json:"id"`
+	AccountID    int64  `json:"account_id"`
+	AccountName  string `json:"account_name"`
+	CimID        string `json:"cim_id"`
+	OldParentID  string `json:"old_cim_parent_id"`
+	NewParentID  string `json:"new_cim_parent_id"`
+	Reason       string `json:"reason"`
+	Status       string `json:"status"`
+	Flagged      string `json:"flagged"`
+	Resolved     string `json:"resolved"`
+	ResolvedBy   string `json:"resolved_by"`
+	ResolvedNote string `json:"resolution"`
+}
+
+// cimParentChange is a CIM account the feed puts under a different parent than LookupAccount has
+type cimParentChange struct {
+	cimID     string
+	oldParent string
+	newParent string
+}
+
+// errAccountReviewNotFound is returned when resolving a review that doesn't exist or is already resolved
+var errAccountReviewNotFound = errors.New("account review not found")
+
+//
+// Returns the CIM parent of each active account in LookupAccount that has one
+//
+func readCimParents(tx *sql.Tx, schema string) (map[string]string, error) {
+	rows, err := tx.Query("SELECT cimid, cimparentid FROM " + schema + ".LookupAccount WHERE active = 1 AND cimparentid IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	parents := make(map[string]string)
+	for rows.Next() {
+		var cimID, parent sql.NullString
+		err = rows.Scan(&cimID, &parent)
+		if err != nil {
+			return nil, err
+		}
+		parents[cimID.String] = parent.String
+	}
+	return parents, rows.Err()
+}
+
+//
+// Flags the ECAL accounts on each CIM account whose parent changed for review, in the load's transaction.  An
+// account that already has an open review for the same new parent isn't flagged again.  Returns the number of
+// accounts flagged.
+//
+func flagCimParentChanges(tx *sql.Tx, schema string, changes []cimParentChange) (int64, error) {
+	if len(changes) < 1 {
+		return 0, nil
+	}
+	stmt, err := tx.Prepare(`INSERT INTO CTO_COMMON.ACCOUNT_REVIEW
+			(schema_name, account_id, cim_id, old_cim_parent_id, new_cim_parent_id, reason, status, flagged)
+		SELECT :1, a.id, a.cimid, :2, :3, :4, :5, SYSTIMESTAMP FROM ` + schema + `.Account a
+		WHERE TRIM(a.cimid) = :6 AND NOT EXISTS (SELECT 1 FROM CTO_COMMON.ACCOUNT_REVIEW r
+			WHERE r.schema_name = :1 AND r.account_id = a.id AND r.status = :5 AND r.reason = :4 AND NVL(r.new_cim_parent_id, ' ') = NVL(:3, ' '))`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var flagged int64
+	for _, change := range changes {
+		result, err := stmt.Exec(schema, change.oldParent, change.newParent, reviewCimParentChanged, reviewOpen, change.cimID)
+		if err != nil {
+			thisError := fmt.Sprintf("Error flagging accounts on CIM %s for review: %s", change.cimID, err.Error())
+			return flagged, errors.New(thisError)
+		}
+		count, _ := result.RowsAffected()
+		flagged += count
+	}
+	return flagged, nil
+}
+
+//
+// HTTP handler for account reviews.  GET lists the ECAL accounts of an instance-environment flagged for review
+// (status=open by default, resolved or all); POST with id and resolvedBy (and optionally a resolution note) marks a
+// review as resolved once the account has been checked.
+//
+func accountReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "instanceEnvironment query parameter is invalid")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		status := strings.ToUpper(query.Get("status"))
+		if len(status) < 1 {
+			status = reviewOpen
+		}
+		if status != reviewOpen && status != reviewResolved && status != "ALL" {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "status must be open, resolved or all")
+			return
+		}
+		reviews, err := getAccountReviews(r.Context(), schema, status)
+		if queryCancelled(r.Context(), "account_review", err) {
+			return
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+			logRequest(r, logError, "account_review", err.Error())
+			return
+		}
+		result, _ := json.Marshal(map[string]interface{}{"items": reviews})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(result)
+
+	case http.MethodPost:
+		id, err := strconv.ParseInt(query.Get("id"), 10, 64)
+		resolvedBy := strings.ToLower(strings.TrimSpace(query.Get("resolvedBy")))
+		if err != nil || !authorPattern.MatchString(resolvedBy) {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "id and a valid resolvedBy email are required")
+			return
+		}
+		err = resolveAccountReview(schema, id, resolvedBy, sanitizeText(query.Get("resolution"), 1000))
+		if err == errAccountReviewNotFound {
+			w.WriteHeader(404)
+			fmt.Fprintf(w, "Open account review %d not found", id)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+			logRequest(r, logError, "account_review", err.Error())
+			return
+		}
+		logRequest(r, logInfo, "account_review", fmt.Sprintf("Account review %d resolved by %s in %s", id, resolvedBy, instanceEnv))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "{\"id\": %d, \"status\": \"%s\"}", id, reviewResolved)
+
+	default:
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+	}
+}
+
+//
+// Returns the reviews of a schema with the given status (or ALL), newest first
+//
+func getAccountReviews(ctx context.Context, schema string, status string) ([]AccountReview, error) {
+	rows, err := DBPool.QueryContext(ctx, `SELECT r.id, r.account_id, NVL(a.accountname, ' '), NVL(r.cim_id, ' '),
+			NVL(r.old_cim_parent_id, ' '), NVL(r.new_cim_parent_id, ' '), r.reason, r.status, r.flagged, r.resolved,
+			NVL(r.resolved_by, ' '), NVL(r.resolution, ' ')
+		FROM CTO_COMMON.ACCOUNT_REVIEW r
+		LEFT OUTER JOIN `+schema+`.Account a ON a.id = r.account_id
+		WHERE r.schema_name = :1 AND (:2 = 'ALL' OR r.status = :2)
+		ORDER BY r.flagged DESC, r.id DESC`, schema, status)
+	if err != nil {
+		thisError := fmt.Sprintf("Error querying account reviews (%s): %s", schema, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	reviews := []AccountReview{}
+	for rows.Next() {
+		var review AccountReview
+		var flagged time.Time
+		var resolved sql.NullTime
+		err = rows.Scan(&review.ID, &review.AccountID, &review.AccountName, &review.CimID, &review.OldParentID,
+			&review.NewParentID, &review.Reason, &review.Status, &flagged, &resolved, &review.ResolvedBy, &review.ResolvedNote)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning account reviews (%s): %s", schema, err.Error())
+			return nil, errors.New(thisError)
+		}
+		review.CimID = strings.TrimSpace(review.CimID)
+		review.OldParentID = strings.TrimSpace(review.OldParentID)
+		review.NewParentID = strings.TrimSpace(review.NewParentID)
+		review.ResolvedBy = strings.TrimSpace(review.ResolvedBy)
+		review.ResolvedNote = strings.TrimSpace(review.ResolvedNote)
+		review.Flagged = flagged.In(outputLocation).Format(time.RFC3339)
+		if resolved.Valid {
+			review.Resolved = resolved.Time.In(outputLocation).Format(time.RFC3339)
+		}
+		reviews = append(reviews, review)
+	}
+	if err = rows.Err(); err != nil {
+		thisError := fmt.Sprintf("Error querying account reviews (%s): %s", schema, err.Error())
+		return nil, errors.New(thisError)
+	}
+	return reviews, nil
+}
+
+//
+// Marks an open review as resolved
+//
+func resolveAccountReview(schema string, id int64, resolvedBy string, resolution string) error {
+	result, err := DBPool.Exec("UPDATE CTO_COMMON.ACCOUNT_REVIEW SET status = :1, resolved = SYSTIMESTAMP, resolved_by = :2, resolution = :3 "+
+		"WHERE id = :4 AND schema_name = :5 AND status = :6", reviewResolved, resolvedBy, resolution, id, schema, reviewOpen)
+	if err != nil {
+		thisError := fmt.Sprintf("Error resolving account review %d (%s): %s", id, schema, err.Error())
+		return errors.New(thisError)
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return errAccountReviewNotFound
+	}
+	return nil
+}
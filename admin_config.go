@@ -0,0 +1,75 @@
+//  Configuration Diagnostics
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// what a secret config entry is shown as when it is set
+const redactedConfigValue = "*******"
+
+//
+// HTTP handler for the admin/config functionality.  Returns the configuration this instance is running with: every
+// config.json entry (secrets redacted), where it was read from, the current schema map (including schemas provisioned
+// since startup) and the time zones in effect.
+//
+func adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+
+	source := "config.json"
+	if uri := os.Getenv("CONFIG_URI"); len(uri) > 0 {
+		source = uri
+	}
+	result, _ := json.Marshal(map[string]interface{}{
+		"source":           source,
+		"config":           redactedConfig(GlobalConfig),
+		"schema_map":       schemaMapSnapshot(),
+		"db_connection":    describeDBConnection(GlobalConfig),
+		"db_time_zone":     dbLocation.String(),
+		"output_time_zone": outputLocation.String(),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+//
+// Returns the config entries by name with the secrets replaced by redactedConfigValue.  An entry is secret if its
+// name ends in Password or Secret, if its field is tagged vault (e.g. ServiceClients, which is client:password pairs)
+// or if its value was read from a secret store.  Credentials embedded in URLs are removed as well.  Empty entries stay
+// empty so it is clear they aren't set; entries that aren't strings are shown as their typed values.
+//
+func redactedConfig(config Config) map[string]interface{} {
+	entries := make(map[string]interface{})
+	v := reflect.ValueOf(config)
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		if v.Field(i).Kind() != reflect.String {
+			entries[name] = v.Field(i).Interface()
+			continue
+		}
+		value := v.Field(i).String()
+		secret := strings.HasSuffix(name, "Password") || strings.HasSuffix(name, "Secret") ||
+			len(v.Type().Field(i).Tag.Get(vaultTag)) > 0 || vaultedConfigEntries[name]
+		if secret && len(value) > 0 {
+			value = redactedConfigValue
+		} else if parsed, err := url.Parse(value); err == nil && parsed.User != nil {
+			parsed.User = url.User(redactedConfigValue)
+			value = parsed.String()
+		}
+		entries[name] = value
+	}
+	return entries
+}
@@ -0,0 +1,172 @@
+//  Analytics Dataset Publishing
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// prefix of the SYNC_METADATA data type each dataset publish is reported under (e.g. oac:ecal_pipeline)
+const analyticsDataType = "oac:"
+
+// how long producing and uploading a single dataset may take
+const analyticsPublishTimeout = 10 * time.Minute
+
+// analyticsDataset is a flat CSV extract that Oracle Analytics Cloud reads from the AnalyticsBucket.  app is the
+// prefix of the instance-environments it applies to (ecal or sts) and query may use %SCHEMA% and %FISCAL_QUARTER%
+// (the fiscal quarter of a DATE column, e.g. %FISCAL_QUARTER%(l.anticipatedclosedate)).
+type analyticsDataset struct {
+	name  string
+	app   string
+	query string
+}
+
+var analyticsDatasets = []analyticsDataset{
+	{name: "ecal_pipeline", app: "ecal", query: `SELECT l.opportunityid AS opportunity_id, l.revenuelineid AS revenue_line_id,
+			NVL(l.l2territoryname, 'Unassigned') AS l2_territory, NVL(l.l3territoryname, 'Unassigned') AS l3_territory,
+			TO_CHAR(l.anticipatedclosedate, 'YYYY-MM-DD') AS close_date, %FISCAL_QUARTER%(l.anticipatedclosedate) AS fiscal_quarter,
+			NVL(l.revenuepipelinek, 0) AS arr_k, NVL(l.revenuetcvk, 0) AS tcv_k, NVL(l.workloadamount, 0) AS workload_amount,
+			CASE WHEN w.id IS NULL THEN 0 ELSE 1 END AS ecal_tracked
+		FROM %SCHEMA%.LookupOpportunity l
+		LEFT OUTER JOIN %SCHEMA%.Opportunity o ON o.opportunityid = l.opportunityid
+		LEFT OUTER JOIN %SCHEMA%.OpportunityWorkload w ON w.opportunity = o.id AND w.workloadidentifier = l.revenuelineid
+		WHERE l.active = 1 AND l.opportunitystatus = 'Open'`},
+	{name: "ecal_workloads", app: "ecal", query: ecalColorFunction + `
+		SELECT o.opportunityid AS opportunity_id, a.accountname AS account_name, a.cimid AS cim_id, o.summary AS summary,
+			` + ecalColorColumn + ` AS color,
+			NVL((SELECT stage FROM %SCHEMA%.EcalStage WHERE id = o.lateststagedone), 'None') AS latest_stage,
+			o.technicallead AS technical_lead,
+			(SELECT TO_CHAR(MAX(os.creationdate), 'YYYY-MM-DD') FROM %SCHEMA%.OpportunityStatus os WHERE os.opportunity = o.id) AS latest_status_date
+		FROM %SCHEMA%.Opportunity o
+		INNER JOIN %SCHEMA%.Account a ON o.account = a.id
+		LEFT OUTER JOIN %SCHEMA%.OpportunityTechHealth th ON th.opportunity = o.id`},
+	{name: "ecal_consumption", app: "ecal", query: `SELECT c.cimid AS cim_id, c.customername AS customer_name,
+			c.subscriptionid AS subscription_id, TO_CHAR(c.usagemonth, 'YYYY-MM') AS usage_month,
+			%FISCAL_QUARTER%(c.usagemonth) AS fiscal_quarter, c.actualusage AS actual_usage, c.currencycode AS currency_code
+		FROM %SCHEMA%.LookupConsumption c`},
+	{name: "sts_path_progress", app: "sts", query: `SELECT su.useremail AS se_email, su.firstname || ' ' || su.lastname AS se_name,
+			su.manager AS manager_email, su.rolename AS role, p.pathname AS path,
+			(SELECT COUNT(*) FROM %SCHEMA%.STSAPathReq pr WHERE pr.pathname = su.path) AS total_tasks,
+			(SELECT COUNT(*) FROM %SCHEMA%.STSAUserStatus stat INNER JOIN %SCHEMA%.STSAPathReq pr ON pr.taskname = stat.taskname AND pr.pathname = su.path
+				WHERE stat.useremail = su.id AND stat.taskstatus = 2) AS tasks_completed,
+			(SELECT COUNT(*) FROM %SCHEMA%.STSAUserStatus stat INNER JOIN %SCHEMA%.STSAPathReq pr ON pr.taskname = stat.taskname AND pr.pathname = su.path
+				WHERE stat.useremail = su.id AND stat.taskstatus = 3) AS tasks_validated,
+			(SELECT TO_CHAR(MAX(stat.lastupdatedate), 'YYYY-MM-DD') FROM %SCHEMA%.STSAUserStatus stat WHERE stat.useremail = su.id) AS last_activity
+		FROM %SCHEMA%.STSUser su
+		INNER JOIN %SCHEMA%.STSPath p ON su.path = p.id`},
+}
+
+//
+// Writes each dataset of the instance-environment's app to AnalyticsBucket as oac/{instance-env}/{dataset}.csv,
+// replacing the previous copy so OAC datasets built over those objects pick up the new data on their next refresh.
+// Each dataset is published on its own so one failing doesn't hold up the others and is reported in /syncStatus
+// under the data type oac:DATASET.  Returns the names of the datasets published.  Does nothing when AnalyticsBucket
+// isn't set.
+//
+func publishAnalyticsDatasets(job *loadJob, instanceEnv string) []string {
+	published := []string{}
+	schema := lookupSchema(instanceEnv)
+	if len(GlobalConfig.AnalyticsBucket) < 1 || len(schema) < 1 {
+		return published
+	}
+
+	replacer := strings.NewReplacer("%SCHEMA%", schema)
+	for _, dataset := range analyticsDatasets {
+		if !strings.HasPrefix(instanceEnv, dataset.app+"-") {
+			continue
+		}
+		run := beginSyncRun(job, "analytics_publish", analyticsDataType+dataset.name, schema, "")
+		start := time.Now()
+		err := publishAnalyticsDataset(instanceEnv, dataset, replacer)
+		if err != nil {
+			run.fail(fmt.Sprintf("Error publishing dataset %s (%s): %s", dataset.name, instanceEnv, err.Error()))
+			continue
+		}
+		run.complete(0, 0)
+		published = append(published, dataset.name)
+		message := fmt.Sprintf("Published dataset %s (%s) in %s", dataset.name, instanceEnv, time.Since(start).Round(time.Millisecond))
+		logOutput(logInfo, "analytics_publish", message)
+	}
+	return published
+}
+
+func publishAnalyticsDataset(instanceEnv string, dataset analyticsDataset, replacer *strings.Replacer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), analyticsPublishTimeout)
+	defer cancel()
+
+	query := replacer.Replace(dataset.query)
+	for strings.Contains(query, "%FISCAL_QUARTER%(") {
+		start := strings.Index(query, "%FISCAL_QUARTER%(")
+		end := strings.Index(query[start:], ")")
+		column := query[start+len("%FISCAL_QUARTER%(") : start+end]
+		query = query[:start] + "(" + fiscalQuarterSQL(column) + ")" + query[start+end+1:]
+	}
+
+	body, err := queryCSV(ctx, query)
+	if err != nil {
+		return err
+	}
+	object := objectLocation{Namespace: GlobalConfig.ArtifactNamespace, Bucket: GlobalConfig.AnalyticsBucket,
+		Object: "oac/" + safeKeySegment(instanceEnv) + "/" + dataset.name + ".csv"}
+	return putObject(ctx, object, "text/csv", body)
+}
+
+//
+// Publishes the datasets of every STS instance-environment.  The STS users and their managers come from the
+// identity feed so this runs after each identity load.
+//
+func publishSTSAnalyticsDatasets() {
+	for _, instanceEnv := range GlobalConfig.InstanceEnvironments {
+		if strings.HasPrefix(instanceEnv, "sts-") {
+			publishAnalyticsDatasets(nil, instanceEnv)
+		}
+	}
+}
+
+//
+// HTTP handler for admin/publishAnalytics.  Publishes the instance-environment's datasets right away, e.g. after
+// edits made in the app that OAC should see before the next load.
+//
+func publishAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+	instanceEnv := r.URL.Query().Get("instanceEnvironment")
+	if len(lookupSchema(instanceEnv)) < 1 {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "instanceEnvironment query parameter is invalid")
+		return
+	}
+	if len(GlobalConfig.AnalyticsBucket) < 1 {
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "Analytics publishing is not configured")
+		return
+	}
+
+	published := publishAnalyticsDatasets(nil, instanceEnv)
+	expected := 0
+	for _, dataset := range analyticsDatasets {
+		if strings.HasPrefix(instanceEnv, dataset.app+"-") {
+			expected++
+		}
+	}
+	if len(published) < expected {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "analytics_publish", fmt.Sprintf("Published %d of %d datasets for %s; see syncStatus", len(published), expected, instanceEnv))
+		return
+	}
+
+	result, _ := json.Marshal(map[string][]string{"published": published})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
@@ -0,0 +1,163 @@
+//  Asynchronous Jobs
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// job states
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobCompleted = "completed"
+	jobFailed    = "failed"
+)
+
+// how many jobs (exports and queries together) run at once; the rest wait their turn so a burst of requests can't
+// starve the dashboards
+const maxConcurrentJobs = 2
+
+// errJobNotFound is returned for an unknown or expired job id
+var errJobNotFound = errors.New("job not found")
+
+// errShuttingDown is returned when a job is submitted after shutdown has started
+var errShuttingDown = errors.New("the service is shutting down")
+
+// asyncJob is the state every background job reports.  Jobs embed it and add their own fields.
+type asyncJob struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	Submitted string `json:"submitted"`
+	Finished  string `json:"finished,omitempty"`
+	Error     string `json:"error,omitempty"`
+
+	expires time.Time
+}
+
+func (j *asyncJob) job() *asyncJob {
+	return j
+}
+
+// asyncTask is any job embedding asyncJob
+type asyncTask interface {
+	job() *asyncJob
+}
+
+// asyncJobs is keyed by job id and guarded by asyncJobsLock, which also guards the fields of every job
+var asyncJobs = make(map[string]asyncTask)
+var asyncJobsLock sync.Mutex
+
+// asyncJobSlots holds one token per running job
+var asyncJobSlots = make(chan struct{}, maxConcurrentJobs)
+
+//
+// Returns a new queued job with a random id that can be looked up for retention after it is registered
+//
+func newAsyncJob(retention time.Duration) (asyncJob, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return asyncJob{}, err
+	}
+	now := time.Now()
+	return asyncJob{ID: hex.EncodeToString(id), Status: jobQueued, Submitted: now.In(outputLocation).Format(time.RFC3339),
+		expires: now.Add(retention)}, nil
+}
+
+//
+// Makes a job visible to lookupAsyncJob, dropping any jobs that have expired
+//
+func registerAsyncJob(task asyncTask) {
+	asyncJobsLock.Lock()
+	defer asyncJobsLock.Unlock()
+	for id, old := range asyncJobs {
+		if time.Now().After(old.job().expires) {
+			delete(asyncJobs, id)
+		}
+	}
+	asyncJobs[task.job().ID] = task
+}
+
+//
+// Returns a registered job; read its fields inside updateAsyncJob
+//
+func lookupAsyncJob(id string) (asyncTask, error) {
+	asyncJobsLock.Lock()
+	defer asyncJobsLock.Unlock()
+	task, ok := asyncJobs[id]
+	if !ok || time.Now().After(task.job().expires) {
+		return nil, errJobNotFound
+	}
+	return task, nil
+}
+
+//
+// Runs update while holding the lock that guards the fields of every job
+//
+func updateAsyncJob(update func()) {
+	asyncJobsLock.Lock()
+	defer asyncJobsLock.Unlock()
+	update()
+}
+
+//
+// Registers a job and runs it in the background (see runAsyncJob), tracked so shutdown waits for it.  Returns
+// errShuttingDown, without registering the job, once shutdown has started.
+//
+func startAsyncJob(module string, task asyncTask, timeout time.Duration, work func(ctx context.Context) error) error {
+	if !trackBackground(module) {
+		return errShuttingDown
+	}
+	registerAsyncJob(task)
+	go func() {
+		defer untrackBackground(module)
+		runAsyncJob(module, task, timeout, work)
+	}()
+	return nil
+}
+
+//
+// Runs a job's work once a slot is free and records the outcome.  A failed job reports the message of an inputError
+// but only a generic message for anything else; the details are logged under module.
+//
+func runAsyncJob(module string, task asyncTask, timeout time.Duration, work func(ctx context.Context) error) {
+	asyncJobSlots <- struct{}{}
+	defer func() { <-asyncJobSlots }()
+
+	// a job still waiting for a slot when shutdown starts isn't begun, so shutdown only waits for the running ones
+	job := task.job()
+	if shuttingDown() {
+		message := "The service shut down before the job ran; please submit it again"
+		finished := time.Now().In(outputLocation).Format(time.RFC3339)
+		updateAsyncJob(func() { job.Status, job.Error, job.Finished = jobFailed, message, finished })
+		logOutput(logWarn, module, fmt.Sprintf("Job %s not run, the service is shutting down", job.ID))
+		return
+	}
+	updateAsyncJob(func() { job.Status = jobRunning })
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+
+	err := work(ctx)
+	finished := time.Now().In(outputLocation).Format(time.RFC3339)
+	if err != nil {
+		message := "Error in input parameters or processing; please contact your service administrator"
+		if inputErr, ok := err.(inputError); ok {
+			message = inputErr.Error()
+		}
+		updateAsyncJob(func() { job.Status, job.Error, job.Finished = jobFailed, message, finished })
+		logOutput(logError, module, fmt.Sprintf("Job %s failed: %s", job.ID, err.Error()))
+		return
+	}
+	updateAsyncJob(func() { job.Status, job.Finished = jobCompleted, finished })
+	logOutput(logInfo, module, fmt.Sprintf("Job %s completed in %s", job.ID, time.Since(start).Round(time.Millisecond)))
+}
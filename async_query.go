@@ -0,0 +1,257 @@
+//  Asynchronous Queries
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// how long a single query may run
+const asyncQueryTimeout = 30 * time.Minute
+
+// how long a query's status and result can be fetched.  Results are held in memory so this is kept short.
+const asyncQueryRetention = time.Hour
+
+// QueryJob is the state of a submitted query, as returned by GET /queries/{id}
+type QueryJob struct {
+	asyncJob
+	Query      string            `json:"query"`
+	Parameters map[string]string `json:"parameters"`
+	Bytes      int               `json:"bytes"`
+
+	result []byte
+}
+
+// namedQuery returns the JSON result of a query for the parameters of the endpoint of the same name.  Queries over
+// ECAL rows return only those in scope; see accessScopedQuery.
+type namedQuery func(ctx context.Context, scope accessScope, params url.Values) ([]byte, error)
+
+// the queries that can be submitted.  The streamed query endpoints (see exportSources) can be submitted too.
+var namedQueries = map[string]namedQuery{
+	"getPipelineByTerritory": func(ctx context.Context, scope accessScope, p url.Values) ([]byte, error) {
+		return getPipelineByTerritory(ctx, p.Get("instanceEnvironment"), p.Get("l2Territory"))
+	},
+	"getQuarterlyRollup": func(ctx context.Context, scope accessScope, p url.Values) ([]byte, error) {
+		return getQuarterlyRollup(ctx, p.Get("instanceEnvironment"), scope, p.Get("managerEmail"), p.Get("fiscalYear"))
+	},
+	"getForecast": func(ctx context.Context, scope accessScope, p url.Values) ([]byte, error) {
+		return getForecast(ctx, p.Get("instanceEnvironment"), scope, p.Get("managerEmail"))
+	},
+	"getWinLoss": func(ctx context.Context, scope accessScope, p url.Values) ([]byte, error) {
+		return getWinLoss(ctx, p.Get("instanceEnvironment"), p.Get("since"))
+	},
+	"getConsumptionVsPlan": func(ctx context.Context, scope accessScope, p url.Values) ([]byte, error) {
+		return getConsumptionVsPlan(ctx, p.Get("instanceEnvironment"), scope, p.Get("accountId"), p.Get("managerEmail"), p.Get("fromMonth"), p.Get("toMonth"))
+	},
+	"getProductCatalog": func(ctx context.Context, scope accessScope, p url.Values) ([]byte, error) {
+		return getProductCatalog(p.Get("instanceEnvironment"), p.Get("level"), map[string]string{
+			"ProductClass":  p.Get("productClass"),
+			"ProductPillar": p.Get("productPillar"),
+			"ProductLine":   p.Get("productLine"),
+		})
+	},
+	"getAccountReport": func(ctx context.Context, scope accessScope, p url.Values) ([]byte, error) {
+		report, err := getAccountReport(ctx, p.Get("instanceEnvironment"), scope, p.Get("accountId"))
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(report)
+	},
+}
+
+//
+// Returns the query of that name, wrapping the streamed query endpoints so they return their whole result
+//
+func lookupNamedQuery(name string) (namedQuery, bool) {
+	if query, ok := namedQueries[name]; ok {
+		return query, true
+	}
+	source, ok := exportSources[name]
+	if !ok {
+		return nil, false
+	}
+	return func(ctx context.Context, scope accessScope, p url.Values) ([]byte, error) {
+		var body bytes.Buffer
+		out := newItemWriter(&body, "{\"items\": [")
+		err := source(ctx, p.Get("instanceEnvironment"), scope, p, out)
+		if err == nil {
+			err = out.finish("], \"truncated\": false}")
+		}
+		return body.Bytes(), err
+	}, true
+}
+
+//
+// True if the query returns ECAL rows and so needs the submitter's scope (see resolveAccess)
+//
+func accessScopedQuery(name string) bool {
+	_, streamed := exportSources[name]
+	switch name {
+	case "getAccountReport", "getConsumptionVsPlan", "getForecast", "getQuarterlyRollup":
+		return true
+	}
+	return streamed
+}
+
+//
+// HTTP handler for queries.  POST /queries submits a query from a {"query": name, "parameters": {...}} body and
+// returns its job (202); GET /queries/{id} returns the job's status and GET /queries/{id}/result its result once
+// it has completed.
+//
+func queriesHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/queries"), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case r.Method == http.MethodPost && path == "":
+		submitQueryHandler(w, r)
+	case r.Method == http.MethodGet && len(parts) == 1 && len(parts[0]) > 0:
+		getQueryStatusHandler(w, r, parts[0])
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[1] == "result":
+		getQueryResultHandler(w, r, parts[0])
+	case len(parts) == 1 || (len(parts) == 2 && parts[1] == "result"):
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func submitQueryHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Query      string            `json:"query"`
+		Parameters map[string]string `json:"parameters"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Unable to parse request body: %s", err.Error())
+		return
+	}
+	query, ok := lookupNamedQuery(request.Query)
+	if !ok {
+		names := []string{}
+		for name := range namedQueries {
+			names = append(names, name)
+		}
+		for name := range exportSources {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "query must be one of %s", strings.Join(names, ", "))
+		return
+	}
+
+	// the rows the submitter may see are decided now, while we know who they are
+	scope := accessScope{}
+	if accessScopedQuery(request.Query) {
+		client, _, _ := r.BasicAuth()
+		scope, err = resolveAccess(r.Context(), DBPool, client, request.Parameters["instanceEnvironment"], request.Parameters["userEmail"])
+		if inputErr, ok := err.(inputError); ok {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", inputErr.Error())
+			return
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+			logRequest(r, logError, "async_query", err.Error())
+			return
+		}
+	}
+
+	base, err := newAsyncJob(asyncQueryRetention)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "async_query", err.Error())
+		return
+	}
+	if request.Parameters == nil {
+		request.Parameters = map[string]string{}
+	}
+	params := url.Values{}
+	for key, value := range request.Parameters {
+		params.Set(key, value)
+	}
+	job := &QueryJob{asyncJob: base, Query: request.Query, Parameters: request.Parameters}
+	err = startAsyncJob("async_query", job, asyncQueryTimeout, func(ctx context.Context) error {
+		result, err := query(ctx, scope, params)
+		if err != nil {
+			return err
+		}
+		updateAsyncJob(func() { job.result, job.Bytes = result, len(result) })
+		return nil
+	})
+	if err == errShuttingDown {
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "The service is shutting down")
+		return
+	}
+	logRequest(r, logInfo, "async_query", fmt.Sprintf("Queued query %s of %s (%s)", job.ID, job.Query, params.Encode()))
+
+	var output []byte
+	updateAsyncJob(func() { output, _ = json.Marshal(job) })
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/queries/"+job.ID)
+	w.WriteHeader(202)
+	w.Write(output)
+}
+
+//
+// Returns a submitted query, or errJobNotFound if the id isn't a query
+//
+func lookupQueryJob(id string) (*QueryJob, error) {
+	task, err := lookupAsyncJob(id)
+	if err != nil {
+		return nil, err
+	}
+	job, ok := task.(*QueryJob)
+	if !ok {
+		return nil, errJobNotFound
+	}
+	return job, nil
+}
+
+func getQueryStatusHandler(w http.ResponseWriter, r *http.Request, id string) {
+	job, err := lookupQueryJob(id)
+	if err != nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Query not found")
+		return
+	}
+	var output []byte
+	updateAsyncJob(func() { output, _ = json.Marshal(job) })
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(output)
+}
+
+func getQueryResultHandler(w http.ResponseWriter, r *http.Request, id string) {
+	job, err := lookupQueryJob(id)
+	if err != nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Query not found")
+		return
+	}
+	var status string
+	var result []byte
+	updateAsyncJob(func() { status, result = job.Status, job.result })
+	if status != jobCompleted {
+		w.WriteHeader(409)
+		fmt.Fprintf(w, "Query is %s", status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
@@ -0,0 +1,30 @@
+//  Audit Trail
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+//
+// Writes a row to CTO_COMMON.AUDIT_LOG describing a change made through this service.  The detail (typically the
+// before and after values) is stored as JSON.  Pass the caller's transaction so the audit record commits or rolls
+// back with the change itself.
+//
+func recordAudit(db QueryRunner, instanceEnv string, entity string, entityID string, action string, actor string, detail interface{}) error {
+	detailJSON, err := json.Marshal(detail)
+	if err != nil {
+		return err
+	}
+	if len(actor) < 1 {
+		actor = "cto_bizlogic_helper"
+	}
+
+	_, err = db.Exec("INSERT INTO CTO_COMMON.AUDIT_LOG (instance_env, entity, entity_id, action, actor, detail, created) "+
+		"VALUES (:1, :2, :3, :4, :5, :6, SYSTIMESTAMP)",
+		instanceEnv, entity, entityID, action, strings.ToLower(actor), string(detailJSON))
+	return err
+}
@@ -0,0 +1,345 @@
+//  Change Capture
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the changes recorded for a row of a lookup table
+const (
+	changeInsert     = "insert"
+	changeUpdate     = "update"
+	changeReactivate = "reactivate"
+	changeClose      = "close"
+	changeVanish     = "vanish"
+)
+
+// how long changes are kept in CTO_COMMON.CHANGE_LOG
+const changeLogRetentionDays = 90
+
+// the LookupOpportunity columns whose changes are reported, in the order opportunityChangeValues returns them
+var opportunityChangeFields = []string{"summary", "salesrep", "anticipatedclosedate", "opportunitystatus", "winprobability",
+	"revenuepipelinek", "revenuetcvk", "revenueprobability", "workloadamount"}
+
+// the names each change type's entity id and sub id are returned under in the key of each change
+var changeKeyNames = map[string][2]string{
+	opportunity: {"opportunity_id", "revenue_line_id"},
+}
+
+// trackedRow is the state of a lookup row before the load
+type trackedRow struct {
+	active bool
+	values []string
+}
+
+// changeTracker compares the rows a load writes with their state before the load and records what changed in
+// CTO_COMMON.CHANGE_LOG within the load's transaction
+type changeTracker struct {
+	entity   string
+	schema   string
+	fields   []string
+	previous map[string]trackedRow
+	seen     map[string]bool
+	stmt     *sql.Stmt
+	counts   map[string]int
+}
+
+// Change is one entry of the /changes feed
+type Change struct {
+	ID      int64             `json:"id"`
+	Type    string            `json:"type"`
+	Key     map[string]string `json:"key"`
+	Change  string            `json:"change"`
+	Fields  []string          `json:"fields,omitempty"`
+	Changed string            `json:"changed"`
+}
+
+//
+// Reads the current state of every LookupOpportunity row in the load's scope and prepares to record the changes made
+// by an opportunity load
+//
+func newOpportunityChangeTracker(tx *sql.Tx, schema string, scope loadScope) (*changeTracker, error) {
+	condition, args := scope.condition(1)
+	rows, err := tx.Query("SELECT opportunityid, revenuelineid, active, summary, salesrep, TO_CHAR(anticipatedclosedate, 'YYYY-MM-DD'), "+
+		"opportunitystatus, TO_CHAR(winprobability), TO_CHAR(revenuepipelinek), TO_CHAR(revenuetcvk), TO_CHAR(revenueprobability), "+
+		"TO_CHAR(workloadamount) FROM "+schema+".LookupOpportunity WHERE "+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	previous := make(map[string]trackedRow)
+	for rows.Next() {
+		var opportunityID, revenueLineID string
+		var active int
+		values := make([]sql.NullString, len(opportunityChangeFields))
+		err := rows.Scan(&opportunityID, &revenueLineID, &active, &values[0], &values[1], &values[2], &values[3], &values[4],
+			&values[5], &values[6], &values[7], &values[8])
+		if err != nil {
+			return nil, err
+		}
+		number := func(value string) float64 {
+			parsed, _ := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			return parsed
+		}
+		previous[opportunityID+"\x00"+revenueLineID] = trackedRow{active: active == 1, values: opportunityChangeValues(
+			values[0].String, values[1].String, values[2].String, values[3].String, number(values[4].String),
+			number(values[5].String), number(values[6].String), number(values[7].String), number(values[8].String))}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO CTO_COMMON.CHANGE_LOG (schema_name, entity, entity_id, entity_sub_id, change_type, fields, changed) " +
+		"VALUES (:1, :2, :3, :4, :5, :6, SYSTIMESTAMP)")
+	if err != nil {
+		return nil, err
+	}
+	return &changeTracker{entity: opportunity, schema: schema, fields: opportunityChangeFields, previous: previous,
+		seen: make(map[string]bool), stmt: stmt, counts: make(map[string]int)}, nil
+}
+
+//
+// Returns the tracked LookupOpportunity values as they are written by the load so they compare equal to the same
+// values read back.  Amounts are rounded to cents.
+//
+func opportunityChangeValues(summary string, salesRep string, closeDate string, status string, winProbability float64,
+	pipeline float64, tcv float64, revenueProbability float64, workloadAmount float64) []string {
+	return []string{summary, salesRep, closeDate, status, changeAmount(winProbability), changeAmount(pipeline), changeAmount(tcv),
+		changeAmount(revenueProbability), changeAmount(workloadAmount)}
+}
+
+//
+// Returns an amount rounded to cents as text, so floating point noise doesn't show up as a change
+//
+func changeAmount(value float64) string {
+	return strconv.FormatFloat(math.Round(value*100)/100, 'f', -1, 64)
+}
+
+//
+// Records the change (if any) to a row written by the load.  active is whether the load left the row active and
+// values are its tracked values (ignored for rows the load closed).  Only the first appearance of a row in the feed
+// is compared.
+//
+func (t *changeTracker) record(id string, subID string, active bool, values []string) error {
+	key := id + "\x00" + subID
+	if t.seen[key] {
+		return nil
+	}
+	t.seen[key] = true
+	before, existed := t.previous[key]
+	delete(t.previous, key)
+
+	change := ""
+	changed := []string{}
+	switch {
+	case !existed && active:
+		change = changeInsert
+	case existed && active && !before.active:
+		change = changeReactivate
+	case existed && active:
+		for i, field := range t.fields {
+			if before.values[i] != values[i] {
+				changed = append(changed, field)
+			}
+		}
+		if len(changed) > 0 {
+			change = changeUpdate
+		}
+	case existed && before.active:
+		change = changeClose
+	}
+	if len(change) < 1 {
+		return nil
+	}
+	return t.write(id, subID, change, changed)
+}
+
+//
+// True if the row was read before the load, i.e. it is within the load's scope
+//
+func (t *changeTracker) tracks(id string, subID string) bool {
+	key := id + "\x00" + subID
+	_, tracked := t.previous[key]
+	return tracked || t.seen[key]
+}
+
+//
+// Records every row that was active before the load but wasn't written by it, i.e. those deactivateVanished has
+// just deactivated
+//
+func (t *changeTracker) recordVanished() error {
+	for key, before := range t.previous {
+		if !before.active {
+			continue
+		}
+		ids := strings.SplitN(key, "\x00", 2)
+		err := t.write(ids[0], ids[1], changeVanish, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *changeTracker) write(id string, subID string, change string, fields []string) error {
+	_, err := t.stmt.Exec(t.schema, t.entity, id, subID, change, strings.Join(fields, ","))
+	if err == nil {
+		t.counts[change]++
+	}
+	return err
+}
+
+//
+// Drops changes older than changeLogRetentionDays and releases the tracker.  Returns a summary of what was recorded
+// for the load's log message.
+//
+func (t *changeTracker) close(tx *sql.Tx) (string, error) {
+	t.stmt.Close()
+	_, err := tx.Exec("DELETE FROM CTO_COMMON.CHANGE_LOG WHERE schema_name = :1 AND entity = :2 AND changed < SYSTIMESTAMP - :3",
+		t.schema, t.entity, changeLogRetentionDays)
+	summary := fmt.Sprintf("%d inserted, %d updated, %d reactivated, %d closed, %d vanished", t.counts[changeInsert],
+		t.counts[changeUpdate], t.counts[changeReactivate], t.counts[changeClose], t.counts[changeVanish])
+	return summary, err
+}
+
+//
+// HTTP handler for changes.  Returns the changes the feeds have made to the lookup rows of type (opportunity) in
+// instanceEnvironment's schema, oldest first, after afterId or since a timestamp.  Pass the returned last_id back as
+// afterId to pick up where the previous call left off.
+//
+func getChangesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	maxRows, err := getMaxRows(query.Get("maxRows"))
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+
+	// a caller limited to their own accounts only sees the changes to those accounts' opportunities
+	scope, err := requestAccess(r, DBPool, query.Get("instanceEnvironment"))
+	if queryCancelled(r.Context(), "change_capture", err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "change_capture", err.Error())
+		return
+	}
+
+	changes, truncated, err := getChanges(r.Context(), query.Get("instanceEnvironment"), scope, query.Get("type"), query.Get("afterId"), query.Get("since"), maxRows)
+	if queryCancelled(r.Context(), "change_capture", err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "change_capture", err.Error())
+		return
+	}
+
+	lastID, _ := strconv.ParseInt(query.Get("afterId"), 10, 64)
+	if len(changes) > 0 {
+		lastID = changes[len(changes)-1].ID
+	}
+	result, _ := json.Marshal(map[string]interface{}{"items": changes, "truncated": truncated, "last_id": lastID})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+//
+// Returns up to maxRows changes of changeType after change afterID, or changed after since.  The bool is true if
+// more were available.  Changes to opportunities outside the caller's scope, including those ECAL doesn't track, are
+// left out.
+//
+func getChanges(ctx context.Context, instanceEnv string, scope accessScope, changeType string, afterID string, since string, maxRows int) ([]Change, bool, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		return nil, false, inputError("instanceEnvironment query parameter is invalid")
+	}
+	if _, ok := changeKeyNames[changeType]; !ok {
+		return nil, false, inputError("type must be " + opportunity)
+	}
+
+	query := "SELECT id, change_type, NVL(fields, ' '), TO_CHAR(SYS_EXTRACT_UTC(changed), 'YYYY-MM-DD HH24:MI:SS'), entity_id, " +
+		"NVL(entity_sub_id, ' ') FROM CTO_COMMON.CHANGE_LOG WHERE schema_name = :1 AND entity = :2"
+	args := []interface{}{schema, changeType}
+	switch {
+	case len(afterID) > 0:
+		id, err := strconv.ParseInt(afterID, 10, 64)
+		if err != nil {
+			return nil, false, inputError("afterId must be a change id")
+		}
+		query += " AND id > :3"
+		args = append(args, id)
+	case len(since) > 0:
+		timestamp, err := parseQueryTimestamp(since)
+		if err != nil {
+			return nil, false, inputError("since must be a timestamp, e.g. 2020-10-08T14:03:00+01:00")
+		}
+		sinceTime, _ := time.ParseInLocation(queryTimestampLayout, timestamp, dbLocation)
+		query += " AND changed > FROM_TZ(TO_TIMESTAMP(:3, 'YYYY-MM-DD HH24:MI:SS'), 'UTC')"
+		args = append(args, sinceTime.UTC().Format(queryTimestampLayout))
+	default:
+		return nil, false, inputError("afterId or since is required")
+	}
+	if condition, scopeArgs := scope.accountCondition("o.account", len(args)+1); len(condition) > 0 {
+		query += " AND entity_id IN (SELECT o.opportunityid FROM " + schema + ".Opportunity o WHERE " +
+			strings.ReplaceAll(condition, "%SCHEMA%", schema) + ")"
+		args = append(args, scopeArgs...)
+	}
+	query += " ORDER BY id"
+
+	rows, err := DBPool.QueryContext(ctx, query, args...)
+	if err != nil {
+		thisError := fmt.Sprintf("Error querying changes (%s, %s): %s", instanceEnv, changeType, err.Error())
+		return nil, false, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	changes := []Change{}
+	for rows.Next() {
+		if len(changes) >= maxRows {
+			return changes, true, nil
+		}
+		change := Change{Type: changeType}
+		var fields, changed, entityID, entitySubID string
+		err := rows.Scan(&change.ID, &change.Change, &fields, &changed, &entityID, &entitySubID)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning change (%s, %s): %s", instanceEnv, changeType, err.Error())
+			return nil, false, errors.New(thisError)
+		}
+		if fields = strings.TrimSpace(fields); len(fields) > 0 {
+			change.Fields = strings.Split(fields, ",")
+		}
+		names := changeKeyNames[changeType]
+		change.Key = map[string]string{names[0]: entityID, names[1]: strings.TrimSpace(entitySubID)}
+		change.Changed = formatUTCTimestamp(changed)
+		changes = append(changes, change)
+	}
+	return changes, false, rows.Err()
+}
@@ -0,0 +1,192 @@
+//  Client Scopes
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// the scope that grants every other one
+const allScopes = "*"
+
+// endpointScopes is what a client needs to call an endpoint: any one of read for GET and HEAD, any one of write for
+// everything else.  Endpoints whose write list is empty are read-only (their POSTs submit queries).
+type endpointScopes struct {
+	read  []string
+	write []string
+}
+
+// the scopes each endpoint needs, by path without the leading slash.  Paths under a prefix ending in / (e.g.
+// queries/{id}) need the prefix's scopes.  Endpoints that aren't listed need admin; meta and usage need none.
+var routeScopes = map[string]endpointScopes{
+	"getManagerQuery":               {read: []string{"query:ecal", "query:sts"}},
+	"getReports":                    {read: []string{"query:identity"}},
+	"getLobTaxonomy":                {read: []string{"query:identity"}},
+	"getIdentities":                 {read: []string{"query:identity"}},
+	"identities/versions":           {read: []string{"query:identity"}},
+	"identities/versions/":          {read: []string{"query:identity"}},
+	"identities/token":              {read: []string{"query:identity"}},
+	"getSTSManagerDashboardSummary": {read: []string{"query:sts"}},
+	"stsTask":                       {read: []string{"query:sts"}, write: []string{"write:sts"}},
+	"stsPath":                       {read: []string{"query:sts"}, write: []string{"write:sts"}},
+	"stsPathRequirement":            {read: []string{"query:sts"}, write: []string{"write:sts"}},
+	"assignSTSPath":                 {read: []string{"query:sts"}, write: []string{"write:sts"}},
+	"getECALDataQuery":              {read: []string{"query:ecal"}},
+	"getECALAccountQuery":           {read: []string{"query:ecal"}},
+	"getECALOpportunityQuery":       {read: []string{"query:ecal"}},
+	"getECALArtifactQuery":          {read: []string{"query:ecal"}},
+	"getArtifact":                   {read: []string{"query:ecal"}},
+	"getProductCatalog":             {read: []string{"query:ecal"}},
+	"searchOpportunities":           {read: []string{"query:ecal"}},
+	"getConsumptionVsPlan":          {read: []string{"query:ecal"}},
+	"getWinLoss":                    {read: []string{"query:ecal"}},
+	"getPipelineByTerritory":        {read: []string{"query:ecal"}},
+	"getQuarterlyRollup":            {read: []string{"query:ecal"}},
+	"getForecast":                   {read: []string{"query:ecal"}},
+	"generateDigest":                {read: []string{"query:ecal"}},
+	"getAccountReport":              {read: []string{"query:ecal"}},
+	"opportunityHistory":            {read: []string{"query:ecal"}},
+	"changes":                       {read: []string{"query:ecal"}},
+	"exports":                       {read: []string{"query:ecal"}},
+	"exportECALWorkbook":            {read: []string{"query:ecal"}},
+	"queries":                       {read: []string{"query:ecal"}},
+	"queries/":                      {read: []string{"query:ecal"}},
+	"postArtifact":                  {read: []string{"write:ecal"}, write: []string{"write:ecal"}},
+	"uploadArtifact":                {read: []string{"write:ecal"}, write: []string{"write:ecal"}},
+	"userAccountAssignment":         {read: []string{"query:ecal"}, write: []string{"write:ecal"}},
+	"postOpportunityStatus":         {read: []string{"write:ecal"}, write: []string{"write:ecal"}},
+	"opportunityTechHealth":         {read: []string{"query:ecal"}, write: []string{"write:ecal"}},
+	"opportunityWorkload":           {read: []string{"query:ecal"}, write: []string{"write:ecal"}},
+	"accountReviews":                {read: []string{"query:ecal"}, write: []string{"write:ecal"}},
+	"postReferenceData":             {read: []string{"ingest:reference"}, write: []string{"ingest:reference"}},
+	"postReferenceBatch":            {read: []string{"ingest:reference"}, write: []string{"ingest:reference"}},
+	"postIdentities":                {read: []string{"ingest:reference"}, write: []string{"ingest:reference"}},
+	"jobs":                          {read: []string{"ingest:reference", "ops"}},
+	"jobs/":                         {read: []string{"ingest:reference", "ops"}},
+	"syncStatus":                    {read: []string{"ops"}},
+	"metrics":                       {read: []string{"ops"}},
+	"feedQuality":                   {read: []string{"ops"}},
+	"health/upstream":               {read: []string{"ops"}},
+	"meta":                          {},
+	"usage":                         {},
+}
+
+// the scope needed by the endpoints that aren't in routeScopes (the admin/ endpoints)
+const adminScope = "admin"
+
+// the scopes granted to each client by ClientScopes; clients without an entry get the * entry's, or every scope if
+// there is no * entry
+var clientScopes = map[string]map[string]bool{}
+
+//
+// Parses ClientScopes ("client:scope|scope,client:scope", * for every other client) and checks each scope is one
+// the endpoints use.  Checked at startup.
+//
+func initClientScopes() error {
+	known := map[string]bool{adminScope: true, allScopes: true}
+	for _, scopes := range routeScopes {
+		for _, scope := range append(append([]string{}, scopes.read...), scopes.write...) {
+			known[scope] = true
+		}
+	}
+
+	granted := map[string]map[string]bool{}
+	for _, entry := range strings.Split(GlobalConfig.ClientScopes, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) < 1 {
+			continue
+		}
+		pair := strings.SplitN(entry, ":", 2)
+		if len(pair) < 2 || len(strings.TrimSpace(pair[0])) < 1 {
+			thisError := fmt.Sprintf("ClientScopes entry %s must be client:scope|scope", entry)
+			return errors.New(thisError)
+		}
+		client := strings.TrimSpace(pair[0])
+		granted[client] = map[string]bool{}
+		for _, scope := range strings.Split(pair[1], "|") {
+			scope = strings.TrimSpace(scope)
+			if !known[scope] {
+				thisError := fmt.Sprintf("ClientScopes entry for %s has an unknown scope (%s); use one of %s", client, scope,
+					strings.Join(knownScopes(known), ", "))
+				return errors.New(thisError)
+			}
+			granted[client][scope] = true
+		}
+	}
+	clientScopes = granted
+	return nil
+}
+
+func knownScopes(known map[string]bool) []string {
+	scopes := []string{}
+	for scope := range known {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+//
+// Returns the scopes the request needs, by its path and method.  An empty list means any client may call it.
+//
+func requiredScopes(r *http.Request) []string {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	scopes, found := routeScopes[path]
+	if !found {
+		for route, prefixScopes := range routeScopes {
+			if strings.HasSuffix(route, "/") && strings.HasPrefix(path, route) {
+				scopes, found = prefixScopes, true
+				break
+			}
+		}
+	}
+	if !found {
+		return []string{adminScope}
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || len(scopes.write) < 1 {
+		return scopes.read
+	}
+	return scopes.write
+}
+
+//
+// True if the client has been granted one of the scopes
+//
+func clientHasScope(client string, scopes []string) bool {
+	if len(scopes) < 1 {
+		return true
+	}
+	granted, found := clientScopes[client]
+	if !found {
+		granted, found = clientScopes[allClients]
+	}
+	if !found || granted[allScopes] {
+		return true
+	}
+	for _, scope := range scopes {
+		if granted[scope] {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Returns false, having answered with a 403, if the client hasn't been granted a scope the request needs
+//
+func admitClientScope(w http.ResponseWriter, r *http.Request, client string) bool {
+	scopes := requiredScopes(r)
+	if clientHasScope(client, scopes) {
+		return true
+	}
+	message := fmt.Sprintf("Client %s is not allowed to call %s (needs %s)", client, r.URL.Path, strings.Join(scopes, " or "))
+	logRequest(r, logWarn, "client_scopes", message)
+	http.Error(w, message, http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,210 @@
+//  Client Usage
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the key of a ClientRequestQuotas/ClientRowQuotas entry that applies to every client without one of its own
+const allClients = "*"
+
+// ClientUsage is what a client has used today (in OutputTimeZone) and its quotas, 0 being unlimited
+type ClientUsage struct {
+	Client       string `json:"client"`
+	Day          string `json:"day"`
+	Requests     int64  `json:"requests"`
+	Rows         int64  `json:"rows"`
+	Rejected     int64  `json:"rejected"`
+	RequestQuota int64  `json:"request_quota"`
+	RowQuota     int64  `json:"row_quota"`
+}
+
+// rowCounter is implemented by a response writer that counts the rows written to it (see itemWriter)
+type rowCounter interface {
+	addRows(rows int64)
+}
+
+// the credentials of each client other than ServiceUsername, from ServiceClients
+var serviceClients = map[string]string{}
+
+// quotas by client (allClients for the default) from ClientRequestQuotas and ClientRowQuotas
+var clientRequestQuotas = map[string]int64{}
+var clientRowQuotas = map[string]int64{}
+
+// today's usage by client, reset at midnight in OutputTimeZone
+var clientUsage = make(map[string]*ClientUsage)
+var clientUsageLock sync.Mutex
+
+//
+// Parses ServiceClients ("client:password,client:password") and the quotas ("client:N,client:N", * for every
+// other client).  Checked at startup.
+//
+func initClientUsage() error {
+	clients := map[string]string{}
+	for _, entry := range strings.Split(GlobalConfig.ServiceClients, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) < 1 {
+			continue
+		}
+		pair := strings.SplitN(entry, ":", 2)
+		if len(pair) < 2 || len(pair[0]) < 1 || len(pair[1]) < 1 || pair[0] == GlobalConfig.ServiceUsername {
+			return errors.New("ServiceClients entries must be client:password for clients other than ServiceUsername")
+		}
+		clients[pair[0]] = pair[1]
+	}
+
+	requestQuotas, err := parseClientQuotas("ClientRequestQuotas", GlobalConfig.ClientRequestQuotas)
+	if err != nil {
+		return err
+	}
+	rowQuotas, err := parseClientQuotas("ClientRowQuotas", GlobalConfig.ClientRowQuotas)
+	if err != nil {
+		return err
+	}
+	serviceClients, clientRequestQuotas, clientRowQuotas = clients, requestQuotas, rowQuotas
+	return nil
+}
+
+func parseClientQuotas(name string, setting string) (map[string]int64, error) {
+	quotas := map[string]int64{}
+	for _, entry := range strings.Split(setting, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) < 1 {
+			continue
+		}
+		pair := strings.SplitN(entry, ":", 2)
+		if len(pair) < 2 {
+			thisError := fmt.Sprintf("%s entry %s must be client:quota", name, entry)
+			return nil, errors.New(thisError)
+		}
+		quota, err := strconv.ParseInt(strings.TrimSpace(pair[1]), 10, 64)
+		if err != nil || quota < 0 {
+			thisError := fmt.Sprintf("%s quota for %s must be a number (0 for unlimited)", name, pair[0])
+			return nil, errors.New(thisError)
+		}
+		quotas[strings.TrimSpace(pair[0])] = quota
+	}
+	return quotas, nil
+}
+
+//
+// True if the username and password are ServiceUsername/ServicePassword or one of ServiceClients
+//
+func validClient(username string, password string) bool {
+	expected := GlobalConfig.ServicePassword
+	if username != GlobalConfig.ServiceUsername {
+		var found bool
+		if expected, found = serviceClients[username]; !found {
+			return false
+		}
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+}
+
+func clientQuota(quotas map[string]int64, client string) int64 {
+	if quota, found := quotas[client]; found {
+		return quota
+	}
+	return quotas[allClients]
+}
+
+//
+// Returns a client's usage for today, starting a new day's count if the last one was on an earlier day.  Must be
+// called with clientUsageLock held.
+//
+func currentClientUsage(client string) *ClientUsage {
+	day := time.Now().In(outputLocation).Format("2006-01-02")
+	usage, found := clientUsage[client]
+	if !found || usage.Day != day {
+		usage = &ClientUsage{Client: client, Day: day}
+		clientUsage[client] = usage
+	}
+	usage.RequestQuota = clientQuota(clientRequestQuotas, client)
+	usage.RowQuota = clientQuota(clientRowQuotas, client)
+	return usage
+}
+
+//
+// Counts a request against the client's quotas.  Returns false, having answered with a 429, if the client has
+// already used its requests or rows for the day.
+//
+func admitClientRequest(w http.ResponseWriter, client string) bool {
+	clientUsageLock.Lock()
+	usage := currentClientUsage(client)
+	exceeded := (usage.RequestQuota > 0 && usage.Requests >= usage.RequestQuota) || (usage.RowQuota > 0 && usage.Rows >= usage.RowQuota)
+	if exceeded {
+		usage.Rejected++
+	} else {
+		usage.Requests++
+	}
+	rejected := usage.Rejected
+	clientUsageLock.Unlock()
+	if !exceeded {
+		return true
+	}
+
+	// the quotas reset at midnight
+	now := time.Now().In(outputLocation)
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, outputLocation)
+	w.Header().Set("Retry-After", strconv.Itoa(int(midnight.Sub(now).Seconds())+1))
+	w.WriteHeader(429)
+	fmt.Fprintf(w, "Daily quota exceeded for client %s", client)
+	if rejected == 1 {
+		logOutput(logWarn, "client_usage", fmt.Sprintf("Client %s has used its daily quota; rejecting its requests until midnight", client))
+	}
+	return false
+}
+
+// usageWriter passes a client's response through, counting the rows the query endpoints stream to it
+type usageWriter struct {
+	http.ResponseWriter
+	client string
+}
+
+func (uw *usageWriter) addRows(rows int64) {
+	clientUsageLock.Lock()
+	currentClientUsage(uw.client).Rows += rows
+	clientUsageLock.Unlock()
+}
+
+func (uw *usageWriter) Flush() {
+	if flusher, ok := uw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//
+// HTTP handler for the usage functionality.  Returns today's request and row counts and quotas of the calling
+// client, or of every client that has made a request today when called with the service credentials.
+//
+func getUsageHandler(w http.ResponseWriter, r *http.Request) {
+	client, _, _ := r.BasicAuth()
+	items := []ClientUsage{}
+
+	clientUsageLock.Lock()
+	if client == GlobalConfig.ServiceUsername {
+		for name := range clientUsage {
+			items = append(items, *currentClientUsage(name))
+		}
+	} else {
+		items = append(items, *currentClientUsage(client))
+	}
+	clientUsageLock.Unlock()
+	sort.Slice(items, func(i, j int) bool { return items[i].Client < items[j].Client })
+
+	result, _ := json.Marshal(map[string]interface{}{"items": items})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
@@ -0,0 +1,216 @@
+//  Compression
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// responses shorter than this aren't compressed; the gzip header and the CPU aren't worth it for a health check
+const gzipMinBytes = 1400
+
+// the most a gzip request body may expand to, so a small upload can't fill the disk or memory
+const maxGzipBodyBytes = 1024 * 1024 * 1024
+
+// content types that are already compressed (or are arbitrary artifact bytes) and are sent as they are
+var incompressibleTypes = []string{"application/gzip", "application/zip", "application/pdf", "application/octet-stream",
+	"application/vnd.openxmlformats", "image/", "video/", "audio/"}
+
+// gzipWriter compresses a response once it is known to be big enough and of a type worth compressing.  Until then the
+// start of the body is held back in pending; a Flush (a streamed response) decides straight away.
+type gzipWriter struct {
+	http.ResponseWriter
+	pending    bytes.Buffer
+	status     int
+	decided    bool
+	compressor *gzip.Writer
+}
+
+func (gw *gzipWriter) WriteHeader(status int) {
+	if gw.status == 0 {
+		gw.status = status
+	}
+	// these have no body to compress
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		gw.decide(false)
+	}
+}
+
+func (gw *gzipWriter) Write(data []byte) (int, error) {
+	if gw.status == 0 {
+		gw.status = http.StatusOK
+	}
+	if !gw.decided {
+		gw.pending.Write(data)
+		if gw.pending.Len() >= gzipMinBytes {
+			gw.decide(true)
+		}
+		return len(data), nil
+	}
+	if gw.compressor != nil {
+		return gw.compressor.Write(data)
+	}
+	return gw.ResponseWriter.Write(data)
+}
+
+func (gw *gzipWriter) Flush() {
+	if !gw.decided {
+		gw.decide(true)
+	}
+	if gw.compressor != nil {
+		gw.compressor.Flush()
+	}
+	if flusher, ok := gw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//
+// Sends the headers, compressing the rest of the response if compress is set and its type is worth compressing, and
+// then whatever was held back
+//
+func (gw *gzipWriter) decide(compress bool) {
+	gw.decided = true
+	header := gw.Header()
+	if compress && len(header.Get("Content-Encoding")) < 1 && compressibleType(header.Get("Content-Type")) {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		gw.compressor = gzip.NewWriter(gw.ResponseWriter)
+	}
+	if gw.status != 0 {
+		gw.ResponseWriter.WriteHeader(gw.status)
+	}
+	if gw.pending.Len() > 0 {
+		if gw.compressor != nil {
+			gw.compressor.Write(gw.pending.Bytes())
+		} else {
+			gw.ResponseWriter.Write(gw.pending.Bytes())
+		}
+		gw.pending.Reset()
+	}
+}
+
+//
+// Sends what is still held back and ends the compressed stream.  Called once the handler returns.
+//
+func (gw *gzipWriter) close() {
+	if !gw.decided {
+		gw.decide(false)
+	}
+	if gw.compressor != nil {
+		gw.compressor.Close()
+	}
+}
+
+//
+// True unless the content type is one that is already compressed.  Responses that haven't set one are JSON.
+//
+func compressibleType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, incompressible := range incompressibleTypes {
+		if strings.HasPrefix(contentType, incompressible) {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// Returns the writer a handler should use, gzip-compressing the response when the caller accepts it, and the function
+// that finishes the response once the handler returns
+//
+func compressResponse(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		return w, func() {}
+	}
+	writer := &gzipWriter{ResponseWriter: w}
+	return writer, writer.close
+}
+
+//
+// True if an Accept-Encoding header accepts gzip, i.e. lists gzip or * without q=0
+//
+func acceptsGzip(acceptEncoding string) bool {
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			pair := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(pair) == 2 && strings.TrimSpace(pair[0]) == "q" {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(pair[1]), 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipBody is a request body sent with Content-Encoding: gzip, decompressed as the handler reads it
+type gzipBody struct {
+	*gzip.Reader
+	source    io.ReadCloser
+	remaining int64
+}
+
+func (gb *gzipBody) Read(data []byte) (int, error) {
+	if gb.remaining <= 0 {
+		var extra [1]byte
+		if n, err := gb.Reader.Read(extra[:]); n == 0 && err == io.EOF {
+			return 0, io.EOF
+		}
+		return 0, errors.New("gzip request body expands to more than the limit")
+	}
+	if int64(len(data)) > gb.remaining {
+		data = data[:gb.remaining]
+	}
+	n, err := gb.Reader.Read(data)
+	gb.remaining -= int64(n)
+	return n, err
+}
+
+func (gb *gzipBody) Close() error {
+	gb.Reader.Close()
+	return gb.source.Close()
+}
+
+//
+// Returns false, having answered with a 400 or 415, if the request body is in an encoding that can't be read.  A
+// gzip body is replaced with its decompressed form so handlers (and payload capture) see the JSON as sent.
+//
+func decompressRequest(w http.ResponseWriter, r *http.Request) bool {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return true
+	case "gzip", "x-gzip":
+	default:
+		http.Error(w, "Unsupported Content-Encoding (use gzip)", http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	reader, err := gzip.NewReader(r.Body)
+	if err != nil {
+		http.Error(w, "Request body is not valid gzip", http.StatusBadRequest)
+		logRequest(r, logWarn, "compression", "Invalid gzip request body: "+err.Error())
+		return false
+	}
+	r.Body = &gzipBody{Reader: reader, source: r.Body, remaining: maxGzipBodyBytes}
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	return true
+}
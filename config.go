@@ -0,0 +1,128 @@
+//  Configuration Decoding
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// the port the service listens on when ServiceListenPort isn't set
+const defaultListenPort = 80
+
+//
+// Decodes config.json into config.  Each entry is converted to its field's type, so existing files that quote
+// everything keep working: int fields take a number or a numeric string, bool fields true/false with or without
+// quotes, and []string fields a JSON array or a comma separated string.  Entries for unknown fields are ignored and
+// an empty value leaves the field at its zero value.
+//
+func decodeConfig(reader io.Reader, config *Config) error {
+	var entries map[string]json.RawMessage
+	err := json.NewDecoder(reader).Decode(&entries)
+	if err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		raw, found := entries[name]
+		if !found || string(raw) == "null" {
+			continue
+		}
+		err = setConfigField(v.Field(i), raw)
+		if err != nil {
+			thisError := fmt.Sprintf("config entry %s %s", name, err.Error())
+			return errors.New(thisError)
+		}
+	}
+
+	if len(config.IdentityMgrLeads) != len(config.MgrAppMapping) {
+		thisError := fmt.Sprintf("IdentityMgrLeads has %d entries but MgrAppMapping has %d", len(config.IdentityMgrLeads),
+			len(config.MgrAppMapping))
+		return errors.New(thisError)
+	}
+	if config.ServiceListenPort < 0 || config.ServiceListenPort > 65535 {
+		return errors.New("config entry ServiceListenPort must be between 1 and 65535")
+	}
+	return nil
+}
+
+//
+// Sets a config field from its raw JSON value according to the field's type
+//
+func setConfigField(field reflect.Value, raw json.RawMessage) error {
+	// every type can be given as a string, which is how the older all-string config files write them
+	var text string
+	quoted := json.Unmarshal(raw, &text) == nil
+	if !quoted {
+		text = strings.TrimSpace(string(raw))
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		if !quoted && (strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{")) {
+			return errors.New("must be a string")
+		}
+		field.SetString(text)
+	case reflect.Int:
+		text = strings.TrimSpace(text)
+		if len(text) < 1 {
+			return nil
+		}
+		number, err := strconv.Atoi(text)
+		if err != nil {
+			return errors.New("must be a whole number")
+		}
+		field.SetInt(int64(number))
+	case reflect.Bool:
+		text = strings.TrimSpace(text)
+		if len(text) < 1 {
+			return nil
+		}
+		flag, err := strconv.ParseBool(strings.ToLower(text))
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		field.SetBool(flag)
+	case reflect.Slice:
+		items := []string{}
+		if !quoted {
+			err := json.Unmarshal(raw, &items)
+			if err != nil {
+				return errors.New("must be a list of strings or a comma separated string")
+			}
+		} else {
+			items = strings.Split(text, ",")
+		}
+		list := []string{}
+		for _, item := range items {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("has an unsupported type (%s)", field.Kind())
+	}
+	return nil
+}
+
+//
+// True if the list holds the value, e.g. an instance-environment in TestDataEnvironments
+//
+func configListContains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+//  Cron Schedules
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five field cron expression (minute hour day-of-month month day-of-week)
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays map[int]bool
+	anyDay, anyWeekday                     bool
+}
+
+//
+// Parses a standard five field cron expression.  Each field may be *, a number, a range (1-5), a list (1,15) or any
+// of those with a step (*/15, 0-30/10).  Days of the week are 0-6 with 0 (or 7) as Sunday.
+//
+func parseCron(expression string) (*cronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression must have 5 fields: minute hour day-of-month month day-of-week")
+	}
+
+	bounds := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := make([]map[int]bool, 5)
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron field %d (%s): %s", i+1, field, err.Error())
+		}
+		sets[i] = set
+	}
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+
+	return &cronSchedule{minutes: sets[0], hours: sets[1], days: sets[2], months: sets[3], weekdays: sets[4],
+		anyDay: strings.HasPrefix(fields[2], "*"), anyWeekday: strings.HasPrefix(fields[4], "*")}, nil
+}
+
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if slash := strings.Index(part, "/"); slash >= 0 {
+			value, err := strconv.Atoi(part[slash+1:])
+			if err != nil || value < 1 {
+				return nil, errors.New("invalid step")
+			}
+			step = value
+			part = part[:slash]
+		}
+
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			value, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, errors.New("invalid value")
+			}
+			low, high = value, value
+			if len(bounds) == 2 {
+				high, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, errors.New("invalid range")
+				}
+			} else if step > 1 {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return nil, fmt.Errorf("values must be between %d and %d", min, max)
+		}
+		for value := low; value <= high; value += step {
+			set[value] = true
+		}
+	}
+	return set, nil
+}
+
+//
+// Returns true if the schedule fires in the minute of t.  As in cron, when both day-of-month and day-of-week are
+// restricted a day matching either one fires.
+//
+func (c *cronSchedule) matches(t time.Time) bool {
+	if !c.minutes[t.Minute()] || !c.hours[t.Hour()] || !c.months[int(t.Month())] {
+		return false
+	}
+	dayMatch := c.days[t.Day()]
+	weekdayMatch := c.weekdays[int(t.Weekday())]
+	switch {
+	case c.anyDay && c.anyWeekday:
+		return true
+	case c.anyDay:
+		return weekdayMatch
+	case c.anyWeekday:
+		return dayMatch
+	default:
+		return dayMatch || weekdayMatch
+	}
+}
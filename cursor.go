@@ -0,0 +1,47 @@
+//  Pagination Cursors
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+// pageCursor marks the last row of a page by its id and the value it is sorted on (its update time, or Key for results
+// in another order).  Callers only ever see it encoded (see encodeCursor) and hand it back
+// unchanged to get the next page.
+type pageCursor struct {
+	ID      string `json:"id"`
+	Updated string `json:"updated,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Sort    string `json:"sort,omitempty"`
+}
+
+//
+// Encodes a cursor as an opaque, URL safe string
+//
+func encodeCursor(cursor pageCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+//
+// Decodes a cursor passed back by a caller.  An empty string is the start of the result set.
+//
+func decodeCursor(cursor string) (pageCursor, error) {
+	var decoded pageCursor
+	if len(cursor) < 1 {
+		return decoded, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return decoded, inputError("cursor is invalid")
+	}
+	err = json.Unmarshal(data, &decoded)
+	if err != nil || len(decoded.ID) < 1 {
+		return decoded, inputError("cursor is invalid")
+	}
+	return decoded, nil
+}
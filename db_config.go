@@ -0,0 +1,169 @@
+//  Database Connection Config
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// files an ATP wallet directory must contain for an auto-login (password-less) connection
+var requiredWalletFiles = []string{"cwallet.sso", "tnsnames.ora", "sqlnet.ora"}
+
+//
+// Builds the godror connect string from the structured DB* config fields.  If DBUser isn't set the legacy
+// DBConnectString (user/password@alias) is used as-is so existing config.json files keep working.
+//
+func buildDBConnectString(config Config) (string, error) {
+	if len(config.DBUser) < 1 {
+		if len(config.DBConnectString) < 1 {
+			return "", errors.New("Either DBUser, DBPassword & DBTNSAlias or DBConnectString must be configured")
+		}
+		return config.DBConnectString, nil
+	}
+	if len(config.DBPassword) < 1 || len(config.DBTNSAlias) < 1 {
+		return "", errors.New("DBPassword and DBTNSAlias are required when DBUser is configured")
+	}
+
+	params := []string{
+		"user=" + strconv.Quote(config.DBUser),
+		"password=" + strconv.Quote(config.DBPassword),
+		"connectString=" + strconv.Quote(config.DBTNSAlias),
+	}
+	if len(config.DBWalletLocation) > 0 {
+		params = append(params, "configDir="+strconv.Quote(config.DBWalletLocation))
+	}
+
+	// pool sizing is optional; anything left empty falls back to the godror default
+	pool := []struct {
+		name  string
+		value string
+	}{
+		{"DBPoolMinSessions", config.DBPoolMinSessions},
+		{"DBPoolMaxSessions", config.DBPoolMaxSessions},
+		{"DBPoolIncrement", config.DBPoolIncrement},
+	}
+	sizes := make(map[string]int)
+	for _, setting := range pool {
+		if len(setting.value) < 1 {
+			continue
+		}
+		size, err := strconv.Atoi(setting.value)
+		if err != nil || size < 0 {
+			thisError := fmt.Sprintf("%s must be a non-negative number (%s)", setting.name, setting.value)
+			return "", errors.New(thisError)
+		}
+		sizes[setting.name] = size
+	}
+	if min, ok := sizes["DBPoolMinSessions"]; ok {
+		if max, ok := sizes["DBPoolMaxSessions"]; ok && min > max {
+			thisError := fmt.Sprintf("DBPoolMinSessions (%d) can't be larger than DBPoolMaxSessions (%d)", min, max)
+			return "", errors.New(thisError)
+		}
+		params = append(params, "poolMinSessions="+strconv.Itoa(min))
+	}
+	if max, ok := sizes["DBPoolMaxSessions"]; ok {
+		params = append(params, "poolMaxSessions="+strconv.Itoa(max))
+	}
+	if increment, ok := sizes["DBPoolIncrement"]; ok {
+		params = append(params, "poolIncrement="+strconv.Itoa(increment))
+	}
+	if len(config.DBConnectionClass) > 0 {
+		params = append(params, "connectionClass="+strconv.Quote(config.DBConnectionClass))
+	}
+
+	return strings.Join(params, " "), nil
+}
+
+//
+// Checks that the configured wallet directory exists, holds the files an auto-login ATP connection needs and defines
+// the configured TNS alias.  Catching this at startup beats a cryptic ORA-12154 on the first request.
+//
+func validateDBWallet(walletLocation string, tnsAlias string) error {
+	if len(walletLocation) < 1 {
+		return nil
+	}
+
+	info, err := os.Stat(walletLocation)
+	if err != nil {
+		thisError := fmt.Sprintf("DBWalletLocation %s is not accessible: %s", walletLocation, err.Error())
+		return errors.New(thisError)
+	}
+	if !info.IsDir() {
+		thisError := fmt.Sprintf("DBWalletLocation %s is not a directory; point it at the unzipped wallet", walletLocation)
+		return errors.New(thisError)
+	}
+
+	missing := []string{}
+	for _, file := range requiredWalletFiles {
+		if _, err := os.Stat(filepath.Join(walletLocation, file)); err != nil {
+			missing = append(missing, file)
+		}
+	}
+	if len(missing) > 0 {
+		thisError := fmt.Sprintf("DBWalletLocation %s is missing %s; download and unzip the ATP wallet there",
+			walletLocation, strings.Join(missing, ", "))
+		return errors.New(thisError)
+	}
+
+	// a full connect descriptor doesn't need to be in tnsnames.ora
+	if len(tnsAlias) < 1 || strings.Contains(tnsAlias, "(") || strings.Contains(tnsAlias, "/") {
+		return nil
+	}
+	tnsnames, err := ioutil.ReadFile(filepath.Join(walletLocation, "tnsnames.ora"))
+	if err != nil {
+		thisError := fmt.Sprintf("Unable to read tnsnames.ora in %s: %s", walletLocation, err.Error())
+		return errors.New(thisError)
+	}
+	aliasPattern := regexp.MustCompile(`(?im)^\s*` + regexp.QuoteMeta(tnsAlias) + `\s*=`)
+	if !aliasPattern.Match(tnsnames) {
+		thisError := fmt.Sprintf("DBTNSAlias %s is not defined in %s", tnsAlias, filepath.Join(walletLocation, "tnsnames.ora"))
+		return errors.New(thisError)
+	}
+	return nil
+}
+
+//
+// Returns a description of the database connection that is safe to log (i.e. without the password)
+//
+func describeDBConnection(config Config) string {
+	if len(config.DBUser) > 0 {
+		description := fmt.Sprintf("%s/*******@%s", config.DBUser, config.DBTNSAlias)
+		if len(config.DBWalletLocation) > 0 {
+			description += " (wallet " + config.DBWalletLocation + ")"
+		}
+		return description
+	}
+
+	// legacy user/password@alias format; either part may be missing
+	alias := ""
+	if at := strings.LastIndex(config.DBConnectString, "@"); at >= 0 {
+		alias = config.DBConnectString[at+1:]
+	}
+	return fmt.Sprintf("%s/*******@%s", dbServiceUser(config), alias)
+}
+
+//
+// Returns the database user the service connects as, from DBUser or the legacy DBConnectString
+//
+func dbServiceUser(config Config) string {
+	if len(config.DBUser) > 0 {
+		return config.DBUser
+	}
+	user := config.DBConnectString
+	if slash := strings.Index(user, "/"); slash >= 0 {
+		return user[:slash]
+	}
+	if at := strings.Index(user, "@"); at >= 0 {
+		return user[:at]
+	}
+	return user
+}
@@ -0,0 +1,195 @@
+//  Local Development Mode
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"time"
+)
+
+// the fixture file read in dev mode when DevFixtures isn't set
+const defaultDevFixtures = "samples/dev_fixtures.json"
+
+// the identities document served in dev mode when IdentityFilename isn't set
+const defaultDevIdentities = "samples/dev_identities.json"
+
+// the manager hierarchy queries run in dev mode when config.json doesn't set them, as in the sample config
+const devECALHierarchyQuery = "SELECT UserEmail FROM %SCHEMA%.user1 u INNER JOIN %SCHEMA%.roletype rt ON u.rolename = rt.id " +
+	"WHERE rt.rolename = 'Manager' START WITH useremail = :1 CONNECT BY PRIOR useremail = manager"
+const devSTSHierarchyQuery = "SELECT UserEmail FROM %SCHEMA%.STSUser u INNER JOIN %SCHEMA%.STSRole r ON u.rolename = r.id " +
+	"WHERE r.rolename = 'Manager' START WITH useremail = :1 CONNECT BY PRIOR useremail = manager"
+
+// how many of the statements run are kept in dev mode; each is logged as it runs, so only the latest are needed
+const devStatementsKept = 100
+
+// the instance-environments served in dev mode when config.json doesn't list any
+var devSchemaMap = map[string]string{"ecal-dev-local": "ECAL_DEV", "sts-dev-local": "STS_DEV"}
+
+// devFixture answers the statements matching Pattern (a regular expression run against the whitespace-collapsed SQL)
+// with Rows under Columns, or with RowsAffected for statements that don't return rows
+type devFixture struct {
+	Pattern      string          `json:"pattern"`
+	Columns      []string        `json:"columns"`
+	Rows         [][]interface{} `json:"rows"`
+	RowsAffected int64           `json:"rows_affected"`
+}
+
+//
+// True if the service was started with --dev
+//
+func devModeRequested(args []string) bool {
+	for _, arg := range args {
+		if arg == "--dev" {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Opens the store the service runs against in dev mode in place of ATP: a memdb database that answers the statements
+// matching the fixtures in DevFixtures (default samples/dev_fixtures.json) with their rows.  It has no schema and
+// runs no SQL; the sample fixtures answer the queries of every query endpoint with a few canned rows.  SYSDATE is
+// always answered so the health check can connect, and every other insert, update, merge or delete succeeds without
+// changing anything, so each endpoint can be run end to end and its SQL seen in the log without an ATP wallet.  A
+// query without a fixture fails with an error naming it rather than returning nothing.  Fixtures are matched in the
+// order they are listed.
+//
+func openDevStore() (Store, error) {
+	mem, db := NewMemDB()
+	mem.LimitStatements(devStatementsKept)
+
+	filename := GlobalConfig.DevFixtures
+	if len(filename) < 1 {
+		filename = defaultDevFixtures
+	}
+	fixtures, err := readDevFixtures(filename)
+	if err != nil && (len(GlobalConfig.DevFixtures) > 0 || !os.IsNotExist(err)) {
+		thisError := fmt.Sprintf("reading dev fixtures %s: %s", filename, err.Error())
+		return nil, errors.New(thisError)
+	}
+	for i, fixture := range fixtures {
+		if _, err := regexp.Compile(fixture.Pattern); err != nil || len(fixture.Pattern) < 1 {
+			thisError := fmt.Sprintf("dev fixture %d of %s has an invalid pattern: %s", i+1, filename, fixture.Pattern)
+			return nil, errors.New(thisError)
+		}
+		if len(fixture.Columns) > 0 {
+			mem.ExpectQuery(fixture.Pattern, fixture.Columns, fixture.Rows...)
+		} else {
+			mem.ExpectExec(fixture.Pattern, fixture.RowsAffected)
+		}
+	}
+	logOutput(logInfo, "dev_mode", fmt.Sprintf("Loaded %d dev fixtures from %s", len(fixtures), filename))
+
+	mem.ExpectQuery(`SELECT SYSDATE FROM DUAL`, []string{"sysdate"}, []interface{}{time.Now()})
+	mem.ExpectExec(`.`, 0)
+
+	// log each statement so contributors can see what an endpoint would have sent to ATP
+	mem.OnStatement(func(statement MemStatement) {
+		logOutput(logInfo, "dev_mode", fmt.Sprintf("%s %v", statement.Query, statement.Args))
+	})
+	return db, nil
+}
+
+//
+// Returns the fixtures in a dev fixture file, a JSON list of {"pattern", "columns", "rows"} or {"pattern",
+// "rows_affected"} entries.  Numbers in rows are kept as their decimal text, which scans into ints, strings and
+// dbNumbers alike, as NUMBER columns do from ATP.  RFC 3339 strings become times so they scan into time.Time and
+// sql.NullTime as DATE and TIMESTAMP columns do.
+//
+func readDevFixtures(filename string) ([]devFixture, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var fixtures []devFixture
+	decoder := json.NewDecoder(file)
+	decoder.UseNumber()
+	err = decoder.Decode(&fixtures)
+	if err != nil {
+		return nil, err
+	}
+	for _, fixture := range fixtures {
+		for _, row := range fixture.Rows {
+			for i, value := range row {
+				switch value := value.(type) {
+				case json.Number:
+					row[i] = value.String()
+				case string:
+					if when, err := time.Parse(time.RFC3339, value); err == nil {
+						row[i] = when
+					}
+				}
+			}
+		}
+	}
+	return fixtures, nil
+}
+
+//
+// Maps the dev instance-environments (ecal-dev-local and sts-dev-local) when config.json doesn't list any and routes
+// the opportunity feed to the ECAL one, so a minimal config.json is enough to run locally
+//
+func registerDevSchemas() {
+	if len(schemaMapSnapshot()) > 0 {
+		return
+	}
+	for instanceEnv, schema := range devSchemaMap {
+		registerSchema(instanceEnv, schema)
+		logOutput(logInfo, "dev_mode", "\t"+instanceEnv+" -> "+schema)
+	}
+	if len(GlobalConfig.ECALOpportunitySyncTarget) < 1 {
+		GlobalConfig.ECALOpportunitySyncTarget = "ecal-dev-local"
+	}
+}
+
+//
+// Fills in the settings a minimal config.json leaves out that dev mode needs: the manager hierarchy queries and the
+// identities file.  The identities file is a copy of samples/dev_identities.json in the temp directory, so an
+// identity load run locally overwrites the copy rather than the sample.
+//
+func applyDevDefaults() error {
+	if len(GlobalConfig.ECALManagerHierarchyQuery) < 1 {
+		GlobalConfig.ECALManagerHierarchyQuery = devECALHierarchyQuery
+	}
+	if len(GlobalConfig.STSManagerHierarchyQuery) < 1 {
+		GlobalConfig.STSManagerHierarchyQuery = devSTSHierarchyQuery
+	}
+	if len(GlobalConfig.IdentityFilename) > 0 {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(defaultDevIdentities)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		thisError := fmt.Sprintf("reading dev identities %s: %s", defaultDevIdentities, err.Error())
+		return errors.New(thisError)
+	}
+	file, err := ioutil.TempFile("", "dev_identities_*.json")
+	if err != nil {
+		thisError := fmt.Sprintf("creating dev identities file: %s", err.Error())
+		return errors.New(thisError)
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		thisError := fmt.Sprintf("writing dev identities file %s: %s", file.Name(), err.Error())
+		return errors.New(thisError)
+	}
+	GlobalConfig.IdentityFilename = file.Name()
+	logOutput(logInfo, "dev_mode", "Serving identities from a copy of "+defaultDevIdentities+": "+file.Name())
+	return nil
+}
@@ -5,58 +5,179 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
 	"strings"
 )
 
+// ECALAccount is one account row of getECALAccountQuery
+type ECALAccount struct {
+	AccountID        dbNumber
+	LOB              string
+	AccountName      string
+	SolutionEngineer string
+	NumOpportunities dbNumber
+}
+
+//
+// Returns the HTTP handler for the getECALAccountQuery functionality, which runs its queries against db
+//
+func getECALAccountQueryHandler(db Store) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// get query parameters
+		query := r.URL.Query()
+		instanceEnv := query.Get("instanceEnvironment")
+
+		// what the caller may see is decided from who they are, not from an isAdmin parameter
+		scope, err := requestAccess(r, db, instanceEnv)
+		if queryCancelled(r.Context(), "ecal_account_query", err) {
+			return
+		}
+		if inputErr, ok := err.(inputError); ok {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", inputErr.Error())
+			return
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+			logRequest(r, logError, "ecal_account_query", err.Error())
+			return
+		}
+
+		maxRows, err := getMaxRows(query.Get("maxRows"))
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+		ndjson, err := ndjsonRequested(query)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+
+		// just the number of accounts, e.g. for a badge, or for HEAD the count and last update time as headers
+		if countOnlyRequested(query) || r.Method == http.MethodHead {
+			count, err := countECALAccountQuery(r.Context(), db, instanceEnv, scope)
+			writeQueryCount(w, r, "ecal_account_query", count, err)
+			return
+		}
+
+		// the caller's list may be cached, warmed after the last data load or from their last request
+		cacheKey := queryCacheKey("getECALAccountQuery", instanceEnv, scope, maxRows)
+		cacheable := !ndjson
+		if cacheable {
+			rememberWarmScope(instanceEnv, scope)
+			if cached, ok := getCachedQuery(cacheKey); ok {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, "{\"items\": [%s], \"truncated\": %t}", cached.result, cached.truncated)
+				return
+			}
+		}
+
+		// call the helper which streams the rows straight to the output
+		out := newItemWriter(w, "{\"items\": [")
+		if ndjson {
+			out = newNDJSONWriter(w)
+		}
+		if cacheable {
+			out.capture()
+		}
+		truncated, err := getECALAccountQuery(r.Context(), db, instanceEnv, scope, maxRows, out)
+		if queryCancelled(r.Context(), "ecal_account_query", err) {
+			return
+		}
+		if err != nil && out.written() {
+			abortStreamedResponse("ecal_account_query", err)
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+			logRequest(r, logError, "ecal_account_query", string(err.Error()))
+			return
+		}
+		if cacheable {
+			putCachedQuery(cacheKey, instanceEnv, queryCacheEntry{result: out.capturedItems(), truncated: truncated})
+		}
+		out.setPaging(truncated, "")
+		out.finish(fmt.Sprintf("], \"truncated\": %t}", truncated))
+	}
+}
+
 //
-// HTTP handler for the getECALAccountQueryHandler functionality
+// Returns data to power the ECAL application.  Specifically returns a list of accounts that should be presented to the user of the app.
+// The instanceEnvironment identifier (sts-dev-preview, sts-prod-live, etc) is required to key the name of the ATP schema to query
+// The scope is either everything (admins) or the accounts of a manager or end-user and their hierarchy
+// Rows are written to out as they are read, at most maxRows of them; the bool result is true if more were available
 //
-func getECALAccountQueryHandler(w http.ResponseWriter, r *http.Request) {
-	// get query parameters
-	query := r.URL.Query()
-	instanceEnv := query.Get("instanceEnvironment")
-	userEmail := query.Get("userEmail")
-	isAdminString := query.Get("isAdmin")
-
-	// convert isAdminString to a bool
-	isAdmin := false
-	if strings.ToLower(isAdminString) == "true" || strings.ToLower(isAdminString) == "yes" {
-		isAdmin = true
+func getECALAccountQuery(ctx context.Context, db QueryRunner, instanceEnv string, scope accessScope, maxRows int, out *itemWriter) (bool, error) {
+	query, args, err := ecalAccountQuerySQL(instanceEnv, scope)
+	if err != nil {
+		return false, err
 	}
 
-	// call the helper which does the data mashing
-	result, err := getECALAccountQuery(instanceEnv, userEmail, isAdmin)
+	// run the query, timing it in case it is slow
+	timer := startQueryTimer("getECALAccountQuery", instanceEnv)
+	rows, err := db.QueryContext(ctx, tagQuery("getECALAccountQuery", instanceEnv, query), args...)
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator")
-		logOutput(logError, "ecal_artifact_query", string(err.Error()))
-		return
+		thisError := fmt.Sprintf("Error running query (%s, %s): %s", instanceEnv, scope, err.Error())
+		return false, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	// vars to hold row results
+	var lastUpdate string
+
+	// step through each row returned and add to the query filter using the correct format
+	count := 0
+	truncated := false
+	for rows.Next() {
+		if count >= maxRows {
+			truncated = true
+			break
+		}
+		var item ECALAccount
+		err := rows.Scan(&item.AccountID, &item.LOB, &item.AccountName, &item.SolutionEngineer, &item.NumOpportunities, &lastUpdate)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning row (%s, %s): %s", instanceEnv, scope, err.Error())
+			return false, errors.New(thisError)
+		}
+		err = out.writeJSON(item)
+		if err != nil {
+			thisError := fmt.Sprintf("Error writing row (%s): %s", instanceEnv, err.Error())
+			return false, errors.New(thisError)
+		}
+		count++
 	}
 
-	// format the result as json
-	json := fmt.Sprintf("{\"items\": [%s]}", result)
+	timer.done(count)
+	return truncated, nil
+}
 
-	// write result to output stream
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, string(json))
+//
+// Returns the number of accounts getECALAccountQuery would return for the user, ignoring maxRows, and when the most
+// recently updated of them was last updated
+//
+func countECALAccountQuery(ctx context.Context, db QueryRunner, instanceEnv string, scope accessScope) (queryCount, error) {
+	query, args, err := ecalAccountQuerySQL(instanceEnv, scope)
+	if err != nil {
+		return queryCount{}, err
+	}
+	return countQueryRows(ctx, db, query, "LastUpdate", args...)
 }
 
 //
-// Returns data to power the ECAL application.  Specifically returns a list of accounts that should be presented to the user of the app.
-// The instanceEnvironment identifier (sts-dev-preview, sts-prod-live, etc) is required to key the name of the ATP schema to query
-// The userEmail parameter is either a manager or end-user email
-// If the isAdmin paramter is set to true then all data will be returned
+// Builds the account query for the scope and its bind arguments
 //
-func getECALAccountQuery(instanceEnv string, userEmail string, isAdmin bool) (string, error) {
+func ecalAccountQuerySQL(instanceEnv string, scope accessScope) (string, []interface{}, error) {
 	// inject the correct schema name into the query
 	if len(instanceEnv) < 1 {
-		thisError := fmt.Sprintf("instanceEnvironment query parameter is invalid (%s, %s, %s)", instanceEnv, userEmail, strconv.FormatBool(isAdmin))
-		return "", errors.New(thisError)
+		thisError := fmt.Sprintf("instanceEnvironment query parameter is invalid (%s, %s)", instanceEnv, scope)
+		return "", nil, errors.New(thisError)
 	}
 
 	// set the core query
@@ -65,24 +186,18 @@ func getECALAccountQuery(instanceEnv string, userEmail string, isAdmin bool) (st
 		l.lookupdescription AS LOB, 
 		a.accountname as AccountName, 
 		a.createdby AS SolutionEngineer,
-		(SELECT count(*) FROM %SCHEMA%.Opportunity o WHERE o.account = a.id) AS NumOpportunities
+		(SELECT count(*) FROM %SCHEMA%.Opportunity o WHERE o.account = a.id) AS NumOpportunities,
+		TO_CHAR(a.lastupdatedate, 'YYYY-MM-DD HH24:MI:SS') AS LastUpdate
 	FROM %SCHEMA%.User1 u 
 	INNER JOIN %SCHEMA%.UserAccount ua ON ua.user1 = u.id
 	INNER JOIN %SCHEMA%.Account a ON a.id = ua.account
 	INNER JOIN %SCHEMA%.Lookup l ON l.id = a.accountlob AND l.lookuptype = 'LOB'	
 	`
-	// if the user is not an admin (regular user or manager) then append the hierarchical query suffix
-	if isAdmin == false {
+	// if the caller is not an admin (regular user or manager) then limit to the accounts of their hierarchy
+	condition, args := scope.accountCondition("a.id", 1)
+	if len(condition) > 0 {
 		template += `
-		WHERE u.useremail = :1 OR u.manager in 
-		(
-		SELECT useremail 
-		FROM %SCHEMA%.User1 u 
-		INNER JOIN %SCHEMA%.RoleType r 
-		ON u.rolename = r.id WHERE r.rolename = 'Manager' 
-		START WITH useremail = :1 
-		CONNECT BY PRIOR useremail = manager
-		)
+		WHERE ` + condition + `
 		`
 	}
 
@@ -90,40 +205,6 @@ func getECALAccountQuery(instanceEnv string, userEmail string, isAdmin bool) (st
 	template += "ORDER BY AccountName ASC"
 
 	// replace the %SCHEMA% template with the correct schema name
-	query := strings.ReplaceAll(template, "%SCHEMA%", SchemaMap[instanceEnv])
-
-	// run the query
-	var rows *sql.Rows
-	var err error
-	if isAdmin {
-		rows, err = DBPool.Query(query)
-	} else {
-		rows, err = DBPool.Query(query, userEmail)
-	}
-	if err != nil {
-		thisError := fmt.Sprintf("Error running query (%s, %s, %s): %s", instanceEnv, userEmail, strconv.FormatBool(isAdmin), err.Error())
-		return "", errors.New(thisError)
-	}
-	defer rows.Close()
-
-	// vars to hold row results
-	var accountID, LOB, accountName, solutionEngineer, numOpportunities string
-
-	// step through each row returned and add to the query filter using the correct format
-	result := ""
-	count := 0
-	for rows.Next() {
-		err := rows.Scan(&accountID, &LOB, &accountName, &solutionEngineer, &numOpportunities)
-		if err != nil {
-			thisError := fmt.Sprintf("Error scanning row (%s, %s, %s): %s", instanceEnv, userEmail, strconv.FormatBool(isAdmin), err.Error())
-			return "", errors.New(thisError)
-		}
-		result += fmt.Sprintf("{\"AccountID\": %s, \"LOB\": \"%s\", \"AccountName\": \"%s\", \"SolutionEngineer\": \"%s\", \"NumOpportunities\": %s},",
-			accountID, LOB, accountName, solutionEngineer, numOpportunities)
-		count++
-	}
-
-	// string the trailing 'or' field if it exists
-	result = strings.TrimSuffix(result, ",")
-	return result, nil
+	query := strings.ReplaceAll(template, "%SCHEMA%", lookupSchema(instanceEnv))
+	return query, args, nil
 }
@@ -0,0 +1,119 @@
+//  ECAL Account Query Tests
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var testAccountColumns = []string{"accountid", "lob", "accountname", "solutionengineer", "numopportunities", "lastupdate"}
+
+func TestGetECALAccountQueryHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		client    string
+		params    string
+		admin     bool
+		userEmail string
+		status    int
+		rows      int
+		truncated bool
+	}{
+		{name: "user sees their hierarchy", client: "vb", params: "&userEmail=SE.One@example.com", userEmail: "se.one@example.com", status: 200, rows: 2},
+		{name: "admin sees everything", client: "vb", params: "&userEmail=admin@example.com", admin: true, status: 200, rows: 2},
+		{name: "unrestricted client without a user sees everything", client: "integration", status: 200, rows: 2},
+		{name: "maxRows truncates", client: "vb", params: "&userEmail=se.one@example.com&maxRows=1", userEmail: "se.one@example.com", status: 200, rows: 1, truncated: true},
+		{name: "user is required", client: "vb", status: 400},
+		{name: "untrusted client can't name a user", client: "other", params: "&userEmail=se.one@example.com", status: 400},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mem, db := newQueryTestStore(t)
+			expectAdminLookup(mem, test.admin)
+			mem.ExpectQuery(`SELECT DISTINCT\(a\.id\) as AccountID`, testAccountColumns,
+				[]interface{}{"1", "North America Tech", "Acme Corp", "se.one@example.com", "1", "2020-08-20 10:15:00"},
+				[]interface{}{"2", "North America Tech", "Globex", "se.two@example.com", "3", "2020-08-18 16:40:00"})
+
+			w := serveQuery(getECALAccountQueryHandler(db), test.client, "/getECALAccountQuery?instanceEnvironment="+testInstanceEnv+test.params)
+			if w.Code != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, w.Code, w.Body.String())
+			}
+			if test.status != 200 {
+				if len(endpointStatements(mem)) > 0 {
+					t.Errorf("expected no query for a refused request, got %v", mem.Statements())
+				}
+				return
+			}
+
+			statement := checkScopedStatement(t, mem, test.userEmail)
+			if !strings.HasSuffix(statement.Query, "ORDER BY AccountName ASC") {
+				t.Errorf("expected the accounts in name order: %s", statement.Query)
+			}
+			response := decodeQueryResponse(t, w)
+			if len(response.Items) != test.rows || response.Truncated != test.truncated {
+				t.Fatalf("expected %d rows (truncated %t), got %d (truncated %t)", test.rows, test.truncated, len(response.Items), response.Truncated)
+			}
+			item := response.Items[0]
+			if item["AccountID"] != 1.0 || item["AccountName"] != "Acme Corp" || item["NumOpportunities"] != 1.0 {
+				t.Errorf("unexpected first account: %v", item)
+			}
+		})
+	}
+}
+
+func TestGetECALAccountQueryHandlerCache(t *testing.T) {
+	mem, db := newQueryTestStore(t)
+	expectAdminLookup(mem, false)
+	mem.ExpectQuery(`SELECT DISTINCT\(a\.id\) as AccountID`, testAccountColumns,
+		[]interface{}{"1", "North America Tech", "Acme Corp", "se.one@example.com", "1", "2020-08-20 10:15:00"})
+
+	// the second request for the same list is answered from the cache; the role is cached too
+	handler := getECALAccountQueryHandler(db)
+	target := "/getECALAccountQuery?instanceEnvironment=" + testInstanceEnv + "&userEmail=se.one@example.com"
+	first := serveQuery(handler, "vb", target)
+	second := serveQuery(handler, "vb", target)
+	if first.Code != 200 || second.Code != 200 {
+		t.Fatalf("expected 200s, got %d and %d", first.Code, second.Code)
+	}
+	if first.Body.String() != second.Body.String() {
+		t.Errorf("cached response differs:\n%s\n%s", first.Body.String(), second.Body.String())
+	}
+	if len(mem.Statements()) != 2 {
+		t.Errorf("expected the role lookup and one query, got %v", mem.Statements())
+	}
+}
+
+func TestGetECALAccountQueryHandlerErrors(t *testing.T) {
+	mem, db := newQueryTestStore(t)
+	expectAdminLookup(mem, false)
+	mem.ExpectError(`SELECT DISTINCT\(a\.id\) as AccountID`, errors.New("ORA-00942: table or view does not exist"))
+
+	w := serveQuery(getECALAccountQueryHandler(db), "vb", "/getECALAccountQuery?instanceEnvironment="+testInstanceEnv+"&userEmail=se.one@example.com")
+	if w.Code != 500 {
+		t.Fatalf("expected 500, got %d: %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "ORA-") {
+		t.Errorf("database error leaked to the caller: %s", w.Body.String())
+	}
+}
+
+func TestGetECALAccountQueryHandlerCountOnly(t *testing.T) {
+	mem, db := newQueryTestStore(t)
+	mem.ExpectQuery(`SELECT COUNT\(\*\), MAX\(LastUpdate\) FROM \(`, []string{"count", "lastupdate"}, []interface{}{"2", "2020-08-20 10:15:00"})
+
+	w := serveQuery(getECALAccountQueryHandler(db), "integration", "/getECALAccountQuery?instanceEnvironment="+testInstanceEnv+"&countOnly=true")
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	response := decodeQueryResponse(t, w)
+	if response.Count == nil || *response.Count != 2 {
+		t.Errorf("expected a count of 2: %s", w.Body.String())
+	}
+	if statements := mem.Statements(); len(statements) != 1 || !strings.Contains(statements[0].Query, "SELECT DISTINCT(a.id) as AccountID") {
+		t.Errorf("expected the account query to be counted, got %v", statements)
+	}
+}
@@ -0,0 +1,255 @@
+//  ECAL Account Report
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errAccountNotFound is returned when the account doesn't exist in the instance-environment
+var errAccountNotFound = errors.New("account not found")
+
+// color names used in the PDF report
+var reportColorNames = map[string]string{"G": "Green", "Y": "Yellow", "R": "Red"}
+
+// ReportArtifact is an artifact uploaded for a workload
+type ReportArtifact struct {
+	Type       string `json:"artifact_type"`
+	Uploaded   string `json:"uploaded"`
+	UploadedBy string `json:"uploaded_by"`
+}
+
+// ReportWorkload is one workload of an account report
+type ReportWorkload struct {
+	WorkloadID         int64            `json:"workload_id"`
+	OpportunityID      string           `json:"opportunity_id"`
+	Summary            string           `json:"summary"`
+	WorkloadType       string           `json:"workload_type"`
+	Color              string           `json:"color"`
+	LatestStage        string           `json:"latest_ecal_stage_done"`
+	TechLead           string           `json:"tech_lead"`
+	LatestStatus       string           `json:"latest_status"`
+	LatestStatusDate   string           `json:"latest_status_date"`
+	LatestStatusAuthor string           `json:"latest_status_author"`
+	Artifacts          []ReportArtifact `json:"artifacts"`
+}
+
+// AccountReport is the summary of an account's ECAL workloads used in QBR packets
+type AccountReport struct {
+	AccountID   int64             `json:"account_id"`
+	AccountName string            `json:"account_name"`
+	CimID       string            `json:"cim_id"`
+	LOB         string            `json:"lob"`
+	Generated   string            `json:"generated"`
+	Workloads   []*ReportWorkload `json:"workloads"`
+}
+
+//
+// HTTP handler for the getAccountReport functionality.  Returns the account's workloads with their colors, artifacts
+// and latest statuses as JSON or, with format=pdf, as a PDF for QBR packets.
+//
+func getAccountReportHandler(w http.ResponseWriter, r *http.Request) {
+	// get query parameters
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	accountID := query.Get("accountId")
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "pdf" {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "format must be json or pdf")
+		return
+	}
+
+	// what the caller may see is decided from who they are
+	scope, err := requestAccess(r, DBPool, instanceEnv)
+	if queryCancelled(r.Context(), "account_report", err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "account_report", err.Error())
+		return
+	}
+
+	// call the helper which does the data mashing
+	report, err := getAccountReport(r.Context(), instanceEnv, scope, accountID)
+	if queryCancelled(r.Context(), "account_report", err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err == errAccountNotFound {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Account not found")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "account_report", err.Error())
+		return
+	}
+
+	// write result to output stream
+	if format == "pdf" {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"account-%d.pdf\"", report.AccountID))
+		w.Write(renderAccountReport(report))
+		return
+	}
+	result, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+//
+// Returns the report of an ECAL account: each of its workloads with color, latest stage, latest status and uploaded
+// artifacts.  An account outside the scope is errAccountNotFound.
+//
+func getAccountReport(ctx context.Context, instanceEnv string, scope accessScope, accountID string) (*AccountReport, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		return nil, inputError("instanceEnvironment query parameter is invalid")
+	}
+	id, err := strconv.ParseInt(accountID, 10, 64)
+	if err != nil {
+		return nil, inputError("accountId query parameter is invalid")
+	}
+
+	report := &AccountReport{AccountID: id, Generated: time.Now().In(outputLocation).Format(queryDateLayout), Workloads: []*ReportWorkload{}}
+	accountQuery := "SELECT a.accountname, NVL(a.cimid, ' '), NVL(l.lookupdescription, ' ') FROM " + schema + ".Account a " +
+		"LEFT OUTER JOIN " + schema + ".Lookup l ON l.id = a.accountlob AND l.lookuptype = 'LOB' WHERE a.id = :1"
+	args := []interface{}{id}
+	if condition, scopeArgs := scope.accountCondition("a.id", 2); len(condition) > 0 {
+		accountQuery += " AND " + strings.ReplaceAll(condition, "%SCHEMA%", schema)
+		args = append(args, scopeArgs...)
+	}
+	err = DBPool.QueryRowContext(ctx, accountQuery, args...).Scan(&report.AccountName, &report.CimID, &report.LOB)
+	if err == sql.ErrNoRows {
+		return nil, errAccountNotFound
+	}
+	if err != nil {
+		thisError := fmt.Sprintf("Error reading account (%s, %d): %s", instanceEnv, id, err.Error())
+		return nil, errors.New(thisError)
+	}
+	report.CimID = strings.TrimSpace(report.CimID)
+	report.LOB = strings.TrimSpace(report.LOB)
+
+	query := ecalColorFunction + `
+		SELECT o.id, o.opportunityid, NVL(o.summary, ' '),
+			NVL((SELECT MIN(w.workloadtype) FROM %SCHEMA%.OpportunityWorkload w WHERE w.opportunity = o.id), 'None'),
+			` + ecalColorColumn + `,
+			NVL((SELECT stage FROM %SCHEMA%.EcalStage WHERE id = o.lateststagedone), 'None'),
+			NVL(o.technicallead, ' '),
+			NVL(os.status, 'No Status Entered'), TO_CHAR(os.creationdate, 'YYYY-MM-DD HH24:MI:SS'), NVL(os.lastupdatedby, ' ')
+		FROM %SCHEMA%.Opportunity o
+		LEFT OUTER JOIN %SCHEMA%.OpportunityTechHealth th ON th.opportunity = o.id
+		LEFT OUTER JOIN %SCHEMA%.OpportunityStatus os ON o.id = os.opportunity
+			AND NOT EXISTS (SELECT 1 FROM %SCHEMA%.OpportunityStatus os1 WHERE os1.opportunity = o.id AND os1.creationdate > os.creationdate)
+		WHERE o.account = :1
+		ORDER BY o.summary`
+	rows, err := DBPool.QueryContext(ctx, strings.ReplaceAll(query, "%SCHEMA%", schema), id)
+	if err != nil {
+		thisError := fmt.Sprintf("Error querying account workloads (%s, %d): %s", instanceEnv, id, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	byID := make(map[int64]*ReportWorkload)
+	for rows.Next() {
+		workload := &ReportWorkload{Artifacts: []ReportArtifact{}}
+		var statusDate sql.NullString
+		err := rows.Scan(&workload.WorkloadID, &workload.OpportunityID, &workload.Summary, &workload.WorkloadType, &workload.Color,
+			&workload.LatestStage, &workload.TechLead, &workload.LatestStatus, &statusDate, &workload.LatestStatusAuthor)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning account workload (%s, %d): %s", instanceEnv, id, err.Error())
+			return nil, errors.New(thisError)
+		}
+		workload.Summary = strings.TrimSpace(workload.Summary)
+		workload.TechLead = strings.TrimSpace(workload.TechLead)
+		workload.LatestStatusAuthor = strings.TrimSpace(workload.LatestStatusAuthor)
+		workload.LatestStatusDate = formatTimestamp(statusDate.String)
+		report.Workloads = append(report.Workloads, workload)
+		byID[workload.WorkloadID] = workload
+	}
+
+	rows, err = DBPool.QueryContext(ctx, `SELECT oa.opportunity, ra.name, TO_CHAR(oa.lastupdatedate, 'YYYY-MM-DD HH24:MI:SS'), NVL(oa.lastupdatedby, ' ')
+		FROM `+schema+`.OpportunityArtifacts oa
+		INNER JOIN `+schema+`.Opportunity o ON oa.opportunity = o.id
+		INNER JOIN `+schema+`.RequiredArtifacts ra ON oa.artifact = ra.id
+		WHERE o.account = :1
+		ORDER BY oa.lastupdatedate DESC`, id)
+	if err != nil {
+		thisError := fmt.Sprintf("Error querying account artifacts (%s, %d): %s", instanceEnv, id, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var workloadID int64
+		var artifact ReportArtifact
+		err := rows.Scan(&workloadID, &artifact.Type, &artifact.Uploaded, &artifact.UploadedBy)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning account artifact (%s, %d): %s", instanceEnv, id, err.Error())
+			return nil, errors.New(thisError)
+		}
+		artifact.Uploaded = formatTimestamp(artifact.Uploaded)
+		artifact.UploadedBy = strings.TrimSpace(artifact.UploadedBy)
+		if workload := byID[workloadID]; workload != nil {
+			workload.Artifacts = append(workload.Artifacts, artifact)
+		}
+	}
+
+	return report, nil
+}
+
+//
+// Renders an account report as a PDF
+//
+func renderAccountReport(report *AccountReport) []byte {
+	doc := newPDFDocument()
+	doc.write(report.AccountName, 18, true, 0)
+	doc.text(fmt.Sprintf("CIM ID: %s    LOB: %s    Generated: %s", report.CimID, report.LOB, report.Generated), 0)
+	doc.text(fmt.Sprintf("%d workloads", len(report.Workloads)), 0)
+
+	for _, workload := range report.Workloads {
+		doc.heading(workload.Summary)
+		color := reportColorNames[workload.Color]
+		if len(color) < 1 {
+			color = workload.Color
+		}
+		doc.text(fmt.Sprintf("Opportunity: %s    Type: %s    Color: %s", workload.OpportunityID, workload.WorkloadType, color), 0)
+		doc.text(fmt.Sprintf("Latest ECAL stage: %s    Tech lead: %s", workload.LatestStage, workload.TechLead), 0)
+		if len(workload.LatestStatusDate) > 0 {
+			doc.text(fmt.Sprintf("Latest status (%s, %s):", workload.LatestStatusDate, workload.LatestStatusAuthor), 0)
+		} else {
+			doc.text("Latest status:", 0)
+		}
+		doc.text(workload.LatestStatus, 15)
+		if len(workload.Artifacts) > 0 {
+			doc.text("Artifacts:", 0)
+			for _, artifact := range workload.Artifacts {
+				doc.text(fmt.Sprintf("%s - uploaded %s by %s", artifact.Type, artifact.Uploaded, artifact.UploadedBy), 15)
+			}
+		}
+	}
+	return doc.bytes()
+}
@@ -0,0 +1,178 @@
+//  ECAL Artifact Download
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/common"
+	"github.com/oracle/oci-go-sdk/objectstorage"
+)
+
+// errArtifactNotFound is returned when an artifact doesn't exist or is outside the caller's hierarchy
+var errArtifactNotFound = errors.New("artifact not found")
+
+//
+// HTTP handler for the getArtifact functionality.  Resolves an artifact's location and either returns a short-lived
+// pre-authenticated URL for it (mode=url, the default) or streams the file through this service (mode=stream).
+//
+func getArtifactHandler(w http.ResponseWriter, r *http.Request) {
+	// get query parameters
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	artifactID := query.Get("id")
+	mode := query.Get("mode")
+
+	// what the caller may see is decided from who they are, not from an isAdmin parameter
+	scope, err := requestAccess(r, DBPool, instanceEnv)
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "artifact_download", err.Error())
+		return
+	}
+
+	// find the artifact, making sure the caller is allowed to see it
+	location, err := getArtifactLocation(instanceEnv, artifactID, scope)
+	if err == errArtifactNotFound {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Artifact not found")
+		logRequest(r, logWarn, "artifact_download", fmt.Sprintf("Artifact %s not found or not visible (%s, %s)", artifactID, instanceEnv, scope))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "artifact_download", err.Error())
+		return
+	}
+
+	// artifacts that were linked from outside Object Storage can't be signed or streamed
+	object, err := parseObjectStorageURL(location)
+	if err != nil {
+		w.WriteHeader(409)
+		fmt.Fprintf(w, "Artifact is not stored in Object Storage")
+		logRequest(r, logWarn, "artifact_download", fmt.Sprintf("Artifact %s (%s): %s", artifactID, instanceEnv, err.Error()))
+		return
+	}
+
+	if mode == "stream" {
+		err = streamArtifact(r.Context(), w, object)
+		if err != nil {
+			logRequest(r, logError, "artifact_download", fmt.Sprintf("Error streaming artifact %s (%s): %s", artifactID, instanceEnv, err.Error()))
+		}
+		return
+	}
+
+	// default mode returns a pre-authenticated URL
+	signedURL, expires, err := createObjectReadURL(r.Context(), object)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "artifact_download", fmt.Sprintf("Error signing artifact %s (%s): %s", artifactID, instanceEnv, err.Error()))
+		return
+	}
+
+	result, _ := json.Marshal(map[string]string{"id": artifactID, "url": signedURL, "expires": expires.Format(time.RFC3339)})
+
+	// write result to output stream
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+//
+// Returns the stored location of an artifact.  The artifact's account must be in the scope; otherwise
+// errArtifactNotFound is returned.
+//
+func getArtifactLocation(instanceEnv string, artifactID string, scope accessScope) (string, error) {
+	if len(instanceEnv) < 1 || len(artifactID) < 1 {
+		thisError := fmt.Sprintf("instanceEnvironment or id query parameter is invalid (%s, %s)", instanceEnv, artifactID)
+		return "", errors.New(thisError)
+	}
+	if _, err := strconv.Atoi(artifactID); err != nil {
+		thisError := fmt.Sprintf("id query parameter is not numeric (%s, %s)", instanceEnv, artifactID)
+		return "", errors.New(thisError)
+	}
+
+	// set the core query
+	var template = `
+	SELECT a.location
+	FROM %SCHEMA%.OpportunityArtifacts a
+	INNER JOIN %SCHEMA%.Opportunity o ON a.opportunity = o.id
+	WHERE a.id = :1
+	`
+	// if the caller is not an admin (regular user or manager) then restrict to accounts in their hierarchy
+	condition, scopeArgs := scope.accountCondition("o.account", 2)
+	if len(condition) > 0 {
+		template += `
+		AND ` + condition + `
+		`
+	}
+
+	// replace the %SCHEMA% template with the correct schema name
+	query := strings.ReplaceAll(template, "%SCHEMA%", lookupSchema(instanceEnv))
+
+	// run the query
+	var location sql.NullString
+	err := DBPool.QueryRow(query, append([]interface{}{artifactID}, scopeArgs...)...).Scan(&location)
+	if err == sql.ErrNoRows || (err == nil && !location.Valid) {
+		return "", errArtifactNotFound
+	}
+	if err != nil {
+		thisError := fmt.Sprintf("Error running query (%s, %s, %s): %s", instanceEnv, artifactID, scope, err.Error())
+		return "", errors.New(thisError)
+	}
+
+	return location.String, nil
+}
+
+//
+// Copies an object from Object Storage to the response as a file download
+//
+func streamArtifact(ctx context.Context, w http.ResponseWriter, object objectLocation) error {
+	if ObjectStorage == nil {
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "Artifact storage is unavailable")
+		return errors.New("Object Storage client is not initialized")
+	}
+
+	response, err := ObjectStorage.GetObject(ctx, objectstorage.GetObjectRequest{
+		NamespaceName: common.String(object.Namespace),
+		BucketName:    common.String(object.Bucket),
+		ObjectName:    common.String(object.Object),
+	})
+	if err != nil {
+		w.WriteHeader(502)
+		fmt.Fprintf(w, "Unable to retrieve artifact")
+		return err
+	}
+	defer response.Content.Close()
+
+	if response.ContentType != nil {
+		w.Header().Set("Content-Type", *response.ContentType)
+	}
+	if response.ContentLength != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(*response.ContentLength, 10))
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(object.Object)))
+
+	_, err = io.Copy(w, response.Content)
+	return err
+}
@@ -5,92 +5,188 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 )
 
+// ECALArtifact is one artifact row of getECALArtifactQuery
+type ECALArtifact struct {
+	ID            dbNumber `json:"id"`
+	Account       string   `json:"account"`
+	OpportunityID string   `json:"opp_id"`
+	SolutionFocus string   `json:"solution_focus"`
+	ArtifactType  string   `json:"artifact_type"`
+	CE            string   `json:"ce"`
+	Uploaded      string   `json:"uploaded"`
+	Location      string   `json:"location"`
+}
+
 //
-// HTTP handler for the getECALDataQueryHandler functionality
+// Returns the HTTP handler for the getECALArtifactQuery functionality, which runs its queries against db
 //
-func getECALArtifactQueryHandler(w http.ResponseWriter, r *http.Request) {
-	// get query parameters
-	query := r.URL.Query()
-	instanceEnv := query.Get("instanceEnvironment")
+func getECALArtifactQueryHandler(db Store) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// get query parameters
+		query := r.URL.Query()
+		instanceEnv := query.Get("instanceEnvironment")
 
-	// call the helper which does the data mashing
-	result, err := getECALArtifactQuery(instanceEnv)
-	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator")
-		logOutput(logError, "ecal_artifact_query", string(err.Error()))
-		return
-	}
+		// what the caller may see is decided from who they are
+		scope, err := requestAccess(r, db, instanceEnv)
+		if queryCancelled(r.Context(), "ecal_artifact_query", err) {
+			return
+		}
+		if inputErr, ok := err.(inputError); ok {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", inputErr.Error())
+			return
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+			logRequest(r, logError, "ecal_artifact_query", err.Error())
+			return
+		}
 
-	// format the result as json
-	json := fmt.Sprintf("{\"items\": [%s]}", result)
+		maxRows, err := getMaxRows(query.Get("maxRows"))
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+		ndjson, err := ndjsonRequested(query)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+
+		// just the number of artifacts, e.g. for a badge, or for HEAD the count and latest upload time as headers
+		if countOnlyRequested(query) || r.Method == http.MethodHead {
+			count, err := countECALArtifactQuery(r.Context(), db, instanceEnv, scope)
+			writeQueryCount(w, r, "ecal_artifact_query", count, err)
+			return
+		}
 
-	// write result to output stream
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, string(json))
+		// call the helper which streams the rows straight to the output
+		out := newItemWriter(w, "{\"items\": [")
+		if ndjson {
+			out = newNDJSONWriter(w)
+		}
+		truncated, err := getECALArtifactQuery(r.Context(), db, instanceEnv, scope, maxRows, out)
+		if queryCancelled(r.Context(), "ecal_artifact_query", err) {
+			return
+		}
+		if err != nil && out.written() {
+			abortStreamedResponse("ecal_artifact_query", err)
+		}
+		if inputErr, ok := err.(inputError); ok {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", inputErr.Error())
+			return
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+			logRequest(r, logError, "ecal_artifact_query", string(err.Error()))
+			return
+		}
+		out.setPaging(truncated, "")
+		out.finish(fmt.Sprintf("], \"truncated\": %t}", truncated))
+	}
 }
 
 //
 // Returns artifacs to power the ECAL artifact curation admin function.
 // The instanceEnvironment identifier (sts-dev-preview, sts-prod-live, etc) is required to key the name of the ATP schema to query
+// Only the artifacts on the accounts in the caller's scope are returned.
+// Rows are written to out as they are read, at most maxRows of them; the bool result is true if more were available
 //
-func getECALArtifactQuery(instanceEnv string) (string, error) {
-	// inject the correct schema name into the query
-	if len(instanceEnv) < 1 {
-		thisError := fmt.Sprintf("[instanceEnvironment query parameter is invalid (%s)", instanceEnv)
-		return "", errors.New(thisError)
+func getECALArtifactQuery(ctx context.Context, db QueryRunner, instanceEnv string, scope accessScope, maxRows int, out *itemWriter) (bool, error) {
+	query, args, err := ecalArtifactQuerySQL(instanceEnv, scope)
+	if err != nil {
+		return false, err
 	}
 
-	// set the core query
-	var template = `select a.id, a.accountname account, o.opportunityid oppid, sf.name solutionfoucs, ra.name type, a.lastupdatedby ce, to_char(a.lastupdatedate, 'MM-DD-YYYY') uploaded, a.location url
-	from %SCHEMA%.opportunityartifacts a
-	inner join %SCHEMA%.opportunity o on a.opportunity = o.id
-	inner join %SCHEMA%.account a on o.account = a.id
-	inner join %SCHEMA%.opportunitysolutionfocu osf on osf.opportunity = o.id
-	inner join %SCHEMA%.solutionfocus sf on sf.id = osf.solutionfocus
-	inner join %SCHEMA%.requiredartifacts ra on a.artifact = ra.id
-	where round(cast(SYSDATE as DATE) - cast(a.lastupdatedate as date)) < 180
-	order by a.lastupdatedate desc`
-
-	var jsonResultTemplate = `{"id":"%s","account":"%s","opp_id":"%s","solution_focus":"%s","artifact_type":"%s","ce":"%s","uploaded":"%s","location":"%s"},`
-
-	// replace the %SCHEMA% template with the correct schema name
-	query := strings.ReplaceAll(template, "%SCHEMA%", SchemaMap[instanceEnv])
-	//fmt.Println(query)
-
-	// run the query
-	rows, err := DBPool.Query(query)
+	// run the query, timing it in case it is slow
+	timer := startQueryTimer("getECALArtifactQuery", instanceEnv)
+	rows, err := db.QueryContext(ctx, tagQuery("getECALArtifactQuery", instanceEnv, query), args...)
 	if err != nil {
 		thisError := fmt.Sprintf("Error running query (%s): %s", instanceEnv, err.Error())
-		return "", errors.New(thisError)
+		return false, errors.New(thisError)
 	}
 	defer rows.Close()
 
-	// vars to hold row results
-	var id, account, oppid, solutionfocus, artifactType, ce, uploaded, location string
-
 	// step through each row returned and add to the query filter using the correct format
-	result := ""
 	count := 0
+	truncated := false
 	for rows.Next() {
-		err := rows.Scan(&id, &account, &oppid, &solutionfocus, &artifactType, &ce, &uploaded, &location)
+		if count >= maxRows {
+			truncated = true
+			break
+		}
+		var item ECALArtifact
+		err := rows.Scan(&item.ID, &item.Account, &item.OpportunityID, &item.SolutionFocus, &item.ArtifactType, &item.CE, &item.Uploaded, &item.Location)
 		if err != nil {
 			thisError := fmt.Sprintf("Error scanning row (%s): %s", instanceEnv, err.Error())
-			return "", errors.New(thisError)
+			return false, errors.New(thisError)
 		}
 
-		result += fmt.Sprintf(jsonResultTemplate,
-			id, account, oppid, solutionfocus, artifactType, ce, uploaded, location)
+		item.Uploaded = formatTimestamp(item.Uploaded)
+		err = out.writeJSON(item)
+		if err != nil {
+			thisError := fmt.Sprintf("Error writing row (%s): %s", instanceEnv, err.Error())
+			return false, errors.New(thisError)
+		}
 		count++
 	}
 
-	// string the trailing 'or' field if it exists
-	result = strings.TrimSuffix(result, ",")
-	return result, nil
+	timer.done(count)
+	return truncated, nil
+}
+
+//
+// Returns the number of artifacts getECALArtifactQuery would return, ignoring maxRows, and the latest upload time
+//
+func countECALArtifactQuery(ctx context.Context, db QueryRunner, instanceEnv string, scope accessScope) (queryCount, error) {
+	query, args, err := ecalArtifactQuerySQL(instanceEnv, scope)
+	if err != nil {
+		return queryCount{}, err
+	}
+	return countQueryRows(ctx, db, query, "uploaded", args...)
+}
+
+//
+// Builds the query for the artifacts in the scope uploaded in the last 180 days and its bind arguments
+//
+func ecalArtifactQuerySQL(instanceEnv string, scope accessScope) (string, []interface{}, error) {
+	// inject the correct schema name into the query
+	if len(instanceEnv) < 1 {
+		thisError := fmt.Sprintf("[instanceEnvironment query parameter is invalid (%s)", instanceEnv)
+		return "", nil, errors.New(thisError)
+	}
+
+	// set the core query
+	var template = `select a.id, a.accountname account, o.opportunityid oppid, sf.name solutionfoucs, ra.name type, a.lastupdatedby ce, to_char(a.lastupdatedate, 'YYYY-MM-DD HH24:MI:SS') uploaded, a.location url
+	from %SCHEMA%.opportunityartifacts a
+	inner join %SCHEMA%.opportunity o on a.opportunity = o.id
+	inner join %SCHEMA%.account a on o.account = a.id
+	inner join %SCHEMA%.opportunitysolutionfocu osf on osf.opportunity = o.id
+	inner join %SCHEMA%.solutionfocus sf on sf.id = osf.solutionfocus
+	inner join %SCHEMA%.requiredartifacts ra on a.artifact = ra.id
+	where round(cast(SYSDATE as DATE) - cast(a.lastupdatedate as date)) < 180
+	`
+	// if the caller is not an admin (regular user or manager) then limit to the accounts of their hierarchy
+	condition, args := scope.accountCondition("o.account", 1)
+	if len(condition) > 0 {
+		template += `AND ` + condition + `
+	`
+	}
+	template += "order by a.lastupdatedate desc"
+
+	// replace the %SCHEMA% template with the correct schema name
+	query := strings.ReplaceAll(template, "%SCHEMA%", lookupSchema(instanceEnv))
+	return query, args, nil
 }
@@ -0,0 +1,125 @@
+//  ECAL Artifact Query Tests
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var testArtifactColumns = []string{"id", "account", "oppid", "solutionfoucs", "type", "ce", "uploaded", "url"}
+
+// expectArtifacts answers the artifact query with two artifacts, the latest first
+func expectArtifacts(mem *MemDB) {
+	mem.ExpectQuery(`from ECAL_TEST\.opportunityartifacts a`, testArtifactColumns,
+		[]interface{}{"31", "Acme Corp", "OPP-1001", "Analytics", "Architecture Diagram", "se.one@example.com", "2020-08-20 10:15:00", "https://example.com/acme/diagram.pdf"},
+		[]interface{}{"32", "Globex", "OPP-1002", "Integration", "Bill of Materials", "se.two@example.com", "2020-08-18 16:40:00", "https://example.com/globex/bom.xlsx"})
+}
+
+func TestGetECALArtifactQueryHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		client    string
+		params    string
+		admin     bool
+		userEmail string
+		status    int
+		rows      int
+		truncated bool
+	}{
+		{name: "user sees their hierarchy's artifacts", client: "vb", params: "&userEmail=se.one@example.com", userEmail: "se.one@example.com", status: 200, rows: 2},
+		{name: "admin sees every artifact", client: "vb", params: "&userEmail=admin@example.com", admin: true, status: 200, rows: 2},
+		{name: "unrestricted client without a user sees every artifact", client: "integration", status: 200, rows: 2},
+		{name: "maxRows truncates", client: "integration", params: "&maxRows=1", status: 200, rows: 1, truncated: true},
+		{name: "invalid maxRows", client: "integration", params: "&maxRows=none", status: 400},
+		{name: "invalid format", client: "integration", params: "&format=csv", status: 400},
+		{name: "untrusted client can't name a user", client: "other", params: "&userEmail=se.one@example.com", status: 400},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mem, db := newQueryTestStore(t)
+			expectAdminLookup(mem, test.admin)
+			expectArtifacts(mem)
+
+			w := serveQuery(getECALArtifactQueryHandler(db), test.client, "/getECALArtifactQuery?instanceEnvironment="+testInstanceEnv+test.params)
+			if w.Code != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, w.Code, w.Body.String())
+			}
+			if test.status != 200 {
+				if len(endpointStatements(mem)) > 0 {
+					t.Errorf("expected no query for a refused request, got %v", mem.Statements())
+				}
+				return
+			}
+
+			statement := checkScopedStatement(t, mem, test.userEmail)
+			if len(test.userEmail) > 0 && !strings.Contains(statement.Query, "AND o.account IN (") {
+				t.Errorf("expected the artifacts limited by opportunity account: %s", statement.Query)
+			}
+			response := decodeQueryResponse(t, w)
+			if len(response.Items) != test.rows || response.Truncated != test.truncated {
+				t.Fatalf("expected %d rows (truncated %t), got %d (truncated %t)", test.rows, test.truncated, len(response.Items), response.Truncated)
+			}
+			item := response.Items[0]
+			if item["id"] != 31.0 || item["opp_id"] != "OPP-1001" || item["uploaded"] != "2020-08-20T10:15:00+00:00" {
+				t.Errorf("unexpected first artifact: %v", item)
+			}
+		})
+	}
+}
+
+func TestGetECALArtifactQueryHandlerNDJSON(t *testing.T) {
+	mem, db := newQueryTestStore(t)
+	expectArtifacts(mem)
+
+	w := serveQuery(getECALArtifactQueryHandler(db), "integration", "/getECALArtifactQuery?instanceEnvironment="+testInstanceEnv+"&format=ndjson")
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("expected an ndjson content type, got %s", contentType)
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected an artifact per line, got %q", w.Body.String())
+	}
+	for _, line := range lines {
+		var item map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &item); err != nil || item["location"] == nil {
+			t.Errorf("line isn't an artifact: %s", line)
+		}
+	}
+}
+
+func TestGetECALArtifactQueryHandlerErrors(t *testing.T) {
+	mem, db := newQueryTestStore(t)
+	mem.ExpectError(`from ECAL_TEST\.opportunityartifacts a`, errors.New("ORA-03113: end-of-file on communication channel"))
+
+	w := serveQuery(getECALArtifactQueryHandler(db), "integration", "/getECALArtifactQuery?instanceEnvironment="+testInstanceEnv)
+	if w.Code != 500 {
+		t.Fatalf("expected 500, got %d: %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "ORA-") {
+		t.Errorf("database error leaked to the caller: %s", w.Body.String())
+	}
+}
+
+func TestGetECALArtifactQueryHandlerCountOnly(t *testing.T) {
+	mem, db := newQueryTestStore(t)
+	expectAdminLookup(mem, false)
+	mem.ExpectQuery(`SELECT COUNT\(\*\), MAX\(uploaded\) FROM \(`, []string{"count", "uploaded"}, []interface{}{"7", "2020-08-20 10:15:00"})
+
+	w := serveQuery(getECALArtifactQueryHandler(db), "vb", "/getECALArtifactQuery?instanceEnvironment="+testInstanceEnv+"&userEmail=se.one@example.com&countOnly=true")
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	response := decodeQueryResponse(t, w)
+	if response.Count == nil || *response.Count != 7 {
+		t.Errorf("expected a count of 7: %s", w.Body.String())
+	}
+	checkScopedStatement(t, mem, "se.one@example.com")
+}
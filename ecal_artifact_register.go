@@ -0,0 +1,160 @@
+//  ECAL Artifact Registration
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ArtifactRecord is the metadata for a newly uploaded artifact
+type ArtifactRecord struct {
+	OpportunityID int64  `json:"opportunity_id"`
+	ArtifactType  string `json:"artifact_type"`
+	Location      string `json:"location"`
+	Uploader      string `json:"uploader"`
+}
+
+//
+// HTTP handler for the postArtifact functionality.  Records an artifact against an ECAL opportunity and marks
+// the matching required artifact as done in a single transaction.
+//
+func postArtifactHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+	instanceEnv := r.URL.Query().Get("instanceEnvironment")
+
+	// decode the artifact metadata from the body
+	var record ArtifactRecord
+	err := json.NewDecoder(r.Body).Decode(&record)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Unable to parse artifact metadata")
+		logRequest(r, logError, "artifact_register", "Unable to decode body: "+err.Error())
+		return
+	}
+
+	// record the artifact
+	id, err := postArtifact(instanceEnv, record)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "artifact_register", err.Error())
+		return
+	}
+
+	message := fmt.Sprintf("Registered artifact %d (%s) for opportunity %d by %s in %s", id, record.ArtifactType, record.OpportunityID, record.Uploader, instanceEnv)
+	logRequest(r, logInfo, "artifact_register", message)
+
+	// write result to output stream
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{\"id\": %d}", id)
+}
+
+//
+// Validates the artifact metadata and records it in the instanceEnvironment's schema inside a transaction.
+// Returns the id of the new OpportunityArtifacts row.
+//
+func postArtifact(instanceEnv string, record ArtifactRecord) (int64, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 {
+		thisError := fmt.Sprintf("instanceEnvironment query parameter is invalid (%s)", instanceEnv)
+		return 0, errors.New(thisError)
+	}
+	if record.OpportunityID < 1 || len(record.ArtifactType) < 1 || len(record.Location) < 1 || len(record.Uploader) < 1 {
+		thisError := fmt.Sprintf("opportunity_id, artifact_type, location and uploader are required (%s, %+v)", instanceEnv, record)
+		return 0, errors.New(thisError)
+	}
+
+	// start a DB transaction
+	tx, err := DBPool.Begin()
+	if err != nil {
+		thisError := fmt.Sprintf("Error starting DB transaction (%s): %s", instanceEnv, err.Error())
+		return 0, errors.New(thisError)
+	}
+	defer tx.Rollback()
+
+	id, err := registerArtifact(tx, schema, record)
+	if err != nil {
+		thisError := fmt.Sprintf("Error registering artifact (%s, %+v): %s", instanceEnv, record, err.Error())
+		return 0, errors.New(thisError)
+	}
+
+	// complete the transaction
+	err = tx.Commit()
+	if err != nil {
+		thisError := fmt.Sprintf("Error committing transaction (%s, %+v): %s", instanceEnv, record, err.Error())
+		return 0, errors.New(thisError)
+	}
+	invalidateQueryCacheFor(instanceEnv)
+
+	return id, nil
+}
+
+//
+// Inserts the OpportunityArtifacts row and flips the OpportunityRequiredArti done flag for the artifact type
+// within an existing transaction.  The artifact type is matched against RequiredArtifacts.name.
+//
+func registerArtifact(tx *sql.Tx, schema string, record ArtifactRecord) (int64, error) {
+	// resolve the artifact type
+	var requiredArtifactID int64
+	err := tx.QueryRow("SELECT id FROM "+schema+".RequiredArtifacts WHERE name = :1", record.ArtifactType).Scan(&requiredArtifactID)
+	if err == sql.ErrNoRows {
+		return 0, errors.New("unknown artifact type " + record.ArtifactType)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// make sure the opportunity exists
+	var count int
+	err = tx.QueryRow("SELECT count(*) FROM "+schema+".Opportunity WHERE id = :1", record.OpportunityID).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("unknown opportunity %d", record.OpportunityID)
+	}
+
+	// record the artifact
+	var id int64
+	_, err = tx.Exec("INSERT INTO "+schema+".OpportunityArtifacts "+
+		"(opportunity, artifact, location, creationdate, lastupdatedate, createdby, lastupdatedby) "+
+		"VALUES (:1, :2, :3, SYSDATE, SYSDATE, :4, :4) RETURNING id INTO :5",
+		record.OpportunityID, requiredArtifactID, record.Location, strings.ToLower(record.Uploader), sql.Out{Dest: &id})
+	if err != nil {
+		return 0, err
+	}
+
+	// flip the required artifact's done flag, creating the row if the opportunity doesn't have one yet
+	result, err := tx.Exec("UPDATE "+schema+".OpportunityRequiredArti SET done = 1, lastupdatedate = SYSDATE, lastupdatedby = :1 "+
+		"WHERE opportunity = :2 AND requiredartifact = :3",
+		strings.ToLower(record.Uploader), record.OpportunityID, requiredArtifactID)
+	if err != nil {
+		return 0, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if updated == 0 {
+		_, err = tx.Exec("INSERT INTO "+schema+".OpportunityRequiredArti "+
+			"(opportunity, requiredartifact, done, creationdate, lastupdatedate, createdby, lastupdatedby) "+
+			"VALUES (:1, :2, 1, SYSDATE, SYSDATE, :3, :3)",
+			record.OpportunityID, requiredArtifactID, strings.ToLower(record.Uploader))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return id, nil
+}
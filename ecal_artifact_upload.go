@@ -0,0 +1,153 @@
+//  ECAL Artifact Upload
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/common"
+	"github.com/oracle/oci-go-sdk/objectstorage"
+)
+
+// default upload size limit when ArtifactMaxUploadMB is not set
+const defaultArtifactMaxUploadMB = 50
+
+// characters we don't allow in a single object key segment
+var unsafeKeyChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+//
+// HTTP handler for the uploadArtifact functionality.  Stores the request body in the artifact bucket under
+// {account}/{opportunity}/{type}/{date}/{filename} and records the artifact metadata against the opportunity.
+//
+func uploadArtifactHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+
+	// get query parameters
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	filename := query.Get("filename")
+	opportunityID, _ := strconv.ParseInt(query.Get("opportunityId"), 10, 64)
+	record := ArtifactRecord{
+		OpportunityID: opportunityID,
+		ArtifactType:  query.Get("artifactType"),
+		Uploader:      query.Get("uploader"),
+	}
+
+	// read the file, enforcing the upload size limit
+	maxMB := defaultArtifactMaxUploadMB
+	if len(GlobalConfig.ArtifactMaxUploadMB) > 0 {
+		maxMB, _ = strconv.Atoi(GlobalConfig.ArtifactMaxUploadMB)
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxMB)*1024*1024))
+	if err != nil {
+		w.WriteHeader(413)
+		fmt.Fprintf(w, "Unable to read artifact; files are limited to %d MB", maxMB)
+		logRequest(r, logError, "artifact_upload", "Unable to read body: "+err.Error())
+		return
+	}
+
+	id, location, err := uploadArtifact(r.Context(), instanceEnv, filename, r.Header.Get("Content-Type"), body, record)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "artifact_upload", err.Error())
+		return
+	}
+
+	message := fmt.Sprintf("Uploaded artifact %d (%d bytes) to %s by %s in %s", id, len(body), location, record.Uploader, instanceEnv)
+	logRequest(r, logInfo, "artifact_upload", message)
+
+	// write result to output stream
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{\"id\": %d, \"location\": %q}", id, location)
+}
+
+//
+// Puts the artifact into Object Storage and records its metadata.  If the metadata can't be written the object
+// is removed again so the bucket doesn't accumulate orphans.  Returns the new artifact id and its location.
+//
+func uploadArtifact(ctx context.Context, instanceEnv string, filename string, contentType string, body []byte, record ArtifactRecord) (int64, string, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 {
+		thisError := fmt.Sprintf("instanceEnvironment query parameter is invalid (%s)", instanceEnv)
+		return 0, "", errors.New(thisError)
+	}
+	if len(filename) < 1 || len(body) < 1 || record.OpportunityID < 1 || len(record.ArtifactType) < 1 || len(record.Uploader) < 1 {
+		thisError := fmt.Sprintf("filename, opportunityId, artifactType, uploader and a non-empty body are required (%s, %+v)", instanceEnv, record)
+		return 0, "", errors.New(thisError)
+	}
+	if ObjectStorage == nil || len(GlobalConfig.ArtifactNamespace) < 1 || len(GlobalConfig.ArtifactBucket) < 1 {
+		return 0, "", errors.New("artifact storage is not configured; check ArtifactNamespace/ArtifactBucket and Object Storage access")
+	}
+
+	// find the account and opportunity identifiers that make up the key
+	var accountID, oppID string
+	err := DBPool.QueryRow("SELECT a.id, o.opportunityid FROM "+schema+".Opportunity o INNER JOIN "+schema+".Account a ON a.id = o.account WHERE o.id = :1",
+		record.OpportunityID).Scan(&accountID, &oppID)
+	if err != nil {
+		thisError := fmt.Sprintf("Unable to find opportunity %d (%s): %s", record.OpportunityID, instanceEnv, err.Error())
+		return 0, "", errors.New(thisError)
+	}
+
+	object := objectLocation{
+		Namespace: GlobalConfig.ArtifactNamespace,
+		Bucket:    GlobalConfig.ArtifactBucket,
+		Object: strings.Join([]string{
+			safeKeySegment(accountID),
+			safeKeySegment(oppID),
+			safeKeySegment(record.ArtifactType),
+			time.Now().Format("2006-01-02"),
+			safeKeySegment(path.Base(filename)),
+		}, "/"),
+	}
+
+	// store the file
+	if len(contentType) < 1 {
+		contentType = "application/octet-stream"
+	}
+	err = putObject(ctx, object, contentType, body)
+	if err != nil {
+		thisError := fmt.Sprintf("Unable to store %s (%s): %s", object.Object, instanceEnv, err.Error())
+		return 0, "", errors.New(thisError)
+	}
+
+	// record the metadata, cleaning up the object if that fails
+	record.Location = objectStorageURL(object)
+	id, err := postArtifact(instanceEnv, record)
+	if err != nil {
+		_, deleteErr := ObjectStorage.DeleteObject(ctx, objectstorage.DeleteObjectRequest{
+			NamespaceName: common.String(object.Namespace),
+			BucketName:    common.String(object.Bucket),
+			ObjectName:    common.String(object.Object),
+		})
+		if deleteErr != nil {
+			logOutput(logWarn, "artifact_upload", fmt.Sprintf("Unable to remove orphaned object %s: %s", object.Object, deleteErr.Error()))
+		}
+		return 0, "", err
+	}
+
+	return id, record.Location, nil
+}
+
+//
+// Collapses anything other than letters, digits, dot, dash and underscore into a single underscore so user supplied
+// values can't introduce extra path segments into an object key
+//
+func safeKeySegment(value string) string {
+	return strings.Trim(unsafeKeyChars.ReplaceAllString(strings.TrimSpace(value), "_"), "_")
+}
@@ -0,0 +1,275 @@
+//  ECAL Consumption Plan vs Actual
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the most months getConsumptionVsPlan will return in one call
+const maxConsumptionMonths = 36
+
+// ConsumptionMonth is the planned and actual consumption of one month
+type ConsumptionMonth struct {
+	Month   string  `json:"month"`
+	Planned float64 `json:"planned"`
+	Actual  float64 `json:"actual"`
+}
+
+// AccountConsumption is the month by month plan vs actual of one ECAL account
+type AccountConsumption struct {
+	AccountID   int64              `json:"account_id"`
+	AccountName string             `json:"account_name"`
+	CimID       string             `json:"cim_id"`
+	Months      []ConsumptionMonth `json:"months"`
+}
+
+//
+// HTTP handler for the getConsumptionVsPlan functionality.  Compares the consumption ramp planned on the ECAL workloads
+// of an account (accountId) or of every account in a manager's hierarchy (managerEmail) against the actual usage in
+// LookupConsumption, month by month.
+//
+func getConsumptionVsPlanHandler(w http.ResponseWriter, r *http.Request) {
+	// get query parameters
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	accountID := query.Get("accountId")
+	managerEmail := query.Get("managerEmail")
+
+	// only the accounts the caller may see are planned, whichever accountId or managerEmail they ask for
+	scope, err := requestAccess(r, DBPool, instanceEnv)
+	if queryCancelled(r.Context(), "consumption_plan", err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "consumption_plan", err.Error())
+		return
+	}
+
+	// call the helper which does the data mashing
+	result, err := getConsumptionVsPlan(r.Context(), instanceEnv, scope, accountID, managerEmail, query.Get("fromMonth"), query.Get("toMonth"))
+	if queryCancelled(r.Context(), "consumption_plan", err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "consumption_plan", err.Error())
+		return
+	}
+
+	// write result to output stream
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+//
+// Returns the plan vs actual of each account in scope along with their total.  fromMonth and toMonth are YYYY-MM and
+// default to the last 12 months.  A workload's plan ramps linearly from its consumption start date to a monthly run
+// rate of workloadamount / 12 over its ramp months.  Accounts outside the caller's scope are left out.
+//
+func getConsumptionVsPlan(ctx context.Context, instanceEnv string, scope accessScope, accountID string, managerEmail string, fromMonth string, toMonth string) ([]byte, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		return nil, inputError("instanceEnvironment query parameter is invalid")
+	}
+	if len(accountID) < 1 && len(managerEmail) < 1 {
+		return nil, inputError("one of accountId or managerEmail is required")
+	}
+	if _, err := strconv.ParseInt(accountID, 10, 64); len(accountID) > 0 && err != nil {
+		return nil, inputError("accountId query parameter is invalid")
+	}
+	months, err := consumptionMonths(fromMonth, toMonth)
+	if err != nil {
+		return nil, err
+	}
+
+	// the accounts in scope
+	accountFilter := "a.id = :1"
+	args := []interface{}{accountID}
+	if len(accountID) < 1 {
+		accountFilter = `a.id IN (SELECT ua.account FROM %SCHEMA%.User1 u INNER JOIN %SCHEMA%.UserAccount ua ON ua.user1 = u.id
+			WHERE u.useremail = :1 OR u.manager IN (SELECT c.reportemail FROM %SCHEMA%.ManagerClosure c WHERE c.manageremail = :1))`
+		args = []interface{}{managerEmail}
+	}
+	if condition, scopeArgs := scope.accountCondition("a.id", len(args)+1); len(condition) > 0 {
+		accountFilter += " AND " + condition
+		args = append(args, scopeArgs...)
+	}
+	accountFilter = strings.ReplaceAll(accountFilter, "%SCHEMA%", schema)
+
+	accounts := []*AccountConsumption{}
+	byID := make(map[int64]*AccountConsumption)
+	rows, err := DBPool.QueryContext(ctx, "SELECT a.id, a.accountname, NVL(a.cimid, ' ') FROM "+schema+".Account a WHERE "+accountFilter+
+		" ORDER BY a.accountname", args...)
+	if err != nil {
+		thisError := fmt.Sprintf("Error querying accounts (%s, %s, %s): %s", instanceEnv, accountID, managerEmail, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		account := &AccountConsumption{}
+		err := rows.Scan(&account.AccountID, &account.AccountName, &account.CimID)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning account (%s): %s", instanceEnv, err.Error())
+			return nil, errors.New(thisError)
+		}
+		account.CimID = strings.TrimSpace(account.CimID)
+		for _, month := range months {
+			account.Months = append(account.Months, ConsumptionMonth{Month: month.Format(queryDateLayout)})
+		}
+		accounts = append(accounts, account)
+		byID[account.AccountID] = account
+	}
+
+	// planned ramp of each workload whose revenue line is still in the feed
+	rows, err = DBPool.QueryContext(ctx, `SELECT a.id, TO_CHAR(w.consumptionstartdate, 'YYYY-MM-DD'),
+			NVL(w.consumptionrampmonths, 0), NVL(l.workloadamount, 0)
+		FROM `+schema+`.Account a
+		INNER JOIN `+schema+`.Opportunity o ON o.account = a.id
+		INNER JOIN `+schema+`.OpportunityWorkload w ON w.opportunity = o.id
+		INNER JOIN `+schema+`.LookupOpportunity l ON l.opportunityid = o.opportunityid AND l.revenuelineid = w.workloadidentifier AND l.active = 1
+		WHERE w.consumptionstartdate IS NOT NULL AND `+accountFilter, args...)
+	if err != nil {
+		thisError := fmt.Sprintf("Error querying consumption plans (%s, %s, %s): %s", instanceEnv, accountID, managerEmail, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var startDate string
+		var rampMonths, amount float64
+		err := rows.Scan(&id, &startDate, &rampMonths, &amount)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning consumption plan (%s): %s", instanceEnv, err.Error())
+			return nil, errors.New(thisError)
+		}
+		start, err := time.Parse(queryDateLayout, startDate)
+		if err != nil || byID[id] == nil {
+			continue
+		}
+		start = time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC)
+		for i, month := range months {
+			byID[id].Months[i].Planned += plannedConsumption(start, rampMonths, amount/12, month)
+		}
+	}
+
+	// actual usage
+	usageQuery := fmt.Sprintf(`SELECT a.id, TO_CHAR(c.usagemonth, 'YYYY-MM-DD'), SUM(c.actualusage)
+		FROM %s.Account a
+		INNER JOIN %s.LookupConsumption c ON c.cimid = a.cimid
+		WHERE %s AND c.usagemonth BETWEEN TO_DATE(:%d, 'YYYY-MM-DD') AND TO_DATE(:%d, 'YYYY-MM-DD')
+		GROUP BY a.id, c.usagemonth`, schema, schema, accountFilter, len(args)+1, len(args)+2)
+	usageArgs := append(append([]interface{}{}, args...), months[0].Format(queryDateLayout), months[len(months)-1].Format(queryDateLayout))
+	rows, err = DBPool.QueryContext(ctx, usageQuery, usageArgs...)
+	if err != nil {
+		thisError := fmt.Sprintf("Error querying consumption actuals (%s, %s, %s): %s", instanceEnv, accountID, managerEmail, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var month string
+		var actual float64
+		err := rows.Scan(&id, &month, &actual)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning consumption actual (%s): %s", instanceEnv, err.Error())
+			return nil, errors.New(thisError)
+		}
+		if byID[id] == nil {
+			continue
+		}
+		for i := range byID[id].Months {
+			if byID[id].Months[i].Month == month {
+				byID[id].Months[i].Actual += actual
+			}
+		}
+	}
+
+	// roll the accounts up into the total
+	total := []ConsumptionMonth{}
+	for i, month := range months {
+		sum := ConsumptionMonth{Month: month.Format(queryDateLayout)}
+		for _, account := range accounts {
+			account.Months[i].Planned = math.Round(account.Months[i].Planned*100) / 100
+			sum.Planned += account.Months[i].Planned
+			sum.Actual += account.Months[i].Actual
+		}
+		sum.Planned = math.Round(sum.Planned*100) / 100
+		total = append(total, sum)
+	}
+
+	return json.Marshal(map[string]interface{}{"accounts": accounts, "total": total})
+}
+
+//
+// Returns the planned consumption in month of a workload that starts consuming in start and reaches runRate after
+// rampMonths
+//
+func plannedConsumption(start time.Time, rampMonths float64, runRate float64, month time.Time) float64 {
+	elapsed := float64((month.Year()-start.Year())*12 + int(month.Month()) - int(start.Month()))
+	if elapsed < 0 {
+		return 0
+	}
+	if rampMonths < 1 || elapsed+1 >= rampMonths {
+		return runRate
+	}
+	return runRate * (elapsed + 1) / rampMonths
+}
+
+//
+// Returns the first day of each month from fromMonth to toMonth (YYYY-MM), defaulting to the last 12 months
+//
+func consumptionMonths(fromMonth string, toMonth string) ([]time.Time, error) {
+	now := time.Now().UTC()
+	to := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if len(toMonth) > 0 {
+		parsed, err := time.Parse("2006-01", toMonth)
+		if err != nil {
+			return nil, inputError("toMonth must be YYYY-MM")
+		}
+		to = parsed
+	}
+	from := to.AddDate(0, -11, 0)
+	if len(fromMonth) > 0 {
+		parsed, err := time.Parse("2006-01", fromMonth)
+		if err != nil {
+			return nil, inputError("fromMonth must be YYYY-MM")
+		}
+		from = parsed
+	}
+	if from.After(to) {
+		return nil, inputError("fromMonth must not be after toMonth")
+	}
+
+	months := []time.Time{}
+	for month := from; !month.After(to); month = month.AddDate(0, 1, 0) {
+		months = append(months, month)
+	}
+	if len(months) > maxConsumptionMonths {
+		return nil, inputError(fmt.Sprintf("at most %d months can be requested", maxConsumptionMonths))
+	}
+	return months, nil
+}
@@ -5,50 +5,18 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
-//
-// HTTP handler for the getECALDataQueryHandler functionality
-//
-func getECALDataQueryHandler(w http.ResponseWriter, r *http.Request) {
-	// get query parameters
-	query := r.URL.Query()
-	instanceEnv := query.Get("instanceEnvironment")
-
-	// call the helper which does the data mashing
-	result, err := getECALDataQuery(instanceEnv)
-	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator")
-		logOutput(logError, "ecal_data_query", string(err.Error()))
-		return
-	}
-
-	// format the result as json
-	json := fmt.Sprintf("{\"items\": [%s]}", result)
-
-	// write result to output stream
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, string(json))
-}
-
-//
-// Returns data to power the ECAL application.  Specifically returns a list of accounts that should be presented to the user of the app.
-// The instanceEnvironment identifier (sts-dev-preview, sts-prod-live, etc) is required to key the name of the ATP schema to query
-//
-func getECALDataQuery(instanceEnv string) (string, error) {
-	// inject the correct schema name into the query
-	if len(instanceEnv) < 1 {
-		thisError := fmt.Sprintf("instanceEnvironment query parameter is invalid (%s)", instanceEnv)
-		return "", errors.New(thisError)
-	}
-
-	// set the core query
-	var template = `with function calculateColor(adopter varchar2, implementer varchar2, logarch number, archdiag number, bom number, poc number, pocstatus varchar2, secsignoff number, 
+// PL/SQL function used by the ECAL queries to score the tech health of a workload as R, Y or G.  Prefix the query
+// with it and select ecalColorColumn.
+const ecalColorFunction = `with function calculateColor(adopter varchar2, implementer varchar2, logarch number, archdiag number, bom number, poc number, pocstatus varchar2, secsignoff number, 
 		techsignoff number, consplan number, consplansignoff number, ccInvolved number, ccSar number) return char is
 totalCount number := 10;
 score number := 0;
@@ -100,16 +68,10 @@ else
 return 'G';
 end if;
 end;
-		select  
-			distinct(o.id) as ecal_workload_id,
-			a.id as ecal_account_id,
-			o.opportunityid as opportunity_id,
-			nvl(w.workloadtype, 'None') as workload_type,
-			w.workloadidentifier as workload_identifier,
-			a.accountname as account_name,
-			a.cimid as cim_id,
-			o.summary as workload_summary,    
-			calculateColor(
+`
+
+// the calculateColor call for a workload o joined to its OpportunityTechHealth th
+const ecalColorColumn = `calculateColor(
 				th.adoptionowneremail,
 				th.implementeremail,
 				(select ora1.done from %SCHEMA%.opportunityrequiredarti ora1 inner join %SCHEMA%.requiredartifacts ra1 ON ora1.requiredartifact = ra1.id where o.id = ora1.opportunity and ra1.name = 'Logical Architecture'),
@@ -122,14 +84,298 @@ end;
 				(select ora4.done from %SCHEMA%.opportunityrequiredarti ora4 inner join %SCHEMA%.requiredartifacts ra4 ON ora4.requiredartifact = ra4.id where o.id = ora4.opportunity and ra4.name = 'Consumption Plan'), 
 				nvl(th.consumptionplansignoff, 0),
 				nvl(th.cloudatcustomerinvolved, 0), 
-				nvl(th.cloudatcustomersardone, 0))
+				nvl(th.cloudatcustomersardone, 0))`
+
+// the filters and sort orders of getECALDataQuery.  The sort expressions are strings as they are the cursor's key.
+var ecalDataQueryColumns = queryColumns{
+	filters: map[string]filterColumn{
+		"accountName": {expression: "a.accountname", contains: true},
+		"color":       {expression: ecalColorColumn, values: []string{"R", "Y", "G"}},
+		"stage":       {expression: "nvl((select stage FROM %SCHEMA%.EcalStage where id = o.lateststagedone), 'None')"},
+		"techLead":    {expression: "o.technicallead"},
+	},
+	sorts: map[string]string{
+		"lastUpdate":  "to_char(o.lastupdatedate, 'YYYY-MM-DD HH24:MI:SS')",
+		"accountName": "nvl(upper(a.accountname), ' ')",
+		"stage":       "lpad(nvl(o.lateststagedone, 0), 10, '0')",
+		"techLead":    "nvl(lower(o.technicallead), ' ')",
+	},
+	defaultSort: "lastUpdate",
+}
+
+// ECALWorkload is one workload row of getECALDataQuery
+type ECALWorkload struct {
+	WorkloadID                dbNumber `json:"ecal_workload_id"`
+	AccountID                 dbNumber `json:"ecal_account_id"`
+	OpportunityID             string   `json:"opportunity_id"`
+	WorkloadType              string   `json:"workload_type"`
+	WorkloadIdentifier        string   `json:"workload_identifier"`
+	AccountName               string   `json:"account_name"`
+	CimID                     string   `json:"cim_id"`
+	WorkloadSummary           string   `json:"workload_summary"`
+	Color                     string   `json:"color"`
+	LatestECALStageDone       string   `json:"latest_ecal_stage_done"`
+	CSAExecuted               dbNumber `json:"csa_executed"`
+	TechLead                  string   `json:"tech_lead"`
+	TechManager               string   `json:"tech_manager"`
+	POCRequired               dbNumber `json:"poc_required"`
+	POCEndDate                string   `json:"poc_enddate"`
+	POCStatus                 string   `json:"poc_status"`
+	POCResolution             string   `json:"poc_resolution"`
+	SecuritySignoff           dbNumber `json:"security_signoff"`
+	TechnicalSignoff          dbNumber `json:"technical_signoff"`
+	ConsPlanSignoff           dbNumber `json:"cons_plan_signoff"`
+	CCInvolved                dbNumber `json:"cc_involved"`
+	CCDone                    dbNumber `json:"cc_done"`
+	TechBlockers              dbNumber `json:"tech_blockers"`
+	CommercialBlockers        dbNumber `json:"commercial_blockers"`
+	CovidImpact               dbNumber `json:"covid_impact"`
+	OCSEngaged                dbNumber `json:"ocs_engaged"`
+	Expansion                 dbNumber `json:"expansion"`
+	TechDecider               string   `json:"tech_decider"`
+	TechSignoffDate           string   `json:"tech_signoff_date"`
+	MigrationBy               string   `json:"migration_by"`
+	PartnerName               string   `json:"partner_name"`
+	WorkloadProgression       string   `json:"workload_progression"`
+	AdopterEmail              string   `json:"adopter_email"`
+	AdopterName               string   `json:"adopter_name"`
+	ImplementerEmail          string   `json:"implementer_email"`
+	ImplementerName           string   `json:"implementer_name"`
+	FutureStateComplete       dbNumber `json:"future_state_complete"`
+	CurrentStateComplete      dbNumber `json:"current_state_complete"`
+	ConsumptionPlanComplete   dbNumber `json:"consumption_plan_complete"`
+	LatestStatus              string   `json:"latest_status"`
+	LatestStatusDate          string   `json:"latest_status_date"`
+	LatestStatusAuthor        string   `json:"latest_status_author"`
+	LatestStageDone           dbNumber `json:"latest_stage_done"`
+	CurrentPhase              dbNumber `json:"current_phase"`
+	ResourceList              string   `json:"resource_list"`
+	TechLeadList              string   `json:"techlead_list"`
+	ClassifiedWorkload        dbNumber `json:"classified_workload"`
+	ClassifiedWorkloadComment string   `json:"classified_workload_comment"`
+	POCExaRequired            dbNumber `json:"poc_exa_required"`
+	POCStartDate              string   `json:"poc_startdate"`
+	Realm                     string   `json:"realm"`
+}
+
+//
+// Returns the HTTP handler for the getECALDataQuery functionality, which runs its queries against db
+//
+func getECALDataQueryHandler(db Store) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// get query parameters
+		query := r.URL.Query()
+		instanceEnv := query.Get("instanceEnvironment")
+
+		// what the caller may see is decided from who they are
+		scope, err := requestAccess(r, db, instanceEnv)
+		if queryCancelled(r.Context(), "ecal_data_query", err) {
+			return
+		}
+		if inputErr, ok := err.(inputError); ok {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", inputErr.Error())
+			return
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+			logRequest(r, logError, "ecal_data_query", err.Error())
+			return
+		}
+
+		maxRows, err := getMaxRows(query.Get("maxRows"))
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+		ndjson, err := ndjsonRequested(query)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+		cursor, err := decodeCursor(query.Get("cursor"))
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+		filters, err := parseQueryFilters(query, ecalDataQueryColumns)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+
+		updatedSince := query.Get("updatedSince")
+
+		// just the number of workloads, e.g. for a badge or to set up paging, or for HEAD the count and last update
+		// time as headers
+		if countOnlyRequested(query) || r.Method == http.MethodHead {
+			count, err := countECALDataQuery(r.Context(), db, instanceEnv, scope, filters, cursor, updatedSince)
+			writeQueryCount(w, r, "ecal_data_query", count, err)
+			return
+		}
+
+		// the first page of the caller's list may be cached, warmed after the last data load or from their last request
+		cacheKey := queryCacheKey("getECALDataQuery", instanceEnv, scope, maxRows)
+		cacheable := !ndjson && filters.empty() && len(cursor.ID) < 1 && len(updatedSince) < 1
+		if cacheable {
+			rememberWarmScope(instanceEnv, scope)
+			if cached, ok := getCachedQuery(cacheKey); ok {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, "{\"items\": [%s], \"truncated\": %t, \"next_cursor\": \"%s\"}", cached.result, cached.truncated, cached.nextCursor)
+				return
+			}
+		}
+
+		// call the helper which streams the rows straight to the output
+		out := newItemWriter(w, "{\"items\": [")
+		if ndjson {
+			out = newNDJSONWriter(w)
+		}
+		if cacheable {
+			out.capture()
+		}
+		nextCursor, err := getECALDataQuery(r.Context(), db, instanceEnv, scope, filters, maxRows, cursor, updatedSince, out)
+		if queryCancelled(r.Context(), "ecal_data_query", err) {
+			return
+		}
+		if err != nil && out.written() {
+			abortStreamedResponse("ecal_data_query", err)
+		}
+		if inputErr, ok := err.(inputError); ok {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", inputErr.Error())
+			return
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+			logRequest(r, logError, "ecal_data_query", string(err.Error()))
+			return
+		}
+		if cacheable {
+			putCachedQuery(cacheKey, instanceEnv, queryCacheEntry{result: out.capturedItems(), truncated: len(nextCursor) > 0, nextCursor: nextCursor})
+		}
+		out.setPaging(len(nextCursor) > 0, nextCursor)
+		out.finish(fmt.Sprintf("], \"truncated\": %t, \"next_cursor\": \"%s\"}", len(nextCursor) > 0, nextCursor))
+	}
+}
+
+//
+// Returns data to power the ECAL application.  Specifically returns a list of accounts that should be presented to the user of the app.
+// The instanceEnvironment identifier (sts-dev-preview, sts-prod-live, etc) is required to key the name of the ATP schema to query
+// Rows are written to out as they are read in (lastupdatedate, id) order starting after cursor, at most maxRows at a time.  When more are
+// available the cursor of the last row returned is passed back (encoded) so the caller can ask for the next page;
+// a workload updated while the caller is paging moves to the end and is returned again rather than being missed.
+// If updatedSince is set only workloads updated after it are returned, so polling integrations can pull just the changes.
+// Only the workloads on the accounts in the caller's scope matching the filters are returned; with a sortBy they are
+// returned in that order instead, the cursor carrying the sort key.
+//
+func getECALDataQuery(ctx context.Context, db QueryRunner, instanceEnv string, scope accessScope, filters queryFilters, maxRows int, cursor pageCursor, updatedSince string, out *itemWriter) (string, error) {
+	query, args, err := ecalDataQuerySQL(instanceEnv, scope, filters, cursor, updatedSince)
+	if err != nil {
+		return "", err
+	}
+
+	// run the query, timing it in case it is slow
+	timer := startQueryTimer("getECALDataQuery", instanceEnv)
+	rows, err := db.QueryContext(ctx, tagQuery("getECALDataQuery", instanceEnv, query), args...)
+	if err != nil {
+		thisError := fmt.Sprintf("Error running query (%s): %s", instanceEnv, err.Error())
+		return "", errors.New(thisError)
+	}
+	defer rows.Close()
+
+	// step through each row returned and add to the query filter using the correct format
+	var lastUpdate, sortKey string
+	count := 0
+	nextCursor := ""
+	last := pageCursor{}
+	for rows.Next() {
+		var item ECALWorkload
+		err := rows.Scan(&item.WorkloadID, &item.AccountID, &item.OpportunityID, &item.WorkloadType, &item.WorkloadIdentifier, &item.AccountName, &item.CimID, &item.WorkloadSummary, &item.Color, &item.LatestECALStageDone,
+			&item.CSAExecuted, &item.TechLead, &item.TechManager, &item.POCRequired, &item.POCEndDate, &item.POCStatus, &item.POCResolution, &item.SecuritySignoff, &item.TechnicalSignoff, &item.ConsPlanSignoff,
+			&item.CCInvolved, &item.CCDone, &item.TechBlockers, &item.CommercialBlockers, &item.CovidImpact, &item.OCSEngaged, &item.Expansion, &item.TechDecider, &item.TechSignoffDate, &item.MigrationBy,
+			&item.PartnerName, &item.WorkloadProgression, &item.AdopterEmail, &item.AdopterName, &item.ImplementerEmail, &item.ImplementerName, &item.FutureStateComplete, &item.CurrentStateComplete, &item.ConsumptionPlanComplete, &item.LatestStatus, &item.LatestStatusDate, &item.LatestStatusAuthor,
+			&item.LatestStageDone, &item.CurrentPhase, &item.ResourceList, &item.TechLeadList, &item.ClassifiedWorkload, &item.ClassifiedWorkloadComment, &item.POCExaRequired, &item.POCStartDate, &item.Realm, &lastUpdate, &sortKey)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning row (%s): %s", instanceEnv, err.Error())
+			return "", errors.New(thisError)
+		}
+
+		// a workload can span several rows so only end the page between workloads
+		if count >= maxRows && string(item.WorkloadID) != last.ID {
+			nextCursor = encodeCursor(last)
+			break
+		}
+		last = pageCursor{ID: string(item.WorkloadID), Updated: lastUpdate}
+		if len(filters.sortBy) > 0 {
+			last = pageCursor{ID: string(item.WorkloadID), Key: sortKey, Sort: filters.sortID()}
+		}
+
+		item.POCEndDate = formatDate("getECALDataQuery", item.POCEndDate)
+		item.TechSignoffDate = formatDate("getECALDataQuery", item.TechSignoffDate)
+		item.LatestStatusDate = formatTimestamp(item.LatestStatusDate)
+		item.POCStartDate = formatDate("getECALDataQuery", item.POCStartDate)
+		err = out.writeJSON(item)
+		if err != nil {
+			thisError := fmt.Sprintf("Error writing row (%s): %s", instanceEnv, err.Error())
+			return "", errors.New(thisError)
+		}
+		count++
+	}
+
+	timer.done(count)
+	return nextCursor, nil
+}
+
+//
+// Returns the number of rows getECALDataQuery would return after cursor (and since updatedSince), ignoring maxRows,
+// and when the most recently updated workload among them was last updated
+//
+func countECALDataQuery(ctx context.Context, db QueryRunner, instanceEnv string, scope accessScope, filters queryFilters, cursor pageCursor, updatedSince string) (queryCount, error) {
+	query, args, err := ecalDataQuerySQL(instanceEnv, scope, filters, cursor, updatedSince)
+	if err != nil {
+		return queryCount{}, err
+	}
+	return countQueryRows(ctx, db, query, "last_update", args...)
+}
+
+//
+// Builds the workload query for the scope and filters, starting after cursor and optionally limited to workloads
+// updated after updatedSince, and its bind arguments
+//
+func ecalDataQuerySQL(instanceEnv string, scope accessScope, filters queryFilters, cursor pageCursor, updatedSince string) (string, []interface{}, error) {
+	// inject the correct schema name into the query
+	if len(instanceEnv) < 1 {
+		thisError := fmt.Sprintf("instanceEnvironment query parameter is invalid (%s)", instanceEnv)
+		return "", nil, errors.New(thisError)
+	}
+	sortKey, sortOrder := filters.order(ecalDataQueryColumns)
+
+	// set the core query
+	var template = ecalColorFunction + `
+		select  
+			distinct(o.id) as ecal_workload_id,
+			a.id as ecal_account_id,
+			o.opportunityid as opportunity_id,
+			nvl(w.workloadtype, 'None') as workload_type,
+			w.workloadidentifier as workload_identifier,
+			a.accountname as account_name,
+			a.cimid as cim_id,
+			o.summary as workload_summary,    
+			` + ecalColorColumn + `
 			as color,
 			nvl((select stage FROM %SCHEMA%.EcalStage where id = o.lateststagedone), 'None') as latest_ecal_stage_done,
 			nvl(a.currentcsaexecuted, 0) as csa_executed,
 			o.technicallead as tech_lead,
 			u.manager as tech_manager,
 			nvl(th.pocrequired, 0) as poc_required,
-			to_char(th.pocenddate, 'MM-DD-YYYY') as poc_enddate,
+			to_char(th.pocenddate, 'YYYY-MM-DD') as poc_enddate,
 			nvl(th.pocstatus, 'Not Started') as poc_status,
 			nvl(th.pocresolution, 'None') as poc_resolution,
 			nvl(th.securitysignoffdone, 0) as security_signoff,
@@ -142,15 +388,15 @@ end;
 			nvl(th.coronavirusimpact, 0) as covid_impact,
 			nvl(th.oracleconsultingengaged, 0) as ocs_engaged,
 			nvl(th.expansion, 0) as expansion,
-			translate(th.technicaldecisionmakern, chr(9)||chr(10)||chr(11)||chr(13)||chr(34), '  ') as tech_decider,
-			to_char(th.technicalsignoffdate, 'MM-DD-YYYY') as tech_signoff_date,
-			translate(th.migrationrunby, chr(9)||chr(10)||chr(11)||chr(13)||chr(34), '  ') as migration_by,
-			translate(th.partnername, chr(9)||chr(10)||chr(11)||chr(13)||chr(34), '  ') as partner_name,
-			translate(th.workloadprogressionstage, chr(9)||chr(10)||chr(11)||chr(13)||chr(34), '  ') as workload_progression,
-			translate(th.adoptionowneremail, chr(9)||chr(10)||chr(11)||chr(13)||chr(34), '  ') as adopter_email,
-			translate(th.adoptionownernametitle, chr(9)||chr(10)||chr(11)||chr(13)||chr(34), '  ') as adopter_name,
-			translate(th.implementeremail, chr(9)||chr(10)||chr(11)||chr(13)||chr(34), '  ') as implementer_email,
-			translate(th.implementernametitle, chr(9)||chr(10)||chr(11)||chr(13)||chr(34), '  ') as implementer_name,
+			th.technicaldecisionmakern as tech_decider,
+			to_char(th.technicalsignoffdate, 'YYYY-MM-DD') as tech_signoff_date,
+			th.migrationrunby as migration_by,
+			th.partnername as partner_name,
+			th.workloadprogressionstage as workload_progression,
+			th.adoptionowneremail as adopter_email,
+			th.adoptionownernametitle as adopter_name,
+			th.implementeremail as implementer_email,
+			th.implementernametitle as implementer_name,
 			(select ora1.done
 			FROM %SCHEMA%.OpportunityRequiredArti ora1
 			INNER JOIN %SCHEMA%.RequiredArtifacts ra1 ON ora1.requiredartifact = ra1.id
@@ -166,8 +412,8 @@ end;
 			FROM %SCHEMA%.OpportunityRequiredArti ora3
 			INNER JOIN %SCHEMA%.RequiredArtifacts ra3 ON ora3.requiredartifact = ra3.id
 			where o.id = ora3.opportunity and ra3.name = 'Consumption Plan') as consumption_plan_complete,
-			replace(translate(nvl(os.status, 'No Status Entered'), chr(9)||chr(10)||chr(11)||chr(13)||chr(34), '  '), '•', '-') as latest_status,
-			to_char(os.creationdate, 'MM-DD-YYYY') as latest_status_date,
+			nvl(os.status, 'No Status Entered') as latest_status,
+			to_char(os.creationdate, 'YYYY-MM-DD HH24:MI:SS') as latest_status_date,
 			os.lastupdatedby as latest_status_author,
 			-- 08-OCT-2020 PBOCCHIO START
 			nvl(o.lateststagedone, 0),
@@ -182,10 +428,12 @@ end;
 			(select listagg(DECODE(u.useremail,o.technicallead,'Y','N'),':') within group (order by DECODE(u.useremail,o.technicallead,1,0) desc, u.useremail) from %SCHEMA%.useraccount ua inner join %SCHEMA%.user1 u on u.id = ua.user1 where ua.account = o.account ) techleadlist,
 			-- 08-OCT-2020 PBOCCHIO END
 		nvl(th.classifiedsensitiveworkload, 0) as classified_workload,
-		replace(translate(nvl(th.classifiedsensitiveworkloadcom, 'No Comment'), chr(9)||chr(10)||chr(11)||chr(13)||chr(34), '  '), '•', '-') as classified_workload_comment,
+		nvl(th.classifiedsensitiveworkloadcom, 'No Comment') as classified_workload_comment,
 		nvl(th.exadatarequired, 0) as poc_exa_required,
-		to_char(th.pocstartdate, 'MM-DD-YYYY') as poc_startdate,
-		nvl(o.realm, '') as realm
+		to_char(th.pocstartdate, 'YYYY-MM-DD') as poc_startdate,
+		nvl(o.realm, '') as realm,
+		to_char(o.lastupdatedate, 'YYYY-MM-DD HH24:MI:SS') as last_update,
+		` + sortKey + ` as sort_key
 		FROM %SCHEMA%.Opportunity o
 		INNER JOIN %SCHEMA%.Account a ON a.id = o.account
 		LEFT OUTER JOIN %SCHEMA%.OpportunityTechHealth th ON th.opportunity = o.id
@@ -194,52 +442,70 @@ end;
 		LEFT OUTER JOIN %SCHEMA%.OpportunityStatus os ON o.id = os.opportunity
 		and not exists (select 1 FROM %SCHEMA%.OpportunityStatus os1 where os1.opportunity = o.id and os1.creationdate > os.creationdate)`
 
-	var jsonResultTemplate = `{"ecal_workload_id":"%s","ecal_account_id":"%s","opportunity_id":"%s","workload_type":"%s","workload_identifier":"%s","account_name":"%s","cim_id":"%s","workload_summary":"%s","color":"%s","latest_ecal_stage_done": "%s","csa_executed":"%s","tech_lead":"%s","tech_manager":"%s","poc_required":"%s","poc_enddate":"%s","poc_status":"%s","poc_resolution":"%s","security_signoff":"%s","technical_signoff":"%s","cons_plan_signoff": "%s","cc_involved":"%s","cc_done":"%s","tech_blockers":"%s","commercial_blockers":"%s","covid_impact":"%s","ocs_engaged":"%s","expansion":"%s","tech_decider":"%s","tech_signoff_date":"%s","migration_by": "%s","partner_name":"%s","workload_progression":"%s","adopter_email":"%s","adopter_name":"%s","implementer_email":"%s","implementer_name":"%s","future_state_complete":"%s","current_state_complete":"%s","consumption_plan_complete":"%s","latest_status":"%s","latest_status_date":"%s","latest_status_author":"%s","latest_stage_done":"%s","current_phase":"%s","resource_list":"%s","techlead_list":"%s","classified_workload":"%s","classified_workload_comment":"%s","poc_exa_required":"%s","poc_startdate":"%s","realm":"%s"},`
-
 	// replace the %SCHEMA% template with the correct schema name
-	query := strings.ReplaceAll(template, "%SCHEMA%", SchemaMap[instanceEnv])
-	//fmt.Println(query)
+	query := strings.ReplaceAll(template, "%SCHEMA%", lookupSchema(instanceEnv))
+	logEnv(instanceEnv, logDebug, "ecal_data_query", query)
 
-	// run the query
-	rows, err := DBPool.Query(query)
-	if err != nil {
-		thisError := fmt.Sprintf("Error running query (%s): %s", instanceEnv, err.Error())
-		return "", errors.New(thisError)
+	// keyset pagination; pick up after the last row of the previous page
+	args := []interface{}{}
+	conditions := []string{}
+	if len(cursor.ID) > 0 && cursor.Sort != filters.sortID() {
+		return "", nil, inputError("cursor is for another sortBy or sortOrder")
+	}
+	if len(cursor.ID) > 0 && len(filters.sortBy) < 1 {
+		_, idErr := strconv.ParseInt(cursor.ID, 10, 64)
+		_, updatedErr := time.Parse("2006-01-02 15:04:05", cursor.Updated)
+		if idErr != nil || updatedErr != nil {
+			return "", nil, inputError("cursor is invalid")
+		}
+		conditions = append(conditions, `(o.lastupdatedate > TO_DATE(:1, 'YYYY-MM-DD HH24:MI:SS')
+		OR (o.lastupdatedate = TO_DATE(:1, 'YYYY-MM-DD HH24:MI:SS') AND o.id > :2))`)
+		args = append(args, cursor.Updated, cursor.ID)
+	} else if len(cursor.ID) > 0 {
+		if _, err := strconv.ParseInt(cursor.ID, 10, 64); err != nil {
+			return "", nil, inputError("cursor is invalid")
+		}
+		comparison := ">"
+		if sortOrder == "DESC" {
+			comparison = "<"
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s %s :1 OR (%s = :1 AND o.id > :2))", sortKey, comparison, sortKey))
+		args = append(args, cursor.Key, cursor.ID)
 	}
-	defer rows.Close()
-
-	// vars to hold row results
-	var ecalWorkloadID, ecalAccountID, opportunityID, workloadType, workloadIdentifier, accountName, cimID, workloadSummary, color, latestECALStageDone string
-	var csaExecuted, techLead, techManager, pocRequired, pocEndDate, pocStatus, pocResolution, securitySignoff, technicalSignoff, consPlanSignoff string
-	var ccInvolved, ccDone, techBlockers, commercialBlockers, covidImpact, ocsEngaged, expansion, techDecider, techSignoffDate, migrationBy string
-	var partnerName, workloadProgression, adopterEmail, adopterName, implementerEmail, implementerName, futureStateComplete, currentStateComplete, consumptionPlanComplete, latestStatus, latestStatusDate, latestStatusAuthor string
-	var latestStageDone, currentPhase, resourceList, techLeadList, classifiedWorkload, classifiedWorkloadComment, pocExaRequired, pocStartDate, realm string
 
-	// step through each row returned and add to the query filter using the correct format
-	result := ""
-	count := 0
-	for rows.Next() {
-		err := rows.Scan(&ecalWorkloadID, &ecalAccountID, &opportunityID, &workloadType, &workloadIdentifier, &accountName, &cimID, &workloadSummary, &color, &latestECALStageDone,
-			&csaExecuted, &techLead, &techManager, &pocRequired, &pocEndDate, &pocStatus, &pocResolution, &securitySignoff, &technicalSignoff, &consPlanSignoff,
-			&ccInvolved, &ccDone, &techBlockers, &commercialBlockers, &covidImpact, &ocsEngaged, &expansion, &techDecider, &techSignoffDate, &migrationBy,
-			&partnerName, &workloadProgression, &adopterEmail, &adopterName, &implementerEmail, &implementerName, &futureStateComplete, &currentStateComplete, &consumptionPlanComplete, &latestStatus, &latestStatusDate, &latestStatusAuthor,
-			&latestStageDone, &currentPhase, &resourceList, &techLeadList, &classifiedWorkload, &classifiedWorkloadComment, &pocExaRequired, &pocStartDate, &realm)
+	// only the workloads changed since the caller's last poll
+	if len(updatedSince) > 0 {
+		since, err := parseQueryTimestamp(updatedSince)
 		if err != nil {
-			thisError := fmt.Sprintf("Error scanning row (%s): %s", instanceEnv, err.Error())
-			return "", errors.New(thisError)
+			return "", nil, inputError("updatedSince must be a timestamp, e.g. 2020-10-08T14:03:00+01:00")
 		}
+		conditions = append(conditions, fmt.Sprintf("o.lastupdatedate > TO_DATE(:%d, 'YYYY-MM-DD HH24:MI:SS')", len(args)+1))
+		args = append(args, since)
+	}
 
-		result += fmt.Sprintf(jsonResultTemplate,
-			ecalWorkloadID, ecalAccountID, opportunityID, workloadType, workloadIdentifier, accountName, cimID, workloadSummary, color, latestECALStageDone,
-			csaExecuted, techLead, techManager, pocRequired, pocEndDate, pocStatus, pocResolution, securitySignoff, technicalSignoff, consPlanSignoff,
-			ccInvolved, ccDone, techBlockers, commercialBlockers, covidImpact, ocsEngaged, expansion, techDecider, techSignoffDate, migrationBy,
-			partnerName, workloadProgression, adopterEmail, adopterName, implementerEmail, implementerName, futureStateComplete, currentStateComplete, consumptionPlanComplete, latestStatus, latestStatusDate, latestStatusAuthor,
-			latestStageDone, currentPhase, resourceList, techLeadList, classifiedWorkload, classifiedWorkloadComment, pocExaRequired, pocStartDate, realm)
-		count++
+	// if the caller is not an admin (regular user or manager) then limit to the accounts of their hierarchy
+	if condition, scopeArgs := scope.accountCondition("a.id", len(args)+1); len(condition) > 0 {
+		conditions = append(conditions, strings.ReplaceAll(condition, "%SCHEMA%", lookupSchema(instanceEnv)))
+		args = append(args, scopeArgs...)
 	}
 
-	// string the trailing 'or' field if it exists
-	result = strings.TrimSuffix(result, ",")
+	// the caller's filters, e.g. one account or the red workloads
+	filterConditions, filterArgs := filters.conditions(ecalDataQueryColumns, len(args)+1)
+	for _, condition := range filterConditions {
+		conditions = append(conditions, strings.ReplaceAll(condition, "%SCHEMA%", lookupSchema(instanceEnv)))
+	}
+	args = append(args, filterArgs...)
+	if len(conditions) > 0 {
+		query += `
+		WHERE ` + strings.Join(conditions, " AND ")
+	}
+	if len(filters.sortBy) > 0 {
+		query += `
+		ORDER BY sort_key ` + sortOrder + `, o.id`
+	} else {
+		query += `
+		ORDER BY o.lastupdatedate, o.id`
+	}
 
-	return result, nil
+	return query, args, nil
 }
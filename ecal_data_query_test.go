@@ -0,0 +1,175 @@
+//  ECAL Data Query Tests
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// the pattern of the workload query, which selects the 51 ECALWorkload columns then last_update and sort_key
+const testWorkloadQuery = `distinct\(o\.id\) as ecal_workload_id`
+
+var testWorkloadColumns = []string{"workload_id", "account_id", "opportunity_id", "workload_type", "workload_identifier", "account_name", "cim_id",
+	"workload_summary", "color", "latest_ecal_stage_done", "csa_executed", "tech_lead", "tech_manager", "poc_required", "poc_enddate", "poc_status",
+	"poc_resolution", "security_signoff", "technical_signoff", "cons_plan_signoff", "cc_involved", "cc_done", "tech_blockers", "commercial_blockers",
+	"covid_impact", "ocs_engaged", "expansion", "tech_decider", "tech_signoff_date", "migration_by", "partner_name", "workload_progression",
+	"adopter_email", "adopter_name", "implementer_email", "implementer_name", "future_state_complete", "current_state_complete",
+	"consumption_plan_complete", "latest_status", "latest_status_date", "latest_status_author", "lateststagedone", "currentphase", "resourceslist",
+	"techleadlist", "classified_workload", "classified_workload_comment", "poc_exa_required", "poc_startdate", "realm", "last_update", "sort_key"}
+
+//
+// Returns a workload row of the workload query for the workload id on account, last updated at lastUpdate
+//
+func testWorkload(id string, account string, lastUpdate string) []interface{} {
+	return []interface{}{id, "1", "VJKL3", "Compute", "RL-1", account, "100001", "PSFT DR on OCI", "G", "03 - Qualify", "1", "se.one@example.com",
+		"mgr.one@example.com", "1", "2020-09-30", "In Progress", "", "1", "0", "0", "0", "0", "0", "0", "0", "0", "1", "CIO", "2020-08-15", "Partner",
+		"Acme Partners", "Migrating", "adopter@acme.example", "Ada Adopter, CIO", "impl@acme.example", "Ivan Implementer, Architect", "1", "1", "0",
+		"On track", "2020-08-20 10:15:00", "se.one@example.com", "3", "2", "se.one@example.com:se.two@example.com", "Y:N", "0", "No Comment", "0",
+		"2020-08-01", "oc1", lastUpdate, ""}
+}
+
+func TestGetECALDataQueryHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		client    string
+		params    string
+		admin     bool
+		userEmail string
+		status    int
+		condition string
+		order     string
+		args      []interface{}
+	}{
+		{name: "user sees their hierarchy's workloads", client: "vb", params: "&userEmail=se.one@example.com", userEmail: "se.one@example.com", status: 200,
+			condition: "WHERE a.id IN", order: "ORDER BY o.lastupdatedate, o.id", args: []interface{}{"se.one@example.com"}},
+		{name: "admin sees every workload", client: "vb", params: "&userEmail=admin@example.com", admin: true, status: 200,
+			order: "ORDER BY o.lastupdatedate, o.id"},
+		{name: "unrestricted client without a user sees every workload", client: "integration", status: 200,
+			order: "ORDER BY o.lastupdatedate, o.id"},
+		{name: "filters are bound after the user", client: "vb", params: "&userEmail=se.one@example.com&accountName=acme&color=r", userEmail: "se.one@example.com", status: 200,
+			condition: "UPPER(a.accountname) LIKE :2 ESCAPE '\\' AND UPPER(calculateColor(", order: "ORDER BY o.lastupdatedate, o.id",
+			args: []interface{}{"se.one@example.com", "%ACME%", "R"}},
+		{name: "updated since", client: "integration", params: "&updatedSince=2020-10-08", status: 200,
+			condition: "WHERE o.lastupdatedate > TO_DATE(:1, 'YYYY-MM-DD HH24:MI:SS')", order: "ORDER BY o.lastupdatedate, o.id", args: []interface{}{"2020-10-08 00:00:00"}},
+		{name: "sort order", client: "integration", params: "&sortBy=accountName&sortOrder=desc", status: 200,
+			condition: "nvl(upper(a.accountname), ' ') as sort_key", order: "ORDER BY sort_key DESC, o.id"},
+		{name: "invalid color", client: "integration", params: "&color=purple", status: 400},
+		{name: "invalid cursor", client: "integration", params: "&cursor=not-a-cursor", status: 400},
+		{name: "cursor for another order", client: "integration", params: "&sortBy=techLead&cursor=" + encodeCursor(pageCursor{ID: "11", Updated: "2020-08-20 10:15:00"}), status: 400},
+		{name: "untrusted client can't name a user", client: "other", params: "&userEmail=se.one@example.com", status: 400},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mem, db := newQueryTestStore(t)
+			expectAdminLookup(mem, test.admin)
+			mem.ExpectQuery(testWorkloadQuery, testWorkloadColumns, testWorkload("11", "Acme Corp", "2020-08-20 10:15:00"), testWorkload("12", "Globex", "2020-08-21 09:00:00"))
+
+			w := serveQuery(getECALDataQueryHandler(db), test.client, "/getECALDataQuery?instanceEnvironment="+testInstanceEnv+test.params)
+			if w.Code != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, w.Code, w.Body.String())
+			}
+			if test.status != 200 {
+				if len(endpointStatements(mem)) > 0 {
+					t.Errorf("expected no query for a refused request, got %v", mem.Statements())
+				}
+				return
+			}
+
+			statement := checkScopedStatement(t, mem, test.userEmail)
+			if !strings.Contains(statement.Query, test.condition) {
+				t.Errorf("expected %q in: %s", test.condition, statement.Query)
+			}
+			if !strings.HasSuffix(statement.Query, test.order) {
+				t.Errorf("expected %q at the end of: %s", test.order, statement.Query)
+			}
+			if (len(statement.Args) > 0 || len(test.args) > 0) && !reflect.DeepEqual(statement.Args, test.args) {
+				t.Errorf("expected args %v, got %v", test.args, statement.Args)
+			}
+
+			response := decodeQueryResponse(t, w)
+			if len(response.Items) != 2 || response.Truncated || len(response.NextCursor) > 0 {
+				t.Fatalf("expected 2 rows on one page, got %d (truncated %t, next cursor %q)", len(response.Items), response.Truncated, response.NextCursor)
+			}
+			item := response.Items[0]
+			if item["ecal_workload_id"] != 11.0 || item["account_name"] != "Acme Corp" || item["poc_enddate"] != "2020-09-30" || item["latest_status_date"] != "2020-08-20T10:15:00+00:00" {
+				t.Errorf("unexpected first workload: %v", item)
+			}
+		})
+	}
+}
+
+func TestGetECALDataQueryHandlerPaging(t *testing.T) {
+	mem, db := newQueryTestStore(t)
+
+	// workload 11 spans two rows, so the first page of one workload holds both and ends before workload 12
+	mem.ExpectQuery(testWorkloadQuery, testWorkloadColumns,
+		testWorkload("11", "Acme Corp", "2020-08-20 10:15:00"), testWorkload("11", "Acme Corp", "2020-08-20 10:15:00"), testWorkload("12", "Globex", "2020-08-21 09:00:00"))
+	handler := getECALDataQueryHandler(db)
+	w := serveQuery(handler, "integration", "/getECALDataQuery?instanceEnvironment="+testInstanceEnv+"&maxRows=1")
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	response := decodeQueryResponse(t, w)
+	if len(response.Items) != 2 || !response.Truncated {
+		t.Fatalf("expected workload 11's 2 rows and more to come, got %d (truncated %t)", len(response.Items), response.Truncated)
+	}
+	if cursor, err := decodeCursor(response.NextCursor); err != nil || cursor != (pageCursor{ID: "11", Updated: "2020-08-20 10:15:00"}) {
+		t.Fatalf("expected a cursor after workload 11, got %q", response.NextCursor)
+	}
+
+	// the next page picks up after the cursor and isn't cached
+	for i := 0; i < 2; i++ {
+		w = serveQuery(handler, "integration", "/getECALDataQuery?instanceEnvironment="+testInstanceEnv+"&maxRows=1&cursor="+response.NextCursor)
+		if w.Code != 200 {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	statements := mem.Statements()
+	if len(statements) != 3 {
+		t.Fatalf("expected the first page and the next one twice, got %v", statements)
+	}
+	next := statements[2]
+	if !strings.Contains(next.Query, "WHERE (o.lastupdatedate > TO_DATE(:1, 'YYYY-MM-DD HH24:MI:SS') OR (o.lastupdatedate = TO_DATE(:1, 'YYYY-MM-DD HH24:MI:SS') AND o.id > :2))") {
+		t.Errorf("expected the keyset condition: %s", next.Query)
+	}
+	if !reflect.DeepEqual(next.Args, []interface{}{"2020-08-20 10:15:00", "11"}) {
+		t.Errorf("expected the cursor to be bound, got %v", next.Args)
+	}
+}
+
+func TestGetECALDataQueryHandlerErrors(t *testing.T) {
+	mem, db := newQueryTestStore(t)
+	expectAdminLookup(mem, false)
+	mem.ExpectError(testWorkloadQuery, errors.New("ORA-06550: line 1, column 7: PLS-00201"))
+
+	w := serveQuery(getECALDataQueryHandler(db), "vb", "/getECALDataQuery?instanceEnvironment="+testInstanceEnv+"&userEmail=se.one@example.com")
+	if w.Code != 500 {
+		t.Fatalf("expected 500, got %d: %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "ORA-") {
+		t.Errorf("database error leaked to the caller: %s", w.Body.String())
+	}
+}
+
+func TestGetECALDataQueryHandlerCountOnly(t *testing.T) {
+	mem, db := newQueryTestStore(t)
+	mem.ExpectQuery(`SELECT COUNT\(\*\), MAX\(last_update\) FROM \(`, []string{"count", "last_update"}, []interface{}{"40", "2020-08-21 09:00:00"})
+
+	w := serveQuery(getECALDataQueryHandler(db), "integration", "/getECALDataQuery?instanceEnvironment="+testInstanceEnv+"&color=g&countOnly=true")
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	response := decodeQueryResponse(t, w)
+	if response.Count == nil || *response.Count != 40 {
+		t.Errorf("expected a count of 40: %s", w.Body.String())
+	}
+	statement := checkScopedStatement(t, mem, "")
+	if !reflect.DeepEqual(statement.Args, []interface{}{"G"}) {
+		t.Errorf("expected the filter to be counted, got %v", statement.Args)
+	}
+}
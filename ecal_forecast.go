@@ -0,0 +1,196 @@
+//  ECAL Blended Forecast
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// how much of a revenue line's probability-weighted ARR is kept given the tech health of its ECAL workload
+var forecastColorFactors = map[string]float64{"G": 1.0, "Y": 0.75, "R": 0.5}
+
+const forecastTechBlockerFactor = 0.8
+const forecastCommercialBlockerFactor = 0.8
+const forecastOpenPOCFactor = 0.85
+const forecastPastDueFactor = 0.5
+
+// ManagerForecast is the forecast of the workloads tracked by one manager's team
+type ManagerForecast struct {
+	ManagerEmail    string             `json:"manager_email"`
+	RevenueLines    int                `json:"revenue_lines"`
+	PipelineARR     float64            `json:"pipeline_arr"`
+	WeightedARR     float64            `json:"weighted_arr"`
+	RiskAdjustedARR float64            `json:"risk_adjusted_arr"`
+	Quarters        map[string]float64 `json:"risk_adjusted_by_quarter"`
+}
+
+//
+// HTTP handler for the getForecast functionality.  Blends the win probability and close date of the open revenue
+// lines in LookupOpportunity with the tech health of the ECAL workloads tracking them into a risk-adjusted ARR
+// forecast per manager.  managerEmail optionally limits it to the managers in that hierarchy.
+//
+func getForecastHandler(w http.ResponseWriter, r *http.Request) {
+	// get query parameters
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	managerEmail := query.Get("managerEmail")
+
+	// only the accounts the caller may see are forecast, whichever managerEmail they ask for
+	scope, err := requestAccess(r, DBPool, instanceEnv)
+	if queryCancelled(r.Context(), "forecast", err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "forecast", err.Error())
+		return
+	}
+
+	// call the helper which does the data mashing
+	result, err := getForecast(r.Context(), instanceEnv, scope, managerEmail)
+	if queryCancelled(r.Context(), "forecast", err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "forecast", err.Error())
+		return
+	}
+
+	// write result to output stream
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+//
+// Returns {"items": [managers]} where each workload is credited to the manager of its technical lead.  The weighted
+// ARR is the revenue line pipeline times its probability; the risk-adjusted ARR then applies forecastRisk.  Workloads
+// of accounts outside the caller's scope are left out.
+//
+func getForecast(ctx context.Context, instanceEnv string, scope accessScope, managerEmail string) ([]byte, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		return nil, inputError("instanceEnvironment query parameter is invalid")
+	}
+
+	template := ecalColorFunction + `
+		SELECT NVL(u.manager, 'Unassigned'), NVL(l.revenuepipelinek, 0), NVL(l.revenueprobability, 0),
+			TO_CHAR(l.anticipatedclosedate, 'YYYY-MM-DD'),
+			` + ecalColorColumn + `,
+			NVL(th.technicalblockers, 0), NVL(th.commercialblockers, 0), NVL(th.pocrequired, 0), NVL(th.pocstatus, 'Not Started')
+		FROM %SCHEMA%.LookupOpportunity l
+		INNER JOIN %SCHEMA%.Opportunity o ON o.opportunityid = l.opportunityid
+		INNER JOIN %SCHEMA%.OpportunityWorkload w ON w.opportunity = o.id AND w.workloadidentifier = l.revenuelineid
+		LEFT OUTER JOIN %SCHEMA%.OpportunityTechHealth th ON th.opportunity = o.id
+		LEFT OUTER JOIN %SCHEMA%.User1 u ON o.technicallead = u.useremail
+		WHERE l.active = 1 AND l.opportunitystatus = 'Open'`
+	args := []interface{}{}
+	if len(managerEmail) > 0 {
+		template += ` AND (u.manager = :1 OR u.manager IN (SELECT c.reportemail FROM %SCHEMA%.ManagerClosure c WHERE c.manageremail = :1))`
+		args = append(args, managerEmail)
+	}
+	if condition, scopeArgs := scope.accountCondition("o.account", len(args)+1); len(condition) > 0 {
+		template += " AND " + condition
+		args = append(args, scopeArgs...)
+	}
+
+	rows, err := DBPool.QueryContext(ctx, strings.ReplaceAll(template, "%SCHEMA%", schema), args...)
+	if err != nil {
+		thisError := fmt.Sprintf("Error running forecast query (%s, %s): %s", instanceEnv, managerEmail, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	today := time.Now().UTC().Format(queryDateLayout)
+	managers := make(map[string]*ManagerForecast)
+	for rows.Next() {
+		var manager, color, pocStatus string
+		var closeDate *string
+		var pipeline, probability float64
+		var techBlockers, commercialBlockers, poc int
+		err := rows.Scan(&manager, &pipeline, &probability, &closeDate, &color, &techBlockers, &commercialBlockers, &poc, &pocStatus)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning forecast row (%s): %s", instanceEnv, err.Error())
+			return nil, errors.New(thisError)
+		}
+
+		forecast := managers[manager]
+		if forecast == nil {
+			forecast = &ManagerForecast{ManagerEmail: manager, Quarters: make(map[string]float64)}
+			managers[manager] = forecast
+		}
+		weighted := pipeline * probability / 100
+		pastDue := closeDate != nil && *closeDate < today
+		adjusted := weighted * forecastRisk(color, techBlockers == 1, commercialBlockers == 1, poc == 1 && pocStatus != "Completed", pastDue)
+
+		forecast.RevenueLines++
+		forecast.PipelineARR += pipeline
+		forecast.WeightedARR += weighted
+		forecast.RiskAdjustedARR += adjusted
+		if closeDate != nil {
+			if date, err := time.Parse(queryDateLayout, *closeDate); err == nil {
+				forecast.Quarters[fiscalQuarterName(fiscalQuarter(date))] += adjusted
+			}
+		}
+	}
+
+	items := []*ManagerForecast{}
+	for _, forecast := range managers {
+		forecast.PipelineARR = math.Round(forecast.PipelineARR*100) / 100
+		forecast.WeightedARR = math.Round(forecast.WeightedARR*100) / 100
+		forecast.RiskAdjustedARR = math.Round(forecast.RiskAdjustedARR*100) / 100
+		for quarter, value := range forecast.Quarters {
+			forecast.Quarters[quarter] = math.Round(value*100) / 100
+		}
+		items = append(items, forecast)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ManagerEmail < items[j].ManagerEmail })
+
+	return json.Marshal(map[string][]*ManagerForecast{"items": items})
+}
+
+//
+// Returns the share of a revenue line's weighted ARR expected to land given the tech health color of its workload,
+// its open blockers, a required POC that isn't complete and a close date that has already passed
+//
+func forecastRisk(color string, techBlockers bool, commercialBlockers bool, openPOC bool, pastDue bool) float64 {
+	factor, ok := forecastColorFactors[color]
+	if !ok {
+		factor = forecastColorFactors["R"]
+	}
+	if techBlockers {
+		factor *= forecastTechBlockerFactor
+	}
+	if commercialBlockers {
+		factor *= forecastCommercialBlockerFactor
+	}
+	if openPOC {
+		factor *= forecastOpenPOCFactor
+	}
+	if pastDue {
+		factor *= forecastPastDueFactor
+	}
+	return factor
+}
@@ -0,0 +1,289 @@
+//  ECAL Manager Digest
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// the windows the digest reports on
+const digestPeriodDays = 7
+const digestStaleStatusDays = 14
+const digestUpcomingPOCDays = 14
+
+// DigestWorkload is an ECAL workload listed in a manager digest
+type DigestWorkload struct {
+	WorkloadID       int64  `json:"workload_id"`
+	AccountName      string `json:"account_name"`
+	OpportunityID    string `json:"opportunity_id"`
+	Summary          string `json:"summary"`
+	TechLead         string `json:"tech_lead"`
+	Created          string `json:"created"`
+	Color            string `json:"color"`
+	PreviousColor    string `json:"previous_color,omitempty"`
+	LatestStatusDate string `json:"latest_status_date,omitempty"`
+	POCEndDate       string `json:"poc_enddate,omitempty"`
+	POCStatus        string `json:"poc_status,omitempty"`
+}
+
+// ManagerDigest is the weekly summary of the workloads in a manager's hierarchy
+type ManagerDigest struct {
+	ManagerEmail   string            `json:"manager_email"`
+	InstanceEnv    string            `json:"instance_environment"`
+	PeriodStart    string            `json:"period_start"`
+	PeriodEnd      string            `json:"period_end"`
+	NewWorkloads   []*DigestWorkload `json:"new_workloads"`
+	ColorChanges   []*DigestWorkload `json:"color_changes"`
+	StaleStatuses  []*DigestWorkload `json:"stale_statuses"`
+	UpcomingPOCEnd []*DigestWorkload `json:"upcoming_poc_end_dates"`
+}
+
+var digestTemplate = template.Must(template.New("digest").Parse(`<html><body>
+<h2>ECAL weekly digest for {{.ManagerEmail}}</h2>
+<p>{{.PeriodStart}} to {{.PeriodEnd}}</p>
+<h3>New workloads ({{len .NewWorkloads}})</h3>
+<ul>{{range .NewWorkloads}}<li>{{.AccountName}}: {{.Summary}} ({{.OpportunityID}}, {{.TechLead}})</li>{{end}}</ul>
+<h3>Color changes ({{len .ColorChanges}})</h3>
+<ul>{{range .ColorChanges}}<li>{{.AccountName}}: {{.Summary}} went from {{.PreviousColor}} to {{.Color}}</li>{{end}}</ul>
+<h3>Stale statuses ({{len .StaleStatuses}})</h3>
+<ul>{{range .StaleStatuses}}<li>{{.AccountName}}: {{.Summary}} ({{.TechLead}}) last status {{if .LatestStatusDate}}{{.LatestStatusDate}}{{else}}never entered{{end}}</li>{{end}}</ul>
+<h3>Upcoming POC end dates ({{len .UpcomingPOCEnd}})</h3>
+<ul>{{range .UpcomingPOCEnd}}<li>{{.AccountName}}: {{.Summary}} POC {{.POCStatus}} ends {{.POCEndDate}}</li>{{end}}</ul>
+</body></html>`))
+
+//
+// HTTP handler for the generateDigest functionality.  Assembles the weekly digest of a manager's hierarchy as JSON
+// or, with format=html, as an HTML body the email notifier can send as is.  Generating a digest records the color of
+// each workload so the next one can report what changed.
+//
+func generateDigestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "generateDigest must be called with POST")
+		return
+	}
+
+	// get query parameters
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	managerEmail := query.Get("managerEmail")
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "html" {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "format must be json or html")
+		return
+	}
+
+	// only the accounts the caller may see are in the digest, whichever managerEmail they ask for
+	scope, err := requestAccess(r, DBPool, instanceEnv)
+	if queryCancelled(r.Context(), "manager_digest", err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "manager_digest", err.Error())
+		return
+	}
+
+	// call the helper which does the data mashing
+	digest, err := generateDigest(r.Context(), instanceEnv, scope, managerEmail)
+	if queryCancelled(r.Context(), "manager_digest", err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "manager_digest", err.Error())
+		return
+	}
+
+	// write result to output stream
+	if format == "html" {
+		var body bytes.Buffer
+		err = digestTemplate.Execute(&body, digest)
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+			logRequest(r, logError, "manager_digest", "Error rendering digest: "+err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(body.Bytes())
+		return
+	}
+	result, _ := json.Marshal(digest)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+//
+// Returns the digest of the workloads on accounts assigned within a manager's hierarchy: workloads created in the
+// last digestPeriodDays, ones whose color changed since the last digest for this manager, ones without a status in
+// digestStaleStatusDays and required POCs ending in the next digestUpcomingPOCDays.  The colors are then saved to
+// CTO_COMMON.DIGEST_WORKLOAD_COLOR for the next digest.  Workloads outside the caller's scope are left out, and a
+// digest narrowed that way isn't saved since it may not be the manager's whole hierarchy.
+//
+func generateDigest(ctx context.Context, instanceEnv string, scope accessScope, managerEmail string) (*ManagerDigest, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		return nil, inputError("instanceEnvironment query parameter is invalid")
+	}
+	if len(managerEmail) < 1 {
+		return nil, inputError("managerEmail query parameter is required")
+	}
+	managerEmail = strings.ToLower(managerEmail)
+
+	now := time.Now().UTC()
+	digest := &ManagerDigest{ManagerEmail: managerEmail, InstanceEnv: instanceEnv,
+		PeriodStart: now.AddDate(0, 0, -digestPeriodDays).Format(queryDateLayout), PeriodEnd: now.Format(queryDateLayout),
+		NewWorkloads: []*DigestWorkload{}, ColorChanges: []*DigestWorkload{}, StaleStatuses: []*DigestWorkload{}, UpcomingPOCEnd: []*DigestWorkload{}}
+
+	// the colors recorded by the last digest
+	previous := make(map[int64]string)
+	rows, err := DBPool.QueryContext(ctx, "SELECT workload_id, color FROM CTO_COMMON.DIGEST_WORKLOAD_COLOR WHERE instance_env = :1 AND manager_email = :2",
+		instanceEnv, managerEmail)
+	if err != nil {
+		thisError := fmt.Sprintf("Error reading previous digest colors (%s, %s): %s", instanceEnv, managerEmail, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var color string
+		if err := rows.Scan(&id, &color); err != nil {
+			thisError := fmt.Sprintf("Error scanning previous digest color (%s, %s): %s", instanceEnv, managerEmail, err.Error())
+			return nil, errors.New(thisError)
+		}
+		previous[id] = color
+	}
+
+	query := ecalColorFunction + `
+		SELECT o.id, a.accountname, o.opportunityid, NVL(o.summary, ' '), NVL(o.technicallead, ' '),
+			TO_CHAR(o.creationdate, 'YYYY-MM-DD HH24:MI:SS'),
+			` + ecalColorColumn + `,
+			(SELECT TO_CHAR(MAX(os.creationdate), 'YYYY-MM-DD HH24:MI:SS') FROM %SCHEMA%.OpportunityStatus os WHERE os.opportunity = o.id),
+			NVL(th.pocrequired, 0), TO_CHAR(th.pocenddate, 'YYYY-MM-DD'), NVL(th.pocstatus, 'Not Started')
+		FROM %SCHEMA%.Opportunity o
+		INNER JOIN %SCHEMA%.Account a ON a.id = o.account
+		LEFT OUTER JOIN %SCHEMA%.OpportunityTechHealth th ON th.opportunity = o.id
+		WHERE o.account IN (SELECT ua.account FROM %SCHEMA%.User1 u INNER JOIN %SCHEMA%.UserAccount ua ON ua.user1 = u.id
+			WHERE u.useremail = :1 OR u.manager IN (SELECT c.reportemail FROM %SCHEMA%.ManagerClosure c WHERE c.manageremail = :1))`
+	args := []interface{}{managerEmail}
+	if condition, scopeArgs := scope.accountCondition("o.account", len(args)+1); len(condition) > 0 {
+		query += " AND " + condition
+		args = append(args, scopeArgs...)
+	}
+	query += " ORDER BY a.accountname, o.id"
+	rows, err = DBPool.QueryContext(ctx, strings.ReplaceAll(query, "%SCHEMA%", schema), args...)
+	if err != nil {
+		thisError := fmt.Sprintf("Error running digest query (%s, %s): %s", instanceEnv, managerEmail, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	periodStart := now.AddDate(0, 0, -digestPeriodDays)
+	staleBefore := now.AddDate(0, 0, -digestStaleStatusDays)
+	pocBefore := now.AddDate(0, 0, digestUpcomingPOCDays).Format(queryDateLayout)
+	today := now.Format(queryDateLayout)
+	colors := make(map[int64]string)
+	for rows.Next() {
+		workload := &DigestWorkload{}
+		var created string
+		var statusDate, pocEndDate sql.NullString
+		var pocRequired int
+		err := rows.Scan(&workload.WorkloadID, &workload.AccountName, &workload.OpportunityID, &workload.Summary, &workload.TechLead,
+			&created, &workload.Color, &statusDate, &pocRequired, &pocEndDate, &workload.POCStatus)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning digest row (%s, %s): %s", instanceEnv, managerEmail, err.Error())
+			return nil, errors.New(thisError)
+		}
+		workload.Summary = strings.TrimSpace(workload.Summary)
+		workload.TechLead = strings.TrimSpace(workload.TechLead)
+		workload.Created = formatTimestamp(created)
+		colors[workload.WorkloadID] = workload.Color
+
+		if when, err := time.ParseInLocation(queryTimestampLayout, created, dbLocation); err == nil && when.After(periodStart) {
+			digest.NewWorkloads = append(digest.NewWorkloads, workload)
+		}
+		if color, ok := previous[workload.WorkloadID]; ok && color != workload.Color {
+			changed := *workload
+			changed.PreviousColor = color
+			digest.ColorChanges = append(digest.ColorChanges, &changed)
+		}
+		if !statusDate.Valid {
+			digest.StaleStatuses = append(digest.StaleStatuses, workload)
+		} else if when, err := time.ParseInLocation(queryTimestampLayout, statusDate.String, dbLocation); err == nil && when.Before(staleBefore) {
+			stale := *workload
+			stale.LatestStatusDate = formatTimestamp(statusDate.String)
+			digest.StaleStatuses = append(digest.StaleStatuses, &stale)
+		}
+		if pocRequired == 1 && pocEndDate.Valid && workload.POCStatus != "Completed" && workload.POCStatus != "Cancelled" &&
+			pocEndDate.String >= today && pocEndDate.String <= pocBefore {
+			upcoming := *workload
+			upcoming.POCEndDate = formatDate("generateDigest", pocEndDate.String)
+			digest.UpcomingPOCEnd = append(digest.UpcomingPOCEnd, &upcoming)
+		}
+	}
+
+	// the caller's scope doesn't narrow their own digest, but may narrow anyone else's
+	if !scope.all && scope.userEmail != managerEmail {
+		return digest, nil
+	}
+	err = saveDigestColors(instanceEnv, managerEmail, colors)
+	if err != nil {
+		thisError := fmt.Sprintf("Error saving digest colors (%s, %s): %s", instanceEnv, managerEmail, err.Error())
+		return nil, errors.New(thisError)
+	}
+	return digest, nil
+}
+
+//
+// Replaces the workload colors recorded for a manager's digest
+//
+func saveDigestColors(instanceEnv string, managerEmail string, colors map[int64]string) error {
+	tx, err := DBPool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM CTO_COMMON.DIGEST_WORKLOAD_COLOR WHERE instance_env = :1 AND manager_email = :2", instanceEnv, managerEmail)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT INTO CTO_COMMON.DIGEST_WORKLOAD_COLOR (instance_env, manager_email, workload_id, color, recorded) " +
+		"VALUES (:1, :2, :3, :4, SYSTIMESTAMP)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for id, color := range colors {
+		_, err = stmt.Exec(instanceEnv, managerEmail, id, color)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -5,58 +5,228 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
 	"strings"
 )
 
+// the filters and sort orders of getECALOpportunityQuery, sorted on the columns of its result
+var ecalOpportunityQueryColumns = queryColumns{
+	filters: map[string]filterColumn{
+		"accountName": {expression: "a.accountname", contains: true},
+		"stage":       {expression: "NVL(stg.stage, 'None')"},
+		"techLead":    {expression: "o.technicallead"},
+	},
+	sorts: map[string]string{
+		"accountName":   "AccountName",
+		"opportunityId": "OpportunityID",
+		"stage":         "LatestECALStage",
+		"lastActivity":  "LastActivity",
+		"arr":           "ARR",
+		"ecalPercent":   "ECALPercent",
+	},
+	defaultSort: "accountName",
+}
+
+// ECALOpportunity is one opportunity row of getECALOpportunityQuery
+type ECALOpportunity struct {
+	ID              dbNumber
+	AccountID       dbNumber
+	AccountName     string
+	OpportunityID   string
+	WorkloadType    string
+	Summary         string
+	ARR             dbNumber
+	ECALPercent     dbNumber
+	LatestECALStage string
+	LastActivity    string
+	POC             bool
+	POCStatus       string
+	Blockers        bool
+}
+
+//
+// Returns the HTTP handler for the getECALOpportunityQuery functionality, which runs its queries against db
+//
+func getECALOpportunityQueryHandler(db Store) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// get query parameters
+		query := r.URL.Query()
+		instanceEnv := query.Get("instanceEnvironment")
+
+		// what the caller may see is decided from who they are, not from an isAdmin parameter
+		scope, err := requestAccess(r, db, instanceEnv)
+		if queryCancelled(r.Context(), "ecal_opportunity_query", err) {
+			return
+		}
+		if inputErr, ok := err.(inputError); ok {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", inputErr.Error())
+			return
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+			logRequest(r, logError, "opp_query", err.Error())
+			return
+		}
+
+		maxRows, err := getMaxRows(query.Get("maxRows"))
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+		ndjson, err := ndjsonRequested(query)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+
+		filters, err := parseQueryFilters(query, ecalOpportunityQueryColumns)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+
+		updatedSince := query.Get("updatedSince")
+
+		// just the number of opportunities, e.g. for a badge or to set up paging, or for HEAD the count and last
+		// update time as headers
+		if countOnlyRequested(query) || r.Method == http.MethodHead {
+			count, err := countECALOpportunityQuery(r.Context(), db, instanceEnv, scope, filters, updatedSince)
+			writeQueryCount(w, r, "ecal_opportunity_query", count, err)
+			return
+		}
+
+		// the caller's list may be cached, warmed after the last data load or from their last request
+		cacheKey := queryCacheKey("getECALOpportunityQuery", instanceEnv, scope, maxRows)
+		cacheable := !ndjson && filters.empty() && len(updatedSince) < 1
+		if cacheable {
+			rememberWarmScope(instanceEnv, scope)
+			if cached, ok := getCachedQuery(cacheKey); ok {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, "{\"items\": [%s], \"truncated\": %t}", cached.result, cached.truncated)
+				return
+			}
+		}
+
+		// call the helper which streams the rows straight to the output
+		out := newItemWriter(w, "{\"items\": [")
+		if ndjson {
+			out = newNDJSONWriter(w)
+		}
+		if cacheable {
+			out.capture()
+		}
+		truncated, err := getECALOpportunityQuery(r.Context(), db, instanceEnv, scope, filters, updatedSince, maxRows, out)
+		if queryCancelled(r.Context(), "ecal_opportunity_query", err) {
+			return
+		}
+		if err != nil && out.written() {
+			abortStreamedResponse("opp_query", err)
+		}
+		if inputErr, ok := err.(inputError); ok {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", inputErr.Error())
+			return
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+			logRequest(r, logError, "opp_query", string(err.Error()))
+			return
+		}
+		if cacheable {
+			putCachedQuery(cacheKey, instanceEnv, queryCacheEntry{result: out.capturedItems(), truncated: truncated})
+		}
+		out.setPaging(truncated, "")
+		out.finish(fmt.Sprintf("], \"truncated\": %t}", truncated))
+	}
+}
+
 //
-// HTTP handler for the getECALAccountQueryHandler functionality
+// Returns data to power the ECAL application.  Specifically returns a list of accounts that should be presented to the user of the app.
+// The instanceEnvironment identifier (sts-dev-preview, sts-prod-live, etc) is required to key the name of the ATP schema to query
+// The scope is either everything (admins) or the accounts of a manager or end-user and their hierarchy, narrowed by the filters
+// If updatedSince is set only opportunities updated after it are returned, so polling integrations can pull just the changes
+// Rows are written to out as they are read, at most maxRows of them; the bool result is true if more were available
 //
-func getECALOpportunityQueryHandler(w http.ResponseWriter, r *http.Request) {
-	// get query parameters
-	query := r.URL.Query()
-	instanceEnv := query.Get("instanceEnvironment")
-	userEmail := query.Get("userEmail")
-	isAdminString := query.Get("isAdmin")
-
-	// convert isAdminString to a bool
-	isAdmin := false
-	if strings.ToLower(isAdminString) == "true" || strings.ToLower(isAdminString) == "yes" {
-		isAdmin = true
+func getECALOpportunityQuery(ctx context.Context, db QueryRunner, instanceEnv string, scope accessScope, filters queryFilters, updatedSince string, maxRows int, out *itemWriter) (bool, error) {
+	query, args, err := ecalOpportunityQuerySQL(instanceEnv, scope, filters, updatedSince)
+	if err != nil {
+		return false, err
 	}
 
-	// call the helper which does the data mashing
-	result, err := getECALOpportunityQuery(instanceEnv, userEmail, isAdmin)
+	// run the query, timing it in case it is slow
+	timer := startQueryTimer("getECALOpportunityQuery", instanceEnv)
+	rows, err := db.QueryContext(ctx, tagQuery("getECALOpportunityQuery", instanceEnv, query), args...)
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator")
-		logOutput(logError, "opp_query", string(err.Error()))
-		return
+		thisError := fmt.Sprintf("Error running query (%s, %s): %s", instanceEnv, scope, err.Error())
+		return false, errors.New(thisError)
 	}
+	defer rows.Close()
 
-	// format the result as json
-	json := fmt.Sprintf("{\"items\": [%s]}", result)
+	// vars to hold row results
+	var commercialBlockers, technicalBlockers, poc int
 
-	// write result to output stream
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, string(json))
+	// step through each row returned and add to the query filter using the correct format
+	count := 0
+	truncated := false
+	for rows.Next() {
+		if count >= maxRows {
+			truncated = true
+			break
+		}
+		var item ECALOpportunity
+		err := rows.Scan(&item.ID, &item.AccountID, &item.AccountName, &item.OpportunityID, &item.WorkloadType, &item.Summary, &item.ARR, &item.ECALPercent, &item.LatestECALStage, &item.LastActivity, &poc, &item.POCStatus, &commercialBlockers, &technicalBlockers)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning row (%s, %s): %s", instanceEnv, scope, err.Error())
+			return false, errors.New(thisError)
+		}
+
+		// calculate booleans
+		item.Blockers = commercialBlockers == 1 || technicalBlockers == 1
+		item.POC = poc == 1
+		item.LastActivity = formatTimestamp(item.LastActivity)
+
+		err = out.writeJSON(item)
+		if err != nil {
+			thisError := fmt.Sprintf("Error writing row (%s): %s", instanceEnv, err.Error())
+			return false, errors.New(thisError)
+		}
+		count++
+	}
+
+	timer.done(count)
+	return truncated, nil
 }
 
 //
-// Returns data to power the ECAL application.  Specifically returns a list of accounts that should be presented to the user of the app.
-// The instanceEnvironment identifier (sts-dev-preview, sts-prod-live, etc) is required to key the name of the ATP schema to query
-// The userEmail parameter is either a manager or end-user email
-// If the isAdmin paramter is set to true then all data will be returned
+// Returns the number of opportunities getECALOpportunityQuery would return for the user, ignoring maxRows, and
+// when the most recently updated of them was last updated
 //
-func getECALOpportunityQuery(instanceEnv string, userEmail string, isAdmin bool) (string, error) {
+func countECALOpportunityQuery(ctx context.Context, db QueryRunner, instanceEnv string, scope accessScope, filters queryFilters, updatedSince string) (queryCount, error) {
+	query, args, err := ecalOpportunityQuerySQL(instanceEnv, scope, filters, updatedSince)
+	if err != nil {
+		return queryCount{}, err
+	}
+	return countQueryRows(ctx, db, query, "LastActivity", args...)
+}
+
+//
+// Builds the opportunity query for the scope and filters, optionally limited to those updated
+// after updatedSince, in the order asked for, and its bind arguments
+//
+func ecalOpportunityQuerySQL(instanceEnv string, scope accessScope, filters queryFilters, updatedSince string) (string, []interface{}, error) {
 	// inject the correct schema name into the query
 	if len(instanceEnv) < 1 {
-		thisError := fmt.Sprintf("instanceEnv query parameter is invalid (%s, %s, %s)", instanceEnv, userEmail, strconv.FormatBool(isAdmin))
-		return "", errors.New(thisError)
+		thisError := fmt.Sprintf("instanceEnv query parameter is invalid (%s, %s)", instanceEnv, scope)
+		return "", nil, errors.New(thisError)
 	}
 
 	// set the core query
@@ -70,7 +240,7 @@ func getECALOpportunityQuery(instanceEnv string, userEmail string, isAdmin bool)
 		NVL(o.projectedARR, 0) AS ARR,
 		NVL(o.ecalPercentComplete, 0) AS ECALPercent,
 		NVL(stg.stage, 'None') AS LatestECALStage,
-		TO_CHAR(o.lastupdatedate, 'MM/DD/YYYY') AS LastActivity,
+		TO_CHAR(o.lastupdatedate, 'YYYY-MM-DD HH24:MI:SS') AS LastActivity,
 		NVL(th.pocRequired, 0) AS POC,
 		NVL(th.pocStatus, 'None') AS POCStatus,
 		NVL(th.commercialBlockers, 0) AS CommercialBlockers,
@@ -83,71 +253,43 @@ func getECALOpportunityQuery(instanceEnv string, userEmail string, isAdmin bool)
 	LEFT OUTER JOIN %SCHEMA%.OpportunityTechHealth th ON th.opportunity = o.id
 	LEFT OUTER JOIN %SCHEMA%.ECALStage stg ON stg.id = o.lateststagedone	
 	`
-	// if the user is not an admin (regular user or manager) then append the hierarchical query suffix
-	if isAdmin == false {
-		template += `
-		WHERE u.useremail = :1 OR u.manager in 
-		(
-		SELECT useremail 
-		FROM %SCHEMA%.User1 u 
-		INNER JOIN %SCHEMA%.RoleType r 
-		ON u.rolename = r.id WHERE r.rolename = 'Manager' 
-		START WITH useremail = :1 
-		CONNECT BY PRIOR useremail = manager
-		)
-		`
+	// if the caller is not an admin (regular user or manager) then limit to the accounts of their hierarchy
+	args := []interface{}{}
+	conditions := []string{}
+	if condition, scopeArgs := scope.accountCondition("a.id", len(args)+1); len(condition) > 0 {
+		conditions = append(conditions, condition)
+		args = append(args, scopeArgs...)
 	}
 
-	// append the order by
-	template += "ORDER BY AccountName ASC, OpportunityID ASC"
-
-	// replace the %SCHEMA% template with the correct schema name
-	query := strings.ReplaceAll(template, "%SCHEMA%", SchemaMap[instanceEnv])
-
-	// run the query
-	var rows *sql.Rows
-	var err error
-	if isAdmin {
-		rows, err = DBPool.Query(query)
-	} else {
-		rows, err = DBPool.Query(query, userEmail)
-	}
-	if err != nil {
-		thisError := fmt.Sprintf("Error running query (%s, %s, %s): %s", instanceEnv, userEmail, strconv.FormatBool(isAdmin), err.Error())
-		return "", errors.New(thisError)
-	}
-	defer rows.Close()
-
-	// vars to hold row results
-	var id, accountID, accountName, opportunityID, workloadType, summary, arr, ecalPercent, latestECALStage, lastActivity, pocStatus string
-	var commercialBlockers, technicalBlockers, poc int
-
-	// step through each row returned and add to the query filter using the correct format
-	result := ""
-	count := 0
-	for rows.Next() {
-		err := rows.Scan(&id, &accountID, &accountName, &opportunityID, &workloadType, &summary, &arr, &ecalPercent, &latestECALStage, &lastActivity, &poc, &pocStatus, &commercialBlockers, &technicalBlockers)
+	// only the opportunities changed since the caller's last poll
+	if len(updatedSince) > 0 {
+		since, err := parseQueryTimestamp(updatedSince)
 		if err != nil {
-			thisError := fmt.Sprintf("Error scanning row (%s, %s, %s): %s", instanceEnv, userEmail, strconv.FormatBool(isAdmin), err.Error())
-			return "", errors.New(thisError)
+			return "", nil, inputError("updatedSince must be a timestamp, e.g. 2020-10-08T14:03:00+01:00")
 		}
+		conditions = append(conditions, fmt.Sprintf("o.lastupdatedate > TO_DATE(:%d, 'YYYY-MM-DD HH24:MI:SS')", len(args)+1))
+		args = append(args, since)
+	}
 
-		// calculate booleans
-		blockers := false
-		if commercialBlockers == 1 || technicalBlockers == 1 {
-			blockers = true
-		}
-		pocBool := false
-		if poc == 1 {
-			pocBool = true
-		}
+	// the caller's filters, e.g. one account or stage
+	filterConditions, filterArgs := filters.conditions(ecalOpportunityQueryColumns, len(args)+1)
+	conditions = append(conditions, filterConditions...)
+	args = append(args, filterArgs...)
+	if len(conditions) > 0 {
+		template += `
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		`
+	}
 
-		result += fmt.Sprintf("{\"ID\": %s, \"AccountID\": %s, \"AccountName\": \"%s\", \"OpportunityID\": \"%s\", \"WorkloadType\": \"%s\", \"Summary\": \"%s\", \"ARR\": %s, \"ECALPercent\": %s, \"LatestECALStage\": \"%s\", \"LastActivity\": \"%s\", \"POC\": %t, \"POCStatus\": \"%s\", \"Blockers\": %t},",
-			id, accountID, accountName, opportunityID, workloadType, summary, arr, ecalPercent, latestECALStage, lastActivity, pocBool, pocStatus, blockers)
-		count++
+	// append the order by; ties are broken by account and opportunity as in the default order
+	sortColumn, sortOrder := filters.order(ecalOpportunityQueryColumns)
+	if sortColumn == "AccountName" {
+		template += "ORDER BY AccountName " + sortOrder + ", OpportunityID ASC"
+	} else {
+		template += "ORDER BY " + sortColumn + " " + sortOrder + ", AccountName ASC, OpportunityID ASC"
 	}
 
-	// string the trailing 'or' field if it exists
-	result = strings.TrimSuffix(result, ",")
-	return result, nil
+	// replace the %SCHEMA% template with the correct schema name
+	query := strings.ReplaceAll(template, "%SCHEMA%", lookupSchema(instanceEnv))
+	return query, args, nil
 }
@@ -0,0 +1,152 @@
+//  ECAL Opportunity Query Tests
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testOpportunityColumns = []string{"id", "accountid", "accountname", "opportunityid", "workloadtype", "summary", "arr", "ecalpercent",
+	"latestecalstage", "lastactivity", "poc", "pocstatus", "commercialblockers", "technicalblockers"}
+
+// expectOpportunities answers the opportunity query with two opportunities, the first running a POC and blocked
+func expectOpportunities(mem *MemDB) {
+	mem.ExpectQuery(`SELECT DISTINCT\(o\.id\) AS ID`, testOpportunityColumns,
+		[]interface{}{"21", "1", "Acme Corp", "OPP-1001", "Analytics", "Data warehouse migration", "250000", "60", "POC", "2020-08-20 10:15:00", "1", "In Progress", "0", "1"},
+		[]interface{}{"22", "2", "Globex", "OPP-1002", "Integration", "ERP integration", "90000", "20", "None", "2020-08-18 16:40:00", "0", "None", "0", "0"})
+}
+
+func TestGetECALOpportunityQueryHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		client    string
+		params    string
+		admin     bool
+		userEmail string
+		status    int
+		condition string
+		order     string
+		args      []interface{}
+	}{
+		{name: "user sees their hierarchy's opportunities", client: "vb", params: "&userEmail=se.one@example.com", userEmail: "se.one@example.com", status: 200,
+			condition: "a.id IN", order: "ORDER BY AccountName ASC, OpportunityID ASC", args: []interface{}{"se.one@example.com"}},
+		{name: "admin sees every opportunity", client: "vb", params: "&userEmail=admin@example.com", admin: true, status: 200,
+			order: "ORDER BY AccountName ASC, OpportunityID ASC"},
+		{name: "filters are bound after the user", client: "vb", params: "&userEmail=se.one@example.com&accountName=acme&stage=poc", userEmail: "se.one@example.com", status: 200,
+			condition: "UPPER(a.accountname) LIKE :2 ESCAPE '\\' AND UPPER(NVL(stg.stage, 'None')) = :3", order: "ORDER BY AccountName ASC, OpportunityID ASC",
+			args: []interface{}{"se.one@example.com", "%ACME%", "POC"}},
+		{name: "wildcards in a filter are matched literally", client: "integration", params: "&accountName=100%25_", status: 200,
+			condition: "UPPER(a.accountname) LIKE :1 ESCAPE '\\'", order: "ORDER BY AccountName ASC, OpportunityID ASC", args: []interface{}{"%100\\%\\_%"}},
+		{name: "sort order", client: "integration", params: "&sortBy=arr&sortOrder=desc", status: 200,
+			order: "ORDER BY ARR DESC, AccountName ASC, OpportunityID ASC"},
+		{name: "updated since", client: "integration", params: "&updatedSince=2020-10-08T14:03:00%2B01:00", status: 200,
+			condition: "o.lastupdatedate > TO_DATE(:1, 'YYYY-MM-DD HH24:MI:SS')", order: "ORDER BY AccountName ASC, OpportunityID ASC", args: []interface{}{"2020-10-08 13:03:00"}},
+		{name: "invalid updatedSince", client: "integration", params: "&updatedSince=yesterday", status: 400},
+		{name: "invalid sortBy", client: "integration", params: "&sortBy=summary", status: 400},
+		{name: "unsupported filter", client: "integration", params: "&color=red", status: 400},
+		{name: "untrusted client can't name a user", client: "other", params: "&userEmail=se.one@example.com", status: 400},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mem, db := newQueryTestStore(t)
+			expectAdminLookup(mem, test.admin)
+			expectOpportunities(mem)
+
+			w := serveQuery(getECALOpportunityQueryHandler(db), test.client, "/getECALOpportunityQuery?instanceEnvironment="+testInstanceEnv+test.params)
+			if w.Code != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, w.Code, w.Body.String())
+			}
+			if test.status != 200 {
+				if len(endpointStatements(mem)) > 0 {
+					t.Errorf("expected no query for a refused request, got %v", mem.Statements())
+				}
+				return
+			}
+
+			statement := checkScopedStatement(t, mem, test.userEmail)
+			if !strings.Contains(statement.Query, test.condition) {
+				t.Errorf("expected %q in: %s", test.condition, statement.Query)
+			}
+			if !strings.HasSuffix(statement.Query, test.order) {
+				t.Errorf("expected %q at the end of: %s", test.order, statement.Query)
+			}
+			if (len(statement.Args) > 0 || len(test.args) > 0) && !reflect.DeepEqual(statement.Args, test.args) {
+				t.Errorf("expected args %v, got %v", test.args, statement.Args)
+			}
+
+			response := decodeQueryResponse(t, w)
+			if len(response.Items) != 2 || response.Truncated {
+				t.Fatalf("expected 2 rows, got %d (truncated %t)", len(response.Items), response.Truncated)
+			}
+			first, second := response.Items[0], response.Items[1]
+			if first["ID"] != 21.0 || first["ARR"] != 250000.0 || first["POC"] != true || first["Blockers"] != true || first["LastActivity"] != "2020-08-20T10:15:00+00:00" {
+				t.Errorf("unexpected first opportunity: %v", first)
+			}
+			if second["POC"] != false || second["Blockers"] != false {
+				t.Errorf("unexpected second opportunity: %v", second)
+			}
+		})
+	}
+}
+
+func TestGetECALOpportunityQueryHandlerCache(t *testing.T) {
+	mem, db := newQueryTestStore(t)
+	expectOpportunities(mem)
+
+	// a filtered list is never cached, so only the plain list is answered from the cache the second time
+	handler := getECALOpportunityQueryHandler(db)
+	for _, params := range []string{"", "", "&stage=poc", "&stage=poc"} {
+		w := serveQuery(handler, "integration", "/getECALOpportunityQuery?instanceEnvironment="+testInstanceEnv+params)
+		if w.Code != 200 {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if response := decodeQueryResponse(t, w); len(response.Items) != 2 {
+			t.Errorf("expected 2 rows, got %d: %s", len(response.Items), w.Body.String())
+		}
+	}
+	if len(mem.Statements()) != 3 {
+		t.Errorf("expected one plain query and two filtered ones, got %v", mem.Statements())
+	}
+}
+
+func TestGetECALOpportunityQueryHandlerErrors(t *testing.T) {
+	mem, db := newQueryTestStore(t)
+	mem.ExpectQuery(`SELECT DISTINCT\(o\.id\) AS ID`, testOpportunityColumns[:3], []interface{}{"21", "1", "Acme Corp"})
+
+	// a row the handler can't read is a server error, not a partial list
+	w := serveQuery(getECALOpportunityQueryHandler(db), "integration", "/getECALOpportunityQuery?instanceEnvironment="+testInstanceEnv)
+	if w.Code != 500 {
+		t.Fatalf("expected 500, got %d: %s", w.Code, w.Body.String())
+	}
+
+	mem, db = newQueryTestStore(t)
+	mem.ExpectError(`SELECT DISTINCT\(o\.id\) AS ID`, errors.New("ORA-01013: user requested cancel of current operation"))
+	w = serveQuery(getECALOpportunityQueryHandler(db), "integration", "/getECALOpportunityQuery?instanceEnvironment="+testInstanceEnv)
+	if w.Code != 500 {
+		t.Fatalf("expected 500, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestGetECALOpportunityQueryHandlerCountOnly(t *testing.T) {
+	mem, db := newQueryTestStore(t)
+	expectAdminLookup(mem, false)
+	mem.ExpectQuery(`SELECT COUNT\(\*\), MAX\(LastActivity\) FROM \(`, []string{"count", "lastactivity"}, []interface{}{"12", "2020-08-20 10:15:00"})
+
+	w := serveQuery(getECALOpportunityQueryHandler(db), "vb", "/getECALOpportunityQuery?instanceEnvironment="+testInstanceEnv+"&userEmail=se.one@example.com&stage=poc&countOnly=true")
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	response := decodeQueryResponse(t, w)
+	if response.Count == nil || *response.Count != 12 {
+		t.Errorf("expected a count of 12: %s", w.Body.String())
+	}
+	statement := checkScopedStatement(t, mem, "se.one@example.com")
+	if !reflect.DeepEqual(statement.Args, []interface{}{"se.one@example.com", "POC"}) {
+		t.Errorf("expected the filters to be counted, got %v", statement.Args)
+	}
+}
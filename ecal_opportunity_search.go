@@ -0,0 +1,174 @@
+//  ECAL Opportunity Search
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// OpportunitySearchResult is one active revenue line of LookupOpportunity matching a search
+type OpportunitySearchResult struct {
+	ID                   int64   `json:"id"`
+	OpportunityID        string  `json:"opportunity_id"`
+	RevenueLineID        string  `json:"revenue_line_id"`
+	CustomerName         string  `json:"customer_name"`
+	CimID                string  `json:"cim_id"`
+	Summary              string  `json:"summary"`
+	ProductName          string  `json:"product_name"`
+	ProductLine          string  `json:"product_line"`
+	OpportunityStatus    string  `json:"opportunity_status"`
+	RevenueSalesStage    string  `json:"revenue_sales_stage"`
+	AnticipatedCloseDate string  `json:"anticipated_close_date"`
+	WorkloadAmount       float64 `json:"workload_amount"`
+}
+
+// the page size of searchOpportunities when maxRows isn't given; a picker only shows the first few matches
+const defaultSearchRows = 50
+
+// the shortest search term accepted, so a single keystroke doesn't match the whole table
+const minSearchLength = 2
+
+// the order results are returned and paged in, case-insensitively by customer name
+const opportunitySearchKey = "UPPER(NVL(customername, ' '))"
+
+//
+// HTTP handler for the searchOpportunities functionality.  Finds active opportunities in LookupOpportunity by
+// customer name, opportunity ID or product a page at a time, for the pickers that attach an opportunity to an ECAL
+// account rather than downloading the whole lookup table.
+//
+func searchOpportunitiesHandler(w http.ResponseWriter, r *http.Request) {
+	// get query parameters
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	term := query.Get("q")
+
+	maxRows := defaultSearchRows
+	if len(query.Get("maxRows")) > 0 {
+		var err error
+		maxRows, err = getMaxRows(query.Get("maxRows"))
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+	}
+	cursor, err := decodeCursor(query.Get("cursor"))
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+
+	// call the helper which does the data mashing
+	result, err := searchOpportunities(r.Context(), instanceEnv, term, maxRows, cursor)
+	if queryCancelled(r.Context(), "opportunity_search", err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "opportunity_search", err.Error())
+		return
+	}
+
+	// write result to output stream
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+//
+// Returns the active LookupOpportunity revenue lines whose customer name, product name, line or group contains term
+// or whose opportunity ID starts with it (all case-insensitive) as {"items": [...], "truncated", "next_cursor"}.
+// Results are ordered by customer name and at most maxRows are returned after cursor; when more match, next_cursor
+// is the cursor of the last one returned.
+//
+func searchOpportunities(ctx context.Context, instanceEnv string, term string, maxRows int, cursor pageCursor) ([]byte, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 {
+		return nil, inputError("instanceEnvironment query parameter is invalid")
+	}
+	term = strings.ToUpper(strings.TrimSpace(term))
+	if len([]rune(term)) < minSearchLength {
+		return nil, inputError(fmt.Sprintf("q query parameter must be at least %d characters", minSearchLength))
+	}
+
+	// the term is matched literally, so the LIKE wildcards in it are escaped
+	pattern := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(term)
+	args := []interface{}{"%" + pattern + "%", pattern + "%"}
+	where := `WHERE active = 1 AND (UPPER(customername) LIKE :1 ESCAPE '\' OR UPPER(opportunityid) LIKE :2 ESCAPE '\'
+		OR UPPER(productname) LIKE :1 ESCAPE '\' OR UPPER(productline) LIKE :1 ESCAPE '\' OR UPPER(productgroup) LIKE :1 ESCAPE '\')`
+	if len(cursor.ID) > 0 {
+		if _, err := strconv.ParseInt(cursor.ID, 10, 64); err != nil {
+			return nil, inputError("cursor is invalid")
+		}
+		args = append(args, cursor.Key, cursor.ID)
+		where += " AND (" + opportunitySearchKey + " > :3 OR (" + opportunitySearchKey + " = :3 AND id > :4))"
+	}
+
+	// one row more than the page tells whether there is another page
+	args = append(args, maxRows+1)
+	query := `SELECT id, NVL(opportunityid, ' '), NVL(revenuelineid, ' '), customername, cimid, summary, productname,
+			productline, opportunitystatus, revenuesalesstage, TO_CHAR(anticipatedclosedate, 'YYYY-MM-DD'),
+			NVL(workloadamount, 0), ` + opportunitySearchKey + `
+		FROM ` + schema + `.LookupOpportunity ` + where + `
+		ORDER BY ` + opportunitySearchKey + `, id
+		FETCH FIRST :` + strconv.Itoa(len(args)) + ` ROWS ONLY`
+
+	timer := startQueryTimer("searchOpportunities", instanceEnv)
+	rows, err := DBPool.QueryContext(ctx, tagQuery("searchOpportunities", instanceEnv, query), args...)
+	if err != nil {
+		thisError := fmt.Sprintf("Error searching opportunities (%s): %s", instanceEnv, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	items := []OpportunitySearchResult{}
+	nextCursor := ""
+	last := pageCursor{}
+	for rows.Next() {
+		var item OpportunitySearchResult
+		var customerName, cimID, summary, productName, productLine, status, salesStage, closeDate sql.NullString
+		var sortKey string
+		err := rows.Scan(&item.ID, &item.OpportunityID, &item.RevenueLineID, &customerName, &cimID, &summary, &productName,
+			&productLine, &status, &salesStage, &closeDate, &item.WorkloadAmount, &sortKey)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning opportunity search row (%s): %s", instanceEnv, err.Error())
+			return nil, errors.New(thisError)
+		}
+		if len(items) >= maxRows {
+			nextCursor = encodeCursor(last)
+			break
+		}
+		last = pageCursor{ID: strconv.FormatInt(item.ID, 10), Key: sortKey}
+
+		item.OpportunityID = strings.TrimSpace(item.OpportunityID)
+		item.RevenueLineID = strings.TrimSpace(item.RevenueLineID)
+		item.CustomerName, item.CimID, item.Summary = customerName.String, cimID.String, summary.String
+		item.ProductName, item.ProductLine = productName.String, productLine.String
+		item.OpportunityStatus, item.RevenueSalesStage = status.String, salesStage.String
+		item.AnticipatedCloseDate = formatDate("searchOpportunities", closeDate.String)
+		items = append(items, item)
+	}
+	err = rows.Err()
+	if err != nil {
+		thisError := fmt.Sprintf("Error reading opportunity search rows (%s): %s", instanceEnv, err.Error())
+		return nil, errors.New(thisError)
+	}
+	timer.done(len(items))
+
+	return json.Marshal(map[string]interface{}{"items": items, "truncated": len(nextCursor) > 0, "next_cursor": nextCursor})
+}
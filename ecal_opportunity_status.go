@@ -0,0 +1,139 @@
+//  ECAL Opportunity Status
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// maximum length in bytes of a status update; OpportunityStatus.status is a VARCHAR2(4000)
+const maxStatusLength = 4000
+
+// StatusRecord is a status update posted against an ECAL workload
+type StatusRecord struct {
+	OpportunityID int64  `json:"opportunity_id"`
+	Status        string `json:"status"`
+	Author        string `json:"author"`
+}
+
+// errOpportunityNotFound is returned when the opportunity (workload) being updated doesn't exist
+var errOpportunityNotFound = errors.New("opportunity not found")
+
+var authorPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+//
+// HTTP handler for the postOpportunityStatus functionality.  Appends a status update to an ECAL workload so that
+// integrations (e.g. the Slack status bot) can post updates without going through VB.
+//
+func postOpportunityStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+	instanceEnv := r.URL.Query().Get("instanceEnvironment")
+
+	// decode the status from the body
+	var record StatusRecord
+	err := json.NewDecoder(r.Body).Decode(&record)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Unable to parse status")
+		logRequest(r, logError, "opportunity_status", "Unable to decode body: "+err.Error())
+		return
+	}
+
+	// record the status
+	id, err := postOpportunityStatus(instanceEnv, record)
+	if err == errOpportunityNotFound {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Opportunity not found")
+		logRequest(r, logWarn, "opportunity_status", fmt.Sprintf("Opportunity %d not found (%s)", record.OpportunityID, instanceEnv))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "opportunity_status", err.Error())
+		return
+	}
+
+	message := fmt.Sprintf("Posted status %d for opportunity %d by %s in %s", id, record.OpportunityID, record.Author, instanceEnv)
+	logRequest(r, logInfo, "opportunity_status", message)
+
+	// write result to output stream
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{\"id\": %d}", id)
+}
+
+//
+// Validates and sanitizes a status update and inserts it into OpportunityStatus.  Returns the id of the new row.
+//
+func postOpportunityStatus(instanceEnv string, record StatusRecord) (int64, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		thisError := fmt.Sprintf("instanceEnvironment query parameter is invalid (%s)", instanceEnv)
+		return 0, errors.New(thisError)
+	}
+
+	author := strings.ToLower(strings.TrimSpace(record.Author))
+	status := sanitizeMultilineText(record.Status, maxStatusLength)
+	if record.OpportunityID < 1 || len(status) < 1 || !authorPattern.MatchString(author) {
+		thisError := fmt.Sprintf("opportunity_id, status and a valid author email are required (%s, %d, %s)", instanceEnv, record.OpportunityID, record.Author)
+		return 0, errors.New(thisError)
+	}
+
+	// start a DB transaction so the status and its event are written together
+	tx, err := DBPool.Begin()
+	if err != nil {
+		thisError := fmt.Sprintf("Error starting DB transaction (%s): %s", instanceEnv, err.Error())
+		return 0, errors.New(thisError)
+	}
+	defer tx.Rollback()
+
+	// make sure the opportunity exists
+	var count int
+	err = tx.QueryRow("SELECT count(*) FROM "+schema+".Opportunity WHERE id = :1", record.OpportunityID).Scan(&count)
+	if err != nil {
+		thisError := fmt.Sprintf("Error looking up opportunity (%s, %d): %s", instanceEnv, record.OpportunityID, err.Error())
+		return 0, errors.New(thisError)
+	}
+	if count == 0 {
+		return 0, errOpportunityNotFound
+	}
+
+	var id int64
+	_, err = tx.Exec("INSERT INTO "+schema+".OpportunityStatus "+
+		"(opportunity, status, creationdate, lastupdatedate, createdby, lastupdatedby) "+
+		"VALUES (:1, :2, SYSDATE, SYSDATE, :3, :3) RETURNING id INTO :4",
+		record.OpportunityID, status, author, sql.Out{Dest: &id})
+	if err != nil {
+		thisError := fmt.Sprintf("Error inserting status (%s, %d, %s): %s", instanceEnv, record.OpportunityID, author, err.Error())
+		return 0, errors.New(thisError)
+	}
+
+	err = enqueueEvent(tx, instanceEnv, eventStatusPosted, map[string]interface{}{"id": id, "opportunity_id": record.OpportunityID,
+		"status": status, "author": author})
+	if err != nil {
+		thisError := fmt.Sprintf("Error writing event (%s, %d): %s", instanceEnv, record.OpportunityID, err.Error())
+		return 0, errors.New(thisError)
+	}
+
+	// complete the transaction
+	err = tx.Commit()
+	if err != nil {
+		thisError := fmt.Sprintf("Error committing transaction (%s, %d): %s", instanceEnv, record.OpportunityID, err.Error())
+		return 0, errors.New(thisError)
+	}
+	invalidateQueryCacheFor(instanceEnv)
+
+	return id, nil
+}
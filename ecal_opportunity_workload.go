@@ -0,0 +1,265 @@
+//  ECAL Opportunity Workload Association
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// StrandedWorkload is an OpportunityWorkload whose revenue line is no longer active in LookupOpportunity, along with
+// the opportunity's active revenue lines that aren't linked to any workload.  LineStatus is CLOSED or VANISHED
+// (from the lookup's deactivation reason) or MISSING if the line was never loaded.
+type StrandedWorkload struct {
+	WorkloadID         int64    `json:"workload_id"`
+	OpportunityID      int64    `json:"ecal_opportunity_id"`
+	AriaOpportunityID  string   `json:"opportunity_id"`
+	WorkloadIdentifier string   `json:"workload_identifier"`
+	LineStatus         string   `json:"revenue_line_status"`
+	Candidates         []string `json:"candidate_revenue_lines"`
+	SuspectedSplit     bool     `json:"suspected_split"`
+}
+
+// errWorkloadConflict is returned when a revenue line is already linked to another workload
+var errWorkloadConflict = errors.New("revenue line already linked to a workload")
+
+//
+// HTTP handler for the opportunityWorkload functionality.  GET lists workloads stranded from the opportunity sync
+// (optionally for a single opportunityId).  POST links revenueLineId to opportunityId, either by repairing the
+// existing workload given by workloadId or by creating a new OpportunityWorkload row.
+//
+func opportunityWorkloadHandler(w http.ResponseWriter, r *http.Request) {
+	// get query parameters
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	opportunityID := query.Get("opportunityId")
+
+	var result interface{}
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		result, err = getStrandedWorkloads(instanceEnv, opportunityID)
+	case http.MethodPost:
+		result, err = linkOpportunityWorkload(instanceEnv, opportunityID, query.Get("revenueLineId"), query.Get("workloadId"), query.Get("updatedBy"))
+	default:
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		logRequest(r, logWarn, "opportunity_workload", fmt.Sprintf("%s opportunity %s (%s): %s", r.Method, opportunityID, instanceEnv, inputErr.Error()))
+		return
+	}
+	if err == errOpportunityNotFound {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Opportunity or workload not found")
+		return
+	}
+	if err == errWorkloadConflict {
+		w.WriteHeader(409)
+		fmt.Fprintf(w, "Revenue line is already linked to a workload")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "opportunity_workload", err.Error())
+		return
+	}
+
+	// write result to output stream
+	json, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+//
+// Returns {"items": [...]} of workloads whose revenue line is not active in LookupOpportunity.  A workload whose
+// opportunity now has more than one unlinked revenue line most likely had its line split upstream.
+//
+func getStrandedWorkloads(instanceEnv string, opportunityID string) (map[string]interface{}, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		thisError := fmt.Sprintf("instanceEnvironment query parameter is invalid (%s, %s)", instanceEnv, opportunityID)
+		return nil, errors.New(thisError)
+	}
+
+	var template = `
+	SELECT w.id, o.id, o.opportunityid, NVL(w.workloadidentifier, ' '),
+		NVL((SELECT MAX(l.deactivationreason) FROM %SCHEMA%.LookupOpportunity l
+			WHERE l.opportunityid = o.opportunityid AND l.revenuelineid = w.workloadidentifier), 'MISSING'),
+		NVL((SELECT LISTAGG(l.revenuelineid, ',') WITHIN GROUP (ORDER BY l.revenuelineid)
+			FROM %SCHEMA%.LookupOpportunity l
+			WHERE l.opportunityid = o.opportunityid AND l.active = 1
+			AND NOT EXISTS (SELECT 1 FROM %SCHEMA%.OpportunityWorkload w2 WHERE w2.opportunity = o.id AND w2.workloadidentifier = l.revenuelineid)
+		), ' ')
+	FROM %SCHEMA%.OpportunityWorkload w
+	INNER JOIN %SCHEMA%.Opportunity o ON o.id = w.opportunity
+	WHERE NOT EXISTS
+		(SELECT 1 FROM %SCHEMA%.LookupOpportunity l WHERE l.opportunityid = o.opportunityid AND l.revenuelineid = w.workloadidentifier AND l.active = 1)
+	`
+	args := []interface{}{}
+	if len(opportunityID) > 0 {
+		id, err := strconv.ParseInt(opportunityID, 10, 64)
+		if err != nil {
+			return nil, inputError("opportunityId query parameter is invalid")
+		}
+		template += " AND o.id = :1"
+		args = append(args, id)
+	}
+	template += " ORDER BY o.id, w.id"
+
+	rows, err := DBPool.Query(strings.ReplaceAll(template, "%SCHEMA%", schema), args...)
+	if err != nil {
+		thisError := fmt.Sprintf("Error running query (%s, %s): %s", instanceEnv, opportunityID, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	items := []StrandedWorkload{}
+	for rows.Next() {
+		var item StrandedWorkload
+		var candidates string
+		err := rows.Scan(&item.WorkloadID, &item.OpportunityID, &item.AriaOpportunityID, &item.WorkloadIdentifier, &item.LineStatus, &candidates)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning row (%s, %s): %s", instanceEnv, opportunityID, err.Error())
+			return nil, errors.New(thisError)
+		}
+		item.WorkloadIdentifier = strings.TrimSpace(item.WorkloadIdentifier)
+		item.Candidates = []string{}
+		if candidates = strings.TrimSpace(candidates); len(candidates) > 0 {
+			item.Candidates = strings.Split(candidates, ",")
+		}
+		item.SuspectedSplit = len(item.Candidates) > 1
+		items = append(items, item)
+	}
+
+	return map[string]interface{}{"items": items}, nil
+}
+
+//
+// Links a LookupOpportunity revenue line to an ECAL opportunity.  If workloadID is set that workload's identifier
+// is repaired to point at the revenue line; otherwise a new OpportunityWorkload is created from the revenue line.
+// Either way the change is audited.
+//
+func linkOpportunityWorkload(instanceEnv string, opportunityID string, revenueLineID string, workloadID string, updatedBy string) (map[string]interface{}, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		thisError := fmt.Sprintf("instanceEnvironment query parameter is invalid (%s, %s)", instanceEnv, opportunityID)
+		return nil, errors.New(thisError)
+	}
+	oppID, err := strconv.ParseInt(opportunityID, 10, 64)
+	if err != nil || oppID < 1 {
+		return nil, inputError("opportunityId query parameter is invalid")
+	}
+	if len(revenueLineID) < 1 || len(updatedBy) < 1 {
+		return nil, inputError("revenueLineId and updatedBy query parameters are required")
+	}
+	updatedBy = strings.ToLower(updatedBy)
+
+	// start a DB transaction
+	tx, err := DBPool.Begin()
+	if err != nil {
+		thisError := fmt.Sprintf("Error starting DB transaction (%s): %s", instanceEnv, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer tx.Rollback()
+
+	// the revenue line must belong to the same Aria opportunity as the ECAL opportunity
+	var productDescription, productGroup, consumptionStartDate sql.NullString
+	var rampMonths sql.NullFloat64
+	err = tx.QueryRow("SELECT l.productdescription, l.productgroup, TO_CHAR(l.consumptionstartdate, 'YYYY-MM-DD'), l.consumptionrampmonths "+
+		"FROM "+schema+".LookupOpportunity l INNER JOIN "+schema+".Opportunity o ON o.opportunityid = l.opportunityid "+
+		"WHERE o.id = :1 AND l.revenuelineid = :2 AND l.active = 1", oppID, revenueLineID).
+		Scan(&productDescription, &productGroup, &consumptionStartDate, &rampMonths)
+	if err == sql.ErrNoRows {
+		var count int
+		err = tx.QueryRow("SELECT count(*) FROM "+schema+".Opportunity WHERE id = :1", oppID).Scan(&count)
+		if err == nil && count == 0 {
+			return nil, errOpportunityNotFound
+		}
+		return nil, inputError("revenueLineId is not an open revenue line of this opportunity")
+	}
+	if err != nil {
+		thisError := fmt.Sprintf("Error looking up revenue line (%s, %d, %s): %s", instanceEnv, oppID, revenueLineID, err.Error())
+		return nil, errors.New(thisError)
+	}
+
+	// a revenue line can only feed one workload or the sync updates would overwrite each other
+	var linked int
+	err = tx.QueryRow("SELECT count(*) FROM "+schema+".OpportunityWorkload WHERE opportunity = :1 AND workloadidentifier = :2", oppID, revenueLineID).Scan(&linked)
+	if err != nil {
+		thisError := fmt.Sprintf("Error checking existing links (%s, %d, %s): %s", instanceEnv, oppID, revenueLineID, err.Error())
+		return nil, errors.New(thisError)
+	}
+	if linked > 0 {
+		return nil, errWorkloadConflict
+	}
+
+	result := map[string]interface{}{"ecal_opportunity_id": oppID, "revenue_line_id": revenueLineID}
+	var id int64
+	if len(workloadID) > 0 {
+		id, err = strconv.ParseInt(workloadID, 10, 64)
+		if err != nil {
+			return nil, inputError("workloadId query parameter is invalid")
+		}
+
+		var previous sql.NullString
+		err = tx.QueryRow("SELECT workloadidentifier FROM "+schema+".OpportunityWorkload WHERE id = :1 AND opportunity = :2 FOR UPDATE", id, oppID).Scan(&previous)
+		if err == sql.ErrNoRows {
+			return nil, errOpportunityNotFound
+		}
+		if err != nil {
+			thisError := fmt.Sprintf("Error looking up workload (%s, %d): %s", instanceEnv, id, err.Error())
+			return nil, errors.New(thisError)
+		}
+
+		_, err = tx.Exec("UPDATE "+schema+".OpportunityWorkload SET workloadidentifier = :1, lastupdatedate = SYSDATE, lastupdatedby = :2 WHERE id = :3",
+			revenueLineID, updatedBy, id)
+		if err != nil {
+			thisError := fmt.Sprintf("Error repairing workload (%s, %d): %s", instanceEnv, id, err.Error())
+			return nil, errors.New(thisError)
+		}
+		result["action"] = "repaired"
+		result["previous_workload_identifier"] = previous.String
+	} else {
+		_, err = tx.Exec("INSERT INTO "+schema+".OpportunityWorkload "+
+			"(opportunity, workloadidentifier, workloaddescription, workloadtype, consumptionstartdate, consumptionrampmonths, "+
+			"creationdate, lastupdatedate, createdby, lastupdatedby) "+
+			"VALUES (:1, :2, :3, :4, TO_DATE(:5, 'YYYY-MM-DD'), :6, SYSDATE, SYSDATE, :7, :7) RETURNING id INTO :8",
+			oppID, revenueLineID, productDescription, productGroup, consumptionStartDate, rampMonths, updatedBy, sql.Out{Dest: &id})
+		if err != nil {
+			thisError := fmt.Sprintf("Error creating workload (%s, %d, %s): %s", instanceEnv, oppID, revenueLineID, err.Error())
+			return nil, errors.New(thisError)
+		}
+		result["action"] = "created"
+	}
+	result["workload_id"] = id
+
+	err = recordAudit(tx, instanceEnv, "OpportunityWorkload", strconv.FormatInt(id, 10), result["action"].(string), updatedBy, result)
+	if err != nil {
+		thisError := fmt.Sprintf("Error writing audit record (%s, %d): %s", instanceEnv, id, err.Error())
+		return nil, errors.New(thisError)
+	}
+
+	// complete the transaction
+	err = tx.Commit()
+	if err != nil {
+		thisError := fmt.Sprintf("Error committing transaction (%s, %d): %s", instanceEnv, oppID, err.Error())
+		return nil, errors.New(thisError)
+	}
+	invalidateQueryCacheFor(instanceEnv)
+
+	logOutput(logInfo, "opportunity_workload", fmt.Sprintf("%s workload %d for opportunity %d -> %s by %s (%s)", result["action"], id, oppID, revenueLineID, updatedBy, instanceEnv))
+	return result, nil
+}
@@ -0,0 +1,156 @@
+//  ECAL Pipeline by Territory
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// TerritoryPipeline is the open pipeline of a territory (or of a territory owner across their territories)
+type TerritoryPipeline struct {
+	Territory     string               `json:"territory,omitempty"`
+	OwnerEmail    string               `json:"owner_email"`
+	ARR           float64              `json:"arr"`
+	TCV           float64              `json:"tcv"`
+	Opportunities int                  `json:"opportunities"`
+	L3Territories []*TerritoryPipeline `json:"l3_territories,omitempty"`
+}
+
+func (p *TerritoryPipeline) add(arr float64, tcv float64, opportunities int) {
+	p.ARR += arr
+	p.TCV += tcv
+	p.Opportunities += opportunities
+}
+
+//
+// HTTP handler for the getPipelineByTerritory functionality.  Returns the open pipeline in LookupOpportunity by L2 and
+// L3 territory along with the totals of each territory owner.  l2Territory optionally limits it to one L2 territory.
+//
+func getPipelineByTerritoryHandler(w http.ResponseWriter, r *http.Request) {
+	// get query parameters
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	l2Territory := query.Get("l2Territory")
+
+	// call the helper which does the data mashing
+	result, err := getPipelineByTerritory(r.Context(), instanceEnv, l2Territory)
+	if queryCancelled(r.Context(), "pipeline_territory", err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "pipeline_territory", err.Error())
+		return
+	}
+
+	// write result to output stream
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+//
+// Returns the open pipeline of the instanceEnvironment as {"items": [L2 territories with their L3 territories],
+// "owners": [territory owner totals]}.  ARR and TCV are the revenue line pipeline and TCV amounts of the feed.
+// An owner of both an L2 and one of its L3 territories has the L2 total only so nothing is counted twice.
+//
+func getPipelineByTerritory(ctx context.Context, instanceEnv string, l2Territory string) ([]byte, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		return nil, inputError("instanceEnvironment query parameter is invalid")
+	}
+
+	template := `SELECT NVL(l.l2territoryname, 'Unassigned'), NVL(l.l2territoryemail, ' '),
+			NVL(l.l3territoryname, 'Unassigned'), NVL(l.l3territoryemail, ' '),
+			SUM(NVL(l.revenuepipelinek, 0)), SUM(NVL(l.revenuetcvk, 0)), COUNT(DISTINCT l.opportunityid)
+		FROM %SCHEMA%.LookupOpportunity l
+		WHERE l.active = 1 AND l.opportunitystatus = 'Open'`
+	if len(l2Territory) > 0 {
+		template += " AND l.l2territoryname = :1"
+	}
+	template += " GROUP BY l.l2territoryname, l.l2territoryemail, l.l3territoryname, l.l3territoryemail"
+	query := strings.ReplaceAll(template, "%SCHEMA%", schema)
+
+	var rows *sql.Rows
+	var err error
+	if len(l2Territory) > 0 {
+		rows, err = DBPool.QueryContext(ctx, query, l2Territory)
+	} else {
+		rows, err = DBPool.QueryContext(ctx, query)
+	}
+	if err != nil {
+		thisError := fmt.Sprintf("Error running pipeline query (%s, %s): %s", instanceEnv, l2Territory, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	l2s := make(map[string]*TerritoryPipeline)
+	l3s := make(map[string]*TerritoryPipeline)
+	owners := make(map[string]*TerritoryPipeline)
+	for rows.Next() {
+		var l2Name, l2Owner, l3Name, l3Owner string
+		var arr, tcv float64
+		var opportunities int
+		err := rows.Scan(&l2Name, &l2Owner, &l3Name, &l3Owner, &arr, &tcv, &opportunities)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning pipeline row (%s): %s", instanceEnv, err.Error())
+			return nil, errors.New(thisError)
+		}
+		l2Owner = strings.TrimSpace(l2Owner)
+		l3Owner = strings.TrimSpace(l3Owner)
+
+		l2 := l2s[l2Name]
+		if l2 == nil {
+			l2 = &TerritoryPipeline{Territory: l2Name, OwnerEmail: l2Owner}
+			l2s[l2Name] = l2
+		}
+		l2.add(arr, tcv, opportunities)
+
+		l3 := l3s[l2Name+"\x00"+l3Name]
+		if l3 == nil {
+			l3 = &TerritoryPipeline{Territory: l3Name, OwnerEmail: l3Owner}
+			l3s[l2Name+"\x00"+l3Name] = l3
+			l2.L3Territories = append(l2.L3Territories, l3)
+		}
+		l3.add(arr, tcv, opportunities)
+
+		// roll up to the owners
+		for i, owner := range []string{l2Owner, l3Owner} {
+			if len(owner) < 1 || (i == 1 && owner == l2Owner) {
+				continue
+			}
+			if owners[owner] == nil {
+				owners[owner] = &TerritoryPipeline{OwnerEmail: owner}
+			}
+			owners[owner].add(arr, tcv, opportunities)
+		}
+	}
+
+	items := []*TerritoryPipeline{}
+	for _, l2 := range l2s {
+		sort.Slice(l2.L3Territories, func(i, j int) bool { return l2.L3Territories[i].Territory < l2.L3Territories[j].Territory })
+		items = append(items, l2)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Territory < items[j].Territory })
+	ownerItems := []*TerritoryPipeline{}
+	for _, owner := range owners {
+		ownerItems = append(ownerItems, owner)
+	}
+	sort.Slice(ownerItems, func(i, j int) bool { return ownerItems[i].OwnerEmail < ownerItems[j].OwnerEmail })
+
+	return json.Marshal(map[string]interface{}{"items": items, "owners": ownerItems})
+}
@@ -0,0 +1,133 @@
+//  ECAL Product Catalog
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// ProductCatalogEntry is one class/pillar/line/group path of the product taxonomy
+type ProductCatalogEntry struct {
+	ProductClass  string `json:"product_class"`
+	ProductPillar string `json:"product_pillar"`
+	ProductLine   string `json:"product_line"`
+	ProductGroup  string `json:"product_group"`
+}
+
+// the taxonomy levels that can be listed with level=, mapped to their LookupProduct column
+var productCatalogLevels = map[string]string{
+	"class":  "ProductClass",
+	"pillar": "ProductPillar",
+	"line":   "ProductLine",
+	"group":  "ProductGroup",
+}
+
+//
+// HTTP handler for the getProductCatalog functionality.  Returns the active product taxonomy loaded from the product
+// feed, optionally narrowed by productClass/productPillar/productLine.  With level=class|pillar|line|group only the
+// distinct values at that level are returned, which is what the app pick lists need.
+//
+func getProductCatalogHandler(w http.ResponseWriter, r *http.Request) {
+	// get query parameters
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	level := query.Get("level")
+	filters := map[string]string{
+		"ProductClass":  query.Get("productClass"),
+		"ProductPillar": query.Get("productPillar"),
+		"ProductLine":   query.Get("productLine"),
+	}
+
+	// call the helper which does the data mashing
+	result, err := getProductCatalog(instanceEnv, level, filters)
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "product_catalog", err.Error())
+		return
+	}
+
+	// write result to output stream
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+//
+// Returns the active LookupProduct entries matching filters (column -> value, empty values are ignored) as
+// {"items": [...]}.  If level is set the items are the distinct values at that level instead of full entries.
+//
+func getProductCatalog(instanceEnv string, level string, filters map[string]string) ([]byte, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 {
+		return nil, inputError("instanceEnvironment query parameter is invalid")
+	}
+	column, ok := productCatalogLevels[level]
+	if len(level) > 0 && !ok {
+		return nil, inputError("level must be one of class, pillar, line or group")
+	}
+
+	where := "WHERE active = 1"
+	args := []interface{}{}
+	for _, filter := range []string{"ProductClass", "ProductPillar", "ProductLine"} {
+		if len(filters[filter]) > 0 {
+			args = append(args, filters[filter])
+			where += " AND " + filter + " = :" + strconv.Itoa(len(args))
+		}
+	}
+
+	// distinct values at one level
+	if len(level) > 0 {
+		rows, err := DBPool.Query("SELECT DISTINCT "+column+" FROM "+schema+".LookupProduct "+where+
+			" AND "+column+" IS NOT NULL ORDER BY "+column, args...)
+		if err != nil {
+			thisError := fmt.Sprintf("Error querying product catalog (%s, %s): %s", instanceEnv, level, err.Error())
+			return nil, errors.New(thisError)
+		}
+		defer rows.Close()
+
+		values := []string{}
+		for rows.Next() {
+			var value string
+			if err := rows.Scan(&value); err != nil {
+				thisError := fmt.Sprintf("Error scanning product catalog row (%s, %s): %s", instanceEnv, level, err.Error())
+				return nil, errors.New(thisError)
+			}
+			values = append(values, value)
+		}
+		return json.Marshal(map[string][]string{"items": values})
+	}
+
+	rows, err := DBPool.Query("SELECT ProductClass, ProductPillar, ProductLine, ProductGroup "+
+		"FROM "+schema+".LookupProduct "+where+" ORDER BY ProductClass, ProductPillar, ProductLine, ProductGroup", args...)
+	if err != nil {
+		thisError := fmt.Sprintf("Error querying product catalog (%s): %s", instanceEnv, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	items := []ProductCatalogEntry{}
+	for rows.Next() {
+		var class string
+		var pillar, line, group sql.NullString
+		err := rows.Scan(&class, &pillar, &line, &group)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning product catalog row (%s): %s", instanceEnv, err.Error())
+			return nil, errors.New(thisError)
+		}
+		items = append(items, ProductCatalogEntry{ProductClass: class, ProductPillar: pillar.String,
+			ProductLine: line.String, ProductGroup: group.String})
+	}
+	return json.Marshal(map[string][]ProductCatalogEntry{"items": items})
+}
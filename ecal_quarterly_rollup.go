@@ -0,0 +1,184 @@
+//  ECAL Quarterly Rollup
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QuarterRollup is the open pipeline and ECAL workloads of revenue lines closing in one fiscal quarter
+type QuarterRollup struct {
+	Quarter        string  `json:"quarter"`
+	FiscalYear     int     `json:"fiscal_year"`
+	FiscalQuarter  int     `json:"fiscal_quarter"`
+	StartDate      string  `json:"start_date"`
+	EndDate        string  `json:"end_date"`
+	Opportunities  int     `json:"opportunities"`
+	RevenueLines   int     `json:"revenue_lines"`
+	PipelineARR    float64 `json:"pipeline_arr"`
+	TCV            float64 `json:"tcv"`
+	Workloads      int     `json:"workloads"`
+	WorkloadAmount float64 `json:"workload_amount"`
+
+	opportunityIDs map[string]bool
+}
+
+//
+// HTTP handler for the getQuarterlyRollup functionality.  Groups the open pipeline in LookupOpportunity and the ECAL
+// workloads tracking it by the fiscal quarter of their close date, for a manager's hierarchy (managerEmail) or the
+// whole instance-environment.  fiscalYear (e.g. 2021) optionally limits it to one fiscal year.
+//
+func getQuarterlyRollupHandler(w http.ResponseWriter, r *http.Request) {
+	// get query parameters
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	managerEmail := query.Get("managerEmail")
+	fiscalYear := query.Get("fiscalYear")
+
+	// only the accounts the caller may see are rolled up, whichever managerEmail they ask for
+	scope, err := requestAccess(r, DBPool, instanceEnv)
+	if queryCancelled(r.Context(), "quarterly_rollup", err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "quarterly_rollup", err.Error())
+		return
+	}
+
+	// call the helper which does the data mashing
+	result, err := getQuarterlyRollup(r.Context(), instanceEnv, scope, managerEmail, fiscalYear)
+	if queryCancelled(r.Context(), "quarterly_rollup", err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "quarterly_rollup", err.Error())
+		return
+	}
+
+	// write result to output stream
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+//
+// Returns {"items": [quarters in date order]}.  Revenue lines are placed in the quarter of their anticipated close
+// date using the fiscal calendar (FiscalYearStartMonth); with managerEmail only those of ECAL opportunities on
+// accounts assigned within the manager's hierarchy are counted.  A caller limited to their own accounts only sees the
+// lines of ECAL opportunities on those accounts.
+//
+func getQuarterlyRollup(ctx context.Context, instanceEnv string, scope accessScope, managerEmail string, fiscalYear string) ([]byte, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		return nil, inputError("instanceEnvironment query parameter is invalid")
+	}
+	year := 0
+	if len(fiscalYear) > 0 {
+		value, err := strconv.Atoi(fiscalYear)
+		if err != nil || value < 2000 {
+			return nil, inputError("fiscalYear must be a four digit year")
+		}
+		year = value
+	}
+
+	template := `SELECT TO_CHAR(l.anticipatedclosedate, 'YYYY-MM-DD'), l.opportunityid,
+			NVL(l.revenuepipelinek, 0), NVL(l.revenuetcvk, 0), NVL(l.workloadamount, 0),
+			CASE WHEN w.id IS NULL THEN 0 ELSE 1 END
+		FROM %SCHEMA%.LookupOpportunity l
+		LEFT OUTER JOIN %SCHEMA%.Opportunity o ON o.opportunityid = l.opportunityid
+		LEFT OUTER JOIN %SCHEMA%.OpportunityWorkload w ON w.opportunity = o.id AND w.workloadidentifier = l.revenuelineid
+		WHERE l.active = 1 AND l.opportunitystatus = 'Open' AND l.anticipatedclosedate IS NOT NULL`
+	args := []interface{}{}
+	if len(managerEmail) > 0 {
+		template += ` AND o.account IN (SELECT ua.account FROM %SCHEMA%.User1 u INNER JOIN %SCHEMA%.UserAccount ua ON ua.user1 = u.id
+			WHERE u.useremail = :1 OR u.manager IN (SELECT c.reportemail FROM %SCHEMA%.ManagerClosure c WHERE c.manageremail = :1))`
+		args = append(args, managerEmail)
+	}
+	if condition, scopeArgs := scope.accountCondition("o.account", len(args)+1); len(condition) > 0 {
+		template += " AND " + condition
+		args = append(args, scopeArgs...)
+	}
+	if year > 0 {
+		first, _ := fiscalQuarterDates(year, 1)
+		_, last := fiscalQuarterDates(year, 4)
+		template += fmt.Sprintf(" AND l.anticipatedclosedate BETWEEN TO_DATE(:%d, 'YYYY-MM-DD') AND TO_DATE(:%d, 'YYYY-MM-DD')", len(args)+1, len(args)+2)
+		args = append(args, first.Format(queryDateLayout), last.Format(queryDateLayout))
+	}
+
+	rows, err := DBPool.QueryContext(ctx, strings.ReplaceAll(template, "%SCHEMA%", schema), args...)
+	if err != nil {
+		thisError := fmt.Sprintf("Error running quarterly rollup query (%s, %s, %s): %s", instanceEnv, managerEmail, fiscalYear, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	quarters := make(map[string]*QuarterRollup)
+	for rows.Next() {
+		var closeDate, opportunityID string
+		var pipeline, tcv, amount float64
+		var workload int
+		err := rows.Scan(&closeDate, &opportunityID, &pipeline, &tcv, &amount, &workload)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning quarterly rollup row (%s): %s", instanceEnv, err.Error())
+			return nil, errors.New(thisError)
+		}
+		date, err := time.Parse(queryDateLayout, closeDate)
+		if err != nil {
+			continue
+		}
+
+		fy, fq := fiscalQuarter(date)
+		name := fiscalQuarterName(fy, fq)
+		quarter := quarters[name]
+		if quarter == nil {
+			first, last := fiscalQuarterDates(fy, fq)
+			quarter = &QuarterRollup{Quarter: name, FiscalYear: fy, FiscalQuarter: fq, StartDate: first.Format(queryDateLayout),
+				EndDate: last.Format(queryDateLayout), opportunityIDs: make(map[string]bool)}
+			quarters[name] = quarter
+		}
+		quarter.opportunityIDs[opportunityID] = true
+		quarter.RevenueLines++
+		quarter.PipelineARR += pipeline
+		quarter.TCV += tcv
+		if workload == 1 {
+			quarter.Workloads++
+			quarter.WorkloadAmount += amount
+		}
+	}
+
+	items := []*QuarterRollup{}
+	for _, quarter := range quarters {
+		quarter.Opportunities = len(quarter.opportunityIDs)
+		quarter.PipelineARR = math.Round(quarter.PipelineARR*100) / 100
+		quarter.TCV = math.Round(quarter.TCV*100) / 100
+		quarter.WorkloadAmount = math.Round(quarter.WorkloadAmount*100) / 100
+		items = append(items, quarter)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].StartDate < items[j].StartDate })
+
+	return json.Marshal(map[string][]*QuarterRollup{"items": items})
+}
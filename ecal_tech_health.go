@@ -0,0 +1,414 @@
+//  ECAL Opportunity Tech Health
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kinds of OpportunityTechHealth fields that can be updated
+const (
+	techHealthFlag = iota
+	techHealthDate
+	techHealthChoice
+	techHealthText
+)
+
+// techHealthField maps an updatable OpportunityTechHealth column to the name used by getECALDataQuery
+type techHealthField struct {
+	Name    string
+	Column  string
+	Kind    int
+	Choices []string
+}
+
+// the fields the quick-update flow is allowed to change.  Names match the getECALDataQuery output.
+var techHealthFields = []techHealthField{
+	{Name: "poc_required", Column: "pocrequired", Kind: techHealthFlag},
+	{Name: "poc_status", Column: "pocstatus", Kind: techHealthChoice, Choices: []string{"Not Started", "In Progress", "On Hold", "Completed", "Cancelled"}},
+	{Name: "poc_resolution", Column: "pocresolution", Kind: techHealthText},
+	{Name: "poc_startdate", Column: "pocstartdate", Kind: techHealthDate},
+	{Name: "poc_enddate", Column: "pocenddate", Kind: techHealthDate},
+	{Name: "poc_exa_required", Column: "exadatarequired", Kind: techHealthFlag},
+	{Name: "security_signoff", Column: "securitysignoffdone", Kind: techHealthFlag},
+	{Name: "technical_signoff", Column: "technicalsignoffdone", Kind: techHealthFlag},
+	{Name: "tech_signoff_date", Column: "technicalsignoffdate", Kind: techHealthDate},
+	{Name: "cons_plan_signoff", Column: "consumptionplansignoff", Kind: techHealthFlag},
+	{Name: "tech_blockers", Column: "technicalblockers", Kind: techHealthFlag},
+	{Name: "commercial_blockers", Column: "commercialblockers", Kind: techHealthFlag},
+}
+
+// maximum length of a free text tech health field
+const maxTechHealthTextLength = 400
+
+// errTechHealthNotFound is returned when the opportunity has no OpportunityTechHealth row
+var errTechHealthNotFound = errors.New("tech health not found")
+
+//
+// HTTP handler for the opportunityTechHealth functionality.  PATCH applies a partial update (JSON body of field: value)
+// to an opportunity's tech health and records the before and after values in the audit log; GET returns the current
+// values.  Both return the row's version as the ETag; a PATCH with If-Match is rejected (412) if someone else has
+// changed the tech health since that version was read.
+//
+func patchOpportunityTechHealthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		getOpportunityTechHealthHandler(w, r)
+		return
+	}
+	if r.Method != http.MethodPatch {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+
+	// get query parameters
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	opportunityID := query.Get("opportunityId")
+	updatedBy := query.Get("updatedBy")
+
+	var body map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Unable to parse tech health update")
+		logRequest(r, logError, "tech_health", "Unable to decode body: "+err.Error())
+		return
+	}
+
+	// call the helper which does the data mashing
+	changes, version, err := patchOpportunityTechHealth(instanceEnv, opportunityID, updatedBy, requestedVersion(r), body)
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		logRequest(r, logWarn, "tech_health", fmt.Sprintf("Rejected update of opportunity %s (%s): %s", opportunityID, instanceEnv, inputErr.Error()))
+		return
+	}
+	if err == errTechHealthNotFound {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Tech health not found")
+		return
+	}
+	if err == errVersionConflict {
+		setRowVersion(w, version)
+		w.WriteHeader(412)
+		fmt.Fprintf(w, "Tech health has been changed by someone else; reload it and try again")
+		logRequest(r, logWarn, "tech_health", fmt.Sprintf("Rejected stale update of opportunity %s by %s (%s)", opportunityID, updatedBy, instanceEnv))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "tech_health", err.Error())
+		return
+	}
+
+	message := fmt.Sprintf("Updated %d tech health fields of opportunity %s by %s (%s)", len(changes), opportunityID, updatedBy, instanceEnv)
+	logRequest(r, logInfo, "tech_health", message)
+
+	// write result to output stream
+	json, _ := json.Marshal(map[string]interface{}{"opportunity_id": opportunityID, "changes": changes, "version": version})
+	setRowVersion(w, version)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func getOpportunityTechHealthHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	opportunityID := query.Get("opportunityId")
+
+	values, version, err := getOpportunityTechHealth(instanceEnv, opportunityID)
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err == errTechHealthNotFound {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Tech health not found")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "tech_health", err.Error())
+		return
+	}
+
+	values["opportunity_id"] = opportunityID
+	values["version"] = version
+	json, _ := json.Marshal(values)
+	setRowVersion(w, version)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+//
+// Returns the updatable tech health fields of an opportunity (null when empty) and the row's version
+//
+func getOpportunityTechHealth(instanceEnv string, opportunityID string) (map[string]interface{}, string, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		return nil, "", inputError("instanceEnvironment query parameter is invalid")
+	}
+	id, err := strconv.ParseInt(opportunityID, 10, 64)
+	if err != nil || id < 1 {
+		return nil, "", inputError("opportunityId query parameter is invalid")
+	}
+
+	selects := techHealthSelects(techHealthFields)
+	current := make([]sql.NullString, len(techHealthFields))
+	var version string
+	dest := []interface{}{&version}
+	for i := range current {
+		dest = append(dest, &current[i])
+	}
+	err = DBPool.QueryRow("SELECT TO_CHAR(lastupdatedate, '"+rowVersionFormat+"'), "+strings.Join(selects, ", ")+
+		" FROM "+schema+".OpportunityTechHealth WHERE opportunity = :1", id).Scan(dest...)
+	if err == sql.ErrNoRows {
+		return nil, "", errTechHealthNotFound
+	}
+	if err != nil {
+		thisError := fmt.Sprintf("Error reading tech health (%s, %d): %s", instanceEnv, id, err.Error())
+		return nil, "", errors.New(thisError)
+	}
+
+	values := make(map[string]interface{})
+	for i, field := range techHealthFields {
+		switch {
+		case !current[i].Valid:
+			values[field.Name] = nil
+		case field.Kind == techHealthFlag:
+			values[field.Name] = json.Number(jsonNumber(current[i].String))
+		default:
+			values[field.Name] = current[i].String
+		}
+	}
+	return values, version, nil
+}
+
+//
+// Returns the select list reading the fields as text
+//
+func techHealthSelects(fields []techHealthField) []string {
+	selects := []string{}
+	for _, field := range fields {
+		if field.Kind == techHealthDate {
+			selects = append(selects, "TO_CHAR("+field.Column+", 'YYYY-MM-DD')")
+		} else {
+			selects = append(selects, "TO_CHAR("+field.Column+")")
+		}
+	}
+	return selects
+}
+
+//
+// Validates the requested field updates, applies the ones that actually change a value and writes an audit record,
+// all in one transaction.  Returns the changed fields as {field: {"before": x, "after": y}} and the row's version
+// afterwards.  If expectedVersion is set and the row's version is different nothing is changed and errVersionConflict
+// is returned along with the current version.
+//
+func patchOpportunityTechHealth(instanceEnv string, opportunityID string, updatedBy string, expectedVersion string,
+	body map[string]interface{}) (map[string]map[string]interface{}, string, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		thisError := fmt.Sprintf("instanceEnvironment query parameter is invalid (%s, %s)", instanceEnv, opportunityID)
+		return nil, "", errors.New(thisError)
+	}
+	id, err := strconv.ParseInt(opportunityID, 10, 64)
+	if err != nil || id < 1 {
+		return nil, "", inputError("opportunityId query parameter is invalid")
+	}
+	if len(updatedBy) < 1 {
+		return nil, "", inputError("updatedBy query parameter is required")
+	}
+
+	fields, values, err := validateTechHealthUpdate(body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// start a DB transaction
+	tx, err := DBPool.Begin()
+	if err != nil {
+		thisError := fmt.Sprintf("Error starting DB transaction (%s): %s", instanceEnv, err.Error())
+		return nil, "", errors.New(thisError)
+	}
+	defer tx.Rollback()
+
+	// lock the row and read the current values so only real changes are applied and audited
+	selects := techHealthSelects(fields)
+	current := make([]sql.NullString, len(fields))
+	var version string
+	dest := []interface{}{&version}
+	for i := range current {
+		dest = append(dest, &current[i])
+	}
+	err = tx.QueryRow("SELECT TO_CHAR(lastupdatedate, '"+rowVersionFormat+"'), "+strings.Join(selects, ", ")+
+		" FROM "+schema+".OpportunityTechHealth WHERE opportunity = :1 FOR UPDATE", id).Scan(dest...)
+	if err == sql.ErrNoRows {
+		return nil, "", errTechHealthNotFound
+	}
+	if err != nil {
+		thisError := fmt.Sprintf("Error reading tech health (%s, %d): %s", instanceEnv, id, err.Error())
+		return nil, "", errors.New(thisError)
+	}
+	err = checkRowVersion(expectedVersion, version)
+	if err != nil {
+		return nil, version, err
+	}
+
+	changes := make(map[string]map[string]interface{})
+	assignments := []string{}
+	args := []interface{}{}
+	for i, field := range fields {
+		after := fmt.Sprint(values[i])
+		if current[i].Valid && current[i].String == after {
+			continue
+		}
+		var before interface{}
+		if current[i].Valid {
+			before = current[i].String
+		}
+		changes[field.Name] = map[string]interface{}{"before": before, "after": values[i]}
+
+		bind := ":" + strconv.Itoa(len(args)+1)
+		if field.Kind == techHealthDate {
+			assignments = append(assignments, field.Column+" = TO_DATE("+bind+", 'YYYY-MM-DD')")
+		} else {
+			assignments = append(assignments, field.Column+" = "+bind)
+		}
+		args = append(args, values[i])
+	}
+	if len(changes) == 0 {
+		return changes, version, nil
+	}
+
+	n := len(args)
+	args = append(args, strings.ToLower(updatedBy), id)
+	_, err = tx.Exec(fmt.Sprintf("UPDATE %s.OpportunityTechHealth SET %s, %s, lastupdatedby = :%d WHERE opportunity = :%d",
+		schema, strings.Join(assignments, ", "), rowVersionUpdate, n+1, n+2), args...)
+	if err != nil {
+		thisError := fmt.Sprintf("Error updating tech health (%s, %d): %s", instanceEnv, id, err.Error())
+		return nil, "", errors.New(thisError)
+	}
+	err = tx.QueryRow("SELECT TO_CHAR(lastupdatedate, '"+rowVersionFormat+"') FROM "+schema+".OpportunityTechHealth WHERE opportunity = :1", id).Scan(&version)
+	if err != nil {
+		thisError := fmt.Sprintf("Error reading tech health version (%s, %d): %s", instanceEnv, id, err.Error())
+		return nil, "", errors.New(thisError)
+	}
+
+	err = recordAudit(tx, instanceEnv, "OpportunityTechHealth", opportunityID, "update", updatedBy, changes)
+	if err != nil {
+		thisError := fmt.Sprintf("Error writing audit record (%s, %d): %s", instanceEnv, id, err.Error())
+		return nil, "", errors.New(thisError)
+	}
+	err = enqueueEvent(tx, instanceEnv, eventTechHealthUpdated, map[string]interface{}{"opportunity_id": id, "changes": changes,
+		"updated_by": strings.ToLower(updatedBy), "version": version})
+	if err != nil {
+		thisError := fmt.Sprintf("Error writing event (%s, %d): %s", instanceEnv, id, err.Error())
+		return nil, "", errors.New(thisError)
+	}
+
+	// complete the transaction
+	err = tx.Commit()
+	if err != nil {
+		thisError := fmt.Sprintf("Error committing transaction (%s, %d): %s", instanceEnv, id, err.Error())
+		return nil, "", errors.New(thisError)
+	}
+	invalidateQueryCacheFor(instanceEnv)
+	return changes, version, nil
+}
+
+//
+// Checks each requested field against techHealthFields and returns the fields with their normalized values in the
+// same order.  Flags must be 0/1 (or true/false), dates YYYY-MM-DD, choices one of the allowed values and text no
+// longer than maxTechHealthTextLength.
+//
+func validateTechHealthUpdate(body map[string]interface{}) ([]techHealthField, []interface{}, error) {
+	if len(body) == 0 {
+		return nil, nil, inputError("No fields to update")
+	}
+
+	known := make(map[string]techHealthField)
+	for _, field := range techHealthFields {
+		known[field.Name] = field
+	}
+	for name := range body {
+		if _, ok := known[name]; !ok {
+			return nil, nil, inputError("Field " + name + " can't be updated")
+		}
+	}
+
+	fields := []techHealthField{}
+	values := []interface{}{}
+	for _, field := range techHealthFields {
+		raw, ok := body[field.Name]
+		if !ok {
+			continue
+		}
+
+		switch field.Kind {
+		case techHealthFlag:
+			switch v := raw.(type) {
+			case bool:
+				if v {
+					values = append(values, 1)
+				} else {
+					values = append(values, 0)
+				}
+			case float64:
+				if v != 0 && v != 1 {
+					return nil, nil, inputError(field.Name + " must be 0 or 1")
+				}
+				values = append(values, int(v))
+			default:
+				return nil, nil, inputError(field.Name + " must be 0 or 1")
+			}
+		case techHealthDate:
+			text, ok := raw.(string)
+			if !ok {
+				return nil, nil, inputError(field.Name + " must be a YYYY-MM-DD date")
+			}
+			if _, err := time.Parse("2006-01-02", text); err != nil {
+				return nil, nil, inputError(field.Name + " must be a YYYY-MM-DD date")
+			}
+			values = append(values, text)
+		case techHealthChoice:
+			text, _ := raw.(string)
+			valid := false
+			for _, choice := range field.Choices {
+				if text == choice {
+					valid = true
+				}
+			}
+			if !valid {
+				return nil, nil, inputError(field.Name + " must be one of: " + strings.Join(field.Choices, ", "))
+			}
+			values = append(values, text)
+		case techHealthText:
+			text, ok := raw.(string)
+			if !ok {
+				return nil, nil, inputError(field.Name + " must be a string")
+			}
+			text = sanitizeText(text, 0)
+			if len(text) > maxTechHealthTextLength {
+				return nil, nil, inputError(fmt.Sprintf("%s must be at most %d characters", field.Name, maxTechHealthTextLength))
+			}
+			values = append(values, text)
+		}
+		fields = append(fields, field)
+	}
+
+	return fields, values, nil
+}
@@ -0,0 +1,164 @@
+//  ECAL User Account Assignment
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errAssignmentNotFound is returned when the user, account, or assignment referenced doesn't exist
+var errAssignmentNotFound = errors.New("user, account or assignment not found")
+
+//
+// HTTP handler for the userAccountAssignment functionality.  POST assigns a user to an account and DELETE removes
+// the assignment.  Both take the instanceEnvironment, userEmail and accountId query parameters.
+//
+func userAccountAssignmentHandler(w http.ResponseWriter, r *http.Request) {
+	// get query parameters
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	userEmail := strings.ToLower(query.Get("userEmail"))
+	accountID := query.Get("accountId")
+
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		err = assignUserToAccount(instanceEnv, userEmail, accountID)
+	case http.MethodDelete:
+		err = unassignUserFromAccount(instanceEnv, userEmail, accountID)
+	default:
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+
+	if err == errAssignmentNotFound {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "User, account or assignment not found")
+		logRequest(r, logWarn, "user_account", fmt.Sprintf("%s %s -> %s (%s): %s", r.Method, userEmail, accountID, instanceEnv, err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "user_account", err.Error())
+		return
+	}
+
+	logRequest(r, logInfo, "user_account", fmt.Sprintf("%s %s -> %s (%s)", r.Method, userEmail, accountID, instanceEnv))
+	w.WriteHeader(200)
+}
+
+//
+// Creates a UserAccount row linking the user to the account.  Both must already exist.  Assigning a user
+// who is already assigned is not an error.
+//
+func assignUserToAccount(instanceEnv string, userEmail string, accountID string) error {
+	schema, err := validateAssignmentParameters(instanceEnv, userEmail, accountID)
+	if err != nil {
+		return err
+	}
+
+	// start a DB transaction
+	tx, err := DBPool.Begin()
+	if err != nil {
+		thisError := fmt.Sprintf("Error starting DB transaction (%s): %s", instanceEnv, err.Error())
+		return errors.New(thisError)
+	}
+	defer tx.Rollback()
+
+	// make sure the user and the account both exist
+	var userID int64
+	err = tx.QueryRow("SELECT id FROM "+schema+".User1 WHERE LOWER(useremail) = :1", userEmail).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return errAssignmentNotFound
+	}
+	if err != nil {
+		thisError := fmt.Sprintf("Error looking up user (%s, %s): %s", instanceEnv, userEmail, err.Error())
+		return errors.New(thisError)
+	}
+
+	var count int
+	err = tx.QueryRow("SELECT count(*) FROM "+schema+".Account WHERE id = :1", accountID).Scan(&count)
+	if err != nil {
+		thisError := fmt.Sprintf("Error looking up account (%s, %s): %s", instanceEnv, accountID, err.Error())
+		return errors.New(thisError)
+	}
+	if count == 0 {
+		return errAssignmentNotFound
+	}
+
+	// insert the assignment unless it already exists
+	_, err = tx.Exec("INSERT INTO "+schema+".UserAccount (user1, account, creationdate, lastupdatedate, createdby, lastupdatedby) "+
+		"SELECT :1, :2, SYSDATE, SYSDATE, 'cto_bizlogic_helper', 'cto_bizlogic_helper' FROM DUAL "+
+		"WHERE NOT EXISTS (SELECT 1 FROM "+schema+".UserAccount WHERE user1 = :1 AND account = :2)",
+		userID, accountID)
+	if err != nil {
+		thisError := fmt.Sprintf("Error inserting assignment (%s, %s, %s): %s", instanceEnv, userEmail, accountID, err.Error())
+		return errors.New(thisError)
+	}
+
+	// complete the transaction
+	err = tx.Commit()
+	if err != nil {
+		thisError := fmt.Sprintf("Error committing transaction (%s, %s, %s): %s", instanceEnv, userEmail, accountID, err.Error())
+		return errors.New(thisError)
+	}
+	invalidateQueryCacheFor(instanceEnv)
+	return nil
+}
+
+//
+// Removes the UserAccount row linking the user to the account
+//
+func unassignUserFromAccount(instanceEnv string, userEmail string, accountID string) error {
+	schema, err := validateAssignmentParameters(instanceEnv, userEmail, accountID)
+	if err != nil {
+		return err
+	}
+
+	result, err := DBPool.Exec("DELETE FROM "+schema+".UserAccount WHERE account = :1 AND user1 = "+
+		"(SELECT id FROM "+schema+".User1 WHERE LOWER(useremail) = :2)", accountID, userEmail)
+	if err != nil {
+		thisError := fmt.Sprintf("Error deleting assignment (%s, %s, %s): %s", instanceEnv, userEmail, accountID, err.Error())
+		return errors.New(thisError)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		thisError := fmt.Sprintf("Error deleting assignment (%s, %s, %s): %s", instanceEnv, userEmail, accountID, err.Error())
+		return errors.New(thisError)
+	}
+	if deleted == 0 {
+		return errAssignmentNotFound
+	}
+	invalidateQueryCacheFor(instanceEnv)
+	return nil
+}
+
+//
+// Checks the common assignment parameters and returns the schema for the instanceEnvironment
+//
+func validateAssignmentParameters(instanceEnv string, userEmail string, accountID string) (string, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		thisError := fmt.Sprintf("instanceEnvironment query parameter is invalid (%s, %s, %s)", instanceEnv, userEmail, accountID)
+		return "", errors.New(thisError)
+	}
+	if len(userEmail) < 1 {
+		thisError := fmt.Sprintf("userEmail query parameter is required (%s, %s, %s)", instanceEnv, userEmail, accountID)
+		return "", errors.New(thisError)
+	}
+	if _, err := strconv.ParseInt(accountID, 10, 64); err != nil {
+		thisError := fmt.Sprintf("accountId query parameter is invalid (%s, %s, %s)", instanceEnv, userEmail, accountID)
+		return "", errors.New(thisError)
+	}
+	return schema, nil
+}
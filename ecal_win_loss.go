@@ -0,0 +1,198 @@
+//  ECAL Win/Loss Analysis
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WinLoss is the number of won and lost opportunities in a group and the resulting win rate (percent)
+type WinLoss struct {
+	Name    string  `json:"name"`
+	Won     int     `json:"won"`
+	Lost    int     `json:"lost"`
+	WinRate float64 `json:"win_rate"`
+}
+
+// WinLossComparison is the win/loss of opportunities with and without an ECAL practice (tech signoff, POC, ...)
+type WinLossComparison struct {
+	Name    string  `json:"name"`
+	With    WinLoss `json:"with"`
+	Without WinLoss `json:"without"`
+}
+
+// winLossGroup collects the distinct won and lost opportunities of a group
+type winLossGroup struct {
+	won  map[string]bool
+	lost map[string]bool
+}
+
+func (g *winLossGroup) add(opportunityID string, won bool) {
+	if won {
+		g.won[opportunityID] = true
+	} else {
+		g.lost[opportunityID] = true
+	}
+}
+
+func (g *winLossGroup) result(name string) WinLoss {
+	result := WinLoss{Name: name, Won: len(g.won), Lost: len(g.lost)}
+	if result.Won+result.Lost > 0 {
+		result.WinRate = math.Round(float64(result.Won)*10000/float64(result.Won+result.Lost)) / 100
+	}
+	return result
+}
+
+func newWinLossGroup() *winLossGroup {
+	return &winLossGroup{won: make(map[string]bool), lost: make(map[string]bool)}
+}
+
+// the ECAL practices compared by getWinLoss, in the order they are returned
+var winLossPractices = []string{"ecal_tracked", "tech_signoff", "poc", "artifacts"}
+
+//
+// HTTP handler for the getWinLoss functionality.  Summarizes the win rate of the Won and Lost opportunities retained
+// in LookupOpportunity by segment, product pillar and whether ECAL tracked them with a tech signoff, POC or artifacts.
+//
+func getWinLossHandler(w http.ResponseWriter, r *http.Request) {
+	// get query parameters
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	since := query.Get("since")
+
+	// call the helper which does the data mashing
+	result, err := getWinLoss(r.Context(), instanceEnv, since)
+	if queryCancelled(r.Context(), "win_loss", err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "win_loss", err.Error())
+		return
+	}
+
+	// write result to output stream
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+//
+// Returns the win/loss summary of the instanceEnvironment.  Opportunities are counted once per group even when they
+// have several revenue lines; an opportunity with lines in more than one pillar counts towards each.  If since
+// (YYYY-MM-DD) is set only opportunities closing on or after it are included.
+//
+func getWinLoss(ctx context.Context, instanceEnv string, since string) ([]byte, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		return nil, inputError("instanceEnvironment query parameter is invalid")
+	}
+	if _, err := time.Parse(queryDateLayout, since); len(since) > 0 && err != nil {
+		return nil, inputError("since must be YYYY-MM-DD")
+	}
+
+	template := `SELECT DISTINCT l.opportunityid, l.opportunitystatus,
+			NVL(la.businesssegment, 'Unknown'), NVL(l.productpillar, 'Unknown'),
+			CASE WHEN o.id IS NULL THEN 0 ELSE 1 END,
+			NVL(th.technicalsignoffdone, 0), NVL(th.pocrequired, 0),
+			CASE WHEN EXISTS (SELECT 1 FROM %SCHEMA%.OpportunityArtifacts oa WHERE oa.opportunity = o.id) THEN 1 ELSE 0 END
+		FROM %SCHEMA%.LookupOpportunity l
+		LEFT OUTER JOIN %SCHEMA%.LookupAccount la ON la.cimid = l.cimid
+		LEFT OUTER JOIN %SCHEMA%.Opportunity o ON o.opportunityid = l.opportunityid
+		LEFT OUTER JOIN %SCHEMA%.OpportunityTechHealth th ON th.opportunity = o.id
+		WHERE l.opportunitystatus IN ('Won', 'Lost')`
+	var rows *sql.Rows
+	var err error
+	if len(since) > 0 {
+		template += " AND l.anticipatedclosedate >= TO_DATE(:1, 'YYYY-MM-DD')"
+		rows, err = DBPool.QueryContext(ctx, strings.ReplaceAll(template, "%SCHEMA%", schema), since)
+	} else {
+		rows, err = DBPool.QueryContext(ctx, strings.ReplaceAll(template, "%SCHEMA%", schema))
+	}
+	if err != nil {
+		thisError := fmt.Sprintf("Error running win/loss query (%s, %s): %s", instanceEnv, since, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	overall := newWinLossGroup()
+	segments := make(map[string]*winLossGroup)
+	pillars := make(map[string]*winLossGroup)
+	with := make(map[string]*winLossGroup)
+	without := make(map[string]*winLossGroup)
+	for _, practice := range winLossPractices {
+		with[practice] = newWinLossGroup()
+		without[practice] = newWinLossGroup()
+	}
+
+	for rows.Next() {
+		var opportunityID, status, segment, pillar string
+		var tracked, techSignoff, poc, artifacts int
+		err := rows.Scan(&opportunityID, &status, &segment, &pillar, &tracked, &techSignoff, &poc, &artifacts)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning win/loss row (%s): %s", instanceEnv, err.Error())
+			return nil, errors.New(thisError)
+		}
+		won := status == "Won"
+
+		overall.add(opportunityID, won)
+		if segments[segment] == nil {
+			segments[segment] = newWinLossGroup()
+		}
+		segments[segment].add(opportunityID, won)
+		if pillars[pillar] == nil {
+			pillars[pillar] = newWinLossGroup()
+		}
+		pillars[pillar].add(opportunityID, won)
+
+		practices := map[string]bool{"ecal_tracked": tracked == 1, "tech_signoff": techSignoff == 1, "poc": poc == 1, "artifacts": artifacts == 1}
+		for practice, present := range practices {
+			if present {
+				with[practice].add(opportunityID, won)
+			} else {
+				without[practice].add(opportunityID, won)
+			}
+		}
+	}
+
+	comparisons := []WinLossComparison{}
+	for _, practice := range winLossPractices {
+		comparisons = append(comparisons, WinLossComparison{Name: practice,
+			With: with[practice].result("with"), Without: without[practice].result("without")})
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"overall":           overall.result("overall"),
+		"by_segment":        winLossResults(segments),
+		"by_product_pillar": winLossResults(pillars),
+		"by_ecal_practice":  comparisons,
+	})
+}
+
+//
+// Returns the results of a set of groups ordered by name
+//
+func winLossResults(groups map[string]*winLossGroup) []WinLoss {
+	results := []WinLoss{}
+	for name, group := range groups {
+		results = append(results, group.result(name))
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	return results
+}
@@ -0,0 +1,222 @@
+//  ECAL Workbook Export
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// workbookWriter sends the workbook headers with the first bytes of the file, so a query that fails before anything
+// has been written can still be answered with a plain error
+type workbookWriter struct {
+	http.ResponseWriter
+	filename string
+	started  bool
+}
+
+func (ww *workbookWriter) Write(data []byte) (int, error) {
+	if !ww.started {
+		ww.started = true
+		ww.Header().Set("Content-Type", xlsxContentType)
+		ww.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", ww.filename))
+	}
+	return ww.ResponseWriter.Write(data)
+}
+
+// workbookBlocker is an opportunity with commercial or technical blockers, for the Blockers sheet
+type workbookBlocker struct {
+	opportunity ECALOpportunity
+	commercial  bool
+	technical   bool
+}
+
+//
+// HTTP handler for the exportECALWorkbook functionality.  Returns an Excel workbook with Accounts, Opportunities,
+// Artifacts and Blockers sheets of everything the caller may see, streamed as the rows are read.
+//
+func exportECALWorkbookHandler(w http.ResponseWriter, r *http.Request) {
+	// get query parameters
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+
+	// what the caller may see is decided from who they are
+	scope, err := requestAccess(r, DBPool, instanceEnv)
+	if queryCancelled(r.Context(), "ecal_workbook", err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "ecal_workbook", err.Error())
+		return
+	}
+
+	// call the helper which streams the workbook straight to the output
+	out := &workbookWriter{ResponseWriter: w, filename: fmt.Sprintf("ecal-%s-%s.xlsx", instanceEnv, time.Now().In(outputLocation).Format("2006-01-02"))}
+	rows, err := writeECALWorkbook(r.Context(), instanceEnv, scope, out)
+	if queryCancelled(r.Context(), "ecal_workbook", err) {
+		return
+	}
+	if err != nil && out.started {
+		abortStreamedResponse("ecal_workbook", err)
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "ecal_workbook", err.Error())
+		return
+	}
+	if counter, ok := w.(rowCounter); ok {
+		counter.addRows(int64(rows))
+	}
+	logRequest(r, logInfo, "ecal_workbook", fmt.Sprintf("Exported %d rows of %s", rows, instanceEnv))
+}
+
+//
+// Writes the workbook of the accounts, opportunities and artifacts in the scope to out, and the opportunities among
+// them with blockers.  The blockers are gathered while the opportunities are written, so only they are held in memory.
+// Returns the number of rows written.
+//
+func writeECALWorkbook(ctx context.Context, instanceEnv string, scope accessScope, out *workbookWriter) (int, error) {
+	workbook := newXLSXWorkbook(out)
+	total := 0
+
+	// accounts
+	query, args, err := ecalAccountQuerySQL(instanceEnv, scope)
+	if err != nil {
+		return 0, err
+	}
+	err = workbook.addSheet("Accounts", "Account ID", "LOB", "Account Name", "Solution Engineer", "Opportunities")
+	if err != nil {
+		return 0, err
+	}
+	count, err := queryWorkbookRows(ctx, instanceEnv, query, args, func(rows *sql.Rows) error {
+		var item ECALAccount
+		var lastUpdate string
+		err := rows.Scan(&item.AccountID, &item.LOB, &item.AccountName, &item.SolutionEngineer, &item.NumOpportunities, &lastUpdate)
+		if err != nil {
+			return err
+		}
+		return workbook.writeRow(item.AccountID, item.LOB, item.AccountName, item.SolutionEngineer, item.NumOpportunities)
+	})
+	if err != nil {
+		return 0, err
+	}
+	total += count
+
+	// opportunities, keeping the ones with blockers for their own sheet
+	query, args, err = ecalOpportunityQuerySQL(instanceEnv, scope, queryFilters{}, "")
+	if err != nil {
+		return 0, err
+	}
+	err = workbook.addSheet("Opportunities", "Account ID", "Account Name", "Opportunity ID", "Workload Type", "Summary", "ARR",
+		"ECAL %", "Latest ECAL Stage", "Last Activity", "POC", "POC Status", "Blockers")
+	if err != nil {
+		return 0, err
+	}
+	blockers := []workbookBlocker{}
+	count, err = queryWorkbookRows(ctx, instanceEnv, query, args, func(rows *sql.Rows) error {
+		var item ECALOpportunity
+		var commercialBlockers, technicalBlockers, poc int
+		err := rows.Scan(&item.ID, &item.AccountID, &item.AccountName, &item.OpportunityID, &item.WorkloadType, &item.Summary, &item.ARR, &item.ECALPercent, &item.LatestECALStage, &item.LastActivity, &poc, &item.POCStatus, &commercialBlockers, &technicalBlockers)
+		if err != nil {
+			return err
+		}
+		item.Blockers = commercialBlockers == 1 || technicalBlockers == 1
+		item.POC = poc == 1
+		item.LastActivity = formatTimestamp(item.LastActivity)
+		if item.Blockers {
+			blockers = append(blockers, workbookBlocker{opportunity: item, commercial: commercialBlockers == 1, technical: technicalBlockers == 1})
+		}
+		return workbook.writeRow(item.AccountID, item.AccountName, item.OpportunityID, item.WorkloadType, item.Summary, item.ARR,
+			item.ECALPercent, item.LatestECALStage, item.LastActivity, item.POC, item.POCStatus, item.Blockers)
+	})
+	if err != nil {
+		return 0, err
+	}
+	total += count
+
+	// artifacts
+	query, args, err = ecalArtifactQuerySQL(instanceEnv, scope)
+	if err != nil {
+		return 0, err
+	}
+	err = workbook.addSheet("Artifacts", "Artifact ID", "Account", "Opportunity ID", "Solution Focus", "Artifact Type", "CE", "Uploaded", "Location")
+	if err != nil {
+		return 0, err
+	}
+	count, err = queryWorkbookRows(ctx, instanceEnv, query, args, func(rows *sql.Rows) error {
+		var item ECALArtifact
+		err := rows.Scan(&item.ID, &item.Account, &item.OpportunityID, &item.SolutionFocus, &item.ArtifactType, &item.CE, &item.Uploaded, &item.Location)
+		if err != nil {
+			return err
+		}
+		return workbook.writeRow(item.ID, item.Account, item.OpportunityID, item.SolutionFocus, item.ArtifactType, item.CE,
+			formatTimestamp(item.Uploaded), item.Location)
+	})
+	if err != nil {
+		return 0, err
+	}
+	total += count
+
+	// blockers
+	err = workbook.addSheet("Blockers", "Account Name", "Opportunity ID", "Workload Type", "Summary", "Latest ECAL Stage",
+		"Commercial Blockers", "Technical Blockers", "Last Activity")
+	if err != nil {
+		return 0, err
+	}
+	for _, blocker := range blockers {
+		item := blocker.opportunity
+		err = workbook.writeRow(item.AccountName, item.OpportunityID, item.WorkloadType, item.Summary, item.LatestECALStage,
+			blocker.commercial, blocker.technical, item.LastActivity)
+		if err != nil {
+			return 0, err
+		}
+	}
+	total += len(blockers)
+
+	return total, workbook.close()
+}
+
+//
+// Runs a query of the workbook, passing each row to write, and returns the number of rows
+//
+func queryWorkbookRows(ctx context.Context, instanceEnv string, query string, args []interface{}, write func(rows *sql.Rows) error) (int, error) {
+	// run the query, timing it in case it is slow
+	timer := startQueryTimer("exportECALWorkbook", instanceEnv)
+	rows, err := DBPool.QueryContext(ctx, tagQuery("exportECALWorkbook", instanceEnv, query), args...)
+	if err != nil {
+		thisError := fmt.Sprintf("Error running query (%s): %s", instanceEnv, err.Error())
+		return 0, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		err := write(rows)
+		if err != nil {
+			thisError := fmt.Sprintf("Error writing row (%s): %s", instanceEnv, err.Error())
+			return 0, errors.New(thisError)
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		thisError := fmt.Sprintf("Error reading rows (%s): %s", instanceEnv, err.Error())
+		return 0, errors.New(thisError)
+	}
+
+	timer.done(count)
+	return count, nil
+}
@@ -0,0 +1,134 @@
+//  Employee Reports
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// EmployeeReport is an employee under a manager.  Depth is 1 for a direct report, 2 for their reports and so on.
+type EmployeeReport struct {
+	Email      string `json:"email"`
+	Name       string `json:"name"`
+	Title      string `json:"title"`
+	Manager    string `json:"manager"`
+	Depth      int    `json:"depth"`
+	Lob        string `json:"lob"`
+	NumDirects int    `json:"num_directs"`
+}
+
+// errManagerNotFound is returned when the manager isn't in ORACLE_EMPLOYEES
+var errManagerNotFound = errors.New("manager not found")
+
+// reports are walked down the MGR column of the last identity load.  LEVEL 1 is the manager, so a depth of N
+// stops at LEVEL N + 1.
+const employeeReportsQuery = `SELECT employee_email_address, NVL(employee_full_name, ' '), NVL(title, ' '), NVL(mgr, ' '),
+		LEVEL - 1, NVL(lob_tag, ' '), NVL(num_directs, 0)
+	FROM CTO_COMMON.ORACLE_EMPLOYEES
+	WHERE LEVEL > 1
+	START WITH LOWER(employee_email_address) = :1
+	CONNECT BY NOCYCLE PRIOR employee_email_address = mgr AND LEVEL <= :2
+	ORDER SIBLINGS BY employee_email_address`
+
+//
+// HTTP handler for the getReports functionality.  Returns the employees under managerEmail from the last identity
+// load in reporting order, each after their manager.  depth limits how many levels down to go (directOnly=true is
+// depth=1); without either the whole organization is returned.
+//
+func getReportsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	managerEmail := strings.ToLower(strings.TrimSpace(query.Get("managerEmail")))
+	depth := 0
+	if strings.ToLower(query.Get("directOnly")) == "true" {
+		depth = 1
+	} else if len(query.Get("depth")) > 0 {
+		value, err := strconv.Atoi(query.Get("depth"))
+		if err != nil || value < 1 {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "depth must be a positive number")
+			return
+		}
+		depth = value
+	}
+
+	reports, err := getReports(r.Context(), managerEmail, depth)
+	if queryCancelled(r.Context(), "employee_reports", err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err == errManagerNotFound {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Manager not found")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "employee_reports", err.Error())
+		return
+	}
+
+	result, _ := json.Marshal(map[string]interface{}{"manager": managerEmail, "items": reports})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+//
+// Returns the employees under a manager down to depth levels (0 for all of them)
+//
+func getReports(ctx context.Context, managerEmail string, depth int) ([]EmployeeReport, error) {
+	if len(managerEmail) < 1 {
+		return nil, inputError("managerEmail query parameter is required")
+	}
+	maxLevel := depth + 1
+	if depth < 1 {
+		maxLevel = 1000
+	}
+
+	var manager string
+	err := DBPool.QueryRowContext(ctx, "SELECT employee_email_address FROM CTO_COMMON.ORACLE_EMPLOYEES WHERE LOWER(employee_email_address) = :1",
+		managerEmail).Scan(&manager)
+	if err == sql.ErrNoRows {
+		return nil, errManagerNotFound
+	}
+	if err != nil {
+		thisError := fmt.Sprintf("Error looking up manager (%s): %s", managerEmail, err.Error())
+		return nil, errors.New(thisError)
+	}
+
+	rows, err := DBPool.QueryContext(ctx, employeeReportsQuery, managerEmail, maxLevel)
+	if err != nil {
+		thisError := fmt.Sprintf("Error querying reports (%s): %s", managerEmail, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	reports := []EmployeeReport{}
+	for rows.Next() {
+		var report EmployeeReport
+		err = rows.Scan(&report.Email, &report.Name, &report.Title, &report.Manager, &report.Depth, &report.Lob, &report.NumDirects)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning reports (%s): %s", managerEmail, err.Error())
+			return nil, errors.New(thisError)
+		}
+		reports = append(reports, report)
+	}
+	if err = rows.Err(); err != nil {
+		thisError := fmt.Sprintf("Error querying reports (%s): %s", managerEmail, err.Error())
+		return nil, errors.New(thisError)
+	}
+	return reports, nil
+}
@@ -0,0 +1,327 @@
+//  Asynchronous Exports
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// how long a single export may run
+const exportTimeout = 30 * time.Minute
+
+// how long a job can be looked up.  The exported files themselves are left to the bucket's lifecycle policy.
+const exportJobRetention = 24 * time.Hour
+
+// ExportJob is the state of an export, as returned by GET /exports
+type ExportJob struct {
+	asyncJob
+	Export      string `json:"export"`
+	InstanceEnv string `json:"instance_environment"`
+	Format      string `json:"format"`
+	Gzip        bool   `json:"gzip"`
+	Rows        int    `json:"rows"`
+	Bytes       int    `json:"bytes"`
+	DownloadURL string `json:"download_url,omitempty"`
+	URLExpires  string `json:"url_expires,omitempty"`
+
+	object     objectLocation
+	urlExpires time.Time
+}
+
+// exportSource writes every row of an export the scope may see to out, which is started with {"items": [
+type exportSource func(ctx context.Context, instanceEnv string, scope accessScope, params url.Values, out *itemWriter) error
+
+// the exports that can be requested; each is the full, unpaged result of the endpoint of the same name
+var exportSources = map[string]exportSource{
+	"getECALDataQuery": func(ctx context.Context, instanceEnv string, scope accessScope, params url.Values, out *itemWriter) error {
+		filters, err := parseQueryFilters(params, ecalDataQueryColumns)
+		if err != nil {
+			return err
+		}
+		_, err = getECALDataQuery(ctx, DBPool, instanceEnv, scope, filters, math.MaxInt32, pageCursor{}, params.Get("updatedSince"), out)
+		return err
+	},
+	"getECALAccountQuery": func(ctx context.Context, instanceEnv string, scope accessScope, params url.Values, out *itemWriter) error {
+		_, err := getECALAccountQuery(ctx, DBPool, instanceEnv, scope, math.MaxInt32, out)
+		return err
+	},
+	"getECALOpportunityQuery": func(ctx context.Context, instanceEnv string, scope accessScope, params url.Values, out *itemWriter) error {
+		filters, err := parseQueryFilters(params, ecalOpportunityQueryColumns)
+		if err != nil {
+			return err
+		}
+		_, err = getECALOpportunityQuery(ctx, DBPool, instanceEnv, scope, filters, params.Get("updatedSince"), math.MaxInt32, out)
+		return err
+	},
+	"getECALArtifactQuery": func(ctx context.Context, instanceEnv string, scope accessScope, params url.Values, out *itemWriter) error {
+		_, err := getECALArtifactQuery(ctx, DBPool, instanceEnv, scope, math.MaxInt32, out)
+		return err
+	},
+}
+
+// errExportsUnavailable is returned when there is nowhere to write exports
+var errExportsUnavailable = errors.New("exports are not configured")
+
+//
+// HTTP handler for exports.  POST starts an export in the background and returns its job (202); GET with id=
+// returns the job's status and, once it has completed, a pre-authenticated URL to download the file.
+//
+func exportsHandler(w http.ResponseWriter, r *http.Request) {
+	var job ExportJob
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		client, _, _ := r.BasicAuth()
+		job, err = submitExport(r.Context(), client, r.URL.Query())
+	case http.MethodGet:
+		job, err = getExportJob(r.Context(), r.URL.Query().Get("id"))
+	default:
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err == errJobNotFound {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Export not found")
+		return
+	}
+	if err == errExportsUnavailable {
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "Exports are not configured")
+		return
+	}
+	if err == errShuttingDown {
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "The service is shutting down")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "exports", err.Error())
+		return
+	}
+
+	result, _ := json.Marshal(job)
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodPost {
+		w.Header().Set("Location", "/exports?id="+job.ID)
+		w.WriteHeader(202)
+	}
+	w.Write(result)
+}
+
+//
+// Validates an export request and queues it.  Takes export (one of exportSources), instanceEnvironment,
+// format (json|csv, default json), gzip (true|false) and the parameters of the export's endpoint.  The rows the
+// client and userEmail may see are decided now, when the export is submitted (see resolveAccess).
+//
+func submitExport(ctx context.Context, client string, params url.Values) (ExportJob, error) {
+	export := params.Get("export")
+	source, ok := exportSources[export]
+	if !ok {
+		names := []string{}
+		for name := range exportSources {
+			names = append(names, name)
+		}
+		return ExportJob{}, inputError("export must be one of " + strings.Join(names, ", "))
+	}
+	instanceEnv := params.Get("instanceEnvironment")
+	if len(lookupSchema(instanceEnv)) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		return ExportJob{}, inputError("instanceEnvironment query parameter is invalid")
+	}
+	format := params.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		return ExportJob{}, inputError("format must be json or csv")
+	}
+	compress := strings.ToLower(params.Get("gzip")) == "true"
+	if ObjectStorage == nil || len(GlobalConfig.ExportBucket) < 1 {
+		return ExportJob{}, errExportsUnavailable
+	}
+	scope, err := resolveAccess(ctx, DBPool, client, instanceEnv, params.Get("userEmail"))
+	if err != nil {
+		return ExportJob{}, err
+	}
+
+	base, err := newAsyncJob(exportJobRetention)
+	if err != nil {
+		return ExportJob{}, err
+	}
+	extension := format
+	if compress {
+		extension += ".gz"
+	}
+	job := &ExportJob{asyncJob: base, Export: export, InstanceEnv: instanceEnv, Format: format, Gzip: compress}
+	job.object = objectLocation{Namespace: GlobalConfig.ArtifactNamespace, Bucket: GlobalConfig.ExportBucket,
+		Object: fmt.Sprintf("exports/%s/%s.%s", export, job.ID, extension)}
+	err = startAsyncJob("exports", job, exportTimeout, func(ctx context.Context) error {
+		return runExport(ctx, job, source, scope, params)
+	})
+	if err != nil {
+		return ExportJob{}, err
+	}
+
+	logOutput(logInfo, "exports", fmt.Sprintf("Queued export %s of %s (%s, %s)", job.ID, export, instanceEnv, extension))
+	return *job, nil
+}
+
+//
+// Runs an export: produces the rows, converts and compresses them as asked and writes the file to ExportBucket
+//
+func runExport(ctx context.Context, job *ExportJob, source exportSource, scope accessScope, params url.Values) error {
+	var body bytes.Buffer
+	out := newItemWriter(&body, "{\"items\": [")
+	err := source(ctx, job.InstanceEnv, scope, params, out)
+	if err != nil {
+		return err
+	}
+	err = out.finish("]}")
+	if err != nil {
+		return err
+	}
+	data := body.Bytes()
+	contentType := "application/json"
+	if job.Format == "csv" {
+		data, err = itemsToCSV(data)
+		if err != nil {
+			return err
+		}
+		contentType = "text/csv"
+	}
+	if job.Gzip {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		writer.Write(data)
+		err = writer.Close()
+		if err != nil {
+			return err
+		}
+		data = compressed.Bytes()
+		contentType = "application/gzip"
+	}
+	err = putObject(ctx, job.object, contentType, data)
+	if err != nil {
+		return err
+	}
+	updateAsyncJob(func() { job.Rows, job.Bytes = out.count, len(data) })
+	return nil
+}
+
+//
+// Returns a copy of an export job.  A completed job gets a pre-authenticated download URL, created the first time
+// it is asked for and again whenever the previous one has expired.
+//
+func getExportJob(ctx context.Context, id string) (ExportJob, error) {
+	task, err := lookupAsyncJob(id)
+	if err != nil {
+		return ExportJob{}, err
+	}
+	job, ok := task.(*ExportJob)
+	if !ok {
+		return ExportJob{}, errJobNotFound
+	}
+	var needsURL bool
+	updateAsyncJob(func() { needsURL = job.Status == jobCompleted && time.Now().After(job.urlExpires) })
+
+	if needsURL {
+		signedURL, expires, err := createObjectReadURL(ctx, job.object)
+		if err != nil {
+			return ExportJob{}, err
+		}
+		updateAsyncJob(func() {
+			job.DownloadURL, job.urlExpires = signedURL, expires
+			job.URLExpires = expires.In(outputLocation).Format(time.RFC3339)
+		})
+	}
+
+	var result ExportJob
+	updateAsyncJob(func() { result = *job })
+	return result, nil
+}
+
+//
+// Converts a {"items": [...]} body of flat JSON objects into CSV.  The columns are the fields of the first item in
+// the order they appear; nulls become empty values.
+//
+func itemsToCSV(body []byte) ([]byte, error) {
+	var items struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	err := json.Unmarshal(body, &items)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	writer := csv.NewWriter(&out)
+	var columns []string
+	for _, item := range items.Items {
+		keys, values, err := itemFields(item)
+		if err != nil {
+			return nil, err
+		}
+		if columns == nil {
+			columns = keys
+			writer.Write(columns)
+		}
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			record[i] = values[column]
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	return out.Bytes(), writer.Error()
+}
+
+//
+// Returns the field names of a flat JSON object in order along with their values as text
+//
+func itemFields(item json.RawMessage) ([]string, map[string]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(item))
+	decoder.UseNumber()
+	if _, err := decoder.Token(); err != nil {
+		return nil, nil, err
+	}
+	keys := []string{}
+	values := make(map[string]string)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		key := fmt.Sprintf("%v", token)
+		var value interface{}
+		err = decoder.Decode(&value)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, key)
+		if value != nil {
+			values[key] = fmt.Sprintf("%v", value)
+		}
+	}
+	return keys, values, nil
+}
@@ -0,0 +1,99 @@
+//  Feed Contract Validation
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// number of records checked by validateFeedContract when FeedContractSampleSize isn't set
+const defaultFeedContractSampleSize = 100
+
+// the feed fields each processor depends on.  A field missing from the feed decodes as an empty string, so a column
+// renamed upstream would otherwise load as blanks everywhere instead of failing.
+var feedContracts = map[string][]string{
+	identity: {"id", "employee_email_address", "employee_full_name", "mgr", "mgr_chain", "lob", "lob_detail",
+		"lob_tag", "lob_tag_root", "num_directs", "updated_on"},
+	opportunity: {"opportunity_id", "opportunity_name", "opportunity_status", "opty_int_id", "registry_id", "cim_id",
+		"customer_name", "revenue_line_id", "close_date", "product_description", "consumption_start_date"},
+	account: {"cim_id", "cim_id_parent", "account_name", "bus_segment_str", "end_user_registry_id", "nac_SE_Team", "nat_SE_Team"},
+	territory: {"territory_name", "territory_level", "parent_territory_name", "level_1_territory_name", "level_2_territory_name",
+		"level_3_territory_name", "territory_owner_email", "level_2_territory_owner_email", "level_3_territory_owner_email"},
+	product:     {"product_class", "product_pillar", "product_line", "product_group"},
+	consumption: {"cim_id", "customer_name", "subscription_id", "usage_month", "actual_usage", "currency_code"},
+}
+
+//
+// Checks that the first FeedContractSampleSize (default 100) records of a feed file carry every field the dataType
+// processor depends on and returns an error listing any that are missing.  Exporters can leave out null fields so
+// a field only counts as missing when none of the sampled records have it.
+//
+func validateFeedContract(dataType string, filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		thisError := fmt.Sprintf("Error opening file (%s): %s", filename, err.Error())
+		return errors.New(thisError)
+	}
+	defer file.Close()
+
+	// seek 10 bytes (chars) to advance past {"items":
+	_, err = file.Seek(10, io.SeekStart)
+	if err != nil {
+		thisError := fmt.Sprintf("Error advancing file stream to position 10: %s", err.Error())
+		return errors.New(thisError)
+	}
+	decoder := json.NewDecoder(file)
+	_, err = decoder.Token()
+	if err != nil {
+		thisError := fmt.Sprintf("Error decoding opening array token (%s): %s", filename, err.Error())
+		return errors.New(thisError)
+	}
+
+	seen := make(map[string]bool)
+	sampled := 0
+	for sampled < feedContractSampleSize() && decoder.More() {
+		var record map[string]json.RawMessage
+		err := decoder.Decode(&record)
+		if err != nil {
+			thisError := fmt.Sprintf("Error decoding %s record %d: %s", dataType, sampled+1, err.Error())
+			return errors.New(thisError)
+		}
+		for field := range record {
+			seen[field] = true
+		}
+		sampled++
+	}
+
+	// an empty feed has nothing to check; the processors deal with that
+	if sampled == 0 {
+		return nil
+	}
+	missing := []string{}
+	for _, field := range feedContracts[dataType] {
+		if !seen[field] {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) > 0 {
+		thisError := fmt.Sprintf("The %s feed (%s) is missing required fields %s in its first %d records; it may have been changed upstream",
+			dataType, filename, strings.Join(missing, ", "), sampled)
+		return errors.New(thisError)
+	}
+	return nil
+}
+
+func feedContractSampleSize() int {
+	size, err := strconv.Atoi(GlobalConfig.FeedContractSampleSize)
+	if err != nil || size < 1 {
+		return defaultFeedContractSampleSize
+	}
+	return size
+}
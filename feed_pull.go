@@ -0,0 +1,425 @@
+//  Feed Puller
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prefix of the SYNC_METADATA data type each pull is reported under (e.g. pull:identity); the load that follows is
+// reported under the feed's own data type
+const feedPullDataType = "pull:"
+
+// how long one page request may take and how often it is tried before the pull gives up
+const feedPullPageTimeout = 2 * time.Minute
+const feedPullAttempts = 4
+const feedPullRetryDelay = 10 * time.Second
+
+// the page size asked for when the source pages by offset without saying what size it used
+const feedPullPageSize = 1000
+
+// the most pages followed in one pull, in case a source keeps sending the same next link
+const feedPullMaxPages = 100000
+
+// feedSource is a REST source a feed is pulled from and the processor the pulled file is loaded with.  With a
+// tokenURL, user and password are an OAuth client id and secret exchanged for a bearer token; otherwise they are
+// sent as basic auth.
+type feedSource struct {
+	dataType string
+	schema   string
+	url      string
+	tokenURL string
+	user     string
+	password string
+	schedule string
+	process  func(job *loadJob, filename string)
+}
+
+// feedToken is a bearer token issued to a feed's OAuth client
+type feedToken struct {
+	value   string
+	expires time.Time
+}
+
+// feedPage is the part of a page of an ORDS style REST collection the puller needs
+type feedPage struct {
+	Items   []json.RawMessage `json:"items"`
+	HasMore bool              `json:"hasMore"`
+	Limit   int               `json:"limit"`
+	Offset  int               `json:"offset"`
+	Links   []struct {
+		Rel  string `json:"rel"`
+		Href string `json:"href"`
+	} `json:"links"`
+}
+
+// the feeds being pulled right now, so a slow pull isn't started again by the next scheduled minute
+var feedPullRunning = make(map[string]bool)
+var feedPullLock sync.Mutex
+
+// bearer tokens by feed, reused until shortly before they expire
+var feedTokens = make(map[string]feedToken)
+var feedTokenLock sync.Mutex
+
+//
+// Returns the feeds that have a REST source configured
+//
+func feedSources() []feedSource {
+	sources := []feedSource{}
+	if len(GlobalConfig.IdentityFeedURL) > 0 {
+		sources = append(sources, feedSource{dataType: identity, schema: "CTO_COMMON", url: GlobalConfig.IdentityFeedURL,
+			user: GlobalConfig.IdentityFeedUser, password: GlobalConfig.IdentityFeedPassword,
+			schedule: GlobalConfig.IdentityFeedSchedule, process: processIdentity})
+	}
+	if len(GlobalConfig.OpportunityFeedURL) > 0 {
+		sources = append(sources, feedSource{dataType: opportunity, schema: lookupSchema(GlobalConfig.ECALOpportunitySyncTarget),
+			url: GlobalConfig.OpportunityFeedURL, tokenURL: GlobalConfig.OpportunityFeedTokenURL,
+			user: GlobalConfig.OpportunityFeedUser, password: GlobalConfig.OpportunityFeedPassword,
+			schedule: GlobalConfig.OpportunityFeedSchedule,
+			process:  func(job *loadJob, filename string) { processOpportunity(job, filename, loadScope{}) }})
+	}
+	if len(GlobalConfig.AccountFeedURL) > 0 {
+		sources = append(sources, feedSource{dataType: account, schema: lookupSchema(GlobalConfig.ECALOpportunitySyncTarget),
+			url: GlobalConfig.AccountFeedURL, tokenURL: GlobalConfig.AccountFeedTokenURL,
+			user: GlobalConfig.AccountFeedUser, password: GlobalConfig.AccountFeedPassword,
+			schedule: GlobalConfig.AccountFeedSchedule,
+			process:  func(job *loadJob, filename string) { processAccount(job, filename, loadScope{}) }})
+	}
+	return sources
+}
+
+//
+// Starts pulling each feed that has a source URL and a schedule (cron, in OutputTimeZone) in place of waiting for
+// it to be pushed through postReferenceData.  Only set the schedules on one instance so each pull happens once.
+//
+func startFeedPuller() {
+	scheduled := make(map[string]*cronSchedule)
+	for _, source := range feedSources() {
+		if len(source.schedule) < 1 {
+			continue
+		}
+		cron, err := parseCron(source.schedule)
+		if err != nil {
+			logOutput(logWarn, "feed_pull", fmt.Sprintf("Invalid schedule for the %s feed, it won't be pulled: %s", source.dataType, err.Error()))
+			continue
+		}
+		scheduled[source.dataType] = cron
+	}
+	if len(scheduled) < 1 {
+		return
+	}
+	logOutput(logInfo, "feed_pull", "Starting feed puller")
+
+	go func() {
+		for {
+			// wake up at the top of each minute
+			now := time.Now()
+			time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+
+			minute := time.Now().In(outputLocation)
+			for _, source := range feedSources() {
+				if cron, found := scheduled[source.dataType]; found && cron.matches(minute) {
+					source := source
+					startLoad("pull:"+source.dataType, func(job *loadJob) { pullFeed(job, source) })
+				}
+			}
+		}
+	}()
+}
+
+//
+// HTTP handler that pulls a feed (type=identity, opportunity or account) from its REST source now rather than
+// waiting for its schedule.  The pull and load run in the background as a load job whose id is returned; their
+// outcome shows up in jobs and syncStatus.
+//
+func pullFeedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+	dataType := r.URL.Query().Get("type")
+	for _, source := range feedSources() {
+		if source.dataType == dataType {
+			source := source
+			job := startLoad("pull:"+source.dataType, func(job *loadJob) { pullFeed(job, source) })
+			if job == nil {
+				w.WriteHeader(503)
+				fmt.Fprintf(w, "The service is shutting down")
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(202)
+			fmt.Fprintf(w, "{\"type\": \"%s\", \"status\": \"started\", \"job_id\": \"%s\"}", dataType, job.ID)
+			return
+		}
+	}
+	w.WriteHeader(404)
+	fmt.Fprintf(w, "No REST source is configured for type %s", dataType)
+}
+
+//
+// Pulls every page of a feed into dataType.json, in the layout postReferenceData assembles, and loads it with the
+// feed's processor.  Nothing is loaded unless every page was read.  Does nothing if the feed is already being pulled.
+// A failed pull fails job; the pull's own counts are only in syncStatus so the job counts what was loaded.
+//
+func pullFeed(job *loadJob, source feedSource) {
+	feedPullLock.Lock()
+	if feedPullRunning[source.dataType] {
+		feedPullLock.Unlock()
+		message := fmt.Sprintf("The %s feed is still being pulled; skipping", source.dataType)
+		logOutput(logWarn, "feed_pull", message)
+		job.fail(message)
+		return
+	}
+	feedPullRunning[source.dataType] = true
+	feedPullLock.Unlock()
+	defer func() {
+		feedPullLock.Lock()
+		delete(feedPullRunning, source.dataType)
+		feedPullLock.Unlock()
+	}()
+
+	filename := source.dataType + ".json"
+	run := beginSyncRun(nil, "feed_pull", feedPullDataType+source.dataType, source.schema, filename)
+	logOutput(logInfo, "feed_pull", fmt.Sprintf("START Pulling %s feed", source.dataType))
+
+	count, err := downloadFeed(source, filename+".pull")
+	if err != nil {
+		os.Remove(filename + ".pull")
+		message := fmt.Sprintf("Error pulling %s feed: %s", source.dataType, err.Error())
+		run.fail(message)
+		job.fail(message)
+		return
+	}
+	err = os.Rename(filename+".pull", filename)
+	if err != nil {
+		message := fmt.Sprintf("Error moving pulled %s feed into place: %s", source.dataType, err.Error())
+		run.fail(message)
+		job.fail(message)
+		return
+	}
+	run.complete(count, count)
+	logOutput(logInfo, "feed_pull", fmt.Sprintf("DONE Pulling %s feed (%d records)", source.dataType, count))
+
+	source.process(job, filename)
+}
+
+//
+// Writes the items of every page of the source to filename as {"items": [...]} and returns how many there were
+//
+func downloadFeed(source feedSource, filename string) (int, error) {
+	output, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0700)
+	if err != nil {
+		return 0, err
+	}
+	defer output.Close()
+
+	// the processors seek past the first 10 bytes, {"items": , so the layout has to match exactly
+	_, err = io.WriteString(output, "{\"items\": [")
+	if err != nil {
+		return 0, err
+	}
+
+	client := &http.Client{Timeout: feedPullPageTimeout}
+	pageURL := source.url
+	count := 0
+	for pages := 0; len(pageURL) > 0; pages++ {
+		if pages >= feedPullMaxPages {
+			thisError := fmt.Sprintf("gave up after %d pages", feedPullMaxPages)
+			return count, errors.New(thisError)
+		}
+		page, err := fetchFeedPage(client, source, pageURL)
+		if err != nil {
+			return count, err
+		}
+		for _, item := range page.Items {
+			if count > 0 {
+				_, err = io.WriteString(output, ",\n")
+			}
+			if err == nil {
+				_, err = output.Write(item)
+			}
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+		pageURL, err = nextFeedPage(pageURL, page)
+		if err != nil {
+			return count, err
+		}
+	}
+
+	_, err = io.WriteString(output, "]}")
+	if err != nil {
+		return count, err
+	}
+	return count, output.Close()
+}
+
+//
+// Returns the URL of the page after this one, or "" if this was the last.  The source's next link is followed
+// when it gives one, otherwise the offset is moved past the items just read.
+//
+func nextFeedPage(pageURL string, page *feedPage) (string, error) {
+	if !page.HasMore || len(page.Items) < 1 {
+		return "", nil
+	}
+	for _, link := range page.Links {
+		if link.Rel == "next" && len(link.Href) > 0 {
+			base, err := url.Parse(pageURL)
+			if err != nil {
+				return "", err
+			}
+			next, err := base.Parse(link.Href)
+			if err != nil {
+				return "", err
+			}
+			return next.String(), nil
+		}
+	}
+
+	next, err := url.Parse(pageURL)
+	if err != nil {
+		return "", err
+	}
+	limit := page.Limit
+	if limit < 1 {
+		limit = feedPullPageSize
+	}
+	query := next.Query()
+	query.Set("offset", strconv.Itoa(page.Offset+len(page.Items)))
+	query.Set("limit", strconv.Itoa(limit))
+	next.RawQuery = query.Encode()
+	return next.String(), nil
+}
+
+//
+// Reads one page from the source, retrying with backoff when the request fails, is throttled or the source returns
+// a server error
+//
+func fetchFeedPage(client *http.Client, source feedSource, pageURL string) (*feedPage, error) {
+	var lastErr error
+	for attempt := 1; attempt <= feedPullAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(float64(feedPullRetryDelay) * math.Pow(2, float64(attempt-2))))
+		}
+		page, retry, err := requestFeedPage(client, source, pageURL)
+		if err == nil {
+			return page, nil
+		}
+		lastErr = err
+		if !retry {
+			break
+		}
+		logOutput(logWarn, "feed_pull", fmt.Sprintf("Attempt %d to read %s failed: %s", attempt, pageURL, err.Error()))
+	}
+	return nil, lastErr
+}
+
+func requestFeedPage(client *http.Client, source feedSource, pageURL string) (*feedPage, bool, error) {
+	request, err := http.NewRequest(http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	request.Header.Set("Accept", "application/json")
+	if len(source.tokenURL) > 0 {
+		token, err := feedAccessToken(client, source)
+		if err != nil {
+			return nil, true, err
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+	} else if len(source.user) > 0 {
+		request.SetBasicAuth(source.user, source.password)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, true, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		thisError := fmt.Sprintf("%s returned %d: %s", pageURL, response.StatusCode, strings.TrimSpace(string(body)))
+		retry := response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+
+		// the token may have been revoked or expired early, so get a new one for the next attempt
+		if response.StatusCode == http.StatusUnauthorized && len(source.tokenURL) > 0 {
+			feedTokenLock.Lock()
+			delete(feedTokens, source.dataType)
+			feedTokenLock.Unlock()
+			retry = true
+		}
+		return nil, retry, errors.New(thisError)
+	}
+
+	var page feedPage
+	err = json.NewDecoder(response.Body).Decode(&page)
+	if err != nil {
+		thisError := fmt.Sprintf("%s returned an invalid page: %s", pageURL, err.Error())
+		return nil, true, errors.New(thisError)
+	}
+	return &page, false, nil
+}
+
+//
+// Returns a bearer token for the feed's OAuth client, asking tokenURL for a new one (client credentials grant) when
+// there isn't one that is good for at least another minute
+//
+func feedAccessToken(client *http.Client, source feedSource) (string, error) {
+	feedTokenLock.Lock()
+	defer feedTokenLock.Unlock()
+	if token, found := feedTokens[source.dataType]; found && time.Now().Add(time.Minute).Before(token.expires) {
+		return token.value, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	request, err := http.NewRequest(http.MethodPost, source.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.SetBasicAuth(source.user, source.password)
+
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		thisError := fmt.Sprintf("token request to %s returned %d: %s", source.tokenURL, response.StatusCode, strings.TrimSpace(string(body)))
+		return "", errors.New(thisError)
+	}
+
+	var grant struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&grant)
+	if err != nil || len(grant.AccessToken) < 1 {
+		thisError := fmt.Sprintf("token request to %s returned no access_token", source.tokenURL)
+		return "", errors.New(thisError)
+	}
+	if grant.ExpiresIn < 1 {
+		grant.ExpiresIn = 300
+	}
+	feedTokens[source.dataType] = feedToken{value: grant.AccessToken, expires: time.Now().Add(time.Duration(grant.ExpiresIn) * time.Second)}
+	return grant.AccessToken, nil
+}
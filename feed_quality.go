@@ -0,0 +1,225 @@
+//  Feed Data Quality
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// number of past loads returned by feedQuality when history isn't given
+const defaultFeedQualityHistory = 30
+
+// FeedQuality is the data-quality score of one load of a feed.  Indicators are percentages of the records read:
+// null_rate:FIELD (empty key field), unparseable_date_rate:FIELD and missing_cim_id_rate.  The score is 100 less
+// the average indicator.
+type FeedQuality struct {
+	DataType   string             `json:"data_type"`
+	Schema     string             `json:"schema"`
+	LoadTime   string             `json:"load_time"`
+	Records    int                `json:"records"`
+	Score      float64            `json:"score"`
+	Indicators map[string]float64 `json:"indicators"`
+}
+
+// feedQuality accumulates the data-quality counts of a load as its records are read
+type feedQuality struct {
+	dataType   string
+	schema     string
+	records    int
+	nulls      map[string]int
+	badDates   map[string]int
+	missingCIM int
+	checkCIM   bool
+}
+
+//
+// Starts scoring a load of dataType into schema.  fields are the key fields whose null rate is reported.
+//
+func newFeedQuality(dataType string, schema string, fields ...string) *feedQuality {
+	quality := &feedQuality{dataType: dataType, schema: schema, nulls: make(map[string]int), badDates: make(map[string]int)}
+	for _, field := range fields {
+		quality.nulls[field] = 0
+	}
+	return quality
+}
+
+//
+// Counts a record along with the values of its key fields
+//
+func (q *feedQuality) addRecord(values map[string]string) {
+	q.records++
+	for field := range q.nulls {
+		if len(values[field]) < 1 {
+			q.nulls[field]++
+		}
+	}
+}
+
+//
+// Counts a date field that is set but isn't a YYYY-MM-DD date
+//
+func (q *feedQuality) checkDate(field string, value string) {
+	if _, ok := q.badDates[field]; !ok {
+		q.badDates[field] = 0
+	}
+	if len(value) < 1 {
+		return
+	}
+	if _, err := time.Parse(queryDateLayout, value); err != nil {
+		q.badDates[field]++
+	}
+}
+
+//
+// Counts a record without a CIM ID (which can't be matched to an account)
+//
+func (q *feedQuality) checkCIMID(cimID string) {
+	q.checkCIM = true
+	if len(cimID) < 1 {
+		q.missingCIM++
+	}
+}
+
+//
+// Returns the indicators and overall score of the load
+//
+func (q *feedQuality) score() FeedQuality {
+	result := FeedQuality{DataType: q.dataType, Schema: q.schema, Records: q.records, Score: 100, Indicators: make(map[string]float64)}
+	if q.records == 0 {
+		return result
+	}
+
+	percent := func(count int) float64 {
+		return math.Round(float64(count)*10000/float64(q.records)) / 100
+	}
+	for field, count := range q.nulls {
+		result.Indicators["null_rate:"+field] = percent(count)
+	}
+	for field, count := range q.badDates {
+		result.Indicators["unparseable_date_rate:"+field] = percent(count)
+	}
+	if q.checkCIM {
+		result.Indicators["missing_cim_id_rate"] = percent(q.missingCIM)
+	}
+
+	if len(result.Indicators) > 0 {
+		total := 0.0
+		for _, value := range result.Indicators {
+			total += value
+		}
+		result.Score = math.Round((100-total/float64(len(result.Indicators)))*100) / 100
+	}
+	return result
+}
+
+//
+// Saves the score of the load to CTO_COMMON.FEED_QUALITY.  Pass the load's transaction so a load that rolls back
+// doesn't leave a score behind.
+//
+func (q *feedQuality) save(db QueryRunner) error {
+	result := q.score()
+	indicators, err := json.Marshal(result.Indicators)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO CTO_COMMON.FEED_QUALITY (data_type, schema_name, load_time, records, score, indicators) "+
+		"VALUES (:1, :2, SYSTIMESTAMP, :3, :4, :5)",
+		result.DataType, result.Schema, result.Records, result.Score, string(indicators))
+	if err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("Data quality of %s load into %s: %.2f over %d records", result.DataType, result.Schema, result.Score, result.Records)
+	logOutput(logInfo, "feed_quality", message)
+	return nil
+}
+
+//
+// HTTP handler for the feedQuality functionality.  Returns the latest score per schema and the scores of the last
+// history (default 30) loads of the feed given by type so data stewards can spot upstream regressions.
+//
+func getFeedQualityHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	dataType := query.Get("type")
+	if dataType != identity && dataType != opportunity && dataType != account && dataType != territory && dataType != product &&
+		dataType != consumption {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "type must be one of %s, %s, %s, %s, %s or %s", identity, opportunity, account, territory, product, consumption)
+		return
+	}
+	history := defaultFeedQualityHistory
+	if len(query.Get("history")) > 0 {
+		value, err := strconv.Atoi(query.Get("history"))
+		if err != nil || value < 1 {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "history must be a positive number")
+			return
+		}
+		history = value
+	}
+
+	items, err := getFeedQuality(dataType, history)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "feed_quality", err.Error())
+		return
+	}
+
+	// the history is newest first so the first entry seen for each schema is its latest
+	latest := []FeedQuality{}
+	seen := make(map[string]bool)
+	for _, item := range items {
+		if !seen[item.Schema] {
+			seen[item.Schema] = true
+			latest = append(latest, item)
+		}
+	}
+
+	result, _ := json.Marshal(map[string][]FeedQuality{"latest": latest, "history": items})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+//
+// Returns the most recent scores of a feed, newest first
+//
+func getFeedQuality(dataType string, history int) ([]FeedQuality, error) {
+	rows, err := DBPool.Query(`SELECT data_type, schema_name, TO_CHAR(load_time, 'YYYY-MM-DD"T"HH24:MI:SSTZH:TZM'),
+		records, score, indicators
+		FROM CTO_COMMON.FEED_QUALITY
+		WHERE data_type = :1
+		ORDER BY load_time DESC
+		FETCH FIRST :2 ROWS ONLY`, dataType, history)
+	if err != nil {
+		thisError := fmt.Sprintf("Error querying FEED_QUALITY (%s): %s", dataType, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	items := []FeedQuality{}
+	for rows.Next() {
+		var item FeedQuality
+		var indicators sql.NullString
+		err := rows.Scan(&item.DataType, &item.Schema, &item.LoadTime, &item.Records, &item.Score, &indicators)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning FEED_QUALITY row (%s): %s", dataType, err.Error())
+			return nil, errors.New(thisError)
+		}
+		item.Indicators = make(map[string]float64)
+		if indicators.Valid {
+			json.Unmarshal([]byte(indicators.String), &item.Indicators)
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
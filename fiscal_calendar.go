@@ -0,0 +1,68 @@
+//  Fiscal Calendar
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Oracle's fiscal year starts on June 1 and is named for the calendar year it ends in (June 2020 is FY21 Q1)
+const defaultFiscalYearStartMonth = time.June
+
+//
+// Returns the month the fiscal year starts in from FiscalYearStartMonth (1-12, default 6)
+//
+func fiscalYearStartMonth() time.Month {
+	month, err := strconv.Atoi(GlobalConfig.FiscalYearStartMonth)
+	if err != nil || month < 1 || month > 12 {
+		return defaultFiscalYearStartMonth
+	}
+	return time.Month(month)
+}
+
+//
+// Returns the fiscal year and quarter (1-4) a date falls in
+//
+func fiscalQuarter(date time.Time) (int, int) {
+	start := fiscalYearStartMonth()
+	offset := (int(date.Month()) - int(start) + 12) % 12
+	year := date.Year()
+	if start != time.January && date.Month() >= start {
+		year++
+	}
+	return year, offset/3 + 1
+}
+
+//
+// Returns the name (e.g. FY21 Q1) of a fiscal quarter
+//
+func fiscalQuarterName(year int, quarter int) string {
+	return fmt.Sprintf("FY%02d Q%d", year%100, quarter)
+}
+
+//
+// Returns the first and last day of a fiscal quarter
+//
+func fiscalQuarterDates(year int, quarter int) (time.Time, time.Time) {
+	start := fiscalYearStartMonth()
+	startYear := year
+	if start != time.January {
+		startYear--
+	}
+	first := time.Date(startYear, start, 1, 0, 0, 0, 0, time.UTC).AddDate(0, (quarter-1)*3, 0)
+	return first, first.AddDate(0, 3, -1)
+}
+
+//
+// Returns a SQL expression naming the fiscal quarter (e.g. FY21 Q1) of a DATE column, for queries whose rows are
+// consumed outside the service and so can't go through fiscalQuarter
+//
+func fiscalQuarterSQL(column string) string {
+	start := int(fiscalYearStartMonth())
+	return fmt.Sprintf("'FY' || TO_CHAR(ADD_MONTHS(%s, %d), 'YY') || ' Q' || (TRUNC(MOD(EXTRACT(MONTH FROM %s) + %d, 12) / 3) + 1)",
+		column, (13-start)%12, column, 12-start)
+}
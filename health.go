@@ -9,6 +9,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 )
 
 //
@@ -18,10 +21,10 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	healthy := true
 	healthErrors := "HEALTH_NOT_OK"
 
-	schema := SchemaMap[GlobalConfig.ECALOpportunitySyncTarget]
+	schema := lookupSchema(GlobalConfig.ECALOpportunitySyncTarget)
 	if len(schema) < 1 {
 		thisError := fmt.Sprintf("Config healthcheck failed: Schema identifier %s not mappable", GlobalConfig.ECALOpportunitySyncTarget)
-		logOutput(logError, "healthcheck", thisError)
+		logRequest(r, logError, "healthcheck", thisError)
 		healthErrors = healthErrors + ":CONFIG"
 		healthy = false
 	}
@@ -30,7 +33,7 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	rows1, err := DBPool.Query("SELECT SYSDATE FROM DUAL")
 	if err != nil {
 		thisError := fmt.Sprintf("DB healthcheck failed: %s", err.Error())
-		logOutput(logError, "healthcheck", thisError)
+		logRequest(r, logError, "healthcheck", thisError)
 		healthErrors = healthErrors + ":DB_ACCESS"
 		healthy = false
 	}
@@ -38,10 +41,10 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 
 	// make sure the ECAL account lookup table is populated
 	count := 0
-	rows2, err := DBPool.Query("SELECT count(*) FROM " + schema + ".LookupAccount")
+	rows2, err := DBPool.Query("SELECT count(*) FROM " + schema + ".LookupAccount WHERE active = 1")
 	if err != nil {
 		thisError := fmt.Sprintf("Account healthcheck failed: %s", err.Error())
-		logOutput(logError, "healthcheck", thisError)
+		logRequest(r, logError, "healthcheck", thisError)
 		healthErrors = healthErrors + ":ACCOUNT_DATA"
 		healthy = false
 	} else {
@@ -50,10 +53,10 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 		err = rows2.Scan(&count)
 		if err != nil || count == 0 {
 			if err == nil {
-				err = errors.New("LookupAccount has 0 rows")
+				err = errors.New("LookupAccount has 0 active rows")
 			}
 			thisError := fmt.Sprintf("Account healthcheck failed: %s", err.Error())
-			logOutput(logError, "healthcheck", thisError)
+			logRequest(r, logError, "healthcheck", thisError)
 			healthErrors = healthErrors + ":ACCOUNT_COUNT"
 			healthy = false
 		}
@@ -61,10 +64,10 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 
 	// make sure the ECAL opportunity lookup table is populated
 	count = 0
-	rows3, err := DBPool.Query("SELECT count(*) FROM " + schema + ".LookupOpportunity")
+	rows3, err := DBPool.Query("SELECT count(*) FROM " + schema + ".LookupOpportunity WHERE active = 1")
 	if err != nil {
 		thisError := fmt.Sprintf("Opportunity healthcheck failed: %s", err.Error())
-		logOutput(logError, "healthcheck", thisError)
+		logRequest(r, logError, "healthcheck", thisError)
 		healthErrors = healthErrors + ":OPPORTUNITY_DATA"
 		healthy = false
 	} else {
@@ -73,10 +76,10 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 		err = rows3.Scan(&count)
 		if err != nil || count == 0 {
 			if err == nil {
-				err = errors.New("LookupOpportunity has 0 rows")
+				err = errors.New("LookupOpportunity has 0 active rows")
 			}
 			thisError := fmt.Sprintf("Opportunity healthcheck failed: %s", err.Error())
-			logOutput(logError, "healthcheck", thisError)
+			logRequest(r, logError, "healthcheck", thisError)
 			healthErrors = healthErrors + ":OPPORTUNITY_COUNT"
 			healthy = false
 		}
@@ -86,19 +89,101 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	_, err = ioutil.ReadFile(GlobalConfig.IdentityFilename)
 	if err != nil {
 		thisError := fmt.Sprintf("FILE healthcheck failed: %s", err.Error())
-		logOutput(logError, "healthcheck", thisError)
+		logRequest(r, logError, "healthcheck", thisError)
 		healthErrors = healthErrors + ":IDENTITY_DATA"
 		healthy = false
 	}
 
+	// make sure the lookup tables and identity file have been refreshed recently.  stale data is reported as
+	// degraded unless StaleDataFailsHealth is set in which case it fails the health check outright
+	staleErrors := checkDataStaleness(schema)
+	if len(staleErrors) > 0 && GlobalConfig.StaleDataFailsHealth {
+		healthErrors = healthErrors + staleErrors
+		healthy = false
+	}
+
+	// the upstream feeds being down is reported on its own after the service's health and never fails the check, so
+	// "the helper is broken" can be told apart from "the feed it loads from is down"
+	upstreamErrors := ""
+	if GlobalConfig.UpstreamHealthChecks {
+		upstreamErrors = checkUpstreamHealth()
+		if len(upstreamErrors) > 0 {
+			upstreamErrors = " UPSTREAM_NOT_OK" + upstreamErrors
+		}
+	}
+
 	// write appropriate response code based on health condition
-	if healthy {
+	if healthy && len(staleErrors) > 0 {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(200)
+		fmt.Fprintf(w, "HEALTH_DEGRADED"+staleErrors+upstreamErrors)
+	} else if healthy {
 		w.Header().Set("Content-Type", "text/html")
 		w.WriteHeader(200)
-		fmt.Fprintf(w, "HEALTH_OK")
+		fmt.Fprintf(w, "HEALTH_OK"+upstreamErrors)
 	} else {
 		w.Header().Set("Content-Type", "text/html")
 		w.WriteHeader(500)
-		fmt.Fprintf(w, healthErrors)
+		fmt.Fprintf(w, healthErrors+upstreamErrors)
+	}
+}
+
+//
+// Checks the last successful load of the lookup tables against LookupStaleHours and the age of the identity
+// file against IdentityFileStaleHours.  Returns a string of :TOKEN markers for each stale source, or an
+// empty string if everything is fresh.  Checks whose window is not configured are skipped.
+//
+func checkDataStaleness(schema string) string {
+	staleErrors := ""
+
+	lookupWindow, err := parseStaleHours(GlobalConfig.LookupStaleHours)
+	if err != nil {
+		logOutput(logError, "healthcheck", "LookupStaleHours is invalid: "+err.Error())
+	} else if lookupWindow > 0 {
+		checks := []struct {
+			dataType string
+			token    string
+		}{{account, ":ACCOUNT_STALE"}, {opportunity, ":OPPORTUNITY_STALE"}}
+
+		for _, check := range checks {
+			lastSuccess, found, err := getLastSyncSuccess(check.dataType, schema)
+			if err != nil {
+				thisError := fmt.Sprintf("Staleness healthcheck failed for %s: %s", check.dataType, err.Error())
+				logOutput(logError, "healthcheck", thisError)
+				staleErrors = staleErrors + check.token
+			} else if !found || time.Since(lastSuccess) > lookupWindow {
+				thisError := fmt.Sprintf("Staleness healthcheck failed: %s data in %s last refreshed %s", check.dataType, schema, lastSuccess.Format(time.RFC3339))
+				logOutput(logWarn, "healthcheck", thisError)
+				staleErrors = staleErrors + check.token
+			}
+		}
+	}
+
+	identityWindow, err := parseStaleHours(GlobalConfig.IdentityFileStaleHours)
+	if err != nil {
+		logOutput(logError, "healthcheck", "IdentityFileStaleHours is invalid: "+err.Error())
+	} else if identityWindow > 0 {
+		info, err := os.Stat(GlobalConfig.IdentityFilename)
+		if err == nil && time.Since(info.ModTime()) > identityWindow {
+			thisError := fmt.Sprintf("Staleness healthcheck failed: %s last written %s", GlobalConfig.IdentityFilename, info.ModTime().Format(time.RFC3339))
+			logOutput(logWarn, "healthcheck", thisError)
+			staleErrors = staleErrors + ":IDENTITY_STALE"
+		}
+	}
+
+	return staleErrors
+}
+
+//
+// Converts a config value expressed in hours to a duration.  An empty value disables the check and returns 0.
+//
+func parseStaleHours(hours string) (time.Duration, error) {
+	if len(hours) < 1 {
+		return 0, nil
+	}
+	value, err := strconv.ParseFloat(hours, 64)
+	if err != nil {
+		return 0, err
 	}
+	return time.Duration(value * float64(time.Hour)), nil
 }
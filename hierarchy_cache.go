@@ -0,0 +1,74 @@
+//  Manager Hierarchy Cache
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default lifetime of a cached hierarchy when HierarchyCacheHours is not set.  The cache is normally
+// invalidated by the identity load long before this; the TTL only guards against edits made directly in VB.
+const defaultHierarchyCacheTTL = 24 * time.Hour
+
+// hierarchyCacheEntry is the cached result of a hierarchy query
+type hierarchyCacheEntry struct {
+	managers []string
+	loaded   time.Time
+}
+
+// hierarchyCache is keyed by instanceEnv|managerEmail and guarded by hierarchyCacheLock
+var hierarchyCache = make(map[string]hierarchyCacheEntry)
+var hierarchyCacheLock sync.RWMutex
+
+//
+// Returns the cached hierarchy for a manager in an instanceEnvironment.  The bool is false on a miss or expired entry.
+//
+func getCachedHierarchy(instanceEnv string, managerEmail string) ([]string, bool) {
+	hierarchyCacheLock.RLock()
+	defer hierarchyCacheLock.RUnlock()
+
+	entry, ok := hierarchyCache[hierarchyCacheKey(instanceEnv, managerEmail)]
+	if !ok || time.Since(entry.loaded) > hierarchyCacheTTL() {
+		return nil, false
+	}
+	return entry.managers, true
+}
+
+//
+// Stores the hierarchy for a manager in an instanceEnvironment
+//
+func putCachedHierarchy(instanceEnv string, managerEmail string, managers []string) {
+	hierarchyCacheLock.Lock()
+	defer hierarchyCacheLock.Unlock()
+	hierarchyCache[hierarchyCacheKey(instanceEnv, managerEmail)] = hierarchyCacheEntry{managers: managers, loaded: time.Now()}
+}
+
+//
+// Drops every cached hierarchy.  Called whenever the identity load commits since reporting lines may have changed.
+//
+func invalidateHierarchyCache() {
+	hierarchyCacheLock.Lock()
+	defer hierarchyCacheLock.Unlock()
+	count := len(hierarchyCache)
+	hierarchyCache = make(map[string]hierarchyCacheEntry)
+	logOutput(logInfo, "hierarchy_cache", "Invalidated "+strconv.Itoa(count)+" cached manager hierarchies")
+}
+
+func hierarchyCacheKey(instanceEnv string, managerEmail string) string {
+	return instanceEnv + "|" + strings.ToLower(managerEmail)
+}
+
+func hierarchyCacheTTL() time.Duration {
+	if len(GlobalConfig.HierarchyCacheHours) > 0 {
+		hours, err := strconv.ParseFloat(GlobalConfig.HierarchyCacheHours, 64)
+		if err == nil {
+			return time.Duration(hours * float64(time.Hour))
+		}
+	}
+	return defaultHierarchyCacheTTL
+}
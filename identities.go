@@ -5,42 +5,201 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
 )
 
+// size of the chunks the identities file is streamed to the client in
+const identityChunkSize = 64 * 1024
+
 //
 // HTTP handler that writes the contents of the identities file to the output
 //
 func postIdentitiesQueryHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		logOutput(logError, "identities", outputHTTPError("postIdentitiesQueryHandler", err, nil))
+		logRequest(r, logError, "identities", outputHTTPError("postIdentitiesQueryHandler", err, nil))
 		w.WriteHeader(500)
 		return
 	}
 	// write identities to filesystem
 	err = ioutil.WriteFile(GlobalConfig.IdentityFilename, body, 0700)
 	if err != nil {
-		logOutput(logError, "identities", outputHTTPError("postIdentitiesQueryHandler", err, nil))
+		logRequest(r, logError, "identities", outputHTTPError("postIdentitiesQueryHandler", err, nil))
 		w.WriteHeader(500)
+		return
 	}
+	go saveIdentityVersion(body)
 }
 
 //
-// HTTP handler that writes the contents of the identities file to the output
+// HTTP handler that writes the contents of the identities file to the output.  If a maxRows or cursor parameter is
+// passed the identities are returned a page at a time (see pageIdentities) instead.  The response carries the
+// Last-Modified time and an ETag of the file so a caller polling for a new file can send If-None-Match or
+// If-Modified-Since and get a 304 while it hasn't been rewritten.  Pages aren't conditional, since the validators
+// describe the whole file rather than the page.
 //
 func getIdentitiesQueryHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	paged := len(query.Get("maxRows")) > 0 || len(query.Get("cursor")) > 0
+	maxRows := 0
+	cursor := pageCursor{}
+	if paged {
+		var err error
+		maxRows, err = getMaxRows(query.Get("maxRows"))
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+		cursor, err = decodeCursor(query.Get("cursor"))
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+	}
+
 	// open identities JSON file from filesystem
-	data, err := ioutil.ReadFile(GlobalConfig.IdentityFilename)
+	file, err := os.Open(GlobalConfig.IdentityFilename)
+	if err != nil {
+		logRequest(r, logError, "identities", outputHTTPError("getIdentitiesQueryHandler", err, nil))
+		w.WriteHeader(500)
+		return
+	}
+	defer file.Close()
+
+	// the file is only ever rewritten wholesale so its modification time and size identify a generation of it
+	info, err := file.Stat()
 	if err != nil {
-		logOutput(logError, "identities", outputHTTPError("getIdentitiesQueryHandler", err, nil))
+		logRequest(r, logError, "identities", outputHTTPError("getIdentitiesQueryHandler", err, nil))
 		w.WriteHeader(500)
 		return
 	}
+	if paged {
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			logRequest(r, logError, "identities", outputHTTPError("getIdentitiesQueryHandler", err, nil))
+			w.WriteHeader(500)
+			return
+		}
+		data, err = pageIdentities(data, maxRows, cursor)
+		if err != nil {
+			logRequest(r, logError, "identities", outputHTTPError("getIdentitiesQueryHandler", err, nil))
+			w.WriteHeader(500)
+			return
+		}
 
-	// write result to output stream
+		// write result to output stream
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+
+	modified := info.ModTime().UTC().Truncate(time.Second)
+	etag := fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size())
+	w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	w.Header().Set("ETag", etag)
+	if identitiesNotModified(r, etag, modified) {
+		w.WriteHeader(304)
+		return
+	}
+
+	// stream the file to the output a chunk at a time rather than reading all of it into memory first
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, string(data))
+	flusher, _ := w.(http.Flusher)
+	buffer := make([]byte, identityChunkSize)
+	for {
+		n, err := file.Read(buffer)
+		if n > 0 {
+			if _, writeErr := w.Write(buffer[:n]); writeErr != nil {
+				logRequest(r, logWarn, "identities", "Client went away while streaming identities: "+writeErr.Error())
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			abortStreamedResponse("identities", err)
+		}
+	}
+}
+
+//
+// True if the caller already has this generation of the identities file.  If-None-Match takes precedence over
+// If-Modified-Since as in RFC 7232.
+//
+func identitiesNotModified(r *http.Request, etag string, modified time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); len(match) > 0 {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.After(since)
+}
+
+//
+// Returns one page of the identities file: up to maxRows identities in id order starting after cursor, along with
+// the truncated flag and the cursor of the next page.  Since the file is rewritten wholesale by each identity load,
+// ordering by id lets a caller walk it reliably even if a load lands partway through.
+//
+func pageIdentities(data []byte, maxRows int, cursor pageCursor) ([]byte, error) {
+	var file struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	err := json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, err
+	}
+
+	// pull out the id of each identity so they can be ordered without decoding the whole record
+	type identity struct {
+		ID   string
+		Item json.RawMessage
+	}
+	identities := []identity{}
+	for _, item := range file.Items {
+		var key struct {
+			ID string `json:"id"`
+		}
+		err = json.Unmarshal(item, &key)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity{ID: key.ID, Item: item})
+	}
+	sort.Slice(identities, func(i, j int) bool { return identities[i].ID < identities[j].ID })
+
+	page := []json.RawMessage{}
+	lastID := ""
+	nextCursor := ""
+	for _, identity := range identities {
+		if identity.ID <= cursor.ID {
+			continue
+		}
+		if len(page) >= maxRows {
+			nextCursor = encodeCursor(pageCursor{ID: lastID})
+			break
+		}
+		page = append(page, identity.Item)
+		lastID = identity.ID
+	}
+
+	return json.Marshal(map[string]interface{}{"items": page, "truncated": len(nextCursor) > 0, "next_cursor": nextCursor})
 }
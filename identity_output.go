@@ -0,0 +1,188 @@
+//  Identity Output Fields
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// identityField is a field of the records in the identities document and the employee attribute it is taken from
+type identityField struct {
+	name   string
+	source string
+}
+
+// the key of the IdentityOutputFields entry that applies to every employee rather than those of one app
+const allIdentityApps = "*"
+
+// the record written for each employee unless IdentityOutputFields changes it
+var defaultIdentityFields = []identityField{{"id", "employee_email_address"}, {"sn", "surname"}, {"manager", "manager_dn"},
+	{"mail", "employee_email_address"}, {"givenname", "given_name"}, {"displayname", "employee_full_name"},
+	{"mgr_chain", "mgr_chain"}, {"lob", "lob_tag"}, {"lob_parent", "lob_tag_root"}, {"num_directs", "num_directs"},
+	{"app_map", "app_map"}}
+
+// sources worked out from the feed rather than copied from one of its attributes
+var derivedIdentitySources = map[string]func(person Employee, appMap string) string{
+	"surname": func(person Employee, appMap string) string {
+		_, surname := splitFullName(person.EmployeeFullName)
+		return surname
+	},
+	"given_name": func(person Employee, appMap string) string {
+		givenName, _ := splitFullName(person.EmployeeFullName)
+		return givenName
+	},
+	"manager_dn": func(person Employee, appMap string) string { return convertEmailToDN(person.Mgr) },
+	"app_map":    func(person Employee, appMap string) string { return appMap },
+}
+
+// sources written as JSON numbers (null if the feed value isn't one)
+var numericIdentitySources = map[string]bool{"num_directs": true, "num_users": true}
+var identityNumberPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// field names are written as is so they have to be plain JSON keys
+var identityFieldNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// the changes IdentityOutputFields makes to the record, by app (allIdentityApps for everyone), set up by
+// initIdentityOutputFields
+var identityFieldChanges = map[string][]identityField{}
+
+// the Employee field holding each attribute of the identity feed, by its name in the feed
+var employeeAttributes = employeeAttributeFields()
+
+func employeeAttributeFields() map[string]int {
+	fields := make(map[string]int)
+	employeeType := reflect.TypeOf(Employee{})
+	for i := 0; i < employeeType.NumField(); i++ {
+		fields[strings.Split(employeeType.Field(i).Tag.Get("json"), ",")[0]] = i
+	}
+	return fields
+}
+
+//
+// Parses IdentityOutputFields, in the form "APP:field=source|field=source,APP:field=source".  The fields of a "*"
+// entry apply to every employee and those of an app (e.g. STS) to the employees whose app_map includes it, after the
+// "*" ones.  Each field=source replaces the source of a field already in the record or adds the field to the end;
+// field= removes it.  A source is any attribute of the identity feed (e.g. cost_center or country) or surname,
+// given_name, manager_dn or app_map.
+//
+func initIdentityOutputFields() error {
+	changes := map[string][]identityField{}
+	for _, entry := range strings.Split(GlobalConfig.IdentityOutputFields, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) < 1 {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		app := strings.TrimSpace(parts[0])
+		if len(parts) < 2 || len(app) < 1 {
+			thisError := fmt.Sprintf("IdentityOutputFields entry %s must be APP:field=source|field=source", entry)
+			return errors.New(thisError)
+		}
+		for _, mapping := range strings.Split(parts[1], "|") {
+			pair := strings.SplitN(mapping, "=", 2)
+			field := identityField{name: strings.TrimSpace(pair[0])}
+			if len(pair) == 2 {
+				field.source = strings.ToLower(strings.TrimSpace(pair[1]))
+			}
+			if len(pair) < 2 || !identityFieldNamePattern.MatchString(field.name) {
+				thisError := fmt.Sprintf("IdentityOutputFields mapping %s of %s must be field=source", mapping, app)
+				return errors.New(thisError)
+			}
+			_, attribute := employeeAttributes[field.source]
+			_, derived := derivedIdentitySources[field.source]
+			if len(field.source) > 0 && !attribute && !derived {
+				thisError := fmt.Sprintf("IdentityOutputFields field %s of %s has unknown source %s", field.name, app, field.source)
+				return errors.New(thisError)
+			}
+			changes[app] = append(changes[app], field)
+		}
+	}
+	identityFieldChanges = changes
+	return nil
+}
+
+//
+// Applies changes to a list of record fields, returning a new list
+//
+func applyIdentityFieldChanges(fields []identityField, changes []identityField) []identityField {
+	result := append([]identityField{}, fields...)
+	for _, change := range changes {
+		found := -1
+		for i, field := range result {
+			if field.name == change.name {
+				found = i
+			}
+		}
+		switch {
+		case found >= 0 && len(change.source) < 1:
+			result = append(result[:found], result[found+1:]...)
+		case found >= 0:
+			result[found] = change
+		case len(change.source) > 0:
+			result = append(result, change)
+		}
+	}
+	return result
+}
+
+// identityRecordWriter writes the records of one identity load, remembering the fields of each app mapping
+type identityRecordWriter struct {
+	fields map[string][]identityField
+}
+
+func newIdentityRecordWriter() *identityRecordWriter {
+	return &identityRecordWriter{fields: make(map[string][]identityField)}
+}
+
+//
+// Returns an employee's record in the identities document as a JSON object
+//
+func (writer *identityRecordWriter) record(person Employee, appMap string) string {
+	fields, found := writer.fields[appMap]
+	if !found {
+		fields = applyIdentityFieldChanges(defaultIdentityFields, identityFieldChanges[allIdentityApps])
+		for _, app := range strings.Split(appMap, "_") {
+			if app != allIdentityApps {
+				fields = applyIdentityFieldChanges(fields, identityFieldChanges[app])
+			}
+		}
+		writer.fields[appMap] = fields
+	}
+
+	var record strings.Builder
+	record.WriteString("{")
+	for i, field := range fields {
+		if i > 0 {
+			record.WriteString(",")
+		}
+		name, _ := json.Marshal(field.name)
+		record.Write(name)
+		record.WriteString(":")
+
+		value := ""
+		if derive, derived := derivedIdentitySources[field.source]; derived {
+			value = derive(person, appMap)
+		} else {
+			value = reflect.ValueOf(person).Field(employeeAttributes[field.source]).String()
+		}
+		if numericIdentitySources[field.source] {
+			if identityNumberPattern.MatchString(strings.TrimSpace(value)) {
+				record.WriteString(strings.TrimSpace(value))
+			} else {
+				record.WriteString("null")
+			}
+			continue
+		}
+		encoded, _ := json.Marshal(value)
+		record.Write(encoded)
+	}
+	record.WriteString("}")
+	return record.String()
+}
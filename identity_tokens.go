@@ -0,0 +1,211 @@
+//  Identity Download Tokens
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how long a download token is good for unless the caller asks for less (or more, up to the maximum)
+const defaultIdentityTokenTTL = 15 * time.Minute
+const maxIdentityTokenTTL = 24 * time.Hour
+
+// identityToken is what a download token grants: the identities document until Expires, or only the identities of
+// one app (in their app_map) and/or LOB
+type identityToken struct {
+	Expires int64  `json:"exp"`
+	App     string `json:"app,omitempty"`
+	Lob     string `json:"lob,omitempty"`
+}
+
+// errIdentityTokensUnavailable is returned when there is no secret to sign tokens with
+var errIdentityTokensUnavailable = errors.New("identity tokens are not configured")
+
+// errIdentityTokenInvalid is returned for a token that wasn't signed by this service, was altered or has expired
+var errIdentityTokenInvalid = errors.New("identity token is invalid or expired")
+
+//
+// HTTP handler that mints a download token for the identities document so a job that only needs that file (e.g.
+// the IdP sync) doesn't have to hold the service credentials.  expiresMinutes sets how long it lasts (default 15, at
+// most a day) and app and lob limit it to the identities whose app_map includes app and whose lob is lob.  Returns
+// the token, when it expires and the path to download with it.
+//
+func identityTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+	query := r.URL.Query()
+	ttl := defaultIdentityTokenTTL
+	if len(query.Get("expiresMinutes")) > 0 {
+		minutes, err := strconv.Atoi(query.Get("expiresMinutes"))
+		if err != nil || minutes < 1 || time.Duration(minutes)*time.Minute > maxIdentityTokenTTL {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "expiresMinutes must be between 1 and %d", int(maxIdentityTokenTTL.Minutes()))
+			return
+		}
+		ttl = time.Duration(minutes) * time.Minute
+	}
+
+	expires := time.Now().Add(ttl)
+	grant := identityToken{Expires: expires.Unix(), App: strings.TrimSpace(query.Get("app")),
+		Lob: strings.TrimSpace(query.Get("lob"))}
+	token, err := signIdentityToken(grant)
+	if err == errIdentityTokensUnavailable {
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "Identity tokens are not configured")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "identity_tokens", err.Error())
+		return
+	}
+	username, _, _ := r.BasicAuth()
+	logRequest(r, logInfo, "identity_tokens", fmt.Sprintf("Issued identities token to %s until %s (app=%s, lob=%s)", username,
+		expires.Format(time.RFC3339), grant.App, grant.Lob))
+
+	json, _ := json.Marshal(map[string]string{"token": token, "expires": expires.In(outputLocation).Format(time.RFC3339),
+		"url": "/identities/download?token=" + token})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+//
+// HTTP handler that serves the identities document to the holder of a download token rather than to basic auth.  A
+// token limited to an app or LOB gets {"items": [...]} with just those identities; otherwise the request is handled
+// as getIdentities (so maxRows, cursor and conditional GETs work as there).
+//
+func identityDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+	grant, err := verifyIdentityToken(r.URL.Query().Get("token"))
+	if err == errIdentityTokensUnavailable {
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "Identity tokens are not configured")
+		return
+	}
+	if err != nil {
+		http.Error(w, "Authorization failed", http.StatusUnauthorized)
+		return
+	}
+	if len(grant.App) < 1 && len(grant.Lob) < 1 {
+		getIdentitiesQueryHandler(w, r)
+		return
+	}
+
+	data, err := ioutil.ReadFile(GlobalConfig.IdentityFilename)
+	if err == nil {
+		data, err = filterIdentities(data, grant)
+	}
+	if err != nil {
+		logRequest(r, logError, "identity_tokens", outputHTTPError("identityDownloadHandler", err, nil))
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+//
+// Returns the identities of the document the token is limited to, matching app against the app_map and lob against
+// the lob of each record
+//
+func filterIdentities(data []byte, grant identityToken) ([]byte, error) {
+	var file struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	err := json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []json.RawMessage{}
+	for _, item := range file.Items {
+		var record struct {
+			AppMap string `json:"app_map"`
+			Lob    string `json:"lob"`
+		}
+		if json.Unmarshal(item, &record) != nil {
+			continue
+		}
+		if len(grant.App) > 0 && !containsToken(strings.Split(record.AppMap, "_"), grant.App) {
+			continue
+		}
+		if len(grant.Lob) > 0 && !strings.EqualFold(record.Lob, grant.Lob) {
+			continue
+		}
+		items = append(items, item)
+	}
+	return json.Marshal(map[string]interface{}{"items": items})
+}
+
+func containsToken(tokens []string, token string) bool {
+	for _, candidate := range tokens {
+		if strings.EqualFold(candidate, token) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Returns the grant encoded and signed with IdentityTokenSecret (HMAC-SHA256) as {payload}.{signature}
+//
+func signIdentityToken(grant identityToken) (string, error) {
+	if len(GlobalConfig.IdentityTokenSecret) < 1 {
+		return "", errIdentityTokensUnavailable
+	}
+	payload, err := json.Marshal(grant)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(identityTokenSignature(encoded)), nil
+}
+
+//
+// Returns the grant of a token if it was signed with IdentityTokenSecret and hasn't expired
+//
+func verifyIdentityToken(token string) (identityToken, error) {
+	var grant identityToken
+	if len(GlobalConfig.IdentityTokenSecret) < 1 {
+		return grant, errIdentityTokensUnavailable
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return grant, errIdentityTokenInvalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, identityTokenSignature(parts[0])) {
+		return grant, errIdentityTokenInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(payload, &grant) != nil || time.Now().Unix() >= grant.Expires {
+		return grant, errIdentityTokenInvalid
+	}
+	return grant, nil
+}
+
+func identityTokenSignature(payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(GlobalConfig.IdentityTokenSecret))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
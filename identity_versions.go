@@ -0,0 +1,241 @@
+//  Identity Document Versions
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// versions are kept as identities/{version}.json in IdentityVersionBucket, the version being the UTC time the
+// document was written
+const identityVersionPrefix = "identities/"
+const identityVersionFormat = "20060102T150405Z"
+
+// how many versions are kept when IdentityVersionsKept isn't set
+const defaultIdentityVersionsKept = 30
+
+// how long saving, listing or reading versions may take
+const identityVersionTimeout = 5 * time.Minute
+
+var identityVersionPattern = regexp.MustCompile(`^\d{8}T\d{6}Z$`)
+
+// IdentityVersion is one stored generation of the identities document
+type IdentityVersion struct {
+	Version string `json:"version"`
+	Created string `json:"created"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// errIdentityVersionsUnavailable is returned when there is nowhere to keep versions
+var errIdentityVersionsUnavailable = errors.New("identity versions are not configured")
+
+// errIdentityVersionNotFound is returned when the requested version isn't kept
+var errIdentityVersionNotFound = errors.New("identity version not found")
+
+//
+// Stores a copy of an identities document just written to IdentityFilename and removes the oldest copies beyond
+// IdentityVersionsKept.  Does nothing when IdentityVersionBucket isn't set.  Failures are only logged since the
+// document itself has been written.
+//
+func saveIdentityVersion(document []byte) {
+	if len(GlobalConfig.IdentityVersionBucket) < 1 {
+		return
+	}
+	kept := defaultIdentityVersionsKept
+	if len(GlobalConfig.IdentityVersionsKept) > 0 {
+		value, err := strconv.Atoi(GlobalConfig.IdentityVersionsKept)
+		if err != nil || value < 1 {
+			logOutput(logError, "identity_versions", "IdentityVersionsKept is invalid: "+GlobalConfig.IdentityVersionsKept)
+			return
+		}
+		kept = value
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), identityVersionTimeout)
+	defer cancel()
+	version := time.Now().UTC().Format(identityVersionFormat)
+	err := putObject(ctx, identityVersionObject(version), "application/json", document)
+	if err != nil {
+		logOutput(logError, "identity_versions", fmt.Sprintf("Unable to save identities version %s: %s", version, err.Error()))
+		return
+	}
+
+	// versions sort oldest first by name
+	versions, err := listIdentityVersions(ctx)
+	if err != nil {
+		logOutput(logWarn, "identity_versions", "Unable to list identities versions for pruning: "+err.Error())
+		return
+	}
+	for i := len(versions) - 1; i >= kept; i-- {
+		err = deleteObject(ctx, identityVersionObject(versions[i].Version))
+		if err != nil {
+			logOutput(logWarn, "identity_versions", fmt.Sprintf("Unable to remove identities version %s: %s", versions[i].Version, err.Error()))
+		}
+	}
+	logOutput(logInfo, "identity_versions", fmt.Sprintf("Saved identities version %s (%d bytes)", version, len(document)))
+}
+
+func identityVersionObject(version string) objectLocation {
+	return objectLocation{Namespace: GlobalConfig.ArtifactNamespace, Bucket: GlobalConfig.IdentityVersionBucket,
+		Object: identityVersionPrefix + version + ".json"}
+}
+
+//
+// Returns the stored versions, newest first
+//
+func listIdentityVersions(ctx context.Context) ([]IdentityVersion, error) {
+	if len(GlobalConfig.IdentityVersionBucket) < 1 {
+		return nil, errIdentityVersionsUnavailable
+	}
+	objects, err := listObjects(ctx, GlobalConfig.ArtifactNamespace, GlobalConfig.IdentityVersionBucket, identityVersionPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []IdentityVersion{}
+	for _, object := range objects {
+		if object.Name == nil {
+			continue
+		}
+		version := strings.TrimSuffix(strings.TrimPrefix(*object.Name, identityVersionPrefix), ".json")
+		if !identityVersionPattern.MatchString(version) {
+			continue
+		}
+		item := IdentityVersion{Version: version}
+		if created, err := time.Parse(identityVersionFormat, version); err == nil {
+			item.Created = created.Format(time.RFC3339)
+		}
+		if object.Size != nil {
+			item.Bytes = *object.Size
+		}
+		versions = append(versions, item)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version > versions[j].Version })
+	return versions, nil
+}
+
+//
+// HTTP handler for identity versions.  GET /identities/versions lists the kept versions of the identities
+// document, newest first; GET /identities/versions/{version} returns that version, or with id={{email}} just the
+// identities in it with that id.
+//
+func identityVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+	version := strings.Trim(strings.TrimPrefix(r.URL.Path, "/identities/versions"), "/")
+	ctx, cancel := context.WithTimeout(r.Context(), identityVersionTimeout)
+	defer cancel()
+
+	var err error
+	if len(version) < 1 {
+		var versions []IdentityVersion
+		versions, err = listIdentityVersions(ctx)
+		if err == nil {
+			json, _ := json.Marshal(map[string]interface{}{"items": versions})
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(json)
+			return
+		}
+	} else {
+		err = writeIdentityVersion(ctx, w, version, strings.ToLower(strings.TrimSpace(r.URL.Query().Get("id"))))
+	}
+
+	if err == errIdentityVersionNotFound {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Identity version not found")
+		return
+	}
+	if err == errIdentityVersionsUnavailable {
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "Identity versions are not configured")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "identity_versions", err.Error())
+	}
+}
+
+//
+// Writes a stored version of the identities document to the response, or only the identities with the given id
+//
+func writeIdentityVersion(ctx context.Context, w http.ResponseWriter, version string, id string) error {
+	if len(GlobalConfig.IdentityVersionBucket) < 1 {
+		return errIdentityVersionsUnavailable
+	}
+	if !identityVersionPattern.MatchString(version) {
+		return errIdentityVersionNotFound
+	}
+	versions, err := listIdentityVersions(ctx)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, kept := range versions {
+		found = found || kept.Version == version
+	}
+	if !found {
+		return errIdentityVersionNotFound
+	}
+
+	content, _, err := getObject(ctx, identityVersionObject(version))
+	if err != nil {
+		thisError := fmt.Sprintf("Error reading identities version %s: %s", version, err.Error())
+		return errors.New(thisError)
+	}
+	defer content.Close()
+
+	if len(id) < 1 {
+		w.Header().Set("Content-Type", "application/json")
+		_, err = io.Copy(w, content)
+		if err != nil {
+			logOutput(logWarn, "identity_versions", "Client went away while streaming identities version: "+err.Error())
+		}
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		thisError := fmt.Sprintf("Error reading identities version %s: %s", version, err.Error())
+		return errors.New(thisError)
+	}
+	var document struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	err = json.Unmarshal(data, &document)
+	if err != nil {
+		thisError := fmt.Sprintf("Error parsing identities version %s: %s", version, err.Error())
+		return errors.New(thisError)
+	}
+	matches := []json.RawMessage{}
+	for _, item := range document.Items {
+		var key struct {
+			ID string `json:"id"`
+		}
+		if json.Unmarshal(item, &key) == nil && strings.ToLower(key.ID) == id {
+			matches = append(matches, item)
+		}
+	}
+
+	json, _ := json.Marshal(map[string]interface{}{"version": version, "items": matches})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+	return nil
+}
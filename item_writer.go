@@ -0,0 +1,196 @@
+//  Streaming Item Writer
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how often a streamed response is flushed to the client while rows are still being read
+const itemFlushInterval = time.Second
+
+// itemWriter streams the items of a {"items": [...]} response as each row is read instead of building the whole
+// body in memory first.  Nothing (not even the prefix) is written until the first item so a handler can still
+// return a proper error status if the query fails before any rows come back.  With ndjson set the items are written
+// one per line with no envelope instead, and whether the result was truncated goes out as trailers.
+type itemWriter struct {
+	out       io.Writer
+	prefix    string
+	ndjson    bool
+	count     int
+	started   bool
+	lastFlush time.Time
+	captured  *strings.Builder
+}
+
+//
+// Creates an itemWriter that writes prefix (e.g. {"items": [) ahead of the first item
+//
+func newItemWriter(out io.Writer, prefix string) *itemWriter {
+	return &itemWriter{out: out, prefix: prefix}
+}
+
+//
+// Creates an itemWriter for format=ndjson, which writes each item on a line of its own (application/x-ndjson) so a
+// client can process an export of tens of thousands of rows as it arrives
+//
+func newNDJSONWriter(out io.Writer) *itemWriter {
+	return &itemWriter{out: out, ndjson: true}
+}
+
+//
+// Returns true if the caller asked for format=ndjson rather than the default {"items": [...]} JSON
+//
+func ndjsonRequested(query url.Values) (bool, error) {
+	switch query.Get("format") {
+	case "", "json":
+		return false, nil
+	case "ndjson":
+		return true, nil
+	}
+	return false, inputError("format must be json or ndjson")
+}
+
+//
+// Writes one item, separated from the previous one by a comma.  The response is flushed after the first item and
+// then at most once every itemFlushInterval so clients (and proxies) see data flowing.
+//
+func (iw *itemWriter) writeItem(item string) error {
+	err := iw.start()
+	if err != nil {
+		return err
+	}
+	if iw.ndjson {
+		item += "\n"
+	} else if iw.count > 0 {
+		item = "," + item
+	}
+	_, err = io.WriteString(iw.out, item)
+	if err != nil {
+		return err
+	}
+	if iw.captured != nil {
+		iw.captured.WriteString(item)
+	}
+	iw.count++
+	if counter, ok := iw.out.(rowCounter); ok {
+		counter.addRows(1)
+	}
+
+	if iw.count == 1 || time.Since(iw.lastFlush) >= itemFlushInterval {
+		iw.flush()
+	}
+	return nil
+}
+
+//
+// Writes one item marshalled to JSON
+//
+func (iw *itemWriter) writeJSON(item interface{}) error {
+	encoded, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return iw.writeItem(string(encoded))
+}
+
+//
+// Records whether more rows were available and the cursor for them as the X-Truncated and X-Next-Cursor trailers of
+// an ndjson response.  A JSON response carries them in its suffix instead so this does nothing.
+//
+func (iw *itemWriter) setPaging(truncated bool, nextCursor string) {
+	if !iw.ndjson {
+		return
+	}
+	iw.start()
+	if w, ok := iw.out.(http.ResponseWriter); ok {
+		w.Header().Set("X-Truncated", strconv.FormatBool(truncated))
+		if len(nextCursor) > 0 {
+			w.Header().Set("X-Next-Cursor", nextCursor)
+		}
+	}
+}
+
+//
+// Completes the response with suffix (e.g. ]}), writing the prefix first if there were no items.  An ndjson
+// response has no envelope so the suffix is dropped.
+//
+func (iw *itemWriter) finish(suffix string) error {
+	err := iw.start()
+	if err != nil {
+		return err
+	}
+	if iw.ndjson {
+		iw.flush()
+		return nil
+	}
+	_, err = io.WriteString(iw.out, suffix)
+	iw.flush()
+	return err
+}
+
+//
+// Keeps a copy of the items written from now on (comma separated, without the prefix and suffix) so the response
+// can be cached while it is streamed
+//
+func (iw *itemWriter) capture() {
+	iw.captured = &strings.Builder{}
+}
+
+//
+// Returns the items kept since capture was called
+//
+func (iw *itemWriter) capturedItems() string {
+	if iw.captured == nil {
+		return ""
+	}
+	return iw.captured.String()
+}
+
+//
+// Returns true once anything has been written, after which an error can no longer be reported with a status code
+//
+func (iw *itemWriter) written() bool {
+	return iw.started
+}
+
+func (iw *itemWriter) start() error {
+	if iw.started {
+		return nil
+	}
+	iw.started = true
+	if w, ok := iw.out.(http.ResponseWriter); ok {
+		if iw.ndjson {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Trailer", "X-Truncated, X-Next-Cursor")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+	}
+	_, err := io.WriteString(iw.out, iw.prefix)
+	return err
+}
+
+func (iw *itemWriter) flush() {
+	iw.lastFlush = time.Now()
+	if flusher, ok := iw.out.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//
+// Reports a query that failed after its response had started streaming.  The status code has already gone out so
+// the connection is aborted instead, which stops the client from mistaking the partial body for a complete one.
+//
+func abortStreamedResponse(module string, err error) {
+	logOutput(logError, module, "Aborting streamed response: "+err.Error())
+	panic(http.ErrAbortHandler)
+}
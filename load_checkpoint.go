@@ -0,0 +1,60 @@
+//  Load Checkpoints
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"database/sql"
+)
+
+// loadCheckpoint is how far a load has got through its file.  Records up to and including processed (counted from
+// 1, the last of them having the key lastKey) have been committed to the load's staging table.  It only applies to
+// the file with the same checksum.
+type loadCheckpoint struct {
+	dataType  string
+	schema    string
+	checksum  string
+	processed int
+	lastKey   string
+}
+
+//
+// Returns the checkpoint left by an earlier, unfinished load of the same file.  The bool is false if there isn't
+// one, in which case the returned checkpoint is a fresh one for the file.
+//
+func readLoadCheckpoint(dataType string, schema string, checksum string) (loadCheckpoint, bool, error) {
+	checkpoint := loadCheckpoint{dataType: dataType, schema: schema, checksum: checksum}
+	err := DBPool.QueryRow("SELECT records_processed, last_key FROM CTO_COMMON.LOAD_CHECKPOINT "+
+		"WHERE data_type = :1 AND schema_name = :2 AND source_checksum = :3", dataType, schema, checksum).
+		Scan(&checkpoint.processed, &checkpoint.lastKey)
+	if err == sql.ErrNoRows {
+		return checkpoint, false, nil
+	}
+	if err != nil {
+		return checkpoint, false, err
+	}
+	return checkpoint, checkpoint.processed > 0, nil
+}
+
+//
+// Records the checkpoint.  Pass the transaction committing the records it covers so the two can't disagree.
+//
+func saveLoadCheckpoint(tx *sql.Tx, checkpoint loadCheckpoint) error {
+	_, err := tx.Exec(`MERGE INTO CTO_COMMON.LOAD_CHECKPOINT c
+		USING (SELECT :1 AS data_type, :2 AS schema_name FROM DUAL) s
+		ON (c.data_type = s.data_type AND c.schema_name = s.schema_name)
+		WHEN MATCHED THEN UPDATE SET c.source_checksum = :3, c.records_processed = :4, c.last_key = :5, c.updated = SYSTIMESTAMP
+		WHEN NOT MATCHED THEN INSERT (data_type, schema_name, source_checksum, records_processed, last_key, updated)
+			VALUES (s.data_type, s.schema_name, :3, :4, :5, SYSTIMESTAMP)`,
+		checkpoint.dataType, checkpoint.schema, checkpoint.checksum, checkpoint.processed, checkpoint.lastKey)
+	return err
+}
+
+//
+// Removes the checkpoint of a data type, either because its load has finished or because it can't be resumed
+//
+func clearLoadCheckpoint(db QueryRunner, dataType string, schema string) error {
+	_, err := db.Exec("DELETE FROM CTO_COMMON.LOAD_CHECKPOINT WHERE data_type = :1 AND schema_name = :2", dataType, schema)
+	return err
+}
@@ -0,0 +1,393 @@
+//  Load Jobs
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// load job states; queued, running and failed are shared with the export and query jobs
+const jobSucceeded = "succeeded"
+
+// how long load jobs are kept in CTO_COMMON.LOAD_JOB
+const loadJobRetentionDays = 30
+
+// how often a running load job records its progress when JobProgressSeconds isn't set
+const defaultJobProgressInterval = 15 * time.Second
+
+// LoadJob is a background load (a postReferenceData or postReferenceBatch load, a feed pull or the post-load hooks)
+// as recorded in CTO_COMMON.LOAD_JOB and returned by /jobs.  The counts add up the feeds the load processed.
+type LoadJob struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Status     string `json:"status"`
+	Instance   string `json:"instance"`
+	Submitted  string `json:"submitted"`
+	Started    string `json:"started,omitempty"`
+	Finished   string `json:"finished,omitempty"`
+	RowsRead   int    `json:"rows_read"`
+	RowsLoaded int    `json:"rows_loaded"`
+	Inserted   int    `json:"inserted"`
+	Updated    int    `json:"updated"`
+	Rejected   int    `json:"rejected"`
+	Error      string `json:"error,omitempty"`
+
+	// how far the job has got through the feed it is loading (or was loading when it failed)
+	Progress *LoadJobProgress `json:"progress,omitempty"`
+}
+
+// LoadJobProgress is how many records of a feed a load job has processed so far and what became of them.  Skipped
+// records were rejected or left alone (e.g. outside a scoped reload).
+type LoadJobProgress struct {
+	DataType  string `json:"data_type"`
+	Schema    string `json:"schema"`
+	Processed int    `json:"processed"`
+	Inserted  int    `json:"inserted"`
+	Updated   int    `json:"updated"`
+	Skipped   int    `json:"skipped"`
+	AsOf      string `json:"as_of"`
+}
+
+// loadJob is a load job while it runs.  Only the load's own goroutine changes it, so it needs no lock.
+type loadJob struct {
+	LoadJob
+	submitted time.Time
+	started   time.Time
+	progress  time.Time
+}
+
+// the host name load jobs are recorded under, so a restarted instance can tell which unfinished jobs were its own
+var loadJobInstance = loadJobHost()
+
+func loadJobHost() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+//
+// Returns a new queued job of jobType (e.g. identity or pull:opportunity) and records it
+//
+func newLoadJob(jobType string) *loadJob {
+	id := make([]byte, 16)
+	rand.Read(id)
+	job := &loadJob{LoadJob: LoadJob{ID: hex.EncodeToString(id), Type: jobType, Status: jobQueued, Instance: loadJobInstance},
+		submitted: time.Now()}
+	job.save()
+
+	_, err := DBPool.Exec("DELETE FROM CTO_COMMON.LOAD_JOB WHERE submitted < SYSTIMESTAMP - NUMTODSINTERVAL(:1, 'DAY')",
+		loadJobRetentionDays)
+	if err != nil {
+		logOutput(logWarn, "load_job", "Unable to purge old load jobs: "+err.Error())
+	}
+	return job
+}
+
+//
+// Marks the job as running
+//
+func (job *loadJob) start() {
+	if job == nil {
+		return
+	}
+	job.Status = jobRunning
+	job.started = time.Now()
+	job.save()
+}
+
+//
+// Adds the counts of a feed the job loaded
+//
+func (job *loadJob) addRun(run *syncRun, rowsRead int, rowsLoaded int) {
+	if job == nil {
+		return
+	}
+	job.RowsRead += rowsRead
+	job.RowsLoaded += rowsLoaded
+	job.Inserted += run.inserted
+	job.Updated += run.updated
+	job.Rejected += run.rejected
+	job.Progress = nil
+	job.save()
+}
+
+//
+// Returns how often a running load job records its progress, or 0 if JobProgressSeconds is "0"
+//
+func jobProgressInterval() time.Duration {
+	seconds, err := strconv.Atoi(GlobalConfig.JobProgressSeconds)
+	if err != nil || seconds < 0 {
+		return defaultJobProgressInterval
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+//
+// Records the counts so far of the feed run is loading if it has been at least JobProgressSeconds since they last
+// were.  Called for every record a processor reads, so between those times it does nothing else.
+//
+func (job *loadJob) reportProgress(run *syncRun) {
+	if job == nil {
+		return
+	}
+	interval := jobProgressInterval()
+	if interval == 0 || time.Since(job.progress) < interval {
+		return
+	}
+	job.setProgress(run)
+	job.save()
+}
+
+//
+// Notes the counts so far of the feed run is loading, to be recorded with the job's next save
+//
+func (job *loadJob) setProgress(run *syncRun) {
+	if job == nil {
+		return
+	}
+	job.progress = time.Now()
+	job.Progress = &LoadJobProgress{DataType: run.dataType, Schema: run.schema, Processed: run.processed,
+		Inserted: run.inserted, Updated: run.updated, Skipped: run.processed - run.inserted - run.updated,
+		AsOf: job.progress.In(outputLocation).Format(time.RFC3339)}
+}
+
+//
+// Records why the job failed.  The first failure is kept since later ones usually follow from it.
+//
+func (job *loadJob) fail(message string) {
+	if job == nil {
+		return
+	}
+	if job.Status != jobFailed {
+		job.Error = message
+	}
+	job.Status = jobFailed
+}
+
+//
+// Marks the job as finished, successfully unless a failure was recorded, and records its final state
+//
+func (job *loadJob) finish() {
+	if job == nil {
+		return
+	}
+	if job.Status != jobFailed {
+		job.Status = jobSucceeded
+	}
+	job.save()
+	logOutput(logInfo, "load_job", fmt.Sprintf("Job %s (%s) %s in %s", job.ID, job.Type, job.Status,
+		time.Since(job.started).Round(time.Millisecond)))
+}
+
+//
+// Writes the job's state to LOAD_JOB.  The load goes ahead if it can't be recorded, as it did before jobs were.
+//
+func (job *loadJob) save() {
+	var started, finished sql.NullTime
+	if !job.started.IsZero() {
+		started = sql.NullTime{Time: job.started, Valid: true}
+	}
+	if job.Status == jobSucceeded || job.Status == jobFailed {
+		finished = sql.NullTime{Time: time.Now(), Valid: true}
+	}
+	var progress LoadJobProgress
+	var progressAt sql.NullTime
+	if job.Progress != nil {
+		progress = *job.Progress
+		progressAt = sql.NullTime{Time: job.progress, Valid: true}
+	}
+
+	_, err := DBPool.Exec(`MERGE INTO CTO_COMMON.LOAD_JOB j
+		USING (SELECT :1 AS job_id FROM DUAL) s
+		ON (j.job_id = s.job_id)
+		WHEN MATCHED THEN UPDATE SET j.status = :2, j.started = :3, j.finished = :4, j.rows_read = :5, j.rows_loaded = :6,
+			j.rows_inserted = :7, j.rows_updated = :8, j.rows_rejected = :9, j.error_message = SUBSTR(:10, 1, 4000),
+			j.progress_data_type = :14, j.progress_schema = :15, j.progress_processed = :16, j.progress_inserted = :17,
+			j.progress_updated = :18, j.progress_skipped = :19, j.progress_at = :20
+		WHEN NOT MATCHED THEN INSERT (job_id, job_type, status, instance, submitted, started, finished, rows_read, rows_loaded,
+				rows_inserted, rows_updated, rows_rejected, error_message)
+			VALUES (s.job_id, :11, :2, :12, :13, :3, :4, :5, :6, :7, :8, :9, SUBSTR(:10, 1, 4000))`,
+		job.ID, job.Status, started, finished, job.RowsRead, job.RowsLoaded, job.Inserted, job.Updated, job.Rejected,
+		job.Error, job.Type, job.Instance, job.submitted, progress.DataType, progress.Schema, progress.Processed,
+		progress.Inserted, progress.Updated, progress.Skipped, progressAt)
+	if err != nil {
+		logOutput(logWarn, "load_job", fmt.Sprintf("Unable to record job %s in LOAD_JOB: %s", job.ID, err.Error()))
+	}
+}
+
+//
+// Marks the jobs this instance left queued or running when it last stopped as failed, since nothing will finish
+// them.  Called at startup.
+//
+func failInterruptedLoadJobs() {
+	result, err := DBPool.Exec(`UPDATE CTO_COMMON.LOAD_JOB SET status = :1, finished = SYSTIMESTAMP,
+			error_message = 'Interrupted by a restart of the instance'
+		WHERE instance = :2 AND status IN (:3, :4)`, jobFailed, loadJobInstance, jobQueued, jobRunning)
+	if err != nil {
+		logOutput(logWarn, "load_job", "Unable to close interrupted load jobs: "+err.Error())
+		return
+	}
+	if count, err := result.RowsAffected(); err == nil && count > 0 {
+		logOutput(logWarn, "load_job", fmt.Sprintf("Marked %d load jobs interrupted by the last restart as failed", count))
+	}
+}
+
+//
+// HTTP handler for the jobs functionality.  GET /jobs/{id} returns a load job; GET /jobs returns the most recent
+// ones first, optionally only those of one type (e.g. type=identity), for the history of a feed.
+//
+func loadJobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+
+	var result []byte
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	if len(id) > 0 {
+		job, err := getLoadJob(r.Context(), id)
+		if queryCancelled(r.Context(), "load_job", err) {
+			return
+		}
+		if err == errJobNotFound {
+			w.WriteHeader(404)
+			fmt.Fprintf(w, "Job not found")
+			return
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+			logRequest(r, logError, "load_job", err.Error())
+			return
+		}
+		result, _ = json.Marshal(job)
+	} else {
+		query := r.URL.Query()
+		maxRows, err := getMaxRows(query.Get("maxRows"))
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", err.Error())
+			return
+		}
+		items, truncated, err := getLoadJobs(r.Context(), query.Get("type"), maxRows)
+		if queryCancelled(r.Context(), "load_job", err) {
+			return
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+			logRequest(r, logError, "load_job", err.Error())
+			return
+		}
+		result, _ = json.Marshal(map[string]interface{}{"items": items, "truncated": truncated})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+// the columns of a LoadJob, in the order scanLoadJob reads them
+const loadJobColumns = `job_id, job_type, status, instance, submitted, started, finished, NVL(rows_read, 0), NVL(rows_loaded, 0),
+	NVL(rows_inserted, 0), NVL(rows_updated, 0), NVL(rows_rejected, 0), error_message, progress_data_type, progress_schema,
+	NVL(progress_processed, 0), NVL(progress_inserted, 0), NVL(progress_updated, 0), NVL(progress_skipped, 0), progress_at`
+
+//
+// Returns the load job with the given id
+//
+func getLoadJob(ctx context.Context, id string) (LoadJob, error) {
+	rows, err := DBPool.QueryContext(ctx, "SELECT "+loadJobColumns+" FROM CTO_COMMON.LOAD_JOB WHERE job_id = :1", id)
+	if err != nil {
+		thisError := fmt.Sprintf("Error querying load job (%s): %s", id, err.Error())
+		return LoadJob{}, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			thisError := fmt.Sprintf("Error querying load job (%s): %s", id, err.Error())
+			return LoadJob{}, errors.New(thisError)
+		}
+		return LoadJob{}, errJobNotFound
+	}
+	return scanLoadJob(rows)
+}
+
+//
+// Returns the most recent load jobs, optionally only those of jobType, at most maxRows of them
+//
+func getLoadJobs(ctx context.Context, jobType string, maxRows int) ([]LoadJob, bool, error) {
+	rows, err := DBPool.QueryContext(ctx, "SELECT "+loadJobColumns+` FROM CTO_COMMON.LOAD_JOB
+		WHERE (:1 IS NULL OR job_type = :1)
+		ORDER BY submitted DESC, job_id`, sql.NullString{String: jobType, Valid: len(jobType) > 0})
+	if err != nil {
+		thisError := fmt.Sprintf("Error querying load jobs (%s): %s", jobType, err.Error())
+		return nil, false, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	items := []LoadJob{}
+	truncated := false
+	for rows.Next() {
+		if len(items) >= maxRows {
+			truncated = true
+			break
+		}
+		item, err := scanLoadJob(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		items = append(items, item)
+	}
+	if err = rows.Err(); err != nil {
+		thisError := fmt.Sprintf("Error querying load jobs (%s): %s", jobType, err.Error())
+		return nil, false, errors.New(thisError)
+	}
+	return items, truncated, nil
+}
+
+func scanLoadJob(rows *sql.Rows) (LoadJob, error) {
+	var job LoadJob
+	var submitted time.Time
+	var started, finished sql.NullTime
+	var message, progressType, progressSchema sql.NullString
+	var progress LoadJobProgress
+	var progressAt sql.NullTime
+	err := rows.Scan(&job.ID, &job.Type, &job.Status, &job.Instance, &submitted, &started, &finished, &job.RowsRead,
+		&job.RowsLoaded, &job.Inserted, &job.Updated, &job.Rejected, &message, &progressType, &progressSchema,
+		&progress.Processed, &progress.Inserted, &progress.Updated, &progress.Skipped, &progressAt)
+	if err != nil {
+		thisError := fmt.Sprintf("Error scanning load job: %s", err.Error())
+		return job, errors.New(thisError)
+	}
+	job.Submitted = submitted.In(outputLocation).Format(time.RFC3339)
+	if started.Valid {
+		job.Started = started.Time.In(outputLocation).Format(time.RFC3339)
+	}
+	if finished.Valid {
+		job.Finished = finished.Time.In(outputLocation).Format(time.RFC3339)
+	}
+	job.Error = message.String
+	if progressAt.Valid {
+		progress.DataType = progressType.String
+		progress.Schema = progressSchema.String
+		progress.AsOf = progressAt.Time.In(outputLocation).Format(time.RFC3339)
+		job.Progress = &progress
+	}
+	return job, nil
+}
@@ -0,0 +1,216 @@
+//  Load Scope
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// the most accounts a single partial reload can be scoped to (Oracle allows 1000 expressions in an IN list)
+const maxScopedAccounts = 1000
+
+// scoped reloads are recorded in SYNC_METADATA under reloadDataType + the data type so they don't count as a
+// full load of the feed
+const reloadDataType = "reload:"
+
+// loadScope limits a reprocess of the opportunity or account feed to the records of some accounts, or of the
+// opportunity feed to an L2 and/or L3 territory, e.g. to pick up an upstream correction or a territory realignment
+// without a full reload.  Records outside the scope are skipped and rows outside it are left alone.  The zero value
+// is the whole feed.
+type loadScope struct {
+	cimIDs      map[string]bool
+	l2Territory string
+	l3Territory string
+}
+
+//
+// Builds the scope of a reprocess from the cimIds or accountIds (ECAL Account ids, resolved to their CIM IDs in the
+// ECALOpportunitySyncTarget schema) query parameters, each a comma separated list, and the l2Territory and
+// l3Territory names.  None of them means the whole feed.
+//
+func parseLoadScope(query url.Values) (loadScope, error) {
+	scope := loadScope{l2Territory: strings.TrimSpace(query.Get("l2Territory")), l3Territory: strings.TrimSpace(query.Get("l3Territory"))}
+	cimIDs := splitScopeList(query.Get("cimIds"))
+	accountIDs := splitScopeList(query.Get("accountIds"))
+	if len(cimIDs) > 0 && len(accountIDs) > 0 {
+		return scope, errors.New("only one of cimIds and accountIds may be given")
+	}
+
+	if len(accountIDs) > 0 {
+		schema := lookupSchema(GlobalConfig.ECALOpportunitySyncTarget)
+		if len(schema) < 1 {
+			thisError := fmt.Sprintf("Schema for (%s) not valid", GlobalConfig.ECALOpportunitySyncTarget)
+			return scope, errors.New(thisError)
+		}
+		if len(accountIDs) > maxScopedAccounts {
+			thisError := fmt.Sprintf("at most %d accountIds may be given", maxScopedAccounts)
+			return scope, errors.New(thisError)
+		}
+		binds := make([]string, len(accountIDs))
+		args := make([]interface{}, len(accountIDs))
+		for i, id := range accountIDs {
+			binds[i] = fmt.Sprintf(":%d", i+1)
+			args[i] = id
+		}
+		rows, err := DBPool.Query("SELECT id, cimid FROM "+schema+".Account WHERE id IN ("+strings.Join(binds, ", ")+")", args...)
+		if err != nil {
+			thisError := fmt.Sprintf("Error looking up accountIds (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+			return scope, errors.New(thisError)
+		}
+		defer rows.Close()
+		found := make(map[string]bool)
+		for rows.Next() {
+			var id string
+			var cimID sql.NullString
+			err = rows.Scan(&id, &cimID)
+			if err != nil {
+				thisError := fmt.Sprintf("Error looking up accountIds (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+				return scope, errors.New(thisError)
+			}
+			if len(strings.TrimSpace(cimID.String)) < 1 {
+				thisError := fmt.Sprintf("account %s has no CIM ID", id)
+				return scope, errors.New(thisError)
+			}
+			found[id] = true
+			cimIDs = append(cimIDs, strings.TrimSpace(cimID.String))
+		}
+		if err = rows.Err(); err != nil {
+			thisError := fmt.Sprintf("Error looking up accountIds (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+			return scope, errors.New(thisError)
+		}
+		for _, id := range accountIDs {
+			if !found[id] {
+				thisError := fmt.Sprintf("account %s not found in %s", id, GlobalConfig.ECALOpportunitySyncTarget)
+				return scope, errors.New(thisError)
+			}
+		}
+	}
+
+	if len(cimIDs) > maxScopedAccounts {
+		thisError := fmt.Sprintf("at most %d cimIds may be given", maxScopedAccounts)
+		return scope, errors.New(thisError)
+	}
+	if len(cimIDs) > 0 {
+		scope.cimIDs = make(map[string]bool)
+		for _, cimID := range cimIDs {
+			scope.cimIDs[cimID] = true
+		}
+	}
+	return scope, nil
+}
+
+//
+// Splits a comma separated query parameter, dropping empty entries
+//
+func splitScopeList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+//
+// True if the scope is the whole feed
+//
+func (scope loadScope) full() bool {
+	return len(scope.cimIDs) == 0 && !scope.byTerritory()
+}
+
+//
+// True if the scope is limited to a territory, which only the opportunity feed carries
+//
+func (scope loadScope) byTerritory() bool {
+	return len(scope.l2Territory) > 0 || len(scope.l3Territory) > 0
+}
+
+//
+// True if the feed record of the account with this CIM ID is in scope
+//
+func (scope loadScope) includes(cimID string) bool {
+	return len(scope.cimIDs) == 0 || scope.cimIDs[strings.TrimSpace(cimID)]
+}
+
+//
+// True if the feed record of a revenue line is in scope.  Territories are matched ignoring case.
+//
+func (scope loadScope) includesOpportunity(opp OpportunityLookup) bool {
+	return scope.includes(opp.CimID) &&
+		(len(scope.l2Territory) < 1 || strings.EqualFold(strings.TrimSpace(opp.L2TerritoryName), scope.l2Territory)) &&
+		(len(scope.l3Territory) < 1 || strings.EqualFold(strings.TrimSpace(opp.L3TerritoryName), scope.l3Territory))
+}
+
+//
+// Returns a SQL condition restricting a lookup table to the rows in scope, along with its bind values numbered from
+// firstBind.  The whole feed is "1 = 1".
+//
+func (scope loadScope) condition(firstBind int) (string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+	bind := func(value string) string {
+		args = append(args, value)
+		return fmt.Sprintf(":%d", firstBind+len(args)-1)
+	}
+
+	if len(scope.cimIDs) > 0 {
+		cimIDs := make([]string, 0, len(scope.cimIDs))
+		for cimID := range scope.cimIDs {
+			cimIDs = append(cimIDs, cimID)
+		}
+		sort.Strings(cimIDs)
+		binds := make([]string, len(cimIDs))
+		for i, cimID := range cimIDs {
+			binds[i] = bind(cimID)
+		}
+		conditions = append(conditions, "cimid IN ("+strings.Join(binds, ", ")+")")
+	}
+	if len(scope.l2Territory) > 0 {
+		conditions = append(conditions, "UPPER(TRIM(l2territoryname)) = UPPER("+bind(scope.l2Territory)+")")
+	}
+	if len(scope.l3Territory) > 0 {
+		conditions = append(conditions, "UPPER(TRIM(l3territoryname)) = UPPER("+bind(scope.l3Territory)+")")
+	}
+	if len(conditions) < 1 {
+		return "1 = 1", nil
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+//
+// Returns the data type a load of dataType with this scope is recorded under
+//
+func (scope loadScope) dataType(dataType string) string {
+	if scope.full() {
+		return dataType
+	}
+	return reloadDataType + dataType
+}
+
+//
+// Describes the scope for log messages
+//
+func (scope loadScope) String() string {
+	if scope.full() {
+		return "full feed"
+	}
+	parts := []string{}
+	if len(scope.cimIDs) > 0 {
+		parts = append(parts, fmt.Sprintf("%d accounts", len(scope.cimIDs)))
+	}
+	if len(scope.l2Territory) > 0 {
+		parts = append(parts, "L2 territory "+scope.l2Territory)
+	}
+	if len(scope.l3Territory) > 0 {
+		parts = append(parts, "L3 territory "+scope.l3Territory)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,150 @@
+//  LOB Taxonomy
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// LobNode is a LOB tag in the taxonomy with the number of employees tagged with it (Employees) and with it or any
+// tag below it (TotalEmployees)
+type LobNode struct {
+	Tag            string     `json:"tag"`
+	Employees      int        `json:"employees"`
+	TotalEmployees int        `json:"total_employees"`
+	Children       []*LobNode `json:"children"`
+
+	parent string
+}
+
+//
+// HTTP handler for the getLobTaxonomy functionality.  Returns the LOB tags of the last identity load as a tree of
+// {"items": [root tags]}, each tag with its children, so apps can build their LOB pick lists from the current
+// organization.
+//
+func getLobTaxonomyHandler(w http.ResponseWriter, r *http.Request) {
+	roots, err := getLobTaxonomy(r.Context())
+	if queryCancelled(r.Context(), "lob_taxonomy", err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "lob_taxonomy", err.Error())
+		return
+	}
+
+	result, _ := json.Marshal(map[string]interface{}{"items": roots})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+//
+// Builds the LOB tree from the LOB_TAG, LOB_TAG_PARENT and LOB_TAG_ROOT of each employee in ORACLE_EMPLOYEES.  The
+// identity load sets a tag's parent to itself at the top of a LOB.  If employees disagree about a tag's parent the
+// most common one wins, and a parent no employee is tagged with is added (with no employees of its own) under its root.
+//
+func getLobTaxonomy(ctx context.Context) ([]*LobNode, error) {
+	rows, err := DBPool.QueryContext(ctx, "SELECT lob_tag, NVL(lob_tag_parent, lob_tag), NVL(lob_tag_root, ' '), COUNT(*) "+
+		"FROM CTO_COMMON.ORACLE_EMPLOYEES WHERE lob_tag IS NOT NULL "+
+		"GROUP BY lob_tag, NVL(lob_tag_parent, lob_tag), NVL(lob_tag_root, ' ') ORDER BY COUNT(*) DESC, lob_tag")
+	if err != nil {
+		thisError := fmt.Sprintf("Error querying LOB tags: %s", err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	nodes := make(map[string]*LobNode)
+	roots := make(map[string]string)
+	node := func(tag string) *LobNode {
+		if _, found := nodes[tag]; !found {
+			nodes[tag] = &LobNode{Tag: tag, Children: []*LobNode{}}
+		}
+		return nodes[tag]
+	}
+	for rows.Next() {
+		var tag, parent, root string
+		var count int
+		err = rows.Scan(&tag, &parent, &root, &count)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning LOB tags: %s", err.Error())
+			return nil, errors.New(thisError)
+		}
+
+		// rows come most common first so the first parent seen for a tag is the one most employees have
+		current := node(tag)
+		current.Employees += count
+		if len(current.parent) < 1 {
+			current.parent = parent
+		}
+		if root != " " {
+			if _, found := roots[parent]; !found {
+				roots[parent] = root
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		thisError := fmt.Sprintf("Error querying LOB tags: %s", err.Error())
+		return nil, errors.New(thisError)
+	}
+
+	// add the parents nobody is tagged with
+	for tag := range nodes {
+		parent := nodes[tag].parent
+		if _, found := nodes[parent]; !found {
+			missing := node(parent)
+			missing.parent = parent
+			if root, found := roots[parent]; found {
+				missing.parent = root
+				if _, found := nodes[root]; !found {
+					node(root).parent = root
+				}
+			}
+		}
+	}
+
+	// attach each tag under its parent unless that would make a loop
+	tree := []*LobNode{}
+	for _, current := range nodes {
+		if current.parent == current.Tag || lobParentLoops(nodes, current) {
+			tree = append(tree, current)
+			continue
+		}
+		nodes[current.parent].Children = append(nodes[current.parent].Children, current)
+	}
+	for _, root := range tree {
+		countLobEmployees(root)
+	}
+	sort.Slice(tree, func(i, j int) bool { return tree[i].Tag < tree[j].Tag })
+	return tree, nil
+}
+
+//
+// True if following a tag's parents leads back to the tag
+//
+func lobParentLoops(nodes map[string]*LobNode, start *LobNode) bool {
+	seen := make(map[string]bool)
+	for current := nodes[start.parent]; current != nil && !seen[current.Tag]; current = nodes[current.parent] {
+		if current == start {
+			return true
+		}
+		seen[current.Tag] = true
+	}
+	return false
+}
+
+func countLobEmployees(node *LobNode) int {
+	sort.Slice(node.Children, func(i, j int) bool { return node.Children[i].Tag < node.Children[j].Tag })
+	node.TotalEmployees = node.Employees
+	for _, child := range node.Children {
+		node.TotalEmployees += countLobEmployees(child)
+	}
+	return node.TotalEmployees
+}
@@ -0,0 +1,204 @@
+//  Structured Logging
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// log formats (LogFormat); text is the original [datetime] [LEVEL] [module] message line
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// the header a request id is read from and returned in, so a caller's id follows the request through the logs
+const requestIDHeader = "X-Request-ID"
+
+// an incoming request id is only used if it looks like one; anything else is replaced
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,64}$`)
+
+// the levels in increasing order of severity
+var logLevels = map[string]int{logDebug: 0, logInfo: 1, logWarn: 2, logError: 3}
+
+// the format and the lowest level written, guarded by logSettingsLock since the level can be changed at runtime
+var logFormat = logFormatText
+var logLevel = logInfo
+var logSettingsLock sync.RWMutex
+
+// serializes writes so lines from concurrent goroutines don't interleave
+var logWriteLock sync.Mutex
+
+// requestIDKey is the context key of a request's id
+type requestIDKey struct{}
+
+// logRecord is one line of the JSON log format
+type logRecord struct {
+	Timestamp   string `json:"timestamp"`
+	Level       string `json:"level"`
+	Component   string `json:"component"`
+	Message     string `json:"message"`
+	RequestID   string `json:"request_id,omitempty"`
+	TraceID     string `json:"trace_id,omitempty"`
+	InstanceEnv string `json:"instance_env,omitempty"`
+	Client      string `json:"client,omitempty"`
+}
+
+//
+// Reads LogFormat and LogLevel from config.json.  Checked at startup.
+//
+func initLogging() error {
+	format := strings.ToLower(GlobalConfig.LogFormat)
+	if len(format) < 1 {
+		format = logFormatText
+	}
+	if format != logFormatText && format != logFormatJSON {
+		thisError := fmt.Sprintf("LogFormat must be %s or %s", logFormatText, logFormatJSON)
+		return errors.New(thisError)
+	}
+	level := logInfo
+	if len(GlobalConfig.LogLevel) > 0 {
+		level = strings.ToUpper(GlobalConfig.LogLevel)
+		if _, found := logLevels[level]; !found {
+			return errors.New("LogLevel must be one of DEBUG, INFO, WARN or ERROR")
+		}
+	}
+
+	logSettingsLock.Lock()
+	logFormat, logLevel = format, level
+	logSettingsLock.Unlock()
+	return nil
+}
+
+//
+// Writes a log line for a request, adding its id, instance-environment and client so every line a request causes can
+// be found together
+//
+func logRequest(r *http.Request, logType string, module string, message string) {
+	client, _, _ := r.BasicAuth()
+	writeLog(logRecord{Level: logType, Component: module, Message: message, RequestID: requestID(r.Context()),
+		TraceID: traceID(r.Context()), InstanceEnv: r.URL.Query().Get("instanceEnvironment"), Client: client})
+}
+
+//
+// Writes a log line for work on an instance-environment that isn't tied to a request, e.g. a data load
+//
+func logEnv(instanceEnv string, logType string, module string, message string) {
+	writeLog(logRecord{Level: logType, Component: module, Message: message, InstanceEnv: instanceEnv})
+}
+
+//
+// Writes a log line in LogFormat to the console, where it is picked up by the OCI Logging Service, unless it is below
+// LogLevel
+//
+func writeLog(record logRecord) {
+	if _, found := logLevels[record.Level]; !found {
+		record.Level = logInfo
+	}
+	logSettingsLock.RLock()
+	format, level := logFormat, logLevel
+	logSettingsLock.RUnlock()
+	if logLevels[record.Level] < logLevels[level] {
+		return
+	}
+	record.Timestamp = time.Now().Format(time.RFC3339)
+
+	var line string
+	if format == logFormatJSON {
+		data, _ := json.Marshal(record)
+		line = string(data)
+	} else {
+		message := record.Message
+		if len(record.RequestID) > 0 {
+			message = "(" + record.RequestID + ") " + message
+		}
+		line = fmt.Sprintf("[%s] [%s] [%s] %s", record.Timestamp, record.Level, record.Component, message)
+	}
+
+	logWriteLock.Lock()
+	fmt.Fprintln(os.Stdout, line)
+	logWriteLock.Unlock()
+}
+
+//
+// Returns the request with an id in its context, taken from the caller's X-Request-ID header when it has a usable one
+// and generated otherwise.  The id is returned in the response's X-Request-ID header.
+//
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(requestIDHeader)
+	if !requestIDPattern.MatchString(id) {
+		bytes := make([]byte, 8)
+		rand.Read(bytes)
+		id = hex.EncodeToString(bytes)
+	}
+	w.Header().Set(requestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+//
+// Wraps a handler that doesn't require basic auth (which assigns request ids and traces itself) so its requests get an
+// id and a span too
+//
+func traced(pass handler) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w, r, endSpan := startRequestSpan(w, withRequestID(w, r))
+		defer endSpan()
+		w, finishResponse := compressResponse(w, r)
+		defer finishResponse()
+		pass(w, r)
+	}
+}
+
+//
+// Returns the id of the request the context belongs to, or an empty string outside a request
+//
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+//
+// HTTP handler for the admin/logLevel functionality.  GET returns the log format and level; PUT or POST with
+// level=DEBUG|INFO|WARN|ERROR changes the level on this instance until it restarts, e.g. to turn on DEBUG while
+// chasing a problem.
+//
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		level := strings.ToUpper(r.URL.Query().Get("level"))
+		if _, found := logLevels[level]; !found {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "level must be one of DEBUG, INFO, WARN or ERROR")
+			return
+		}
+		logSettingsLock.Lock()
+		previous := logLevel
+		logLevel = level
+		logSettingsLock.Unlock()
+		logRequest(r, logWarn, "logging", fmt.Sprintf("Log level changed from %s to %s", previous, level))
+	default:
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+
+	logSettingsLock.RLock()
+	result, _ := json.Marshal(map[string]string{"format": logFormat, "level": logLevel})
+	logSettingsLock.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
@@ -5,57 +5,137 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
-	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"reflect"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 
 	_ "github.com/godror/godror"
 	"github.com/oracle/oci-go-sdk/common"
 	"github.com/oracle/oci-go-sdk/common/auth"
-	"github.com/oracle/oci-go-sdk/secrets"
 )
 
-// Config holds all config data loaded from local config.json file
+// how long reading config.json from Object Storage may take
+const configFetchTimeout = time.Minute
+
+// Config holds all config data loaded from local config.json file (or the object CONFIG_URI points at).  Entries are
+// converted to each field's type (see decodeConfig) and fields tagged vault may be given as a secret OCID.
 type Config struct {
-	ServiceListenPort         string
+	ServiceListenPort         int
 	ServiceUsername           string
-	ServicePassword           string
-	DBConnectString           string
+	ServicePassword           string `vault:"ocid"`
+	ServiceClients            string `vault:"ocid"`
+	ClientRequestQuotas       string
+	ClientRowQuotas           string
+	ClientScopes              string
+	LogFormat                 string
+	LogLevel                  string
+	TracingEndpoint           string
+	TracingDataKey            string `vault:"ocid"`
+	TracingSamplePercent      int
+	ReplayProtection          bool
+	ReplayWindowMinutes       string
+	UnrestrictedClients       []string
+	TrustedUserClients        []string
+	AdminRoles                []string
+	DBConnectString           string `vault:"ocid"`
+	DBUser                    string
+	DBPassword                string `vault:"ocid"`
+	DBTNSAlias                string
+	DBWalletLocation          string
+	DBPoolMinSessions         string
+	DBPoolMaxSessions         string
+	DBPoolIncrement           string
+	DBConnectionClass         string
 	IdentityFilename          string
-	IdentityMgrLeads          string
-	MgrAppMapping             string
-	InstanceEnvironments      string
-	SchemaNames               string
+	IdentityMgrLeads          []string
+	MgrAppMapping             []string
+	InstanceEnvironments      []string
+	SchemaNames               []string
 	ECALOpportunitySyncTarget string
 	ECALManagerHierarchyQuery string
 	STSManagerHierarchyQuery  string
+	LookupStaleHours          string
+	IdentityFileStaleHours    string
+	StaleDataFailsHealth      bool
+	UpstreamHealthChecks      bool
+	UpstreamHosts             []string
+	ArtifactURLTTLMinutes     string
+	ArtifactNamespace         string
+	ArtifactBucket            string
+	ArtifactMaxUploadMB       string
+	HierarchyCacheHours       string
+	ProvisionUsers            bool
+	ProvisionDefaultRole      string
+	SyncRoles                 bool
+	TestDataEnvironments      []string
+	MaxQueryRows              string
+	QueryCacheMinutes         string
+	SlowQueryMillis           string
+	MViewRefresh              string
+	GatherStats               string
+	DashboardQueryWorkers     string
+	OutputDateFormat          string
+	OutputDateFormats         string
+	OutputTimestampFormat     string
+	OutputTimeZone            string
+	DBTimeZone                string
+	FeedContractSampleSize    string
+	FiscalYearStartMonth      string
+	ReportScheduler           bool
+	SMTPServer                string
+	SMTPUser                  string
+	SMTPPassword              string `vault:"ocid"`
+	SMTPFrom                  string
+	AnalyticsBucket           string
+	ExportBucket              string
+	WebhookURL                string
+	WebhookSecret             string `vault:"ocid"`
+	IdentityVersionBucket     string
+	IdentityVersionsKept      string
+	IdentityOutputFields      string
+	IdentityTokenSecret       string `vault:"ocid"`
+	IdentityFeedURL           string
+	IdentityFeedUser          string
+	IdentityFeedPassword      string `vault:"ocid"`
+	IdentityFeedSchedule      string
+	OpportunityFeedURL        string
+	OpportunityFeedTokenURL   string
+	OpportunityFeedUser       string
+	OpportunityFeedPassword   string `vault:"ocid"`
+	OpportunityFeedSchedule   string
+	AccountFeedURL            string
+	AccountFeedTokenURL       string
+	AccountFeedUser           string
+	AccountFeedPassword       string `vault:"ocid"`
+	AccountFeedSchedule       string
+	ShutdownGraceSeconds      int
+	JobProgressSeconds        string
+	DevMode                   bool
+	DevFixtures               string
 }
 
 // GlobalConfig is a global holder for configuration information
 var GlobalConfig Config
 
 // DBPool is the database connection pool
-var DBPool *sql.DB
+var DBPool Store
 
-// SchemaMap maps the instance-environment key (e.g. dev-stage, prod-live, etc) to the ATP schema name
+// SchemaMap maps the instance-environment key (e.g. dev-stage, prod-live, etc) to the ATP schema name.  It can be
+// added to at runtime (see provisionSchema) so access it through lookupSchema/schemaMapSnapshot/registerSchema.
 var SchemaMap map[string]string
-
-// IdentityMgrLeads contains the top level managers who should be included in the list of employees loaded into the platform
-var IdentityMgrLeads []string
-
-// MgrAppMapping is a parallel array mapping the IdentityMgrLead in the same position to the VBCS apps that org is mapped to
-var MgrAppMapping []string
+var schemaMapLock sync.RWMutex
 
 // Logging constants
+const logDebug = "DEBUG"
 const logInfo = "INFO"
 const logWarn = "WARN"
 const logError = "ERROR"
@@ -73,172 +153,384 @@ func main() {
 		}
 	}
 
+	// --dev (or DevMode in config.json) runs against an in-memory stand-in for ATP so the service can be run locally
+	// without a wallet.  it implies --novault.
+	devMode := devModeRequested(os.Args[1:])
+	if devMode {
+		skipVault = true
+	}
+
 	// read system configuration from config file
 	logOutput(logInfo, "main", "Reading & Decoding config.json")
 	GlobalConfig = loadConfig("config.json", skipVault)
+	err := initLogging()
+	if err != nil {
+		logOutput(logError, "main", "Invalid logging configuration: "+err.Error())
+		return
+	}
+	err = initTracing()
+	if err != nil {
+		logOutput(logError, "main", "Invalid tracing configuration: "+err.Error())
+		return
+	}
+	defer stopTracing()
+	if devMode || GlobalConfig.DevMode {
+		devMode = true
+		logOutput(logInfo, "main", "Running in DEV mode against an in-memory database; no data is read from or written to ATP.")
+	}
 
 	// load schema mappings
 	logOutput(logInfo, "main", "Loading schema mappings")
 	SchemaMap = make(map[string]string)
-	err := loadSchemaMap()
+	err = loadSchemaMap()
 	if err != nil {
 		logOutput(logError, "main", err.Error())
 		return
 	}
+	if devMode {
+		registerDevSchemas()
+		err = applyDevDefaults()
+		if err != nil {
+			logOutput(logError, "main", "Invalid dev mode configuration: "+err.Error())
+			return
+		}
+	}
 	logOutput(logInfo, "main", "Routing opportunity data to: "+GlobalConfig.ECALOpportunitySyncTarget)
 
-	// initialize database connection pool
-	DBPool, err = sql.Open("godror", GlobalConfig.DBConnectString)
+	// load the output time zones and check the date formats before any queries run
+	err = initOutputFormats()
 	if err != nil {
-		logOutput(logError, "main", err.Error())
+		logOutput(logError, "main", "Invalid output format configuration: "+err.Error())
 		return
 	}
+	err = initIdentityOutputFields()
+	if err != nil {
+		logOutput(logError, "main", "Invalid identity output configuration: "+err.Error())
+		return
+	}
+	err = initClientUsage()
+	if err != nil {
+		logOutput(logError, "main", "Invalid client configuration: "+err.Error())
+		return
+	}
+	err = initClientScopes()
+	if err != nil {
+		logOutput(logError, "main", "Invalid client configuration: "+err.Error())
+		return
+	}
+
+	// connect to OCI Object Storage for artifact handling.  failure here only disables the artifact endpoints.
+	// dev mode has no OCI credentials to connect with.
+	if !devMode {
+		err = initObjectStorage()
+		if err != nil {
+			logOutput(logWarn, "main", "Object Storage unavailable: "+err.Error())
+		}
+	}
+
+	// initialize database connection pool, or the in-memory stand-in in dev mode
+	if devMode {
+		DBPool, err = openDevStore()
+		if err != nil {
+			logOutput(logError, "main", "Invalid dev mode configuration: "+err.Error())
+			return
+		}
+	} else {
+		err = validateDBWallet(GlobalConfig.DBWalletLocation, GlobalConfig.DBTNSAlias)
+		if err != nil {
+			logOutput(logError, "main", "Invalid database wallet: "+err.Error())
+			return
+		}
+		connectString, err := buildDBConnectString(GlobalConfig)
+		if err != nil {
+			logOutput(logError, "main", "Invalid database configuration: "+err.Error())
+			return
+		}
+		pool, err := sql.Open("godror", connectString)
+		if err != nil {
+			logOutput(logError, "main", err.Error())
+			return
+		}
+		DBPool = pool
+	}
+	DBPool = traceStore(DBPool)
 	defer DBPool.Close()
 
 	// register function listeners
 	logOutput(logInfo, "main", "Registering REST handlers")
-	http.HandleFunc("/health", healthHandler)
+	http.HandleFunc("/health", traced(healthHandler))
+	http.HandleFunc("/health/upstream", basicAuth(upstreamHealthHandler))
 	http.HandleFunc("/getManagerQuery", basicAuth(getManagerQueryHandler))
+	http.HandleFunc("/getReports", basicAuth(getReportsHandler))
+	http.HandleFunc("/getLobTaxonomy", basicAuth(getLobTaxonomyHandler))
 	http.HandleFunc("/getSTSManagerDashboardSummary", basicAuth(getSTSManagerDashboardSummaryHandler))
-	http.HandleFunc("/getECALAccountQuery", basicAuth(getECALAccountQueryHandler))
-	http.HandleFunc("/getECALArtifactQuery", basicAuth(getECALArtifactQueryHandler))
-	http.HandleFunc("/getECALDataQuery", basicAuth(getECALDataQueryHandler))
-	http.HandleFunc("/getECALOpportunityQuery", basicAuth(getECALOpportunityQueryHandler))
+	http.HandleFunc("/stsTask", basicAuth(stsAdminHandler(stsTaskEntity)))
+	http.HandleFunc("/stsPath", basicAuth(stsAdminHandler(stsPathEntity)))
+	http.HandleFunc("/stsPathRequirement", basicAuth(stsAdminHandler(stsPathRequirementEntity)))
+	http.HandleFunc("/assignSTSPath", basicAuth(assignSTSPathHandler))
+	http.HandleFunc("/getECALAccountQuery", basicAuth(getECALAccountQueryHandler(DBPool)))
+	http.HandleFunc("/getECALArtifactQuery", basicAuth(getECALArtifactQueryHandler(DBPool)))
+	http.HandleFunc("/getArtifact", basicAuth(getArtifactHandler))
+	http.HandleFunc("/postArtifact", basicAuth(postArtifactHandler))
+	http.HandleFunc("/uploadArtifact", basicAuth(uploadArtifactHandler))
+	http.HandleFunc("/userAccountAssignment", basicAuth(userAccountAssignmentHandler))
+	http.HandleFunc("/postOpportunityStatus", basicAuth(postOpportunityStatusHandler))
+	http.HandleFunc("/opportunityTechHealth", basicAuth(patchOpportunityTechHealthHandler))
+	http.HandleFunc("/opportunityWorkload", basicAuth(opportunityWorkloadHandler))
+	http.HandleFunc("/opportunityHistory", basicAuth(getOpportunityHistoryHandler))
+	http.HandleFunc("/accountReviews", basicAuth(accountReviewsHandler))
+	http.HandleFunc("/getECALDataQuery", basicAuth(getECALDataQueryHandler(DBPool)))
+	http.HandleFunc("/getECALOpportunityQuery", basicAuth(getECALOpportunityQueryHandler(DBPool)))
 	http.HandleFunc("/getIdentities", basicAuth(getIdentitiesQueryHandler))
-	http.HandleFunc("/postIdentities", basicAuth(postIdentitiesQueryHandler))
-	http.HandleFunc("/postReferenceData", basicAuth(postReferenceDataHandler))
+	http.HandleFunc("/postIdentities", basicAuth(replayProtected(postIdentitiesQueryHandler)))
+	http.HandleFunc("/identities/versions", basicAuth(identityVersionsHandler))
+	http.HandleFunc("/identities/versions/", basicAuth(identityVersionsHandler))
+	http.HandleFunc("/identities/token", basicAuth(identityTokenHandler))
+	http.HandleFunc("/identities/download", traced(identityDownloadHandler))
+	http.HandleFunc("/postReferenceData", basicAuth(replayProtected(postReferenceDataHandler)))
+	http.HandleFunc("/postReferenceBatch", basicAuth(replayProtected(postReferenceBatchHandler)))
+	http.HandleFunc("/jobs", basicAuth(loadJobsHandler))
+	http.HandleFunc("/jobs/", basicAuth(loadJobsHandler))
+	http.HandleFunc("/syncStatus", basicAuth(getSyncStatusHandler))
+	http.HandleFunc("/metrics", basicAuth(getMetricsHandler))
+	http.HandleFunc("/usage", basicAuth(getUsageHandler))
+	http.HandleFunc("/meta", basicAuth(getMetaHandler))
+	http.HandleFunc("/feedQuality", basicAuth(getFeedQualityHandler))
+	http.HandleFunc("/getProductCatalog", basicAuth(getProductCatalogHandler))
+	http.HandleFunc("/searchOpportunities", basicAuth(searchOpportunitiesHandler))
+	http.HandleFunc("/getConsumptionVsPlan", basicAuth(getConsumptionVsPlanHandler))
+	http.HandleFunc("/getWinLoss", basicAuth(getWinLossHandler))
+	http.HandleFunc("/getPipelineByTerritory", basicAuth(getPipelineByTerritoryHandler))
+	http.HandleFunc("/getQuarterlyRollup", basicAuth(getQuarterlyRollupHandler))
+	http.HandleFunc("/getForecast", basicAuth(getForecastHandler))
+	http.HandleFunc("/generateDigest", basicAuth(generateDigestHandler))
+	http.HandleFunc("/getAccountReport", basicAuth(getAccountReportHandler))
+	http.HandleFunc("/exports", basicAuth(exportsHandler))
+	http.HandleFunc("/exportECALWorkbook", basicAuth(exportECALWorkbookHandler))
+	http.HandleFunc("/queries", basicAuth(queriesHandler))
+	http.HandleFunc("/queries/", basicAuth(queriesHandler))
+	http.HandleFunc("/changes", basicAuth(getChangesHandler))
+	http.HandleFunc("/admin/provisionSchema", basicAuth(provisionSchemaHandler))
+	http.HandleFunc("/admin/seedSchema", basicAuth(seedSchemaHandler))
+	http.HandleFunc("/admin/generateTestData", basicAuth(generateTestDataHandler))
+	http.HandleFunc("/admin/reportSchedule", basicAuth(reportScheduleHandler))
+	http.HandleFunc("/admin/runReport", basicAuth(runReportHandler))
+	http.HandleFunc("/admin/publishAnalytics", basicAuth(publishAnalyticsHandler))
+	http.HandleFunc("/admin/pullFeed", basicAuth(pullFeedHandler))
+	http.HandleFunc("/admin/backfillSnapshots", basicAuth(backfillSnapshotsHandler))
+	http.HandleFunc("/admin/config", basicAuth(adminConfigHandler))
+	http.HandleFunc("/admin/slowQueries", basicAuth(slowQueriesHandler))
+	http.HandleFunc("/admin/payloadCapture", basicAuth(payloadCaptureHandler))
+	http.HandleFunc("/admin/logLevel", basicAuth(logLevelHandler))
+
+	// loads this instance was running when it last stopped won't finish now
+	failInterruptedLoadJobs()
+
+	// start producing scheduled reports if this instance is the one configured to run them
+	startReportScheduler()
+
+	// pull the feeds that have a REST source on their schedules
+	startFeedPuller()
+
+	// deliver the events written to the outbox
+	startOutboxDispatcher()
 
 	// emit endpoint/database information
-	dbuser := strings.SplitAfter(GlobalConfig.DBConnectString, "/")
-	sid := strings.SplitAfter(GlobalConfig.DBConnectString, "@")
-	logMessage := fmt.Sprintf("Connecting to ATP Connect String: %s*******@%s", dbuser[0], sid[1])
-	logOutput(logInfo, "main", logMessage)
+	if !devMode {
+		logOutput(logInfo, "main", "Connecting to ATP Connect String: "+describeDBConnection(GlobalConfig))
+	}
 
 	// start HTTP listener
-	logOutput(logInfo, "main", "Starting HTTP Listener on port "+GlobalConfig.ServiceListenPort+"...")
-	http.ListenAndServe(":"+GlobalConfig.ServiceListenPort, nil)
+	port := GlobalConfig.ServiceListenPort
+	if port == 0 {
+		port = defaultListenPort
+	}
+	logOutput(logInfo, "main", "Starting HTTP Listener on port "+strconv.Itoa(port)+"...")
+	serveUntilStopped(&http.Server{Addr: ":" + strconv.Itoa(port)})
+
+	// the deferred DBPool.Close releases the connections once the loads are done with them
+	logOutput(logInfo, "main", "Closing database connections")
 }
 
 //
 //  Load a global hashmap to map instance-env to ATP schema name
 //
 func loadSchemaMap() error {
-	instanceEnvKeys := strings.Split(GlobalConfig.InstanceEnvironments, ",")
-	schemaNames := strings.Split(GlobalConfig.SchemaNames, ",")
+	instanceEnvKeys := GlobalConfig.InstanceEnvironments
+	schemaNames := GlobalConfig.SchemaNames
 	if len(instanceEnvKeys) != len(schemaNames) {
 		return errors.New("InstanceEnvironments count doesn't match SchemaNames count.  Check config.json")
 	}
 
 	// create a hashmap for easier runtime lookup
 	for i, item := range instanceEnvKeys {
-		SchemaMap[item] = schemaNames[i]
-		logOutput(logInfo, "main", "\t"+item+" -> "+SchemaMap[item])
+		registerSchema(item, schemaNames[i])
+		logOutput(logInfo, "main", "\t"+item+" -> "+schemaNames[i])
 	}
 
 	return nil
 }
 
 //
-// Wraps handler function with a basic auth check
+// Returns the schema name for an instance-environment or an empty string if it isn't configured
+//
+func lookupSchema(instanceEnv string) string {
+	schemaMapLock.RLock()
+	defer schemaMapLock.RUnlock()
+	return SchemaMap[instanceEnv]
+}
+
+//
+// Returns a copy of the schema map that is safe to range over while schemas are being registered
+//
+func schemaMapSnapshot() map[string]string {
+	schemaMapLock.RLock()
+	defer schemaMapLock.RUnlock()
+	snapshot := make(map[string]string, len(SchemaMap))
+	for instanceEnv, schema := range SchemaMap {
+		snapshot[instanceEnv] = schema
+	}
+	return snapshot
+}
+
+//
+// Adds (or replaces) the schema mapping for an instance-environment
+//
+func registerSchema(instanceEnv string, schema string) {
+	schemaMapLock.Lock()
+	defer schemaMapLock.Unlock()
+	SchemaMap[instanceEnv] = schema
+}
+
+//
+// Wraps handler function with a basic auth check.  The request is counted against the client's daily quotas and
+// the rows streamed back to it are counted towards its row quota.
 //
 type handler func(w http.ResponseWriter, r *http.Request)
 
 func basicAuth(pass handler) handler {
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		r = withRequestID(w, r)
+		w, r, endSpan := startRequestSpan(w, r)
+		defer endSpan()
+		w, finishResponse := compressResponse(w, r)
+		defer finishResponse()
 		username, password, _ := r.BasicAuth()
 
-		if username != GlobalConfig.ServiceUsername || password != GlobalConfig.ServicePassword {
+		if !validClient(username, password) {
 			http.Error(w, "Authorization failed", http.StatusUnauthorized)
 			return
 		}
+		if !admitClientScope(w, r, username) {
+			return
+		}
+		if !admitClientRequest(w, username) {
+			return
+		}
+		if !decompressRequest(w, r) {
+			return
+		}
 
-		pass(w, r)
+		servePayloadCapture(pass, &usageWriter{ResponseWriter: w, client: username}, r)
 	}
 }
 
 //
 //  Read the config.json file and parse configuration data into a struct. Communicate with the OCI Secrets Service
-//  to retrieve the secret data.  If the environment is secure and vault is not needed, that section can be skipped by
-//  passing skipVault=true.  On error, panic here.
+//  and/or HashiCorp Vault to retrieve the secret data.  If the environment is secure and vault is not needed, that
+//  section can be skipped by passing skipVault=true.  On error, panic here.
 //
 func loadConfig(filename string, skipVault bool) Config {
 
-	// open the config file
+	// open the config file, or the Object Storage object CONFIG_URI points at
 	var config = Config{}
-	file, err := os.Open(filename)
+	file, err := openConfig(filename)
 	if err != nil {
 		panic("reading config.json: " + err.Error())
 	}
 	defer file.Close()
 
-	// decode config.json into struct
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&config)
+	// decode config.json into struct, converting each entry to its field's type
+	err = decodeConfig(file, &config)
 	if err != nil {
-		panic("marshalling to struct: " + err.Error())
+		panic("decoding config.json: " + err.Error())
 	}
 
-	// Convert identity manager leads into an array of strings
-	IdentityMgrLeads = strings.Split(config.IdentityMgrLeads, ",")
-
-	// Convert manager mappings into an array of strings
-	MgrAppMapping = strings.Split(config.MgrAppMapping, ",")
-
 	// if vault integration is off, return the config struct as-is.  no need for further decoding.
 	if skipVault == true {
 		return config
 	}
 
-	// connect to the OCI Secrets Service
-	var provider common.ConfigurationProvider
-	provider, err = auth.InstancePrincipalConfigurationProvider()
+	// retrieve the [vault] (OCI Secrets Service) and [hashivault] (HashiCorp Vault) entries from their secret stores
+	err = resolveConfigSecrets(&config)
 	if err != nil {
-		provider = common.DefaultConfigProvider()
+		panic("resolving config secrets: " + err.Error())
 	}
 
-	client, err := secrets.NewSecretsClientWithConfigurationProvider(provider)
+	return config
+}
+
+//
+// Returns the config.json to read: the Object Storage object named by the CONFIG_URI environment variable
+// (oci://bucket@namespace/path/config.json or a native Object Storage URL) when it is set, so containers don't need
+// the config baked into the image or mounted, otherwise the local file
+//
+func openConfig(filename string) (io.ReadCloser, error) {
+	uri := os.Getenv("CONFIG_URI")
+	if len(uri) < 1 {
+		return os.Open(filename)
+	}
+	location, err := parseObjectStorageURI(uri)
 	if err != nil {
-		panic("connecting to OCI Secrets Service: " + err.Error())
+		return nil, err
 	}
+	logOutput(logInfo, "main", "Reading config from "+uri)
 
-	// step through all the struct values and scan for [vault] prefix
-	// which indicates that the value needs to be retrieved from the OCI Secret Service
-	// format is [vault]FieldName:OCID
-	v := reflect.ValueOf(config)
-	values := make([]interface{}, v.NumField())
-	for i := 0; i < v.NumField(); i++ {
-		values[i] = v.Field(i).Interface()
-		if strings.HasPrefix(values[i].(string), "[vault]") {
-			keySlice := strings.Split(strings.TrimPrefix(values[i].(string), "[vault]"), ":")
-			fieldName := keySlice[0]
-			vaultKey := keySlice[1]
-			vaultValue := getSecretValue(client, vaultKey)
-			reflect.ValueOf(&config).Elem().FieldByName(fieldName).SetString(vaultValue)
+	if ObjectStorage == nil {
+		err = initObjectStorage()
+		if err != nil {
+			return nil, err
 		}
 	}
-
-	return config
+	ctx, cancel := context.WithTimeout(context.Background(), configFetchTimeout)
+	defer cancel()
+	content, _, err := getObject(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
 }
 
 //
-// Returns a secret value from the OCI Secret Service based on a secret OCID
+// Returns an OCI configuration provider.  Resource principals are used when running as an OCI resource that has
+// them (e.g. a container instance or function), then instance principals, and if neither is available (e.g. when
+// running locally) we fall back to the default ~/.oci/config file provider.
 //
-func getSecretValue(client secrets.SecretsClient, secretOCID string) string {
-	request := secrets.GetSecretBundleRequest{SecretId: &secretOCID}
-	response, err := client.GetSecretBundle(context.Background(), request)
-	if err != nil {
-		panic("reading value for key [" + secretOCID + "]: " + err.Error())
+func getOCIConfigProvider() common.ConfigurationProvider {
+	if len(os.Getenv("OCI_RESOURCE_PRINCIPAL_VERSION")) > 0 {
+		provider, err := auth.ResourcePrincipalConfigurationProvider()
+		if err == nil {
+			return provider
+		}
 	}
-
-	encodedResponse := fmt.Sprintf("%s", response.SecretBundleContent)
-	encodedResponse = strings.TrimRight(strings.TrimLeft(encodedResponse, "{ Content="), " }")
-	decodedByteArray, err := base64.StdEncoding.DecodeString(encodedResponse)
+	provider, err := auth.InstancePrincipalConfigurationProvider()
 	if err != nil {
-		panic("decoding value for key [" + secretOCID + "]: " + err.Error())
+		return common.DefaultConfigProvider()
 	}
+	return provider
+}
 
-	return string(decodedByteArray)
+// inputError is an input validation failure whose message is safe to return to the caller with a 400
+type inputError string
+
+func (e inputError) Error() string {
+	return string(e)
 }
 
 //
@@ -256,14 +548,11 @@ func outputHTTPError(message string, err error, res *http.Response) string {
 }
 
 //
-// Log error to console log.  We specify a particular format so that it can be parsed by the OCI Logging Service
+// Log error to console log.  We specify a particular format so that it can be parsed by the OCI Logging Service,
+// either the line below or, with LogFormat set to json, one JSON object per line (see writeLog)
 //
-// [datetime] [INFO|WARN|ERROR] [module] message
+// [datetime] [DEBUG|INFO|WARN|ERROR] [module] message
 //
 func logOutput(logType string, module string, message string) {
-	if logType != logInfo && logType != logWarn && logType != logError {
-		logType = logInfo
-	}
-	fmt.Printf("[%s] [%s] [%s] %s\n", time.Now().Format(time.RFC3339), logType, module, message)
-	return
+	writeLog(logRecord{Level: logType, Component: module, Message: message})
 }
@@ -0,0 +1,82 @@
+//  Manager Closure
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// the closure holds, for every user, each Manager-role user in their reporting tree (including themselves).
+// It is the materialized form of the START WITH useremail = :1 CONNECT BY PRIOR useremail = manager subquery
+// that the dashboard queries used to run on every request.
+const ecalClosureInsert = `INSERT INTO %SCHEMA%.ManagerClosure (manageremail, reportemail, depth)
+	SELECT CONNECT_BY_ROOT u.useremail, u.useremail, LEVEL - 1
+	FROM %SCHEMA%.User1 u
+	INNER JOIN %SCHEMA%.RoleType r ON u.rolename = r.id
+	WHERE r.rolename = 'Manager'
+	CONNECT BY NOCYCLE PRIOR u.useremail = u.manager`
+
+const stsClosureInsert = `INSERT INTO %SCHEMA%.ManagerClosure (manageremail, reportemail, depth)
+	SELECT CONNECT_BY_ROOT u.useremail, u.useremail, LEVEL - 1
+	FROM %SCHEMA%.STSUser u
+	INNER JOIN %SCHEMA%.STSRole r ON u.rolename = r.id
+	WHERE r.rolename = 'Manager'
+	CONNECT BY NOCYCLE PRIOR u.useremail = u.manager`
+
+//
+// Rebuild the ManagerClosure table in every configured schema.  Runs after each identity load; failures are
+// logged per schema so one broken environment doesn't stop the others from refreshing.
+//
+func refreshManagerClosures() {
+	for instanceEnv, schema := range schemaMapSnapshot() {
+		count, err := refreshManagerClosure(instanceEnv, schema)
+		if err != nil {
+			logOutput(logError, "manager_closure", err.Error())
+			continue
+		}
+		message := fmt.Sprintf("Refreshed ManagerClosure for %s (%s) with %d rows", instanceEnv, schema, count)
+		logOutput(logInfo, "manager_closure", message)
+	}
+}
+
+//
+// Rebuild the ManagerClosure table for a single schema inside a transaction so readers never see it empty
+//
+func refreshManagerClosure(instanceEnv string, schema string) (int64, error) {
+	template := stsClosureInsert
+	if strings.HasPrefix(instanceEnv, "ecal-") {
+		template = ecalClosureInsert
+	}
+
+	tx, err := DBPool.Begin()
+	if err != nil {
+		thisError := fmt.Sprintf("Error starting DB transaction (%s): %s", instanceEnv, err.Error())
+		return 0, errors.New(thisError)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM " + schema + ".ManagerClosure")
+	if err != nil {
+		thisError := fmt.Sprintf("Unable to delete from ManagerClosure (%s): %s", instanceEnv, err.Error())
+		return 0, errors.New(thisError)
+	}
+
+	result, err := tx.Exec(strings.ReplaceAll(template, "%SCHEMA%", schema))
+	if err != nil {
+		thisError := fmt.Sprintf("Unable to populate ManagerClosure (%s): %s", instanceEnv, err.Error())
+		return 0, errors.New(thisError)
+	}
+	count, _ := result.RowsAffected()
+
+	err = tx.Commit()
+	if err != nil {
+		thisError := fmt.Sprintf("Error committing ManagerClosure (%s): %s", instanceEnv, err.Error())
+		return 0, errors.New(thisError)
+	}
+
+	return count, nil
+}
@@ -5,36 +5,69 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 )
 
+// ManagerRecord is a user record for a manager returned by the hierarchy query
+type ManagerRecord struct {
+	Email   string `json:"email"`
+	Name    string `json:"name,omitempty"`
+	Manager string `json:"manager"`
+	Role    string `json:"role"`
+}
+
 //
-// HTTP handler for the getManagerQuery functionality
+// HTTP handler for the getManagerQuery functionality.  By default the result is a VBCS filter expression; passing
+// output=json returns the manager emails as a JSON array instead, and includeUsers=true adds their user records.
 //
 func getManagerQueryHandler(w http.ResponseWriter, r *http.Request) {
 	// get query parameters
 	query := r.URL.Query()
 	managerEmail := query.Get("managerEmail")
 	instanceEnv := query.Get("instanceEnvironment")
+	output := query.Get("output")
+	includeUsers := strings.ToLower(query.Get("includeUsers")) == "true"
+
+	// JSON output mode
+	if output == "json" {
+		result, err := getManagerQueryJSON(r.Context(), managerEmail, instanceEnv, includeUsers)
+		if queryCancelled(r.Context(), "mgr_query", err) {
+			return
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+			logRequest(r, logError, "mgr_query", string(err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(result)
+		return
+	}
 
 	// call the helper which does the data mashing
-	result, err := getManagerQuery(managerEmail, instanceEnv)
+	result, err := getManagerQuery(r.Context(), managerEmail, instanceEnv)
+	if queryCancelled(r.Context(), "mgr_query", err) {
+		return
+	}
 	if err != nil {
 		w.WriteHeader(500)
-		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator")
-		logOutput(logError, "mgr_query", string(err.Error()))
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "mgr_query", string(err.Error()))
 		return
 	}
 
 	// format the result as json
-	json := fmt.Sprintf("{\"query\":\"%s\"}", result)
+	json, _ := json.Marshal(map[string]string{"query": result})
 
 	// write result to output stream
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, string(json))
+	w.Write(json)
 }
 
 //
@@ -43,52 +76,157 @@ func getManagerQueryHandler(w http.ResponseWriter, r *http.Request) {
 // in the form of "manager = '".  In addition to the manager email, the instanceEnvironment identifier (dev-preview, prod-live, etc)
 // is required to key the name of the ATP schema to query
 //
-func getManagerQuery(managerEmail string, instanceEnv string) (string, error) {
-	// inject the correct schema name into the query
-	if len(instanceEnv) < 1 {
-		thisError := fmt.Sprintf("instanceEnvironment query parameter is invalid: instanceEnv=%s and managerEmail=%s", instanceEnv, managerEmail)
-		return "", errors.New(thisError)
+func getManagerQuery(ctx context.Context, managerEmail string, instanceEnv string) (string, error) {
+	managers, err := getManagerHierarchy(ctx, managerEmail, instanceEnv)
+	if err != nil {
+		return "", err
 	}
 
-	// based on the instanceEnvironment key, choose the right schema and query type
-	// depending on whether the caller is ECAL or STS and what environment we're in
-	var template string
-	if strings.HasPrefix(instanceEnv, "ecal-") {
-		template = GlobalConfig.ECALManagerHierarchyQuery
-	} else {
-		template = GlobalConfig.STSManagerHierarchyQuery
+	// add each manager to the query filter using the correct format
+	var queryString string
+	for _, userEmail := range managers {
+		queryString += fmt.Sprintf("manager = '%s' or ", userEmail)
+	}
+
+	// string the trailing 'or' field if it exists
+	queryString = strings.TrimSuffix(queryString, "or ")
+
+	// if we didn't get any results, just use the email address that was passed in for the query
+	// this shouldn't happen but if it does this will fail gracefully
+	if len(queryString) < 1 {
+		queryString = fmt.Sprintf("manager = '%s'", managerEmail)
+	}
+
+	logOutput(logInfo, "mgr_query", "Query for "+managerEmail+": "+queryString)
+	return queryString, nil
+}
+
+//
+// Returns the managers within a given manager's hierarchy as a JSON document of the form {"managers": [...]}.
+// If includeUsers is set, a "users" array with the user record of each manager is added.
+//
+func getManagerQueryJSON(ctx context.Context, managerEmail string, instanceEnv string, includeUsers bool) ([]byte, error) {
+	managers, err := getManagerHierarchy(ctx, managerEmail, instanceEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]interface{}{"managers": managers}
+	if includeUsers {
+		users, err := getManagerRecords(ctx, managerEmail, instanceEnv)
+		if err != nil {
+			return nil, err
+		}
+		result["users"] = users
+	}
+
+	return json.Marshal(result)
+}
+
+//
+// Returns the email addresses of all managers in a given manager's hierarchy (including the manager) by running the
+// configured ECAL or STS hierarchy query against the instanceEnvironment's schema.  Results are cached until the next
+// identity load.
+//
+func getManagerHierarchy(ctx context.Context, managerEmail string, instanceEnv string) ([]string, error) {
+	// the hierarchy only changes with the identity load so serve it from the cache when we can
+	if managers, ok := getCachedHierarchy(instanceEnv, managerEmail); ok {
+		return managers, nil
+	}
+
+	query, err := managerHierarchyQuery(managerEmail, instanceEnv)
+	if err != nil {
+		return nil, err
 	}
-	query := strings.ReplaceAll(template, "%SCHEMA%", SchemaMap[instanceEnv])
 
 	// run the query
-	rows, err := DBPool.Query(query, managerEmail)
+	rows, err := DBPool.QueryContext(ctx, query, managerEmail)
 	if err != nil {
 		thisError := fmt.Sprintf("Error running query: instanceEnv=%s and managerEmail=%s and error=%s", instanceEnv, managerEmail, err.Error())
-		return "", errors.New(thisError)
+		return nil, errors.New(thisError)
 	}
 	defer rows.Close()
 
-	var userEmail, queryString string
-
-	// step through each row returned and add to the query filter using the correct format
+	// step through each row returned and collect the manager emails
+	managers := []string{}
+	var userEmail string
 	for rows.Next() {
 		err := rows.Scan(&userEmail)
 		if err != nil {
 			thisError := fmt.Sprintf("Error scanning row: instanceEnv=%s and managerEmail=%s and error=%s", instanceEnv, managerEmail, err.Error())
-			return "", errors.New(thisError)
+			return nil, errors.New(thisError)
 		}
-		queryString += fmt.Sprintf("manager = '%s' or ", userEmail)
+		managers = append(managers, userEmail)
 	}
 
-	// string the trailing 'or' field if it exists
-	queryString = strings.TrimSuffix(queryString, "or ")
+	putCachedHierarchy(instanceEnv, managerEmail, managers)
+	return managers, nil
+}
 
-	// if we didn't get any results, just use the email address that was passed in for the query
-	// this shouldn't happen but if it does this will fail gracefully
-	if len(queryString) < 1 {
-		queryString = fmt.Sprintf("manager = '%s'", managerEmail)
+//
+// Returns the user records for all managers in a given manager's hierarchy
+//
+func getManagerRecords(ctx context.Context, managerEmail string, instanceEnv string) ([]ManagerRecord, error) {
+	hierarchy, err := managerHierarchyQuery(managerEmail, instanceEnv)
+	if err != nil {
+		return nil, err
 	}
 
-	logOutput(logInfo, "mgr_query", "Query for "+managerEmail+": "+queryString)
-	return queryString, nil
+	// ECAL and STS keep their users in different tables
+	var template string
+	if strings.HasPrefix(instanceEnv, "ecal-") {
+		template = `SELECT u.useremail, ' ', NVL(u.manager, ' '), NVL(r.rolename, ' ')
+			FROM %SCHEMA%.User1 u LEFT OUTER JOIN %SCHEMA%.RoleType r ON u.rolename = r.id
+			WHERE u.useremail IN (%HIERARCHY%) ORDER BY u.useremail`
+	} else {
+		template = `SELECT u.useremail, u.firstname || ' ' || u.lastname, NVL(u.manager, ' '), NVL(r.rolename, ' ')
+			FROM %SCHEMA%.STSUser u LEFT OUTER JOIN %SCHEMA%.STSRole r ON u.rolename = r.id
+			WHERE u.useremail IN (%HIERARCHY%) ORDER BY u.useremail`
+	}
+	query := strings.ReplaceAll(template, "%HIERARCHY%", hierarchy)
+	query = strings.ReplaceAll(query, "%SCHEMA%", lookupSchema(instanceEnv))
+
+	// run the query
+	rows, err := DBPool.QueryContext(ctx, query, managerEmail)
+	if err != nil {
+		thisError := fmt.Sprintf("Error running user query: instanceEnv=%s and managerEmail=%s and error=%s", instanceEnv, managerEmail, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	users := []ManagerRecord{}
+	for rows.Next() {
+		var user ManagerRecord
+		err := rows.Scan(&user.Email, &user.Name, &user.Manager, &user.Role)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning user row: instanceEnv=%s and managerEmail=%s and error=%s", instanceEnv, managerEmail, err.Error())
+			return nil, errors.New(thisError)
+		}
+		user.Name = strings.TrimSpace(user.Name)
+		user.Manager = strings.TrimSpace(user.Manager)
+		user.Role = strings.TrimSpace(user.Role)
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+//
+// Returns the hierarchy query for an instanceEnvironment with the schema name injected.  Based on the instanceEnvironment
+// key, choose the right query type depending on whether the caller is ECAL or STS.
+//
+func managerHierarchyQuery(managerEmail string, instanceEnv string) (string, error) {
+	// inject the correct schema name into the query
+	if len(instanceEnv) < 1 {
+		thisError := fmt.Sprintf("instanceEnvironment query parameter is invalid: instanceEnv=%s and managerEmail=%s", instanceEnv, managerEmail)
+		return "", errors.New(thisError)
+	}
+
+	var template string
+	if strings.HasPrefix(instanceEnv, "ecal-") {
+		template = GlobalConfig.ECALManagerHierarchyQuery
+	} else {
+		template = GlobalConfig.STSManagerHierarchyQuery
+	}
+	return strings.ReplaceAll(template, "%SCHEMA%", lookupSchema(instanceEnv)), nil
 }
@@ -0,0 +1,293 @@
+//  In-Memory Database Driver
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MemDB is a scripted stand-in for ATP.  Statements are matched against the registered expectations (in the order
+// they were added) and answered with canned rows or row counts, and every statement run is recorded so the
+// generated SQL and binds can be checked.  It backs --dev (see openDevStore) and the ECAL query handler tests.  It
+// is registered with database/sql as the "memdb" driver:
+//
+//	mem, db := NewMemDB()
+//	mem.ExpectQuery(`FROM \w+\.User1`, []string{"useremail"}, []interface{}{"a@b.com"})
+//	handler := getECALAccountQueryHandler(db)
+type MemDB struct {
+	lock           sync.Mutex
+	expectations   []*memExpectation
+	statements     []MemStatement
+	statementLimit int
+	onStatement    func(MemStatement)
+}
+
+// MemStatement is a statement run against a MemDB along with its bind values
+type MemStatement struct {
+	Query string
+	Args  []interface{}
+}
+
+type memExpectation struct {
+	pattern      *regexp.Regexp
+	columns      []string
+	rows         [][]driver.Value
+	rowsAffected int64
+	execOnly     bool
+	err          error
+}
+
+// registry of open MemDBs by data source name
+var memDBs = make(map[string]*MemDB)
+var memDBLock sync.Mutex
+
+var whitespacePattern = regexp.MustCompile(`\s+`)
+
+func init() {
+	sql.Register("memdb", memDriver{})
+}
+
+//
+// Creates an empty MemDB and a *sql.DB (which satisfies Store) connected to it
+//
+func NewMemDB() (*MemDB, *sql.DB) {
+	mem := &MemDB{}
+	memDBLock.Lock()
+	name := "memdb-" + strconv.Itoa(len(memDBs)+1)
+	memDBs[name] = mem
+	memDBLock.Unlock()
+
+	// sql.Open never fails for a registered driver; connections are only made on first use
+	db, _ := sql.Open("memdb", name)
+	return mem, db
+}
+
+//
+// Answers queries matching pattern (a regular expression run against the whitespace-collapsed SQL) with rows
+//
+func (m *MemDB) ExpectQuery(pattern string, columns []string, rows ...[]interface{}) {
+	expectation := &memExpectation{pattern: regexp.MustCompile(pattern), columns: columns}
+	for _, row := range rows {
+		values := []driver.Value{}
+		for _, value := range row {
+			values = append(values, value)
+		}
+		expectation.rows = append(expectation.rows, values)
+	}
+	m.add(expectation)
+}
+
+//
+// Answers statements run with Exec matching pattern with the given number of affected rows.  Queries never match
+// it, so a query without an expectation of its own fails rather than quietly returning nothing.
+//
+func (m *MemDB) ExpectExec(pattern string, rowsAffected int64) {
+	m.add(&memExpectation{pattern: regexp.MustCompile(pattern), rowsAffected: rowsAffected, execOnly: true})
+}
+
+//
+// Fails statements matching pattern with err
+//
+func (m *MemDB) ExpectError(pattern string, err error) {
+	m.add(&memExpectation{pattern: regexp.MustCompile(pattern), err: err})
+}
+
+//
+// Returns the statements run so far, oldest first
+//
+func (m *MemDB) Statements() []MemStatement {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]MemStatement{}, m.statements...)
+}
+
+//
+// Keeps only the last limit statements run (0 keeps them all, the default), for a MemDB that runs for a long time
+//
+func (m *MemDB) LimitStatements(limit int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.statementLimit = limit
+}
+
+//
+// Calls fn with each statement as it is run, e.g. to log them
+//
+func (m *MemDB) OnStatement(fn func(MemStatement)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.onStatement = fn
+}
+
+func (m *MemDB) add(expectation *memExpectation) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.expectations = append(m.expectations, expectation)
+}
+
+//
+// Records the statement and returns the first expectation that matches it, passing over the ExpectExec ones for a
+// query
+//
+func (m *MemDB) match(query string, args []driver.NamedValue, isQuery bool) (*memExpectation, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	query = strings.TrimSpace(whitespacePattern.ReplaceAllString(query, " "))
+	statement := MemStatement{Query: query}
+	for _, arg := range args {
+		statement.Args = append(statement.Args, arg.Value)
+	}
+	m.statements = append(m.statements, statement)
+	if m.statementLimit > 0 && len(m.statements) > m.statementLimit {
+		m.statements = append([]MemStatement{}, m.statements[len(m.statements)-m.statementLimit:]...)
+	}
+	if m.onStatement != nil {
+		m.onStatement(statement)
+	}
+
+	for _, expectation := range m.expectations {
+		if expectation.execOnly && isQuery {
+			continue
+		}
+		if expectation.pattern.MatchString(query) {
+			return expectation, expectation.err
+		}
+	}
+	return nil, fmt.Errorf("memdb: no expectation matches %s", query)
+}
+
+// memDriver and the types below implement the database/sql/driver interfaces on top of a MemDB
+type memDriver struct{}
+
+type memConn struct {
+	db *MemDB
+}
+
+type memStmt struct {
+	conn  *memConn
+	query string
+}
+
+type memTx struct{}
+
+type memResult struct {
+	rowsAffected int64
+}
+
+type memRows struct {
+	columns []string
+	rows    [][]driver.Value
+	next    int
+}
+
+func (memDriver) Open(name string) (driver.Conn, error) {
+	memDBLock.Lock()
+	defer memDBLock.Unlock()
+	db, ok := memDBs[name]
+	if !ok {
+		return nil, errors.New("memdb: unknown database " + name)
+	}
+	return &memConn{db: db}, nil
+}
+
+func (c *memConn) Prepare(query string) (driver.Stmt, error) {
+	return &memStmt{conn: c, query: query}, nil
+}
+
+func (c *memConn) Close() error {
+	return nil
+}
+
+func (c *memConn) Begin() (driver.Tx, error) {
+	return memTx{}, nil
+}
+
+// accept any bind value (including godror specific ones such as sql.Out) as-is
+func (c *memConn) CheckNamedValue(value *driver.NamedValue) error {
+	return nil
+}
+
+func (s *memStmt) Close() error {
+	return nil
+}
+
+func (s *memStmt) NumInput() int {
+	return -1
+}
+
+func (s *memStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *memStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *memStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	expectation, err := s.conn.db.match(s.query, args, false)
+	if err != nil {
+		return nil, err
+	}
+	return memResult{rowsAffected: expectation.rowsAffected}, nil
+}
+
+func (s *memStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	expectation, err := s.conn.db.match(s.query, args, true)
+	if err != nil {
+		return nil, err
+	}
+	return &memRows{columns: expectation.columns, rows: expectation.rows}, nil
+}
+
+func (memTx) Commit() error {
+	return nil
+}
+
+func (memTx) Rollback() error {
+	return nil
+}
+
+func (r memResult) LastInsertId() (int64, error) {
+	return 0, errors.New("memdb: LastInsertId is not supported")
+}
+
+func (r memResult) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+func (r *memRows) Columns() []string {
+	return r.columns
+}
+
+func (r *memRows) Close() error {
+	return nil
+}
+
+func (r *memRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
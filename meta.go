@@ -0,0 +1,108 @@
+//  Metadata Discovery
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// MetaEnvironment is a configured instance-environment, the app it belongs to and the endpoints that take it as
+// their instanceEnvironment
+type MetaEnvironment struct {
+	InstanceEnv string   `json:"instance_environment"`
+	App         string   `json:"app"`
+	Endpoints   []string `json:"endpoints"`
+}
+
+// MetaFormats describes how dates and timestamps are written and the formats the endpoints that offer a choice take
+type MetaFormats struct {
+	DateFormat      string              `json:"date_format"`
+	DateFormats     map[string]string   `json:"date_formats,omitempty"`
+	TimestampFormat string              `json:"timestamp_format"`
+	TimeZone        string              `json:"time_zone"`
+	Endpoints       map[string][]string `json:"endpoints"`
+}
+
+// the endpoints that take an instanceEnvironment, by the app whose instance-environments (ecal-*, sts-*) they accept
+var metaAppEndpoints = map[string][]string{
+	"ecal": {"getECALDataQuery", "getECALAccountQuery", "getECALOpportunityQuery", "getECALArtifactQuery", "getManagerQuery",
+		"getArtifact", "postArtifact", "uploadArtifact", "userAccountAssignment", "postOpportunityStatus", "opportunityTechHealth",
+		"opportunityWorkload", "opportunityHistory", "accountReviews", "getProductCatalog", "searchOpportunities", "getConsumptionVsPlan",
+		"getWinLoss", "getPipelineByTerritory", "getQuarterlyRollup", "getForecast", "generateDigest", "getAccountReport", "exports", "queries",
+		"exportECALWorkbook", "changes"},
+	"sts": {"getManagerQuery", "getSTSManagerDashboardSummary", "stsTask", "stsPath", "stsPathRequirement", "assignSTSPath"},
+}
+
+// the format parameter values accepted by the endpoints that have one, the first being the default
+var metaFormatEndpoints = map[string][]string{
+	"exports":          {"json", "csv"},
+	"getAccountReport": {"json", "pdf"},
+	"generateDigest":   {"json", "html"},
+}
+
+//
+// HTTP handler for the meta functionality.  Describes the instance-environments this instance serves and the
+// endpoints each can be passed to, how dates and timestamps are formatted and which optional capabilities are
+// configured, so client applications can configure themselves rather than hard-coding environment keys.
+//
+func getMetaHandler(w http.ResponseWriter, r *http.Request) {
+	environments := []MetaEnvironment{}
+	for instanceEnv := range schemaMapSnapshot() {
+		app := strings.SplitN(instanceEnv, "-", 2)[0]
+		endpoints, found := metaAppEndpoints[app]
+		if !found {
+			endpoints = []string{}
+		}
+		environments = append(environments, MetaEnvironment{InstanceEnv: instanceEnv, App: app, Endpoints: endpoints})
+	}
+	sort.Slice(environments, func(i, j int) bool { return environments[i].InstanceEnv < environments[j].InstanceEnv })
+
+	formats := MetaFormats{DateFormat: getOutputDateFormat(""), TimestampFormat: GlobalConfig.OutputTimestampFormat,
+		TimeZone: outputLocation.String(), Endpoints: metaFormatEndpoints}
+	if len(formats.TimestampFormat) < 1 {
+		formats.TimestampFormat = defaultOutputTimestampFormat
+	}
+	for _, entry := range strings.Split(GlobalConfig.OutputDateFormats, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) == 2 && len(strings.TrimSpace(parts[1])) > 0 {
+			if formats.DateFormats == nil {
+				formats.DateFormats = make(map[string]string)
+			}
+			formats.DateFormats[parts[0]] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	result, _ := json.Marshal(map[string]interface{}{
+		"environments":       environments,
+		"opportunity_target": GlobalConfig.ECALOpportunitySyncTarget,
+		"formats":            formats,
+		"limits":             map[string]int{"max_query_rows": maxQueryRows(), "query_cache_minutes": int(queryCacheTTL().Minutes())},
+		"capabilities":       metaCapabilities(),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+//
+// Returns which of the optional features this instance has been configured with
+//
+func metaCapabilities() map[string]bool {
+	return map[string]bool{
+		"artifacts":         ObjectStorage != nil && len(GlobalConfig.ArtifactBucket) > 0,
+		"count_only":        true,
+		"exports":           ObjectStorage != nil && len(GlobalConfig.ExportBucket) > 0,
+		"feed_pull":         len(GlobalConfig.IdentityFeedURL)+len(GlobalConfig.OpportunityFeedURL)+len(GlobalConfig.AccountFeedURL) > 0,
+		"head_counts":       true,
+		"identity_tokens":   len(GlobalConfig.IdentityTokenSecret) > 0,
+		"identity_versions": ObjectStorage != nil && len(GlobalConfig.IdentityVersionBucket) > 0,
+		"query_cache":       queryCacheTTL() > 0,
+		"replay_protection": GlobalConfig.ReplayProtection,
+		"report_scheduler":  GlobalConfig.ReportScheduler,
+		"webhooks":          len(GlobalConfig.WebhookURL) > 0,
+	}
+}
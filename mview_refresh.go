@@ -0,0 +1,66 @@
+//  Materialized View Refresh
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// prefix of the SYNC_METADATA data type each materialized view refresh is reported under (e.g. mview:MV_PIPELINE)
+const mviewDataType = "mview:"
+
+//
+// Returns the materialized views to refresh after a load into an instance-environment.  MViewRefresh in config.json
+// lists them per instance-env as "ecal-dev-stage:MV_ONE|MV_TWO,ecal-prod-live:MV_ONE".
+//
+func getMViewRefreshList(instanceEnv string) []string {
+	views := []string{}
+	for _, entry := range strings.Split(GlobalConfig.MViewRefresh, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 || parts[0] != instanceEnv {
+			continue
+		}
+		for _, view := range strings.Split(parts[1], "|") {
+			view = strings.ToUpper(strings.TrimSpace(view))
+			if len(view) > 0 {
+				views = append(views, view)
+			}
+		}
+	}
+	return views
+}
+
+//
+// Refreshes (DBMS_MVIEW.REFRESH, fast if possible and complete otherwise) each materialized view configured for the
+// instance-environment, one at a time so a broken view doesn't hold up the others.  The outcome of each refresh is
+// recorded in SYNC_METADATA and so shows up in /syncStatus under the data type mview:VIEW_NAME.
+//
+func refreshMaterializedViews(job *loadJob, instanceEnv string) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 {
+		return
+	}
+
+	for _, view := range getMViewRefreshList(instanceEnv) {
+		run := beginSyncRun(job, "mview_refresh", mviewDataType+view, schema, "")
+		if !schemaNamePattern.MatchString(view) {
+			run.fail(fmt.Sprintf("Invalid materialized view name in MViewRefresh (%s): %s", instanceEnv, view))
+			continue
+		}
+
+		start := time.Now()
+		_, err := DBPool.Exec("BEGIN DBMS_MVIEW.REFRESH(list => :1, method => '?', atomic_refresh => FALSE); END;", schema+"."+view)
+		if err != nil {
+			run.fail(fmt.Sprintf("Error refreshing materialized view %s.%s (%s): %s", schema, view, instanceEnv, err.Error()))
+			continue
+		}
+
+		run.complete(0, 0)
+		message := fmt.Sprintf("Refreshed materialized view %s.%s in %s", schema, view, time.Since(start).Round(time.Millisecond))
+		logOutput(logInfo, "mview_refresh", message)
+	}
+}
@@ -0,0 +1,217 @@
+//  Object Storage Helpers
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/common"
+	"github.com/oracle/oci-go-sdk/objectstorage"
+)
+
+// ObjectStorage is the OCI Object Storage client, nil if it could not be initialized at startup
+var ObjectStorage *objectstorage.ObjectStorageClient
+
+// matches the path portion of a native Object Storage URL: /n/{namespace}/b/{bucket}/o/{object}
+var objectURLPattern = regexp.MustCompile(`^/n/([^/]+)/b/([^/]+)/o/(.+)$`)
+
+// default lifetime of a pre-authenticated request when ArtifactURLTTLMinutes is not set
+const defaultArtifactURLTTL = 15 * time.Minute
+
+// objectLocation identifies a single object in Object Storage
+type objectLocation struct {
+	Namespace string
+	Bucket    string
+	Object    string
+}
+
+//
+// Create the global Object Storage client using the same provider chain as the Secrets Service
+//
+func initObjectStorage() error {
+	client, err := objectstorage.NewObjectStorageClientWithConfigurationProvider(getOCIConfigProvider())
+	if err != nil {
+		return err
+	}
+	ObjectStorage = &client
+	return nil
+}
+
+//
+// Parse a native Object Storage URL (https://objectstorage.{region}.oraclecloud.com/n/{ns}/b/{bucket}/o/{object})
+// into its namespace, bucket, and object name.  Returns an error if the URL does not point into Object Storage.
+//
+func parseObjectStorageURL(location string) (objectLocation, error) {
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return objectLocation{}, err
+	}
+
+	matches := objectURLPattern.FindStringSubmatch(parsed.EscapedPath())
+	if matches == nil {
+		return objectLocation{}, errors.New("not an Object Storage URL: " + location)
+	}
+
+	object, err := url.PathUnescape(matches[3])
+	if err != nil {
+		return objectLocation{}, err
+	}
+	return objectLocation{Namespace: matches[1], Bucket: matches[2], Object: object}, nil
+}
+
+//
+// Parse an object reference given either as oci://{bucket}@{namespace}/{object} or as a native Object Storage URL
+//
+func parseObjectStorageURI(location string) (objectLocation, error) {
+	if !strings.HasPrefix(location, "oci://") {
+		return parseObjectStorageURL(location)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(location, "oci://"), "/", 2)
+	bucket := strings.SplitN(parts[0], "@", 2)
+	if len(parts) < 2 || len(bucket) < 2 || len(bucket[0]) < 1 || len(bucket[1]) < 1 || len(parts[1]) < 1 {
+		return objectLocation{}, errors.New("not an oci://bucket@namespace/object URI: " + location)
+	}
+	return objectLocation{Namespace: bucket[1], Bucket: bucket[0], Object: parts[1]}, nil
+}
+
+//
+// Returns the native Object Storage URL for an object, escaping each path segment of the object name
+//
+func objectStorageURL(location objectLocation) string {
+	segments := strings.Split(location.Object, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return fmt.Sprintf("%s/n/%s/b/%s/o/%s", ObjectStorage.Host, location.Namespace, location.Bucket, strings.Join(segments, "/"))
+}
+
+//
+// Create a short-lived, read-only pre-authenticated request for an object and return its full URL and expiry time
+//
+func createObjectReadURL(ctx context.Context, location objectLocation) (string, time.Time, error) {
+	if ObjectStorage == nil {
+		return "", time.Time{}, errors.New("Object Storage client is not initialized")
+	}
+
+	// determine how long the URL should live
+	ttl := defaultArtifactURLTTL
+	if len(GlobalConfig.ArtifactURLTTLMinutes) > 0 {
+		minutes, err := strconv.Atoi(GlobalConfig.ArtifactURLTTLMinutes)
+		if err != nil {
+			return "", time.Time{}, errors.New("ArtifactURLTTLMinutes is invalid: " + err.Error())
+		}
+		ttl = time.Duration(minutes) * time.Minute
+	}
+	expires := time.Now().Add(ttl)
+
+	request := objectstorage.CreatePreauthenticatedRequestRequest{
+		NamespaceName: common.String(location.Namespace),
+		BucketName:    common.String(location.Bucket),
+		CreatePreauthenticatedRequestDetails: objectstorage.CreatePreauthenticatedRequestDetails{
+			Name:        common.String(fmt.Sprintf("cto-bizlogic-helper-%d", time.Now().UnixNano())),
+			ObjectName:  common.String(location.Object),
+			AccessType:  objectstorage.CreatePreauthenticatedRequestDetailsAccessTypeObjectread,
+			TimeExpires: &common.SDKTime{Time: expires},
+		},
+	}
+	response, err := ObjectStorage.CreatePreauthenticatedRequest(ctx, request)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return ObjectStorage.Host + *response.AccessUri, expires, nil
+}
+
+//
+// Stores body as an object, replacing any object of the same name
+//
+func putObject(ctx context.Context, location objectLocation, contentType string, body []byte) error {
+	if ObjectStorage == nil {
+		return errors.New("Object Storage client is not initialized")
+	}
+	_, err := ObjectStorage.PutObject(ctx, objectstorage.PutObjectRequest{
+		NamespaceName: common.String(location.Namespace),
+		BucketName:    common.String(location.Bucket),
+		ObjectName:    common.String(location.Object),
+		ContentLength: common.Int64(int64(len(body))),
+		ContentType:   common.String(contentType),
+		PutObjectBody: ioutil.NopCloser(bytes.NewReader(body)),
+	})
+	return err
+}
+
+//
+// Returns a reader over an object's content along with its size.  The caller must close the reader.
+//
+func getObject(ctx context.Context, location objectLocation) (io.ReadCloser, int64, error) {
+	if ObjectStorage == nil {
+		return nil, 0, errors.New("Object Storage client is not initialized")
+	}
+	response, err := ObjectStorage.GetObject(ctx, objectstorage.GetObjectRequest{
+		NamespaceName: common.String(location.Namespace),
+		BucketName:    common.String(location.Bucket),
+		ObjectName:    common.String(location.Object),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	size := int64(0)
+	if response.ContentLength != nil {
+		size = *response.ContentLength
+	}
+	return response.Content, size, nil
+}
+
+//
+// Returns every object in a bucket whose name starts with prefix, in name order, with its size and creation time
+//
+func listObjects(ctx context.Context, namespace string, bucket string, prefix string) ([]objectstorage.ObjectSummary, error) {
+	if ObjectStorage == nil {
+		return nil, errors.New("Object Storage client is not initialized")
+	}
+	objects := []objectstorage.ObjectSummary{}
+	request := objectstorage.ListObjectsRequest{
+		NamespaceName: common.String(namespace),
+		BucketName:    common.String(bucket),
+		Prefix:        common.String(prefix),
+		Fields:        common.String("name,size,timeCreated"),
+	}
+	for {
+		response, err := ObjectStorage.ListObjects(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, response.Objects...)
+		if response.NextStartWith == nil {
+			return objects, nil
+		}
+		request.Start = response.NextStartWith
+	}
+}
+
+//
+// Deletes an object
+//
+func deleteObject(ctx context.Context, location objectLocation) error {
+	if ObjectStorage == nil {
+		return errors.New("Object Storage client is not initialized")
+	}
+	_, err := ObjectStorage.DeleteObject(ctx, objectstorage.DeleteObjectRequest{
+		NamespaceName: common.String(location.Namespace),
+		BucketName:    common.String(location.Bucket),
+		ObjectName:    common.String(location.Object),
+	})
+	return err
+}
@@ -0,0 +1,307 @@
+//  Opportunity History
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the audit action recorded for changes made by the opportunity load
+const auditActionSync = "sync"
+
+// the Opportunity and OpportunityWorkload columns the opportunity load writes, in the order syncedOpportunityValues
+// and syncedWorkloadValues return them
+var syncedOpportunityFields = []string{"summary", "salesrep", "projectedarr", "projectedtcv", "opportunitystatus",
+	"anticipatedclosedate", "winprobability"}
+var syncedWorkloadFields = []string{"workloaddescription", "consumptionstartdate", "consumptionrampmonths", "workloadtype"}
+
+// syncedRow is the before and after state of an ECAL row the opportunity load writes
+type syncedRow struct {
+	before []sql.NullString
+	after  []string
+}
+
+// syncedWorkload identifies the ECAL Opportunity and OpportunityWorkload rows the load writes for a revenue line
+type syncedWorkload struct {
+	opportunityID int64
+	workloadID    int64
+}
+
+// opportunitySyncAudit follows the writes the opportunity load makes to the ECAL Opportunity and OpportunityWorkload
+// rows and audits each row whose values differ at the end of the load.  An opportunity with several revenue lines is
+// written once per line so only its final state is compared with where it started.
+type opportunitySyncAudit struct {
+	instanceEnv   string
+	workloads     map[string]syncedWorkload
+	opportunities map[int64]*syncedRow
+	workloadRows  map[int64]*syncedRow
+}
+
+// OpportunityHistory is an audit record of a change to an ECAL opportunity or one of its workloads
+type OpportunityHistory struct {
+	ID       int64           `json:"id"`
+	Entity   string          `json:"entity"`
+	EntityID string          `json:"entity_id"`
+	Action   string          `json:"action"`
+	Actor    string          `json:"actor"`
+	Detail   json.RawMessage `json:"detail"`
+	Created  string          `json:"created"`
+}
+
+//
+// Reads the current state of every ECAL opportunity workload before an opportunity load
+//
+func newOpportunitySyncAudit(tx *sql.Tx, instanceEnv string, schema string) (*opportunitySyncAudit, error) {
+	rows, err := tx.Query("SELECT o.id, w.id, o.opportunityid, w.workloadidentifier, " +
+		"o.summary, o.salesrep, TO_CHAR(o.projectedarr), TO_CHAR(o.projectedtcv), o.opportunitystatus, " +
+		"TO_CHAR(o.anticipatedclosedate, 'YYYY-MM-DD'), TO_CHAR(o.winprobability), " +
+		"w.workloaddescription, TO_CHAR(w.consumptionstartdate, 'YYYY-MM-DD'), TO_CHAR(w.consumptionrampmonths), w.workloadtype " +
+		"FROM " + schema + ".Opportunity o INNER JOIN " + schema + ".OpportunityWorkload w ON w.opportunity = o.id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	audit := &opportunitySyncAudit{instanceEnv: instanceEnv, workloads: make(map[string]syncedWorkload),
+		opportunities: make(map[int64]*syncedRow), workloadRows: make(map[int64]*syncedRow)}
+	for rows.Next() {
+		var ids syncedWorkload
+		var opportunityID, revenueLineID sql.NullString
+		opportunity := make([]sql.NullString, len(syncedOpportunityFields))
+		workload := make([]sql.NullString, len(syncedWorkloadFields))
+		err := rows.Scan(&ids.opportunityID, &ids.workloadID, &opportunityID, &revenueLineID,
+			&opportunity[0], &opportunity[1], &opportunity[2], &opportunity[3], &opportunity[4], &opportunity[5], &opportunity[6],
+			&workload[0], &workload[1], &workload[2], &workload[3])
+		if err != nil {
+			return nil, err
+		}
+		audit.workloads[opportunityID.String+"\x00"+revenueLineID.String] = ids
+		audit.opportunities[ids.opportunityID] = &syncedRow{before: normalizeSyncedAmounts(opportunity, 2, 3, 6)}
+		audit.workloadRows[ids.workloadID] = &syncedRow{before: normalizeSyncedAmounts(workload, 2)}
+	}
+	return audit, rows.Err()
+}
+
+//
+// Rounds the numeric columns at the given positions the same way syncedOpportunityValues does
+//
+func normalizeSyncedAmounts(values []sql.NullString, positions ...int) []sql.NullString {
+	for _, i := range positions {
+		if number, err := strconv.ParseFloat(strings.TrimSpace(values[i].String), 64); err == nil {
+			values[i].String = changeAmount(number)
+		}
+	}
+	return values
+}
+
+//
+// Returns the Opportunity values the load writes for a revenue line
+//
+func syncedOpportunityValues(summary string, salesRep string, arr float64, tcv float64, status string, closeDate string,
+	winProbability float64) []string {
+	return []string{summary, salesRep, changeAmount(arr), changeAmount(tcv), status, closeDate, changeAmount(winProbability)}
+}
+
+//
+// Returns the OpportunityWorkload values the load writes for a revenue line
+//
+func syncedWorkloadValues(description string, consumptionStartDate string, rampMonths float64, workloadType string) []string {
+	return []string{description, consumptionStartDate, changeAmount(rampMonths), workloadType}
+}
+
+//
+// Notes the values the load has just written for a revenue line.  Revenue lines without an ECAL workload aren't
+// written and are ignored.
+//
+func (a *opportunitySyncAudit) written(opportunityID string, revenueLineID string, opportunity []string, workload []string) {
+	ids, ok := a.workloads[opportunityID+"\x00"+revenueLineID]
+	if !ok {
+		return
+	}
+	a.opportunities[ids.opportunityID].after = opportunity
+	a.workloadRows[ids.workloadID].after = workload
+}
+
+//
+// Writes an audit record for every Opportunity and OpportunityWorkload row the load changed, with the before and
+// after value of each changed column.  Returns the number of rows audited.
+//
+func (a *opportunitySyncAudit) record(tx *sql.Tx) (int, error) {
+	audited := 0
+	for _, table := range []struct {
+		entity string
+		fields []string
+		rows   map[int64]*syncedRow
+	}{
+		{"Opportunity", syncedOpportunityFields, a.opportunities},
+		{"OpportunityWorkload", syncedWorkloadFields, a.workloadRows},
+	} {
+		ids := []int64{}
+		for id := range table.rows {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		for _, id := range ids {
+			row := table.rows[id]
+			if row.after == nil {
+				continue
+			}
+			changes := make(map[string]map[string]interface{})
+			for i, field := range table.fields {
+				if row.before[i].Valid && row.before[i].String == row.after[i] {
+					continue
+				}
+				if !row.before[i].Valid && len(row.after[i]) < 1 {
+					continue
+				}
+				var before interface{}
+				if row.before[i].Valid {
+					before = row.before[i].String
+				}
+				changes[field] = map[string]interface{}{"before": before, "after": row.after[i]}
+			}
+			if len(changes) == 0 {
+				continue
+			}
+			err := recordAudit(tx, a.instanceEnv, table.entity, strconv.FormatInt(id, 10), auditActionSync, "", changes)
+			if err != nil {
+				return audited, err
+			}
+			audited++
+		}
+	}
+	return audited, nil
+}
+
+//
+// HTTP handler for opportunityHistory.  Returns the audit trail of an ECAL opportunity, its workloads and its tech
+// health, newest first: the changes made by the opportunity load (action sync, actor cto_bizlogic_helper) alongside
+// those made through the write endpoints.
+//
+func getOpportunityHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	maxRows, err := getMaxRows(query.Get("maxRows"))
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	instanceEnv := query.Get("instanceEnvironment")
+	opportunityID := query.Get("opportunityId")
+
+	// an opportunity on an account the caller may not see is reported as not found
+	scope, err := requestAccess(r, DBPool, instanceEnv)
+	if queryCancelled(r.Context(), "opportunity_history", err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "opportunity_history", err.Error())
+		return
+	}
+
+	history, truncated, err := getOpportunityHistory(r.Context(), instanceEnv, scope, opportunityID, maxRows)
+	if queryCancelled(r.Context(), "opportunity_history", err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err == errOpportunityNotFound {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Opportunity not found")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "opportunity_history", err.Error())
+		return
+	}
+
+	result, _ := json.Marshal(map[string]interface{}{"opportunity_id": opportunityID, "items": history, "truncated": truncated})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+//
+// Returns up to maxRows audit records of the ECAL opportunity (Opportunity.id) and its workloads and tech health.
+// The bool is true if there were more.  An opportunity outside the caller's scope is errOpportunityNotFound.
+//
+func getOpportunityHistory(ctx context.Context, instanceEnv string, scope accessScope, opportunityID string, maxRows int) ([]OpportunityHistory, bool, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		return nil, false, inputError("instanceEnvironment query parameter is invalid")
+	}
+	id, err := strconv.ParseInt(opportunityID, 10, 64)
+	if err != nil {
+		return nil, false, inputError("opportunityId query parameter is invalid")
+	}
+
+	var exists int
+	existsQuery := "SELECT COUNT(*) FROM " + schema + ".Opportunity o WHERE o.id = :1"
+	args := []interface{}{id}
+	if condition, scopeArgs := scope.accountCondition("o.account", 2); len(condition) > 0 {
+		existsQuery += " AND " + strings.ReplaceAll(condition, "%SCHEMA%", schema)
+		args = append(args, scopeArgs...)
+	}
+	err = DBPool.QueryRowContext(ctx, existsQuery, args...).Scan(&exists)
+	if err != nil {
+		thisError := fmt.Sprintf("Error reading opportunity (%s, %d): %s", instanceEnv, id, err.Error())
+		return nil, false, errors.New(thisError)
+	}
+	if exists == 0 {
+		return nil, false, errOpportunityNotFound
+	}
+
+	rows, err := DBPool.QueryContext(ctx, "SELECT id, entity, entity_id, action, actor, detail, "+
+		"TO_CHAR(SYS_EXTRACT_UTC(created), 'YYYY-MM-DD HH24:MI:SS') FROM CTO_COMMON.AUDIT_LOG WHERE instance_env = :1 AND ("+
+		"(entity IN ('Opportunity', 'OpportunityTechHealth') AND entity_id = :2) OR "+
+		"(entity = 'OpportunityWorkload' AND entity_id IN (SELECT TO_CHAR(id) FROM "+schema+".OpportunityWorkload WHERE opportunity = :3))) "+
+		"ORDER BY id DESC", instanceEnv, opportunityID, id)
+	if err != nil {
+		thisError := fmt.Sprintf("Error querying opportunity history (%s, %d): %s", instanceEnv, id, err.Error())
+		return nil, false, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	history := []OpportunityHistory{}
+	for rows.Next() {
+		if len(history) >= maxRows {
+			return history, true, nil
+		}
+		var record OpportunityHistory
+		var detail sql.NullString
+		err := rows.Scan(&record.ID, &record.Entity, &record.EntityID, &record.Action, &record.Actor, &detail, &record.Created)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning opportunity history (%s, %d): %s", instanceEnv, id, err.Error())
+			return nil, false, errors.New(thisError)
+		}
+		record.Detail = json.RawMessage("null")
+		if detail.Valid && len(detail.String) > 0 {
+			record.Detail = json.RawMessage(detail.String)
+		}
+		record.Created = formatUTCTimestamp(record.Created)
+		history = append(history, record)
+	}
+	return history, false, rows.Err()
+}
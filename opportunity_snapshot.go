@@ -0,0 +1,346 @@
+//  Opportunity Snapshots
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the SYNC_METADATA data types snapshots are reported under: the capture after each opportunity load and backfills
+const snapshotDataType = "snapshot:" + opportunity
+const snapshotBackfillDataType = "backfill:" + opportunity
+
+// how a snapshot came to be: captured from LookupOpportunity after a load, or rebuilt from a historical feed file
+const (
+	snapshotFromLoad     = "load"
+	snapshotFromBackfill = "backfill"
+)
+
+// the date of a historical feed file is taken from its name, e.g. opportunity-2020-07-31.json or opp_20200731.json.gz
+var snapshotFileDatePattern = regexp.MustCompile(`(\d{4})-?(\d{2})-?(\d{2})`)
+
+// snapshotFile is a historical feed file and the day it was taken
+type snapshotFile struct {
+	object string
+	date   string
+}
+
+//
+// Records the Open and Won revenue lines of the instance-environment's LookupOpportunity in
+// CTO_COMMON.OPPORTUNITY_SNAPSHOT as of today (in OutputTimeZone), replacing any snapshot already taken today, so the
+// last load of each day is the one kept.  Runs after each opportunity load commits.
+//
+func captureOpportunitySnapshot(job *loadJob, instanceEnv string) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 {
+		return
+	}
+	run := beginSyncRun(job, "opportunity_snapshot", snapshotDataType, schema, "")
+	today := time.Now().In(outputLocation).Format(queryDateLayout)
+
+	tx, err := DBPool.Begin()
+	if err != nil {
+		run.fail(fmt.Sprintf("Error starting DB transaction (%s): %s", instanceEnv, err.Error()))
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM CTO_COMMON.OPPORTUNITY_SNAPSHOT WHERE schema_name = :1 AND snapshot_date = TO_DATE(:2, 'YYYY-MM-DD')",
+		schema, today)
+	if err != nil {
+		run.fail(fmt.Sprintf("Unable to replace today's opportunity snapshot (%s): %s", instanceEnv, err.Error()))
+		return
+	}
+	result, err := tx.Exec(`INSERT INTO CTO_COMMON.OPPORTUNITY_SNAPSHOT (schema_name, snapshot_date, opportunityid, revenuelineid,
+			opportunitystatus, anticipatedclosedate, winprobability, revenuepipelinek, revenuetcvk, revenueprobability, workloadamount,
+			l2territoryname, source, captured)
+		SELECT :1, TO_DATE(:2, 'YYYY-MM-DD'), opportunityid, revenuelineid, opportunitystatus, anticipatedclosedate, winprobability,
+			revenuepipelinek, revenuetcvk, revenueprobability, workloadamount, l2territoryname, :3, SYSTIMESTAMP
+		FROM `+schema+`.LookupOpportunity WHERE active = 1`, schema, today, snapshotFromLoad)
+	if err != nil {
+		run.fail(fmt.Sprintf("Unable to capture opportunity snapshot (%s): %s", instanceEnv, err.Error()))
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		run.fail(fmt.Sprintf("Error committing opportunity snapshot (%s): %s", instanceEnv, err.Error()))
+		return
+	}
+
+	rows, _ := result.RowsAffected()
+	run.complete(int(rows), int(rows))
+	logEnv(instanceEnv, logInfo, "opportunity_snapshot", fmt.Sprintf("Captured opportunity snapshot of %s with %d revenue lines", today, rows))
+}
+
+//
+// HTTP handler for admin/backfillSnapshots.  Rebuilds the opportunity snapshots of the days before snapshots were
+// captured from the dated opportunity feed files under a bucket prefix (oci://bucket@namespace/prefix).  The backfill
+// runs in the background as a load job whose id is returned; its outcome shows up in jobs and syncStatus.
+//
+func backfillSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	if len(instanceEnv) < 1 {
+		instanceEnv = GlobalConfig.ECALOpportunitySyncTarget
+	}
+	if len(lookupSchema(instanceEnv)) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "instanceEnvironment query parameter is invalid")
+		return
+	}
+	prefix, err := parseObjectStorageURI(query.Get("prefix"))
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "prefix must be oci://bucket@namespace/prefix")
+		return
+	}
+	if ObjectStorage == nil {
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "Object Storage is not available")
+		return
+	}
+
+	job := startLoad("snapshot_backfill", func(job *loadJob) { backfillSnapshots(job, instanceEnv, prefix) })
+	if job == nil {
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "The service is shutting down")
+		return
+	}
+	logRequest(r, logInfo, "opportunity_snapshot", fmt.Sprintf("START Backfilling opportunity snapshots of %s from %s (job %s)",
+		instanceEnv, query.Get("prefix"), job.ID))
+
+	result, _ := json.Marshal(map[string]string{"instance_environment": instanceEnv, "prefix": query.Get("prefix"), "status": "started", "job_id": job.ID})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(202)
+	w.Write(result)
+}
+
+//
+// Loads each dated feed file under prefix into the snapshot of its day, oldest first.  Files without a date in their
+// name are skipped, as are days that already have a snapshot captured after a load, since that is the better record
+// of the day.  A day backfilled before is replaced, so a backfill that stopped part way can simply be run again.
+//
+func backfillSnapshots(job *loadJob, instanceEnv string, prefix objectLocation) {
+	schema := lookupSchema(instanceEnv)
+	run := beginSyncRun(job, "opportunity_snapshot", snapshotBackfillDataType, schema, prefix.Object)
+	ctx := context.Background()
+
+	objects, err := listObjects(ctx, prefix.Namespace, prefix.Bucket, prefix.Object)
+	if err != nil {
+		run.fail(fmt.Sprintf("Error listing %s in %s: %s", prefix.Object, prefix.Bucket, err.Error()))
+		return
+	}
+	names := []string{}
+	for _, object := range objects {
+		if object.Name != nil {
+			names = append(names, *object.Name)
+		}
+	}
+	files, undated := datedSnapshotFiles(names)
+	if len(undated) > 0 {
+		logEnv(instanceEnv, logWarn, "opportunity_snapshot", fmt.Sprintf("Skipping files without a date in their name: %v", undated))
+	}
+
+	captured, err := capturedSnapshotDates(schema)
+	if err != nil {
+		run.fail(fmt.Sprintf("Error reading captured snapshot dates (%s): %s", instanceEnv, err.Error()))
+		return
+	}
+
+	read, loaded, days := 0, 0, 0
+	for _, file := range files {
+		if captured[file.date] {
+			logEnv(instanceEnv, logInfo, "opportunity_snapshot", fmt.Sprintf("Skipping %s, %s already has a captured snapshot", file.object, file.date))
+			continue
+		}
+		if shuttingDown() {
+			run.fail(fmt.Sprintf("Stopped backfilling at %s since the service is shutting down; run it again to finish", file.date))
+			return
+		}
+		fileRead, fileLoaded, err := backfillSnapshotFile(run, schema, objectLocation{Namespace: prefix.Namespace, Bucket: prefix.Bucket, Object: file.object}, file.date)
+		if err != nil {
+			run.fail(fmt.Sprintf("Error backfilling %s from %s (%s): %s", file.date, file.object, instanceEnv, err.Error()))
+			return
+		}
+		read += fileRead
+		loaded += fileLoaded
+		days++
+		logEnv(instanceEnv, logInfo, "opportunity_snapshot", fmt.Sprintf("Backfilled %s from %s with %d of %d revenue lines", file.date,
+			file.object, fileLoaded, fileRead))
+	}
+
+	run.complete(read, loaded)
+	message := fmt.Sprintf("DONE Backfilling %d days of opportunity snapshots of %s (%d revenue lines read, %d loaded)", days, instanceEnv, read, loaded)
+	logEnv(instanceEnv, logInfo, "opportunity_snapshot", message)
+}
+
+//
+// Returns the files whose names carry a valid date in date order, keeping the last in name order when two are of the
+// same day, along with the names of those that don't
+//
+func datedSnapshotFiles(names []string) ([]snapshotFile, []string) {
+	sort.Strings(names)
+	byDate := make(map[string]string)
+	undated := []string{}
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			continue
+		}
+		matches := snapshotFileDatePattern.FindAllStringSubmatch(path.Base(name), -1)
+		if len(matches) < 1 {
+			undated = append(undated, name)
+			continue
+		}
+		last := matches[len(matches)-1]
+		date := last[1] + "-" + last[2] + "-" + last[3]
+		if _, err := time.Parse(queryDateLayout, date); err != nil {
+			undated = append(undated, name)
+			continue
+		}
+		byDate[date] = name
+	}
+
+	files := []snapshotFile{}
+	for date, name := range byDate {
+		files = append(files, snapshotFile{object: name, date: date})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].date < files[j].date })
+	return files, undated
+}
+
+//
+// Returns the days of the schema that have a snapshot captured after a load
+//
+func capturedSnapshotDates(schema string) (map[string]bool, error) {
+	rows, err := DBPool.Query("SELECT DISTINCT TO_CHAR(snapshot_date, 'YYYY-MM-DD') FROM CTO_COMMON.OPPORTUNITY_SNAPSHOT "+
+		"WHERE schema_name = :1 AND source = :2", schema, snapshotFromLoad)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	dates := make(map[string]bool)
+	for rows.Next() {
+		var date string
+		if err := rows.Scan(&date); err != nil {
+			return nil, err
+		}
+		dates[date] = true
+	}
+	return dates, rows.Err()
+}
+
+//
+// Replaces the snapshot of date with the Open and Won revenue lines of one feed file, in the layout postReferenceData
+// takes ({"items": [...]}, gzipped if the name ends in .gz).  Returns the revenue lines read and loaded.
+//
+func backfillSnapshotFile(run *syncRun, schema string, location objectLocation, date string) (int, int, error) {
+	content, _, err := getObject(context.Background(), location)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer content.Close()
+	var reader io.Reader = content
+	if strings.HasSuffix(location.Object, ".gz") {
+		unzipped, err := gzip.NewReader(content)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer unzipped.Close()
+		reader = unzipped
+	}
+
+	// advance past {"items": [ to the records
+	decoder := json.NewDecoder(reader)
+	for _, expected := range []string{"{", "items", "["} {
+		token, err := decoder.Token()
+		if err != nil {
+			return 0, 0, err
+		}
+		if fmt.Sprint(token) != expected {
+			return 0, 0, errors.New("not an {\"items\": [...]} feed file")
+		}
+	}
+
+	tx, err := DBPool.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM CTO_COMMON.OPPORTUNITY_SNAPSHOT WHERE schema_name = :1 AND snapshot_date = TO_DATE(:2, 'YYYY-MM-DD')",
+		schema, date)
+	if err != nil {
+		return 0, 0, err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO CTO_COMMON.OPPORTUNITY_SNAPSHOT (schema_name, snapshot_date, opportunityid, revenuelineid,
+			opportunitystatus, anticipatedclosedate, winprobability, revenuepipelinek, revenuetcvk, revenueprobability, workloadamount,
+			l2territoryname, source, captured)
+		VALUES (:1, TO_DATE(:2, 'YYYY-MM-DD'), :3, :4, :5, TO_DATE(:6, 'YYYY-MM-DD'), :7, :8, :9, :10, :11, :12, :13, SYSTIMESTAMP)`)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stmt.Close()
+
+	// a feed can list a revenue line twice; the snapshot keeps the first
+	seen := make(map[string]bool)
+	read, loaded := 0, 0
+	for decoder.More() {
+		var opp OpportunityLookup
+		err := decoder.Decode(&opp)
+		if err != nil {
+			thisError := fmt.Sprintf("Error decoding revenue line %d: %s", read+1, err.Error())
+			return read, loaded, errors.New(thisError)
+		}
+		read++
+		run.recordProcessed()
+
+		key := opp.OppID + "|" + opp.RevenueLineID
+		if (opp.OppStatus != "Open" && opp.OppStatus != "Won") || len(opp.OppID) < 1 || seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		// the values are converted as processOpportunity converts them, so backfilled days line up with captured ones
+		revenuePipelineK, _ := strconv.ParseFloat(opp.RevenuePipelineK, 64)
+		revenueTCVK, _ := strconv.ParseFloat(opp.RevenueTCVK, 64)
+		workloadAmount, _ := strconv.ParseFloat(opp.WorkloadAmount, 64)
+		winProbability, _ := strconv.ParseInt(opp.WinProbability, 10, 64)
+		workloadProbability, _ := strconv.ParseInt(opp.RevenueProbability, 10, 64)
+		if workloadProbability == 0 {
+			workloadProbability = winProbability
+		}
+		closeDate := strings.Split(opp.CloseDate, "T")[0]
+		if _, err := time.Parse(queryDateLayout, closeDate); err != nil {
+			closeDate = ""
+		}
+		sanitizeFields(maxIDFieldLength, &opp.OppID, &opp.RevenueLineID, &opp.OppStatus)
+		sanitizeFields(maxNameFieldLength, &opp.L2TerritoryName)
+
+		_, err = stmt.Exec(schema, date, opp.OppID, opp.RevenueLineID, opp.OppStatus, closeDate, winProbability,
+			revenuePipelineK*1000, revenueTCVK*1000, workloadProbability, workloadAmount*1000, opp.L2TerritoryName, snapshotFromBackfill)
+		if err != nil {
+			return read, loaded, err
+		}
+		loaded++
+	}
+	return read, loaded, tx.Commit()
+}
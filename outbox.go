@@ -0,0 +1,223 @@
+//  Event Outbox
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// the events written to the outbox
+const (
+	eventTechHealthUpdated    = "techHealth.updated"
+	eventStatusPosted         = "opportunityStatus.posted"
+	eventSTSPathAssigned      = "stsPath.assigned"
+	eventOpportunitiesChanged = "opportunities.changed"
+)
+
+// outbox row states
+const (
+	outboxPending   = "PENDING"
+	outboxDelivered = "DELIVERED"
+	outboxFailed    = "FAILED"
+)
+
+// how often the dispatcher looks for events to deliver and how many it takes at a time
+const outboxPollInterval = 5 * time.Second
+const outboxBatchSize = 50
+
+// an event is retried with exponential backoff (starting at outboxRetryDelay, at most outboxMaxRetryDelay apart)
+// until it has failed outboxMaxAttempts times
+const outboxRetryDelay = 30 * time.Second
+const outboxMaxRetryDelay = time.Hour
+const outboxMaxAttempts = 10
+
+// how long delivered events are kept
+const outboxRetentionDays = 7
+
+// how long the webhook has to accept an event
+const webhookTimeout = 10 * time.Second
+
+// outboxEvent is the body POSTed to the webhook for each event
+type outboxEvent struct {
+	ID          int64           `json:"id"`
+	Type        string          `json:"type"`
+	InstanceEnv string          `json:"instance_environment"`
+	Created     string          `json:"created"`
+	Data        json.RawMessage `json:"data"`
+}
+
+//
+// Writes an event to CTO_COMMON.OUTBOX for the dispatcher to deliver to WebhookURL.  Pass the transaction making the
+// change the event describes so the event is only ever published if the change commits, and is never lost if the
+// service stops between the commit and the delivery.  Does nothing when WebhookURL isn't set.
+//
+func enqueueEvent(db QueryRunner, instanceEnv string, eventType string, data interface{}) error {
+	if len(GlobalConfig.WebhookURL) < 1 {
+		return nil
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO CTO_COMMON.OUTBOX (event_type, instance_env, payload, status, attempts, next_attempt, created) "+
+		"VALUES (:1, :2, :3, :4, 0, SYSTIMESTAMP, SYSTIMESTAMP)", eventType, instanceEnv, string(payload), outboxPending)
+	return err
+}
+
+//
+// Starts the goroutine that delivers the outbox to WebhookURL.  It can run on every instance; each event is locked
+// by the instance delivering it so only one of them sends it.
+//
+func startOutboxDispatcher() {
+	if len(GlobalConfig.WebhookURL) < 1 {
+		return
+	}
+	logOutput(logInfo, "outbox", "Starting event dispatcher for "+GlobalConfig.WebhookURL)
+
+	go func() {
+		client := &http.Client{Timeout: webhookTimeout}
+		lastPurge := time.Time{}
+		for {
+			time.Sleep(outboxPollInterval)
+			delivered, err := dispatchOutbox(client)
+			if err != nil {
+				logOutput(logError, "outbox", err.Error())
+			}
+			if delivered > 0 {
+				logOutput(logInfo, "outbox", fmt.Sprintf("Delivered %d events", delivered))
+			}
+
+			if time.Since(lastPurge) > time.Hour {
+				_, err = DBPool.Exec("DELETE FROM CTO_COMMON.OUTBOX WHERE status = :1 AND created < SYSTIMESTAMP - :2",
+					outboxDelivered, outboxRetentionDays)
+				if err != nil {
+					logOutput(logWarn, "outbox", "Unable to purge delivered events: "+err.Error())
+				}
+				lastPurge = time.Now()
+			}
+		}
+	}()
+}
+
+//
+// Delivers the events that are due, oldest first, and records the outcome of each.  Returns the number delivered.
+//
+func dispatchOutbox(client *http.Client) (int, error) {
+	tx, err := DBPool.Begin()
+	if err != nil {
+		return 0, errors.New("Error starting DB transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+
+	// SKIP LOCKED leaves the events another instance is delivering to that instance
+	rows, err := tx.Query("SELECT id, event_type, instance_env, payload, attempts, TO_CHAR(SYS_EXTRACT_UTC(created), 'YYYY-MM-DD HH24:MI:SS') "+
+		"FROM CTO_COMMON.OUTBOX WHERE status = :1 AND next_attempt <= SYSTIMESTAMP ORDER BY id FOR UPDATE SKIP LOCKED", outboxPending)
+	if err != nil {
+		return 0, errors.New("Error reading outbox: " + err.Error())
+	}
+	events := []outboxEvent{}
+	attempts := []int{}
+	for rows.Next() && len(events) < outboxBatchSize {
+		var event outboxEvent
+		var payload sql.NullString
+		var attempt int
+		err = rows.Scan(&event.ID, &event.Type, &event.InstanceEnv, &payload, &attempt, &event.Created)
+		if err != nil {
+			rows.Close()
+			return 0, errors.New("Error scanning outbox: " + err.Error())
+		}
+		event.Created = formatUTCTimestamp(event.Created)
+		event.Data = json.RawMessage("null")
+		if payload.Valid && len(payload.String) > 0 {
+			event.Data = json.RawMessage(payload.String)
+		}
+		events = append(events, event)
+		attempts = append(attempts, attempt)
+	}
+	rows.Close()
+
+	delivered := 0
+	for i, event := range events {
+		err := deliverEvent(client, event)
+		if err == nil {
+			_, err = tx.Exec("UPDATE CTO_COMMON.OUTBOX SET status = :1, attempts = attempts + 1, delivered = SYSTIMESTAMP, last_error = NULL WHERE id = :2",
+				outboxDelivered, event.ID)
+			if err != nil {
+				return delivered, errors.New("Error updating outbox: " + err.Error())
+			}
+			delivered++
+			continue
+		}
+
+		attempt := attempts[i] + 1
+		status := outboxPending
+		if attempt >= outboxMaxAttempts {
+			status = outboxFailed
+			logOutput(logError, "outbox", fmt.Sprintf("Giving up on event %d (%s) after %d attempts: %s", event.ID, event.Type, attempt, err.Error()))
+		} else {
+			logOutput(logWarn, "outbox", fmt.Sprintf("Unable to deliver event %d (%s), attempt %d: %s", event.ID, event.Type, attempt, err.Error()))
+		}
+		delay := time.Duration(math.Min(float64(outboxRetryDelay)*math.Pow(2, float64(attempt-1)), float64(outboxMaxRetryDelay)))
+		message := err.Error()
+		if len(message) > 1000 {
+			message = message[:1000]
+		}
+		_, err = tx.Exec("UPDATE CTO_COMMON.OUTBOX SET status = :1, attempts = :2, last_error = :3, "+
+			"next_attempt = SYSTIMESTAMP + NUMTODSINTERVAL(:4, 'SECOND') WHERE id = :5",
+			status, attempt, message, int(delay.Seconds()), event.ID)
+		if err != nil {
+			return delivered, errors.New("Error updating outbox: " + err.Error())
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return delivered, errors.New("Error committing outbox: " + err.Error())
+	}
+	return delivered, nil
+}
+
+//
+// POSTs an event to WebhookURL.  When WebhookSecret is set the body is signed with HMAC-SHA256 in the
+// X-Event-Signature header so the receiver can check it came from this service.  Any 2xx response is a delivery.
+//
+func deliverEvent(client *http.Client, event outboxEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, GlobalConfig.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Event-Id", fmt.Sprintf("%d", event.ID))
+	request.Header.Set("X-Event-Type", event.Type)
+	if len(GlobalConfig.WebhookSecret) > 0 {
+		mac := hmac.New(sha256.New, []byte(GlobalConfig.WebhookSecret))
+		mac.Write(body)
+		request.Header.Set("X-Event-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+//  Output Formats
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the date format used when neither OutputDateFormats nor OutputDateFormat covers an endpoint (ISO-8601)
+const defaultOutputDateFormat = "YYYY-MM-DD"
+
+// the format used for full timestamps when OutputTimestampFormat isn't set (ISO-8601 with the UTC offset)
+const defaultOutputTimestampFormat = "YYYY-MM-DDTHH24:MI:SSTZH:TZM"
+
+// the layouts the queries select dates (TO_CHAR(..., 'YYYY-MM-DD')) and timestamps (TO_CHAR(..., 'YYYY-MM-DD HH24:MI:SS'))
+// in before they are reformatted for output
+const queryDateLayout = "2006-01-02"
+const queryTimestampLayout = "2006-01-02 15:04:05"
+
+// OutputDateFormat(s) are written with the Oracle style tokens below; they are turned into a Go time layout here
+var dateFormatTokens = strings.NewReplacer("TZH:TZM", "-07:00", "YYYY", "2006", "MON", "Jan", "MM", "01", "DD", "02", "HH24", "15", "MI", "04", "SS", "05")
+
+// anything left in a converted layout (other than Jan and a T separator) that matches this wasn't a supported token
+var unknownDateTokenPattern = regexp.MustCompile(`[A-Za-z]`)
+
+// the zone the DATE columns are stored in (DBTimeZone) and the zone timestamps are returned in (OutputTimeZone).
+// Both are UTC until initOutputFormats loads the configured zones.
+var dbLocation = time.UTC
+var outputLocation = time.UTC
+
+//
+// Returns the date format configured for an endpoint (e.g. getECALOpportunityQuery).  OutputDateFormats entries
+// ("endpoint:FORMAT,endpoint:FORMAT") win over the global OutputDateFormat which wins over ISO-8601.
+//
+func getOutputDateFormat(endpoint string) string {
+	for _, entry := range strings.Split(GlobalConfig.OutputDateFormats, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) == 2 && parts[0] == endpoint && len(strings.TrimSpace(parts[1])) > 0 {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+	if len(GlobalConfig.OutputDateFormat) > 0 {
+		return GlobalConfig.OutputDateFormat
+	}
+	return defaultOutputDateFormat
+}
+
+//
+// Reformats a YYYY-MM-DD date read by one of the queries in the endpoint's output format.  Empty (NULL) dates stay
+// empty and anything that doesn't parse is passed through untouched.
+//
+func formatDate(endpoint string, value string) string {
+	if len(value) < 1 {
+		return value
+	}
+	date, err := time.Parse(queryDateLayout, value)
+	if err != nil {
+		return value
+	}
+	layout, err := dateLayout(getOutputDateFormat(endpoint))
+	if err != nil {
+		return value
+	}
+	return date.Format(layout)
+}
+
+//
+// Reformats a YYYY-MM-DD HH24:MI:SS timestamp read by one of the queries.  The value is taken to be in DBTimeZone and
+// is returned in OutputTimeZone using OutputTimestampFormat, which by default includes the offset so clients in other
+// regions can convert it to their own local time.
+//
+func formatTimestamp(value string) string {
+	if len(value) < 1 {
+		return value
+	}
+	timestamp, err := time.ParseInLocation(queryTimestampLayout, value, dbLocation)
+	if err != nil {
+		return value
+	}
+	format := GlobalConfig.OutputTimestampFormat
+	if len(format) < 1 {
+		format = defaultOutputTimestampFormat
+	}
+	layout, err := dateLayout(format)
+	if err != nil {
+		return value
+	}
+	return timestamp.In(outputLocation).Format(layout)
+}
+
+//
+// Reformats a YYYY-MM-DD HH24:MI:SS timestamp read in UTC, e.g. TO_CHAR(SYS_EXTRACT_UTC(col), ...) of a TIMESTAMP
+// WITH TIME ZONE column, the same way as formatTimestamp
+//
+func formatUTCTimestamp(value string) string {
+	timestamp, err := time.ParseInLocation(queryTimestampLayout, value, time.UTC)
+	if err != nil {
+		return value
+	}
+	return formatTimestamp(timestamp.In(dbLocation).Format(queryTimestampLayout))
+}
+
+//
+// Parses a timestamp passed in by a caller (e.g. updatedSince) and returns it in DBTimeZone as YYYY-MM-DD HH24:MI:SS
+// for comparing with DATE columns.  Accepts RFC 3339 with an offset (the default timestamp output format), or
+// YYYY-MM-DD HH:MI:SS and YYYY-MM-DD taken to be in OutputTimeZone.
+//
+func parseQueryTimestamp(value string) (string, error) {
+	// an unescaped + in the offset arrives as a space
+	if len(value) > 19 && value[19] == ' ' {
+		value = value[:19] + "+" + value[20:]
+	}
+	timestamp, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		timestamp, err = time.ParseInLocation(queryTimestampLayout, value, outputLocation)
+	}
+	if err != nil {
+		timestamp, err = time.ParseInLocation(queryDateLayout, value, outputLocation)
+	}
+	if err != nil {
+		return "", err
+	}
+	return timestamp.In(dbLocation).Format(queryTimestampLayout), nil
+}
+
+//
+// Returns a numeric column value as a JSON number, or null if it is empty or not a number.  Oracle can hand back
+// decimals without a leading zero (.5) which isn't valid JSON so those are normalized.
+//
+func jsonNumber(value string) string {
+	value = strings.TrimSpace(value)
+	if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return value
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsInf(number, 0) || math.IsNaN(number) {
+		return "null"
+	}
+	return strconv.FormatFloat(number, 'f', -1, 64)
+}
+
+// dbNumber is a numeric column scanned as text, marshalled as a JSON number (or null) the way jsonNumber writes it
+type dbNumber string
+
+func (n dbNumber) MarshalJSON() ([]byte, error) {
+	return []byte(jsonNumber(string(n))), nil
+}
+
+//
+// Loads DBTimeZone and OutputTimeZone and checks OutputTimestampFormat, OutputDateFormat and every OutputDateFormats
+// entry at startup so a typo doesn't show up as garbled dates
+//
+func initOutputFormats() error {
+	zones := []struct {
+		name     string
+		value    string
+		location **time.Location
+	}{
+		{"DBTimeZone", GlobalConfig.DBTimeZone, &dbLocation},
+		{"OutputTimeZone", GlobalConfig.OutputTimeZone, &outputLocation},
+	}
+	for _, zone := range zones {
+		if len(zone.value) < 1 {
+			continue
+		}
+		location, err := time.LoadLocation(zone.value)
+		if err != nil {
+			thisError := fmt.Sprintf("%s must be an IANA time zone such as Europe/London (%s): %s", zone.name, zone.value, err.Error())
+			return errors.New(thisError)
+		}
+		*zone.location = location
+	}
+
+	formats := []string{}
+	for _, format := range []string{GlobalConfig.OutputTimestampFormat, GlobalConfig.OutputDateFormat} {
+		if len(format) > 0 {
+			formats = append(formats, format)
+		}
+	}
+	for _, entry := range strings.Split(GlobalConfig.OutputDateFormats, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) < 1 {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[1])) < 1 {
+			thisError := fmt.Sprintf("OutputDateFormats entry must look like endpoint:FORMAT (%s)", entry)
+			return errors.New(thisError)
+		}
+		formats = append(formats, strings.TrimSpace(parts[1]))
+	}
+
+	for _, format := range formats {
+		if _, err := dateLayout(format); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dateLayout(format string) (string, error) {
+	layout := dateFormatTokens.Replace(format)
+	if unknownDateTokenPattern.MatchString(strings.NewReplacer("Jan", "", "T", "").Replace(layout)) {
+		thisError := fmt.Sprintf("Unsupported date format %s; use YYYY, MM, MON, DD, HH24, MI, SS, TZH:TZM and T", format)
+		return "", errors.New(thisError)
+	}
+	return layout, nil
+}
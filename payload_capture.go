@@ -0,0 +1,385 @@
+//  Payload Capture
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// how many captured requests are kept; the oldest is dropped to make room for the next
+const payloadCaptureEntries = 200
+
+// how much of each request and response body is kept
+const payloadCaptureMaxBytes = 64 * 1024
+
+// how long capture stays on for an endpoint when minutes isn't given, and the longest it can be turned on for
+const defaultPayloadCaptureMinutes = 60
+const maxPayloadCaptureMinutes = 24 * 60
+
+// the admin endpoint itself is never captured
+const payloadCaptureEndpoint = "admin/payloadCapture"
+
+// parameter and JSON field names whose values are always redacted, matched case-insensitively anywhere in the name
+var payloadSecretNames = []string{"password", "secret", "token", "authorization", "apikey", "api_key", "credential"}
+
+// matches a "name": "value" pair of a JSON body that was cut off and so can't be parsed to redact it field by field
+var payloadSecretPattern = regexp.MustCompile(`(?i)("[^"]*(?:password|secret|token|authorization|apikey|api_key|credential)[^"]*"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// PayloadCaptureRule turns capture on for one endpoint
+type PayloadCaptureRule struct {
+	Endpoint   string  `json:"endpoint"`
+	SampleRate float64 `json:"sample_rate"`
+	Minutes    int     `json:"minutes,omitempty"`
+	Expires    string  `json:"expires"`
+
+	expires time.Time
+}
+
+// CapturedPayload is one sampled request and the response it got, with the secrets redacted
+type CapturedPayload struct {
+	ID                int64               `json:"id"`
+	Time              string              `json:"time"`
+	Endpoint          string              `json:"endpoint"`
+	Client            string              `json:"client"`
+	Method            string              `json:"method"`
+	Parameters        map[string][]string `json:"parameters"`
+	RequestBody       string              `json:"request_body,omitempty"`
+	Status            int                 `json:"status"`
+	ResponseBody      string              `json:"response_body,omitempty"`
+	ResponseBytes     int                 `json:"response_bytes"`
+	ResponseTruncated bool                `json:"response_truncated"`
+	DurationMillis    int64               `json:"duration_ms"`
+}
+
+// the capture rules by endpoint and the ring of captured payloads, all guarded by payloadCaptureLock
+var payloadCaptureRules = make(map[string]*PayloadCaptureRule)
+var payloadCaptures []CapturedPayload
+var payloadCaptureNext int64 = 1
+var payloadCaptureLock sync.Mutex
+
+// captureWriter passes a sampled response through while keeping a copy of its status and the start of its body.
+// It embeds the usageWriter so rows are still counted and streamed responses still flush.
+type captureWriter struct {
+	*usageWriter
+	status  int
+	body    bytes.Buffer
+	written int
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+	cw.usageWriter.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(data []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	cw.written += len(data)
+	if room := payloadCaptureMaxBytes - cw.body.Len(); room > 0 {
+		if len(data) < room {
+			room = len(data)
+		}
+		cw.body.Write(data[:room])
+	}
+	return cw.usageWriter.Write(data)
+}
+
+// captureReader keeps a copy of the start of a sampled request's body as the handler reads it
+type captureReader struct {
+	io.ReadCloser
+	body bytes.Buffer
+}
+
+func (cr *captureReader) Read(data []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(data)
+	if room := payloadCaptureMaxBytes - cr.body.Len(); room > 0 && n > 0 {
+		if n < room {
+			room = n
+		}
+		cr.body.Write(data[:room])
+	}
+	return n, err
+}
+
+//
+// Runs the handler for an authenticated request, capturing the request and its response if capture is on for the
+// endpoint and the request is sampled.  Requests that aren't sampled go straight through.
+//
+func servePayloadCapture(pass handler, w *usageWriter, r *http.Request) {
+	endpoint := strings.Trim(r.URL.Path, "/")
+	if !samplePayloadCapture(endpoint) {
+		pass(w, r)
+		return
+	}
+
+	start := time.Now()
+	writer := &captureWriter{usageWriter: w}
+	var reader *captureReader
+	if r.Body != nil {
+		reader = &captureReader{ReadCloser: r.Body}
+		r.Body = reader
+	}
+	pass(writer, r)
+
+	capture := CapturedPayload{Time: start.Format(time.RFC3339), Endpoint: endpoint, Client: w.client, Method: r.Method,
+		Parameters: redactParameters(r.URL.Query()), Status: writer.status, ResponseBytes: writer.written,
+		ResponseTruncated: writer.written > writer.body.Len(), DurationMillis: time.Since(start).Milliseconds()}
+	if reader != nil {
+		capture.RequestBody = redactPayload(reader.body.Bytes(), r.Header.Get("Content-Type"))
+	}
+	capture.ResponseBody = redactPayload(writer.body.Bytes(), writer.Header().Get("Content-Type"))
+	recordPayloadCapture(capture)
+}
+
+//
+// True if capture is on for the endpoint and this request falls in its sample
+//
+func samplePayloadCapture(endpoint string) bool {
+	payloadCaptureLock.Lock()
+	defer payloadCaptureLock.Unlock()
+	rule, found := payloadCaptureRules[endpoint]
+	if !found {
+		return false
+	}
+	if time.Now().After(rule.expires) {
+		delete(payloadCaptureRules, endpoint)
+		logOutput(logInfo, "payload_capture", "Payload capture expired for "+endpoint)
+		return false
+	}
+	return rand.Float64() < rule.SampleRate
+}
+
+//
+// Adds a capture to the ring, dropping the oldest once it is full
+//
+func recordPayloadCapture(capture CapturedPayload) {
+	payloadCaptureLock.Lock()
+	defer payloadCaptureLock.Unlock()
+	capture.ID = payloadCaptureNext
+	payloadCaptureNext++
+	if len(payloadCaptures) >= payloadCaptureEntries {
+		payloadCaptures = payloadCaptures[1:]
+	}
+	payloadCaptures = append(payloadCaptures, capture)
+}
+
+//
+// True if a parameter or field name is one whose value must never be captured
+//
+func payloadSecretName(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range payloadSecretNames {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Returns a copy of the query parameters with the values of the secret ones redacted
+//
+func redactParameters(parameters map[string][]string) map[string][]string {
+	redacted := make(map[string][]string, len(parameters))
+	for name, values := range parameters {
+		if payloadSecretName(name) {
+			values = []string{redactedConfigValue}
+		}
+		redacted[name] = values
+	}
+	return redacted
+}
+
+//
+// Returns a captured body as text with its secrets redacted.  JSON bodies have the values of their secret fields
+// replaced wherever they are nested; bodies that were cut off are redacted by pattern instead.  Binary bodies (e.g.
+// PDF reports) are only described.
+//
+func redactPayload(body []byte, contentType string) string {
+	if len(body) < 1 {
+		return ""
+	}
+	if !utf8.Valid(body) || strings.HasPrefix(contentType, "application/pdf") {
+		return fmt.Sprintf("[%d bytes of %s]", len(body), contentType)
+	}
+
+	var document interface{}
+	if json.Unmarshal(body, &document) == nil {
+		redacted, err := json.Marshal(redactJSON(document))
+		if err == nil {
+			return string(redacted)
+		}
+	}
+	return payloadSecretPattern.ReplaceAllString(string(body), `${1}"`+redactedConfigValue+`"`)
+}
+
+func redactJSON(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for name, field := range typed {
+			if payloadSecretName(name) {
+				typed[name] = redactedConfigValue
+			} else {
+				typed[name] = redactJSON(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range typed {
+			typed[i] = redactJSON(item)
+		}
+	}
+	return value
+}
+
+//
+// HTTP handler for the admin/payloadCapture functionality.  GET returns the endpoints being captured and the captured
+// payloads, newest first (optionally only those of endpoint= and after afterId=).  POST turns capture on for an
+// endpoint from a JSON body of {"endpoint", "sample_rate", "minutes"} and DELETE (endpoint=) turns it off.  Only the
+// service credentials can use it since the captures hold other clients' data.
+//
+func payloadCaptureHandler(w http.ResponseWriter, r *http.Request) {
+	client, _, _ := r.BasicAuth()
+	if client != GlobalConfig.ServiceUsername {
+		w.WriteHeader(403)
+		fmt.Fprintf(w, "Payload capture is only available with the service credentials")
+		return
+	}
+
+	query := r.URL.Query()
+	var result interface{}
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		result, err = getPayloadCaptures(query.Get("endpoint"), query.Get("afterId"))
+	case http.MethodPost, http.MethodPut:
+		var rule PayloadCaptureRule
+		err = json.NewDecoder(r.Body).Decode(&rule)
+		if err != nil {
+			err = inputError("Unable to parse request body: " + err.Error())
+			break
+		}
+		result, err = startPayloadCapture(rule)
+	case http.MethodDelete:
+		err = stopPayloadCapture(query.Get("endpoint"))
+		result = map[string]string{"stopped": query.Get("endpoint")}
+	default:
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "payload_capture", err.Error())
+		return
+	}
+
+	output, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(output)
+}
+
+//
+// Turns capture on for an endpoint (e.g. getECALDataQuery) for the rule's sample of requests and minutes.  Turning it
+// on again replaces the previous rule.
+//
+func startPayloadCapture(rule PayloadCaptureRule) (PayloadCaptureRule, error) {
+	rule.Endpoint = strings.Trim(rule.Endpoint, "/")
+	if len(rule.Endpoint) < 1 || rule.Endpoint == payloadCaptureEndpoint {
+		return rule, inputError("endpoint is required and can't be " + payloadCaptureEndpoint)
+	}
+	if rule.SampleRate <= 0 || rule.SampleRate > 1 {
+		return rule, inputError("sample_rate must be greater than 0 and at most 1")
+	}
+	if rule.Minutes == 0 {
+		rule.Minutes = defaultPayloadCaptureMinutes
+	}
+	if rule.Minutes < 0 || rule.Minutes > maxPayloadCaptureMinutes {
+		return rule, inputError(fmt.Sprintf("minutes must be between 1 and %d", maxPayloadCaptureMinutes))
+	}
+	rule.expires = time.Now().Add(time.Duration(rule.Minutes) * time.Minute)
+	rule.Expires = rule.expires.Format(time.RFC3339)
+
+	payloadCaptureLock.Lock()
+	payloadCaptureRules[rule.Endpoint] = &rule
+	payloadCaptureLock.Unlock()
+
+	logOutput(logInfo, "payload_capture", fmt.Sprintf("Capturing %g of %s requests until %s", rule.SampleRate,
+		rule.Endpoint, rule.Expires))
+	return rule, nil
+}
+
+//
+// Turns capture off for an endpoint.  Its payloads already captured are kept.
+//
+func stopPayloadCapture(endpoint string) error {
+	endpoint = strings.Trim(endpoint, "/")
+	if len(endpoint) < 1 {
+		return inputError("endpoint query parameter is required")
+	}
+
+	payloadCaptureLock.Lock()
+	delete(payloadCaptureRules, endpoint)
+	payloadCaptureLock.Unlock()
+
+	logOutput(logInfo, "payload_capture", "Stopped capturing "+endpoint)
+	return nil
+}
+
+//
+// Returns the capture rules in effect and the captured payloads, newest first, optionally only those of one
+// endpoint and those after afterId
+//
+func getPayloadCaptures(endpoint string, afterID string) (map[string]interface{}, error) {
+	var after int64
+	if len(afterID) > 0 {
+		value, err := strconv.ParseInt(afterID, 10, 64)
+		if err != nil {
+			return nil, inputError("afterId query parameter is invalid")
+		}
+		after = value
+	}
+	endpoint = strings.Trim(endpoint, "/")
+
+	payloadCaptureLock.Lock()
+	defer payloadCaptureLock.Unlock()
+	rules := []PayloadCaptureRule{}
+	for _, rule := range payloadCaptureRules {
+		if time.Now().Before(rule.expires) {
+			rules = append(rules, *rule)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Endpoint < rules[j].Endpoint })
+
+	items := []CapturedPayload{}
+	for i := len(payloadCaptures) - 1; i >= 0; i-- {
+		capture := payloadCaptures[i]
+		if capture.ID > after && (len(endpoint) < 1 || capture.Endpoint == endpoint) {
+			items = append(items, capture)
+		}
+	}
+	return map[string]interface{}{"rules": rules, "items": items}, nil
+}
@@ -0,0 +1,150 @@
+//  PDF Writer
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// US letter page laid out in points
+const pdfPageWidth = 612
+const pdfPageHeight = 792
+const pdfMargin = 50
+
+// pdfDocument is a minimal text-only PDF (Helvetica, flowing lines and automatic page breaks).  It is all the reports
+// need and saves pulling a PDF library into the build.
+type pdfDocument struct {
+	pages []*bytes.Buffer
+	y     float64
+}
+
+func newPDFDocument() *pdfDocument {
+	doc := &pdfDocument{}
+	doc.newPage()
+	return doc
+}
+
+func (d *pdfDocument) newPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.y = pdfPageHeight - pdfMargin
+}
+
+//
+// Writes text in the given size, wrapped to the page width and indented by indent points.  bold uses Helvetica-Bold.
+//
+func (d *pdfDocument) write(text string, size float64, bold bool, indent float64) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	// Helvetica averages about half an em per character
+	width := int((pdfPageWidth - 2*pdfMargin - indent) / (size * 0.5))
+	for _, line := range wrapText(text, width) {
+		if d.y-size*1.4 < pdfMargin {
+			d.newPage()
+		}
+		d.y -= size * 1.4
+		fmt.Fprintf(d.pages[len(d.pages)-1], "BT /%s %.1f Tf %.1f %.1f Td (%s) Tj ET\n", font, size, pdfMargin+indent, d.y, pdfEscape(line))
+	}
+}
+
+func (d *pdfDocument) heading(text string) {
+	d.y -= 6
+	d.write(text, 14, true, 0)
+}
+
+func (d *pdfDocument) text(text string, indent float64) {
+	d.write(text, 10, false, indent)
+}
+
+//
+// Returns the finished document
+//
+func (d *pdfDocument) bytes() []byte {
+	var out bytes.Buffer
+	offsets := []int{}
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n")
+	kids := []string{}
+	for i := range d.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 5+i*2))
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, page := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, 6+i*2))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+//
+// Escapes text for a PDF string; characters outside Latin-1 can't be shown by the standard fonts and become '?'
+//
+func pdfEscape(text string) string {
+	var out strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			out.WriteRune('\\')
+			out.WriteRune(r)
+		case r < 32:
+			out.WriteRune(' ')
+		case r < 128:
+			out.WriteRune(r)
+		case r < 256:
+			fmt.Fprintf(&out, "\\%03o", r)
+		default:
+			out.WriteRune('?')
+		}
+	}
+	return out.String()
+}
+
+//
+// Splits text into lines of at most width characters at word boundaries
+//
+func wrapText(text string, width int) []string {
+	lines := []string{}
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			for len([]rune(word)) > width {
+				if len(line) > 0 {
+					lines = append(lines, line)
+					line = ""
+				}
+				lines = append(lines, string([]rune(word)[:width]))
+				word = string([]rune(word)[width:])
+			}
+			if len(line) > 0 && len([]rune(line))+1+len([]rune(word)) > width {
+				lines = append(lines, line)
+				line = ""
+			}
+			if len(line) > 0 {
+				line += " "
+			}
+			line += word
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,22 @@
+//  Post-Load Hooks
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+//
+// Runs the work that depends on freshly loaded lookup data once a load of rows rows into table in instanceEnv has
+// committed.  The table's statistics are gathered first so everything after it gets plans for the new data, then
+// materialized views are refreshed since the dashboard queries warmed and the analytics datasets published afterwards
+// may read from them.  An opportunity load is also kept as the day's opportunity snapshot.  Each step reports its
+// outcome to job, the post_load load job.
+//
+func runPostLoadHooks(job *loadJob, instanceEnv string, table string, rows int) {
+	if table == "LookupOpportunity" {
+		captureOpportunitySnapshot(job, instanceEnv)
+	}
+	gatherTableStats(job, instanceEnv, table, rows)
+	refreshMaterializedViews(job, instanceEnv)
+	warmQueryCache()
+	publishAnalyticsDatasets(job, instanceEnv)
+}
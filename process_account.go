@@ -7,11 +7,13 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"strings"
+	"time"
 )
 
 // AccountLookup Represents an account returned from the corporate feed
@@ -32,22 +34,31 @@ type AccountLookup struct {
 const paygo = "PAYGO"
 
 //
-// Process accounts from JSON file to LookupAccount table
+// Process accounts from JSON file to LookupAccount table.  A scoped load only refreshes the accounts in scope.
 //
-func processAccount(filename string) {
+func processAccount(job *loadJob, filename string, scope loadScope) {
 
 	// determine appropriate instance-environment based on the value of the config.json setting
-	schema := SchemaMap[GlobalConfig.ECALOpportunitySyncTarget]
+	schema := lookupSchema(GlobalConfig.ECALOpportunitySyncTarget)
+	run := beginSyncRun(job, "process_account", scope.dataType(account), schema, filename)
 	if len(schema) < 1 {
-		logOutput(logError, "process_account", "Schema for "+GlobalConfig.ECALOpportunitySyncTarget+" not valid")
+		run.fail("Schema for " + GlobalConfig.ECALOpportunitySyncTarget + " not valid")
 		return
 	}
 
+	// only one load of the feed into the schema runs at a time, across every instance
+	lock, err := acquireSyncLock(account, schema)
+	if err != nil {
+		run.fail(err.Error())
+		return
+	}
+	defer lock.release()
+
 	// open file for reading
 	file, err := os.Open(filename)
 	if err != nil {
 		message := fmt.Sprintf("Error opening file (%s): %s", filename, err.Error())
-		logOutput(logError, "process_account", message)
+		run.fail(message)
 		return
 	}
 	defer file.Close()
@@ -56,43 +67,75 @@ func processAccount(filename string) {
 	_, err = file.Seek(10, io.SeekStart)
 	if err != nil {
 		message := fmt.Sprintf("Error advancing file stream to position 10: %s", err.Error())
-		logOutput(logError, "process_account", message)
+		run.fail(message)
+		return
+	}
+
+	// make sure the feed still carries the fields we depend on before touching the database
+	err = validateFeedContract(account, filename)
+	if err != nil {
+		run.fail(err.Error())
 		return
 	}
 
 	// decode full account list from response
 	decoder := json.NewDecoder(file)
-	logOutput(logInfo, "process_account", "START Processing accounts ("+GlobalConfig.ECALOpportunitySyncTarget+")")
+	logEnv(GlobalConfig.ECALOpportunitySyncTarget, logInfo, "process_account", fmt.Sprintf("START Processing accounts (%s, %s)", GlobalConfig.ECALOpportunitySyncTarget, scope))
 
 	// start a DB transaction
 	tx, err := DBPool.Begin()
 	defer tx.Rollback()
 	if err != nil {
 		message := fmt.Sprintf("Error creating DB transaction (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
-		logOutput(logError, "process_account", message)
+		run.fail(message)
 		return
 	}
 
-	// delete all data from LookupAccount table
-	_, err = tx.Exec("DELETE FROM " + schema + ".LookupAccount")
+	// rows are no longer deleted and reloaded.  Accounts in the feed are updated in place (or added after the
+	// current highest id) and stamped with loadTime; accounts that dropped out of the feed are deactivated.
+	loadTime := time.Now()
+	baseID, err := maxLookupID(tx, schema+".LookupAccount")
 	if err != nil {
-		message := fmt.Sprintf("Unable to delete from LookupAccount (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
-		logOutput(logError, "process_account", message)
+		message := fmt.Sprintf("Unable to read max id from LookupAccount (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
 		return
 	}
 
-	// prepare insert statement
-	query := "INSERT INTO " + schema + ".LookupAccount" +
+	// remember each account's CIM parent so accounts that move to another parent can be flagged for review
+	parents, err := readCimParents(tx, schema)
+	if err != nil {
+		message := fmt.Sprintf("Unable to read CIM parents from LookupAccount (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+	moved := []cimParentChange{}
+
+	// prepare update & insert statements
+	query := "UPDATE " + schema + ".LookupAccount SET " +
+		"CimParentId = :1, AccountName = :2, BusinessSegment = :3, EndUserRegistryId = :4, GlobalRegistryId = :5, " +
+		"RegistryIdList = :6, NacSeTeam = :7, NatSeTeam = :8, CimIDReg = :9, " +
+		"active = 1, deactivateddate = null, deactivationreason = null, lastseendate = :10, " +
+		"lastupdatedate = SYSDATE, lastupdatedby = 'cto_bizlogic_helper' " +
+		"WHERE CimId = :11"
+	updateStmt, err := tx.Prepare(query)
+	defer updateStmt.Close()
+	if err != nil {
+		message := fmt.Sprintf("Unable to prepare statement for update (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	query = "INSERT INTO " + schema + ".LookupAccount" +
 		"(id, creationdate, lastupdatedate, createdby, lastupdatedby, abcschangenumber, " +
 		"CimId, CimParentId, AccountName, BusinessSegment, EndUserRegistryId, GlobalRegistryId, " +
-		"RegistryIdList, NacSeTeam, NatSeTeam, CimIDReg) " +
+		"RegistryIdList, NacSeTeam, NatSeTeam, CimIDReg, active, lastseendate) " +
 		"VALUES(:1, SYSDATE, SYSDATE, 'cto_bizlogic_helper', 'cto_bizlogic_helper', null, " +
-		":2, :3, :4, :5, :6, :7, :8, :9, :10, :11)"
+		":2, :3, :4, :5, :6, :7, :8, :9, :10, :11, 1, :12)"
 	insertStmt, err := tx.Prepare(query)
 	defer insertStmt.Close()
 	if err != nil {
 		message := fmt.Sprintf("Unable to prepare statement for insert (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
-		logOutput(logError, "process_account", message)
+		run.fail(message)
 		return
 	}
 
@@ -100,11 +143,12 @@ func processAccount(filename string) {
 	_, err = decoder.Token()
 	if err != nil {
 		message := fmt.Sprintf("Error decoding opening array token (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
-		logOutput(logError, "process_account", message)
+		run.fail(message)
 		return
 	}
 
 	// iterate each account
+	quality := newFeedQuality(account, schema, "account_name", "bus_segment_str", "end_user_registry_id")
 	counter := 1
 	loaded := 0
 	for decoder.More() {
@@ -114,27 +158,57 @@ func processAccount(filename string) {
 		if err != nil {
 			message := fmt.Sprintf("Error decoding account (%s) %d: %s",
 				GlobalConfig.ECALOpportunitySyncTarget, counter, err.Error())
-			logOutput(logError, "process_account", message)
+			run.fail(message)
 			return
 		}
+		run.recordProcessed()
+
+		// score the record as it came in the feed
+		quality.addRecord(map[string]string{"account_name": account.AccountName, "bus_segment_str": account.BusinessSegment,
+			"end_user_registry_id": account.EndUserRegistryID})
+		quality.checkCIMID(account.CimID)
 
 		// perform any data adjustments necessary
 		account.NacSeTeam = tokenizeSeList(account.NacSeTeam)
 		account.NatSeTeam = tokenizeSeList(account.NatSeTeam)
 		account.BusinessSegment = collapseBusinessSegment(account.BusinessSegment)
-		account.AccountName = strings.ReplaceAll(account.AccountName, "\"", "")
+		sanitizeFields(maxIDFieldLength, &account.CimID, &account.CimParentID, &account.EndUserRegistryID, &account.GlobalRegistryID)
+		sanitizeFields(maxNameFieldLength, &account.AccountName, &account.BusinessSegment, &account.NacSeTeam, &account.NatSeTeam)
+		sanitizeFields(maxLongFieldLength, &account.RegistryIDList)
+		sanitizeFields(200, &account.CimIDReg)
 
-		// add account to LookupAccount staging table
+		// a scoped load leaves other accounts alone
+		if !scope.includes(account.CimID) {
+			continue
+		}
+
+		// add or refresh the account in the LookupAccount staging table
 		if account.BusinessSegment != paygo {
-			_, err = insertStmt.Exec(counter, account.CimID, account.CimParentID, account.AccountName, account.BusinessSegment,
+			if parent, found := parents[account.CimID]; found && parent != account.CimParentID {
+				moved = append(moved, cimParentChange{cimID: account.CimID, oldParent: parent, newParent: account.CimParentID})
+			}
+			var result sql.Result
+			result, err = updateStmt.Exec(account.CimParentID, account.AccountName, account.BusinessSegment,
 				account.EndUserRegistryID, account.GlobalRegistryID, account.RegistryIDList, account.NacSeTeam, account.NatSeTeam,
-				account.CimIDReg)
+				account.CimIDReg, loadTime, account.CimID)
+			if err == nil {
+				if updated, _ := result.RowsAffected(); updated == 0 {
+					_, err = insertStmt.Exec(baseID+int64(counter), account.CimID, account.CimParentID, account.AccountName, account.BusinessSegment,
+						account.EndUserRegistryID, account.GlobalRegistryID, account.RegistryIDList, account.NacSeTeam, account.NatSeTeam,
+						account.CimIDReg, loadTime)
+					run.inserted++
+				} else {
+					run.updated++
+				}
+			}
 			loaded++
+		} else {
+			run.rejected++
 		}
 		if err != nil {
 			message := fmt.Sprintf("Unable to insert account %s into LookupAccount (%s): %s", account.AccountName,
 				GlobalConfig.ECALOpportunitySyncTarget, err.Error())
-			logOutput(logError, "process_account", message)
+			run.fail(message)
 			return
 		}
 
@@ -145,22 +219,56 @@ func processAccount(filename string) {
 	_, err = decoder.Token()
 	if err != nil {
 		message := fmt.Sprintf("Error decoding closing array token (%s): %s\n", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
-		logOutput(logError, "process_account", message)
+		run.fail(message)
+		return
+	}
+
+	// deactivate accounts that weren't in this feed
+	vanished, err := deactivateVanished(tx, schema+".LookupAccount", loadTime, scope)
+	if err != nil {
+		message := fmt.Sprintf("Unable to deactivate vanished accounts in LookupAccount (%s): %s",
+			GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	// flag the ECAL accounts on CIM accounts that moved to another parent along with the load
+	flagged, err := flagCimParentChanges(tx, schema, moved)
+	if err != nil {
+		message := fmt.Sprintf("Unable to flag accounts for review (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
 		return
 	}
 
+	// record the data quality of the feed along with the load; a scoped load hasn't scored the whole feed
+	if scope.full() {
+		err = quality.save(tx)
+		if err != nil {
+			logEnv(GlobalConfig.ECALOpportunitySyncTarget, logWarn, "process_account", "Unable to record feed quality: "+err.Error())
+		}
+	}
+
 	// complete the transaction
 	err = tx.Commit()
 	if err != nil {
 		message := fmt.Sprintf("Error committing transaction (%s): %s\n",
 			GlobalConfig.ECALOpportunitySyncTarget, err.Error())
-		logOutput(logError, "process_account", message)
+		run.fail(message)
 		return
 	}
 
-	message := fmt.Sprintf("DONE Processing %d accounts and loaded %d for %s\n",
-		counter, loaded, GlobalConfig.ECALOpportunitySyncTarget)
-	logOutput(logInfo, "process_account", message)
+	// drop the cached dashboard queries now so nobody is served results from before the load, then refresh
+	// anything derived from the lookups (materialized views, cached dashboard queries) in the background
+	invalidateQueryCacheFor(GlobalConfig.ECALOpportunitySyncTarget)
+	rows := counter - 1
+	startLoad("post_load", func(job *loadJob) {
+		runPostLoadHooks(job, GlobalConfig.ECALOpportunitySyncTarget, "LookupAccount", rows)
+	})
+
+	run.complete(counter-1, loaded)
+	message := fmt.Sprintf("DONE Processing %d accounts and loaded %d (%d vanished, %d moved to another CIM parent, %d ECAL accounts flagged for review) for %s (%s)\n",
+		counter, loaded, vanished, len(moved), flagged, GlobalConfig.ECALOpportunitySyncTarget, scope)
+	logEnv(GlobalConfig.ECALOpportunitySyncTarget, logInfo, "process_account", message)
 }
 
 //
@@ -0,0 +1,219 @@
+//  ProcessConsumption
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConsumptionLookup represents one month of actual usage of a customer subscription returned from the corporate feed
+type ConsumptionLookup struct {
+	CimID          string `json:"cim_id"`
+	CustomerName   string `json:"customer_name"`
+	SubscriptionID string `json:"subscription_id"`
+	UsageMonth     string `json:"usage_month"`
+	ActualUsage    string `json:"actual_usage"`
+	CurrencyCode   string `json:"currency_code"`
+}
+
+//
+// Process monthly consumption from JSON file to LookupConsumption table.  Rows are keyed by CIM ID, subscription and
+// month and updated in place.  The feed only carries recent months so, unlike the other lookups, rows that aren't in
+// a load are kept as history rather than deactivated.
+//
+func processConsumption(job *loadJob, filename string) {
+
+	// determine appropriate instance-environment based on the value of the config.json setting
+	schema := lookupSchema(GlobalConfig.ECALOpportunitySyncTarget)
+	run := beginSyncRun(job, "process_consumption", consumption, schema, filename)
+	if len(schema) < 1 {
+		run.fail("Schema for " + GlobalConfig.ECALOpportunitySyncTarget + " not valid")
+		return
+	}
+
+	// only one load of the feed into the schema runs at a time, across every instance
+	lock, err := acquireSyncLock(consumption, schema)
+	if err != nil {
+		run.fail(err.Error())
+		return
+	}
+	defer lock.release()
+
+	// open file for reading
+	file, err := os.Open(filename)
+	if err != nil {
+		message := fmt.Sprintf("Error opening file (%s): %s", filename, err.Error())
+		run.fail(message)
+		return
+	}
+	defer file.Close()
+
+	// seek 10 bytes (chars) to advance past {"items":
+	_, err = file.Seek(10, io.SeekStart)
+	if err != nil {
+		message := fmt.Sprintf("Error advancing file stream to position 10: %s", err.Error())
+		run.fail(message)
+		return
+	}
+
+	// make sure the feed still carries the fields we depend on before touching the database
+	err = validateFeedContract(consumption, filename)
+	if err != nil {
+		run.fail(err.Error())
+		return
+	}
+
+	// decode full consumption list from response
+	decoder := json.NewDecoder(file)
+	logEnv(GlobalConfig.ECALOpportunitySyncTarget, logInfo, "process_consumption", "START Processing consumption ("+GlobalConfig.ECALOpportunitySyncTarget+")")
+
+	// start a DB transaction
+	tx, err := DBPool.Begin()
+	defer tx.Rollback()
+	if err != nil {
+		message := fmt.Sprintf("Error creating DB transaction (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	loadTime := time.Now()
+	baseID, err := maxLookupID(tx, schema+".LookupConsumption")
+	if err != nil {
+		message := fmt.Sprintf("Unable to read max id from LookupConsumption (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	// prepare update & insert statements.  usage is stored against the first day of its month.
+	query := "UPDATE " + schema + ".LookupConsumption SET " +
+		"CustomerName = :1, ActualUsage = :2, CurrencyCode = :3, lastseendate = :4, " +
+		"lastupdatedate = SYSDATE, lastupdatedby = 'cto_bizlogic_helper' " +
+		"WHERE CimID = :5 AND SubscriptionID = :6 AND UsageMonth = TRUNC(TO_DATE(:7, 'YYYY-MM-DD'), 'MM')"
+	updateStmt, err := tx.Prepare(query)
+	defer updateStmt.Close()
+	if err != nil {
+		message := fmt.Sprintf("Unable to prepare statement for update (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	query = "INSERT INTO " + schema + ".LookupConsumption" +
+		"(id, creationdate, lastupdatedate, createdby, lastupdatedby, " +
+		"CimID, CustomerName, SubscriptionID, UsageMonth, ActualUsage, CurrencyCode, lastseendate) " +
+		"VALUES(:1, SYSDATE, SYSDATE, 'cto_bizlogic_helper', 'cto_bizlogic_helper', " +
+		":2, :3, :4, TRUNC(TO_DATE(:5, 'YYYY-MM-DD'), 'MM'), :6, :7, :8)"
+	insertStmt, err := tx.Prepare(query)
+	defer insertStmt.Close()
+	if err != nil {
+		message := fmt.Sprintf("Unable to prepare statement for insert (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	// consume the opening array brace
+	_, err = decoder.Token()
+	if err != nil {
+		message := fmt.Sprintf("Error decoding opening array token (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	// iterate each usage record
+	quality := newFeedQuality(consumption, schema, "subscription_id", "usage_month", "actual_usage")
+	counter := 1
+	loaded := 0
+	for decoder.More() {
+		// decode next record
+		var usage ConsumptionLookup
+		err := decoder.Decode(&usage)
+		if err != nil {
+			message := fmt.Sprintf("Error decoding consumption (%s) %d: %s",
+				GlobalConfig.ECALOpportunitySyncTarget, counter, err.Error())
+			run.fail(message)
+			return
+		}
+		run.recordProcessed()
+		counter++
+
+		// truncate timestamps
+		usage.UsageMonth = strings.Split(usage.UsageMonth, "T")[0]
+
+		// score the record as it came in the feed
+		quality.addRecord(map[string]string{"subscription_id": usage.SubscriptionID, "usage_month": usage.UsageMonth,
+			"actual_usage": usage.ActualUsage})
+		quality.checkDate("usage_month", usage.UsageMonth)
+		quality.checkCIMID(usage.CimID)
+
+		sanitizeFields(maxIDFieldLength, &usage.CimID, &usage.SubscriptionID, &usage.CurrencyCode)
+		sanitizeFields(maxNameFieldLength, &usage.CustomerName)
+
+		// usage that can't be tied to a customer and month can't be compared to a plan
+		actualUsage, parseErr := strconv.ParseFloat(usage.ActualUsage, 64)
+		if _, dateErr := time.Parse(queryDateLayout, usage.UsageMonth); len(usage.CimID) < 1 || len(usage.SubscriptionID) < 1 ||
+			dateErr != nil || parseErr != nil {
+			run.rejected++
+			continue
+		}
+
+		// add or refresh the usage in the LookupConsumption table
+		result, err := updateStmt.Exec(usage.CustomerName, actualUsage, usage.CurrencyCode, loadTime,
+			usage.CimID, usage.SubscriptionID, usage.UsageMonth)
+		if err == nil {
+			if updated, _ := result.RowsAffected(); updated == 0 {
+				_, err = insertStmt.Exec(baseID+int64(counter), usage.CimID, usage.CustomerName, usage.SubscriptionID,
+					usage.UsageMonth, actualUsage, usage.CurrencyCode, loadTime)
+				run.inserted++
+			} else {
+				run.updated++
+			}
+		}
+		if err != nil {
+			message := fmt.Sprintf("Unable to insert consumption %s/%s/%s into LookupConsumption (%s): %s", usage.CimID,
+				usage.SubscriptionID, usage.UsageMonth, GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+			run.fail(message)
+			return
+		}
+		loaded++
+	}
+
+	// consume the closing array brace
+	_, err = decoder.Token()
+	if err != nil {
+		message := fmt.Sprintf("Error decoding closing array token (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	// record the data quality of the feed along with the load
+	err = quality.save(tx)
+	if err != nil {
+		logEnv(GlobalConfig.ECALOpportunitySyncTarget, logWarn, "process_consumption", "Unable to record feed quality: "+err.Error())
+	}
+
+	// complete the transaction
+	err = tx.Commit()
+	if err != nil {
+		message := fmt.Sprintf("Error committing transaction (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	// refresh anything derived from the lookups (e.g. plan vs. actual materialized views) in the background
+	rows := counter - 1
+	startLoad("post_load", func(job *loadJob) {
+		runPostLoadHooks(job, GlobalConfig.ECALOpportunitySyncTarget, "LookupConsumption", rows)
+	})
+
+	run.complete(counter-1, loaded)
+	message := fmt.Sprintf("DONE Processing %d consumption records and loaded %d for %s",
+		counter-1, loaded, GlobalConfig.ECALOpportunitySyncTarget)
+	logEnv(GlobalConfig.ECALOpportunitySyncTarget, logInfo, "process_consumption", message)
+}
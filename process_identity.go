@@ -66,11 +66,24 @@ type Employee struct {
 
 const noMatch = "NOMATCH"
 
-func processIdentity(filename string) {
+// how many records of the identity feed are loaded into the staging table between checkpoints
+const identityCheckpointInterval = 25000
+
+func processIdentity(job *loadJob, filename string) {
+	run := beginSyncRun(job, "process_identity", identity, "CTO_COMMON", filename)
+
+	// only one load of the feed into the schema runs at a time, across every instance
+	lock, err := acquireSyncLock(identity, "CTO_COMMON")
+	if err != nil {
+		run.fail(err.Error())
+		return
+	}
+	defer lock.release()
+
 	file, err := os.Open(filename)
 	if err != nil {
 		message := fmt.Sprintf("Error opening file (%s): %s", filename, err.Error())
-		logOutput(logInfo, "process_identity", message)
+		run.fail(message)
 		return
 	}
 	defer file.Close()
@@ -79,7 +92,14 @@ func processIdentity(filename string) {
 	_, err = file.Seek(10, io.SeekStart)
 	if err != nil {
 		message := fmt.Sprintf("Error advancing file stream to position 10: %s", err.Error())
-		logOutput(logError, "process_identity", message)
+		run.fail(message)
+		return
+	}
+
+	// make sure the feed still carries the fields we depend on before touching the database
+	err = validateFeedContract(identity, filename)
+	if err != nil {
+		run.fail(err.Error())
 		return
 	}
 
@@ -87,25 +107,51 @@ func processIdentity(filename string) {
 	decoder := json.NewDecoder(file)
 	logOutput(logInfo, "process_identity", "START Processing identities")
 
+	// the feed is loaded into a staging table in batches, each committed along with a checkpoint, so a load of the
+	// same file that fails part way through can pick up from the last checkpoint.  The staging table replaces
+	// ORACLE_EMPLOYEES in a single transaction once the whole file is in.
+	checkpoint := loadCheckpoint{dataType: identity, schema: "CTO_COMMON"}
+	resuming := false
+	checksum, err := fileChecksum(filename)
+	if err != nil {
+		logOutput(logWarn, "process_identity", "Unable to checksum identity file, starting from the beginning: "+err.Error())
+	} else {
+		checkpoint, resuming, err = readLoadCheckpoint(identity, "CTO_COMMON", checksum)
+		if err != nil {
+			logOutput(logWarn, "process_identity", "Unable to read identity checkpoint, starting from the beginning: "+err.Error())
+			resuming = false
+		}
+	}
+
 	// start a DB transaction
 	tx, err := DBPool.Begin()
-	defer tx.Rollback()
+	defer func() { tx.Rollback() }()
 	if err != nil {
 		message := fmt.Sprintf("Error starting DB transaction: %s", err.Error())
-		logOutput(logError, "process_identity", message)
+		run.fail(message)
 		return
 	}
 
-	// delete all data from LookupOpportunity table
-	_, err = tx.Exec("DELETE FROM CTO_COMMON.ORACLE_EMPLOYEES")
-	if err != nil {
-		message := fmt.Sprintf("Error deleting from CTO_COMMON.ORACLE_EMPLOYEES: %s", err.Error())
-		logOutput(logError, "process_identity", message)
-		return
+	// a fresh load starts with an empty staging table
+	if resuming {
+		logOutput(logInfo, "process_identity", fmt.Sprintf("RESUMING identities after record %d (%s)", checkpoint.processed, checkpoint.lastKey))
+	} else {
+		_, err = tx.Exec("DELETE FROM CTO_COMMON.ORACLE_EMPLOYEES_STAGE")
+		if err != nil {
+			message := fmt.Sprintf("Error deleting from CTO_COMMON.ORACLE_EMPLOYEES_STAGE: %s", err.Error())
+			run.fail(message)
+			return
+		}
+		err = clearLoadCheckpoint(tx, identity, "CTO_COMMON")
+		if err != nil {
+			message := fmt.Sprintf("Error clearing identity checkpoint: %s", err.Error())
+			run.fail(message)
+			return
+		}
 	}
 
 	// prepare insert statement
-	query := `INSERT INTO CTO_COMMON.ORACLE_EMPLOYEES (
+	query := `INSERT INTO CTO_COMMON.ORACLE_EMPLOYEES_STAGE (
 		ID, 
 		EMPLOYEE_EMAIL_ADDRESS, 
 		ROLE, 
@@ -164,7 +210,7 @@ func processIdentity(filename string) {
 	defer insertStmt.Close()
 	if err != nil {
 		message := fmt.Sprintf("Error preparing insert statement: %s", err.Error())
-		logOutput(logError, "process_identity", message)
+		run.fail(message)
 		return
 	}
 
@@ -172,29 +218,52 @@ func processIdentity(filename string) {
 	_, err = decoder.Token()
 	if err != nil {
 		message := fmt.Sprintf("Error decoding opening array token: %s", err.Error())
-		logOutput(logError, "process_identity", message)
+		run.fail(message)
 		return
 	}
 
 	// initialize identityString
 	identityString := "{\"items\":["
+	records := newIdentityRecordWriter()
 
 	// initialize mgrAppMap
 	mgrAppMapping := noMatch
 
+	// read the previous high-water mark so we can report how many records changed since the last load
+	previousMark, err := getHighWaterMark(identity, "CTO_COMMON")
+	if err != nil {
+		logOutput(logWarn, "process_identity", "Unable to read identity high-water mark: "+err.Error())
+	}
+	changedEmps := 0
+
+	// employees who belong in the VBCS apps, provisioned into the app schemas once the load commits
+	provisioned := []provisionedUser{}
+
 	// iterate each employee
 	includedEmps := 0
 	insertedEmps := 0
+	quality := newFeedQuality(identity, "CTO_COMMON", "employee_email_address", "mgr", "lob", "mgr_chain")
 	counter := 1
 	for decoder.More() {
 		var person Employee
 		err := decoder.Decode(&person)
 		if err != nil {
 			message := fmt.Sprintf("Error decoding person %d: %s", counter, err.Error())
-			logOutput(logError, "process_identity", message)
+			run.fail(message)
 			return
 		}
+		run.recordProcessed()
 		counter++
+		record := counter - 1
+
+		// records up to the checkpoint are already staged; check the file lines up with it
+		if resuming && record == checkpoint.processed && person.ID != checkpoint.lastKey {
+			clearLoadCheckpoint(DBPool, identity, "CTO_COMMON")
+			message := fmt.Sprintf("Record %d of the identity file (%s) doesn't match the checkpoint (%s); the next load will start from the beginning",
+				record, person.ID, checkpoint.lastKey)
+			run.fail(message)
+			return
+		}
 
 		// truncate timestamps
 		person.StartDate = strings.TrimSuffix(strings.Split(person.StartDate, "T")[0], "T")
@@ -204,6 +273,20 @@ func processIdentity(filename string) {
 		person.LeftCompanyOn = strings.TrimSuffix(strings.Split(person.LeftCompanyOn, "T")[0], "T")
 		person.Inactive = strings.TrimSuffix(strings.Split(person.Inactive, "T")[0], "T")
 
+		// score the record as it came in the feed
+		quality.addRecord(map[string]string{"employee_email_address": person.EmployeeEmailAddress, "mgr": person.Mgr, "lob": person.Lob,
+			"mgr_chain": person.MgrChain})
+		quality.checkDate("start_date", person.StartDate)
+		quality.checkDate("updated_on", person.UpdatedOn)
+
+		// track the most recent update date in the feed as the high-water mark (YYYY-MM-DD sorts lexically)
+		if person.UpdatedOn > run.highWaterMark {
+			run.highWaterMark = person.UpdatedOn
+		}
+		if person.UpdatedOn > previousMark {
+			changedEmps++
+		}
+
 		// if the lobtagparent is null this means the lob tag is a root element.  However per analytic
 		// requirements we set parent = tag
 		if len(person.LobTagParent) < 1 {
@@ -212,18 +295,21 @@ func processIdentity(filename string) {
 
 		// insert person into table if they have not left Oracle and they have a givenname (this last condition to get rid of some dummy accounts)
 		if person.Lob != "X-LEFT ORACLE" && person.Lob != "P-LEFT ORACLE" && person.LobDetail != "/givenname=" {
-			_, err = insertStmt.Exec(person.ID, person.EmployeeEmailAddress, person.Role, person.Status, person.RecordType,
-				person.Title, person.Mgr, person.Lob, person.CostCenter, person.Region, person.Country, person.StartDate,
-				person.EndDate, person.CreatedOn, person.CreatedBy, person.UpdatedOn, person.UpdatedBy, person.EmployeeFullName,
-				person.LdapStatus, person.Evp, person.EvpDirect, person.NeverProcessLdap, person.DoNotUpdateFromLdap,
-				person.LockRegion, person.LeftCompanyOn, person.Inactive, person.MgrLevel, person.State, person.City,
-				person.MgrChain, person.TopMgrDirMinus1, person.TopMgrDirMinus2, person.TopMgrDirMinus3, person.TopMgrDirMinus4,
-				person.NumDirects, person.NumUsers, person.OldUID, person.ChainLevel, person.OracleUID, person.LobDetail,
-				person.HierLevel, person.TopMgrSeq, person.LobTag, person.LobTagParent, person.LobTagRoot)
-			if err != nil {
-				message := fmt.Sprintf("Error inserting person (%s): %s", person.EmployeeFullName, err.Error())
-				logOutput(logError, "process_identity", message)
-				return
+			// records up to the checkpoint are already in the staging table
+			if record > checkpoint.processed {
+				_, err = insertStmt.Exec(person.ID, person.EmployeeEmailAddress, person.Role, person.Status, person.RecordType,
+					person.Title, person.Mgr, person.Lob, person.CostCenter, person.Region, person.Country, person.StartDate,
+					person.EndDate, person.CreatedOn, person.CreatedBy, person.UpdatedOn, person.UpdatedBy, person.EmployeeFullName,
+					person.LdapStatus, person.Evp, person.EvpDirect, person.NeverProcessLdap, person.DoNotUpdateFromLdap,
+					person.LockRegion, person.LeftCompanyOn, person.Inactive, person.MgrLevel, person.State, person.City,
+					person.MgrChain, person.TopMgrDirMinus1, person.TopMgrDirMinus2, person.TopMgrDirMinus3, person.TopMgrDirMinus4,
+					person.NumDirects, person.NumUsers, person.OldUID, person.ChainLevel, person.OracleUID, person.LobDetail,
+					person.HierLevel, person.TopMgrSeq, person.LobTag, person.LobTagParent, person.LobTagRoot)
+				if err != nil {
+					message := fmt.Sprintf("Error inserting person (%s): %s", person.EmployeeFullName, err.Error())
+					run.fail(message)
+					return
+				}
 			}
 
 			// check to see if this person is part of the management chain of one of the top level managers
@@ -231,24 +317,43 @@ func processIdentity(filename string) {
 			// will be included in the identity synchronization.
 			mgrAppMapping = includeUserInPlatform(person.MgrChain)
 			if mgrAppMapping != noMatch {
-				nameSplit := strings.SplitAfterN(person.EmployeeFullName, " ", 2)
-				identityString = identityString +
-					"{\"id\":\"" + person.EmployeeEmailAddress +
-					"\",\"sn\":\"" + strings.TrimRight(nameSplit[1], " ") +
-					"\",\"manager\":\"" + convertEmailToDN(person.Mgr) +
-					"\",\"mail\":\"" + person.EmployeeEmailAddress +
-					"\",\"givenname\":\"" + strings.TrimRight(nameSplit[0], " ") +
-					"\",\"displayname\":\"" + person.EmployeeFullName +
-					"\",\"mgr_chain\":\"" + person.MgrChain +
-					"\",\"lob\":\"" + person.LobTag +
-					"\",\"lob_parent\":\"" + person.LobTagRoot +
-					"\",\"num_directs\":" + person.NumDirects +
-					",\"app_map\":\"" + mgrAppMapping +
-					"\"},"
+				identityString = identityString + records.record(person, mgrAppMapping) + ","
+				provisioned = append(provisioned, newProvisionedUser(person, mgrAppMapping))
 				includedEmps++
 			}
 
 			insertedEmps++
+			run.inserted++
+		} else {
+			run.rejected++
+		}
+
+		// commit what's been staged so far with a checkpoint and carry on in a new transaction
+		if record%identityCheckpointInterval == 0 && record > checkpoint.processed && len(checksum) > 0 {
+			checkpoint.processed = record
+			checkpoint.lastKey = person.ID
+			err = saveLoadCheckpoint(tx, checkpoint)
+			if err == nil {
+				err = tx.Commit()
+			}
+
+			// the service is stopping; what's staged is safe and the next load of this file picks up from here
+			if err == nil && shuttingDown() {
+				message := fmt.Sprintf("Stopped loading identities at record %d for shutdown; the next load of the same file resumes there", record)
+				run.fail(message)
+				return
+			}
+			if err == nil {
+				tx, err = DBPool.Begin()
+			}
+			if err == nil {
+				insertStmt, err = tx.Prepare(query)
+			}
+			if err != nil {
+				message := fmt.Sprintf("Error checkpointing identities at record %d: %s", record, err.Error())
+				run.fail(message)
+				return
+			}
 		}
 	}
 
@@ -256,28 +361,75 @@ func processIdentity(filename string) {
 	_, err = decoder.Token()
 	if err != nil {
 		message := fmt.Sprintf("Error decoding closing array token: %s", err.Error())
-		logOutput(logError, "process_identity", message)
+		run.fail(message)
+		return
+	}
+
+	// replace ORACLE_EMPLOYEES with the staged feed.  The staging table has the same columns in the same order.
+	_, err = tx.Exec("DELETE FROM CTO_COMMON.ORACLE_EMPLOYEES")
+	if err != nil {
+		message := fmt.Sprintf("Error deleting from CTO_COMMON.ORACLE_EMPLOYEES: %s", err.Error())
+		run.fail(message)
+		return
+	}
+	_, err = tx.Exec("INSERT INTO CTO_COMMON.ORACLE_EMPLOYEES SELECT * FROM CTO_COMMON.ORACLE_EMPLOYEES_STAGE")
+	if err != nil {
+		message := fmt.Sprintf("Error copying CTO_COMMON.ORACLE_EMPLOYEES_STAGE to CTO_COMMON.ORACLE_EMPLOYEES: %s", err.Error())
+		run.fail(message)
+		return
+	}
+	_, err = tx.Exec("DELETE FROM CTO_COMMON.ORACLE_EMPLOYEES_STAGE")
+	if err != nil {
+		message := fmt.Sprintf("Error deleting from CTO_COMMON.ORACLE_EMPLOYEES_STAGE: %s", err.Error())
+		run.fail(message)
 		return
 	}
+	err = clearLoadCheckpoint(tx, identity, "CTO_COMMON")
+	if err != nil {
+		message := fmt.Sprintf("Error clearing identity checkpoint: %s", err.Error())
+		run.fail(message)
+		return
+	}
+
+	// record the data quality of the feed along with the load
+	err = quality.save(tx)
+	if err != nil {
+		logOutput(logWarn, "process_identity", "Unable to record feed quality: "+err.Error())
+	}
 
 	// complete the transaction
 	err = tx.Commit()
 	if err != nil {
 		message := fmt.Sprintf("Error committing transaction: %s", err.Error())
-		logOutput(logError, "process_identity", message)
+		run.fail(message)
 		return
 	}
 
+	// reporting lines may have changed so drop any cached manager hierarchies, push new and moved users (and their
+	// roles) into the app schemas and rebuild the closure tables.  The cached query results were scoped through the
+	// old closures, so they go too.
+	invalidateHierarchyCache()
+	provisionUsers(provisioned)
+	syncRoles(provisioned)
+	refreshManagerClosures()
+	invalidateQueryCache()
+
+	// the STS datasets in OAC follow the users and their managers
+	go publishSTSAnalyticsDatasets()
+
 	// write identities.json file to the filesystem
 	identityString = identityString[0:len(identityString)-1] + "]}"
 	err = ioutil.WriteFile(GlobalConfig.IdentityFilename, []byte(identityString), 0700)
 	if err != nil {
 		message := fmt.Sprintf("Error writing (%s) to filesystem: %s\n", GlobalConfig.IdentityFilename, err.Error())
-		logOutput(logError, "process_identity", message)
+		run.fail(message)
+	} else {
+		go saveIdentityVersion([]byte(identityString))
 	}
 
-	message := fmt.Sprintf("DONE processing %d employees, loading %d current employees and writing %d employees to %s",
-		counter, insertedEmps, includedEmps, GlobalConfig.IdentityFilename)
+	run.complete(counter-1, insertedEmps)
+	message := fmt.Sprintf("DONE processing %d employees (%d updated since %s), loading %d current employees and writing %d employees to %s",
+		counter, changedEmps, previousMark, insertedEmps, includedEmps, GlobalConfig.IdentityFilename)
 	logOutput(logInfo, "process_identity", message)
 }
 
@@ -308,9 +460,9 @@ func includeUserInPlatform(mgrChain string) string {
 		return noMatch
 	}
 
-	for i, manager := range IdentityMgrLeads {
+	for i, manager := range GlobalConfig.IdentityMgrLeads {
 		if strings.Contains(mgrChain, manager) {
-			return MgrAppMapping[i]
+			return GlobalConfig.MgrAppMapping[i]
 		}
 	}
 
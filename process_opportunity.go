@@ -13,6 +13,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // OpportunityLookup represents an individual returned from the custom Aria export service
@@ -54,23 +55,33 @@ type OpportunityLookup struct {
 }
 
 //
-// Process opportunities from JSON file to LookupOpportunity table
+// Process opportunities from JSON file to LookupOpportunity table.  A scoped load only refreshes the revenue lines of
+// the accounts or territory in scope.
 //
-func processOpportunity(filename string) {
+func processOpportunity(job *loadJob, filename string, scope loadScope) {
 
 	// determine appropriate instance-environment based on the value of the config.json setting
-	schema := SchemaMap[GlobalConfig.ECALOpportunitySyncTarget]
+	schema := lookupSchema(GlobalConfig.ECALOpportunitySyncTarget)
+	run := beginSyncRun(job, "process_opportunity", scope.dataType(opportunity), schema, filename)
 	if len(schema) < 1 {
 		message := fmt.Sprintf("Schema for (%s) not valid", GlobalConfig.ECALOpportunitySyncTarget)
-		logOutput(logError, "process_opportunity", message)
+		run.fail(message)
 		return
 	}
 
+	// only one load of the feed into the schema runs at a time, across every instance
+	lock, err := acquireSyncLock(opportunity, schema)
+	if err != nil {
+		run.fail(err.Error())
+		return
+	}
+	defer lock.release()
+
 	// open file for reading
 	file, err := os.Open(filename)
 	if err != nil {
 		message := fmt.Sprintf("Error opening file (%s]): %s", filename, err.Error())
-		logOutput(logError, "process_opportunity", message)
+		run.fail(message)
 		return
 	}
 	defer file.Close()
@@ -79,52 +90,96 @@ func processOpportunity(filename string) {
 	_, err = file.Seek(10, io.SeekStart)
 	if err != nil {
 		message := fmt.Sprintf("Error advancing file stream to position 10: %s", err.Error())
-		logOutput(logError, "process_opportunity", message)
+		run.fail(message)
+		return
+	}
+
+	// make sure the feed still carries the fields we depend on before touching the database
+	err = validateFeedContract(opportunity, filename)
+	if err != nil {
+		run.fail(err.Error())
 		return
 	}
 
 	// decode full opportunity list from response
 	decoder := json.NewDecoder(file)
-	message := fmt.Sprintf("START Processing opportunities (%s)", GlobalConfig.ECALOpportunitySyncTarget)
-	logOutput(logInfo, "process_opportunity", message)
+	message := fmt.Sprintf("START Processing opportunities (%s, %s)", GlobalConfig.ECALOpportunitySyncTarget, scope)
+	logEnv(GlobalConfig.ECALOpportunitySyncTarget, logInfo, "process_opportunity", message)
 
 	// start a DB transaction
 	tx, err := DBPool.Begin()
 	defer tx.Rollback()
 	if err != nil {
 		message := fmt.Sprintf("Error creating DB transaction (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
-		logOutput(logError, "process_opportunity", message)
+		run.fail(message)
 		return
 	}
 
-	// delete all data from LookupOpportunity table
-	_, err = tx.Exec("DELETE FROM " + schema + ".LookupOpportunity")
+	// rows are no longer deleted and reloaded.  Revenue lines in the feed are updated in place (or added after the
+	// current highest id) and stamped with loadTime; lines that have closed or dropped out of the feed are deactivated.
+	loadTime := time.Now()
+	baseID, err := maxLookupID(tx, schema+".LookupOpportunity")
 	if err != nil {
-		message := fmt.Sprintf("Unable to delete from LookupOpportunity (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
-		logOutput(logError, "process_opportunity", message)
+		message := fmt.Sprintf("Unable to read max id from LookupOpportunity (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
 		return
 	}
 
-	// prepare insert statement
-	queryString := "INSERT INTO " + schema + ".LookupOpportunity" +
+	// prepare update & insert statements.  the update takes the same values as the insert (less the id) with the
+	// opportunityid/revenuelineid key moved to the end for the WHERE clause.
+	queryString := "UPDATE " + schema + ".LookupOpportunity SET " +
+		"summary = :1, salesrep = :2, projectedarr = :3, anticipatedclosedate = TO_DATE(:4, 'YYYY-MM-DD'), winprobability = :5, " +
+		"projectedtcv = :6, integrationid = :7, registryid = :8, cimid = :9, opportunitystatus = :10, customername = :11, territoryowner = :12, " +
+		"opportunityvalue = :13, forecasttypegroup = :14, revenuetype = :15, revenuetypegroup = :16, revenuelinestatus = :17, revenuesalesstage = :18, " +
+		"revenuepipelinek = :19, revenuetcvk = :20, revenueprobability = :21, productclass = :22, productpillar = :23, productline = :24, productgroup = :25, " +
+		"productname = :26, productdescription = :27, workloadamount = :28, consumptionstartdate = TO_DATE(:29, 'YYYY-MM-DD'), consumptionrampmonths = :30, " +
+		"l2territoryname = :31, l3territoryname = :32, l2territoryemail = :33, l3territoryemail = :34, " +
+		"active = 1, deactivateddate = null, deactivationreason = null, lastseendate = :35, " +
+		"lastupdatedate = SYSDATE, lastupdatedby = 'cto_bizlogic_helper' " +
+		"WHERE opportunityid = :36 AND revenuelineid = :37"
+	lookupUpdateStmt, err := tx.Prepare(queryString)
+	defer lookupUpdateStmt.Close()
+	if err != nil {
+		message := fmt.Sprintf("Unable to prepare statement for lookup update (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	queryString = "INSERT INTO " + schema + ".LookupOpportunity" +
 		"(id, creationdate, lastupdatedate, createdby, lastupdatedby, abcschangenumber, " +
 		"opportunityid, summary, salesrep, projectedarr, anticipatedclosedate, winprobability, " +
 		"projectedtcv, integrationid, registryid, cimid, opportunitystatus, customername, territoryowner," +
 		"opportunityvalue, forecasttypegroup, revenuelineid, revenuetype, revenuetypegroup, revenuelinestatus, revenuesalesstage," +
 		"revenuepipelinek, revenuetcvk, revenueprobability, productclass, productpillar, productline, productgroup," +
-		"productname, productdescription, workloadamount, consumptionstartdate, consumptionrampmonths, l2territoryname, l3territoryname, l2territoryemail, l3territoryemail" +
+		"productname, productdescription, workloadamount, consumptionstartdate, consumptionrampmonths, l2territoryname, l3territoryname, l2territoryemail, l3territoryemail, " +
+		"active, lastseendate" +
 		") VALUES ( " +
 		":1, SYSDATE, SYSDATE, 'cto_bizlogic_helper', 'cto_bizlogic_helper', null, " +
 		":2, :3, :4, :5, TO_DATE(:6, 'YYYY-MM-DD'), :7, " +
 		":8, :9, :10, :11, :12, :13, :14, " +
 		":15, :16, :17, :18, :19, :20, :21, " +
 		":22, :23, :24, :25, :26, :27, :28, " +
-		":29, :30, :31, TO_DATE(:32, 'YYYY-MM-DD'), :33, :34, :35, :36, :37)"
+		":29, :30, :31, TO_DATE(:32, 'YYYY-MM-DD'), :33, :34, :35, :36, :37, " +
+		"1, :38)"
 	insertStmt, err := tx.Prepare(queryString)
 	defer insertStmt.Close()
 	if err != nil {
 		message := fmt.Sprintf("Unable to prepare statement for insert (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
-		logOutput(logError, "process_opportunity", message)
+		run.fail(message)
+		return
+	}
+
+	// revenue lines that are in the feed but no longer Open/Won are closed.  keep the original close date if the
+	// line was already closed on an earlier load.
+	closeStmt, err := tx.Prepare("UPDATE " + schema + ".LookupOpportunity SET " +
+		"opportunitystatus = :1, lastseendate = :2, " +
+		"deactivateddate = CASE WHEN active = 0 AND deactivationreason = '" + deactivationClosed + "' THEN deactivateddate ELSE SYSTIMESTAMP END, " +
+		"active = 0, deactivationreason = '" + deactivationClosed + "', lastupdatedate = SYSDATE, lastupdatedby = 'cto_bizlogic_helper' " +
+		"WHERE opportunityid = :3 AND revenuelineid = :4")
+	defer closeStmt.Close()
+	if err != nil {
+		message := fmt.Sprintf("Unable to prepare statement for lookup close (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
 		return
 	}
 
@@ -138,7 +193,7 @@ func processOpportunity(filename string) {
 	defer updateStmt1.Close()
 	if err != nil {
 		message := fmt.Sprintf("Unable to prepare statement for Opportunity update (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
-		logOutput(logError, "process_opportunity", message)
+		run.fail(message)
 		return
 	}
 	updateStmt2, err := tx.Prepare(
@@ -149,7 +204,23 @@ func processOpportunity(filename string) {
 	defer updateStmt2.Close()
 	if err != nil {
 		message := fmt.Sprintf("Unable to prepare statement for OpportunityWorkload update (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
-		logOutput(logError, "process_opportunity", message)
+		run.fail(message)
+		return
+	}
+
+	// record what this load changes for downstream caches (see /changes)
+	changes, err := newOpportunityChangeTracker(tx, schema, scope)
+	if err != nil {
+		message := fmt.Sprintf("Unable to read LookupOpportunity for change capture (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	// audit the changes this load makes to ECAL opportunities (see /opportunityHistory)
+	syncAudit, err := newOpportunitySyncAudit(tx, GlobalConfig.ECALOpportunitySyncTarget, schema)
+	if err != nil {
+		message := fmt.Sprintf("Unable to read Opportunity for auditing (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
 		return
 	}
 
@@ -157,12 +228,14 @@ func processOpportunity(filename string) {
 	_, err = decoder.Token()
 	if err != nil {
 		message := fmt.Sprintf("Error decoding opening array token (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
-		logOutput(logError, "process_opportunity", message)
+		run.fail(message)
 		return
 	}
 
 	// iterate each opportunity
 	insertedOpps := 0
+	closedOpps := int64(0)
+	quality := newFeedQuality(opportunity, schema, "opportunity_id", "revenue_line_id", "customer_name", "opportunity_status", "registry_id")
 	counter := 1
 	for decoder.More() {
 		// decode next record
@@ -171,9 +244,10 @@ func processOpportunity(filename string) {
 		if err != nil {
 			message := fmt.Sprintf("(%s) Error decoding person %d: %s",
 				GlobalConfig.ECALOpportunitySyncTarget, counter, err.Error())
-			logOutput(logError, "process_opportunity", message)
+			run.fail(message)
 			return
 		}
+		run.recordProcessed()
 
 		// convert strings to numbers
 		tcv := 0
@@ -190,6 +264,13 @@ func processOpportunity(filename string) {
 		opp.CloseDate = strings.TrimSuffix(strings.Split(opp.CloseDate, "T")[0], "T")
 		opp.ConsumptionStartDate = strings.TrimSuffix(strings.Split(opp.ConsumptionStartDate, "T")[0], "T")
 
+		// score the record as it came in the feed
+		quality.addRecord(map[string]string{"opportunity_id": opp.OppID, "revenue_line_id": opp.RevenueLineID, "customer_name": opp.CustomerName,
+			"opportunity_status": opp.OppStatus, "registry_id": opp.RegistryID})
+		quality.checkDate("close_date", opp.CloseDate)
+		quality.checkDate("consumption_start_date", opp.ConsumptionStartDate)
+		quality.checkCIMID(opp.CimID)
+
 		// other fixes for the evil that SI data brings
 		if len(opp.OppOwner) < 1 {
 			opp.OppOwner = opp.TerritoryOwner
@@ -201,23 +282,79 @@ func processOpportunity(filename string) {
 			opp.ProductDescription = "Unspecified"
 		}
 		opp.OppName = strings.ReplaceAll(opp.OppName, "_", " ")
+		sanitizeFields(maxIDFieldLength, &opp.OppID, &opp.IntegrationID, &opp.RegistryID, &opp.CimID, &opp.OppStatus, &opp.ForecastTypeGroup,
+			&opp.RevenueLineID, &opp.RevenueType, &opp.RevenueTypeGroup, &opp.RevenueLineStatus, &opp.RevenueSalesStage)
+		sanitizeFields(maxNameFieldLength, &opp.OppOwner, &opp.CustomerName, &opp.TerritoryOwner, &opp.ProductClass, &opp.ProductPillar,
+			&opp.ProductLine, &opp.ProductGroup, &opp.ProductName, &opp.L2TerritoryName, &opp.L3TerritoryName)
+		sanitizeFields(maxEmailFieldLength, &opp.L2TerritoryEmail, &opp.L3TerritoryEmail)
+		sanitizeFields(maxLongFieldLength, &opp.OppName, &opp.ProductDescription)
+
+		// a scoped load leaves revenue lines outside its accounts or territory alone, but still refreshes the lines it
+		// holds within them so one that has moved to another account or territory upstream isn't taken as vanished
+		if !scope.includesOpportunity(opp) && !changes.tracks(opp.OppID, opp.RevenueLineID) {
+			continue
+		}
 
-		// add opportunity to LookupOpportunity staging table
-		// only put opportunities in 'Open' or 'Won' state into the lookup table
+		// add or refresh the opportunity in the LookupOpportunity staging table
+		// only opportunities in 'Open' or 'Won' state are active in the lookup table; anything else is closed
+		var changeValues []string
 		if opp.OppStatus == "Open" || opp.OppStatus == "Won" {
-			_, err = insertStmt.Exec(
-				counter, opp.OppID, opp.OppName, opp.OppOwner, arr*1000, opp.CloseDate, winProbability,
+			result, err := lookupUpdateStmt.Exec(
+				opp.OppName, opp.OppOwner, arr*1000, opp.CloseDate, winProbability,
 				tcv*1000, opp.IntegrationID, opp.RegistryID, opp.CimID, opp.OppStatus, opp.CustomerName, opp.TerritoryOwner,
-				opportunityValue*1000, opp.ForecastTypeGroup, opp.RevenueLineID, opp.RevenueType, opp.RevenueTypeGroup, opp.RevenueLineStatus, opp.RevenueProbability,
+				opportunityValue*1000, opp.ForecastTypeGroup, opp.RevenueType, opp.RevenueTypeGroup, opp.RevenueLineStatus, opp.RevenueProbability,
 				revenuePipelineK*1000, revenueTCVK*1000, workloadProbability, opp.ProductClass, opp.ProductPillar, opp.ProductLine, opp.ProductGroup,
-				opp.ProductName, opp.ProductDescription, workloadAmount*1000, opp.ConsumptionStartDate, consumptionRampMonths, opp.L2TerritoryName, opp.L3TerritoryName, opp.L2TerritoryEmail, opp.L3TerritoryEmail)
+				opp.ProductName, opp.ProductDescription, workloadAmount*1000, opp.ConsumptionStartDate, consumptionRampMonths, opp.L2TerritoryName, opp.L3TerritoryName, opp.L2TerritoryEmail, opp.L3TerritoryEmail,
+				loadTime, opp.OppID, opp.RevenueLineID)
 			if err != nil {
-				message := fmt.Sprintf("Unable to insert opportunity %s into LookupOpportunity (%s): %s",
+				message := fmt.Sprintf("Unable to update opportunity %s in LookupOpportunity (%s): %s",
 					opp.OppID, GlobalConfig.ECALOpportunitySyncTarget, err.Error())
-				logOutput(logError, "process_opportunity", message)
+				run.fail(message)
 				return
 			}
+			if updated, _ := result.RowsAffected(); updated == 0 {
+				_, err = insertStmt.Exec(
+					baseID+int64(counter), opp.OppID, opp.OppName, opp.OppOwner, arr*1000, opp.CloseDate, winProbability,
+					tcv*1000, opp.IntegrationID, opp.RegistryID, opp.CimID, opp.OppStatus, opp.CustomerName, opp.TerritoryOwner,
+					opportunityValue*1000, opp.ForecastTypeGroup, opp.RevenueLineID, opp.RevenueType, opp.RevenueTypeGroup, opp.RevenueLineStatus, opp.RevenueProbability,
+					revenuePipelineK*1000, revenueTCVK*1000, workloadProbability, opp.ProductClass, opp.ProductPillar, opp.ProductLine, opp.ProductGroup,
+					opp.ProductName, opp.ProductDescription, workloadAmount*1000, opp.ConsumptionStartDate, consumptionRampMonths, opp.L2TerritoryName, opp.L3TerritoryName, opp.L2TerritoryEmail, opp.L3TerritoryEmail,
+					loadTime)
+				if err != nil {
+					message := fmt.Sprintf("Unable to insert opportunity %s into LookupOpportunity (%s): %s",
+						opp.OppID, GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+					run.fail(message)
+					return
+				}
+				run.inserted++
+			} else {
+				run.updated++
+			}
 			insertedOpps++
+			changeValues = opportunityChangeValues(opp.OppName, opp.OppOwner, opp.CloseDate, opp.OppStatus, float64(winProbability),
+				revenuePipelineK*1000, revenueTCVK*1000, float64(workloadProbability), workloadAmount*1000)
+		} else {
+			result, err := closeStmt.Exec(opp.OppStatus, loadTime, opp.OppID, opp.RevenueLineID)
+			if err != nil {
+				message := fmt.Sprintf("Unable to close opportunity %s in LookupOpportunity (%s): %s",
+					opp.OppID, GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+				run.fail(message)
+				return
+			}
+			closed, _ := result.RowsAffected()
+			closedOpps += closed
+			if closed > 0 {
+				run.updated++
+			} else {
+				run.rejected++
+			}
+		}
+		err = changes.record(opp.OppID, opp.RevenueLineID, changeValues != nil, changeValues)
+		if err != nil {
+			message := fmt.Sprintf("Unable to record change to opportunity %s (%s): %s",
+				opp.OppID, GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+			run.fail(message)
+			return
 		}
 
 		// update existing Opportunity table with any updated data.  We do this regardless of opportunity status since
@@ -226,7 +363,7 @@ func processOpportunity(filename string) {
 		if err != nil {
 			message := fmt.Sprintf("Unable to update opportunity %s in Opportunity (%s): %s",
 				opp.OppID, GlobalConfig.ECALOpportunitySyncTarget, err.Error())
-			logOutput(logError, "process_opportunity", message)
+			run.fail(message)
 			return
 		}
 		// update existing OpportunityWorkload table with any updated data.  We do this regardless of opportunity status since
@@ -235,9 +372,12 @@ func processOpportunity(filename string) {
 		if err != nil {
 			message := fmt.Sprintf("Unable to update opportunity %s in OpportunityWorkload (%s): %s",
 				opp.OppID, GlobalConfig.ECALOpportunitySyncTarget, err.Error())
-			logOutput(logError, "process_opportunity", message)
+			run.fail(message)
 			return
 		}
+		syncAudit.written(opp.OppID, opp.RevenueLineID,
+			syncedOpportunityValues(opp.OppName, opp.OppOwner, revenuePipelineK*1000, opportunityValue*1000, opp.OppStatus, opp.CloseDate, float64(winProbability)),
+			syncedWorkloadValues(opp.ProductDescription, opp.ConsumptionStartDate, consumptionRampMonths, opp.ProductGroup))
 
 		counter++
 	}
@@ -247,21 +387,77 @@ func processOpportunity(filename string) {
 	if err != nil {
 		message := fmt.Sprintf("Error decoding closing array token (%s): %s",
 			GlobalConfig.ECALOpportunitySyncTarget, err.Error())
-		logOutput(logError, "process_opportunity", message)
+		run.fail(message)
+		return
+	}
+
+	// deactivate revenue lines that weren't in this feed at all
+	vanishedOpps, err := deactivateVanished(tx, schema+".LookupOpportunity", loadTime, scope)
+	if err != nil {
+		message := fmt.Sprintf("Unable to deactivate vanished opportunities in LookupOpportunity (%s): %s",
+			GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
 		return
 	}
 
+	err = changes.recordVanished()
+	if err != nil {
+		message := fmt.Sprintf("Unable to record vanished opportunities (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+	changeSummary, err := changes.close(tx)
+	if err != nil {
+		message := fmt.Sprintf("Unable to purge old changes (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+	auditedRows, err := syncAudit.record(tx)
+	if err != nil {
+		message := fmt.Sprintf("Unable to audit changes to ECAL opportunities (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	// let subscribers know there are changes to pick up from /changes
+	if len(changes.counts) > 0 || auditedRows > 0 {
+		err = enqueueEvent(tx, GlobalConfig.ECALOpportunitySyncTarget, eventOpportunitiesChanged, map[string]interface{}{
+			"changes": changes.counts, "ecal_rows_audited": auditedRows})
+		if err != nil {
+			message := fmt.Sprintf("Unable to write opportunity load event (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+			run.fail(message)
+			return
+		}
+	}
+
+	// record the data quality of the feed along with the load; a scoped load hasn't scored the whole feed
+	if scope.full() {
+		err = quality.save(tx)
+		if err != nil {
+			logEnv(GlobalConfig.ECALOpportunitySyncTarget, logWarn, "process_opportunity", "Unable to record feed quality: "+err.Error())
+		}
+	}
+
 	// complete the transaction
 	err = tx.Commit()
 	if err != nil {
 		message := fmt.Sprintf("Error committing transaction (%s): %s",
 			GlobalConfig.ECALOpportunitySyncTarget, err.Error())
-		logOutput(logError, "process_opportunity", message)
+		run.fail(message)
 		return
 	}
 
-	message = fmt.Sprintf("DONE Processing %d opportunities with %d in Open/Won state for %s",
-		counter-1, insertedOpps, GlobalConfig.ECALOpportunitySyncTarget)
-	logOutput(logInfo, "process_opportunity", message)
+	// drop the cached dashboard queries now so nobody is served results from before the load, then refresh
+	// anything derived from the lookups (materialized views, cached dashboard queries) in the background
+	invalidateQueryCacheFor(GlobalConfig.ECALOpportunitySyncTarget)
+	rows := counter - 1
+	startLoad("post_load", func(job *loadJob) {
+		runPostLoadHooks(job, GlobalConfig.ECALOpportunitySyncTarget, "LookupOpportunity", rows)
+	})
+
+	run.complete(counter-1, insertedOpps)
+	message = fmt.Sprintf("DONE Processing %d opportunities with %d in Open/Won state (%d closed, %d vanished) for %s (%s); changes: %s; %d ECAL rows audited",
+		counter-1, insertedOpps, closedOpps, vanishedOpps, GlobalConfig.ECALOpportunitySyncTarget, scope, changeSummary, auditedRows)
+	logEnv(GlobalConfig.ECALOpportunitySyncTarget, logInfo, "process_opportunity", message)
 
 }
@@ -0,0 +1,208 @@
+//  ProcessProduct
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ProductLookup represents one entry of the product taxonomy returned from the corporate feed
+type ProductLookup struct {
+	ProductClass  string `json:"product_class"`
+	ProductPillar string `json:"product_pillar"`
+	ProductLine   string `json:"product_line"`
+	ProductGroup  string `json:"product_group"`
+}
+
+//
+// Process the product catalog from JSON file to LookupProduct table.  Entries are keyed by their full
+// class/pillar/line/group path and, like accounts, updated in place with the ones that drop out of the feed deactivated.
+//
+func processProduct(job *loadJob, filename string) {
+
+	// determine appropriate instance-environment based on the value of the config.json setting
+	schema := lookupSchema(GlobalConfig.ECALOpportunitySyncTarget)
+	run := beginSyncRun(job, "process_product", product, schema, filename)
+	if len(schema) < 1 {
+		run.fail("Schema for " + GlobalConfig.ECALOpportunitySyncTarget + " not valid")
+		return
+	}
+
+	// only one load of the feed into the schema runs at a time, across every instance
+	lock, err := acquireSyncLock(product, schema)
+	if err != nil {
+		run.fail(err.Error())
+		return
+	}
+	defer lock.release()
+
+	// open file for reading
+	file, err := os.Open(filename)
+	if err != nil {
+		message := fmt.Sprintf("Error opening file (%s): %s", filename, err.Error())
+		run.fail(message)
+		return
+	}
+	defer file.Close()
+
+	// seek 10 bytes (chars) to advance past {"items":
+	_, err = file.Seek(10, io.SeekStart)
+	if err != nil {
+		message := fmt.Sprintf("Error advancing file stream to position 10: %s", err.Error())
+		run.fail(message)
+		return
+	}
+
+	// make sure the feed still carries the fields we depend on before touching the database
+	err = validateFeedContract(product, filename)
+	if err != nil {
+		run.fail(err.Error())
+		return
+	}
+
+	// decode full product list from response
+	decoder := json.NewDecoder(file)
+	logEnv(GlobalConfig.ECALOpportunitySyncTarget, logInfo, "process_product", "START Processing products ("+GlobalConfig.ECALOpportunitySyncTarget+")")
+
+	// start a DB transaction
+	tx, err := DBPool.Begin()
+	defer tx.Rollback()
+	if err != nil {
+		message := fmt.Sprintf("Error creating DB transaction (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	loadTime := time.Now()
+	baseID, err := maxLookupID(tx, schema+".LookupProduct")
+	if err != nil {
+		message := fmt.Sprintf("Unable to read max id from LookupProduct (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	// prepare update & insert statements.  any level below the class can be empty (null) so they are compared with
+	// DECODE, which treats two nulls as equal.
+	query := "UPDATE " + schema + ".LookupProduct SET " +
+		"active = 1, deactivateddate = null, deactivationreason = null, lastseendate = :1, " +
+		"lastupdatedate = SYSDATE, lastupdatedby = 'cto_bizlogic_helper' " +
+		"WHERE DECODE(ProductClass, :2, 1, 0) = 1 AND DECODE(ProductPillar, :3, 1, 0) = 1 " +
+		"AND DECODE(ProductLine, :4, 1, 0) = 1 AND DECODE(ProductGroup, :5, 1, 0) = 1"
+	updateStmt, err := tx.Prepare(query)
+	defer updateStmt.Close()
+	if err != nil {
+		message := fmt.Sprintf("Unable to prepare statement for update (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	query = "INSERT INTO " + schema + ".LookupProduct" +
+		"(id, creationdate, lastupdatedate, createdby, lastupdatedby, " +
+		"ProductClass, ProductPillar, ProductLine, ProductGroup, active, lastseendate) " +
+		"VALUES(:1, SYSDATE, SYSDATE, 'cto_bizlogic_helper', 'cto_bizlogic_helper', :2, :3, :4, :5, 1, :6)"
+	insertStmt, err := tx.Prepare(query)
+	defer insertStmt.Close()
+	if err != nil {
+		message := fmt.Sprintf("Unable to prepare statement for insert (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	// consume the opening array brace
+	_, err = decoder.Token()
+	if err != nil {
+		message := fmt.Sprintf("Error decoding opening array token (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	// iterate each product
+	quality := newFeedQuality(product, schema, "product_class", "product_pillar", "product_line", "product_group")
+	counter := 1
+	loaded := 0
+	for decoder.More() {
+		// decode next record
+		var prod ProductLookup
+		err := decoder.Decode(&prod)
+		if err != nil {
+			message := fmt.Sprintf("Error decoding product (%s) %d: %s",
+				GlobalConfig.ECALOpportunitySyncTarget, counter, err.Error())
+			run.fail(message)
+			return
+		}
+		run.recordProcessed()
+		counter++
+
+		// score the record as it came in the feed
+		quality.addRecord(map[string]string{"product_class": prod.ProductClass, "product_pillar": prod.ProductPillar,
+			"product_line": prod.ProductLine, "product_group": prod.ProductGroup})
+
+		sanitizeFields(maxNameFieldLength, &prod.ProductClass, &prod.ProductPillar, &prod.ProductLine, &prod.ProductGroup)
+
+		// an entry without a class doesn't fit anywhere in the taxonomy
+		if len(prod.ProductClass) < 1 {
+			run.rejected++
+			continue
+		}
+
+		// add or refresh the entry in the LookupProduct table
+		result, err := updateStmt.Exec(loadTime, prod.ProductClass, prod.ProductPillar, prod.ProductLine, prod.ProductGroup)
+		if err == nil {
+			if updated, _ := result.RowsAffected(); updated == 0 {
+				_, err = insertStmt.Exec(baseID+int64(counter), prod.ProductClass, prod.ProductPillar, prod.ProductLine, prod.ProductGroup, loadTime)
+				run.inserted++
+			} else {
+				run.updated++
+			}
+		}
+		if err != nil {
+			message := fmt.Sprintf("Unable to insert product %s/%s/%s/%s into LookupProduct (%s): %s", prod.ProductClass,
+				prod.ProductPillar, prod.ProductLine, prod.ProductGroup, GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+			run.fail(message)
+			return
+		}
+		loaded++
+	}
+
+	// consume the closing array brace
+	_, err = decoder.Token()
+	if err != nil {
+		message := fmt.Sprintf("Error decoding closing array token (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	// deactivate entries that weren't in this feed
+	vanished, err := deactivateVanished(tx, schema+".LookupProduct", loadTime, loadScope{})
+	if err != nil {
+		message := fmt.Sprintf("Unable to deactivate vanished products in LookupProduct (%s): %s",
+			GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	// record the data quality of the feed along with the load
+	err = quality.save(tx)
+	if err != nil {
+		logEnv(GlobalConfig.ECALOpportunitySyncTarget, logWarn, "process_product", "Unable to record feed quality: "+err.Error())
+	}
+
+	// complete the transaction
+	err = tx.Commit()
+	if err != nil {
+		message := fmt.Sprintf("Error committing transaction (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	run.complete(counter-1, loaded)
+	message := fmt.Sprintf("DONE Processing %d products and loaded %d (%d vanished) for %s",
+		counter-1, loaded, vanished, GlobalConfig.ECALOpportunitySyncTarget)
+	logEnv(GlobalConfig.ECALOpportunitySyncTarget, logInfo, "process_product", message)
+}
@@ -0,0 +1,230 @@
+//  ProcessTerritory
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// TerritoryLookup represents a sales territory returned from the corporate feed
+type TerritoryLookup struct {
+	TerritoryName       string `json:"territory_name"`
+	TerritoryLevel      string `json:"territory_level"`
+	ParentTerritoryName string `json:"parent_territory_name"`
+	L1TerritoryName     string `json:"level_1_territory_name"`
+	L2TerritoryName     string `json:"level_2_territory_name"`
+	L3TerritoryName     string `json:"level_3_territory_name"`
+	OwnerEmail          string `json:"territory_owner_email"`
+	L2OwnerEmail        string `json:"level_2_territory_owner_email"`
+	L3OwnerEmail        string `json:"level_3_territory_owner_email"`
+}
+
+//
+// Process territories from JSON file to LookupTerritory table.  Territories are keyed by name and, like accounts,
+// are updated in place with the ones that drop out of the feed deactivated.
+//
+func processTerritory(job *loadJob, filename string) {
+
+	// determine appropriate instance-environment based on the value of the config.json setting
+	schema := lookupSchema(GlobalConfig.ECALOpportunitySyncTarget)
+	run := beginSyncRun(job, "process_territory", territory, schema, filename)
+	if len(schema) < 1 {
+		run.fail("Schema for " + GlobalConfig.ECALOpportunitySyncTarget + " not valid")
+		return
+	}
+
+	// only one load of the feed into the schema runs at a time, across every instance
+	lock, err := acquireSyncLock(territory, schema)
+	if err != nil {
+		run.fail(err.Error())
+		return
+	}
+	defer lock.release()
+
+	// open file for reading
+	file, err := os.Open(filename)
+	if err != nil {
+		message := fmt.Sprintf("Error opening file (%s): %s", filename, err.Error())
+		run.fail(message)
+		return
+	}
+	defer file.Close()
+
+	// seek 10 bytes (chars) to advance past {"items":
+	_, err = file.Seek(10, io.SeekStart)
+	if err != nil {
+		message := fmt.Sprintf("Error advancing file stream to position 10: %s", err.Error())
+		run.fail(message)
+		return
+	}
+
+	// make sure the feed still carries the fields we depend on before touching the database
+	err = validateFeedContract(territory, filename)
+	if err != nil {
+		run.fail(err.Error())
+		return
+	}
+
+	// decode full territory list from response
+	decoder := json.NewDecoder(file)
+	logEnv(GlobalConfig.ECALOpportunitySyncTarget, logInfo, "process_territory", "START Processing territories ("+GlobalConfig.ECALOpportunitySyncTarget+")")
+
+	// start a DB transaction
+	tx, err := DBPool.Begin()
+	defer tx.Rollback()
+	if err != nil {
+		message := fmt.Sprintf("Error creating DB transaction (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	loadTime := time.Now()
+	baseID, err := maxLookupID(tx, schema+".LookupTerritory")
+	if err != nil {
+		message := fmt.Sprintf("Unable to read max id from LookupTerritory (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	// prepare update & insert statements
+	query := "UPDATE " + schema + ".LookupTerritory SET " +
+		"TerritoryLevel = :1, ParentTerritoryName = :2, L1TerritoryName = :3, L2TerritoryName = :4, L3TerritoryName = :5, " +
+		"OwnerEmail = :6, L2OwnerEmail = :7, L3OwnerEmail = :8, " +
+		"active = 1, deactivateddate = null, deactivationreason = null, lastseendate = :9, " +
+		"lastupdatedate = SYSDATE, lastupdatedby = 'cto_bizlogic_helper' " +
+		"WHERE TerritoryName = :10"
+	updateStmt, err := tx.Prepare(query)
+	defer updateStmt.Close()
+	if err != nil {
+		message := fmt.Sprintf("Unable to prepare statement for update (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	query = "INSERT INTO " + schema + ".LookupTerritory" +
+		"(id, creationdate, lastupdatedate, createdby, lastupdatedby, " +
+		"TerritoryName, TerritoryLevel, ParentTerritoryName, L1TerritoryName, L2TerritoryName, L3TerritoryName, " +
+		"OwnerEmail, L2OwnerEmail, L3OwnerEmail, active, lastseendate) " +
+		"VALUES(:1, SYSDATE, SYSDATE, 'cto_bizlogic_helper', 'cto_bizlogic_helper', " +
+		":2, :3, :4, :5, :6, :7, :8, :9, :10, 1, :11)"
+	insertStmt, err := tx.Prepare(query)
+	defer insertStmt.Close()
+	if err != nil {
+		message := fmt.Sprintf("Unable to prepare statement for insert (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	// consume the opening array brace
+	_, err = decoder.Token()
+	if err != nil {
+		message := fmt.Sprintf("Error decoding opening array token (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	// iterate each territory
+	quality := newFeedQuality(territory, schema, "territory_name", "territory_level", "territory_owner_email")
+	counter := 1
+	loaded := 0
+	for decoder.More() {
+		// decode next record
+		var terr TerritoryLookup
+		err := decoder.Decode(&terr)
+		if err != nil {
+			message := fmt.Sprintf("Error decoding territory (%s) %d: %s",
+				GlobalConfig.ECALOpportunitySyncTarget, counter, err.Error())
+			run.fail(message)
+			return
+		}
+		run.recordProcessed()
+		counter++
+
+		// score the record as it came in the feed
+		quality.addRecord(map[string]string{"territory_name": terr.TerritoryName, "territory_level": terr.TerritoryLevel,
+			"territory_owner_email": terr.OwnerEmail})
+
+		sanitizeFields(maxNameFieldLength, &terr.TerritoryName, &terr.ParentTerritoryName, &terr.L1TerritoryName, &terr.L2TerritoryName, &terr.L3TerritoryName)
+		sanitizeFields(maxEmailFieldLength, &terr.OwnerEmail, &terr.L2OwnerEmail, &terr.L3OwnerEmail)
+
+		// a territory without a name can't be keyed
+		if len(terr.TerritoryName) < 1 {
+			run.rejected++
+			continue
+		}
+		var level sql.NullInt64
+		if value, err := strconv.ParseInt(terr.TerritoryLevel, 10, 64); err == nil {
+			level = sql.NullInt64{Int64: value, Valid: true}
+		}
+
+		// add or refresh the territory in the LookupTerritory staging table
+		result, err := updateStmt.Exec(level, terr.ParentTerritoryName, terr.L1TerritoryName, terr.L2TerritoryName, terr.L3TerritoryName,
+			terr.OwnerEmail, terr.L2OwnerEmail, terr.L3OwnerEmail, loadTime, terr.TerritoryName)
+		if err == nil {
+			if updated, _ := result.RowsAffected(); updated == 0 {
+				_, err = insertStmt.Exec(baseID+int64(counter), terr.TerritoryName, level, terr.ParentTerritoryName,
+					terr.L1TerritoryName, terr.L2TerritoryName, terr.L3TerritoryName, terr.OwnerEmail, terr.L2OwnerEmail, terr.L3OwnerEmail, loadTime)
+				run.inserted++
+			} else {
+				run.updated++
+			}
+		}
+		if err != nil {
+			message := fmt.Sprintf("Unable to insert territory %s into LookupTerritory (%s): %s", terr.TerritoryName,
+				GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+			run.fail(message)
+			return
+		}
+		loaded++
+	}
+
+	// consume the closing array brace
+	_, err = decoder.Token()
+	if err != nil {
+		message := fmt.Sprintf("Error decoding closing array token (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	// deactivate territories that weren't in this feed
+	vanished, err := deactivateVanished(tx, schema+".LookupTerritory", loadTime, loadScope{})
+	if err != nil {
+		message := fmt.Sprintf("Unable to deactivate vanished territories in LookupTerritory (%s): %s",
+			GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	// record the data quality of the feed along with the load
+	err = quality.save(tx)
+	if err != nil {
+		logEnv(GlobalConfig.ECALOpportunitySyncTarget, logWarn, "process_territory", "Unable to record feed quality: "+err.Error())
+	}
+
+	// complete the transaction
+	err = tx.Commit()
+	if err != nil {
+		message := fmt.Sprintf("Error committing transaction (%s): %s", GlobalConfig.ECALOpportunitySyncTarget, err.Error())
+		run.fail(message)
+		return
+	}
+
+	// refresh anything derived from the lookups (e.g. pipeline-by-territory materialized views) in the background
+	rows := counter - 1
+	startLoad("post_load", func(job *loadJob) {
+		runPostLoadHooks(job, GlobalConfig.ECALOpportunitySyncTarget, "LookupTerritory", rows)
+	})
+
+	run.complete(counter-1, loaded)
+	message := fmt.Sprintf("DONE Processing %d territories and loaded %d (%d vanished) for %s",
+		counter-1, loaded, vanished, GlobalConfig.ECALOpportunitySyncTarget)
+	logEnv(GlobalConfig.ECALOpportunitySyncTarget, logInfo, "process_territory", message)
+}
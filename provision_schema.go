@@ -0,0 +1,306 @@
+//  Schema Provisioning
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// provisionedTable is a table this service reads/writes in an application schema.  %SCHEMA% in the DDL is replaced
+// with the schema being provisioned.
+type provisionedTable struct {
+	Name     string
+	ECALOnly bool
+	DDL      []string
+}
+
+// the tables this service needs in every application schema (ECALOnly tables are only needed by ECAL schemas)
+var provisionedTables = []provisionedTable{
+	{Name: "MANAGERCLOSURE", DDL: []string{
+		`CREATE TABLE %SCHEMA%.MANAGERCLOSURE (
+			MANAGEREMAIL VARCHAR2(320) NOT NULL,
+			REPORTEMAIL  VARCHAR2(320) NOT NULL,
+			DEPTH        NUMBER NOT NULL)`,
+		`CREATE INDEX %SCHEMA%.MANAGERCLOSURE_IX1 ON %SCHEMA%.MANAGERCLOSURE (MANAGEREMAIL, REPORTEMAIL)`,
+		`CREATE INDEX %SCHEMA%.MANAGERCLOSURE_IX2 ON %SCHEMA%.MANAGERCLOSURE (LOWER(MANAGEREMAIL), REPORTEMAIL)`,
+	}},
+	{Name: "LOOKUPACCOUNT", ECALOnly: true, DDL: []string{
+		`CREATE TABLE %SCHEMA%.LOOKUPACCOUNT (
+			ID                 NUMBER PRIMARY KEY,
+			CREATIONDATE       DATE,
+			LASTUPDATEDATE     DATE,
+			CREATEDBY          VARCHAR2(320),
+			LASTUPDATEDBY      VARCHAR2(320),
+			ABCSCHANGENUMBER   VARCHAR2(100),
+			CIMID              VARCHAR2(100),
+			CIMPARENTID        VARCHAR2(100),
+			ACCOUNTNAME        VARCHAR2(400),
+			BUSINESSSEGMENT    VARCHAR2(400),
+			ENDUSERREGISTRYID  VARCHAR2(100),
+			GLOBALREGISTRYID   VARCHAR2(100),
+			REGISTRYIDLIST     VARCHAR2(4000),
+			NACSETEAM          VARCHAR2(400),
+			NATSETEAM          VARCHAR2(400),
+			CIMIDREG           VARCHAR2(200),
+			ACTIVE             NUMBER(1) DEFAULT 1 NOT NULL,
+			LASTSEENDATE       TIMESTAMP WITH TIME ZONE,
+			DEACTIVATEDDATE    TIMESTAMP WITH TIME ZONE,
+			DEACTIVATIONREASON VARCHAR2(20))`,
+		`CREATE UNIQUE INDEX %SCHEMA%.LOOKUPACCOUNT_UK1 ON %SCHEMA%.LOOKUPACCOUNT (CIMID)`,
+	}},
+	{Name: "LOOKUPOPPORTUNITY", ECALOnly: true, DDL: []string{
+		`CREATE TABLE %SCHEMA%.LOOKUPOPPORTUNITY (
+			ID                    NUMBER PRIMARY KEY,
+			CREATIONDATE          DATE,
+			LASTUPDATEDATE        DATE,
+			CREATEDBY             VARCHAR2(320),
+			LASTUPDATEDBY         VARCHAR2(320),
+			ABCSCHANGENUMBER      VARCHAR2(100),
+			OPPORTUNITYID         VARCHAR2(100),
+			SUMMARY               VARCHAR2(4000),
+			SALESREP              VARCHAR2(400),
+			PROJECTEDARR          NUMBER,
+			ANTICIPATEDCLOSEDATE  DATE,
+			WINPROBABILITY        NUMBER,
+			PROJECTEDTCV          NUMBER,
+			INTEGRATIONID         VARCHAR2(100),
+			REGISTRYID            VARCHAR2(100),
+			CIMID                 VARCHAR2(100),
+			OPPORTUNITYSTATUS     VARCHAR2(100),
+			CUSTOMERNAME          VARCHAR2(400),
+			TERRITORYOWNER        VARCHAR2(400),
+			OPPORTUNITYVALUE      NUMBER,
+			FORECASTTYPEGROUP     VARCHAR2(100),
+			REVENUELINEID         VARCHAR2(100),
+			REVENUETYPE           VARCHAR2(100),
+			REVENUETYPEGROUP      VARCHAR2(100),
+			REVENUELINESTATUS     VARCHAR2(100),
+			REVENUESALESSTAGE     VARCHAR2(100),
+			REVENUEPIPELINEK      NUMBER,
+			REVENUETCVK           NUMBER,
+			REVENUEPROBABILITY    NUMBER,
+			PRODUCTCLASS          VARCHAR2(400),
+			PRODUCTPILLAR         VARCHAR2(400),
+			PRODUCTLINE           VARCHAR2(400),
+			PRODUCTGROUP          VARCHAR2(400),
+			PRODUCTNAME           VARCHAR2(400),
+			PRODUCTDESCRIPTION    VARCHAR2(4000),
+			WORKLOADAMOUNT        NUMBER,
+			CONSUMPTIONSTARTDATE  VARCHAR2(100),
+			CONSUMPTIONRAMPMONTHS NUMBER,
+			L2TERRITORYNAME       VARCHAR2(400),
+			L3TERRITORYNAME       VARCHAR2(400),
+			L2TERRITORYEMAIL      VARCHAR2(320),
+			L3TERRITORYEMAIL      VARCHAR2(320),
+			ACTIVE                NUMBER(1) DEFAULT 1 NOT NULL,
+			LASTSEENDATE          TIMESTAMP WITH TIME ZONE,
+			DEACTIVATEDDATE       TIMESTAMP WITH TIME ZONE,
+			DEACTIVATIONREASON    VARCHAR2(20))`,
+		`CREATE UNIQUE INDEX %SCHEMA%.LOOKUPOPPORTUNITY_UK1 ON %SCHEMA%.LOOKUPOPPORTUNITY (OPPORTUNITYID, REVENUELINEID)`,
+	}},
+	{Name: "LOOKUPTERRITORY", ECALOnly: true, DDL: []string{
+		`CREATE TABLE %SCHEMA%.LOOKUPTERRITORY (
+			ID                  NUMBER PRIMARY KEY,
+			CREATIONDATE        DATE,
+			LASTUPDATEDATE      DATE,
+			CREATEDBY           VARCHAR2(320),
+			LASTUPDATEDBY       VARCHAR2(320),
+			TERRITORYNAME       VARCHAR2(400) NOT NULL,
+			TERRITORYLEVEL      NUMBER,
+			PARENTTERRITORYNAME VARCHAR2(400),
+			L1TERRITORYNAME     VARCHAR2(400),
+			L2TERRITORYNAME     VARCHAR2(400),
+			L3TERRITORYNAME     VARCHAR2(400),
+			OWNEREMAIL          VARCHAR2(320),
+			L2OWNEREMAIL        VARCHAR2(320),
+			L3OWNEREMAIL        VARCHAR2(320),
+			ACTIVE              NUMBER(1) DEFAULT 1 NOT NULL,
+			LASTSEENDATE        TIMESTAMP WITH TIME ZONE,
+			DEACTIVATEDDATE     TIMESTAMP WITH TIME ZONE,
+			DEACTIVATIONREASON  VARCHAR2(20))`,
+		`CREATE UNIQUE INDEX %SCHEMA%.LOOKUPTERRITORY_UK1 ON %SCHEMA%.LOOKUPTERRITORY (TERRITORYNAME)`,
+		`CREATE INDEX %SCHEMA%.LOOKUPTERRITORY_IX1 ON %SCHEMA%.LOOKUPTERRITORY (PARENTTERRITORYNAME)`,
+	}},
+	{Name: "LOOKUPPRODUCT", ECALOnly: true, DDL: []string{
+		`CREATE TABLE %SCHEMA%.LOOKUPPRODUCT (
+			ID                 NUMBER PRIMARY KEY,
+			CREATIONDATE       DATE,
+			LASTUPDATEDATE     DATE,
+			CREATEDBY          VARCHAR2(320),
+			LASTUPDATEDBY      VARCHAR2(320),
+			PRODUCTCLASS       VARCHAR2(400) NOT NULL,
+			PRODUCTPILLAR      VARCHAR2(400),
+			PRODUCTLINE        VARCHAR2(400),
+			PRODUCTGROUP       VARCHAR2(400),
+			ACTIVE             NUMBER(1) DEFAULT 1 NOT NULL,
+			LASTSEENDATE       TIMESTAMP WITH TIME ZONE,
+			DEACTIVATEDDATE    TIMESTAMP WITH TIME ZONE,
+			DEACTIVATIONREASON VARCHAR2(20))`,
+		`CREATE INDEX %SCHEMA%.LOOKUPPRODUCT_IX1 ON %SCHEMA%.LOOKUPPRODUCT (PRODUCTCLASS, PRODUCTPILLAR, PRODUCTLINE)`,
+	}},
+	{Name: "LOOKUPCONSUMPTION", ECALOnly: true, DDL: []string{
+		`CREATE TABLE %SCHEMA%.LOOKUPCONSUMPTION (
+			ID             NUMBER PRIMARY KEY,
+			CREATIONDATE   DATE,
+			LASTUPDATEDATE DATE,
+			CREATEDBY      VARCHAR2(320),
+			LASTUPDATEDBY  VARCHAR2(320),
+			CIMID          VARCHAR2(100) NOT NULL,
+			CUSTOMERNAME   VARCHAR2(400),
+			SUBSCRIPTIONID VARCHAR2(100) NOT NULL,
+			USAGEMONTH     DATE NOT NULL,
+			ACTUALUSAGE    NUMBER,
+			CURRENCYCODE   VARCHAR2(10),
+			LASTSEENDATE   TIMESTAMP WITH TIME ZONE)`,
+		`CREATE UNIQUE INDEX %SCHEMA%.LOOKUPCONSUMPTION_UK1 ON %SCHEMA%.LOOKUPCONSUMPTION (CIMID, SUBSCRIPTIONID, USAGEMONTH)`,
+	}},
+}
+
+// SchemaProvisioning is the outcome of provisioning a schema for an instance-environment
+type SchemaProvisioning struct {
+	InstanceEnv string           `json:"instance_environment"`
+	Schema      string           `json:"schema"`
+	Created     []string         `json:"created"`
+	Granted     []string         `json:"granted"`
+	SmokeCheck  map[string]int64 `json:"smoke_check"`
+}
+
+// errSchemaConflict is returned when the instance-environment is already mapped to a different schema
+var errSchemaConflict = errors.New("instance-environment already mapped to another schema")
+
+var instanceEnvPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)+$`)
+var schemaNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_$#]{0,127}$`)
+
+//
+// HTTP handler for the admin/provisionSchema functionality.  Creates the tables this service needs in a new
+// schema, grants the service user access, smoke checks the result and registers the instance-environment.
+//
+func provisionSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+
+	// get query parameters
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	schema := strings.ToUpper(query.Get("schema"))
+
+	// call the helper which does the data mashing
+	result, err := provisionSchema(instanceEnv, schema)
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		logRequest(r, logWarn, "provision_schema", fmt.Sprintf("Rejected provisioning of %s (%s): %s", instanceEnv, schema, inputErr.Error()))
+		return
+	}
+	if err == errSchemaConflict {
+		w.WriteHeader(409)
+		fmt.Fprintf(w, "%s is already mapped to %s", instanceEnv, lookupSchema(instanceEnv))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "provision_schema", err.Error())
+		return
+	}
+
+	message := fmt.Sprintf("Provisioned %s -> %s (created %v, granted %v)", instanceEnv, schema, result.Created, result.Granted)
+	logRequest(r, logInfo, "provision_schema", message)
+
+	// write result to output stream
+	json, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+//
+// Creates any of the provisionedTables missing from the schema, grants the service user DML on them when it
+// doesn't own the schema, checks each table can be queried and then adds the instance-environment to the schema
+// map.  Safe to re-run; tables that already exist are left alone.  The mapping only lives until the next restart
+// so InstanceEnvironments/SchemaNames in config.json still need to be updated.
+//
+func provisionSchema(instanceEnv string, schema string) (SchemaProvisioning, error) {
+	result := SchemaProvisioning{InstanceEnv: instanceEnv, Schema: schema, Created: []string{}, Granted: []string{}}
+
+	if !instanceEnvPattern.MatchString(instanceEnv) {
+		return result, inputError("instanceEnvironment must look like ecal-dev-stage or sts-prod-live")
+	}
+	if !schemaNamePattern.MatchString(schema) {
+		return result, inputError("schema must be a valid schema name")
+	}
+	existing := lookupSchema(instanceEnv)
+	if len(existing) > 0 && existing != schema {
+		return result, errSchemaConflict
+	}
+
+	var count int
+	err := DBPool.QueryRow("SELECT count(*) FROM all_users WHERE username = :1", schema).Scan(&count)
+	if err != nil {
+		thisError := fmt.Sprintf("Error looking up schema (%s, %s): %s", instanceEnv, schema, err.Error())
+		return result, errors.New(thisError)
+	}
+	if count == 0 {
+		return result, inputError("schema " + schema + " doesn't exist")
+	}
+
+	// DDL commits implicitly so there's no transaction here; each step is skipped if it's already been done
+	serviceUser := strings.ToUpper(dbServiceUser(GlobalConfig))
+	tables := []string{}
+	for _, table := range provisionedTables {
+		if table.ECALOnly && !strings.HasPrefix(instanceEnv, "ecal-") {
+			continue
+		}
+		tables = append(tables, table.Name)
+
+		err = DBPool.QueryRow("SELECT count(*) FROM all_tables WHERE owner = :1 AND table_name = :2", schema, table.Name).Scan(&count)
+		if err != nil {
+			thisError := fmt.Sprintf("Error looking up table (%s, %s.%s): %s", instanceEnv, schema, table.Name, err.Error())
+			return result, errors.New(thisError)
+		}
+		if count == 0 {
+			for _, ddl := range table.DDL {
+				_, err = DBPool.Exec(strings.ReplaceAll(ddl, "%SCHEMA%", schema))
+				if err != nil {
+					thisError := fmt.Sprintf("Error creating table (%s, %s.%s): %s", instanceEnv, schema, table.Name, err.Error())
+					return result, errors.New(thisError)
+				}
+			}
+			result.Created = append(result.Created, table.Name)
+		}
+
+		// ADMIN (or the schema owner) can already reach everything
+		if len(serviceUser) > 0 && serviceUser != schema && serviceUser != "ADMIN" {
+			_, err = DBPool.Exec("GRANT SELECT, INSERT, UPDATE, DELETE ON " + schema + "." + table.Name + " TO " + serviceUser)
+			if err != nil {
+				thisError := fmt.Sprintf("Error granting access (%s, %s.%s, %s): %s", instanceEnv, schema, table.Name, serviceUser, err.Error())
+				return result, errors.New(thisError)
+			}
+			result.Granted = append(result.Granted, table.Name)
+		}
+	}
+
+	// smoke check that every table this service touches can be read before the schema is put into service
+	result.SmokeCheck = make(map[string]int64)
+	for _, table := range tables {
+		var rows int64
+		err = DBPool.QueryRow("SELECT count(*) FROM " + schema + "." + table).Scan(&rows)
+		if err != nil {
+			thisError := fmt.Sprintf("Smoke check failed (%s, %s.%s): %s", instanceEnv, schema, table, err.Error())
+			return result, errors.New(thisError)
+		}
+		result.SmokeCheck[table] = rows
+	}
+
+	registerSchema(instanceEnv, schema)
+	return result, nil
+}
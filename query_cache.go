@@ -0,0 +1,259 @@
+//  Dashboard Query Cache
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default lifetime of a warmed query result when QueryCacheMinutes is not set.  Kept short since edits made in the
+// ECAL app aren't seen by a cached result until it expires.
+const defaultQueryCacheTTL = 15 * time.Minute
+
+// the most the cached results may add up to; the oldest are dropped to make room.  A full getECALDataQuery page can
+// run to megabytes so this caps memory rather than the number of users.
+const maxQueryCacheBytes = 256 * 1024 * 1024
+
+// the most users per instance-environment whose dashboard queries are warmed after a load, and how recently they must
+// have opened a dashboard to be one of them
+const maxWarmedUsers = 50
+const warmedUserWindow = 7 * 24 * time.Hour
+
+// queryCacheEntry is the cached result of one of the heavy dashboard queries
+type queryCacheEntry struct {
+	result      string
+	truncated   bool
+	nextCursor  string
+	loaded      time.Time
+	instanceEnv string
+}
+
+// queryCache is keyed by query|instanceEnv|scope|maxRows and guarded by queryCacheLock, as is the total size of the
+// results in it
+var queryCache = make(map[string]queryCacheEntry)
+var queryCacheBytes int
+var queryCacheLock sync.RWMutex
+
+// warmedUsers is when each user limited to their own accounts last asked for a cacheable dashboard query, keyed by
+// instance-environment and then email.  Guarded by warmedUsersLock.
+var warmedUsers = make(map[string]map[string]time.Time)
+var warmedUsersLock sync.Mutex
+
+//
+// Returns a cached query result.  The bool is false on a miss, an expired entry or when caching is disabled.
+//
+func getCachedQuery(key string) (queryCacheEntry, bool) {
+	queryCacheLock.RLock()
+	defer queryCacheLock.RUnlock()
+
+	entry, ok := queryCache[key]
+	if !ok || time.Since(entry.loaded) > queryCacheTTL() {
+		return queryCacheEntry{}, false
+	}
+	return entry, true
+}
+
+//
+// Stores a query result of instanceEnv, dropping the oldest results if the cache would grow past maxQueryCacheBytes.
+// Nothing is stored while caching is disabled.
+//
+func putCachedQuery(key string, instanceEnv string, entry queryCacheEntry) {
+	if queryCacheTTL() <= 0 || len(entry.result) > maxQueryCacheBytes {
+		return
+	}
+	queryCacheLock.Lock()
+	defer queryCacheLock.Unlock()
+	if previous, found := queryCache[key]; found {
+		queryCacheBytes -= len(previous.result)
+		delete(queryCache, key)
+	}
+	for queryCacheBytes+len(entry.result) > maxQueryCacheBytes && len(queryCache) > 0 {
+		oldestKey := ""
+		var oldest time.Time
+		for k, cached := range queryCache {
+			if len(oldestKey) < 1 || cached.loaded.Before(oldest) {
+				oldestKey, oldest = k, cached.loaded
+			}
+		}
+		queryCacheBytes -= len(queryCache[oldestKey].result)
+		delete(queryCache, oldestKey)
+	}
+	entry.loaded = time.Now()
+	entry.instanceEnv = instanceEnv
+	queryCache[key] = entry
+	queryCacheBytes += len(entry.result)
+}
+
+//
+// Drops every cached query result
+//
+func invalidateQueryCache() {
+	queryCacheLock.Lock()
+	defer queryCacheLock.Unlock()
+	count := len(queryCache)
+	queryCache = make(map[string]queryCacheEntry)
+	queryCacheBytes = 0
+	logOutput(logInfo, "query_cache", "Invalidated "+strconv.Itoa(count)+" cached query results")
+}
+
+//
+// Drops the cached query results of one instance-environment, as soon as a load into it or an edit made through this
+// service commits, so nobody is served results from before it
+//
+func invalidateQueryCacheFor(instanceEnv string) {
+	queryCacheLock.Lock()
+	defer queryCacheLock.Unlock()
+	count := 0
+	for key, entry := range queryCache {
+		if entry.instanceEnv == instanceEnv {
+			queryCacheBytes -= len(entry.result)
+			delete(queryCache, key)
+			count++
+		}
+	}
+	if count > 0 {
+		logEnv(instanceEnv, logInfo, "query_cache", fmt.Sprintf("Invalidated %d cached query results of %s", count, instanceEnv))
+	}
+}
+
+//
+// Runs the heavy dashboard queries (the ECAL data query and the admin account and opportunity lists) for every ECAL
+// instance-environment and caches the results, so the first manager to open a dashboard after the nightly load
+// doesn't wait on a cold query.  Called in the background after processOpportunity/processAccount commit.  Besides
+// the unrestricted results (those of admins and UnrestrictedClients) the results of the users who opened a dashboard
+// recently are warmed too (see warmScopes); anyone else's are cached as they are asked for.  Only the default (first)
+// page is warmed.
+//
+func warmQueryCache() {
+	invalidateQueryCache()
+	if queryCacheTTL() <= 0 {
+		return
+	}
+
+	maxRows := maxQueryRows()
+	for instanceEnv := range schemaMapSnapshot() {
+		if !strings.HasPrefix(instanceEnv, "ecal-") {
+			continue
+		}
+		start := time.Now()
+
+		scopes := warmScopes(instanceEnv)
+		for _, scope := range scopes {
+			err := warmScope(instanceEnv, scope, maxRows)
+			if err != nil {
+				logOutput(logError, "query_cache", err.Error())
+			}
+		}
+
+		message := fmt.Sprintf("Warmed dashboard queries for %s (%d users) in %s", instanceEnv, len(scopes)-1, time.Since(start).Round(time.Millisecond))
+		logOutput(logInfo, "query_cache", message)
+	}
+}
+
+//
+// Caches the first page of each dashboard query of instanceEnv as scope sees it
+//
+func warmScope(instanceEnv string, scope accessScope, maxRows int) error {
+	var result strings.Builder
+	nextCursor, err := getECALDataQuery(context.Background(), DBPool, instanceEnv, scope, queryFilters{}, maxRows, pageCursor{}, "", newItemWriter(&result, ""))
+	if err != nil {
+		return err
+	}
+	putCachedQuery(queryCacheKey("getECALDataQuery", instanceEnv, scope, maxRows), instanceEnv,
+		queryCacheEntry{result: result.String(), truncated: len(nextCursor) > 0, nextCursor: nextCursor})
+
+	result.Reset()
+	truncated, err := getECALAccountQuery(context.Background(), DBPool, instanceEnv, scope, maxRows, newItemWriter(&result, ""))
+	if err != nil {
+		return err
+	}
+	putCachedQuery(queryCacheKey("getECALAccountQuery", instanceEnv, scope, maxRows), instanceEnv, queryCacheEntry{result: result.String(), truncated: truncated})
+
+	result.Reset()
+	truncated, err = getECALOpportunityQuery(context.Background(), DBPool, instanceEnv, scope, queryFilters{}, "", maxRows, newItemWriter(&result, ""))
+	if err != nil {
+		return err
+	}
+	putCachedQuery(queryCacheKey("getECALOpportunityQuery", instanceEnv, scope, maxRows), instanceEnv, queryCacheEntry{result: result.String(), truncated: truncated})
+	return nil
+}
+
+//
+// Remembers that a user asked for one of instanceEnv's cacheable dashboard queries so the next warmQueryCache warms
+// their results too.  Unrestricted scopes are always warmed and aren't recorded.
+//
+func rememberWarmScope(instanceEnv string, scope accessScope) {
+	if scope.all {
+		return
+	}
+	warmedUsersLock.Lock()
+	defer warmedUsersLock.Unlock()
+	users := warmedUsers[instanceEnv]
+	if users == nil {
+		users = make(map[string]time.Time)
+		warmedUsers[instanceEnv] = users
+	}
+	users[scope.userEmail] = time.Now()
+
+	// forget whoever asked longest ago once there are too many to warm
+	for len(users) > maxWarmedUsers {
+		oldestEmail := ""
+		var oldest time.Time
+		for email, seen := range users {
+			if len(oldestEmail) < 1 || seen.Before(oldest) {
+				oldestEmail, oldest = email, seen
+			}
+		}
+		delete(users, oldestEmail)
+	}
+}
+
+//
+// Returns the scopes whose dashboard queries of instanceEnv are warmed: the unrestricted one, then the users who asked
+// for one within warmedUserWindow, most recent first.  Users who haven't asked since are forgotten.
+//
+func warmScopes(instanceEnv string) []accessScope {
+	warmedUsersLock.Lock()
+	defer warmedUsersLock.Unlock()
+	users := warmedUsers[instanceEnv]
+	emails := []string{}
+	for email, seen := range users {
+		if time.Since(seen) > warmedUserWindow {
+			delete(users, email)
+			continue
+		}
+		emails = append(emails, email)
+	}
+	sort.Slice(emails, func(i, j int) bool { return users[emails[i]].After(users[emails[j]]) })
+
+	scopes := []accessScope{allAccess}
+	for _, email := range emails {
+		scopes = append(scopes, accessScope{userEmail: email})
+	}
+	return scopes
+}
+
+//
+// Returns the cache key of a query's first page for the scope (all, or the user whose accounts it was limited to)
+//
+func queryCacheKey(query string, instanceEnv string, scope accessScope, maxRows int) string {
+	return query + "|" + instanceEnv + "|" + scope.String() + "|" + strconv.Itoa(maxRows)
+}
+
+func queryCacheTTL() time.Duration {
+	if len(GlobalConfig.QueryCacheMinutes) > 0 {
+		minutes, err := strconv.ParseFloat(GlobalConfig.QueryCacheMinutes, 64)
+		if err == nil {
+			return time.Duration(minutes * float64(time.Minute))
+		}
+	}
+	return defaultQueryCacheTTL
+}
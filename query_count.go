@@ -0,0 +1,87 @@
+//  Query Counts
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// queryCount is the number of rows a query endpoint's query matches and the last update time (YYYY-MM-DD HH24:MI:SS
+// in DBTimeZone) of the most recently updated of them, empty when there are none
+type queryCount struct {
+	rows         int64
+	lastModified string
+}
+
+//
+// True if a query endpoint was asked for countOnly=true, i.e. just the number of rows it would return
+//
+func countOnlyRequested(query url.Values) bool {
+	return strings.ToLower(query.Get("countOnly")) == "true"
+}
+
+//
+// Counts the rows a query endpoint's query matches in db rather than by fetching them, along with the
+// latest value of its modifiedColumn.  The query is run as an inline view so its DISTINCT and joins count as they
+// would be returned; a query prefixed with ecalColorFunction keeps the function declaration at the top as Oracle
+// requires.
+//
+func countQueryRows(ctx context.Context, db QueryRunner, query string, modifiedColumn string, args ...interface{}) (queryCount, error) {
+	prefix := ""
+	if strings.HasPrefix(query, ecalColorFunction) {
+		prefix = ecalColorFunction
+		query = strings.TrimPrefix(query, ecalColorFunction)
+	}
+
+	var count queryCount
+	var lastModified sql.NullString
+	err := db.QueryRowContext(ctx, prefix+"SELECT COUNT(*), MAX("+modifiedColumn+") FROM ("+query+")", args...).Scan(&count.rows, &lastModified)
+	if err != nil {
+		thisError := fmt.Sprintf("Error counting query rows: %s", err.Error())
+		return count, errors.New(thisError)
+	}
+	count.lastModified = lastModified.String
+	return count, nil
+}
+
+//
+// Writes the response to a countOnly or HEAD request, or the error as the query endpoints report them.  countOnly
+// gets {"count": N}; HEAD gets no body, just the count in X-Total-Count and the last update time in Last-Modified
+// so a poller can tell whether anything has changed.
+//
+func writeQueryCount(w http.ResponseWriter, r *http.Request, module string, count queryCount, err error) {
+	if queryCancelled(r.Context(), module, err) {
+		return
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, module, err.Error())
+		return
+	}
+
+	w.Header().Set("X-Total-Count", strconv.FormatInt(count.rows, 10))
+	if modified, err := time.ParseInLocation(queryTimestampLayout, count.lastModified, dbLocation); err == nil {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return
+	}
+	fmt.Fprintf(w, "{\"count\": %d}", count.rows)
+}
@@ -0,0 +1,151 @@
+//  Query Filters
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// the filter parameters the ECAL list queries understand; each endpoint supports some of them (see queryColumns)
+var queryFilterParams = []string{"accountName", "color", "stage", "techLead"}
+
+// filterColumn is how a filter parameter is matched: the SQL expression it is compared to (case-insensitively), whether
+// the value only has to be contained in it, and the values accepted when only some make sense
+type filterColumn struct {
+	expression string
+	contains   bool
+	values     []string
+}
+
+// queryColumns are the filters and sort orders an endpoint supports.  sorts maps each sortBy value to the SQL that is
+// ordered on, which for a paged endpoint is also the cursor's key and so must be a string.
+type queryColumns struct {
+	filters     map[string]filterColumn
+	sorts       map[string]string
+	defaultSort string
+}
+
+// queryFilters are the filters and sort order a caller asked for.  sortBy is empty for the endpoint's default order.
+type queryFilters struct {
+	values     map[string]string
+	sortBy     string
+	descending bool
+}
+
+//
+// Reads the filter parameters and sortBy/sortOrder from a request for an endpoint with the given columns, rejecting
+// ones the endpoint doesn't support
+//
+func parseQueryFilters(params url.Values, columns queryColumns) (queryFilters, error) {
+	filters := queryFilters{values: make(map[string]string)}
+	for _, param := range queryFilterParams {
+		value := strings.TrimSpace(params.Get(param))
+		if len(value) < 1 {
+			continue
+		}
+		column, found := columns.filters[param]
+		if !found {
+			return filters, inputError(fmt.Sprintf("%s can't be used with this endpoint", param))
+		}
+		value = strings.ToUpper(value)
+		if len(column.values) > 0 && !configListContains(column.values, value) {
+			return filters, inputError(fmt.Sprintf("%s must be one of %s", param, strings.Join(column.values, ", ")))
+		}
+		filters.values[param] = value
+	}
+
+	sortBy := params.Get("sortBy")
+	if len(sortBy) > 0 {
+		if _, found := columns.sorts[sortBy]; !found {
+			return filters, inputError("sortBy must be one of " + strings.Join(sortedKeys(columns.sorts), ", "))
+		}
+	}
+	switch strings.ToLower(params.Get("sortOrder")) {
+	case "", "asc":
+	case "desc":
+		filters.descending = true
+		if len(sortBy) < 1 {
+			sortBy = columns.defaultSort
+		}
+	default:
+		return filters, inputError("sortOrder must be asc or desc")
+	}
+	if sortBy != columns.defaultSort || filters.descending {
+		filters.sortBy = sortBy
+	}
+	return filters, nil
+}
+
+//
+// True if no filter was given and the default order is used, i.e. the result is the endpoint's plain one
+//
+func (filters queryFilters) empty() bool {
+	return len(filters.values) < 1 && len(filters.sortBy) < 1
+}
+
+//
+// Identifies the sort order for a cursor, so a cursor from one order isn't used to page through another.  Empty for
+// the default order, whose cursors are unchanged.
+//
+func (filters queryFilters) sortID() string {
+	if len(filters.sortBy) < 1 {
+		return ""
+	}
+	if filters.descending {
+		return filters.sortBy + " desc"
+	}
+	return filters.sortBy + " asc"
+}
+
+//
+// Returns the WHERE conditions of the filters, with bind variables numbered from first, and their arguments.  The
+// values are always bound, never spliced into the SQL.
+//
+func (filters queryFilters) conditions(columns queryColumns, first int) ([]string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+	for _, param := range queryFilterParams {
+		value, found := filters.values[param]
+		if !found {
+			continue
+		}
+		column := columns.filters[param]
+		if column.contains {
+			pattern := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(value)
+			conditions = append(conditions, fmt.Sprintf("UPPER(%s) LIKE :%d ESCAPE '\\'", column.expression, first+len(args)))
+			args = append(args, "%"+pattern+"%")
+		} else {
+			conditions = append(conditions, fmt.Sprintf("UPPER(%s) = :%d", column.expression, first+len(args)))
+			args = append(args, value)
+		}
+	}
+	return conditions, args
+}
+
+//
+// Returns the SQL the results are ordered on and ASC or DESC
+//
+func (filters queryFilters) order(columns queryColumns) (string, string) {
+	sortBy := filters.sortBy
+	if len(sortBy) < 1 {
+		sortBy = columns.defaultSort
+	}
+	if filters.descending {
+		return columns.sorts[sortBy], "DESC"
+	}
+	return columns.sorts[sortBy], "ASC"
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
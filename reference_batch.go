@@ -0,0 +1,292 @@
+//  PostReferenceBatch Handler
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the largest ZIP accepted and the largest feed it may unpack to
+const maxReferenceBatchBytes = 512 << 20
+const maxReferenceFeedBytes = 2 << 30
+
+// name of the optional manifest in a batch ZIP
+const referenceBatchManifest = "manifest.json"
+
+// the order feeds in a batch are processed in, so each feed's lookups are loaded before the feeds that refer to them
+var referenceBatchOrder = []string{identity, territory, product, account, opportunity, consumption}
+
+// only one batch runs at a time
+var referenceBatchRunning bool
+var referenceBatchLock sync.Mutex
+
+// ReferenceBatchManifest optionally names the file holding each feed in a batch ZIP (e.g. {"feeds":
+// {"identity": "people.json"}}).  Without it the files are taken from their names, e.g. identity.json.
+type ReferenceBatchManifest struct {
+	Feeds map[string]string `json:"feeds"`
+}
+
+// ReferenceBatch is the response to a batch upload: the feeds found, in the order they will be processed, and the
+// load job processing them
+type ReferenceBatch struct {
+	Feeds []string `json:"feeds"`
+	JobID string   `json:"job_id"`
+}
+
+//
+// HTTP handler that takes a single ZIP of complete reference data files (identity.json, account.json,
+// opportunity.json, ... or the files named by a manifest.json) in place of the chunked postReferenceData calls.  The
+// files are unpacked to where postReferenceData assembles them and processed one after another in dependency order in
+// the background; a feed that fails stops the feeds after it.
+//
+func postReferenceBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+
+	referenceBatchLock.Lock()
+	if referenceBatchRunning {
+		referenceBatchLock.Unlock()
+		w.WriteHeader(409)
+		fmt.Fprintf(w, "A reference data batch is already being processed")
+		return
+	}
+	referenceBatchRunning = true
+	referenceBatchLock.Unlock()
+	started := false
+	defer func() {
+		if !started {
+			finishReferenceBatch()
+		}
+	}()
+
+	// a ZIP has to be read from the end so spool it to disk first
+	archive, err := ioutil.TempFile("", "reference-batch-*.zip")
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Processing Error")
+		logRequest(r, logError, "reference_batch", "Unable to create batch file: "+err.Error())
+		return
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	size, err := io.Copy(archive, http.MaxBytesReader(w, r.Body, maxReferenceBatchBytes))
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Unable to read body; the ZIP may be at most %d bytes", maxReferenceBatchBytes)
+		logRequest(r, logError, "reference_batch", "Unable to read body: "+err.Error())
+		return
+	}
+
+	feeds, err := unpackReferenceBatch(archive, size)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid reference data batch: %s", err.Error())
+		logRequest(r, logError, "reference_batch", "Invalid reference data batch: "+err.Error())
+		return
+	}
+
+	job := startLoad("reference_batch", func(job *loadJob) { processReferenceBatch(job, feeds) })
+	if job == nil {
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "The service is shutting down")
+		return
+	}
+	started = true
+	message := fmt.Sprintf("START Processing reference data batch %v (job %s)", feeds, job.ID)
+	logRequest(r, logInfo, "reference_batch", message)
+
+	json, _ := json.Marshal(ReferenceBatch{Feeds: feeds, JobID: job.ID})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(202)
+	w.Write(json)
+}
+
+func finishReferenceBatch() {
+	referenceBatchLock.Lock()
+	referenceBatchRunning = false
+	referenceBatchLock.Unlock()
+}
+
+//
+// Writes each feed in the ZIP to dataType.json and returns the data types found in the order they are to be
+// processed.  Nothing is written unless the whole ZIP is valid.
+//
+func unpackReferenceBatch(archive *os.File, size int64) ([]string, error) {
+	reader, err := zip.NewReader(archive, size)
+	if err != nil {
+		return nil, err
+	}
+
+	// directories and hidden files (e.g. the ._ files macOS adds) are ignored
+	files := make(map[string]*zip.File)
+	for _, file := range reader.File {
+		name := path.Base(file.Name)
+		if !file.FileInfo().IsDir() && !strings.HasPrefix(name, ".") {
+			files[name] = file
+		}
+	}
+
+	// work out which file holds each feed
+	entries := make(map[string]*zip.File)
+	if manifestFile, found := files[referenceBatchManifest]; found {
+		var manifest ReferenceBatchManifest
+		err = readReferenceBatchManifest(manifestFile, &manifest)
+		if err != nil {
+			thisError := fmt.Sprintf("%s is invalid: %s", referenceBatchManifest, err.Error())
+			return nil, errors.New(thisError)
+		}
+		for dataType, name := range manifest.Feeds {
+			if !isReferenceDataType(dataType) {
+				thisError := fmt.Sprintf("%s names unknown type %s", referenceBatchManifest, dataType)
+				return nil, errors.New(thisError)
+			}
+			file, found := files[path.Base(name)]
+			if !found {
+				thisError := fmt.Sprintf("%s names %s which isn't in the ZIP", referenceBatchManifest, name)
+				return nil, errors.New(thisError)
+			}
+			entries[dataType] = file
+		}
+	} else {
+		for name, file := range files {
+			dataType := name[:len(name)-len(path.Ext(name))]
+			if path.Ext(name) != ".json" || !isReferenceDataType(dataType) {
+				thisError := fmt.Sprintf("%s isn't a reference data file; expected TYPE.json or a %s", name, referenceBatchManifest)
+				return nil, errors.New(thisError)
+			}
+			entries[dataType] = file
+		}
+	}
+	if len(entries) < 1 {
+		return nil, errors.New("the ZIP has no reference data files")
+	}
+
+	// unpack next to each file's final name and only move them into place once all of them are unpacked
+	feeds := []string{}
+	for _, dataType := range referenceBatchOrder {
+		if file, found := entries[dataType]; found {
+			err = extractReferenceFile(file, dataType+".json.batch")
+			if err != nil {
+				thisError := fmt.Sprintf("Unable to unpack %s: %s", file.Name, err.Error())
+				return nil, errors.New(thisError)
+			}
+			feeds = append(feeds, dataType)
+		}
+	}
+	for _, dataType := range feeds {
+		err = os.Rename(dataType+".json.batch", dataType+".json")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return feeds, nil
+}
+
+func readReferenceBatchManifest(file *zip.File, manifest *ReferenceBatchManifest) error {
+	reader, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return json.NewDecoder(io.LimitReader(reader, 1<<20)).Decode(manifest)
+}
+
+func extractReferenceFile(file *zip.File, filename string) error {
+	reader, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	output, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0700)
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(output, io.LimitReader(reader, maxReferenceFeedBytes+1))
+	if err == nil && written > maxReferenceFeedBytes {
+		err = fmt.Errorf("unpacks to more than %d bytes", maxReferenceFeedBytes)
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+	}
+	return err
+}
+
+func isReferenceDataType(dataType string) bool {
+	for _, known := range referenceBatchOrder {
+		if dataType == known {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Runs the processor of each feed in turn.  The processors report their own outcome to SYNC_METADATA so a feed
+// has loaded if its last success moved on while it ran.  Their counts and failures are added up in job.
+//
+func processReferenceBatch(job *loadJob, feeds []string) {
+	defer finishReferenceBatch()
+	started := time.Now()
+
+	for i, dataType := range feeds {
+		schema := lookupSchema(GlobalConfig.ECALOpportunitySyncTarget)
+		if dataType == identity {
+			schema = "CTO_COMMON"
+		}
+		before, _, err := getLastSyncSuccess(dataType, schema)
+		if err != nil {
+			message := fmt.Sprintf("Unable to read sync status before processing %s: %s", dataType, err.Error())
+			logOutput(logError, "reference_batch", message)
+			job.fail(message)
+			return
+		}
+
+		filename := dataType + ".json"
+		switch dataType {
+		case identity:
+			processIdentity(job, filename)
+		case territory:
+			processTerritory(job, filename)
+		case product:
+			processProduct(job, filename)
+		case account:
+			processAccount(job, filename, loadScope{})
+		case opportunity:
+			processOpportunity(job, filename, loadScope{})
+		case consumption:
+			processConsumption(job, filename)
+		}
+
+		after, found, err := getLastSyncSuccess(dataType, schema)
+		if err != nil || !found || !after.After(before) {
+			message := fmt.Sprintf("STOPPED Processing reference data batch; %s didn't load so %v weren't processed", dataType, feeds[i+1:])
+			logOutput(logError, "reference_batch", message)
+			job.fail(message)
+			return
+		}
+	}
+
+	message := fmt.Sprintf("DONE Processing reference data batch %v in %s", feeds, time.Since(started).Round(time.Second))
+	logOutput(logInfo, "reference_batch", message)
+}
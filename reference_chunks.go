@@ -0,0 +1,124 @@
+//  Reference Data Chunks
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// an Idempotency-Key is 1 to 128 letters, digits, ., _, : or -
+var chunkKeyPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// postReferenceData calls that add to a file hold this, so a retried chunk arriving while the original is still being
+// written waits for it and is then seen as a duplicate
+var referenceChunkLock sync.Mutex
+
+//
+// Returns the key that identifies a postReferenceData chunk: the Idempotency-Key header or, without one, the chunk
+// query string parameter (the chunk's sequence number within the file).  Returns "" for a call with neither, which is
+// appended as before.
+//
+func referenceChunkKey(r *http.Request) (string, error) {
+	if key := r.Header.Get("Idempotency-Key"); len(key) > 0 {
+		if !chunkKeyPattern.MatchString(key) {
+			return "", inputError("Idempotency-Key header must be 1 to 128 letters, digits, ., _, : or -")
+		}
+		return key, nil
+	}
+	if sequence := r.URL.Query().Get("chunk"); len(sequence) > 0 {
+		number, err := strconv.Atoi(sequence)
+		if err != nil || number < 0 {
+			return "", inputError("chunk query string parameter must be a sequence number of 0 or more")
+		}
+		return "chunk:" + strconv.Itoa(number), nil
+	}
+	return "", nil
+}
+
+// the chunks received since a file's first chunk are logged next to it, one "key<TAB>job id" line each
+func chunkLogFilename(filename string) string {
+	return filename + ".chunks"
+}
+
+//
+// Starts the chunk log of a file over with its first chunk, whose key may be "".  Keys from an earlier upload of
+// the file are forgotten, so sequence numbers can start again from the beginning.
+//
+func startChunkLog(filename string, key string) error {
+	var entry string
+	if len(key) > 0 {
+		entry = key + "\t\n"
+	}
+	err := ioutil.WriteFile(chunkLogFilename(filename), []byte(entry), 0700)
+	if err != nil {
+		thisError := fmt.Sprintf("Error starting chunk log (%s): %s", filename, err.Error())
+		return errors.New(thisError)
+	}
+	return nil
+}
+
+//
+// Logs the chunk with key as received, along with the id of the load job it started if it was the last one
+//
+func recordChunk(filename string, key string, jobID string) error {
+	file, err := os.OpenFile(chunkLogFilename(filename), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0700)
+	if err != nil {
+		thisError := fmt.Sprintf("Error opening chunk log (%s): %s", filename, err.Error())
+		return errors.New(thisError)
+	}
+	_, err = fmt.Fprintf(file, "%s\t%s\n", key, jobID)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		thisError := fmt.Sprintf("Error writing chunk log (%s): %s", filename, err.Error())
+		return errors.New(thisError)
+	}
+	return nil
+}
+
+//
+// Returns the keys of the chunks received since the file's first chunk, each with the id of the load job it started
+// (or "").  A file without a chunk log has had none.
+//
+func readChunkLog(filename string) (map[string]string, error) {
+	chunks := make(map[string]string)
+	file, err := os.Open(chunkLogFilename(filename))
+	if os.IsNotExist(err) {
+		return chunks, nil
+	}
+	if err != nil {
+		thisError := fmt.Sprintf("Error opening chunk log (%s): %s", filename, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer file.Close()
+
+	// a key is logged again with its job id once the load it started is running, so the last entry wins
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(fields[0]) < 1 {
+			continue
+		}
+		chunks[fields[0]] = ""
+		if len(fields) > 1 {
+			chunks[fields[0]] = fields[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		thisError := fmt.Sprintf("Error reading chunk log (%s): %s", filename, err.Error())
+		return nil, errors.New(thisError)
+	}
+	return chunks, nil
+}
@@ -5,6 +5,8 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -21,10 +23,14 @@ const reprocess = "reprocess"
 const identity = "identity"
 const opportunity = "opportunity"
 const account = "account"
+const territory = "territory"
+const product = "product"
+const consumption = "consumption"
 
 //
 // HTTP handler that takes chunks of external reference data, combines into files, and calls the appropriate
-// handler to process
+// handler to process.  The last (or reprocess) call returns 202 with the id of the load job the processing runs as.
+// A chunk sent again with the same Idempotency-Key or chunk number is ignored.
 //
 func postReferenceDataHandler(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
@@ -33,92 +39,211 @@ func postReferenceDataHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(500)
 		fmt.Fprintf(w, "Missing or invalid position query string parameter")
 		message := fmt.Sprintf("Missing or invalid position parameter: %s", position)
-		logOutput(logError, "reference_data", message)
+		logRequest(r, logError, "reference_data", message)
 		return
 	}
 
 	dataType := query.Get("type")
-	if dataType != identity && dataType != opportunity && dataType != account {
+	if dataType != identity && dataType != opportunity && dataType != account && dataType != territory && dataType != product &&
+		dataType != consumption {
 		w.WriteHeader(500)
 		fmt.Fprintf(w, "Missing or invalid type query string parameter")
 		message := fmt.Sprintf("Missing or invalid type parameter: %s", dataType)
-		logOutput(logError, "reference_data", message)
+		logRequest(r, logError, "reference_data", message)
+		return
+	}
+
+	// a reprocess of the opportunity or account feed can be limited to some accounts, and of the opportunity feed
+	// to a territory
+	scope, err := parseLoadScope(query)
+	if err == nil && !scope.full() && (position != reprocess || (dataType != opportunity && dataType != account)) {
+		err = errors.New("a load scope can only be given to reprocess the opportunity or account feed")
+	}
+	if err == nil && scope.byTerritory() && dataType != opportunity {
+		err = errors.New("l2Territory and l3Territory can only be given to reprocess the opportunity feed")
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Invalid cimIds, accountIds, l2Territory or l3Territory query string parameter")
+		message := fmt.Sprintf("Invalid load scope (%s, %s): %s", position, dataType, err.Error())
+		logRequest(r, logError, "reference_data", message)
 		return
 	}
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		message := fmt.Sprintf("Unable to read body: %s", err.Error())
-		logOutput(logError, "reference_data", message)
-		fmt.Fprintf(w, "Unable to read body")
+		logRequest(r, logError, "reference_data", message)
 		w.WriteHeader(500)
+		fmt.Fprintf(w, "Unable to read body")
 		return
 	}
 
-	//fmt.Printf("[%s] postReferenceDataHandler: Payload size: %d\n",time.Now().Format(time.RFC3339), len(body))
+	logRequest(r, logDebug, "reference_data", fmt.Sprintf("Payload size: %d", len(body)))
 
-	// write data to filesystem
+	// a chunk sent again with the same key (e.g. retried by the exporter after a timeout) is only appended once, and
+	// a last chunk sent again doesn't start a second load
 	filename := dataType + ".json"
+	key, err := referenceChunkKey(r)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+	chunkJob, duplicate := "", false
+	if position != reprocess {
+		referenceChunkLock.Lock()
+		defer referenceChunkLock.Unlock()
+	}
+	if len(key) > 0 && (position == middle || position == last) {
+		chunks, err := readChunkLog(filename)
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Processing Error")
+			logRequest(r, logError, "reference_data", err.Error())
+			return
+		}
+		chunkJob, duplicate = chunks[key]
+	}
+	if duplicate && (position == middle || len(chunkJob) > 0) {
+		message := fmt.Sprintf("Ignoring chunk %s already received in %s position (%s)", key, position, dataType)
+		logRequest(r, logWarn, "reference_data", message)
+		w.Header().Set("Idempotent-Replayed", "true")
+		if position == last {
+			result, _ := json.Marshal(map[string]string{"job_id": chunkJob, "type": dataType})
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(result)
+		}
+		return
+	}
+
+	// write data to filesystem
 	if position == first {
 		// first position requires opening a new file and writing to it.  if an old file exists it is overwritten
 		err = ioutil.WriteFile(filename, body, 0700)
 		if err != nil {
 			message := fmt.Sprintf("Error writing to file in 'first' position (%s): %s", dataType, err.Error())
-			logOutput(logError, "reference_data", message)
+			logRequest(r, logError, "reference_data", message)
+			w.WriteHeader(500)
 			fmt.Fprintf(w, "Processing Error")
+			return
+		}
+
+		// the file starts over, and so do the chunks received
+		err = startChunkLog(filename, key)
+		if err != nil {
+			logRequest(r, logError, "reference_data", err.Error())
 			w.WriteHeader(500)
+			fmt.Fprintf(w, "Processing Error")
+			return
 		}
 		message := fmt.Sprintf("START Collecting Data (%s)", dataType)
-		logOutput(logInfo, "reference_data", message)
+		logRequest(r, logInfo, "reference_data", message)
 	} else {
 		// all other normative positions (middle & last) require appending to the existing file
-		// we don't do this when reprocessing; we assume a complete file is already on disk
-		if position == middle || position == last {
+		// we don't do this when reprocessing; we assume a complete file is already on disk, nor for a chunk already
+		// appended (a last chunk sent again after its load couldn't start gets here to start it)
+		if (position == middle || position == last) && !duplicate {
+			// a chunk that couldn't be appended isn't logged as received, so the exporter's retry of it is
+			// appended rather than ignored, and a last one doesn't start a load of the partial file
 			file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0700)
 			if err != nil {
 				message := fmt.Sprintf("Error writing datatype %s to file %s in %s position: %s",
 					dataType, filename, position, err.Error())
-				logOutput(logError, "reference_data", message)
-				fmt.Fprintf(w, "Processing Error")
+				logRequest(r, logError, "reference_data", message)
 				w.WriteHeader(500)
+				fmt.Fprintf(w, "Processing Error")
+				return
 			}
 
-			if _, err := file.Write(body); err != nil {
-				file.Close()
+			_, err = file.Write(body)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
 				message := fmt.Sprintf("Error writing datatype %s to file %s in %s position: %s",
 					dataType, filename, position, err.Error())
-				logOutput(logError, "reference_data", message)
-				fmt.Fprintf(w, "Processing Error")
+				logRequest(r, logError, "reference_data", message)
 				w.WriteHeader(500)
+				fmt.Fprintf(w, "Processing Error")
+				return
+			}
+
+			if len(key) > 0 {
+				err = recordChunk(filename, key, "")
+				if err != nil {
+					logRequest(r, logError, "reference_data", err.Error())
+					w.WriteHeader(500)
+					fmt.Fprintf(w, "Processing Error")
+					return
+				}
 			}
-			file.Close()
 		}
 
 		// in last position we need to kick off processing.  same applies to reprocessing.
 		if position == last || position == reprocess {
 			message := fmt.Sprintf("DONE Collecting Data (%s)", dataType)
-			logOutput(logInfo, "reference_data", message)
+			logRequest(r, logInfo, "reference_data", message)
+			var job *loadJob
 
 			// process identity data in separate goroutine
 			if dataType == identity {
 				message = fmt.Sprintf("Handing off to identity processor (%s)", dataType)
-				logOutput(logInfo, "reference_data", message)
-				go processIdentity(filename)
+				logRequest(r, logInfo, "reference_data", message)
+				job = startLoad(identity, func(job *loadJob) { processIdentity(job, filename) })
 			}
 
 			// process opportunity data in separate goroutine
 			if dataType == opportunity {
-				message = fmt.Sprintf("Handing off to opportunity processor (%s)", dataType)
-				logOutput(logInfo, "reference_data", message)
-				go processOpportunity(filename)
+				message = fmt.Sprintf("Handing off to opportunity processor (%s, %s)", dataType, scope)
+				logRequest(r, logInfo, "reference_data", message)
+				job = startLoad(opportunity, func(job *loadJob) { processOpportunity(job, filename, scope) })
 			}
 
 			// process account data in separate goroutine
 			if dataType == account {
-				message = fmt.Sprintf("Handing off to account processor (%s)", dataType)
-				logOutput(logInfo, "reference_data", message)
-				go processAccount(filename)
+				message = fmt.Sprintf("Handing off to account processor (%s, %s)", dataType, scope)
+				logRequest(r, logInfo, "reference_data", message)
+				job = startLoad(account, func(job *loadJob) { processAccount(job, filename, scope) })
+			}
+
+			// process territory data in separate goroutine
+			if dataType == territory {
+				message = fmt.Sprintf("Handing off to territory processor (%s)", dataType)
+				logRequest(r, logInfo, "reference_data", message)
+				job = startLoad(territory, func(job *loadJob) { processTerritory(job, filename) })
+			}
+
+			// process product catalog data in separate goroutine
+			if dataType == product {
+				message = fmt.Sprintf("Handing off to product processor (%s)", dataType)
+				logRequest(r, logInfo, "reference_data", message)
+				job = startLoad(product, func(job *loadJob) { processProduct(job, filename) })
+			}
+
+			// process consumption data in separate goroutine
+			if dataType == consumption {
+				message = fmt.Sprintf("Handing off to consumption processor (%s)", dataType)
+				logRequest(r, logInfo, "reference_data", message)
+				job = startLoad(consumption, func(job *loadJob) { processConsumption(job, filename) })
+			}
+
+			// the caller follows the load through its job
+			if job == nil {
+				w.WriteHeader(503)
+				fmt.Fprintf(w, "The service is shutting down")
+				return
+			}
+			if len(key) > 0 && position == last {
+				err = recordChunk(filename, key, job.ID)
+				if err != nil {
+					logRequest(r, logWarn, "reference_data", err.Error())
+				}
 			}
+			result, _ := json.Marshal(map[string]string{"job_id": job.ID, "type": dataType})
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(202)
+			w.Write(result)
 		}
 	}
 }
@@ -0,0 +1,123 @@
+//  Replay Protection
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how far a push's timestamp may be from the server's clock when ReplayWindowMinutes isn't set
+const defaultReplayWindow = 5 * time.Minute
+
+var requestNoncePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{16,128}$`)
+
+// errRequestReplayed is returned for a push whose nonce has already been used
+var errRequestReplayed = errors.New("request nonce has already been used")
+
+// when the expired nonces were last removed, so that happens at most once a minute
+var lastNoncePurge time.Time
+var noncePurgeLock sync.Mutex
+
+//
+// Wraps a push handler (postReferenceData, postReferenceBatch, postIdentities) so that, when ReplayProtection is
+// "true", each request must carry an X-Request-Timestamp (Unix seconds) within the replay window of now and an
+// X-Request-Nonce not used before.  A captured request can then only be replayed within the window, and only if the
+// original never arrived.
+//
+func replayProtected(pass handler) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !GlobalConfig.ReplayProtection {
+			pass(w, r)
+			return
+		}
+		client, _, _ := r.BasicAuth()
+		err := checkRequestNonce(client, r.URL.Path, r.Header.Get("X-Request-Timestamp"), r.Header.Get("X-Request-Nonce"))
+		if inputErr, ok := err.(inputError); ok {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", inputErr.Error())
+			logRequest(r, logWarn, "replay_protection", fmt.Sprintf("Rejected push to %s from %s: %s", r.URL.Path, client, inputErr.Error()))
+			return
+		}
+		if err == errRequestReplayed {
+			w.WriteHeader(409)
+			fmt.Fprintf(w, "Request has already been received")
+			logRequest(r, logWarn, "replay_protection", fmt.Sprintf("Rejected replayed push to %s from %s", r.URL.Path, client))
+			return
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+			logRequest(r, logError, "replay_protection", err.Error())
+			return
+		}
+		pass(w, r)
+	}
+}
+
+func replayWindow() time.Duration {
+	minutes, err := strconv.Atoi(GlobalConfig.ReplayWindowMinutes)
+	if err != nil || minutes < 1 {
+		return defaultReplayWindow
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+//
+// Checks the timestamp is within the replay window and records the nonce, returning errRequestReplayed if it has
+// been seen before.  Nonces are kept in CTO_COMMON.REQUEST_NONCE so every instance sees them.
+//
+func checkRequestNonce(client string, path string, timestamp string, nonce string) error {
+	window := replayWindow()
+	seconds, err := strconv.ParseInt(strings.TrimSpace(timestamp), 10, 64)
+	if err != nil {
+		return inputError("X-Request-Timestamp header must be the time of the request in Unix seconds")
+	}
+	if math.Abs(time.Since(time.Unix(seconds, 0)).Seconds()) > window.Seconds() {
+		return inputError(fmt.Sprintf("X-Request-Timestamp must be within %d minutes of the server's time", int(window.Minutes())))
+	}
+	if !requestNoncePattern.MatchString(nonce) {
+		return inputError("X-Request-Nonce header must be 16 to 128 letters, digits, - or _ used for a single request")
+	}
+
+	purgeRequestNonces(window)
+	_, err = DBPool.Exec("INSERT INTO CTO_COMMON.REQUEST_NONCE (nonce, client, path, seen) VALUES (:1, :2, :3, SYSTIMESTAMP)",
+		nonce, client, path)
+	if err != nil {
+		// ORA-00001: unique constraint violated
+		if strings.Contains(err.Error(), "ORA-00001") {
+			return errRequestReplayed
+		}
+		thisError := fmt.Sprintf("Error recording request nonce: %s", err.Error())
+		return errors.New(thisError)
+	}
+	return nil
+}
+
+//
+// Removes the nonces old enough that a request carrying them would be outside the window anyway
+//
+func purgeRequestNonces(window time.Duration) {
+	noncePurgeLock.Lock()
+	if time.Since(lastNoncePurge) < time.Minute {
+		noncePurgeLock.Unlock()
+		return
+	}
+	lastNoncePurge = time.Now()
+	noncePurgeLock.Unlock()
+
+	_, err := DBPool.Exec("DELETE FROM CTO_COMMON.REQUEST_NONCE WHERE seen < SYSTIMESTAMP - NUMTODSINTERVAL(:1, 'SECOND')",
+		int64(2*window.Seconds()))
+	if err != nil {
+		logOutput(logWarn, "replay_protection", "Unable to purge expired request nonces: "+err.Error())
+	}
+}
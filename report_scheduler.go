@@ -0,0 +1,521 @@
+//  Report Scheduler
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// prefix of the SYNC_METADATA data type each scheduled report run is reported under (e.g. report:weekly-pipeline)
+const reportDataType = "report:"
+
+// how long a single report run may take to produce and deliver
+const reportRunTimeout = 10 * time.Minute
+
+// ReportSchedule is an admin defined report: what to produce, when (cron, in OutputTimeZone) and where to send it
+type ReportSchedule struct {
+	ID           int64  `json:"id"`
+	Name         string `json:"name"`
+	InstanceEnv  string `json:"instance_environment"`
+	Report       string `json:"report"`
+	Parameters   string `json:"parameters"`
+	Template     string `json:"template"`
+	Cron         string `json:"cron"`
+	Recipients   string `json:"recipients"`
+	TargetBucket string `json:"target_bucket"`
+	Enabled      bool   `json:"enabled"`
+	CreatedBy    string `json:"created_by"`
+}
+
+// reportOutput is a produced report ready to deliver
+type reportOutput struct {
+	body        []byte
+	contentType string
+	extension   string
+}
+
+// reportGenerator produces a report for a schedule; params are the schedule's parameters
+type reportGenerator func(ctx context.Context, schedule ReportSchedule, params url.Values) (reportOutput, error)
+
+// the reports that can be scheduled.  "sql" runs the schedule's template (a SELECT over %SCHEMA%) into a CSV file;
+// the others produce the output of the endpoint of the same name.
+var reportGenerators = map[string]reportGenerator{
+	"sql": sqlReport,
+	"pipelineByTerritory": func(ctx context.Context, s ReportSchedule, p url.Values) (reportOutput, error) {
+		return jsonReport(getPipelineByTerritory(ctx, s.InstanceEnv, p.Get("l2Territory")))
+	},
+	"quarterlyRollup": func(ctx context.Context, s ReportSchedule, p url.Values) (reportOutput, error) {
+		return jsonReport(getQuarterlyRollup(ctx, s.InstanceEnv, allAccess, p.Get("managerEmail"), p.Get("fiscalYear")))
+	},
+	"forecast": func(ctx context.Context, s ReportSchedule, p url.Values) (reportOutput, error) {
+		return jsonReport(getForecast(ctx, s.InstanceEnv, allAccess, p.Get("managerEmail")))
+	},
+	"winLoss": func(ctx context.Context, s ReportSchedule, p url.Values) (reportOutput, error) {
+		return jsonReport(getWinLoss(ctx, s.InstanceEnv, p.Get("since")))
+	},
+	"consumptionVsPlan": func(ctx context.Context, s ReportSchedule, p url.Values) (reportOutput, error) {
+		return jsonReport(getConsumptionVsPlan(ctx, s.InstanceEnv, allAccess, p.Get("accountId"), p.Get("managerEmail"), p.Get("fromMonth"), p.Get("toMonth")))
+	},
+	"accountReport": func(ctx context.Context, s ReportSchedule, p url.Values) (reportOutput, error) {
+		report, err := getAccountReport(ctx, s.InstanceEnv, allAccess, p.Get("accountId"))
+		if err != nil {
+			return reportOutput{}, err
+		}
+		if p.Get("format") == "json" {
+			return jsonReport(json.Marshal(report))
+		}
+		return reportOutput{body: renderAccountReport(report), contentType: "application/pdf", extension: "pdf"}, nil
+	},
+	"digest": func(ctx context.Context, s ReportSchedule, p url.Values) (reportOutput, error) {
+		digest, err := generateDigest(ctx, s.InstanceEnv, allAccess, p.Get("managerEmail"))
+		if err != nil {
+			return reportOutput{}, err
+		}
+		if p.Get("format") == "json" {
+			return jsonReport(json.Marshal(digest))
+		}
+		var body bytes.Buffer
+		err = digestTemplate.Execute(&body, digest)
+		return reportOutput{body: body.Bytes(), contentType: "text/html; charset=utf-8", extension: "html"}, err
+	},
+}
+
+func jsonReport(body []byte, err error) (reportOutput, error) {
+	return reportOutput{body: body, contentType: "application/json", extension: "json"}, err
+}
+
+//
+// Runs the schedule's SELECT (with %SCHEMA% replaced by the instance-environment's schema) and returns the rows as CSV
+//
+func sqlReport(ctx context.Context, schedule ReportSchedule, params url.Values) (reportOutput, error) {
+	body, err := queryCSV(ctx, strings.ReplaceAll(schedule.Template, "%SCHEMA%", lookupSchema(schedule.InstanceEnv)))
+	return reportOutput{body: body, contentType: "text/csv", extension: "csv"}, err
+}
+
+//
+// Runs a query and returns its rows as CSV with a header row of the column names
+//
+func queryCSV(ctx context.Context, query string, args ...interface{}) ([]byte, error) {
+	rows, err := DBPool.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	writer := csv.NewWriter(&body)
+	writer.Write(columns)
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		err := rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		record := make([]string, len(columns))
+		for i, value := range values {
+			record[i] = value.String
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), writer.Error()
+}
+
+//
+// Starts the background loop that runs scheduled reports when ReportScheduler is "true".  Schedules are re-read
+// every minute so changes made through admin/reportSchedule take effect without a restart.
+//
+func startReportScheduler() {
+	if !GlobalConfig.ReportScheduler {
+		return
+	}
+	logOutput(logInfo, "report_scheduler", "Starting report scheduler")
+
+	go func() {
+		for {
+			// wake up at the top of each minute
+			now := time.Now()
+			time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+
+			minute := time.Now().In(outputLocation)
+			schedules, err := getReportSchedules(0)
+			if err != nil {
+				logOutput(logError, "report_scheduler", err.Error())
+				continue
+			}
+			for _, schedule := range schedules {
+				if !schedule.Enabled {
+					continue
+				}
+				cron, err := parseCron(schedule.Cron)
+				if err != nil {
+					logOutput(logWarn, "report_scheduler", fmt.Sprintf("Invalid cron for report %s: %s", schedule.Name, err.Error()))
+					continue
+				}
+				if cron.matches(minute) {
+					go runReport(schedule)
+				}
+			}
+		}
+	}()
+}
+
+//
+// Produces a report and delivers it to its recipients and/or target bucket.  The outcome is recorded in
+// SYNC_METADATA and shows up in /syncStatus under the data type report:NAME.
+//
+func runReport(schedule ReportSchedule) error {
+	run := beginSyncRun(nil, "report_scheduler", reportDataType+schedule.Name, lookupSchema(schedule.InstanceEnv), "")
+	ctx, cancel := context.WithTimeout(context.Background(), reportRunTimeout)
+	defer cancel()
+
+	generator, ok := reportGenerators[schedule.Report]
+	if !ok {
+		message := fmt.Sprintf("Unknown report %s for schedule %s", schedule.Report, schedule.Name)
+		run.fail(message)
+		return errors.New(message)
+	}
+	params, _ := url.ParseQuery(schedule.Parameters)
+	output, err := generator(ctx, schedule, params)
+	if err != nil {
+		message := fmt.Sprintf("Error producing report %s: %s", schedule.Name, err.Error())
+		run.fail(message)
+		return errors.New(message)
+	}
+
+	runTime := time.Now().In(outputLocation)
+	filename := fmt.Sprintf("%s-%s.%s", safeKeySegment(schedule.Name), runTime.Format("2006-01-02-1504"), output.extension)
+	if len(schedule.TargetBucket) > 0 {
+		object := objectLocation{Namespace: GlobalConfig.ArtifactNamespace, Bucket: schedule.TargetBucket,
+			Object: "reports/" + safeKeySegment(schedule.Name) + "/" + filename}
+		err = putObject(ctx, object, output.contentType, output.body)
+		if err != nil {
+			message := fmt.Sprintf("Error storing report %s in %s: %s", schedule.Name, schedule.TargetBucket, err.Error())
+			run.fail(message)
+			return errors.New(message)
+		}
+	}
+	if len(strings.TrimSpace(schedule.Recipients)) > 0 {
+		subject := fmt.Sprintf("%s (%s)", schedule.Name, runTime.Format(queryDateLayout))
+		err = sendReportEmail(splitRecipients(schedule.Recipients), subject, filename, output)
+		if err != nil {
+			message := fmt.Sprintf("Error emailing report %s: %s", schedule.Name, err.Error())
+			run.fail(message)
+			return errors.New(message)
+		}
+	}
+
+	run.complete(0, 0)
+	logOutput(logInfo, "report_scheduler", fmt.Sprintf("Delivered report %s (%d bytes)", schedule.Name, len(output.body)))
+	return nil
+}
+
+func splitRecipients(recipients string) []string {
+	list := []string{}
+	for _, recipient := range strings.Split(recipients, ",") {
+		if recipient = strings.TrimSpace(recipient); len(recipient) > 0 {
+			list = append(list, recipient)
+		}
+	}
+	return list
+}
+
+//
+// Emails a report as an attachment through SMTPServer (host:port), authenticating with SMTPUser/SMTPPassword if set
+//
+func sendReportEmail(recipients []string, subject string, filename string, output reportOutput) error {
+	if len(GlobalConfig.SMTPServer) < 1 || len(GlobalConfig.SMTPFrom) < 1 {
+		return errors.New("email delivery is not configured; check SMTPServer/SMTPFrom")
+	}
+
+	var message bytes.Buffer
+	writer := multipart.NewWriter(&message)
+	fmt.Fprintf(&message, "From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%s\r\n\r\n",
+		GlobalConfig.SMTPFrom, strings.Join(recipients, ", "), subject, writer.Boundary())
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(part, "The %s report is attached.\r\n", subject)
+
+	part, err = writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {output.contentType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {fmt.Sprintf("attachment; filename=\"%s\"", filename)},
+	})
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(output.body)
+	for len(encoded) > 76 {
+		fmt.Fprintf(part, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(part, "%s\r\n", encoded)
+	writer.Close()
+
+	var auth smtp.Auth
+	if len(GlobalConfig.SMTPUser) > 0 {
+		host, _, _ := net.SplitHostPort(GlobalConfig.SMTPServer)
+		auth = smtp.PlainAuth("", GlobalConfig.SMTPUser, GlobalConfig.SMTPPassword, host)
+	}
+	return smtp.SendMail(GlobalConfig.SMTPServer, auth, GlobalConfig.SMTPFrom, recipients, message.Bytes())
+}
+
+//
+// HTTP handler for admin/reportSchedule.  GET lists the schedules (or one with id=), POST creates one from a JSON
+// body, PUT replaces schedule id= and DELETE removes it.
+//
+func reportScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var id int64
+	if len(query.Get("id")) > 0 {
+		value, err := strconv.ParseInt(query.Get("id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "id query parameter is invalid")
+			return
+		}
+		id = value
+	}
+
+	var result interface{}
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		result, err = getReportSchedules(id)
+		if err == nil && id > 0 && len(result.([]ReportSchedule)) == 0 {
+			err = sql.ErrNoRows
+		}
+	case http.MethodPost, http.MethodPut:
+		var schedule ReportSchedule
+		err = json.NewDecoder(r.Body).Decode(&schedule)
+		if err != nil {
+			err = inputError("Unable to parse request body: " + err.Error())
+			break
+		}
+		if r.Method == http.MethodPut && id < 1 {
+			err = inputError("id query parameter is required")
+			break
+		}
+		result, err = saveReportSchedule(schedule, id)
+	case http.MethodDelete:
+		err = deleteReportSchedule(id)
+		result = map[string]int64{"deleted": id}
+	default:
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err == sql.ErrNoRows {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Report schedule %d not found", id)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "report_scheduler", err.Error())
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		logRequest(r, logInfo, "report_scheduler", fmt.Sprintf("%s report schedule %d", r.Method, id))
+	}
+	output, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(output)
+}
+
+//
+// HTTP handler for admin/runReport.  Produces and delivers report schedule id= right away, whether or not it is
+// enabled, and waits for it to finish.
+//
+func runReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "id query parameter is invalid")
+		return
+	}
+
+	schedules, err := getReportSchedules(id)
+	if err == nil && len(schedules) == 0 {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Report schedule %d not found", id)
+		return
+	}
+	if err == nil {
+		err = runReport(schedules[0])
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "report_scheduler", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{\"id\": %d, \"status\": \"delivered\"}", id)
+}
+
+//
+// Returns all report schedules, or only schedule id if it is set
+//
+func getReportSchedules(id int64) ([]ReportSchedule, error) {
+	query := "SELECT id, name, instance_env, report, NVL(parameters, ' '), NVL(template, ' '), cron, NVL(recipients, ' '), " +
+		"NVL(target_bucket, ' '), enabled, NVL(created_by, ' ') FROM CTO_COMMON.REPORT_SCHEDULE"
+	var rows *sql.Rows
+	var err error
+	if id > 0 {
+		rows, err = DBPool.Query(query+" WHERE id = :1", id)
+	} else {
+		rows, err = DBPool.Query(query + " ORDER BY name")
+	}
+	if err != nil {
+		thisError := fmt.Sprintf("Error querying REPORT_SCHEDULE: %s", err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	schedules := []ReportSchedule{}
+	for rows.Next() {
+		var schedule ReportSchedule
+		var enabled int
+		err := rows.Scan(&schedule.ID, &schedule.Name, &schedule.InstanceEnv, &schedule.Report, &schedule.Parameters, &schedule.Template,
+			&schedule.Cron, &schedule.Recipients, &schedule.TargetBucket, &enabled, &schedule.CreatedBy)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning REPORT_SCHEDULE row: %s", err.Error())
+			return nil, errors.New(thisError)
+		}
+		schedule.Enabled = enabled == 1
+		schedule.Parameters = strings.TrimSpace(schedule.Parameters)
+		schedule.Template = strings.TrimSpace(schedule.Template)
+		schedule.Recipients = strings.TrimSpace(schedule.Recipients)
+		schedule.TargetBucket = strings.TrimSpace(schedule.TargetBucket)
+		schedule.CreatedBy = strings.TrimSpace(schedule.CreatedBy)
+		schedules = append(schedules, schedule)
+	}
+	return schedules, rows.Err()
+}
+
+//
+// Validates a schedule and creates it (id 0) or replaces schedule id.  Returns the saved schedule.
+//
+func saveReportSchedule(schedule ReportSchedule, id int64) (ReportSchedule, error) {
+	schedule.Name = strings.TrimSpace(schedule.Name)
+	// the name has to fit SYNC_METADATA.DATA_TYPE once prefixed with report:
+	if len(schedule.Name) < 1 || len(reportDataType+schedule.Name) > 50 {
+		return schedule, inputError("name is required and must be at most 43 characters")
+	}
+	if len(lookupSchema(schedule.InstanceEnv)) < 1 {
+		return schedule, inputError("instance_environment is invalid")
+	}
+	if _, ok := reportGenerators[schedule.Report]; !ok {
+		names := []string{}
+		for name := range reportGenerators {
+			names = append(names, name)
+		}
+		return schedule, inputError("report must be one of " + strings.Join(names, ", "))
+	}
+	if schedule.Report == "sql" {
+		statement := strings.ToUpper(strings.TrimSpace(schedule.Template))
+		if !strings.HasPrefix(statement, "SELECT") && !strings.HasPrefix(statement, "WITH") {
+			return schedule, inputError("template must be a SELECT statement for sql reports")
+		}
+	}
+	if _, err := url.ParseQuery(schedule.Parameters); err != nil {
+		return schedule, inputError("parameters must be a query string, e.g. managerEmail=a@b.com&fiscalYear=2021")
+	}
+	if _, err := parseCron(schedule.Cron); err != nil {
+		return schedule, inputError("cron is invalid: " + err.Error())
+	}
+	if len(strings.TrimSpace(schedule.Recipients)) < 1 && len(schedule.TargetBucket) < 1 {
+		return schedule, inputError("at least one of recipients or target_bucket is required")
+	}
+
+	enabled := 0
+	if schedule.Enabled {
+		enabled = 1
+	}
+	var err error
+	if id > 0 {
+		var result sql.Result
+		result, err = DBPool.Exec("UPDATE CTO_COMMON.REPORT_SCHEDULE SET name = :1, instance_env = :2, report = :3, parameters = :4, "+
+			"template = :5, cron = :6, recipients = :7, target_bucket = :8, enabled = :9 WHERE id = :10",
+			schedule.Name, schedule.InstanceEnv, schedule.Report, schedule.Parameters, schedule.Template, schedule.Cron,
+			schedule.Recipients, schedule.TargetBucket, enabled, id)
+		if err == nil {
+			if updated, _ := result.RowsAffected(); updated == 0 {
+				return schedule, sql.ErrNoRows
+			}
+		}
+		schedule.ID = id
+	} else {
+		_, err = DBPool.Exec("INSERT INTO CTO_COMMON.REPORT_SCHEDULE (name, instance_env, report, parameters, template, cron, "+
+			"recipients, target_bucket, enabled, created_by, created) VALUES (:1, :2, :3, :4, :5, :6, :7, :8, :9, :10, SYSTIMESTAMP) "+
+			"RETURNING id INTO :11",
+			schedule.Name, schedule.InstanceEnv, schedule.Report, schedule.Parameters, schedule.Template, schedule.Cron,
+			schedule.Recipients, schedule.TargetBucket, enabled, schedule.CreatedBy, sql.Out{Dest: &schedule.ID})
+	}
+	if err != nil {
+		thisError := fmt.Sprintf("Error saving report schedule %s: %s", schedule.Name, err.Error())
+		return schedule, errors.New(thisError)
+	}
+	return schedule, nil
+}
+
+//
+// Removes schedule id
+//
+func deleteReportSchedule(id int64) error {
+	result, err := DBPool.Exec("DELETE FROM CTO_COMMON.REPORT_SCHEDULE WHERE id = :1", id)
+	if err != nil {
+		thisError := fmt.Sprintf("Error deleting report schedule %d: %s", id, err.Error())
+		return errors.New(thisError)
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
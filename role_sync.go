@@ -0,0 +1,180 @@
+//  Role Synchronization
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// the role name the hierarchy queries filter on; anyone with direct reports must have it or their
+// reports fall out of the CONNECT BY results
+const managerRole = "Manager"
+
+//
+// Derives the application role for a user from the HR feed.  Anyone with direct reports, or on the management
+// track (an M-level) without any directs at the moment, is a Manager; everyone else gets ProvisionDefaultRole.
+//
+func deriveRole(user provisionedUser) string {
+	if user.NumDirects > 0 || strings.HasPrefix(strings.ToUpper(user.MgrLevel), "M") {
+		return managerRole
+	}
+	if len(GlobalConfig.ProvisionDefaultRole) > 0 {
+		return GlobalConfig.ProvisionDefaultRole
+	}
+	return defaultProvisionRole
+}
+
+//
+// Brings the role of every user in the identity feed in line with the role derived from the feed, or with the
+// entry in CTO_COMMON.ROLE_OVERRIDES for exceptions (admins, service accounts, etc).  Only runs when SyncRoles is
+// enabled in config.json; failures are logged per schema so one broken environment doesn't stop the others.
+//
+func syncRoles(users []provisionedUser) {
+	if !GlobalConfig.SyncRoles {
+		return
+	}
+
+	for instanceEnv, schema := range schemaMapSnapshot() {
+		count, err := syncSchemaRoles(instanceEnv, schema, users)
+		if err != nil {
+			logOutput(logError, "role_sync", err.Error())
+			continue
+		}
+		message := fmt.Sprintf("Changed the role of %d users in %s (%s)", count, instanceEnv, schema)
+		logOutput(logInfo, "role_sync", message)
+	}
+}
+
+//
+// Updates the roles of one instance-env's users inside a single transaction.  Overrides are applied after the
+// derived roles so they also cover users who aren't in the identity feed.
+//
+func syncSchemaRoles(instanceEnv string, schema string, users []provisionedUser) (int64, error) {
+	app := "STS"
+	userTable := schema + ".STSUser"
+	roleTable := schema + ".STSRole"
+	if strings.HasPrefix(instanceEnv, "ecal-") {
+		app = "ECAL"
+		userTable = schema + ".User1"
+		roleTable = schema + ".RoleType"
+	}
+
+	roles, err := getRoleIDs(roleTable)
+	if err != nil {
+		thisError := fmt.Sprintf("Error reading roles (%s): %s", instanceEnv, err.Error())
+		return 0, errors.New(thisError)
+	}
+	overrides, err := getRoleOverrides(instanceEnv)
+	if err != nil {
+		thisError := fmt.Sprintf("Error reading role overrides (%s): %s", instanceEnv, err.Error())
+		return 0, errors.New(thisError)
+	}
+
+	tx, err := DBPool.Begin()
+	if err != nil {
+		thisError := fmt.Sprintf("Error starting DB transaction (%s): %s", instanceEnv, err.Error())
+		return 0, errors.New(thisError)
+	}
+	defer tx.Rollback()
+
+	// only touch rows whose role actually differs so lastupdatedate stays meaningful
+	stmt, err := tx.Prepare("UPDATE " + userTable + " SET rolename = :1, lastupdatedate = SYSDATE, " +
+		"lastupdatedby = 'cto_bizlogic_helper' WHERE LOWER(useremail) = LOWER(:2) AND DECODE(rolename, :1, 0, 1) = 1")
+	if err != nil {
+		thisError := fmt.Sprintf("Error preparing role update (%s): %s", instanceEnv, err.Error())
+		return 0, errors.New(thisError)
+	}
+	defer stmt.Close()
+
+	// apply a role by name, skipping names that don't exist in this app so we never null out a user's role
+	var count int64
+	setRole := func(email string, roleName string) error {
+		roleID, ok := roles[roleName]
+		if !ok {
+			logOutput(logWarn, "role_sync", fmt.Sprintf("Role %s does not exist in %s; skipping %s", roleName, instanceEnv, email))
+			return nil
+		}
+		result, err := stmt.Exec(roleID, email)
+		if err != nil {
+			thisError := fmt.Sprintf("Error updating role (%s, %s, %s): %s", instanceEnv, email, roleName, err.Error())
+			return errors.New(thisError)
+		}
+		affected, _ := result.RowsAffected()
+		count += affected
+		return nil
+	}
+
+	for _, user := range users {
+		if !userMappedToApp(user.AppMap, app) {
+			continue
+		}
+		if _, ok := overrides[strings.ToLower(user.Email)]; ok {
+			continue
+		}
+		if err := setRole(user.Email, deriveRole(user)); err != nil {
+			return 0, err
+		}
+	}
+	for email, roleName := range overrides {
+		if err := setRole(email, roleName); err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		thisError := fmt.Sprintf("Error committing roles (%s): %s", instanceEnv, err.Error())
+		return 0, errors.New(thisError)
+	}
+	return count, nil
+}
+
+//
+// Returns a map of role name to id for a RoleType or STSRole table
+//
+func getRoleIDs(roleTable string) (map[string]int64, error) {
+	rows, err := DBPool.Query("SELECT id, rolename FROM " + roleTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := make(map[string]int64)
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		roles[name] = id
+	}
+	return roles, rows.Err()
+}
+
+//
+// Returns a map of lowercased user email to role name from CTO_COMMON.ROLE_OVERRIDES for an instance-env
+//
+func getRoleOverrides(instanceEnv string) (map[string]string, error) {
+	rows, err := DBPool.Query("SELECT user_email, role_name FROM CTO_COMMON.ROLE_OVERRIDES WHERE instance_env = :1", instanceEnv)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overrides := make(map[string]string)
+	for rows.Next() {
+		var email, roleName sql.NullString
+		if err := rows.Scan(&email, &roleName); err != nil {
+			return nil, err
+		}
+		if email.Valid && roleName.Valid {
+			overrides[strings.ToLower(email.String)] = roleName.String
+		}
+	}
+	return overrides, rows.Err()
+}
@@ -0,0 +1,44 @@
+//  Row Limits
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// hard cap on the rows a query endpoint returns when MaxQueryRows isn't set in config.json
+const defaultMaxQueryRows = 5000
+
+//
+// Returns the configured hard cap on rows returned by the query endpoints
+//
+func maxQueryRows() int {
+	limit, err := strconv.Atoi(GlobalConfig.MaxQueryRows)
+	if err != nil || limit < 1 {
+		return defaultMaxQueryRows
+	}
+	return limit
+}
+
+//
+// Resolves the number of rows a query endpoint should return from its (optional) maxRows parameter.  Requests for
+// more than the hard cap are quietly capped; the response's truncated flag tells the caller rows were left out.
+//
+func getMaxRows(maxRows string) (int, error) {
+	limit := maxQueryRows()
+	if len(maxRows) < 1 {
+		return limit, nil
+	}
+
+	requested, err := strconv.Atoi(maxRows)
+	if err != nil || requested < 1 {
+		return 0, inputError(fmt.Sprintf("maxRows must be a number between 1 and %d", limit))
+	}
+	if requested < limit {
+		return requested, nil
+	}
+	return limit, nil
+}
@@ -0,0 +1,54 @@
+//  Row Versions
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// a row's version is its lastupdatedate, selected with TO_CHAR(lastupdatedate, rowVersionFormat)
+const rowVersionFormat = "YYYYMMDDHH24MISS"
+
+// lastupdatedate is only good to the second, so a write always moves it forward at least a second to make sure
+// two writes in the same second still leave different versions
+const rowVersionUpdate = "lastupdatedate = GREATEST(SYSDATE, NVL(lastupdatedate, SYSDATE) + 1/86400)"
+
+// errVersionConflict is returned when the row was changed after the version the caller read
+var errVersionConflict = errors.New("row has been changed since it was read")
+
+//
+// Returns the version the caller last read from the If-Match header, or an empty string if the write isn't
+// conditional (no header, or *)
+//
+func requestedVersion(r *http.Request) string {
+	version := strings.TrimSpace(r.Header.Get("If-Match"))
+	version = strings.Trim(strings.TrimPrefix(version, "W/"), "\"")
+	if version == "*" {
+		return ""
+	}
+	return version
+}
+
+//
+// Returns errVersionConflict if the caller asked for a conditional write and the row's current version isn't the
+// one they read
+//
+func checkRowVersion(requested string, current string) error {
+	if len(requested) > 0 && requested != current {
+		return errVersionConflict
+	}
+	return nil
+}
+
+//
+// Returns a row's version to the caller as the ETag to send back in If-Match
+//
+func setRowVersion(w http.ResponseWriter, version string) {
+	if len(version) > 0 {
+		w.Header().Set("ETag", "\""+version+"\"")
+	}
+}
@@ -0,0 +1,85 @@
+//  Data Sanitization
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// column sizes of the free text fields cleaned on the way in (see the DDL in provision_schema.go)
+const (
+	maxIDFieldLength    = 100
+	maxEmailFieldLength = 320
+	maxNameFieldLength  = 400
+	maxLongFieldLength  = 4000
+)
+
+var markupPattern = regexp.MustCompile(`<[^>]*>`)
+
+//
+// Cleans a single line of free text before it is stored: tabs and line breaks become spaces, other control
+// characters and double quotes are dropped, bullets become dashes and the result is trimmed and cut to maxBytes
+// (0 for no limit).  Text cleaned here can be dropped into the JSON responses without any further scrubbing.
+//
+func sanitizeText(text string, maxBytes int) string {
+	cleaned := strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t' || r == '\n':
+			return ' '
+		case r == '"' || unicode.IsControl(r) || r == unicode.ReplacementChar:
+			return -1
+		case r == '•':
+			return '-'
+		}
+		return r
+	}, text)
+	return truncateText(strings.TrimSpace(cleaned), maxBytes)
+}
+
+//
+// Cleans multi-line free text (status updates) before it is stored: markup is stripped, line endings are normalized
+// to \n, runs of blank lines are collapsed and otherwise it is treated as sanitizeText does
+//
+func sanitizeMultilineText(text string, maxBytes int) string {
+	text = markupPattern.ReplaceAllString(text, "")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = sanitizeText(line, 0)
+	}
+	cleaned := strings.Join(lines, "\n")
+	for strings.Contains(cleaned, "\n\n\n") {
+		cleaned = strings.ReplaceAll(cleaned, "\n\n\n", "\n\n")
+	}
+	return truncateText(strings.TrimSpace(cleaned), maxBytes)
+}
+
+//
+// Runs sanitizeText over each of fields in place
+//
+func sanitizeFields(maxBytes int, fields ...*string) {
+	for _, field := range fields {
+		*field = sanitizeText(*field, maxBytes)
+	}
+}
+
+//
+// Cuts text to at most maxBytes (VARCHAR2 lengths are in bytes) on a character boundary so we never store half of a
+// multi-byte character
+//
+func truncateText(text string, maxBytes int) string {
+	if maxBytes < 1 || len(text) <= maxBytes {
+		return text
+	}
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return strings.TrimSpace(text[:cut])
+}
@@ -0,0 +1,224 @@
+//  Secrets
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/secrets"
+)
+
+// secretStore resolves the key of a config entry to its secret value
+type secretStore interface {
+	getSecret(key string) (string, error)
+}
+
+// the prefix of a config entry held in the OCI Secrets Service ([vault]SecretOCID) and in HashiCorp Vault
+// ([hashivault]path#key).  The older [vault]FieldName:SecretOCID form is still accepted.
+const ociSecretPrefix = "[vault]"
+const hashiVaultSecretPrefix = "[hashivault]"
+
+// the struct tag marking a config field as a credential.  Its value is the form the field may also be given in
+// without a prefix; "ocid" means a bare OCI secret OCID is read from the OCI Secrets Service.
+const vaultTag = "vault"
+
+// how long a single HashiCorp Vault read may take
+const hashiVaultTimeout = 30 * time.Second
+
+// the config entries that were read from a secret store, so they are never shown (see redactedConfig)
+var vaultedConfigEntries = make(map[string]bool)
+
+//
+// Replaces each config entry held in a secret store with the secret it points at, connecting to each secret store
+// the first time an entry needs it so environments only need the stores they use.  An entry is held in a store when
+// it starts with one of the store prefixes or, for a field tagged vault:"ocid", when it is a bare secret OCID.  Only
+// string fields can be held in a store.
+//
+func resolveConfigSecrets(config *Config) error {
+	stores := make(map[string]secretStore)
+	connect := map[string]func() (secretStore, error){
+		ociSecretPrefix:        newOCISecretStore,
+		hashiVaultSecretPrefix: newHashiVaultStore,
+	}
+
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		if v.Field(i).Kind() != reflect.String {
+			continue
+		}
+		prefix, key := configSecretKey(v.Type().Field(i), v.Field(i).String())
+		if len(prefix) < 1 {
+			continue
+		}
+
+		// the older form names the field the secret belongs to, which must be this one
+		if keySlice := strings.SplitN(key, ":", 2); len(keySlice) == 2 && !strings.HasPrefix(key, "ocid1.") {
+			if keySlice[0] != name {
+				thisError := fmt.Sprintf("config entry %s names another field (%s); use %s{{key}}", name, keySlice[0], prefix)
+				return errors.New(thisError)
+			}
+			key = keySlice[1]
+		}
+		if len(key) < 1 {
+			thisError := fmt.Sprintf("config entry %s must be in the form %s{{key}}", name, prefix)
+			return errors.New(thisError)
+		}
+
+		store, found := stores[prefix]
+		if !found {
+			var err error
+			store, err = connect[prefix]()
+			if err != nil {
+				thisError := fmt.Sprintf("connecting to %s secret store: %s", prefix, err.Error())
+				return errors.New(thisError)
+			}
+			stores[prefix] = store
+		}
+		secret, err := store.getSecret(key)
+		if err != nil {
+			thisError := fmt.Sprintf("reading value for key [%s] of %s: %s", key, name, err.Error())
+			return errors.New(thisError)
+		}
+		v.Field(i).SetString(secret)
+		vaultedConfigEntries[name] = true
+	}
+	return nil
+}
+
+//
+// Returns the store prefix and key of a config entry held in a secret store, or empty strings if it isn't one
+//
+func configSecretKey(field reflect.StructField, value string) (string, string) {
+	for _, prefix := range []string{ociSecretPrefix, hashiVaultSecretPrefix} {
+		if strings.HasPrefix(value, prefix) {
+			return prefix, strings.TrimPrefix(value, prefix)
+		}
+	}
+	if field.Tag.Get(vaultTag) == "ocid" && strings.HasPrefix(value, "ocid1.vaultsecret.") {
+		return ociSecretPrefix, value
+	}
+	return "", ""
+}
+
+// ociSecretStore reads secrets from the OCI Secrets Service by secret OCID
+type ociSecretStore struct {
+	client secrets.SecretsClient
+}
+
+func newOCISecretStore() (secretStore, error) {
+	client, err := secrets.NewSecretsClientWithConfigurationProvider(getOCIConfigProvider())
+	if err != nil {
+		return nil, err
+	}
+	return &ociSecretStore{client: client}, nil
+}
+
+//
+// Returns a secret value from the OCI Secret Service based on a secret OCID
+//
+func (store *ociSecretStore) getSecret(secretOCID string) (string, error) {
+	request := secrets.GetSecretBundleRequest{SecretId: &secretOCID}
+	response, err := store.client.GetSecretBundle(context.Background(), request)
+	if err != nil {
+		return "", err
+	}
+
+	encodedResponse := fmt.Sprintf("%s", response.SecretBundleContent)
+	encodedResponse = strings.TrimRight(strings.TrimLeft(encodedResponse, "{ Content="), " }")
+	decodedByteArray, err := base64.StdEncoding.DecodeString(encodedResponse)
+	if err != nil {
+		thisError := fmt.Sprintf("decoding secret: %s", err.Error())
+		return "", errors.New(thisError)
+	}
+
+	return string(decodedByteArray), nil
+}
+
+// hashiVaultStore reads secrets from a HashiCorp Vault server using the standard VAULT_ADDR, VAULT_TOKEN and
+// (for Vault Enterprise) VAULT_NAMESPACE environment variables
+type hashiVaultStore struct {
+	address   string
+	token     string
+	namespace string
+	client    *http.Client
+}
+
+func newHashiVaultStore() (secretStore, error) {
+	store := &hashiVaultStore{address: strings.TrimRight(os.Getenv("VAULT_ADDR"), "/"), token: os.Getenv("VAULT_TOKEN"),
+		namespace: os.Getenv("VAULT_NAMESPACE"), client: &http.Client{Timeout: hashiVaultTimeout}}
+	if len(store.address) < 1 || len(store.token) < 1 {
+		return nil, errors.New("VAULT_ADDR and VAULT_TOKEN must be set")
+	}
+	return store, nil
+}
+
+//
+// Returns a secret value from HashiCorp Vault.  The key is the secret's path and the field to return, e.g.
+// secret/data/cto/db#password.  Both KV version 2 (secret/data/...) and version 1 secrets are read.
+//
+func (store *hashiVaultStore) getSecret(key string) (string, error) {
+	keySlice := strings.SplitN(key, "#", 2)
+	if len(keySlice) < 2 || len(keySlice[0]) < 1 || len(keySlice[1]) < 1 {
+		thisError := fmt.Sprintf("HashiCorp Vault key %s must be in the form path#field", key)
+		return "", errors.New(thisError)
+	}
+	path, field := strings.Trim(keySlice[0], "/"), keySlice[1]
+
+	request, err := http.NewRequest(http.MethodGet, store.address+"/v1/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("X-Vault-Token", store.token)
+	if len(store.namespace) > 0 {
+		request.Header.Set("X-Vault-Namespace", store.namespace)
+	}
+	response, err := store.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		thisError := fmt.Sprintf("HashiCorp Vault returned %d for %s: %s", response.StatusCode, path, strings.TrimSpace(string(body)))
+		return "", errors.New(thisError)
+	}
+
+	// KV version 2 nests the secret's fields one level further down, under data.data
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&secret)
+	if err != nil {
+		return "", err
+	}
+	fields := secret.Data
+	if nested, ok := secret.Data["data"].(map[string]interface{}); ok {
+		if _, versioned := secret.Data["metadata"]; versioned {
+			fields = nested
+		}
+	}
+	value, found := fields[field]
+	if !found {
+		thisError := fmt.Sprintf("HashiCorp Vault secret %s has no field %s", path, field)
+		return "", errors.New(thisError)
+	}
+	if text, ok := value.(string); ok {
+		return text, nil
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded), nil
+}
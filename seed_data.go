@@ -0,0 +1,180 @@
+//  Seed Data Loader
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// seedFiles holds the baseline reference rows for a new ECAL schema.  Files are loaded in name order so tables
+// that are referenced (e.g. ECALPhase) come before the tables that reference them (e.g. ECALStage).
+//
+//go:embed seed/*.json
+var seedFiles embed.FS
+
+// seedTable is the contents of one seed file.  Every row carries its id so references between seed tables are stable.
+type seedTable struct {
+	Table string                   `json:"table"`
+	Rows  []map[string]interface{} `json:"rows"`
+}
+
+var seedIdentifierPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+//
+// HTTP handler for the admin/seedSchema functionality.  Loads the embedded seed rows into the schema of an ECAL
+// instance-environment.  Rows that already exist (by id) are left alone so the load can be safely re-run.
+//
+func seedSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+	instanceEnv := r.URL.Query().Get("instanceEnvironment")
+
+	// call the helper which does the data mashing
+	inserted, err := seedSchema(instanceEnv)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "seed_data", err.Error())
+		return
+	}
+
+	message := fmt.Sprintf("Seeded %s: %v", instanceEnv, inserted)
+	logRequest(r, logInfo, "seed_data", message)
+
+	// write result to output stream
+	json, _ := json.Marshal(inserted)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+//
+// Inserts any missing seed rows into the instance-environment's schema in a single transaction.  Returns the number
+// of rows inserted per table.
+//
+func seedSchema(instanceEnv string) (map[string]int64, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		thisError := fmt.Sprintf("instanceEnvironment query parameter is invalid (%s)", instanceEnv)
+		return nil, errors.New(thisError)
+	}
+
+	tables, err := loadSeedTables()
+	if err != nil {
+		return nil, err
+	}
+
+	// start a DB transaction
+	tx, err := DBPool.Begin()
+	if err != nil {
+		thisError := fmt.Sprintf("Error starting DB transaction (%s): %s", instanceEnv, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer tx.Rollback()
+
+	inserted := make(map[string]int64)
+	for _, table := range tables {
+		inserted[table.Table] = 0
+		for _, row := range table.Rows {
+			// sort the columns so the statement (and its binds) are the same for every row of a table
+			columns := []string{}
+			for column := range row {
+				if column != "id" {
+					columns = append(columns, column)
+				}
+			}
+			sort.Strings(columns)
+
+			binds := []string{":1"}
+			args := []interface{}{row["id"]}
+			for i, column := range columns {
+				binds = append(binds, ":"+strconv.Itoa(i+2))
+				args = append(args, row[column])
+			}
+			n := len(args)
+			args = append(args, row["id"])
+			query := fmt.Sprintf("INSERT INTO %s.%s (id, %s, creationdate, lastupdatedate, createdby, lastupdatedby) "+
+				"SELECT %s, SYSDATE, SYSDATE, 'cto_bizlogic_helper', 'cto_bizlogic_helper' FROM DUAL "+
+				"WHERE NOT EXISTS (SELECT 1 FROM %s.%s WHERE id = :%d)",
+				schema, table.Table, strings.Join(columns, ", "), strings.Join(binds, ", "), schema, table.Table, n+1)
+
+			result, err := tx.Exec(query, args...)
+			if err != nil {
+				thisError := fmt.Sprintf("Error seeding %s (%s, %v): %s", table.Table, instanceEnv, row, err.Error())
+				return nil, errors.New(thisError)
+			}
+			count, _ := result.RowsAffected()
+			inserted[table.Table] += count
+		}
+	}
+
+	// complete the transaction
+	err = tx.Commit()
+	if err != nil {
+		thisError := fmt.Sprintf("Error committing transaction (%s): %s", instanceEnv, err.Error())
+		return nil, errors.New(thisError)
+	}
+	return inserted, nil
+}
+
+//
+// Reads and checks the embedded seed files in load order.  Table and column names end up in SQL text so they must
+// be plain identifiers, and every row needs a whole number id.
+//
+func loadSeedTables() ([]seedTable, error) {
+	entries, err := seedFiles.ReadDir("seed")
+	if err != nil {
+		return nil, err
+	}
+
+	tables := []seedTable{}
+	for _, entry := range entries {
+		content, err := seedFiles.ReadFile(path.Join("seed", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var table seedTable
+		err = json.Unmarshal(content, &table)
+		if err != nil {
+			thisError := fmt.Sprintf("Unable to parse seed file %s: %s", entry.Name(), err.Error())
+			return nil, errors.New(thisError)
+		}
+		if !seedIdentifierPattern.MatchString(table.Table) {
+			thisError := fmt.Sprintf("Seed file %s has an invalid table name (%s)", entry.Name(), table.Table)
+			return nil, errors.New(thisError)
+		}
+
+		for i, row := range table.Rows {
+			id, ok := row["id"].(float64)
+			if !ok || id < 1 || id != float64(int64(id)) {
+				thisError := fmt.Sprintf("Seed file %s row %d has no valid id", entry.Name(), i+1)
+				return nil, errors.New(thisError)
+			}
+			for column, value := range row {
+				if !seedIdentifierPattern.MatchString(column) {
+					thisError := fmt.Sprintf("Seed file %s row %d has an invalid column (%s)", entry.Name(), i+1, column)
+					return nil, errors.New(thisError)
+				}
+				// JSON numbers decode as float64; bind whole numbers as integers
+				if number, ok := value.(float64); ok && number == float64(int64(number)) {
+					row[column] = int64(number)
+				}
+			}
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
@@ -0,0 +1,165 @@
+//  Graceful Shutdown
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// how long shutdown waits for in-flight requests and background loads when ShutdownGraceSeconds isn't set.  Keep it
+// under the time the platform waits after SIGTERM before killing the container.
+const defaultShutdownGrace = 30 * time.Second
+
+// the background work (reference data processing, feed pulls, post-load hooks, exports and submitted queries) still
+// running by name, counted in runningLoadsDone so shutdown can wait for it.  runningLoadsLock also orders starting
+// work against shutdown; see trackBackground.
+var runningLoads = make(map[string]int)
+var runningLoadsLock sync.Mutex
+var runningLoadsDone sync.WaitGroup
+
+// set once shutdown has started so no new loads are started and long loads can stop at their next checkpoint
+var shutdownStarted int32
+
+//
+// Runs a background load in its own goroutine as a load job of type name, tracked so shutdown waits for it to
+// finish.  Returns the job, or nil once shutdown has started since new loads aren't run then; the data they would
+// have loaded is still on disk for the next load.
+//
+func startLoad(name string, load func(job *loadJob)) *loadJob {
+	if !trackBackground(name) {
+		return nil
+	}
+	job := newLoadJob(name)
+
+	go func() {
+		_, loadSpan := startSpan(context.Background(), "load "+name, spanInternal)
+		defer func() {
+			job.finish()
+			loadSpan.finish(nil)
+			untrackBackground(name)
+		}()
+		job.start()
+		load(job)
+	}()
+	return job
+}
+
+//
+// Counts a piece of background work of type name so shutdown waits for it.  Returns false, and counts nothing, once
+// shutdown has started.  The check and the count are made holding runningLoadsLock, which shutdown holds while it
+// sets shutdownStarted, so work is either counted before shutdown starts waiting or not started at all.
+//
+func trackBackground(name string) bool {
+	runningLoadsLock.Lock()
+	defer runningLoadsLock.Unlock()
+	if shuttingDown() {
+		logOutput(logWarn, "shutdown", "Not starting "+name+", the service is shutting down")
+		return false
+	}
+	runningLoads[name]++
+	runningLoadsDone.Add(1)
+	return true
+}
+
+//
+// Marks a piece of background work counted by trackBackground as finished
+//
+func untrackBackground(name string) {
+	runningLoadsLock.Lock()
+	if runningLoads[name]--; runningLoads[name] < 1 {
+		delete(runningLoads, name)
+	}
+	runningLoadsLock.Unlock()
+	runningLoadsDone.Done()
+}
+
+//
+// True once the service has been told to stop
+//
+func shuttingDown() bool {
+	return atomic.LoadInt32(&shutdownStarted) == 1
+}
+
+//
+// Serves HTTP until SIGTERM or SIGINT, then stops accepting connections, lets the requests in flight (e.g. a
+// postReferenceData upload) finish and waits for the background loads and jobs, all within ShutdownGraceSeconds.  Loads still
+// running when it runs out are abandoned; their uncommitted work is rolled back by the database and the identity load
+// resumes from its last checkpoint.  Returns once the service can exit.
+//
+func serveUntilStopped(server *http.Server) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+
+	failed := make(chan error, 1)
+	go func() {
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			failed <- err
+		}
+	}()
+
+	select {
+	case err := <-failed:
+		logOutput(logError, "main", "HTTP listener failed: "+err.Error())
+		return
+	case received := <-stop:
+		logOutput(logInfo, "shutdown", fmt.Sprintf("Received %s, shutting down", received))
+	}
+	runningLoadsLock.Lock()
+	atomic.StoreInt32(&shutdownStarted, 1)
+	runningLoadsLock.Unlock()
+
+	grace := defaultShutdownGrace
+	if GlobalConfig.ShutdownGraceSeconds > 0 {
+		grace = time.Duration(GlobalConfig.ShutdownGraceSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		logOutput(logWarn, "shutdown", "Requests still in flight were cut off: "+err.Error())
+	} else {
+		logOutput(logInfo, "shutdown", "In-flight requests drained")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		runningLoadsDone.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		logOutput(logInfo, "shutdown", "Background loads and jobs finished")
+	case <-ctx.Done():
+		logOutput(logWarn, "shutdown", "Background loads and jobs still running were abandoned: "+describeRunningLoads())
+	}
+}
+
+//
+// Lists the background loads and jobs still running, e.g. "exports, identity, opportunity x2"
+//
+func describeRunningLoads() string {
+	runningLoadsLock.Lock()
+	defer runningLoadsLock.Unlock()
+	names := []string{}
+	for name, count := range runningLoads {
+		if count > 1 {
+			name = fmt.Sprintf("%s x%d", name, count)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprint(names)
+}
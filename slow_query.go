@@ -0,0 +1,249 @@
+//  Slow Query Capture
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a query endpoint's query is slow when it takes longer than this and SlowQueryMillis isn't set
+const defaultSlowQueryThreshold = 5 * time.Second
+
+// how long looking up and storing the plan of a slow query may take
+const slowQueryCaptureTimeout = time.Minute
+
+// how long slow queries are kept in CTO_COMMON.SLOW_QUERY
+const slowQueryRetentionDays = 30
+
+// SlowQuery is a run of a query endpoint's query that took longer than the slow threshold along with the cursor it
+// ran on and that cursor's execution plan
+type SlowQuery struct {
+	ID            int64  `json:"id"`
+	Endpoint      string `json:"endpoint"`
+	InstanceEnv   string `json:"instance_environment"`
+	ElapsedMillis int64  `json:"elapsed_ms"`
+	Rows          int64  `json:"rows"`
+	SQLID         string `json:"sql_id"`
+	ChildNumber   int64  `json:"child_number"`
+	PlanHashValue int64  `json:"plan_hash_value"`
+	AvgMillis     int64  `json:"avg_elapsed_ms"`
+	Plan          string `json:"plan"`
+	Captured      string `json:"captured"`
+}
+
+// queryTimer times one run of a query endpoint's query, from being sent until its last row has been read
+type queryTimer struct {
+	endpoint    string
+	instanceEnv string
+	started     time.Time
+}
+
+//
+// Returns the threshold above which a query endpoint's query is captured as slow, or 0 if SlowQueryMillis is "0"
+//
+func slowQueryThreshold() time.Duration {
+	millis, err := strconv.Atoi(GlobalConfig.SlowQueryMillis)
+	if err != nil || millis < 0 {
+		return defaultSlowQueryThreshold
+	}
+	return time.Duration(millis) * time.Millisecond
+}
+
+//
+// Marks a query endpoint's query with a comment naming the endpoint and instance-environment so its cursor can be
+// found in V$SQL.  The comment is the same on every run so cursors are still shared.
+//
+func tagQuery(endpoint string, instanceEnv string, query string) string {
+	return "/* cto-bizlogic-helper " + endpoint + " " + instanceEnv + " */ " + query
+}
+
+func startQueryTimer(endpoint string, instanceEnv string) queryTimer {
+	return queryTimer{endpoint: endpoint, instanceEnv: instanceEnv, started: time.Now()}
+}
+
+//
+// Called once the query's rows have been read.  If it was slow the run is logged and its plan is captured in the
+// background so the response isn't held up.  The time includes streaming the rows out, so a slow client can make a
+// fast query look slow; the average elapsed time Oracle reports for the cursor is stored alongside to tell them apart.
+//
+func (timer queryTimer) done(rows int) {
+	elapsed := time.Since(timer.started)
+	threshold := slowQueryThreshold()
+	if threshold < 1 || elapsed < threshold {
+		return
+	}
+	logOutput(logWarn, "slow_query", fmt.Sprintf("%s (%s) took %dms for %d rows", timer.endpoint, timer.instanceEnv,
+		elapsed.Milliseconds(), rows))
+	go func() {
+		err := captureSlowQuery(timer.endpoint, timer.instanceEnv, elapsed, rows)
+		if err != nil {
+			logOutput(logWarn, "slow_query", "Unable to capture the plan of a slow query: "+err.Error())
+		}
+	}()
+}
+
+//
+// Looks up the most recently run cursor tagged with the endpoint and instance-environment in V$SQL, formats its plan
+// with DBMS_XPLAN.DISPLAY_CURSOR and stores both in CTO_COMMON.SLOW_QUERY.  Needs SELECT on V$SQL, V$SQL_PLAN,
+// V$SQL_PLAN_STATISTICS_ALL and V$SESSION; without them the run is still stored, just without a plan.
+//
+func captureSlowQuery(endpoint string, instanceEnv string, elapsed time.Duration, rows int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), slowQueryCaptureTimeout)
+	defer cancel()
+
+	var sqlID sql.NullString
+	var childNumber, planHashValue, avgMicros sql.NullInt64
+	plan := ""
+	err := DBPool.QueryRowContext(ctx, `SELECT sql_id, child_number, plan_hash_value,
+			ROUND(elapsed_time / GREATEST(executions, 1))
+		FROM v$sql
+		WHERE sql_text LIKE :1
+		ORDER BY last_active_time DESC
+		FETCH FIRST 1 ROWS ONLY`, tagQuery(endpoint, instanceEnv, "")+"%").Scan(&sqlID, &childNumber, &planHashValue, &avgMicros)
+	if err != nil && err != sql.ErrNoRows {
+		logOutput(logWarn, "slow_query", fmt.Sprintf("Unable to find the cursor of %s: %s", endpoint, err.Error()))
+	}
+	if sqlID.Valid {
+		plan, err = displayCursorPlan(ctx, sqlID.String, childNumber.Int64)
+		if err != nil {
+			logOutput(logWarn, "slow_query", fmt.Sprintf("Unable to read the plan of %s (%s): %s", endpoint, sqlID.String, err.Error()))
+		}
+	}
+
+	_, err = DBPool.ExecContext(ctx, `INSERT INTO CTO_COMMON.SLOW_QUERY (endpoint, instance_env, elapsed_ms, rows_returned,
+			sql_id, child_number, plan_hash_value, avg_elapsed_ms, plan, captured)
+		VALUES (:1, :2, :3, :4, :5, :6, :7, :8, :9, SYSTIMESTAMP)`,
+		endpoint, instanceEnv, elapsed.Milliseconds(), rows, sqlID, childNumber, planHashValue, avgMicros.Int64/1000, plan)
+	if err != nil {
+		thisError := fmt.Sprintf("Error recording slow query (%s): %s", endpoint, err.Error())
+		return errors.New(thisError)
+	}
+
+	_, err = DBPool.ExecContext(ctx, "DELETE FROM CTO_COMMON.SLOW_QUERY WHERE captured < SYSTIMESTAMP - NUMTODSINTERVAL(:1, 'DAY')",
+		slowQueryRetentionDays)
+	if err != nil {
+		logOutput(logWarn, "slow_query", "Unable to purge old slow queries: "+err.Error())
+	}
+	return nil
+}
+
+//
+// Returns the plan of a cursor as DBMS_XPLAN formats it, one line per plan line
+//
+func displayCursorPlan(ctx context.Context, sqlID string, childNumber int64) (string, error) {
+	rows, err := DBPool.QueryContext(ctx, "SELECT plan_table_output FROM TABLE(DBMS_XPLAN.DISPLAY_CURSOR(:1, :2, 'TYPICAL'))",
+		sqlID, childNumber)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	lines := []string{}
+	for rows.Next() {
+		var line sql.NullString
+		err = rows.Scan(&line)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, line.String)
+	}
+	return strings.Join(lines, "\n"), rows.Err()
+}
+
+//
+// HTTP handler for the admin/slowQueries functionality.  Returns the slow queries captured in the last days (default
+// 7), newest first, optionally only those of one endpoint, with their SQL_ID, plan hash value and plan so a plan
+// flip shows up as a change of plan_hash_value for the same endpoint.
+//
+func slowQueriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+	query := r.URL.Query()
+	days := 7
+	if len(query.Get("days")) > 0 {
+		var err error
+		days, err = strconv.Atoi(query.Get("days"))
+		if err != nil || days < 1 || days > slowQueryRetentionDays {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "days must be between 1 and %d", slowQueryRetentionDays)
+			return
+		}
+	}
+	maxRows, err := getMaxRows(query.Get("maxRows"))
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+
+	items, truncated, err := getSlowQueries(r.Context(), query.Get("endpoint"), days, maxRows)
+	if queryCancelled(r.Context(), "slow_query", err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "slow_query", err.Error())
+		return
+	}
+	result, _ := json.Marshal(map[string]interface{}{"items": items, "truncated": truncated})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+//
+// Returns the slow queries captured in the last days, newest first, at most maxRows of them
+//
+func getSlowQueries(ctx context.Context, endpoint string, days int, maxRows int) ([]SlowQuery, bool, error) {
+	rows, err := DBPool.QueryContext(ctx, `SELECT id, endpoint, NVL(instance_env, ' '), elapsed_ms, NVL(rows_returned, 0),
+			NVL(sql_id, ' '), NVL(child_number, 0), NVL(plan_hash_value, 0), NVL(avg_elapsed_ms, 0), plan, captured
+		FROM CTO_COMMON.SLOW_QUERY
+		WHERE captured > SYSTIMESTAMP - NUMTODSINTERVAL(:1, 'DAY') AND (:2 IS NULL OR endpoint = :2)
+		ORDER BY captured DESC, id DESC`, days, sql.NullString{String: endpoint, Valid: len(endpoint) > 0})
+	if err != nil {
+		thisError := fmt.Sprintf("Error querying slow queries: %s", err.Error())
+		return nil, false, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	items := []SlowQuery{}
+	truncated := false
+	for rows.Next() {
+		if len(items) >= maxRows {
+			truncated = true
+			break
+		}
+		var item SlowQuery
+		var plan sql.NullString
+		var captured time.Time
+		err = rows.Scan(&item.ID, &item.Endpoint, &item.InstanceEnv, &item.ElapsedMillis, &item.Rows, &item.SQLID,
+			&item.ChildNumber, &item.PlanHashValue, &item.AvgMillis, &plan, &captured)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning slow queries: %s", err.Error())
+			return nil, false, errors.New(thisError)
+		}
+		item.InstanceEnv = strings.TrimSpace(item.InstanceEnv)
+		item.SQLID = strings.TrimSpace(item.SQLID)
+		item.Plan = plan.String
+		item.Captured = captured.In(outputLocation).Format(time.RFC3339)
+		items = append(items, item)
+	}
+	if err = rows.Err(); err != nil {
+		thisError := fmt.Sprintf("Error querying slow queries: %s", err.Error())
+		return nil, false, errors.New(thisError)
+	}
+	return items, truncated, nil
+}
@@ -0,0 +1,40 @@
+//  Soft Close
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// deactivation reasons recorded on lookup rows that are no longer active
+const deactivationClosed = "CLOSED"
+const deactivationVanished = "VANISHED"
+
+//
+// Returns the highest id in a lookup table so rows added during a load can be numbered after it
+//
+func maxLookupID(tx *sql.Tx, table string) (int64, error) {
+	var maxID int64
+	err := tx.QueryRow("SELECT NVL(MAX(id), 0) FROM " + table).Scan(&maxID)
+	return maxID, err
+}
+
+//
+// Marks every active row in a lookup table that wasn't seen by the load started at loadTime as VANISHED.  Rows are
+// kept (rather than deleted) so anything that references them keeps its history.  Only rows within the load's
+// scope are considered.  Returns the number of rows deactivated.
+//
+func deactivateVanished(tx *sql.Tx, table string, loadTime time.Time, scope loadScope) (int64, error) {
+	condition, args := scope.condition(3)
+	result, err := tx.Exec("UPDATE "+table+" SET active = 0, deactivateddate = SYSTIMESTAMP, deactivationreason = :1, "+
+		"lastupdatedate = SYSDATE, lastupdatedby = 'cto_bizlogic_helper' "+
+		"WHERE active = 1 AND (lastseendate IS NULL OR lastseendate < :2) AND "+condition,
+		append([]interface{}{deactivationVanished, loadTime}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,45 @@
+//  Data Access
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// QueryRunner is the part of database/sql the query helpers use.  It is satisfied by both *sql.DB and *sql.Tx so a
+// helper can run either standalone or inside the caller's transaction.
+type QueryRunner interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Store is the type of DBPool.  In the service it is the godror connection pool; anything else that satisfies it (e.g. a
+// *sql.DB opened on the memdb driver) can stand in for it.  The ECAL query handlers (getECALDataQuery,
+// getECALAccountQuery, getECALOpportunityQuery and getECALArtifactQuery) are handed the store they run against, so
+// their tests give each handler its own memdb; the other handlers still reach DBPool as a package global, which --dev
+// replaces for the whole process at once.
+type Store interface {
+	QueryRunner
+	Begin() (*sql.Tx, error)
+	Conn(ctx context.Context) (*sql.Conn, error)
+	Close() error
+}
+
+//
+// Returns true (and logs it) if err came from a query that was cancelled because the caller went away, e.g. a dashboard
+// user navigated off the page or VBCS timed out the request.  There's nobody left to send an error to in that case.
+//
+func queryCancelled(ctx context.Context, module string, err error) bool {
+	if err == nil || ctx.Err() == nil {
+		return false
+	}
+	logOutput(logWarn, module, "Query cancelled, client went away: "+ctx.Err().Error())
+	return true
+}
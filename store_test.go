@@ -0,0 +1,132 @@
+//  Data Access Tests
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// the ECAL instance-environment and schema the query handler tests run against
+const testInstanceEnv = "ecal-test"
+const testSchema = "ECAL_TEST"
+
+// the pattern of isAppAdmin's role lookup in the test schema
+const testAdminLookup = `SELECT COUNT\(\*\) FROM ECAL_TEST\.User1 u INNER JOIN ECAL_TEST\.RoleType r`
+
+//
+// Returns an empty memdb for a query handler test, with the service configured so vb (the VB apps) may name its user
+// and integration sees everything without one.  The access and query caches are emptied so nothing is answered
+// from an earlier test.
+//
+func newQueryTestStore(t *testing.T) (*MemDB, Store) {
+	t.Helper()
+	saved := GlobalConfig
+	t.Cleanup(func() { GlobalConfig = saved })
+	GlobalConfig = Config{ServiceUsername: "vb", UnrestrictedClients: []string{"integration"}}
+
+	schemaMapLock.Lock()
+	if SchemaMap == nil {
+		SchemaMap = make(map[string]string)
+	}
+	schemaMapLock.Unlock()
+	registerSchema(testInstanceEnv, testSchema)
+
+	accessCacheLock.Lock()
+	accessCache = make(map[string]accessCacheEntry)
+	accessCacheLock.Unlock()
+	invalidateQueryCache()
+
+	mem, db := NewMemDB()
+	t.Cleanup(func() { db.Close() })
+	return mem, db
+}
+
+//
+// Answers isAppAdmin's role lookup as an admin or not
+//
+func expectAdminLookup(mem *MemDB, admin bool) {
+	count := "0"
+	if admin {
+		count = "1"
+	}
+	mem.ExpectQuery(testAdminLookup, []string{"count"}, []interface{}{count})
+}
+
+//
+// Runs a GET of target through handler as client and returns the response
+//
+func serveQuery(h handler, client string, target string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.SetBasicAuth(client, "password")
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+// queryResponse is the body of a successful query endpoint response
+type queryResponse struct {
+	Items      []map[string]interface{} `json:"items"`
+	Truncated  bool                     `json:"truncated"`
+	NextCursor string                   `json:"next_cursor"`
+	Count      *int                     `json:"count"`
+}
+
+func decodeQueryResponse(t *testing.T, w *httptest.ResponseRecorder) queryResponse {
+	t.Helper()
+	var response queryResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("response isn't JSON (%s): %s", err.Error(), w.Body.String())
+	}
+	return response
+}
+
+//
+// Returns the statements run other than the role lookup, i.e. the ones the endpoint itself sent
+//
+func endpointStatements(mem *MemDB) []MemStatement {
+	statements := []MemStatement{}
+	for _, statement := range mem.Statements() {
+		if !strings.Contains(statement.Query, "INNER JOIN "+testSchema+".RoleType r") {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+//
+// Checks that the endpoint sent one statement, with the row-level condition for userEmail if it is set and without
+// one otherwise, and returns it
+//
+func checkScopedStatement(t *testing.T, mem *MemDB, userEmail string) MemStatement {
+	t.Helper()
+	statements := endpointStatements(mem)
+	if len(statements) != 1 {
+		t.Fatalf("expected 1 statement, got %d: %v", len(statements), statements)
+	}
+	statement := statements[0]
+	if !strings.Contains(statement.Query, testSchema+".") || strings.Contains(statement.Query, "%SCHEMA%") {
+		t.Errorf("schema wasn't filled in: %s", statement.Query)
+	}
+	scoped := strings.Contains(statement.Query, "FROM "+testSchema+".ManagerClosure c WHERE LOWER(c.manageremail) = :")
+	if len(userEmail) > 0 {
+		if !scoped {
+			t.Errorf("expected the row-level condition: %s", statement.Query)
+		}
+		found := false
+		for _, arg := range statement.Args {
+			found = found || arg == userEmail
+		}
+		if !found {
+			t.Errorf("expected %s to be bound, got %v", userEmail, statement.Args)
+		}
+	} else if scoped {
+		t.Errorf("expected no row-level condition: %s", statement.Query)
+	}
+	return statement
+}
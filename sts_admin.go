@@ -0,0 +1,393 @@
+//  STS Curriculum Administration
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// stsAdminField describes one editable column of an STS curriculum table
+type stsAdminField struct {
+	Column     string
+	Name       string
+	Numeric    bool
+	Required   bool
+	References string
+}
+
+// stsAdminEntity describes an STS curriculum table managed through the admin endpoints
+type stsAdminEntity struct {
+	Table  string
+	Fields []stsAdminField
+}
+
+var stsTaskEntity = stsAdminEntity{
+	Table: "STSTask",
+	Fields: []stsAdminField{
+		{Column: "taskname", Name: "taskName", Required: true},
+		{Column: "description", Name: "description"},
+	},
+}
+
+var stsPathEntity = stsAdminEntity{
+	Table: "STSPath",
+	Fields: []stsAdminField{
+		{Column: "pathname", Name: "pathName", Required: true},
+		{Column: "description", Name: "description"},
+	},
+}
+
+var stsPathRequirementEntity = stsAdminEntity{
+	Table: "STSAPathReq",
+	Fields: []stsAdminField{
+		{Column: "pathname", Name: "pathId", Numeric: true, Required: true, References: "STSPath"},
+		{Column: "taskname", Name: "taskId", Numeric: true, Required: true, References: "STSTask"},
+	},
+}
+
+// errSTSAdminNotFound is returned when the row being read, updated or deleted doesn't exist
+var errSTSAdminNotFound = errors.New("row not found")
+
+// errSTSAdminInUse is returned when a row can't be deleted because other rows still reference it
+var errSTSAdminInUse = errors.New("row is referenced by other rows")
+
+//
+// Returns an HTTP handler providing CRUD for an STS curriculum table.  All methods take the instanceEnvironment
+// query parameter; GET lists all rows (or one with id=), POST creates a row from a JSON body, PUT updates the
+// fields present in the JSON body of row id=, and DELETE removes row id=.  The optional user query parameter is
+// recorded in createdby/lastupdatedby.
+//
+func stsAdminHandler(entity stsAdminEntity) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		instanceEnv := query.Get("instanceEnvironment")
+		id := query.Get("id")
+		user := strings.ToLower(query.Get("user"))
+		if len(user) < 1 {
+			user = "cto_bizlogic_helper"
+		}
+
+		var result string
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			result, err = getSTSAdminRows(instanceEnv, entity, id)
+		case http.MethodPost, http.MethodPut:
+			var body map[string]interface{}
+			err = json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				err = inputError("Unable to parse request body: " + err.Error())
+				break
+			}
+			if r.Method == http.MethodPost {
+				result, err = createSTSAdminRow(instanceEnv, entity, body, user)
+			} else {
+				result, err = updateSTSAdminRow(instanceEnv, entity, id, body, user)
+			}
+		case http.MethodDelete:
+			err = deleteSTSAdminRow(instanceEnv, entity, id)
+		default:
+			w.WriteHeader(405)
+			fmt.Fprintf(w, "Method not allowed")
+			return
+		}
+
+		if inputErr, ok := err.(inputError); ok {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "%s", inputErr.Error())
+			logRequest(r, logWarn, "sts_admin", fmt.Sprintf("%s %s (%s, %s): %s", r.Method, entity.Table, instanceEnv, id, inputErr.Error()))
+			return
+		}
+		if err == errSTSAdminNotFound {
+			w.WriteHeader(404)
+			fmt.Fprintf(w, "%s %s not found", entity.Table, id)
+			return
+		}
+		if err == errSTSAdminInUse {
+			w.WriteHeader(409)
+			fmt.Fprintf(w, "%s %s is still in use", entity.Table, id)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+			logRequest(r, logError, "sts_admin", err.Error())
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			logRequest(r, logInfo, "sts_admin", fmt.Sprintf("%s %s id=%s %s by %s (%s)", r.Method, entity.Table, id, result, user, instanceEnv))
+		}
+		if len(result) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, "%s", result)
+		}
+	}
+}
+
+//
+// Returns the rows of an STS curriculum table (or just row id if set) as {"items": [...]}
+//
+func getSTSAdminRows(instanceEnv string, entity stsAdminEntity, id string) (string, error) {
+	schema, err := getSTSAdminSchema(instanceEnv)
+	if err != nil {
+		return "", err
+	}
+
+	columns := []string{"id"}
+	for _, field := range entity.Fields {
+		columns = append(columns, field.Column)
+	}
+	query := "SELECT " + strings.Join(columns, ", ") + " FROM " + schema + "." + entity.Table
+
+	var rows *sql.Rows
+	if len(id) > 0 {
+		var rowID int64
+		rowID, err = parseSTSAdminID(id)
+		if err != nil {
+			return "", err
+		}
+		rows, err = DBPool.Query(query+" WHERE id = :1", rowID)
+	} else {
+		rows, err = DBPool.Query(query + " ORDER BY id")
+	}
+	if err != nil {
+		thisError := fmt.Sprintf("Error running query (%s, %s, %s): %s", instanceEnv, entity.Table, id, err.Error())
+		return "", errors.New(thisError)
+	}
+	defer rows.Close()
+
+	items := []map[string]interface{}{}
+	for rows.Next() {
+		var rowID int64
+		values := make([]sql.NullString, len(entity.Fields))
+		dest := []interface{}{&rowID}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		err := rows.Scan(dest...)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning row (%s, %s): %s", instanceEnv, entity.Table, err.Error())
+			return "", errors.New(thisError)
+		}
+
+		item := map[string]interface{}{"id": rowID}
+		for i, field := range entity.Fields {
+			if !values[i].Valid {
+				item[field.Name] = nil
+			} else if field.Numeric {
+				item[field.Name], _ = strconv.ParseInt(values[i].String, 10, 64)
+			} else {
+				item[field.Name] = values[i].String
+			}
+		}
+		items = append(items, item)
+	}
+	if len(id) > 0 && len(items) == 0 {
+		return "", errSTSAdminNotFound
+	}
+
+	result, err := json.Marshal(map[string]interface{}{"items": items})
+	if err != nil {
+		return "", err
+	}
+	return string(result), nil
+}
+
+//
+// Inserts a row into an STS curriculum table and returns {"id": n}
+//
+func createSTSAdminRow(instanceEnv string, entity stsAdminEntity, body map[string]interface{}, user string) (string, error) {
+	schema, err := getSTSAdminSchema(instanceEnv)
+	if err != nil {
+		return "", err
+	}
+	fields, values, err := validateSTSAdminBody(schema, entity, body, true)
+	if err != nil {
+		return "", err
+	}
+
+	columns := []string{}
+	binds := []string{}
+	for i, field := range fields {
+		columns = append(columns, field.Column)
+		binds = append(binds, ":"+strconv.Itoa(i+1))
+	}
+	n := len(fields)
+	query := fmt.Sprintf("INSERT INTO %s.%s (%s, creationdate, lastupdatedate, createdby, lastupdatedby) "+
+		"VALUES (%s, SYSDATE, SYSDATE, :%d, :%d) RETURNING id INTO :%d",
+		schema, entity.Table, strings.Join(columns, ", "), strings.Join(binds, ", "), n+1, n+1, n+2)
+
+	var id int64
+	values = append(values, user, sql.Out{Dest: &id})
+	_, err = DBPool.Exec(query, values...)
+	if err != nil {
+		thisError := fmt.Sprintf("Error inserting into %s (%s, %v): %s", entity.Table, instanceEnv, body, err.Error())
+		return "", errors.New(thisError)
+	}
+	return fmt.Sprintf("{\"id\": %d}", id), nil
+}
+
+//
+// Updates the fields present in the body for row id of an STS curriculum table
+//
+func updateSTSAdminRow(instanceEnv string, entity stsAdminEntity, id string, body map[string]interface{}, user string) (string, error) {
+	schema, err := getSTSAdminSchema(instanceEnv)
+	if err != nil {
+		return "", err
+	}
+	rowID, err := parseSTSAdminID(id)
+	if err != nil {
+		return "", err
+	}
+	fields, values, err := validateSTSAdminBody(schema, entity, body, false)
+	if err != nil {
+		return "", err
+	}
+	if len(fields) == 0 {
+		return "", inputError("No fields to update")
+	}
+
+	assignments := []string{}
+	for i, field := range fields {
+		assignments = append(assignments, field.Column+" = :"+strconv.Itoa(i+1))
+	}
+	n := len(fields)
+	query := fmt.Sprintf("UPDATE %s.%s SET %s, lastupdatedate = SYSDATE, lastupdatedby = :%d WHERE id = :%d",
+		schema, entity.Table, strings.Join(assignments, ", "), n+1, n+2)
+
+	values = append(values, user, rowID)
+	result, err := DBPool.Exec(query, values...)
+	if err != nil {
+		thisError := fmt.Sprintf("Error updating %s %d (%s, %v): %s", entity.Table, rowID, instanceEnv, body, err.Error())
+		return "", errors.New(thisError)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if updated == 0 {
+		return "", errSTSAdminNotFound
+	}
+	return "", nil
+}
+
+//
+// Deletes row id from an STS curriculum table.  Rows still referenced elsewhere (e.g. a task that is part of a
+// path) are reported as errSTSAdminInUse.
+//
+func deleteSTSAdminRow(instanceEnv string, entity stsAdminEntity, id string) error {
+	schema, err := getSTSAdminSchema(instanceEnv)
+	if err != nil {
+		return err
+	}
+	rowID, err := parseSTSAdminID(id)
+	if err != nil {
+		return err
+	}
+
+	result, err := DBPool.Exec("DELETE FROM "+schema+"."+entity.Table+" WHERE id = :1", rowID)
+	if err != nil {
+		// ORA-02292: integrity constraint violated - child record found
+		if strings.Contains(err.Error(), "ORA-02292") {
+			return errSTSAdminInUse
+		}
+		thisError := fmt.Sprintf("Error deleting %s %d (%s): %s", entity.Table, rowID, instanceEnv, err.Error())
+		return errors.New(thisError)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return errSTSAdminNotFound
+	}
+	return nil
+}
+
+//
+// Checks a request body against an entity's fields and returns the fields present along with their values in the
+// same order.  Unknown fields are rejected, required fields must be present when requireAll is set, and
+// referenced rows must exist.
+//
+func validateSTSAdminBody(schema string, entity stsAdminEntity, body map[string]interface{}, requireAll bool) ([]stsAdminField, []interface{}, error) {
+	known := make(map[string]bool)
+	for _, field := range entity.Fields {
+		known[field.Name] = true
+	}
+	for name := range body {
+		if !known[name] {
+			return nil, nil, inputError("Unknown field " + name)
+		}
+	}
+
+	fields := []stsAdminField{}
+	values := []interface{}{}
+	for _, field := range entity.Fields {
+		raw, ok := body[field.Name]
+		if !ok {
+			if requireAll && field.Required {
+				return nil, nil, inputError(field.Name + " is required")
+			}
+			continue
+		}
+
+		if field.Numeric {
+			number, ok := raw.(float64)
+			if !ok || number < 1 || number != float64(int64(number)) {
+				return nil, nil, inputError(field.Name + " must be a positive integer")
+			}
+			if len(field.References) > 0 {
+				var count int
+				err := DBPool.QueryRow("SELECT count(*) FROM "+schema+"."+field.References+" WHERE id = :1", int64(number)).Scan(&count)
+				if err != nil {
+					return nil, nil, err
+				}
+				if count == 0 {
+					return nil, nil, inputError(fmt.Sprintf("%s %d does not exist", field.Name, int64(number)))
+				}
+			}
+			values = append(values, int64(number))
+		} else {
+			text, ok := raw.(string)
+			if !ok {
+				return nil, nil, inputError(field.Name + " must be a string")
+			}
+			text = strings.TrimSpace(text)
+			if field.Required && len(text) < 1 {
+				return nil, nil, inputError(field.Name + " must not be empty")
+			}
+			values = append(values, text)
+		}
+		fields = append(fields, field)
+	}
+	return fields, values, nil
+}
+
+//
+// Returns the schema for an STS instanceEnvironment
+//
+func getSTSAdminSchema(instanceEnv string) (string, error) {
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || strings.HasPrefix(instanceEnv, "ecal-") {
+		thisError := fmt.Sprintf("instanceEnvironment query parameter is invalid (%s)", instanceEnv)
+		return "", errors.New(thisError)
+	}
+	return schema, nil
+}
+
+func parseSTSAdminID(id string) (int64, error) {
+	rowID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || rowID < 1 {
+		return 0, inputError("id query parameter is invalid")
+	}
+	return rowID, nil
+}
@@ -5,9 +5,12 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -20,110 +23,216 @@ func getSTSManagerDashboardSummaryHandler(w http.ResponseWriter, r *http.Request
 	managerEmail := query.Get("managerEmail")
 	instanceEnv := query.Get("instanceEnvironment")
 
+	maxRows, err := getMaxRows(query.Get("maxRows"))
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", err.Error())
+		return
+	}
+
 	// call the helper which does the data mashing
-	result, err := getSTSManagerDashboardSummary(managerEmail, instanceEnv)
+	result, truncated, err := getSTSManagerDashboardSummary(r.Context(), managerEmail, instanceEnv, maxRows)
+	if queryCancelled(r.Context(), "sts_manager_query", err) {
+		return
+	}
 	if err != nil {
 		w.WriteHeader(500)
-		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator")
-		logOutput(logError, "sts_manager_query", string(err.Error()))
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "sts_manager_query", string(err.Error()))
 		return
 	}
 
 	// format the result as json
-	json := fmt.Sprintf("{\"items\": [%s]}", result)
+	json, _ := json.Marshal(map[string]interface{}{"items": result, "truncated": truncated})
 
 	// write result to output stream
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, string(json))
+	w.Write(json)
 }
 
+// default number of STS dashboard queries run at once when DashboardQueryWorkers isn't set
+const defaultDashboardQueryWorkers = 4
+
+// restricts an STSUser (su) query to the manager's organization
+const stsTeamFilter = `su.manager IN (SELECT c.reportemail FROM %SCHEMA%.ManagerClosure c WHERE c.manageremail = :1)`
+
 //
 // Returns data to power the STS Manager Dashboard, specifically the Solution Engineer list.
 // In addition to the manager email, the instanceEnvironment identifier (sts-dev-preview, sts-prod-live, etc)
 // is required to key the name of the ATP schema to query
+// At most maxRows rows are returned; the bool result is true if more were available
+// The per-SE task counts used to be correlated subqueries run for every SE; they are now separate aggregate
+// queries over the whole team run side by side (see DashboardQueryWorkers) and merged here.
 //
-func getSTSManagerDashboardSummary(managerEmail string, instanceEnv string) (string, error) {
+func getSTSManagerDashboardSummary(ctx context.Context, managerEmail string, instanceEnv string, maxRows int) ([]STSDashboardMember, bool, error) {
 	// inject the correct schema name into the query
 	if len(instanceEnv) < 1 {
 		thisError := fmt.Sprintf("instanceEnvironment query parameter is invalid (%s, %s)", instanceEnv, managerEmail)
-		return "", errors.New(thisError)
+		return nil, false, errors.New(thisError)
 	}
+	schema := lookupSchema(instanceEnv)
 
-	// set the query
-	var template = `
-	   SELECT su.id as id,
-	    su.rolename,
-		su.firstname || ' ' || su.lastname as name, 
-		su.useremail as email, 
-		p.id as pathId,
-		p.pathname as pathName,
-		(
-			select count(pr.id) 
-			from %SCHEMA%.STSAPathReq pr
-			where pr.pathname = su.path
-			) as totalTasksInPath,
-		(
-			select count(stat.id) 
-			from %SCHEMA%.STSAUserStatus stat
-			inner join %SCHEMA%.STSPath p on su.path = p.id
-			inner join %SCHEMA%.STSTask t on stat.taskname = t.id
-			inner join %SCHEMA%.STSAPathReq pr on t.id = pr.taskname and p.id = pr.pathname
-			where stat.useremail = su.id and stat.taskstatus = 2
-			) as tasksCompleted,
-			(
-			select count(stat.id) 
-			from %SCHEMA%.STSAUserStatus stat
-			inner join %SCHEMA%.STSPath p on su.path = p.id
-			inner join %SCHEMA%.STSTask t on stat.taskname = t.id
-			inner join %SCHEMA%.STSAPathReq pr on t.id = pr.taskname and p.id = pr.pathname
-			where stat.useremail = su.id and stat.taskstatus = 3
-			) as tasksValidated,
-			TO_CHAR(NVL(
-				(select max(lastupdatedate) from %SCHEMA%.STSAUserStatus stat where stat.useremail = su.id), 
-				su.lastupdatedate), 'MM/DD/YYYY') 
-			as lastActivity
+	// the SE list
+	var team []stsTeamMember
+	listQuery := `
+		SELECT su.id, su.rolename, su.firstname || ' ' || su.lastname as name, su.useremail, p.id, p.pathname,
+			TO_CHAR(su.lastupdatedate, 'YYYY-MM-DD HH24:MI:SS')
 		FROM %SCHEMA%.STSUser su
 		INNER JOIN %SCHEMA%.STSPath p on su.path = p.id
-		WHERE su.manager IN 
-			(
-			SELECT useremail 
-			FROM %SCHEMA%.STSUser u 
-			INNER JOIN %SCHEMA%.STSRole r 
-			ON u.rolename = r.id WHERE r.rolename = 'Manager' 
-			START WITH useremail = :1 
-			CONNECT BY PRIOR useremail = manager
-			)	
-		ORDER BY name ASC
-	`
-	// replace the %SCHEMA% template with the correct schema name
-	query := strings.ReplaceAll(template, "%SCHEMA%", SchemaMap[instanceEnv])
-
-	// run the query
-	rows, err := DBPool.Query(query, managerEmail)
+		WHERE ` + stsTeamFilter + `
+		ORDER BY name ASC`
+
+	// aggregates keyed by STSUser id
+	var totalTasks, tasksCompleted, tasksValidated, lastActivity map[string]string
+	totalTasksQuery := `
+		SELECT su.id, count(pr.id)
+		FROM %SCHEMA%.STSUser su
+		INNER JOIN %SCHEMA%.STSAPathReq pr on pr.pathname = su.path
+		WHERE ` + stsTeamFilter + `
+		GROUP BY su.id`
+	taskStatusQuery := `
+		SELECT su.id, count(stat.id)
+		FROM %SCHEMA%.STSUser su
+		INNER JOIN %SCHEMA%.STSAUserStatus stat on stat.useremail = su.id
+		INNER JOIN %SCHEMA%.STSTask t on stat.taskname = t.id
+		INNER JOIN %SCHEMA%.STSAPathReq pr on t.id = pr.taskname and pr.pathname = su.path
+		WHERE ` + stsTeamFilter + ` AND stat.taskstatus = :2
+		GROUP BY su.id`
+	lastActivityQuery := `
+		SELECT su.id, TO_CHAR(max(stat.lastupdatedate), 'YYYY-MM-DD HH24:MI:SS')
+		FROM %SCHEMA%.STSUser su
+		INNER JOIN %SCHEMA%.STSAUserStatus stat on stat.useremail = su.id
+		WHERE ` + stsTeamFilter + `
+		GROUP BY su.id`
+
+	err := runParallel(dashboardQueryWorkers(),
+		func() (err error) {
+			team, err = getSTSTeamMembers(ctx, strings.ReplaceAll(listQuery, "%SCHEMA%", schema), managerEmail)
+			return err
+		},
+		func() (err error) {
+			totalTasks, err = getSTSTeamAggregate(ctx, strings.ReplaceAll(totalTasksQuery, "%SCHEMA%", schema), managerEmail)
+			return err
+		},
+		func() (err error) {
+			tasksCompleted, err = getSTSTeamAggregate(ctx, strings.ReplaceAll(taskStatusQuery, "%SCHEMA%", schema), managerEmail, 2)
+			return err
+		},
+		func() (err error) {
+			tasksValidated, err = getSTSTeamAggregate(ctx, strings.ReplaceAll(taskStatusQuery, "%SCHEMA%", schema), managerEmail, 3)
+			return err
+		},
+		func() (err error) {
+			lastActivity, err = getSTSTeamAggregate(ctx, strings.ReplaceAll(lastActivityQuery, "%SCHEMA%", schema), managerEmail)
+			return err
+		})
 	if err != nil {
 		thisError := fmt.Sprintf("Error running query (%s, %s): %s", instanceEnv, managerEmail, err.Error())
-		return "", errors.New(thisError)
+		return nil, false, errors.New(thisError)
+	}
+
+	// merge the aggregates into the SE list
+	result := []STSDashboardMember{}
+	truncated := false
+	for count, member := range team {
+		if count >= maxRows {
+			truncated = true
+			break
+		}
+		activity, ok := lastActivity[member.id]
+		if !ok {
+			activity = member.lastUpdate
+		}
+		result = append(result, STSDashboardMember{
+			ID:               dbNumber(member.id),
+			Name:             member.name,
+			Email:            member.email,
+			RoleName:         member.roleName,
+			PathID:           dbNumber(member.pathID),
+			PathName:         member.pathName,
+			TotalTasksInPath: dbNumber(countOrZero(totalTasks, member.id)),
+			TasksCompleted:   dbNumber(countOrZero(tasksCompleted, member.id)),
+			TasksValidated:   dbNumber(countOrZero(tasksValidated, member.id)),
+			LastActivity:     formatTimestamp(activity),
+		})
+	}
+	return result, truncated, nil
+}
+
+// STSDashboardMember is one SE of the STS Manager Dashboard
+type STSDashboardMember struct {
+	ID               dbNumber `json:"id"`
+	Name             string   `json:"name"`
+	Email            string   `json:"email"`
+	RoleName         string   `json:"roleName"`
+	PathID           dbNumber `json:"pathId"`
+	PathName         string   `json:"pathName"`
+	TotalTasksInPath dbNumber `json:"totalTasksInPath"`
+	TasksCompleted   dbNumber `json:"tasksCompleted"`
+	TasksValidated   dbNumber `json:"tasksValidated"`
+	LastActivity     string   `json:"lastActivity"`
+}
+
+// stsTeamMember is one row of the STS dashboard SE list before the task counts are merged in
+type stsTeamMember struct {
+	id, roleName, name, email, pathID, pathName, lastUpdate string
+}
+
+//
+// Runs the STS dashboard SE list query
+//
+func getSTSTeamMembers(ctx context.Context, query string, args ...interface{}) ([]stsTeamMember, error) {
+	rows, err := DBPool.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
 	}
 	defer rows.Close()
 
-	// vars to hold row results
-	var id, roleName, name, email, pathID, pathName, totalTasksInPath, tasksCompleted, tasksValidated, lastActivity string
+	team := []stsTeamMember{}
+	for rows.Next() {
+		var member stsTeamMember
+		err := rows.Scan(&member.id, &member.roleName, &member.name, &member.email, &member.pathID, &member.pathName, &member.lastUpdate)
+		if err != nil {
+			return nil, err
+		}
+		team = append(team, member)
+	}
+	return team, rows.Err()
+}
 
-	// step through each row returned and add to the query filter using the correct format
-	result := ""
-	count := 0
+//
+// Runs an STS dashboard aggregate query returning (STSUser id, value) rows and returns the values keyed by id
+//
+func getSTSTeamAggregate(ctx context.Context, query string, args ...interface{}) (map[string]string, error) {
+	rows, err := DBPool.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[string]string)
 	for rows.Next() {
-		err := rows.Scan(&id, &roleName, &name, &email, &pathID, &pathName, &totalTasksInPath, &tasksCompleted, &tasksValidated, &lastActivity)
+		var id, value string
+		err := rows.Scan(&id, &value)
 		if err != nil {
-			thisError := fmt.Sprintf("Error scanning row (%s, %s): %s", instanceEnv, managerEmail, err.Error())
-			return "", errors.New(thisError)
+			return nil, err
 		}
-		result += fmt.Sprintf("{\"id\": %s, \"name\": \"%s\", \"email\": \"%s\", \"roleName\": \"%s\", \"pathId\": %s, \"pathName\": \"%s\", \"totalTasksInPath\": %s, \"tasksCompleted\": %s, \"tasksValidated\": %s, \"lastActivity\": \"%s\"},",
-			id, name, email, roleName, pathID, pathName, totalTasksInPath, tasksCompleted, tasksValidated, lastActivity)
-		count++
+		values[id] = value
 	}
+	return values, rows.Err()
+}
 
-	// string the trailing 'or' field if it exists
-	result = strings.TrimSuffix(result, ",")
-	return result, nil
+func countOrZero(counts map[string]string, id string) string {
+	if count, ok := counts[id]; ok {
+		return count
+	}
+	return "0"
+}
+
+func dashboardQueryWorkers() int {
+	workers, err := strconv.Atoi(GlobalConfig.DashboardQueryWorkers)
+	if err != nil || workers < 1 {
+		return defaultDashboardQueryWorkers
+	}
+	return workers
 }
@@ -0,0 +1,227 @@
+//  STS Path Assignment
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PathAssignment is the result of assigning an STS user to a path
+type PathAssignment struct {
+	UserEmail          string `json:"userEmail"`
+	PreviousPathID     *int64 `json:"previousPathId"`
+	PathID             int64  `json:"pathId"`
+	StatusRecordsReset int64  `json:"statusRecordsReset"`
+	Version            string `json:"version"`
+}
+
+// errPathAssignmentNotFound is returned when the user or path doesn't exist
+var errPathAssignmentNotFound = errors.New("user or path not found")
+
+//
+// HTTP handler for the assignSTSPath functionality.  Sets a user's STS path and, if resetStatus=true, removes their
+// task status records so they start the new path from scratch.  The change is recorded in the audit log against
+// the assignedBy query parameter.  GET returns the user's current path.  Both return the user row's version as the
+// ETag; a POST with If-Match is rejected (412) if the user has been changed since that version was read.
+//
+func assignSTSPathHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		getSTSPathAssignmentHandler(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+
+	// get query parameters
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	userEmail := strings.ToLower(query.Get("userEmail"))
+	pathID := query.Get("pathId")
+	assignedBy := query.Get("assignedBy")
+	resetStatus := strings.ToLower(query.Get("resetStatus")) == "true"
+
+	// call the helper which does the data mashing
+	result, err := assignSTSPath(instanceEnv, userEmail, pathID, assignedBy, requestedVersion(r), resetStatus)
+	if err == errPathAssignmentNotFound {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "User or path not found")
+		logRequest(r, logWarn, "sts_path_assignment", fmt.Sprintf("User %s or path %s not found (%s)", userEmail, pathID, instanceEnv))
+		return
+	}
+	if err == errVersionConflict {
+		setRowVersion(w, result.Version)
+		w.WriteHeader(412)
+		fmt.Fprintf(w, "User has been changed by someone else; reload it and try again")
+		logRequest(r, logWarn, "sts_path_assignment", fmt.Sprintf("Rejected stale assignment of %s to path %s by %s (%s)", userEmail, pathID, assignedBy, instanceEnv))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "sts_path_assignment", err.Error())
+		return
+	}
+
+	message := fmt.Sprintf("Assigned %s to path %d by %s (%s), reset %d status records", userEmail, result.PathID, assignedBy, instanceEnv, result.StatusRecordsReset)
+	logRequest(r, logInfo, "sts_path_assignment", message)
+
+	// write result to output stream
+	json, _ := json.Marshal(result)
+	setRowVersion(w, result.Version)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func getSTSPathAssignmentHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+	userEmail := strings.ToLower(query.Get("userEmail"))
+
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || strings.HasPrefix(instanceEnv, "ecal-") || len(userEmail) < 1 {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "instanceEnvironment and userEmail query parameters are required")
+		return
+	}
+
+	result := PathAssignment{UserEmail: userEmail}
+	var path sql.NullInt64
+	err := DBPool.QueryRow("SELECT path, TO_CHAR(lastupdatedate, '"+rowVersionFormat+"') FROM "+schema+".STSUser WHERE LOWER(useremail) = :1",
+		userEmail).Scan(&path, &result.Version)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "User or path not found")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "sts_path_assignment", fmt.Sprintf("Error looking up user (%s, %s): %s", instanceEnv, userEmail, err.Error()))
+		return
+	}
+	result.PathID = path.Int64
+
+	json, _ := json.Marshal(result)
+	setRowVersion(w, result.Version)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+//
+// Moves an STS user to a new path inside a transaction, optionally clearing their STSAUserStatus records, and
+// writes an audit record of the change.  If expectedVersion is set and the user row's version is different nothing
+// is changed and errVersionConflict is returned with the current version.
+//
+func assignSTSPath(instanceEnv string, userEmail string, pathID string, assignedBy string, expectedVersion string,
+	resetStatus bool) (PathAssignment, error) {
+	var result PathAssignment
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 || strings.HasPrefix(instanceEnv, "ecal-") {
+		thisError := fmt.Sprintf("instanceEnvironment query parameter is invalid (%s, %s, %s)", instanceEnv, userEmail, pathID)
+		return result, errors.New(thisError)
+	}
+	if len(userEmail) < 1 || len(assignedBy) < 1 {
+		thisError := fmt.Sprintf("userEmail and assignedBy query parameters are required (%s, %s, %s)", instanceEnv, userEmail, assignedBy)
+		return result, errors.New(thisError)
+	}
+	newPath, err := strconv.ParseInt(pathID, 10, 64)
+	if err != nil || newPath < 1 {
+		thisError := fmt.Sprintf("pathId query parameter is invalid (%s, %s, %s)", instanceEnv, userEmail, pathID)
+		return result, errors.New(thisError)
+	}
+
+	// start a DB transaction
+	tx, err := DBPool.Begin()
+	if err != nil {
+		thisError := fmt.Sprintf("Error starting DB transaction (%s): %s", instanceEnv, err.Error())
+		return result, errors.New(thisError)
+	}
+	defer tx.Rollback()
+
+	// lock the user row so concurrent assignments don't interleave
+	var userID int64
+	var previousPath sql.NullInt64
+	var version string
+	err = tx.QueryRow("SELECT id, path, TO_CHAR(lastupdatedate, '"+rowVersionFormat+"') FROM "+schema+".STSUser WHERE LOWER(useremail) = :1 FOR UPDATE",
+		userEmail).Scan(&userID, &previousPath, &version)
+	if err == sql.ErrNoRows {
+		return result, errPathAssignmentNotFound
+	}
+	if err != nil {
+		thisError := fmt.Sprintf("Error looking up user (%s, %s): %s", instanceEnv, userEmail, err.Error())
+		return result, errors.New(thisError)
+	}
+	err = checkRowVersion(expectedVersion, version)
+	if err != nil {
+		result.Version = version
+		return result, err
+	}
+
+	var count int
+	err = tx.QueryRow("SELECT count(*) FROM "+schema+".STSPath WHERE id = :1", newPath).Scan(&count)
+	if err != nil {
+		thisError := fmt.Sprintf("Error looking up path (%s, %d): %s", instanceEnv, newPath, err.Error())
+		return result, errors.New(thisError)
+	}
+	if count == 0 {
+		return result, errPathAssignmentNotFound
+	}
+
+	_, err = tx.Exec("UPDATE "+schema+".STSUser SET path = :1, "+rowVersionUpdate+", lastupdatedby = :2 WHERE id = :3",
+		newPath, strings.ToLower(assignedBy), userID)
+	if err != nil {
+		thisError := fmt.Sprintf("Error updating path (%s, %s, %d): %s", instanceEnv, userEmail, newPath, err.Error())
+		return result, errors.New(thisError)
+	}
+	err = tx.QueryRow("SELECT TO_CHAR(lastupdatedate, '"+rowVersionFormat+"') FROM "+schema+".STSUser WHERE id = :1", userID).Scan(&result.Version)
+	if err != nil {
+		thisError := fmt.Sprintf("Error reading user version (%s, %s): %s", instanceEnv, userEmail, err.Error())
+		return result, errors.New(thisError)
+	}
+
+	// STSAUserStatus.useremail holds the STSUser id
+	if resetStatus {
+		deleted, err := tx.Exec("DELETE FROM "+schema+".STSAUserStatus WHERE useremail = :1", userID)
+		if err != nil {
+			thisError := fmt.Sprintf("Error resetting status records (%s, %s): %s", instanceEnv, userEmail, err.Error())
+			return result, errors.New(thisError)
+		}
+		result.StatusRecordsReset, _ = deleted.RowsAffected()
+	}
+
+	result.UserEmail = userEmail
+	result.PathID = newPath
+	if previousPath.Valid {
+		result.PreviousPathID = &previousPath.Int64
+	}
+
+	err = recordAudit(tx, instanceEnv, "STSUser.path", strconv.FormatInt(userID, 10), "assign", assignedBy, result)
+	if err != nil {
+		thisError := fmt.Sprintf("Error writing audit record (%s, %s): %s", instanceEnv, userEmail, err.Error())
+		return result, errors.New(thisError)
+	}
+	err = enqueueEvent(tx, instanceEnv, eventSTSPathAssigned, map[string]interface{}{"assignment": result, "assigned_by": strings.ToLower(assignedBy)})
+	if err != nil {
+		thisError := fmt.Sprintf("Error writing event (%s, %s): %s", instanceEnv, userEmail, err.Error())
+		return result, errors.New(thisError)
+	}
+
+	// complete the transaction
+	err = tx.Commit()
+	if err != nil {
+		thisError := fmt.Sprintf("Error committing transaction (%s, %s): %s", instanceEnv, userEmail, err.Error())
+		return result, errors.New(thisError)
+	}
+	return result, nil
+}
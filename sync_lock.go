@@ -0,0 +1,113 @@
+//  Sync Locks
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// how long acquiring or releasing a sync lock may take
+const syncLockTimeout = time.Minute
+
+// DBMS_LOCK.REQUEST results
+const (
+	lockGranted     = 0
+	lockBusy        = 1
+	lockAlreadyHeld = 4
+)
+
+// the loads running in this process, by lock name
+var syncLocksHeld = make(map[string]bool)
+var syncLocksLock sync.Mutex
+
+// syncLock is held while a feed is loaded into a schema.  It is a DBMS_LOCK user lock held by a session set aside
+// for the load, so Oracle releases it if the process dies or loses the connection part way through.
+type syncLock struct {
+	name   string
+	handle string
+	conn   *sql.Conn
+}
+
+//
+// Takes the lock for loading a feed into a schema, in this process and in the database so that only one replica
+// runs the load.  Returns an error rather than waiting if another load of the same feed into the schema is running.
+// A scoped reload takes the same lock as a full load of its feed.
+//
+func acquireSyncLock(dataType string, schema string) (*syncLock, error) {
+	lock := &syncLock{name: fmt.Sprintf("CTO_BIZLOGIC_SYNC:%s:%s", dataType, schema)}
+
+	syncLocksLock.Lock()
+	if syncLocksHeld[lock.name] {
+		syncLocksLock.Unlock()
+		thisError := fmt.Sprintf("A %s load into %s is already running on this instance", dataType, schema)
+		return nil, errors.New(thisError)
+	}
+	syncLocksHeld[lock.name] = true
+	syncLocksLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), syncLockTimeout)
+	defer cancel()
+	conn, err := DBPool.Conn(ctx)
+	if err != nil {
+		lock.forget()
+		thisError := fmt.Sprintf("Unable to get a session for the %s lock on %s: %s", dataType, schema, err.Error())
+		return nil, errors.New(thisError)
+	}
+
+	// ALLOCATE_UNIQUE maps the name to a lock handle (it commits, but this session has nothing else to commit).  The
+	// lock isn't released on commit, only by RELEASE or the end of the session.
+	var status int
+	_, err = conn.ExecContext(ctx, `DECLARE
+			h VARCHAR2(128);
+		BEGIN
+			DBMS_LOCK.ALLOCATE_UNIQUE(:1, h);
+			:2 := DBMS_LOCK.REQUEST(h, DBMS_LOCK.X_MODE, 0, FALSE);
+			:3 := h;
+		END;`, lock.name, sql.Out{Dest: &status}, sql.Out{Dest: &lock.handle})
+	if err == nil && status != lockGranted && status != lockAlreadyHeld {
+		if status == lockBusy {
+			err = fmt.Errorf("a %s load into %s is already running on another instance", dataType, schema)
+		} else {
+			err = fmt.Errorf("DBMS_LOCK.REQUEST returned %d", status)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		lock.forget()
+		thisError := fmt.Sprintf("Unable to lock %s load into %s: %s", dataType, schema, err.Error())
+		return nil, errors.New(thisError)
+	}
+	lock.conn = conn
+	return lock, nil
+}
+
+//
+// Releases the lock and returns its session to the pool
+//
+func (lock *syncLock) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), syncLockTimeout)
+	defer cancel()
+	var status int
+	_, err := lock.conn.ExecContext(ctx, "BEGIN :1 := DBMS_LOCK.RELEASE(:2); END;", sql.Out{Dest: &status}, lock.handle)
+	if err != nil || status != 0 {
+		// closing the session below doesn't end it, it goes back to the pool still holding the lock, so drop it
+		logOutput(logWarn, "sync_lock", fmt.Sprintf("Unable to release %s (%d): %v", lock.name, status, err))
+		lock.conn.Raw(func(driverConn interface{}) error { return driver.ErrBadConn })
+	}
+	lock.conn.Close()
+	lock.forget()
+}
+
+func (lock *syncLock) forget() {
+	syncLocksLock.Lock()
+	delete(syncLocksHeld, lock.name)
+	syncLocksLock.Unlock()
+}
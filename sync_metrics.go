@@ -0,0 +1,133 @@
+//  Sync Metrics
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// outcomes of a sync run as reported in the metrics
+const (
+	syncSuccess = "success"
+	syncFailure = "failure"
+)
+
+// SyncMetrics is the metrics record logged at the end of every sync run
+type SyncMetrics struct {
+	Feed            string  `json:"feed"`
+	Schema          string  `json:"schema"`
+	Status          string  `json:"status"`
+	RecordsRead     int     `json:"records_read"`
+	Inserted        int     `json:"inserted"`
+	Updated         int     `json:"updated"`
+	Rejected        int     `json:"rejected"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// syncMetricTotals accumulates the runs of one feed into one schema since the service started
+type syncMetricTotals struct {
+	runs         map[string]int
+	read         int
+	inserted     int
+	updated      int
+	rejected     int
+	lastStatus   string
+	lastDuration float64
+	lastRun      time.Time
+}
+
+// syncMetricTotals keyed by feed and schema, guarded by syncMetricsLock
+var syncMetricTotalsMap = make(map[[2]string]*syncMetricTotals)
+var syncMetricsLock sync.Mutex
+
+//
+// Logs the metrics of a finished sync run as a single JSON line (module sync_metrics) and adds them to the totals
+// served by /metrics.  Record counts of failed runs aren't added since the load was rolled back.
+//
+func recordSyncMetrics(run *syncRun, status string, rowsRead int) {
+	metrics := SyncMetrics{Feed: run.dataType, Schema: run.schema, Status: status, DurationSeconds: time.Since(run.started).Seconds()}
+	if status == syncSuccess {
+		metrics.RecordsRead = rowsRead
+		metrics.Inserted = run.inserted
+		metrics.Updated = run.updated
+		metrics.Rejected = run.rejected
+	}
+
+	line, _ := json.Marshal(metrics)
+	logOutput(logInfo, "sync_metrics", string(line))
+
+	syncMetricsLock.Lock()
+	defer syncMetricsLock.Unlock()
+	key := [2]string{metrics.Feed, metrics.Schema}
+	totals, ok := syncMetricTotalsMap[key]
+	if !ok {
+		totals = &syncMetricTotals{runs: make(map[string]int)}
+		syncMetricTotalsMap[key] = totals
+	}
+	totals.runs[status]++
+	totals.read += metrics.RecordsRead
+	totals.inserted += metrics.Inserted
+	totals.updated += metrics.Updated
+	totals.rejected += metrics.Rejected
+	totals.lastStatus = status
+	totals.lastDuration = metrics.DurationSeconds
+	totals.lastRun = time.Now()
+}
+
+//
+// HTTP handler for the metrics functionality.  Returns the sync run totals since the service started in the
+// Prometheus text format so they can be scraped, charted and alerted on (e.g. a load suddenly taking much longer).
+//
+func getMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	syncMetricsLock.Lock()
+	defer syncMetricsLock.Unlock()
+
+	keys := [][2]string{}
+	for key := range syncMetricTotalsMap {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0]+"|"+keys[i][1] < keys[j][0]+"|"+keys[j][1]
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP cto_sync_runs_total Sync runs by outcome.")
+	fmt.Fprintln(w, "# TYPE cto_sync_runs_total counter")
+	for _, key := range keys {
+		for _, status := range []string{syncSuccess, syncFailure} {
+			fmt.Fprintf(w, "cto_sync_runs_total{feed=%q,schema=%q,status=%q} %d\n", key[0], key[1], status, syncMetricTotalsMap[key].runs[status])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP cto_sync_records_total Records handled by successful sync runs by what happened to them.")
+	fmt.Fprintln(w, "# TYPE cto_sync_records_total counter")
+	for _, key := range keys {
+		totals := syncMetricTotalsMap[key]
+		for _, outcome := range []struct {
+			name  string
+			count int
+		}{{"read", totals.read}, {"inserted", totals.inserted}, {"updated", totals.updated}, {"rejected", totals.rejected}} {
+			fmt.Fprintf(w, "cto_sync_records_total{feed=%q,schema=%q,outcome=%q} %d\n", key[0], key[1], outcome.name, outcome.count)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP cto_sync_last_duration_seconds Duration of the most recent sync run.")
+	fmt.Fprintln(w, "# TYPE cto_sync_last_duration_seconds gauge")
+	for _, key := range keys {
+		totals := syncMetricTotalsMap[key]
+		fmt.Fprintf(w, "cto_sync_last_duration_seconds{feed=%q,schema=%q,status=%q} %g\n", key[0], key[1], totals.lastStatus, totals.lastDuration)
+	}
+
+	fmt.Fprintln(w, "# HELP cto_sync_last_run_timestamp_seconds Unix time the most recent sync run finished.")
+	fmt.Fprintln(w, "# TYPE cto_sync_last_run_timestamp_seconds gauge")
+	for _, key := range keys {
+		fmt.Fprintf(w, "cto_sync_last_run_timestamp_seconds{feed=%q,schema=%q} %d\n", key[0], key[1], syncMetricTotalsMap[key].lastRun.Unix())
+	}
+}
@@ -0,0 +1,243 @@
+//  Sync Status
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// SyncStatus holds the persisted sync metadata for a data type loaded into a schema
+type SyncStatus struct {
+	DataType           string  `json:"data_type"`
+	Schema             string  `json:"schema"`
+	HighWaterMark      string  `json:"high_water_mark"`
+	LastSuccess        string  `json:"last_success"`
+	RowsRead           int     `json:"rows_read"`
+	RowsLoaded         int     `json:"rows_loaded"`
+	DurationSeconds    float64 `json:"duration_seconds"`
+	SourceChecksum     string  `json:"source_checksum"`
+	LastFailure        string  `json:"last_failure"`
+	LastFailureMessage string  `json:"last_failure_message"`
+}
+
+// syncRun tracks a single execution of one of the reference data processors
+type syncRun struct {
+	module        string
+	dataType      string
+	schema        string
+	filename      string
+	highWaterMark string
+	started       time.Time
+	failed        bool
+	job           *loadJob
+
+	// what happened to the records read, reported by recordSyncMetrics
+	processed int
+	inserted  int
+	updated   int
+	rejected  int
+}
+
+//
+// Start tracking a load of dataType from filename into schema.  The module is used when logging failures.  The
+// outcome is also reported to job, if the run is part of one.
+//
+func beginSyncRun(job *loadJob, module string, dataType string, schema string, filename string) *syncRun {
+	return &syncRun{module: module, dataType: dataType, schema: schema, filename: filename, started: time.Now(), job: job}
+}
+
+//
+// Log a processing error and record it as the latest failure for this data type and schema
+//
+func (run *syncRun) fail(message string) {
+	logOutput(logError, run.module, message)
+	run.job.setProgress(run)
+	run.job.fail(message)
+	if !run.failed {
+		recordSyncMetrics(run, syncFailure, 0)
+	}
+	run.failed = true
+
+	_, err := DBPool.Exec(`MERGE INTO CTO_COMMON.SYNC_METADATA m
+		USING (SELECT :1 AS data_type, :2 AS schema_name FROM DUAL) s
+		ON (m.data_type = s.data_type AND m.schema_name = s.schema_name)
+		WHEN MATCHED THEN UPDATE SET m.last_failure = SYSTIMESTAMP, m.last_failure_message = SUBSTR(:3, 1, 4000)
+		WHEN NOT MATCHED THEN INSERT (data_type, schema_name, last_failure, last_failure_message)
+			VALUES (s.data_type, s.schema_name, SYSTIMESTAMP, SUBSTR(:3, 1, 4000))`,
+		run.dataType, run.schema, message)
+	if err != nil {
+		logOutput(logWarn, run.module, "Unable to record failure in SYNC_METADATA: "+err.Error())
+	}
+}
+
+//
+// Count a record read from the feed, reporting the run's progress to its job from time to time
+//
+func (run *syncRun) recordProcessed() {
+	run.processed++
+	run.job.reportProgress(run)
+}
+
+//
+// Record a successful load along with the number of rows read from the feed and loaded into the database.
+// If a failure was already recorded during this run the success is not recorded.
+//
+func (run *syncRun) complete(rowsRead int, rowsLoaded int) {
+	if run.failed {
+		return
+	}
+	recordSyncMetrics(run, syncSuccess, rowsRead)
+	run.job.addRun(run, rowsRead, rowsLoaded)
+
+	// runs that aren't loading a file (e.g. materialized view refreshes) have no checksum
+	checksum := ""
+	var err error
+	if len(run.filename) > 0 {
+		checksum, err = fileChecksum(run.filename)
+		if err != nil {
+			logOutput(logWarn, run.module, "Unable to checksum source file: "+err.Error())
+		}
+	}
+
+	_, err = DBPool.Exec(`MERGE INTO CTO_COMMON.SYNC_METADATA m
+		USING (SELECT :1 AS data_type, :2 AS schema_name FROM DUAL) s
+		ON (m.data_type = s.data_type AND m.schema_name = s.schema_name)
+		WHEN MATCHED THEN UPDATE SET m.last_success = SYSTIMESTAMP, m.rows_read = :3, m.rows_loaded = :4,
+			m.duration_seconds = :5, m.source_checksum = :6, m.high_water_mark = NVL(:7, m.high_water_mark)
+		WHEN NOT MATCHED THEN INSERT (data_type, schema_name, last_success, rows_read, rows_loaded, duration_seconds, source_checksum, high_water_mark)
+			VALUES (s.data_type, s.schema_name, SYSTIMESTAMP, :3, :4, :5, :6, :7)`,
+		run.dataType, run.schema, rowsRead, rowsLoaded, time.Since(run.started).Seconds(), checksum, run.highWaterMark)
+	if err != nil {
+		logOutput(logWarn, run.module, "Unable to record success in SYNC_METADATA: "+err.Error())
+	}
+}
+
+//
+// Returns the hex encoded SHA-256 checksum of a file
+//
+func fileChecksum(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+//
+// Returns the sync metadata rows, optionally restricted to a single data type
+//
+func getSyncMetadata(dataType string) ([]SyncStatus, error) {
+	query := `SELECT data_type, schema_name, high_water_mark,
+		TO_CHAR(last_success, 'YYYY-MM-DD"T"HH24:MI:SSTZH:TZM'), NVL(rows_read, 0), NVL(rows_loaded, 0),
+		NVL(duration_seconds, 0), source_checksum,
+		TO_CHAR(last_failure, 'YYYY-MM-DD"T"HH24:MI:SSTZH:TZM'), last_failure_message
+		FROM CTO_COMMON.SYNC_METADATA `
+
+	// run the query, filtering on data type if one was supplied
+	var rows *sql.Rows
+	var err error
+	if len(dataType) > 0 {
+		rows, err = DBPool.Query(query+"WHERE data_type = :1 ORDER BY data_type, schema_name", dataType)
+	} else {
+		rows, err = DBPool.Query(query + "ORDER BY data_type, schema_name")
+	}
+	if err != nil {
+		thisError := fmt.Sprintf("Error querying SYNC_METADATA (%s): %s", dataType, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	// vars to hold nullable columns
+	var highWaterMark, lastSuccess, sourceChecksum, lastFailure, lastFailureMessage sql.NullString
+
+	items := []SyncStatus{}
+	for rows.Next() {
+		var status SyncStatus
+		err := rows.Scan(&status.DataType, &status.Schema, &highWaterMark, &lastSuccess, &status.RowsRead,
+			&status.RowsLoaded, &status.DurationSeconds, &sourceChecksum, &lastFailure, &lastFailureMessage)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning SYNC_METADATA row (%s): %s", dataType, err.Error())
+			return nil, errors.New(thisError)
+		}
+		status.HighWaterMark = highWaterMark.String
+		status.LastSuccess = lastSuccess.String
+		status.SourceChecksum = sourceChecksum.String
+		status.LastFailure = lastFailure.String
+		status.LastFailureMessage = lastFailureMessage.String
+		items = append(items, status)
+	}
+
+	return items, nil
+}
+
+//
+// Returns the time of the last successful load of dataType into schema.  The bool is false if there has never been one.
+//
+func getLastSyncSuccess(dataType string, schema string) (time.Time, bool, error) {
+	var lastSuccess sql.NullTime
+	err := DBPool.QueryRow("SELECT last_success FROM CTO_COMMON.SYNC_METADATA WHERE data_type = :1 AND schema_name = :2",
+		dataType, schema).Scan(&lastSuccess)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return lastSuccess.Time, lastSuccess.Valid, nil
+}
+
+//
+// Returns the high-water mark recorded by the last successful load of dataType into schema, or an empty string
+//
+func getHighWaterMark(dataType string, schema string) (string, error) {
+	var mark sql.NullString
+	err := DBPool.QueryRow("SELECT high_water_mark FROM CTO_COMMON.SYNC_METADATA WHERE data_type = :1 AND schema_name = :2",
+		dataType, schema).Scan(&mark)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return mark.String, err
+}
+
+//
+// HTTP handler that reports the last load outcome for each data type and schema.  An optional type
+// query parameter restricts the output to a single data type.
+//
+func getSyncStatusHandler(w http.ResponseWriter, r *http.Request) {
+	items, err := getSyncMetadata(r.URL.Query().Get("type"))
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "sync_status", err.Error())
+		return
+	}
+
+	result, err := json.Marshal(map[string][]SyncStatus{"items": items})
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "sync_status", err.Error())
+		return
+	}
+
+	// write result to output stream
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
@@ -0,0 +1,365 @@
+//  Synthetic Test Data
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the domain of every synthetic user so they can't be mistaken for (or mailed as) real people
+const syntheticEmailDomain = "synthetic.example.com"
+
+// written as createdby/lastupdatedby on the synthetic rows so they can be told apart from app data
+const syntheticCreatedBy = "cto_synthetic_data"
+
+// roughly one manager per this many users
+const syntheticTeamSize = 6
+
+// SyntheticVolumes is how much test data to generate.  Opportunities are per account and workloads per opportunity.
+type SyntheticVolumes struct {
+	Accounts      int   `json:"accounts"`
+	Opportunities int   `json:"opportunities_per_account"`
+	Workloads     int   `json:"workloads_per_opportunity"`
+	Users         int   `json:"users"`
+	Seed          int64 `json:"seed"`
+}
+
+// SyntheticResult is what generateTestData wrote, by table
+type SyntheticResult struct {
+	InstanceEnv string           `json:"instance_environment"`
+	Volumes     SyntheticVolumes `json:"volumes"`
+	Inserted    map[string]int64 `json:"inserted"`
+}
+
+// each volume parameter with its default and the most that can be asked for in one call
+var syntheticVolumeLimits = map[string][2]int{
+	"accounts":      {20, 1000},
+	"opportunities": {3, 20},
+	"workloads":     {2, 10},
+	"users":         {12, 500},
+}
+
+var syntheticFirstNames = []string{"Alex", "Blake", "Casey", "Dana", "Emery", "Finley", "Gray", "Harper", "Jordan", "Kai",
+	"Logan", "Morgan", "Noel", "Parker", "Quinn", "Reese", "Sage", "Taylor"}
+var syntheticLastNames = []string{"Abbott", "Bishop", "Carver", "Dalton", "Ellison", "Fletcher", "Garner", "Hayes", "Irving",
+	"Jensen", "Keller", "Lambert", "Mercer", "Nolan", "Osborne", "Pruitt", "Ramsey", "Sutton"}
+var syntheticCompanyNames = []string{"Acme", "Globex", "Initech", "Umbrella", "Hooli", "Vandelay", "Soylent", "Tyrell",
+	"Cyberdyne", "Wonka", "Gringotts", "Monarch", "Oscorp", "Massive Dynamic"}
+var syntheticIndustries = []string{"Bank", "Health", "Logistics", "Retail", "Energy", "Telecom", "Insurance", "Manufacturing"}
+var syntheticSummaries = []string{"EBS migration to OCI", "PSFT DR on OCI", "Data warehouse on ADW", "Integration for CIS",
+	"Analytics modernization", "Exadata consolidation", "Kubernetes platform on OKE", "JDE lift and shift", "Data lake on Object Storage"}
+var syntheticWorkloadTypes = []string{"Lift & Shift", "Database", "Analytics", "Integration", "Custom Apps", "Exadata"}
+
+//
+// HTTP handler for the admin/generateTestData functionality.  Fills a dev instance-environment with synthetic users,
+// accounts, opportunities, workloads and tech health so the dashboards and ingest paths can be exercised without
+// copying production data.
+//
+func generateTestDataHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Method not allowed")
+		return
+	}
+	query := r.URL.Query()
+	instanceEnv := query.Get("instanceEnvironment")
+
+	volumes, err := getSyntheticVolumes(query)
+	if err == nil {
+		err = checkTestDataEnvironment(instanceEnv)
+	}
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+
+	// call the helper which does the data mashing
+	result, err := generateTestData(instanceEnv, volumes)
+	if inputErr, ok := err.(inputError); ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s", inputErr.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error in input parameters or processing; please contact your service administrator (request id %s)", requestID(r.Context()))
+		logRequest(r, logError, "synthetic_data", err.Error())
+		return
+	}
+
+	message := fmt.Sprintf("Generated test data in %s (seed %d): %v", instanceEnv, volumes.Seed, result.Inserted)
+	logRequest(r, logInfo, "synthetic_data", message)
+
+	// write result to output stream
+	json, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+//
+// Reads the volume parameters, applying the defaults and limits in syntheticVolumeLimits.  seed makes a run
+// repeatable; without one the current time is used.
+//
+func getSyntheticVolumes(query url.Values) (SyntheticVolumes, error) {
+	values := make(map[string]int)
+	for name, limits := range syntheticVolumeLimits {
+		values[name] = limits[0]
+		if len(query.Get(name)) < 1 {
+			continue
+		}
+		value, err := strconv.Atoi(query.Get(name))
+		if err != nil || value < 0 || value > limits[1] {
+			return SyntheticVolumes{}, inputError(fmt.Sprintf("%s must be between 0 and %d", name, limits[1]))
+		}
+		values[name] = value
+	}
+	volumes := SyntheticVolumes{Accounts: values["accounts"], Opportunities: values["opportunities"],
+		Workloads: values["workloads"], Users: values["users"], Seed: time.Now().UnixNano()}
+	if len(query.Get("seed")) > 0 {
+		seed, err := strconv.ParseInt(query.Get("seed"), 10, 64)
+		if err != nil {
+			return SyntheticVolumes{}, inputError("seed must be a whole number")
+		}
+		volumes.Seed = seed
+	}
+	if volumes.Accounts > 0 && volumes.Users < 1 {
+		return SyntheticVolumes{}, inputError("users must be at least 1 to assign the accounts to")
+	}
+	return volumes, nil
+}
+
+//
+// Only the ECAL instance-environments listed in TestDataEnvironments can be filled with synthetic data, so a typo
+// can't write test rows into a production schema
+//
+func checkTestDataEnvironment(instanceEnv string) error {
+	if len(lookupSchema(instanceEnv)) < 1 || !strings.HasPrefix(instanceEnv, "ecal-") {
+		return inputError("instanceEnvironment query parameter is invalid")
+	}
+	if configListContains(GlobalConfig.TestDataEnvironments, instanceEnv) {
+		return nil
+	}
+	return inputError(instanceEnv + " is not listed in TestDataEnvironments")
+}
+
+//
+// Inserts the synthetic data in a single transaction and then rebuilds the schema's ManagerClosure so the new users'
+// hierarchies show up on the dashboards.  The schema must have been seeded (admin/seedSchema) since accounts,
+// stages and roles reference the seed rows.  Users are upserted by email so re-running with the same seed doesn't
+// duplicate them; accounts and opportunities are added on every run.
+//
+func generateTestData(instanceEnv string, volumes SyntheticVolumes) (SyntheticResult, error) {
+	schema := lookupSchema(instanceEnv)
+	result := SyntheticResult{InstanceEnv: instanceEnv, Volumes: volumes, Inserted: map[string]int64{
+		"User1": 0, "Account": 0, "UserAccount": 0, "Opportunity": 0, "OpportunityWorkload": 0, "OpportunityTechHealth": 0}}
+	random := rand.New(rand.NewSource(volumes.Seed))
+
+	lobs, err := syntheticReferenceIDs(schema, "SELECT id FROM "+schema+".Lookup WHERE lookuptype = 'LOB' ORDER BY id")
+	if err != nil {
+		return result, err
+	}
+	stages, err := syntheticReferenceIDs(schema, "SELECT id FROM "+schema+".ECALStage ORDER BY id")
+	if err != nil {
+		return result, err
+	}
+	if len(lobs) < 1 || len(stages) < 1 {
+		return result, inputError(instanceEnv + " has no LOB lookups or ECAL stages; run admin/seedSchema first")
+	}
+
+	// start a DB transaction
+	tx, err := DBPool.Begin()
+	if err != nil {
+		thisError := fmt.Sprintf("Error starting DB transaction (%s): %s", instanceEnv, err.Error())
+		return result, errors.New(thisError)
+	}
+	defer tx.Rollback()
+
+	// a small org: the first manager runs it and the others report to them, with the users spread across the managers
+	managers := (volumes.Users + syntheticTeamSize - 1) / syntheticTeamSize
+	emails := make([]string, volumes.Users)
+	teamMembers := []string{}
+	merge := strings.ReplaceAll(ecalProvisionMerge, "%SCHEMA%", schema)
+	for i := 0; i < volumes.Users; i++ {
+		emails[i] = fmt.Sprintf("%s.%s.%d@%s", strings.ToLower(syntheticFirstNames[random.Intn(len(syntheticFirstNames))]),
+			strings.ToLower(syntheticLastNames[random.Intn(len(syntheticLastNames))]), i+1, syntheticEmailDomain)
+		manager, role := "", "Manager"
+		if i > 0 && i < managers {
+			manager = emails[0]
+		} else if i >= managers {
+			manager, role = emails[i%managers], "User"
+			teamMembers = append(teamMembers, emails[i])
+		}
+		res, err := tx.Exec(merge, emails[i], manager, role)
+		if err != nil {
+			thisError := fmt.Sprintf("Error creating synthetic user %s (%s): %s", emails[i], instanceEnv, err.Error())
+			return result, errors.New(thisError)
+		}
+		count, _ := res.RowsAffected()
+		result.Inserted["User1"] += count
+	}
+	if len(teamMembers) < 1 {
+		teamMembers = emails
+	}
+
+	for a := 0; a < volumes.Accounts; a++ {
+		owner := teamMembers[random.Intn(len(teamMembers))]
+		var accountID int64
+		_, err = tx.Exec("INSERT INTO "+schema+".Account (accountname, accountlob, cimid, currentcsaexecuted, "+
+			"creationdate, lastupdatedate, createdby, lastupdatedby) "+
+			"VALUES (:1, :2, :3, :4, SYSDATE - :5, SYSDATE - :6, :7, :7) RETURNING id INTO :8",
+			fmt.Sprintf("%s %s %d", syntheticCompanyNames[random.Intn(len(syntheticCompanyNames))],
+				syntheticIndustries[random.Intn(len(syntheticIndustries))], 1000+random.Intn(9000)),
+			lobs[random.Intn(len(lobs))], strconv.Itoa(10000000+random.Intn(90000000)), random.Intn(2),
+			180+random.Intn(365), random.Intn(90), syntheticCreatedBy, sql.Out{Dest: &accountID})
+		if err != nil {
+			thisError := fmt.Sprintf("Error creating synthetic account (%s): %s", instanceEnv, err.Error())
+			return result, errors.New(thisError)
+		}
+		result.Inserted["Account"]++
+
+		_, err = tx.Exec("INSERT INTO "+schema+".UserAccount (user1, account, creationdate, lastupdatedate, createdby, lastupdatedby) "+
+			"SELECT u.id, :1, SYSDATE, SYSDATE, :2, :2 FROM "+schema+".User1 u WHERE LOWER(u.useremail) = :3",
+			accountID, syntheticCreatedBy, owner)
+		if err != nil {
+			thisError := fmt.Sprintf("Error assigning synthetic account %d (%s): %s", accountID, instanceEnv, err.Error())
+			return result, errors.New(thisError)
+		}
+		result.Inserted["UserAccount"]++
+
+		for o := 0; o < volumes.Opportunities; o++ {
+			err = insertSyntheticOpportunity(tx, schema, random, accountID, owner, stages, volumes.Workloads, result.Inserted)
+			if err != nil {
+				thisError := fmt.Sprintf("Error creating synthetic opportunity for account %d (%s): %s", accountID, instanceEnv, err.Error())
+				return result, errors.New(thisError)
+			}
+		}
+	}
+
+	// complete the transaction
+	err = tx.Commit()
+	if err != nil {
+		thisError := fmt.Sprintf("Error committing transaction (%s): %s", instanceEnv, err.Error())
+		return result, errors.New(thisError)
+	}
+
+	// the new managers need their closure rows before the hierarchy queries will find their teams
+	if volumes.Users > 0 {
+		_, err = refreshManagerClosure(instanceEnv, schema)
+		if err != nil {
+			return result, err
+		}
+		invalidateHierarchyCache()
+	}
+	invalidateQueryCache()
+	return result, nil
+}
+
+//
+// Inserts an opportunity with its tech health and workloads, progressing it to a random ECAL stage with tech health
+// flags to match so the dashboard colors come out mixed
+//
+func insertSyntheticOpportunity(tx *sql.Tx, schema string, random *rand.Rand, accountID int64, techLead string,
+	stages []int64, workloads int, inserted map[string]int64) error {
+	stage := random.Intn(len(stages) + 1)
+	progress := float64(stage) / float64(len(stages))
+	flag := func(chance float64) int {
+		if random.Float64() < chance {
+			return 1
+		}
+		return 0
+	}
+	var latestStage interface{}
+	if stage > 0 {
+		latestStage = stages[stage-1]
+	}
+
+	var opportunityID int64
+	_, err := tx.Exec("INSERT INTO "+schema+".Opportunity (account, opportunityid, summary, projectedarr, ecalpercentcomplete, "+
+		"lateststagedone, technicallead, realm, creationdate, lastupdatedate, createdby, lastupdatedby) "+
+		"VALUES (:1, :2, :3, :4, :5, :6, :7, :8, SYSDATE - :9, SYSDATE - :10, :11, :11) RETURNING id INTO :12",
+		accountID, syntheticOpportunityID(random), syntheticSummaries[random.Intn(len(syntheticSummaries))],
+		(1+random.Intn(200))*5000, int(progress*100), latestStage, techLead, "OC1",
+		90+random.Intn(270), random.Intn(60), syntheticCreatedBy, sql.Out{Dest: &opportunityID})
+	if err != nil {
+		return err
+	}
+	inserted["Opportunity"]++
+
+	pocRequired := flag(0.5)
+	pocStatus := "Not Started"
+	if pocRequired == 1 && progress > 0.5 {
+		pocStatus = "Completed"
+	} else if pocRequired == 1 && progress > 0.25 {
+		pocStatus = "In Progress"
+	}
+	_, err = tx.Exec("INSERT INTO "+schema+".OpportunityTechHealth (opportunity, adoptionowneremail, implementeremail, "+
+		"pocrequired, pocstatus, securitysignoffdone, technicalsignoffdone, consumptionplansignoff, technicalblockers, "+
+		"commercialblockers, cloudatcustomerinvolved, cloudatcustomersardone, creationdate, lastupdatedate, createdby, lastupdatedby) "+
+		"VALUES (:1, :2, :3, :4, :5, :6, :7, :8, :9, :10, :11, :12, SYSDATE, SYSDATE, :13, :13)",
+		opportunityID, fmt.Sprintf("adopter.%d@%s", opportunityID, syntheticEmailDomain), techLead,
+		pocRequired, pocStatus, flag(progress), flag(progress*0.9), flag(progress*0.8), flag(0.15), flag(0.1), 0, 0,
+		syntheticCreatedBy)
+	if err != nil {
+		return err
+	}
+	inserted["OpportunityTechHealth"]++
+
+	for w := 0; w < workloads; w++ {
+		workloadType := syntheticWorkloadTypes[random.Intn(len(syntheticWorkloadTypes))]
+		_, err = tx.Exec("INSERT INTO "+schema+".OpportunityWorkload (opportunity, workloadidentifier, workloaddescription, "+
+			"workloadtype, consumptionstartdate, consumptionrampmonths, creationdate, lastupdatedate, createdby, lastupdatedby) "+
+			"VALUES (:1, :2, :3, :4, TRUNC(SYSDATE) + :5, :6, SYSDATE, SYSDATE, :7, :7)",
+			opportunityID, fmt.Sprintf("SYN-%d-%d", opportunityID, w+1), workloadType+" workload", workloadType,
+			random.Intn(180), 3+random.Intn(10), syntheticCreatedBy)
+		if err != nil {
+			return err
+		}
+		inserted["OpportunityWorkload"]++
+	}
+	return nil
+}
+
+//
+// Returns a 5 character opportunity id like the ones the opportunity feed carries
+//
+func syntheticOpportunityID(random *rand.Rand) string {
+	const characters = "ABCDEFGHJKLMNPQRSTUVWXYZ0123456789"
+	id := make([]byte, 5)
+	for i := range id {
+		id[i] = characters[random.Intn(len(characters))]
+	}
+	return string(id)
+}
+
+func syntheticReferenceIDs(schema string, query string) ([]int64, error) {
+	rows, err := DBPool.Query(query)
+	if err != nil {
+		thisError := fmt.Sprintf("Error reading reference rows (%s): %s", schema, err.Error())
+		return nil, errors.New(thisError)
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			thisError := fmt.Sprintf("Error scanning reference rows (%s): %s", schema, err.Error())
+			return nil, errors.New(thisError)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,76 @@
+//  Table Statistics
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// prefix of the SYNC_METADATA data type each statistics gathering is reported under (e.g. stats:LOOKUPOPPORTUNITY)
+const tableStatsDataType = "stats:"
+
+//
+// Returns the smallest load (in rows) into an instance-environment that has its table statistics gathered afterwards
+// and whether statistics are gathered there at all.  GatherStats in config.json sets it per instance-env as
+// "ecal-prod-live:20000,ecal-dev-stage:0"; instance-envs without an entry are left to the nightly stats job.
+//
+func getGatherStatsThreshold(instanceEnv string) (int, bool) {
+	for _, entry := range strings.Split(GlobalConfig.GatherStats, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 || parts[0] != instanceEnv {
+			continue
+		}
+		threshold, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || threshold < 0 {
+			logOutput(logWarn, "table_stats", fmt.Sprintf("Invalid row threshold in GatherStats (%s): %s", instanceEnv, parts[1]))
+			return 0, false
+		}
+		return threshold, true
+	}
+	return 0, false
+}
+
+//
+// Gathers optimizer statistics (DBMS_STATS.GATHER_TABLE_STATS, including its indexes) on a lookup table that a load of
+// rows rows into the instance-environment has just replaced, when the load reached the GatherStats threshold.  Stats
+// left over from before a full reload make the optimizer pick poor plans for the dashboard queries that follow.  The
+// outcome is recorded in SYNC_METADATA and so shows up in /syncStatus under the data type stats:TABLE_NAME, with the
+// load's rows as rows_read and the table's row count from the new statistics as rows_loaded.
+//
+func gatherTableStats(job *loadJob, instanceEnv string, table string, rows int) {
+	threshold, enabled := getGatherStatsThreshold(instanceEnv)
+	if !enabled || rows < threshold {
+		return
+	}
+	schema := lookupSchema(instanceEnv)
+	if len(schema) < 1 {
+		return
+	}
+
+	table = strings.ToUpper(table)
+	run := beginSyncRun(job, "table_stats", tableStatsDataType+table, schema, "")
+	start := time.Now()
+	_, err := DBPool.Exec("BEGIN DBMS_STATS.GATHER_TABLE_STATS(ownname => :1, tabname => :2, cascade => TRUE); END;",
+		strings.ToUpper(schema), table)
+	if err != nil {
+		run.fail(fmt.Sprintf("Error gathering statistics on %s.%s (%s): %s", schema, table, instanceEnv, err.Error()))
+		return
+	}
+
+	var tableRows int
+	err = DBPool.QueryRow("SELECT NVL(num_rows, 0) FROM ALL_TABLES WHERE owner = :1 AND table_name = :2",
+		strings.ToUpper(schema), table).Scan(&tableRows)
+	if err != nil {
+		logOutput(logWarn, "table_stats", fmt.Sprintf("Unable to read row count of %s.%s: %s", schema, table, err.Error()))
+	}
+
+	run.complete(rows, tableRows)
+	message := fmt.Sprintf("Gathered statistics on %s.%s (%d rows) after a load of %d rows in %s", schema, table,
+		tableRows, rows, time.Since(start).Round(time.Millisecond))
+	logOutput(logInfo, "table_stats", message)
+}
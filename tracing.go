@@ -0,0 +1,470 @@
+//  Tracing
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the service name spans are reported under
+const tracingServiceName = "cto-bizlogic-helper"
+
+// the W3C trace context header a caller's trace is continued from
+const traceParentHeader = "traceparent"
+
+// finished spans wait in a buffer of this size and are sent in batches of up to tracingBatchSize at least every
+// tracingExportInterval; spans that arrive while the buffer is full are dropped rather than slowing requests down
+const tracingBufferSize = 4096
+const tracingBatchSize = 512
+const tracingExportInterval = 5 * time.Second
+
+// how long a single export may take
+const tracingExportTimeout = 10 * time.Second
+
+// the longest db.statement recorded on a query span
+const tracingMaxStatement = 4000
+
+// OTLP span kinds
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+// matches a W3C traceparent header: version-traceid-spanid-flags
+var traceParentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// the finished spans waiting to be exported; nil while tracing is off.  tracingLock guards the channel being closed
+// by stopTracing and the count of spans dropped.
+var tracingSpans chan *span
+var tracingClosed bool
+var tracingDropped int64
+var tracingLock sync.RWMutex
+var tracingStopped = make(chan struct{})
+
+// spanKey is the context key of the span a context belongs to
+type spanKey struct{}
+
+// span is one timed operation of a trace.  A nil *span is a trace that isn't sampled (or tracing being off), so every
+// method is safe to call on one.
+type span struct {
+	traceID    string
+	spanID     string
+	parentID   string
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        string
+}
+
+//
+// Turns tracing on when TracingEndpoint is set and starts exporting spans to it.  Checked at startup.
+//
+func initTracing() error {
+	if len(GlobalConfig.TracingEndpoint) < 1 {
+		return nil
+	}
+	if !strings.HasPrefix(GlobalConfig.TracingEndpoint, "http://") && !strings.HasPrefix(GlobalConfig.TracingEndpoint, "https://") {
+		return errors.New("TracingEndpoint must be an http:// or https:// OTLP traces URL")
+	}
+	if GlobalConfig.TracingSamplePercent < 0 || GlobalConfig.TracingSamplePercent > 100 {
+		return errors.New("TracingSamplePercent must be between 0 and 100")
+	}
+
+	tracingSpans = make(chan *span, tracingBufferSize)
+	go exportSpans()
+	logOutput(logInfo, "tracing", "Exporting traces to "+GlobalConfig.TracingEndpoint)
+	return nil
+}
+
+//
+// True if spans are being recorded
+//
+func tracingEnabled() bool {
+	return tracingSpans != nil
+}
+
+//
+// Starts a span as a child of the span in ctx, or as the root of a new trace (sampled by TracingSamplePercent) if ctx
+// has none, and returns a context carrying it.  Call finish on the span when the operation is done.
+//
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if !tracingEnabled() {
+		return ctx, nil
+	}
+	parent, hasParent := ctx.Value(spanKey{}).(*span)
+	if hasParent && parent == nil {
+		return ctx, nil
+	}
+	if !hasParent {
+		return newTrace(ctx, "", "", sampleTrace(), name, kind)
+	}
+	return newTrace(ctx, parent.traceID, parent.spanID, true, name, kind)
+}
+
+//
+// Starts a span in the trace given by ids (a new trace when traceID is empty), or records that the trace isn't sampled
+//
+func newTrace(ctx context.Context, traceID string, parentID string, sampled bool, name string, kind int) (context.Context, *span) {
+	if !sampled {
+		return context.WithValue(ctx, spanKey{}, (*span)(nil)), nil
+	}
+	if len(traceID) < 1 {
+		traceID = randomHex(16)
+	}
+	s := &span{traceID: traceID, spanID: randomHex(8), parentID: parentID, name: name, kind: kind, start: time.Now(),
+		attributes: make(map[string]interface{})}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+//
+// True if a new trace falls in the TracingSamplePercent sample (every trace when it isn't set)
+//
+func sampleTrace() bool {
+	percent := GlobalConfig.TracingSamplePercent
+	if percent == 0 || percent >= 100 {
+		return true
+	}
+	b := make([]byte, 1)
+	rand.Read(b)
+	return int(b[0])*100 < percent*256
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//
+// Returns the id of the trace the context belongs to, or an empty string if it isn't traced
+//
+func traceID(ctx context.Context) string {
+	if s, _ := ctx.Value(spanKey{}).(*span); s != nil {
+		return s.traceID
+	}
+	return ""
+}
+
+func (s *span) set(key string, value interface{}) {
+	if s != nil {
+		s.attributes[key] = value
+	}
+}
+
+//
+// Marks the span as failed if err is set and queues it for export
+//
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.err = err.Error()
+	}
+	s.end = time.Now()
+
+	// spans of loads abandoned at shutdown can finish after the export has stopped; those are dropped
+	tracingLock.RLock()
+	queued := false
+	if !tracingClosed {
+		select {
+		case tracingSpans <- s:
+			queued = true
+		default:
+		}
+	}
+	tracingLock.RUnlock()
+	if !queued {
+		tracingLock.Lock()
+		tracingDropped++
+		tracingLock.Unlock()
+	}
+}
+
+// spanWriter records the status of a traced request's response
+type spanWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *spanWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *spanWriter) Write(data []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(data)
+}
+
+func (sw *spanWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//
+// Starts the server span of a request, continuing the caller's trace when it sends a traceparent header.  Returns the
+// writer and request the handler should use and the function that ends the span once the handler returns.
+//
+func startRequestSpan(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func()) {
+	if !tracingEnabled() {
+		return w, r, func() {}
+	}
+
+	var ctx context.Context
+	var s *span
+	name := r.Method + " " + r.URL.Path
+	if parent := traceParentPattern.FindStringSubmatch(r.Header.Get(traceParentHeader)); parent != nil {
+		flags, _ := strconv.ParseUint(parent[3], 16, 8)
+		ctx, s = newTrace(r.Context(), parent[1], parent[2], flags&1 == 1, name, spanServer)
+	} else {
+		ctx, s = startSpan(r.Context(), name, spanServer)
+	}
+	if s == nil {
+		return w, r.WithContext(ctx), func() {}
+	}
+
+	client, _, _ := r.BasicAuth()
+	s.set("http.method", r.Method)
+	s.set("http.target", r.URL.Path)
+	s.set("http.request_id", requestID(r.Context()))
+	s.set("enduser.id", client)
+	if instanceEnv := r.URL.Query().Get("instanceEnvironment"); len(instanceEnv) > 0 {
+		s.set("instance_env", instanceEnv)
+	}
+	writer := &spanWriter{ResponseWriter: w}
+	return writer, r.WithContext(ctx), func() {
+		status := writer.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		s.set("http.status_code", status)
+		var err error
+		if status >= 500 {
+			err = errors.New(http.StatusText(status))
+		}
+		s.finish(err)
+	}
+}
+
+// tracingStore records a client span for every query run with a context, as a child of the request's span
+type tracingStore struct {
+	Store
+}
+
+//
+// Returns store wrapped so its queries are traced, or store itself while tracing is off
+//
+func traceStore(store Store) Store {
+	if !tracingEnabled() {
+		return store
+	}
+	return tracingStore{Store: store}
+}
+
+//
+// Starts the span of a query, named by its operation (e.g. "oracle SELECT")
+//
+func startQuerySpan(ctx context.Context, query string) *span {
+	statement := strings.TrimSpace(query)
+	if strings.HasPrefix(statement, "/*") {
+		if end := strings.Index(statement, "*/"); end > 0 {
+			statement = strings.TrimSpace(statement[end+2:])
+		}
+	}
+	operation := strings.ToUpper(strings.SplitN(statement+" ", " ", 2)[0])
+	if len(query) > tracingMaxStatement {
+		query = query[:tracingMaxStatement]
+	}
+	_, s := startSpan(ctx, "oracle "+operation, spanClient)
+	s.set("db.system", "oracle")
+	s.set("db.operation", operation)
+	s.set("db.statement", query)
+	return s
+}
+
+func (ts tracingStore) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	s := startQuerySpan(ctx, query)
+	rows, err := ts.Store.QueryContext(ctx, query, args...)
+	s.finish(err)
+	return rows, err
+}
+
+func (ts tracingStore) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	s := startQuerySpan(ctx, query)
+	result, err := ts.Store.ExecContext(ctx, query, args...)
+	if err == nil {
+		if affected, rowsErr := result.RowsAffected(); rowsErr == nil {
+			s.set("db.rows_affected", affected)
+		}
+	}
+	s.finish(err)
+	return result, err
+}
+
+func (ts tracingStore) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	s := startQuerySpan(ctx, query)
+	row := ts.Store.QueryRowContext(ctx, query, args...)
+	s.finish(row.Err())
+	return row
+}
+
+//
+// Sends the finished spans to TracingEndpoint in batches until stopTracing is called
+//
+func exportSpans() {
+	defer close(tracingStopped)
+	ticker := time.NewTicker(tracingExportInterval)
+	defer ticker.Stop()
+
+	batch := []*span{}
+	for {
+		select {
+		case s, open := <-tracingSpans:
+			if !open {
+				sendSpans(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) < tracingBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		sendSpans(batch)
+		batch = []*span{}
+	}
+}
+
+//
+// Stops tracing and sends the spans still waiting.  Called at shutdown once requests and loads are done.
+//
+func stopTracing() {
+	if !tracingEnabled() {
+		return
+	}
+	tracingLock.Lock()
+	tracingClosed = true
+	close(tracingSpans)
+	tracingLock.Unlock()
+	select {
+	case <-tracingStopped:
+	case <-time.After(tracingExportTimeout):
+		logOutput(logWarn, "tracing", "Timed out sending the last spans")
+	}
+}
+
+//
+// Sends a batch of spans to TracingEndpoint as OTLP/HTTP JSON.  OCI APM's OTLP endpoint takes its data key in the
+// Authorization header (TracingDataKey); an OpenTelemetry collector needs none.  A failed export is logged and the batch
+// dropped.
+//
+func sendSpans(batch []*span) {
+	tracingLock.Lock()
+	dropped := tracingDropped
+	tracingDropped = 0
+	tracingLock.Unlock()
+	if dropped > 0 {
+		logOutput(logWarn, "tracing", fmt.Sprintf("Dropped %d spans, the export buffer was full", dropped))
+	}
+	if len(batch) < 1 {
+		return
+	}
+
+	body, err := json.Marshal(otlpTraces(batch))
+	if err != nil {
+		logOutput(logWarn, "tracing", "Unable to encode spans: "+err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tracingExportTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, GlobalConfig.TracingEndpoint, bytes.NewReader(body))
+	if err != nil {
+		logOutput(logWarn, "tracing", "Unable to export spans: "+err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(GlobalConfig.TracingDataKey) > 0 {
+		req.Header.Set("Authorization", "dataKey "+GlobalConfig.TracingDataKey)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logOutput(logWarn, "tracing", fmt.Sprintf("Unable to export %d spans: %s", len(batch), err.Error()))
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		logOutput(logWarn, "tracing", outputHTTPError(fmt.Sprintf("Unable to export %d spans", len(batch)), nil, res))
+	}
+}
+
+//
+// Returns spans as an OTLP ExportTraceServiceRequest in its JSON encoding
+//
+func otlpTraces(batch []*span) map[string]interface{} {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		attributes := []map[string]interface{}{}
+		for key, value := range s.attributes {
+			attributes = append(attributes, map[string]interface{}{"key": key, "value": otlpValue(value)})
+		}
+		entry := map[string]interface{}{
+			"traceId":           s.traceID,
+			"spanId":            s.spanID,
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attributes,
+		}
+		if len(s.parentID) > 0 {
+			entry["parentSpanId"] = s.parentID
+		}
+		if len(s.err) > 0 {
+			entry["status"] = map[string]interface{}{"code": 2, "message": s.err}
+		}
+		spans = append(spans, entry)
+	}
+
+	resource := []map[string]interface{}{{"key": "service.name", "value": otlpValue(tracingServiceName)}}
+	return map[string]interface{}{"resourceSpans": []map[string]interface{}{{
+		"resource":   map[string]interface{}{"attributes": resource},
+		"scopeSpans": []map[string]interface{}{{"scope": map[string]string{"name": tracingServiceName}, "spans": spans}},
+	}}}
+}
+
+func otlpValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
@@ -0,0 +1,211 @@
+//  Upstream Health
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/objectstorage"
+)
+
+// how long a single upstream probe may take
+const upstreamProbeTimeout = 10 * time.Second
+
+// how long probe results are reused, so frequent health checks don't hit the upstream sources every time
+const upstreamProbeCacheTTL = time.Minute
+
+// UpstreamStatus is the reachability of one upstream source the loads depend on
+type UpstreamStatus struct {
+	Name          string `json:"name"`
+	Kind          string `json:"kind"`
+	Target        string `json:"target"`
+	Reachable     bool   `json:"reachable"`
+	Detail        string `json:"detail,omitempty"`
+	LatencyMillis int64  `json:"latency_ms"`
+}
+
+// upstreamSource is an upstream to probe and how to probe it
+type upstreamSource struct {
+	name   string
+	kind   string
+	target string
+	probe  func(ctx context.Context) (string, error)
+}
+
+// the last probe results, guarded by upstreamProbeLock
+var upstreamProbeResults []UpstreamStatus
+var upstreamProbeTime time.Time
+var upstreamProbeLock sync.Mutex
+
+//
+// HTTP handler for the health/upstream functionality.  Probes each configured upstream source (feed and token URLs,
+// Object Storage buckets and UpstreamHosts) and returns their reachability, with a 503 if any is down.  The service's
+// own health is left to /health so a failing feed can be told apart from a failing helper.
+//
+func upstreamHealthHandler(w http.ResponseWriter, r *http.Request) {
+	statuses := checkUpstreams()
+	reachable := true
+	for _, status := range statuses {
+		reachable = reachable && status.Reachable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !reachable {
+		w.WriteHeader(503)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"reachable": reachable, "upstreams": statuses})
+}
+
+//
+// Returns the :NAME markers of the upstream sources that can't be reached, for the health check when
+// UpstreamHealthChecks is on.  An empty string means all of them are up.
+//
+func checkUpstreamHealth() string {
+	downErrors := ""
+	for _, status := range checkUpstreams() {
+		if !status.Reachable {
+			thisError := fmt.Sprintf("Upstream healthcheck failed: %s (%s) %s", status.Name, status.Target, status.Detail)
+			logOutput(logWarn, "healthcheck", thisError)
+			downErrors = downErrors + ":" + strings.ToUpper(status.Name)
+		}
+	}
+	return downErrors
+}
+
+//
+// Probes every configured upstream source at once, reusing the previous results if they are recent enough.  The probes
+// don't take the caller's context since their results are shared with the callers that follow.
+//
+func checkUpstreams() []UpstreamStatus {
+	upstreamProbeLock.Lock()
+	defer upstreamProbeLock.Unlock()
+	if upstreamProbeResults != nil && time.Since(upstreamProbeTime) < upstreamProbeCacheTTL {
+		return upstreamProbeResults
+	}
+
+	sources := upstreamSources()
+	statuses := make([]UpstreamStatus, len(sources))
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		wg.Add(1)
+		go func(i int, source upstreamSource) {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(context.Background(), upstreamProbeTimeout)
+			defer cancel()
+
+			start := time.Now()
+			detail, err := source.probe(probeCtx)
+			statuses[i] = UpstreamStatus{Name: source.name, Kind: source.kind, Target: source.target, Reachable: err == nil,
+				Detail: detail, LatencyMillis: time.Since(start).Milliseconds()}
+			if err != nil {
+				statuses[i].Detail = err.Error()
+			}
+		}(i, source)
+	}
+	wg.Wait()
+
+	upstreamProbeResults = statuses
+	upstreamProbeTime = time.Now()
+	return statuses
+}
+
+//
+// Returns the upstream sources configured on this instance: the REST feeds and their token URLs, the Object Storage
+// buckets and the UpstreamHosts given as "name=host:port" (e.g. an SFTP drop), which are checked with a TCP connect
+//
+func upstreamSources() []upstreamSource {
+	sources := []upstreamSource{}
+	for _, feed := range feedSources() {
+		sources = append(sources, httpUpstream(feed.dataType+"_feed", feed.url))
+		if len(feed.tokenURL) > 0 {
+			sources = append(sources, httpUpstream(feed.dataType+"_feed_token", feed.tokenURL))
+		}
+	}
+
+	buckets := []struct {
+		name   string
+		bucket string
+	}{{"artifact_bucket", GlobalConfig.ArtifactBucket}, {"export_bucket", GlobalConfig.ExportBucket},
+		{"analytics_bucket", GlobalConfig.AnalyticsBucket}, {"identity_version_bucket", GlobalConfig.IdentityVersionBucket}}
+	for _, bucket := range buckets {
+		if len(bucket.bucket) > 0 {
+			sources = append(sources, bucketUpstream(bucket.name, bucket.bucket))
+		}
+	}
+
+	for _, entry := range GlobalConfig.UpstreamHosts {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			parts = []string{entry, entry}
+		}
+		sources = append(sources, hostUpstream(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])))
+	}
+	return sources
+}
+
+//
+// An HTTP source is up when it answers at all below a 5xx; it isn't sent credentials, so a 401 or 403 still counts
+//
+func httpUpstream(name string, location string) upstreamSource {
+	target := location
+	if parsed, err := url.Parse(location); err == nil {
+		target = parsed.Host
+	}
+	return upstreamSource{name: name, kind: "http", target: target, probe: func(ctx context.Context) (string, error) {
+		request, err := http.NewRequestWithContext(ctx, http.MethodHead, location, nil)
+		if err != nil {
+			return "", err
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return "", err
+		}
+		response.Body.Close()
+		detail := fmt.Sprintf("HTTP %d", response.StatusCode)
+		if response.StatusCode >= 500 {
+			return "", fmt.Errorf("returned %s", detail)
+		}
+		return detail, nil
+	}}
+}
+
+//
+// A bucket is up when the service can read its metadata in ArtifactNamespace
+//
+func bucketUpstream(name string, bucket string) upstreamSource {
+	return upstreamSource{name: name, kind: "object_storage", target: GlobalConfig.ArtifactNamespace + "/" + bucket,
+		probe: func(ctx context.Context) (string, error) {
+			if ObjectStorage == nil {
+				return "", errors.New("Object Storage client is not initialized")
+			}
+			_, err := ObjectStorage.HeadBucket(ctx, objectstorage.HeadBucketRequest{
+				NamespaceName: &GlobalConfig.ArtifactNamespace, BucketName: &bucket})
+			return "", err
+		}}
+}
+
+//
+// A host is up when a TCP connection to it can be opened
+//
+func hostUpstream(name string, address string) upstreamSource {
+	return upstreamSource{name: name, kind: "tcp", target: address, probe: func(ctx context.Context) (string, error) {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return "", err
+		}
+		conn.Close()
+		return "", nil
+	}}
+}
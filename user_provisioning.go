@@ -0,0 +1,166 @@
+//  User Provisioning
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// default application role given to newly provisioned users without direct reports
+const defaultProvisionRole = "User"
+
+// provisionedUser is an employee from the identity feed who belongs in one or more of the VBCS apps
+type provisionedUser struct {
+	Email      string
+	FirstName  string
+	LastName   string
+	Manager    string
+	NumDirects int
+	MgrLevel   string
+	AppMap     string
+}
+
+// new users are inserted with their derived role; existing users only have their manager refreshed here
+// since keeping roles in line is syncRoles' job
+const ecalProvisionMerge = `MERGE INTO %SCHEMA%.User1 u
+	USING (SELECT LOWER(:1) AS useremail, LOWER(:2) AS manager,
+		(SELECT id FROM %SCHEMA%.RoleType WHERE rolename = :3) AS rolename FROM DUAL) s
+	ON (LOWER(u.useremail) = s.useremail)
+	WHEN MATCHED THEN UPDATE SET
+		u.manager = s.manager, u.lastupdatedate = SYSDATE, u.lastupdatedby = 'cto_bizlogic_helper'
+		WHERE DECODE(u.manager, s.manager, 0, 1) = 1
+	WHEN NOT MATCHED THEN INSERT (useremail, manager, rolename, creationdate, lastupdatedate, createdby, lastupdatedby)
+		VALUES (s.useremail, s.manager, s.rolename, SYSDATE, SYSDATE, 'cto_bizlogic_helper', 'cto_bizlogic_helper')`
+
+const stsProvisionMerge = `MERGE INTO %SCHEMA%.STSUser u
+	USING (SELECT LOWER(:1) AS useremail, LOWER(:2) AS manager,
+		(SELECT id FROM %SCHEMA%.STSRole WHERE rolename = :3) AS rolename, :4 AS firstname, :5 AS lastname FROM DUAL) s
+	ON (LOWER(u.useremail) = s.useremail)
+	WHEN MATCHED THEN UPDATE SET
+		u.manager = s.manager, u.firstname = s.firstname, u.lastname = s.lastname,
+		u.lastupdatedate = SYSDATE, u.lastupdatedby = 'cto_bizlogic_helper'
+		WHERE DECODE(u.manager, s.manager, 0, 1) = 1 OR DECODE(u.firstname, s.firstname, 0, 1) = 1
+			OR DECODE(u.lastname, s.lastname, 0, 1) = 1
+	WHEN NOT MATCHED THEN INSERT (useremail, manager, rolename, firstname, lastname, creationdate, lastupdatedate, createdby, lastupdatedby)
+		VALUES (s.useremail, s.manager, s.rolename, s.firstname, s.lastname, SYSDATE, SYSDATE, 'cto_bizlogic_helper', 'cto_bizlogic_helper')`
+
+//
+// Builds a provisionedUser from an identity feed record and the app mapping token of the org they belong to
+//
+func newProvisionedUser(person Employee, appMap string) provisionedUser {
+	firstName, lastName := splitFullName(person.EmployeeFullName)
+	numDirects, _ := strconv.Atoi(person.NumDirects)
+	return provisionedUser{
+		Email:      person.EmployeeEmailAddress,
+		FirstName:  firstName,
+		LastName:   lastName,
+		Manager:    person.Mgr,
+		NumDirects: numDirects,
+		MgrLevel:   person.MgrLevel,
+		AppMap:     appMap,
+	}
+}
+
+//
+// Upserts the provisioned users into the user table of every configured instance-env whose app (ECAL or STS) is
+// listed in the user's app mapping.  Only runs when ProvisionUsers is enabled in config.json; failures are logged
+// per schema so one broken environment doesn't stop the others.
+//
+func provisionUsers(users []provisionedUser) {
+	if !GlobalConfig.ProvisionUsers {
+		return
+	}
+
+	for instanceEnv, schema := range schemaMapSnapshot() {
+		count, err := provisionSchemaUsers(instanceEnv, schema, users)
+		if err != nil {
+			logOutput(logError, "user_provisioning", err.Error())
+			continue
+		}
+		message := fmt.Sprintf("Provisioned %d new or changed users into %s (%s)", count, instanceEnv, schema)
+		logOutput(logInfo, "user_provisioning", message)
+	}
+}
+
+//
+// Upserts the users mapped to an instance-env's app into its schema inside a single transaction
+//
+func provisionSchemaUsers(instanceEnv string, schema string, users []provisionedUser) (int64, error) {
+	app := "STS"
+	template := stsProvisionMerge
+	if strings.HasPrefix(instanceEnv, "ecal-") {
+		app = "ECAL"
+		template = ecalProvisionMerge
+	}
+
+	tx, err := DBPool.Begin()
+	if err != nil {
+		thisError := fmt.Sprintf("Error starting DB transaction (%s): %s", instanceEnv, err.Error())
+		return 0, errors.New(thisError)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(strings.ReplaceAll(template, "%SCHEMA%", schema))
+	if err != nil {
+		thisError := fmt.Sprintf("Error preparing provisioning statement (%s): %s", instanceEnv, err.Error())
+		return 0, errors.New(thisError)
+	}
+	defer stmt.Close()
+
+	var count int64
+	for _, user := range users {
+		if !userMappedToApp(user.AppMap, app) {
+			continue
+		}
+
+		role := deriveRole(user)
+		var args []interface{}
+		if app == "ECAL" {
+			args = []interface{}{user.Email, user.Manager, role}
+		} else {
+			args = []interface{}{user.Email, user.Manager, role, user.FirstName, user.LastName}
+		}
+		result, err := stmt.Exec(args...)
+		if err != nil {
+			thisError := fmt.Sprintf("Error provisioning user (%s, %s): %s", instanceEnv, user.Email, err.Error())
+			return 0, errors.New(thisError)
+		}
+		affected, _ := result.RowsAffected()
+		count += affected
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		thisError := fmt.Sprintf("Error committing provisioned users (%s): %s", instanceEnv, err.Error())
+		return 0, errors.New(thisError)
+	}
+	return count, nil
+}
+
+//
+// Returns true if an app mapping token (e.g. ECAL_STS) includes the given app
+//
+func userMappedToApp(appMap string, app string) bool {
+	for _, item := range strings.Split(appMap, "_") {
+		if item == app {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Splits a full name into first name and the remainder.  Single-word names are returned as the first name.
+//
+func splitFullName(fullName string) (string, string) {
+	nameSplit := strings.SplitN(strings.TrimSpace(fullName), " ", 2)
+	if len(nameSplit) < 2 {
+		return nameSplit[0], ""
+	}
+	return nameSplit[0], strings.TrimSpace(nameSplit[1])
+}
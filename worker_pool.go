@@ -0,0 +1,40 @@
+//  Worker Pool
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"sync"
+)
+
+//
+// Runs tasks concurrently, at most workers at a time, and waits for all of them to finish.  Returns the first
+// error reported by a task (in task order) or nil.
+//
+func runParallel(workers int, tasks ...func() error) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	errs := make([]error, len(tasks))
+	slots := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, task := range tasks {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, task func() error) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			errs[i] = task()
+		}(i, task)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+//  XLSX Writer
+//	CTO Business Logic Helpers
+//	Ed Shnekendorf, 2020, https://github.com/eshneken/cto-bizlogic-helper
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// the content type of an .xlsx file
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// Excel refuses sheet names longer than this
+const xlsxMaxSheetName = 31
+
+// xlsxWorkbook writes an Excel workbook straight to out a row at a time.  Strings are written inline rather than
+// through a shared string table so nothing but the sheet names has to be held until the end; sheets are written one
+// after the other, each finished when the next is started.  Only a bold header row and text, number and boolean cells
+// are supported, which is all the workbook export uses.
+type xlsxWorkbook struct {
+	archive *zip.Writer
+	sheet   io.Writer
+	sheets  []string
+	row     int
+}
+
+func newXLSXWorkbook(out io.Writer) *xlsxWorkbook {
+	return &xlsxWorkbook{archive: zip.NewWriter(out)}
+}
+
+//
+// Finishes the current sheet and starts a new one called name whose first row is header, in bold
+//
+func (wb *xlsxWorkbook) addSheet(name string, header ...string) error {
+	if len(name) < 1 || len(name) > xlsxMaxSheetName || strings.ContainsAny(name, `[]:*?/\`) {
+		thisError := fmt.Sprintf("Invalid sheet name (%s)", name)
+		return errors.New(thisError)
+	}
+	err := wb.endSheet()
+	if err != nil {
+		return err
+	}
+
+	wb.sheets = append(wb.sheets, name)
+	wb.sheet, err = wb.archive.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", len(wb.sheets)))
+	if err != nil {
+		return err
+	}
+	wb.row = 0
+	_, err = io.WriteString(wb.sheet, xml.Header+`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`+
+		`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`+
+		`<sheetData>`)
+	if err != nil {
+		return err
+	}
+
+	cells := make([]interface{}, len(header))
+	for i, title := range header {
+		cells[i] = title
+	}
+	return wb.writeCells(cells, ` s="1"`)
+}
+
+//
+// Writes a row of the current sheet.  Strings become text cells, dbNumbers and Go numbers number cells (an empty or
+// non-numeric dbNumber is left blank) and bools TRUE/FALSE.
+//
+func (wb *xlsxWorkbook) writeRow(values ...interface{}) error {
+	if wb.sheet == nil {
+		return errors.New("No sheet started")
+	}
+	return wb.writeCells(values, "")
+}
+
+func (wb *xlsxWorkbook) writeCells(values []interface{}, style string) error {
+	wb.row++
+	var row bytes.Buffer
+	fmt.Fprintf(&row, `<row r="%d">`, wb.row)
+	for i, value := range values {
+		ref := xlsxColumn(i) + strconv.Itoa(wb.row)
+		switch v := value.(type) {
+		case string:
+			if len(v) < 1 {
+				continue
+			}
+			fmt.Fprintf(&row, `<c r="%s" t="inlineStr"%s><is><t xml:space="preserve">`, ref, style)
+			xml.EscapeText(&row, []byte(v))
+			row.WriteString(`</t></is></c>`)
+		case dbNumber:
+			number := jsonNumber(string(v))
+			if number != "null" {
+				fmt.Fprintf(&row, `<c r="%s"%s><v>%s</v></c>`, ref, style, number)
+			}
+		case int:
+			fmt.Fprintf(&row, `<c r="%s"%s><v>%d</v></c>`, ref, style, v)
+		case float64:
+			fmt.Fprintf(&row, `<c r="%s"%s><v>%s</v></c>`, ref, style, strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			flag := 0
+			if v {
+				flag = 1
+			}
+			fmt.Fprintf(&row, `<c r="%s" t="b"%s><v>%d</v></c>`, ref, style, flag)
+		default:
+			thisError := fmt.Sprintf("Unsupported cell type %T in %s", value, ref)
+			return errors.New(thisError)
+		}
+	}
+	row.WriteString(`</row>`)
+	_, err := wb.sheet.Write(row.Bytes())
+	return err
+}
+
+func (wb *xlsxWorkbook) endSheet() error {
+	if wb.sheet == nil {
+		return nil
+	}
+	_, err := io.WriteString(wb.sheet, `</sheetData></worksheet>`)
+	wb.sheet = nil
+	return err
+}
+
+//
+// Finishes the last sheet and writes the parts that list the sheets, which completes the file
+//
+func (wb *xlsxWorkbook) close() error {
+	if len(wb.sheets) < 1 {
+		return errors.New("A workbook needs at least one sheet")
+	}
+	err := wb.endSheet()
+	if err != nil {
+		return err
+	}
+
+	var contentTypes, workbook, workbookRels strings.Builder
+	contentTypes.WriteString(xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+	workbook.WriteString(xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	workbookRels.WriteString(xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	for i, name := range wb.sheets {
+		fmt.Fprintf(&contentTypes, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i+1)
+		var escaped bytes.Buffer
+		xml.EscapeText(&escaped, []byte(name))
+		fmt.Fprintf(&workbook, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, escaped.String(), i+1, i+1)
+		fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, i+1, i+1)
+	}
+	contentTypes.WriteString(`</Types>`)
+	workbook.WriteString(`</sheets></workbook>`)
+	fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/></Relationships>`, len(wb.sheets)+1)
+
+	parts := []struct{ name, body string }{
+		{"[Content_Types].xml", contentTypes.String()},
+		{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", workbook.String()},
+		{"xl/_rels/workbook.xml.rels", workbookRels.String()},
+		// style 0 is the default and style 1 the bold header
+		{"xl/styles.xml", xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+			`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+			`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+			`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+			`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+			`<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>` +
+			`</styleSheet>`},
+	}
+	for _, part := range parts {
+		writer, err := wb.archive.Create(part.name)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(writer, part.body)
+		if err != nil {
+			return err
+		}
+	}
+	return wb.archive.Close()
+}
+
+//
+// Returns the letters of the zero-based column index, e.g. A for 0 and AA for 26
+//
+func xlsxColumn(index int) string {
+	name := ""
+	for index++; index > 0; index = (index - 1) / 26 {
+		name = string(rune('A'+(index-1)%26)) + name
+	}
+	return name
+}